@@ -0,0 +1,38 @@
+;; Benchmark: dotimes vs Tail Recursion
+;; Tests: summing 0..n-1 with an in-frame dotimes loop against a tail-recursive defun
+;; Compare the two by timing each mode separately:
+;;   bytecomp benchmarks/bench_dotimes.lisp -o bench_dotimes.bc
+;;   time lisp-vm bench_dotimes.bc dotimes
+;;   time lisp-vm bench_dotimes.bc recursive
+
+(print "=== Benchmark: dotimes vs Tail Recursion ===")
+(print "")
+
+;; Configuration - adjust these for different intensity levels
+(def ITERATIONS 1000000)
+
+;; Sum with dotimes: the counter is a local slot, the loop is a backward jump
+(defun sum-dotimes (n)
+  (let ((sum 0))
+    (do
+      (dotimes (i n)
+        (set! sum (+ sum i)))
+      sum)))
+
+;; Sum with a tail-recursive helper: each step is a tail call
+(defun sum-recursive-helper (i n sum)
+  (if (>= i n)
+      sum
+      (sum-recursive-helper (+ i 1) n (+ sum i))))
+
+(defun sum-recursive (n)
+  (sum-recursive-helper 0 n 0))
+
+(def mode (if (null? (get-args)) "dotimes" (car (get-args))))
+
+(if (string=? mode "recursive")
+    (print (string-append "Tail-recursive sum: " (number->string (sum-recursive ITERATIONS))))
+    (print (string-append "dotimes sum: " (number->string (sum-dotimes ITERATIONS)))))
+
+(print "")
+(print "=== dotimes Benchmark Complete ===")
@@ -0,0 +1,57 @@
+;; Benchmark: Hash Map vs Association List Lookup
+;; Tests: map-get against a linear alist search, 10k integer keys
+;; Compare the two by timing each mode separately:
+;;   bytecomp benchmarks/bench_hashmap.lisp -o bench_hashmap.bc
+;;   time lisp-vm bench_hashmap.bc map
+;;   time lisp-vm bench_hashmap.bc alist
+
+(print "=== Benchmark: Hash Map vs Alist Lookup ===")
+(print "")
+
+;; Configuration - adjust these for different intensity levels
+(def KEY_COUNT 10000)
+
+;; Build an alist ((0 0) (1 10) ...) of KEY_COUNT entries
+(defun make-alist (n)
+  (loop ((i 0) (acc '()))
+    (if (>= i n)
+        acc
+        (recur (+ i 1) (cons (list i (* i 10)) acc)))))
+
+;; Build a map {0 0 1 10 ...} of KEY_COUNT entries
+(defun make-table (n)
+  (let ((table {}))
+    (do (dotimes (i n) (map-set! table i (* i 10)))
+        table)))
+
+;; Linear search, as an assoc on an alist does
+(defun alist-get (alist key)
+  (if (null? alist)
+      false
+      (if (= (car (car alist)) key)
+          (car (cdr (car alist)))
+          (alist-get (cdr alist) key))))
+
+;; Look up every key once and sum the values
+(defun sum-alist (alist n)
+  (loop ((i 0) (sum 0))
+    (if (>= i n)
+        sum
+        (recur (+ i 1) (+ sum (alist-get alist i))))))
+
+(defun sum-table (table n)
+  (loop ((i 0) (sum 0))
+    (if (>= i n)
+        sum
+        (recur (+ i 1) (+ sum (map-get table i))))))
+
+(def mode (if (null? (get-args)) "map" (car (get-args))))
+
+(if (string=? mode "alist")
+    (let ((alist (make-alist KEY_COUNT)))
+      (print (string-append "Alist lookups, sum: " (number->string (sum-alist alist KEY_COUNT)))))
+    (let ((table (make-table KEY_COUNT)))
+      (print (string-append "Map lookups, sum: " (number->string (sum-table table KEY_COUNT))))))
+
+(print "")
+(print "=== Hash Map Benchmark Complete ===")
@@ -1,6 +1,7 @@
 ;; HTTP Server for Benchmarking with Keep-Alive Support
 ;; Equivalent to Python/Lua/Ruby versions
 ;; Handles 100000 requests then exits (enough for any benchmark run)
+;; Usage: lisp-vm benchmarks/network/http_server.lisp [port]
 
 ;; Handle a keep-alive connection (inner loop)
 ;; Returns count after processing all requests on this connection
@@ -30,4 +31,5 @@
               (let ((z (http-close stream)))
                 (recur new-count)))))))))
 
-(run-benchmark-server 8080 100000)
+(let ((args (get-args)))
+  (run-benchmark-server (if (null? args) 8080 (string->number (car args))) 100000))
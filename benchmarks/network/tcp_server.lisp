@@ -0,0 +1,37 @@
+;; HTTP Server for Benchmarking, hand-rolled on raw TCP sockets
+;; Equivalent to http_server.go: every request gets the same fixed response
+;; Handles 100000 requests then exits (enough for any benchmark run)
+;; Usage: lisp-vm benchmarks/network/tcp_server.lisp [port]
+
+(define response
+  "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 16\r\nConnection: close\r\n\r\nHello from Lisp!")
+
+;; Read until the blank line that ends the request headers.
+;; Returns nil if the client hangs up first.
+(defun read-request (conn)
+  (loop ((request ""))
+    (if (string-contains? request "\r\n\r\n")
+      request
+      (let ((chunk (socket-read conn 4096)))
+        (if (string? chunk)
+          (recur (string-append request chunk))
+          chunk)))))
+
+;; Answer one connection, closing it afterwards
+(defun handle-connection (conn)
+  (let ((request (read-request conn)))
+    (let ((sent (if (string? request) (socket-write conn response) 0)))
+      (let ((closed (socket-close conn)))
+        sent))))
+
+;; Accept connections one at a time until max-requests have been answered
+(defun run-tcp-server (port max-requests)
+  (let ((listener (tcp-listen port)))
+    (loop ((count 0))
+      (if (>= count max-requests)
+        count
+        (let ((sent (handle-connection (tcp-accept listener))))
+          (recur (if (> sent 0) (+ count 1) count)))))))
+
+(let ((args (get-args)))
+  (run-tcp-server (if (null? args) 8080 (string->number (car args))) 100000))
@@ -0,0 +1,346 @@
+#!/usr/bin/env python3
+"""
+Benchmark harness: runs every benchmark in benchmarks.json under each of its
+implementations and reports comparable numbers.
+
+Each benchmark is run W times to warm up, then N times measured. A run
+records its wall time, its maximum resident set size (of the process the
+command started, not of processes that one started) and how it ended. The
+report gives the median of each, and each implementation's median time as a
+ratio of the baseline implementation's. It is printed as a table and written
+as JSON.
+
+A benchmark marked "server" starts its command as a server, waits for the
+port to accept connections and then sends it `size` HTTP requests, one
+connection each. The time is how long those requests took, and the server
+is shut down after each run, whether it passed or failed.
+
+Usage:
+    python3 benchmarks/run_benchmarks.py [--filter REGEX] [--runs N] [--warmup W]
+                                         [--baseline IMPL] [--json PATH]
+                                         [--vm PATH] [--bytecomp PATH] [--list]
+
+Build the VM first with `cargo build --release`. The exit status is 1 when
+any benchmark crashed, failed its requests or timed out, so a regression
+fails the run. An implementation whose program isn't installed is skipped.
+
+benchmarks.json lists each benchmark's name, its implementations with the
+command for each (and an optional setup command run once before them), and
+optionally a list of input sizes. Commands run from the benchmarks directory
+and can use these placeholders:
+    {lisp_vm}   the lisp-vm binary        {bytecomp}  the bytecomp binary
+    {tmp}       a scratch directory       {size}      the input size
+    {port}      a free port, for servers
+"""
+
+import argparse
+import http.client
+import json
+import os
+import re
+import signal
+import socket
+import statistics
+import subprocess
+import sys
+import tempfile
+import time
+from datetime import datetime, timezone
+
+BENCH_DIR = os.path.dirname(os.path.abspath(__file__))
+REPO_DIR = os.path.dirname(BENCH_DIR)
+DEFINITIONS = os.path.join(BENCH_DIR, "benchmarks.json")
+
+SERVER_START_TIMEOUT = 30  # Seconds a server gets to start accepting connections
+SERVER_STOP_TIMEOUT = 5    # Seconds a server gets to exit once asked to
+REQUEST_TIMEOUT = 5        # Seconds any one request may take
+
+
+class BenchmarkFailure(Exception):
+    """A run that crashed, timed out or got a wrong response"""
+
+
+class Skipped(Exception):
+    """An implementation whose program isn't installed"""
+
+
+class Child:
+    """A benchmark process, reaped with wait4 so its resource usage is kept"""
+
+    def __init__(self, command, stderr):
+        try:
+            # A session of its own, so stopping it stops anything it started too
+            self.process = subprocess.Popen(command, cwd=BENCH_DIR, stdin=subprocess.DEVNULL,
+                                            stdout=subprocess.DEVNULL, stderr=stderr,
+                                            start_new_session=True)
+        except FileNotFoundError:
+            raise Skipped(f"{command[0]} not found")
+        self.status = None
+        self.max_rss_kb = None
+        self.peak_rss_kb = None  # High-water mark read from /proc while the process ran
+
+    def _sample_memory(self):
+        # On Linux ru_maxrss also counts the harness's own memory, which the child
+        # had between fork and exec, so the kernel's high-water mark is read instead
+        try:
+            with open(f"/proc/{self.process.pid}/status") as status:
+                for line in status:
+                    if line.startswith("VmHWM:"):
+                        self.peak_rss_kb = max(self.peak_rss_kb or 0, int(line.split()[1]))
+        except OSError:
+            pass
+
+    def _reaped(self, flags):
+        self._sample_memory()
+        pid, status, usage = os.wait4(self.process.pid, flags)
+        if pid == 0:
+            return False
+        self.status = status
+        self.process.returncode = os.waitstatus_to_exitcode(status)
+        if self.peak_rss_kb is not None:
+            self.max_rss_kb = self.peak_rss_kb
+        else:
+            # ru_maxrss is in kilobytes on Linux and in bytes on macOS
+            self.max_rss_kb = usage.ru_maxrss // 1024 if sys.platform == "darwin" else usage.ru_maxrss
+        return True
+
+    def running(self):
+        return self.status is None and not self._reaped(os.WNOHANG)
+
+    def wait(self, timeout):
+        deadline = time.monotonic() + timeout
+        while self.running():
+            if time.monotonic() > deadline:
+                return False
+            time.sleep(0.002)
+        return True
+
+    def stop(self):
+        """Stop the process if it's still running; True when it had to be stopped"""
+        if not self.running():
+            return False
+        for sig in (signal.SIGTERM, signal.SIGKILL):
+            try:
+                os.killpg(self.process.pid, sig)
+            except ProcessLookupError:
+                pass
+            if self.wait(SERVER_STOP_TIMEOUT):
+                break
+        return True
+
+    def exit_status(self):
+        """The exit code, or the name of the signal that ended the process"""
+        if os.WIFSIGNALED(self.status):
+            return signal.Signals(os.WTERMSIG(self.status)).name
+        return os.WEXITSTATUS(self.status)
+
+
+def free_port():
+    with socket.socket() as s:
+        s.bind(("127.0.0.1", 0))
+        return s.getsockname()[1]
+
+
+def wait_for_port(port, server):
+    deadline = time.monotonic() + SERVER_START_TIMEOUT
+    while time.monotonic() < deadline:
+        if not server.running():
+            raise BenchmarkFailure(f"server exited with status {server.exit_status()} before accepting connections")
+        try:
+            socket.create_connection(("127.0.0.1", port), timeout=1).close()
+            return
+        except OSError:
+            time.sleep(0.05)
+    raise BenchmarkFailure(f"server didn't accept connections within {SERVER_START_TIMEOUT}s")
+
+
+def drive_requests(port, count):
+    for i in range(count):
+        try:
+            conn = http.client.HTTPConnection("127.0.0.1", port, timeout=REQUEST_TIMEOUT)
+            conn.request("GET", "/", headers={"Connection": "close"})
+            response = conn.getresponse()
+            response.read()
+            conn.close()
+        except (OSError, http.client.HTTPException) as e:
+            raise BenchmarkFailure(f"request {i + 1} of {count} failed: {e}")
+        if response.status != 200:
+            raise BenchmarkFailure(f"request {i + 1} of {count} got status {response.status}")
+
+
+def stderr_tail(stderr):
+    stderr.seek(0)
+    lines = stderr.read().decode(errors="replace").strip().splitlines()
+    return "; ".join(lines[-3:])
+
+
+def run_once(command, benchmark, size, port, timeout):
+    """Run the command once, as a program or as a server, returning its measurements"""
+    with tempfile.TemporaryFile() as stderr:
+        child = Child(command, stderr)
+        try:
+            if benchmark.get("server"):
+                wait_for_port(port, child)
+                start = time.perf_counter()
+                drive_requests(port, size)
+                wall = time.perf_counter() - start
+                if not child.running() and child.exit_status() != 0:
+                    raise BenchmarkFailure(f"server exited with status {child.exit_status()}")
+            else:
+                start = time.perf_counter()
+                if not child.wait(timeout):
+                    raise BenchmarkFailure(f"timed out after {timeout}s")
+                wall = time.perf_counter() - start
+                if child.exit_status() != 0:
+                    raise BenchmarkFailure(f"exited with status {child.exit_status()}")
+        except BenchmarkFailure as failure:
+            child.stop()
+            output = stderr_tail(stderr)
+            raise BenchmarkFailure(f"{failure}: {output}" if output else str(failure))
+        finally:
+            child.stop()
+    # A server stopped by the harness ended as it should have
+    return {"wall_seconds": wall, "max_rss_kb": child.max_rss_kb, "exit_status": child.exit_status()}
+
+
+def expand(command, placeholders):
+    return [part.format(**placeholders) for part in command]
+
+
+def run_case(benchmark, implementation, spec, size, args, tmp):
+    """Every run of one implementation at one size, as the report's entry for it"""
+    entry = {"benchmark": benchmark["name"], "implementation": implementation, "size": size,
+             "status": "ok", "runs": []}
+    placeholders = {"lisp_vm": args.vm, "bytecomp": args.bytecomp, "tmp": tmp, "size": size, "port": "{port}"}
+    try:
+        if "setup" in spec:
+            setup = expand(spec["setup"], placeholders)
+            try:
+                done = subprocess.run(setup, cwd=BENCH_DIR, capture_output=True, timeout=args.timeout)
+            except FileNotFoundError:
+                raise Skipped(f"{setup[0]} not found")
+            if done.returncode != 0:
+                output = done.stderr.decode(errors="replace").strip().splitlines()
+                raise BenchmarkFailure(f"setup exited with status {done.returncode}: {'; '.join(output[-3:])}")
+        for run in range(args.warmup + args.runs):
+            port = free_port()
+            command = [part.replace("{port}", str(port)) for part in expand(spec["command"], placeholders)]
+            entry["command"] = command
+            measured = run_once(command, benchmark, size, port, args.timeout)
+            if run >= args.warmup:
+                entry["runs"].append(measured)
+    except Skipped as skipped:
+        entry.update(status="skipped", error=str(skipped))
+    except BenchmarkFailure as failure:
+        entry.update(status="failed", error=str(failure))
+    if entry["runs"]:
+        entry["median_seconds"] = statistics.median(run["wall_seconds"] for run in entry["runs"])
+        rss = [run["max_rss_kb"] for run in entry["runs"] if run["max_rss_kb"] is not None]
+        entry["median_max_rss_kb"] = statistics.median(rss) if rss else None
+    return entry
+
+
+def add_ratios(entries, baseline):
+    """Each entry's median time over its benchmark's baseline at the same size"""
+    cases = {}
+    for entry in entries:
+        cases.setdefault((entry["benchmark"], entry["size"]), []).append(entry)
+    for case in cases.values():
+        base = next((e for e in case if e["implementation"] == baseline), case[0])
+        for entry in case:
+            entry["baseline"] = base["implementation"]
+            if entry.get("median_seconds") is not None and base.get("median_seconds"):
+                entry["ratio"] = entry["median_seconds"] / base["median_seconds"]
+
+
+def print_table(entries):
+    headers = ["benchmark", "size", "implementation", "median", "max rss", "ratio", "status"]
+    rows = []
+    for e in entries:
+        median = e.get("median_seconds")
+        rss = e.get("median_max_rss_kb")
+        ratio = e.get("ratio")
+        status = e["status"] if e["status"] == "ok" else f"{e['status']}: {e['error']}"
+        rows.append([
+            e["benchmark"],
+            "" if e["size"] is None else str(e["size"]),
+            e["implementation"],
+            "" if median is None else f"{median:.3f}s",
+            "" if rss is None else f"{rss / 1024:.1f}MB",
+            "" if ratio is None else f"{ratio:.2f}x",
+            status,
+        ])
+    # The status column isn't padded: errors can be long
+    widths = [max(len(row[i]) for row in rows + [headers]) for i in range(len(headers) - 1)]
+    for row in [headers] + rows:
+        cells = [cell.ljust(width) for cell, width in zip(row, widths)]
+        print("  ".join(cells + [row[-1]]).rstrip())
+
+
+def load_benchmarks(filters):
+    with open(DEFINITIONS) as f:
+        benchmarks = json.load(f)["benchmarks"]
+    patterns = [re.compile(f) for f in filters]
+    return [b for b in benchmarks if not patterns or any(p.search(b["name"]) for p in patterns)]
+
+
+def main():
+    parser = argparse.ArgumentParser(description="Run the benchmark suite and report comparable numbers.")
+    parser.add_argument("--filter", action="append", default=[], metavar="REGEX",
+                        help="run only benchmarks whose name matches (may be given more than once)")
+    parser.add_argument("--runs", type=int, default=5, help="measured runs of each (default 5)")
+    parser.add_argument("--warmup", type=int, default=1, help="unmeasured runs before them (default 1)")
+    parser.add_argument("--baseline", default="lisp",
+                        help="implementation the ratios are relative to (default lisp; "
+                             "a benchmark without it uses its first)")
+    parser.add_argument("--json", default="benchmark-results.json", metavar="PATH",
+                        help="where to write the JSON report (default benchmark-results.json)")
+    parser.add_argument("--vm", default=os.path.join(REPO_DIR, "target", "release", "lisp-vm"),
+                        help="lisp-vm binary (default target/release/lisp-vm)")
+    parser.add_argument("--bytecomp", default=os.path.join(REPO_DIR, "target", "release", "bytecomp"),
+                        help="bytecomp binary (default target/release/bytecomp)")
+    parser.add_argument("--timeout", type=float, default=600, help="seconds a run may take (default 600)")
+    parser.add_argument("--list", action="store_true", help="list the benchmarks selected and exit")
+    args = parser.parse_args()
+    if args.runs < 1 or args.warmup < 0:
+        parser.error("--runs must be at least 1 and --warmup at least 0")
+    args.vm = os.path.abspath(args.vm)
+    args.bytecomp = os.path.abspath(args.bytecomp)
+
+    benchmarks = load_benchmarks(args.filter)
+    if not benchmarks:
+        parser.error("no benchmark matches the filter")
+    if args.list:
+        for b in benchmarks:
+            print(f"{b['name']}: {', '.join(b['implementations'])}")
+        return 0
+    if not os.path.exists(args.vm):
+        parser.error(f"{args.vm} doesn't exist; build it with cargo build --release or pass --vm")
+
+    entries = []
+    with tempfile.TemporaryDirectory(prefix="lisp-bench-") as tmp:
+        for benchmark in benchmarks:
+            for size in benchmark.get("sizes", [None]):
+                for implementation, spec in benchmark["implementations"].items():
+                    print(f"{benchmark['name']} [{implementation}]" + ("" if size is None else f" size {size}"),
+                          file=sys.stderr, flush=True)
+                    entries.append(run_case(benchmark, implementation, spec, size, args, tmp))
+    add_ratios(entries, args.baseline)
+
+    report = {
+        "generated": datetime.now(timezone.utc).isoformat(timespec="seconds"),
+        "runs": args.runs,
+        "warmup": args.warmup,
+        "baseline": args.baseline,
+        "results": entries,
+    }
+    with open(args.json, "w") as f:
+        json.dump(report, f, indent=2)
+        f.write("\n")
+    print_table(entries)
+    print(f"\nReport written to {args.json}")
+    return 1 if any(e["status"] == "failed" for e in entries) else 0
+
+
+if __name__ == "__main__":
+    sys.exit(main())
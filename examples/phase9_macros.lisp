@@ -4,23 +4,23 @@
 (defmacro unless (cond body)
   `(if ,cond false ,body))
 
-(defmacro and (a b)
+(defmacro my-and (a b)
   `(if ,a ,b false))
 
-(defmacro or (a b)
+(defmacro my-or (a b)
   `(if ,a true ,b))
 
 (print (when (> 10 5) (+ 1 2)))
 
 (print (unless (< 10 5) (+ 3 4)))
 
-(print (and true (> 5 3)))
+(print (my-and true (> 5 3)))
 
-(print (and false (> 5 3)))
+(print (my-and false (> 5 3)))
 
-(print (or true (> 5 3)))
+(print (my-or true (> 5 3)))
 
-(print (or false (> 5 3)))
+(print (my-or false (> 5 3)))
 
 (defun test-when (x)
   (when (> x 5) (print "big")))
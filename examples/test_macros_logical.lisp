@@ -1,25 +1,25 @@
-(defmacro and (a b)
+(defmacro my-and (a b)
   `(if ,a ,b false))
 
-(defmacro or (a b)
+(defmacro my-or (a b)
   `(if ,a true ,b))
 
 (defmacro not (x)
   `(if ,x false true))
 
-(print (and true true))
-(print (and true false))
-(print (and false true))
-(print (and false false))
+(print (my-and true true))
+(print (my-and true false))
+(print (my-and false true))
+(print (my-and false false))
 
-(print (or true true))
-(print (or true false))
-(print (or false true))
-(print (or false false))
+(print (my-or true true))
+(print (my-or true false))
+(print (my-or false true))
+(print (my-or false false))
 
 (print (not true))
 (print (not false))
 
-(print (and (> 5 3) (< 2 4)))
-(print (or (> 5 10) (< 2 4)))
+(print (my-and (> 5 3) (< 2 4)))
+(print (my-or (> 5 10) (< 2 4)))
 (print (not (> 5 10)))
@@ -1,4 +1,5 @@
-use lisp_bytecode_vm::{Compiler, bytecode, parser::Parser, optimizer::Optimizer};
+use lisp_bytecode_vm::{Compiler, bytecode, parser::Parser, optimizer::Optimizer, prelude};
+use lisp_bytecode_vm::vm::source_map::SourceMaps;
 use std::env;
 use std::fs;
 
@@ -71,32 +72,16 @@ fn main() {
     // Compile to bytecode
     let mut compiler = Compiler::new();
 
-    // Auto-load stdlib.lisp if it exists
-    let stdlib_paths = vec![
-        "stdlib.lisp".to_string(),
-        format!("{}/stdlib.lisp", env::current_dir().unwrap().display()),
-        format!("{}/../../stdlib.lisp", env::current_exe().unwrap().parent().unwrap().display()),
-    ];
-
-    for stdlib_path in stdlib_paths {
-        if let Ok(stdlib_source) = fs::read_to_string(&stdlib_path) {
-            let mut stdlib_parser = Parser::new_with_file(&stdlib_source, stdlib_path.clone());
-            if let Ok(stdlib_exprs) = stdlib_parser.parse_all() {
-                // Compile stdlib (ignore main bytecode, just get functions and macros)
-                if let Ok((_stdlib_functions, _)) = compiler.compile_program(&stdlib_exprs) {
-                    // Functions and macros are already in the compiler
-                    // Clear the main bytecode so it doesn't interfere with user program
-                    compiler.clear_main_bytecode();
-                    break;
-                }
-            }
-        }
+    // The prelude's functions are compiled in with the program's
+    if let Err(e) = prelude::compile(&mut compiler) {
+        eprintln!("{}", e);
+        std::process::exit(1);
     }
 
     let (mut functions, mut main_bytecode) = match compiler.compile_program(&exprs) {
         Ok((f, m)) => (f, m),
         Err(compile_error) => {
-            eprintln!("{}", compile_error.format(Some(&source)));
+            eprintln!("{}", compile_error.format(Some(compiler.source_for(&compile_error, &source))));
             std::process::exit(1);
         }
     };
@@ -126,8 +111,10 @@ fn main() {
         println!();
     }
 
-    // Save bytecode to file
-    if let Err(e) = bytecode::save_bytecode_file(&output_file, &functions, &main_bytecode) {
+    // Save bytecode to file. Optimization moves instructions around, so source
+    // maps (used for runtime error locations) are only kept for unoptimized output
+    let source_maps = if optimize { SourceMaps::new() } else { compiler.source_maps() };
+    if let Err(e) = bytecode::save_bytecode_file_with_source_maps(&output_file, &functions, &main_bytecode, &source_maps) {
         eprintln!("Error writing bytecode file: {}", e);
         std::process::exit(1);
     }
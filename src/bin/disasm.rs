@@ -1,5 +1,7 @@
-use lisp_bytecode_vm::{bytecode, disassembler};
+use lisp_bytecode_vm::{bytecode, disassembler, Compiler, Instruction, parser::Parser};
+use std::collections::HashMap;
 use std::env;
+use std::fs;
 
 fn main() {
     let args: Vec<String> = env::args().collect();
@@ -7,26 +9,78 @@ fn main() {
     if args.len() < 2 {
         eprintln!("Lisp Bytecode Disassembler");
         eprintln!();
-        eprintln!("Usage: {} <bytecode-file>", args[0]);
+        eprintln!("Usage: {} <bytecode-file | source-file.lisp> [function-name]", args[0]);
         eprintln!();
         eprintln!("Examples:");
         eprintln!("  {} program.bc", args[0]);
         eprintln!("  {} factorial.lisp.bc", args[0]);
+        eprintln!("  {} factorial.lisp", args[0]);
+        eprintln!("  {} factorial.lisp factorial", args[0]);
         std::process::exit(1);
     }
 
-    let bytecode_file = &args[1];
+    let input_file = &args[1];
 
-    // Load bytecode from file
-    let (functions, main_bytecode) = match bytecode::load_bytecode_file(bytecode_file) {
-        Ok((f, m)) => (f, m),
-        Err(e) => {
-            eprintln!("Error loading bytecode file '{}': {}", bytecode_file, e);
-            std::process::exit(1);
+    // Source files are compiled on the fly, anything else is loaded as bytecode.
+    // Only compiled source knows parameter names
+    let (functions, main_bytecode, param_names) = if input_file.ends_with(".lisp") {
+        compile_source_file(input_file)
+    } else {
+        match bytecode::load_bytecode_file(input_file) {
+            Ok((f, m)) => (f, m, HashMap::new()),
+            Err(e) => {
+                eprintln!("Error loading bytecode file '{}': {}", input_file, e);
+                std::process::exit(1);
+            }
         }
     };
 
+    // Disassemble a single function if one was requested
+    if let Some(function_name) = args.get(2) {
+        match functions.get(function_name) {
+            Some(code) => {
+                let params = param_names.get(function_name).map(Vec::as_slice).unwrap_or(&[]);
+                print!("{}", disassembler::disassemble_function_with_params(function_name, code, params))
+            }
+            None => {
+                eprintln!("Error: function '{}' not found in '{}'", function_name, input_file);
+                std::process::exit(1);
+            }
+        }
+        return;
+    }
+
     // Disassemble and print
-    let disassembly = disassembler::disassemble_bytecode(&functions, &main_bytecode);
+    let disassembly = disassembler::disassemble_bytecode_with_params(&functions, &main_bytecode, &param_names);
     print!("{}", disassembly);
 }
+
+type Program = (HashMap<String, Vec<Instruction>>, Vec<Instruction>, HashMap<String, Vec<String>>);
+
+fn compile_source_file(input_file: &str) -> Program {
+    let source = match fs::read_to_string(input_file) {
+        Ok(s) => s,
+        Err(e) => {
+            eprintln!("Error reading file '{}': {}", input_file, e);
+            std::process::exit(1);
+        }
+    };
+
+    let mut parser = Parser::new_with_file(&source, input_file.to_string());
+    let exprs = match parser.parse_all() {
+        Ok(e) => e,
+        Err(msg) => {
+            eprintln!("Parse error: {}", msg);
+            std::process::exit(1);
+        }
+    };
+
+    let mut compiler = Compiler::new();
+    match compiler.compile_program(&exprs) {
+        Ok((f, m)) => (f, m, compiler.function_params().clone()),
+        Err(compile_error) => {
+            eprintln!("{}", compile_error.format(Some(compiler.source_for(&compile_error, &source))));
+            std::process::exit(1);
+        }
+    }
+}
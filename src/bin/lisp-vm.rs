@@ -1,5 +1,13 @@
-use lisp_bytecode_vm::{VM, bytecode};
+use lisp_bytecode_vm::{VM, Compiler, Instruction, bytecode, disassembler, parser::Parser, prelude, repl::Repl, test_runner};
+use lisp_bytecode_vm::vm::value::format_float;
+use lisp_bytecode_vm::vm::source_map::{ProgramSlotNames, SourceMaps};
+use lisp_bytecode_vm::vm::debugger::Debugger;
+use lisp_bytecode_vm::vm::profiler::Profiler;
+use lisp_bytecode_vm::vm::tracer::CallTracer;
+use std::collections::HashMap;
 use std::env;
+use std::fs;
+use std::rc::Rc;
 
 fn main() {
     let args: Vec<String> = env::args().collect();
@@ -7,29 +15,166 @@ fn main() {
     if args.len() < 2 {
         eprintln!("Lisp Bytecode VM");
         eprintln!();
-        eprintln!("Usage: {} [--print-result] <bytecode-file>", args[0]);
+        eprintln!("Usage: {} [--print-result] [--debug] [--disasm] [--profile] [--profile-json FILE] [--trace-calls] [--trace=NAME,...] [--gc-threshold N] [--max-depth N] [--max-stack N] [--max-instructions N] [--no-prelude] [--test] [--warnings-as-errors] <bytecode-file | source.lisp> [--] [ARGS...]", args[0]);
+        eprintln!("       {} compile [--no-prelude] <source.lisp> [-o <output.bc>]", args[0]);
+        eprintln!("       {} run [OPTIONS] <bytecode-file>", args[0]);
+        eprintln!("       {} repl", args[0]);
+        eprintln!();
+        eprintln!("Commands:");
+        eprintln!("  compile           Compile a source file to bytecode (default output: <source>.bc)");
+        eprintln!("  run               Run a bytecode file, without parsing or compiling anything");
+        eprintln!("  repl              Start an interactive session (same as the 'repl' binary)");
         eprintln!();
         eprintln!("Options:");
         eprintln!("  --print-result    Print the final value on the stack");
+        eprintln!("  --debug           Pause before each instruction in the stepping debugger");
+        eprintln!("  --disasm          Print the compiled program's bytecode instead of running it");
+        eprintln!("  --profile         Print per-function and per-opcode counts and times on exit");
+        eprintln!("  --profile-json F  Profile the run and write the results to F as JSON");
+        eprintln!("  --trace-calls     Log each call with its arguments and each return to stderr");
+        eprintln!("  --trace=F,G       Print each call of the functions F and G and what it returns, as (trace F) does");
+        eprintln!("  --gc-threshold N  Collect garbage after every N allocations (default: $LISP_VM_GC_THRESHOLD or 100000)");
+        eprintln!("  --max-depth N     Fail a call nested deeper than N calls with a stack depth error (default: 10000)");
+        eprintln!("  --max-stack N     Fail a call made with more than N values on the value stack (default: 1000000)");
+        eprintln!("  --max-instructions N  Fail, catchably, once the program has executed N instructions");
+        eprintln!("  --no-prelude      Don't compile and run the built-in prelude (stdlib.lisp) first");
+        eprintln!("  --test            Run the file, then every deftest in it, and report which failed");
+        eprintln!("  --warnings-as-errors  Fail instead of running when compiling reports warnings");
+        eprintln!("  --                Stop reading options: the rest are the program's (command-line-args)");
         eprintln!();
         eprintln!("Examples:");
         eprintln!("  {} program.bc", args[0]);
         eprintln!("  {} --print-result program.bc", args[0]);
+        eprintln!("  {} --debug program.lisp", args[0]);
+        eprintln!("  {} --disasm program.lisp", args[0]);
+        eprintln!("  {} --profile program.lisp", args[0]);
+        eprintln!("  {} --test tests.lisp", args[0]);
+        eprintln!("  {} script.lisp -- --disasm input.txt", args[0]);
+        eprintln!("  {} compile program.lisp -o program.bc", args[0]);
+        eprintln!("  {} run program.bc", args[0]);
         eprintln!();
-        eprintln!("Note: Compile Lisp source files using 'bytecomp' first");
+        eprintln!("Note: .lisp files are compiled in memory unless run through 'compile'");
         std::process::exit(1);
     }
 
+    if args[1] == "repl" {
+        Repl::new().run();
+        return;
+    }
+
+    if args[1] == "compile" {
+        if let Err(e) = compile_to_file(&args[2..]) {
+            eprintln!("{}", e);
+            std::process::exit(1);
+        }
+        return;
+    }
+
+    // With `run`, the file is always loaded as bytecode, even if it is named .lisp
+    let bytecode_only = args[1] == "run";
+
     // Parse flags
     let mut print_result = false;
+    let mut debug = false;
+    let mut disasm = false;
+    let mut profile = false;
+    let mut profile_json = None;
+    let mut trace_calls = false;
+    let mut traced: Vec<String> = Vec::new();
+    let mut gc_threshold = None;
+    let mut max_depth = None;
+    let mut max_stack = None;
+    let mut max_instructions = None;
+    let mut no_prelude = false;
+    let mut test = false;
+    let mut warnings_as_errors = false;
     let mut bytecode_file = "";
     let mut vm_args = Vec::new();
-    let mut i = 1;
+    let mut i = if bytecode_only { 2 } else { 1 };
 
     while i < args.len() {
-        if args[i] == "--print-result" {
+        if args[i] == "--" {
+            // Everything after is the program's, even what looks like an option;
+            // the file comes first if it wasn't given yet
+            i += 1;
+            if bytecode_file.is_empty() && i < args.len() {
+                bytecode_file = &args[i];
+                i += 1;
+            }
+            vm_args.extend_from_slice(&args[i..]);
+            break;
+        } else if args[i] == "--print-result" {
             print_result = true;
             i += 1;
+        } else if args[i] == "--debug" {
+            debug = true;
+            i += 1;
+        } else if args[i] == "--disasm" {
+            disasm = true;
+            i += 1;
+        } else if args[i] == "--profile" {
+            profile = true;
+            i += 1;
+        } else if let Some(names) = args[i].strip_prefix("--trace=") {
+            traced.extend(names.split(',').filter(|name| !name.is_empty()).map(String::from));
+            i += 1;
+        } else if args[i] == "--trace-calls" {
+            trace_calls = true;
+            i += 1;
+        } else if args[i] == "--no-prelude" {
+            no_prelude = true;
+            i += 1;
+        } else if args[i] == "--test" {
+            test = true;
+            i += 1;
+        } else if args[i] == "--warnings-as-errors" {
+            warnings_as_errors = true;
+            i += 1;
+        } else if args[i] == "--profile-json" {
+            match args.get(i + 1) {
+                Some(path) => profile_json = Some(path.clone()),
+                None => {
+                    eprintln!("Error: --profile-json expects a file to write");
+                    std::process::exit(1);
+                }
+            }
+            i += 2;
+        } else if args[i] == "--gc-threshold" {
+            match args.get(i + 1).and_then(|n| n.parse::<usize>().ok()) {
+                Some(n) => gc_threshold = Some(n),
+                None => {
+                    eprintln!("Error: --gc-threshold expects a number of allocations");
+                    std::process::exit(1);
+                }
+            }
+            i += 2;
+        } else if args[i] == "--max-depth" {
+            match args.get(i + 1).and_then(|n| n.parse::<usize>().ok()) {
+                Some(n) if n > 0 => max_depth = Some(n),
+                _ => {
+                    eprintln!("Error: --max-depth expects a positive number of calls");
+                    std::process::exit(1);
+                }
+            }
+            i += 2;
+        } else if args[i] == "--max-stack" {
+            match args.get(i + 1).and_then(|n| n.parse::<usize>().ok()) {
+                Some(n) if n > 0 => max_stack = Some(n),
+                _ => {
+                    eprintln!("Error: --max-stack expects a positive number of values");
+                    std::process::exit(1);
+                }
+            }
+            i += 2;
+        } else if args[i] == "--max-instructions" {
+            match args.get(i + 1).and_then(|n| n.parse::<u64>().ok()) {
+                Some(n) if n > 0 => max_instructions = Some(n),
+                _ => {
+                    eprintln!("Error: --max-instructions expects a positive number of instructions");
+                    std::process::exit(1);
+                }
+            }
+            i += 2;
         } else if bytecode_file.is_empty() {
             bytecode_file = &args[i];
             i += 1;
@@ -45,31 +190,149 @@ fn main() {
         std::process::exit(1);
     }
 
-    // Load bytecode from file
-    let (functions, main_bytecode) = match bytecode::load_bytecode_file(bytecode_file) {
-        Ok(b) => b,
-        Err(e) => {
-            eprintln!("Error loading bytecode: {}", e);
-            std::process::exit(1);
+    // Only compiled source knows which functions are deftests, and in what order
+    if test && (bytecode_only || !bytecode_file.ends_with(".lisp")) {
+        eprintln!("Error: --test expects a .lisp source file");
+        std::process::exit(1);
+    }
+
+    // Load bytecode from file, or compile a source file. Only compiled source
+    // knows parameter and let binding names, which the debugger uses to show locals
+    let ((functions, main_bytecode, source_maps, param_names, slot_names, tests), prelude_main) = if bytecode_file.ends_with(".lisp") && !bytecode_only {
+        match compile_source(bytecode_file, debug, warnings_as_errors, !no_prelude) {
+            Ok(program) => program,
+            Err(e) => {
+                eprintln!("{}", e);
+                std::process::exit(1);
+            }
+        }
+    } else {
+        match bytecode::load_bytecode_file_with_source_maps(bytecode_file) {
+            Ok((functions, main_bytecode, source_maps)) => {
+                let program = (functions, main_bytecode, source_maps, HashMap::new(), ProgramSlotNames::default(), Vec::new());
+                if no_prelude {
+                    (program, None)
+                } else {
+                    with_prelude(program)
+                }
+            }
+            Err(e) => {
+                eprintln!("Error loading bytecode: {}", e);
+                std::process::exit(1);
+            }
         }
     };
 
+    if disasm {
+        // List the program's own functions, not the prelude's
+        let program_functions: HashMap<String, Vec<Instruction>> = functions.into_iter()
+            .filter(|(name, _)| defined_in(&source_maps, name, bytecode_file))
+            .collect();
+        print!("{}", disassembler::disassemble_bytecode_with_params(&program_functions, &main_bytecode, &param_names));
+        return;
+    }
+
     // Execute bytecode on the VM
     let mut vm = VM::new();
     // Merge user-defined functions with builtins (don't overwrite builtins)
     for (name, bytecode) in functions {
         vm.functions.insert(name, bytecode);
     }
-    vm.current_bytecode = main_bytecode;
+    vm.current_bytecode = Rc::new(main_bytecode);
+    vm.source_maps = source_maps;
+    vm.current_file = Some(bytecode_file.to_string());
+    if let Some(threshold) = gc_threshold {
+        vm.heap.set_threshold(threshold);
+    }
+    if let Some(depth) = max_depth {
+        vm.max_call_depth = depth;
+    }
+    if let Some(values) = max_stack {
+        vm.max_value_stack = values;
+    }
+
+    // The prelude's top-level forms run first, outside the debugger and profiler
+    if let Some(prelude_main) = prelude_main {
+        if let Err(e) = prelude::run(&mut vm, prelude_main) {
+            eprintln!("{}", e);
+            std::process::exit(1);
+        }
+    }
+    // Counted from here, so the prelude doesn't use up the program's budget
+    vm.set_instruction_budget(max_instructions);
+
+    if debug {
+        let mut debugger = Debugger::new();
+        debugger.set_param_names(param_names);
+        debugger.set_slot_names(slot_names);
+        // The files the program was compiled from, to show the line paused on
+        let files: std::collections::HashSet<&str> = std::iter::once(&vm.source_maps.main)
+            .chain(vm.source_maps.functions.values())
+            .flat_map(|map| map.entries().iter().map(|(_, location)| location.file.as_str()))
+            .collect();
+        for file in files {
+            if let Ok(source) = fs::read_to_string(file) {
+                debugger.add_source(file.to_string(), source);
+            }
+        }
+        println!("Debugging {} (type 'help' for commands)", bytecode_file);
+        vm.debugger = Some(debugger);
+    }
+
+    if profile || profile_json.is_some() {
+        vm.profiler = Some(Profiler::new());
+    }
+    if trace_calls {
+        vm.call_tracer = Some(CallTracer::new());
+    }
+    for name in &traced {
+        if vm.trace_function(name).is_err() {
+            eprintln!("Error: --trace: no function named '{}'", name);
+            std::process::exit(1);
+        }
+    }
 
     // Pass command-line arguments to the VM
     vm.args = vm_args;
 
-    if let Err(runtime_error) = vm.run() {
+    let result = vm.run();
+
+    // The profile covers the run up to a runtime error as well
+    if let Some(profiler) = &vm.profiler {
+        if profile {
+            eprint!("{}", profiler.report());
+        }
+        if let Some(path) = &profile_json {
+            if let Err(e) = fs::write(path, profiler.to_json()) {
+                eprintln!("Error writing profile to '{}': {}", path, e);
+            }
+        }
+    }
+
+    if let Err(runtime_error) = result {
         eprintln!("{}", runtime_error.format());
         std::process::exit(1);
     }
 
+    // The program called exit. Drop the VM first, which closes the output ports
+    // it still holds, since process::exit runs no destructors
+    if let Some(code) = vm.exit_code {
+        drop(vm);
+        let _ = std::io::Write::flush(&mut std::io::stdout());
+        std::process::exit(code);
+    }
+
+    // With the program's definitions in place, run its tests; any failure fails the run
+    if test {
+        let tests: Vec<&str> = tests.iter().map(String::as_str).collect();
+        let report = test_runner::run_tests(&mut vm, &tests);
+        print!("{}", report.format());
+        if report.failed() > 0 {
+            std::process::exit(1);
+        }
+        return;
+    }
+
     // Print final result if requested
     if print_result {
         if let Some(value) = vm.value_stack.last() {
@@ -78,20 +341,94 @@ fn main() {
     }
 }
 
+type Program = (HashMap<String, Vec<Instruction>>, Vec<Instruction>, SourceMaps, HashMap<String, Vec<String>>, ProgramSlotNames, Vec<String>);
+
+/// Compile a source file, with the let binding names the debugger shows when `debug` is set.
+/// Warnings are printed, and fail the compile when `warnings_as_errors` is set. With
+/// `prelude`, the prelude is compiled first and its top-level code is returned as well
+fn compile_source(path: &str, debug: bool, warnings_as_errors: bool, prelude: bool) -> Result<(Program, Option<Vec<Instruction>>), String> {
+    let source = fs::read_to_string(path).map_err(|e| format!("Error reading file '{}': {}", path, e))?;
+    let mut parser = Parser::new_with_file(&source, path.to_string());
+    let exprs = parser.parse_all().map_err(|msg| format!("Parse error: {}", msg))?;
+
+    let mut compiler = Compiler::new();
+    let prelude_main = if prelude {
+        Some(prelude::compile(&mut compiler)?.1)
+    } else {
+        None
+    };
+
+    compiler.set_record_slot_names(debug);
+    let (functions, main_bytecode) = compiler.compile_program(&exprs)
+        .map_err(|compile_error| compile_error.format(Some(compiler.source_for(&compile_error, &source))))?;
+    for warning in compiler.warnings() {
+        eprint!("{}", warning.format(Some(compiler.source_at(&warning.location, &source))));
+    }
+    if warnings_as_errors && !compiler.warnings().is_empty() {
+        let count = compiler.warnings().len();
+        return Err(format!("Error: {} warning{} treated as errors", count, if count == 1 { "" } else { "s" }));
+    }
+    let tests = compiler.tests().into_iter().map(String::from).collect();
+    let program = (functions, main_bytecode, compiler.source_maps(), compiler.function_params().clone(), compiler.slot_names(), tests);
+    Ok((program, prelude_main))
+}
+
+/// A program loaded from bytecode, with the prelude's functions under its own
+/// and the prelude's top-level code to run first
+fn with_prelude(program: Program) -> (Program, Option<Vec<Instruction>>) {
+    let (functions, main_bytecode, mut source_maps, param_names, slot_names, tests) = program;
+    let mut compiler = Compiler::new();
+    let (mut all_functions, prelude_main) = match prelude::compile(&mut compiler) {
+        Ok(prelude) => prelude,
+        Err(e) => {
+            eprintln!("{}", e);
+            std::process::exit(1);
+        }
+    };
+    all_functions.extend(functions);
+    let mut locations = compiler.source_maps().functions;
+    locations.extend(source_maps.functions);
+    source_maps.functions = locations;
+    ((all_functions, main_bytecode, source_maps, param_names, slot_names, tests), Some(prelude_main))
+}
+
+/// `compile [--no-prelude] <source.lisp> [-o <output.bc>]`: save the compiled
+/// program, with its source maps, so it can be run later without the compiler
+fn compile_to_file(args: &[String]) -> Result<(), String> {
+    let no_prelude = args.iter().any(|arg| arg == "--no-prelude");
+    let args: Vec<String> = args.iter().filter(|arg| *arg != "--no-prelude").cloned().collect();
+    let (input_file, output_file) = match args.as_slice() {
+        [input] => (input, format!("{}.bc", input.trim_end_matches(".lisp"))),
+        [input, flag, output] if flag == "-o" => (input, output.clone()),
+        _ => return Err("Usage: lisp-vm compile [--no-prelude] <source.lisp> [-o <output.bc>]".to_string()),
+    };
+
+    // The prelude's functions are saved with the program; `run` loads the prelude again for its top-level code
+    let ((functions, main_bytecode, source_maps, _, _, _), _) = compile_source(input_file, false, false, !no_prelude)?;
+    bytecode::save_bytecode_file_with_source_maps(&output_file, &functions, &main_bytecode, &source_maps)
+        .map_err(|e| format!("Error writing bytecode file: {}", e))?;
+    println!("Compiled {} -> {}", input_file, output_file);
+    Ok(())
+}
+
+/// Whether a function's code comes from `path`. Functions without source
+/// positions (loaded from bytecode) are always included
+fn defined_in(source_maps: &SourceMaps, function: &str, path: &str) -> bool {
+    match source_maps.functions.get(function).and_then(|map| map.entries().first()) {
+        Some((_, location)) => location.file == path,
+        None => true,
+    }
+}
+
 fn format_value(value: &lisp_bytecode_vm::Value) -> String {
     use lisp_bytecode_vm::Value;
     match value {
         Value::Integer(n) => n.to_string(),
-        Value::Float(f) => {
-            // Always show at least one decimal place for whole numbers
-            if f.fract() == 0.0 && !f.is_nan() && !f.is_infinite() {
-                format!("{:.1}", f)
-            } else {
-                f.to_string()
-            }
-        }
+        Value::BigInt(n) => n.to_string(),
+        Value::Float(f) => format_float(*f),
         Value::Boolean(b) => b.to_string(),
         Value::String(s) => s.to_string(),
+        Value::Char(c) => c.to_string(),
         Value::Symbol(s) => s.to_string(),
         Value::List(items) => {
             let formatted: Vec<String> = items.iter().map(|v| format_value(v)).collect();
@@ -107,12 +444,22 @@ fn format_value(value: &lisp_bytecode_vm::Value) -> String {
         }
         Value::HashMap(_) => "#<hashmap>".to_string(),
         Value::Vector(items) => {
-            let formatted: Vec<String> = items.iter().map(|v| format_value(v)).collect();
-            format!("[{}]", formatted.join(" "))
+            let formatted: Vec<String> = items.borrow().iter().map(|v| format_value(v)).collect();
+            format!("#({})", formatted.join(" "))
         }
         Value::TcpListener(_) => "#<tcp-listener>".to_string(),
         Value::TcpStream(_) => "#<tcp-stream>".to_string(),
         Value::SharedTcpListener(_) => "#<shared-tcp-listener>".to_string(),
         Value::Pointer(p) => format!("#<pointer 0x{:x}>", p),
+        Value::Cell(_) => "#<cell>".to_string(),
+        Value::Struct(data) => {
+            let mut parts = vec![data.name.to_string()];
+            parts.extend(data.fields.iter().map(format_value));
+            format!("#<{}>", parts.join(" "))
+        }
+        Value::Port(port) => format!("#<{}-port>", port.borrow().kind()),
+        Value::Promise(_) => "#<promise>".to_string(),
+        Value::Task(task) => format!("#<task {}>", task.borrow().id),
+        Value::Channel(_) => "#<channel>".to_string(),
     }
 }
@@ -1,10 +1,13 @@
-use crate::vm::errors::Location;
+use crate::vm::errors::{CompileError, Location};
+use crate::vm::value::{format_char, format_float, List, Value};
+use crate::vm::VM;
 
 #[derive(Debug, Clone, PartialEq)]
 pub enum LispExpr {
     Number(i64),
     Float(f64),
     Boolean(bool),
+    Char(char),
     Symbol(String),
     List(Vec<SourceExpr>),
     DottedList(Vec<SourceExpr>, Box<SourceExpr>), // (a b . rest) - for cons patterns
@@ -28,6 +31,116 @@ impl SourceExpr {
             location: Location::unknown(),
         }
     }
+
+    /// The expression as data, as quote gives it: symbols become Symbol values
+    /// and lists become lists. Fails on a dotted list whose rest isn't a list.
+    pub fn to_value(&self) -> Result<Value, CompileError> {
+        match &self.expr {
+            LispExpr::Number(n) => Ok(Value::Integer(*n)),
+            LispExpr::Float(f) => Ok(Value::Float(*f)),
+            LispExpr::Boolean(b) => Ok(Value::Boolean(*b)),
+            LispExpr::Char(c) => Ok(Value::Char(*c)),
+            LispExpr::Symbol(s) => match s.strip_prefix("__STRING__") {
+                // Quoted strings stay strings, so '("a" b) reads back what write printed
+                Some(text) => Ok(Value::string(text)),
+                None => Ok(Value::symbol(s.as_str())),
+            },
+            LispExpr::List(items) => {
+                let mut values = Vec::new();
+                for item in items {
+                    values.push(item.to_value()?);
+                }
+                Ok(Value::List(List::from_vec(values)))
+            }
+            LispExpr::DottedList(items, rest) => {
+                // '(a b . rest) - cons a and b onto rest, which must be a list
+                match rest.to_value()? {
+                    Value::List(rest_list) => {
+                        let mut result = rest_list;
+                        for item in items.iter().rev() {
+                            result = List::cons(item.to_value()?, result);
+                        }
+                        Ok(Value::List(result))
+                    }
+                    _ => Err(CompileError::new(
+                        "Rest of dotted list must be a list".to_string(),
+                        rest.location.clone(),
+                    )),
+                }
+            }
+        }
+    }
+
+    /// The data as an expression, the inverse of to_value: strings become string
+    /// literals and named functions their names. Every form is placed at
+    /// `location`. Fails on values no source can write, like closures or bignums.
+    pub fn from_value(value: &Value, location: &Location) -> Result<SourceExpr, CompileError> {
+        let expr = match value {
+            Value::Integer(n) => LispExpr::Number(*n),
+            Value::Float(f) => LispExpr::Float(*f),
+            Value::Boolean(b) => LispExpr::Boolean(*b),
+            Value::Char(c) => LispExpr::Char(*c),
+            Value::Symbol(s) => LispExpr::Symbol(s.to_string()),
+            // Strings are represented as special symbols in the AST
+            Value::String(s) => LispExpr::Symbol(format!("__STRING__{}", s)),
+            Value::Function(name) => LispExpr::Symbol(name.to_string()),
+            Value::List(items) => {
+                let mut exprs = Vec::new();
+                for item in items.iter() {
+                    exprs.push(SourceExpr::from_value(item, location)?);
+                }
+                LispExpr::List(exprs)
+            }
+            Value::BigInt(n) => {
+                return Err(CompileError::new(format!("Cannot convert bignum {} to an expression", n), location.clone()));
+            }
+            _ => {
+                return Err(CompileError::new(
+                    format!("Cannot convert {} to an expression", VM::type_name(value)),
+                    location.clone(),
+                ));
+            }
+        };
+        Ok(SourceExpr::new(expr, location.clone()))
+    }
+
+    /// The expression as it could be written in source, with quote shorthands
+    /// and string literals restored (spacing and comments are not kept)
+    pub fn to_source(&self) -> String {
+        match &self.expr {
+            LispExpr::Number(n) => n.to_string(),
+            LispExpr::Float(f) => format_float(*f),
+            LispExpr::Boolean(b) => b.to_string(),
+            LispExpr::Char(c) => format_char(*c),
+            LispExpr::Symbol(s) => match s.strip_prefix("__STRING__") {
+                Some(text) => format!("{:?}", text),
+                None => s.clone(),
+            },
+            LispExpr::List(items) => {
+                let shorthand = match items.as_slice() {
+                    [head, _] => match &head.expr {
+                        LispExpr::Symbol(s) if s == "quote" => Some("'"),
+                        LispExpr::Symbol(s) if s == "quasiquote" => Some("`"),
+                        LispExpr::Symbol(s) if s == "unquote" => Some(","),
+                        LispExpr::Symbol(s) if s == "unquote-splicing" => Some(",@"),
+                        _ => None,
+                    },
+                    _ => None,
+                };
+                match shorthand {
+                    Some(prefix) => format!("{}{}", prefix, items[1].to_source()),
+                    None => {
+                        let parts: Vec<String> = items.iter().map(SourceExpr::to_source).collect();
+                        format!("({})", parts.join(" "))
+                    }
+                }
+            }
+            LispExpr::DottedList(head, tail) => {
+                let parts: Vec<String> = head.iter().map(SourceExpr::to_source).collect();
+                format!("({} . {})", parts.join(" "), tail.to_source())
+            }
+        }
+    }
 }
 
 // Helper functions for creating AST nodes (used in tests)
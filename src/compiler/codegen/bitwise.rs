@@ -0,0 +1,57 @@
+// Bitwise builtins: (bit-and a b), (bit-or a b), (bit-xor a b), (bit-not a),
+// (shift-left a count) and (shift-right a count)
+//
+// Integers are treated as two's complement of unlimited width, bignums
+// included. When the operands are literals the call has already folded in
+// compile_located_expr, unless it is a shift by a negative count; that is
+// reported here, at the call, like an overflowing checked-add.
+
+use crate::vm::instructions::Instruction;
+use crate::vm::errors::CompileError;
+use crate::vm::value::Value;
+use crate::vm::VM;
+use super::Compiler;
+use super::super::ast::SourceExpr;
+
+impl Compiler {
+    pub(super) fn compile_bitwise_builtin(&mut self, expr: &SourceExpr, operator: &str, items: &[SourceExpr]) -> Result<(), CompileError> {
+        let (arity, usage) = match operator {
+            "bit-not" => (1, "a"),
+            "shift-left" | "shift-right" => (2, "a count"),
+            _ => (2, "a b"),
+        };
+        if items.len() != arity + 1 {
+            let plural = if arity == 1 { "" } else { "s" };
+            return Err(CompileError::new(
+                format!("{} expects exactly {} argument{}: ({} {})", operator, arity, plural, operator, usage),
+                expr.location.clone(),
+            ));
+        }
+        if arity == 2 {
+            if let (Some(a), Some(b)) = (self.fold_constant(&items[1]), self.fold_constant(&items[2])) {
+                let is_integer = |value: &Value| matches!(value, Value::Integer(_) | Value::BigInt(_));
+                if is_integer(&a) && is_integer(&b) {
+                    if let Err(err) = VM::bitwise_arith(operator, &a, Some(&b)) {
+                        return Err(CompileError::new(err.message, expr.location.clone()));
+                    }
+                }
+            }
+        }
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        for arg in &items[1..] {
+            self.compile_operand(arg)?;
+        }
+        self.stack_depth -= arity;
+        self.emit(match operator {
+            "bit-and" => Instruction::BitAnd,
+            "bit-or" => Instruction::BitOr,
+            "bit-xor" => Instruction::BitXor,
+            "bit-not" => Instruction::BitNot,
+            "shift-left" => Instruction::ShiftLeft,
+            _ => Instruction::ShiftRight,
+        });
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+}
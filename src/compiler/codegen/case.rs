@@ -0,0 +1,241 @@
+// Literal dispatch: (case key (1 ...) ((2 3) ...) (else ...))
+//
+// The key is evaluated once and compared against each clause's literal keys in
+// order. Integer keys that are dense enough are compiled to a single JumpTable
+// instruction instead, which indexes straight to the matching clause. Either way
+// keys compare the way = does, so 2.0 selects the clause for 2.
+
+use std::collections::HashSet;
+use std::sync::Arc;
+
+use crate::vm::value::{Value, List};
+use crate::vm::instructions::Instruction;
+use crate::vm::errors::CompileError;
+use super::Compiler;
+use super::super::ast::{LispExpr, SourceExpr};
+
+/// Fewest integer keys worth a jump table; smaller cases compare keys one by one
+const JUMP_TABLE_MIN_KEYS: usize = 4;
+
+/// A jump table may have at most this many entries per key, the rest go to the default
+const JUMP_TABLE_MAX_SPREAD: usize = 2;
+
+// A case clause: its keys, or None for the else clause, and its body
+type CaseClause<'a> = (Option<Vec<Value>>, &'a [SourceExpr]);
+
+// ==================== CASE ====================
+
+impl Compiler {
+    // Compile case expression: (case key (keys body...) ... (else body...))
+    // With no matching clause and no else, the case evaluates to nil.
+    pub(super) fn compile_case(&mut self, expr: &SourceExpr, items: &[SourceExpr]) -> Result<(), CompileError> {
+        if items.len() < 2 {
+            return Err(CompileError::new(
+                "case expects a key and clauses: (case key (keys body...) ... (else body...))".to_string(),
+                expr.location.clone(),
+            ));
+        }
+        let clauses = Self::parse_case_clauses(&items[2..])?;
+
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        self.compile_expr(&items[1])?;
+
+        match Self::jump_table_range(&clauses) {
+            Some((min, len)) => self.compile_case_jump_table(&clauses, min, len, saved_tail)?,
+            None => self.compile_case_comparisons(&clauses, saved_tail)?,
+        }
+
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+
+    fn parse_case_clauses(clauses: &[SourceExpr]) -> Result<Vec<CaseClause<'_>>, CompileError> {
+        let mut parsed = Vec::with_capacity(clauses.len());
+        for (i, clause) in clauses.iter().enumerate() {
+            let parts = match &clause.expr {
+                LispExpr::List(parts) if parts.len() >= 2 => parts,
+                _ => {
+                    return Err(CompileError::new(
+                        "case clause expects (keys body...)".to_string(),
+                        clause.location.clone(),
+                    ));
+                }
+            };
+
+            let keys = match &parts[0].expr {
+                LispExpr::Symbol(s) if s == "else" => {
+                    if i != clauses.len() - 1 {
+                        return Err(CompileError::new(
+                            "else clause must be the last clause in case".to_string(),
+                            clause.location.clone(),
+                        ));
+                    }
+                    None
+                }
+                LispExpr::List(keys) => Some(keys.iter().map(Self::case_key).collect::<Result<Vec<_>, _>>()?),
+                _ => Some(vec![Self::case_key(&parts[0])?]),
+            };
+            parsed.push((keys, &parts[1..]));
+        }
+        Ok(parsed)
+    }
+
+    // Keys are literals; a symbol stands for itself, as if quoted
+    fn case_key(key: &SourceExpr) -> Result<Value, CompileError> {
+        match &key.expr {
+            LispExpr::Number(n) => Ok(Value::Integer(*n)),
+            LispExpr::Boolean(b) => Ok(Value::Boolean(*b)),
+            LispExpr::Symbol(s) => match s.strip_prefix("__STRING__") {
+                Some(text) => Ok(Value::String(Arc::new(text.to_string()))),
+                None => Ok(Value::symbol(s.as_str())),
+            },
+            _ => Err(CompileError::with_suggestion(
+                "case keys must be integers, booleans, strings or symbols".to_string(),
+                key.location.clone(),
+                "Use cond or match to test other values".to_string(),
+            )),
+        }
+    }
+
+    // The smallest key and table length, when every key is an integer and there are
+    // enough of them, packed closely enough, for a jump table to pay off
+    fn jump_table_range(clauses: &[CaseClause]) -> Option<(i64, usize)> {
+        let mut keys = HashSet::new();
+        for (clause_keys, _) in clauses {
+            for key in clause_keys.iter().flatten() {
+                match key {
+                    Value::Integer(n) => keys.insert(*n),
+                    _ => return None,
+                };
+            }
+        }
+        if keys.len() < JUMP_TABLE_MIN_KEYS {
+            return None;
+        }
+
+        let min = *keys.iter().min()?;
+        let max = *keys.iter().max()?;
+        let len = usize::try_from(max.checked_sub(min)?).ok()?.checked_add(1)?;
+        if len > keys.len() * JUMP_TABLE_MAX_SPREAD {
+            return None;
+        }
+        Some((min, len))
+    }
+
+    // The key is consumed by the JumpTable, so clause bodies run with nothing extra on the stack
+    fn compile_case_jump_table(&mut self, clauses: &[CaseClause], min: i64, len: usize, tail: bool) -> Result<(), CompileError> {
+        let table_idx = self.instruction_address;
+        self.emit(Instruction::JumpTable(min, Vec::new(), 0)); // placeholder, filled in below
+
+        let mut targets: Vec<Option<usize>> = vec![None; len];
+        let mut end_jumps = Vec::with_capacity(clauses.len());
+        let mut default = None;
+
+        for (keys, body) in clauses {
+            let start = self.instruction_address;
+            match keys {
+                Some(keys) => {
+                    for key in keys {
+                        if let Value::Integer(n) = key {
+                            // An earlier clause with the same key wins
+                            targets[(*n - min) as usize].get_or_insert(start);
+                        }
+                    }
+                }
+                None => default = Some(start),
+            }
+
+            self.in_tail_position = tail;
+            self.compile_sequence(body)?;
+            end_jumps.push(self.instruction_address);
+            self.emit(Instruction::Jmp(0)); // placeholder, patched to the end
+        }
+
+        let default = match default {
+            Some(addr) => addr,
+            None => {
+                let addr = self.instruction_address;
+                self.emit(Instruction::Push(Value::List(List::Nil)));
+                addr
+            }
+        };
+
+        let end = self.instruction_address;
+        for jump_idx in end_jumps {
+            self.patch_jump(jump_idx, end);
+        }
+        let targets = targets.into_iter().map(|target| target.unwrap_or(default)).collect();
+        self.bytecode[table_idx] = Instruction::JumpTable(min, targets, default);
+        Ok(())
+    }
+
+    // The key stays in a local slot while its clauses compare against it, and each
+    // body slides it off under its value
+    fn compile_case_comparisons(&mut self, clauses: &[CaseClause], tail: bool) -> Result<(), CompileError> {
+        let key_slot = Instruction::GetLocal(self.stack_depth);
+        self.stack_depth += 1;
+        let mut end_jumps = Vec::with_capacity(clauses.len());
+        let mut has_else = false;
+
+        for (keys, body) in clauses {
+            let mut next_clause_jumps = Vec::new();
+            match keys {
+                Some(keys) if keys.is_empty() => continue, // Matches nothing
+                Some(keys) => {
+                    // Every key but the last jumps into the body on a match; the
+                    // last falls through into it, or on to the next clause
+                    let mut body_jumps = Vec::with_capacity(keys.len() - 1);
+                    for (i, key) in keys.iter().enumerate() {
+                        self.emit(key_slot.clone());
+                        self.emit(Instruction::Push(key.clone()));
+                        // Symbols and booleans are the same whenever they're equal, so
+                        // comparing them by identity skips Eq's numeric coercions
+                        let compare = match key {
+                            Value::Symbol(_) | Value::Boolean(_) => Instruction::IsEq,
+                            _ => Instruction::Eq,
+                        };
+                        self.emit(compare);
+                        if i == keys.len() - 1 {
+                            next_clause_jumps.push(self.instruction_address);
+                            self.emit(Instruction::JmpIfFalse(0));
+                        } else {
+                            let next_key = self.instruction_address + 2;
+                            self.emit(Instruction::JmpIfFalse(next_key));
+                            body_jumps.push(self.instruction_address);
+                            self.emit(Instruction::Jmp(0));
+                        }
+                    }
+                    let body_start = self.instruction_address;
+                    for jump_idx in body_jumps {
+                        self.patch_jump(jump_idx, body_start);
+                    }
+                }
+                None => has_else = true,
+            }
+
+            self.in_tail_position = tail;
+            self.compile_sequence(body)?;
+            self.emit(Instruction::Slide(1));
+            end_jumps.push(self.instruction_address);
+            self.emit(Instruction::Jmp(0)); // placeholder, patched to the end
+
+            let next_clause = self.instruction_address;
+            for jump_idx in next_clause_jumps {
+                self.patch_jump(jump_idx, next_clause);
+            }
+        }
+
+        if !has_else {
+            self.emit(Instruction::Push(Value::List(List::Nil)));
+            self.emit(Instruction::Slide(1));
+        }
+
+        let end = self.instruction_address;
+        for jump_idx in end_jumps {
+            self.patch_jump(jump_idx, end);
+        }
+        self.stack_depth -= 1;
+        Ok(())
+    }
+}
@@ -0,0 +1,42 @@
+// Character builtins: (char->integer c), (integer->char n), (char=? a b),
+// (char<? a b), the class predicates like (char-alphabetic? c) and (string-ref s i)
+//
+// Each compiles inline to a single instruction. They live apart from the other
+// builtins to keep compile_located_expr's frame small, since every nested form
+// recurses through it.
+
+use crate::vm::instructions::Instruction;
+use crate::vm::errors::CompileError;
+use super::Compiler;
+use super::super::ast::SourceExpr;
+
+impl Compiler {
+    pub(super) fn compile_char_builtin(&mut self, expr: &SourceExpr, operator: &str, items: &[SourceExpr]) -> Result<(), CompileError> {
+        let (arity, usage, instruction) = match operator {
+            "char->integer" => (1, "(char->integer c)", Instruction::CharToInteger),
+            "integer->char" => (1, "(integer->char n)", Instruction::IntegerToChar),
+            "char=?" => (2, "(char=? a b)", Instruction::CharEq),
+            "char<?" => (2, "(char<? a b)", Instruction::CharLt),
+            "char-alphabetic?" => (1, "(char-alphabetic? c)", Instruction::IsAlphabetic),
+            "char-numeric?" => (1, "(char-numeric? c)", Instruction::IsNumeric),
+            "char-whitespace?" => (1, "(char-whitespace? c)", Instruction::IsWhitespace),
+            _ => (2, "(string-ref s i)", Instruction::StringRef),
+        };
+        if items.len() != arity + 1 {
+            let plural = if arity == 1 { "" } else { "s" };
+            return Err(CompileError::new(
+                format!("{} expects exactly {} argument{}: {}", operator, arity, plural, usage),
+                expr.location.clone(),
+            ));
+        }
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        for arg in &items[1..] {
+            self.compile_operand(arg)?;
+        }
+        self.stack_depth -= arity;
+        self.emit(instruction);
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+}
@@ -0,0 +1,312 @@
+// Coverage of multi-clause defun patterns: the arguments no clause matches, and
+// the clauses that earlier ones together always match first
+//
+// Patterns are reduced to the shapes they tell apart: the empty list, a pair of
+// a head and a tail, true, false and other literals. A type or struct pattern
+// (but :list and :boolean, which are nil-or-pair and true-or-false) counts as
+// matching values none of those shapes name, so it never makes another clause
+// unreachable. A clause with a guard may fail, so it covers nothing.
+//
+// The search is the usual one for match compilers: a row of shapes is useful
+// after some clauses when a value matches it and none of them. A clause that
+// isn't useful never matches. A row of wildcards that is useful after every
+// clause gives a value no clause matches, shown as its shape: nil, a list, true,
+// false, or _ for a value the clauses name none of.
+//
+// Any value can be passed to any argument, so no set of patterns but a wildcard
+// covers every value. For unreachable clauses the search keeps to that, so a
+// catch-all after (nil) and ((h . t)) still counts. For the missing arguments,
+// nil and pairs cover a position that only list patterns look at, and true and
+// false one that only boolean patterns do; numbers, strings, symbols and chars
+// never run out. A position with a type or struct pattern, as in a function
+// over a few structs, is taken to get only values the clauses there name.
+//
+//   (defun f ((nil) 0) (((x)) x))   doesn't cover: ((_ _ . _))
+
+use crate::vm::value::Value;
+use super::Compiler;
+use super::types::Pattern;
+
+#[derive(Debug, Clone, PartialEq)]
+enum Shape {
+    Any,                          // A variable or wildcard
+    Nil,
+    Cons(Box<Shape>, Box<Shape>),
+    Bool(bool),
+    Literal(Value),               // A number, string, symbol or char
+    Opaque,                       // A type or struct pattern
+    Or(Vec<Shape>),
+}
+
+// What the search splits a column on: the shapes with parts, or none
+#[derive(Debug, Clone, PartialEq)]
+enum Head {
+    Nil,
+    Cons,
+    Bool(bool),
+    Literal(Value),
+}
+
+impl Head {
+    fn arity(&self) -> usize {
+        match self {
+            Head::Cons => 2,
+            _ => 0,
+        }
+    }
+
+    // The shape with this head, its parts taken from the front of `row`
+    fn rebuild(&self, mut row: Vec<Shape>) -> Vec<Shape> {
+        let parts: Vec<Shape> = row.drain(..self.arity()).collect();
+        let shape = match (self, parts.as_slice()) {
+            (Head::Cons, [head, tail]) => Shape::Cons(Box::new(head.clone()), Box::new(tail.clone())),
+            (Head::Nil, _) => Shape::Nil,
+            (Head::Bool(b), _) => Shape::Bool(*b),
+            (Head::Literal(value), _) => Shape::Literal(value.clone()),
+            (Head::Cons, _) => unreachable!("a pair has two parts"),
+        };
+        row.insert(0, shape);
+        row
+    }
+}
+
+impl Shape {
+    fn of_pattern(pattern: &Pattern) -> Shape {
+        match pattern {
+            Pattern::Variable(_) | Pattern::Wildcard => Shape::Any,
+            Pattern::Literal(value) => Shape::of_value(value),
+            Pattern::QuotedSymbol(name) => Shape::Literal(Value::symbol(name)),
+            Pattern::EmptyList => Shape::Nil,
+            Pattern::List(items) => Shape::list(items.iter().map(Shape::of_pattern), Shape::Nil),
+            Pattern::DottedList(items, tail) => Shape::list(items.iter().map(Shape::of_pattern), Shape::of_pattern(tail)),
+            Pattern::Or(alternatives) => Shape::Or(alternatives.iter().map(Shape::of_pattern).collect()),
+            Pattern::As(_, inner) => Shape::of_pattern(inner),
+            Pattern::Type(name, inner) => Shape::of_type(name, Shape::of_pattern(inner)),
+            Pattern::Struct(_, _) => Shape::Opaque,
+        }
+    }
+
+    fn of_value(value: &Value) -> Shape {
+        match value {
+            Value::Boolean(b) => Shape::Bool(*b),
+            Value::List(list) => Shape::list(list.iter().map(Shape::of_value), Shape::Nil),
+            _ => Shape::Literal(value.clone()),
+        }
+    }
+
+    fn list(items: impl Iterator<Item = Shape>, tail: Shape) -> Shape {
+        items.collect::<Vec<_>>().into_iter().rev().fold(tail, |tail, item| Shape::Cons(Box::new(item), Box::new(tail)))
+    }
+
+    // (:list p) and (:boolean p) are p among the shapes of their type; other
+    // types stay opaque, as does a pattern that can't be of its type
+    fn of_type(name: &str, inner: Shape) -> Shape {
+        let (all, is_of_type): (Vec<Shape>, fn(&Shape) -> bool) = match name {
+            "list" => (vec![Shape::Nil, Shape::Cons(Box::new(Shape::Any), Box::new(Shape::Any))], |shape| matches!(shape, Shape::Nil | Shape::Cons(_, _))),
+            "boolean" => (vec![Shape::Bool(false), Shape::Bool(true)], |shape| matches!(shape, Shape::Bool(_))),
+            _ => return Shape::Opaque,
+        };
+        fn restrict(shape: Shape, all: &[Shape], is_of_type: fn(&Shape) -> bool) -> Shape {
+            match shape {
+                Shape::Any => Shape::Or(all.to_vec()),
+                Shape::Or(alternatives) => Shape::Or(alternatives.into_iter().map(|alternative| restrict(alternative, all, is_of_type)).collect()),
+                shape if is_of_type(&shape) => shape,
+                _ => Shape::Opaque,
+            }
+        }
+        restrict(inner, &all, is_of_type)
+    }
+
+    fn head(&self) -> Option<Head> {
+        match self {
+            Shape::Nil => Some(Head::Nil),
+            Shape::Cons(_, _) => Some(Head::Cons),
+            Shape::Bool(b) => Some(Head::Bool(*b)),
+            Shape::Literal(value) => Some(Head::Literal(value.clone())),
+            Shape::Any | Shape::Opaque | Shape::Or(_) => None,
+        }
+    }
+
+    fn parts(&self) -> Vec<Shape> {
+        match self {
+            Shape::Cons(head, tail) => vec![head.as_ref().clone(), tail.as_ref().clone()],
+            _ => Vec::new(),
+        }
+    }
+
+    // As a value shape is written in a warning; the shapes found missing are
+    // only ever wildcards, nil, pairs and booleans
+    fn format(&self) -> String {
+        match self {
+            Shape::Nil => "nil".to_string(),
+            Shape::Bool(b) => b.to_string(),
+            Shape::Cons(head, tail) => {
+                let mut items = vec![head.format()];
+                let mut tail = tail.as_ref();
+                while let Shape::Cons(head, rest) = tail {
+                    items.push(head.format());
+                    tail = rest;
+                }
+                match tail {
+                    Shape::Nil => format!("({})", items.join(" ")),
+                    tail => format!("({} . {})", items.join(" "), tail.format()),
+                }
+            }
+            _ => "_".to_string(),
+        }
+    }
+}
+
+// Rows with an or-shape first split into one row per alternative
+fn expand_first(rows: &[Vec<Shape>]) -> Vec<Vec<Shape>> {
+    fn push(row: Vec<Shape>, expanded: &mut Vec<Vec<Shape>>) {
+        match row.first() {
+            Some(Shape::Or(alternatives)) => {
+                for alternative in alternatives {
+                    let mut split = row.clone();
+                    split[0] = alternative.clone();
+                    push(split, expanded);
+                }
+            }
+            _ => expanded.push(row),
+        }
+    }
+    let mut expanded = Vec::new();
+    for row in rows {
+        push(row.clone(), &mut expanded);
+    }
+    expanded
+}
+
+// The rows that match a value with `head` first, with that value's parts in
+// place of it; opaque shapes don't match one
+fn specialize(rows: &[Vec<Shape>], head: &Head) -> Vec<Vec<Shape>> {
+    rows.iter()
+        .filter_map(|row| {
+            let parts = match &row[0] {
+                Shape::Any => vec![Shape::Any; head.arity()],
+                shape if shape.head().as_ref() == Some(head) => shape.parts(),
+                _ => return None,
+            };
+            Some(parts.into_iter().chain(row[1..].iter().cloned()).collect())
+        })
+        .collect()
+}
+
+// The rows that match a value whose head no row names, without their first column
+fn default_rows(rows: &[Vec<Shape>]) -> Vec<Vec<Shape>> {
+    rows.iter().filter(|row| row[0] == Shape::Any).map(|row| row[1..].to_vec()).collect()
+}
+
+// Heads of the first column, each once, in the order the search tries them
+fn column_heads(rows: &[Vec<Shape>]) -> Vec<Head> {
+    let mut heads: Vec<Head> = Vec::new();
+    for head in rows.iter().filter_map(|row| row[0].head()) {
+        if !heads.contains(&head) {
+            heads.push(head);
+        }
+    }
+    heads.sort_by_key(|head| match head {
+        Head::Nil => 0,
+        Head::Cons => 1,
+        Head::Bool(false) => 2,
+        Head::Bool(true) => 3,
+        Head::Literal(_) => 4,
+    });
+    heads
+}
+
+// Whether, looking for missing arguments, the heads of a column leave no other
+// value to try: every list or boolean shape when it names only those, or any
+// heads at all beside a type or struct pattern, trusted to cover the rest
+fn complete_heads(rows: &[Vec<Shape>], heads: &[Head]) -> bool {
+    rows.iter().any(|row| row[0] == Shape::Opaque)
+        || heads == [Head::Nil, Head::Cons]
+        || heads == [Head::Bool(false), Head::Bool(true)]
+}
+
+// A shape none of `heads` has: the other list or boolean shape when the column
+// names only those, a wildcard for something else
+fn missing_head(heads: &[Head]) -> Shape {
+    match heads {
+        [Head::Nil] => Shape::Cons(Box::new(Shape::Any), Box::new(Shape::Any)),
+        [Head::Cons] => Shape::Nil,
+        [Head::Bool(b)] => Shape::Bool(!b),
+        _ => Shape::Any,
+    }
+}
+
+// A value, as one shape per column, that matches `row` and none of `rows`.
+// `typed` lets lists and booleans run out, as for the missing arguments.
+fn useful(rows: &[Vec<Shape>], row: &[Shape], typed: bool) -> Option<Vec<Shape>> {
+    let Some((first, rest)) = row.split_first() else {
+        return rows.is_empty().then(Vec::new);
+    };
+    let rows = expand_first(rows);
+    let with_parts = |parts: Vec<Shape>| -> Vec<Shape> { parts.into_iter().chain(rest.iter().cloned()).collect() };
+
+    if let Shape::Or(alternatives) = first {
+        return alternatives.iter().find_map(|alternative| useful(&rows, &with_parts(vec![alternative.clone()]), typed));
+    }
+    if let Some(head) = first.head() {
+        let found = useful(&specialize(&rows, &head), &with_parts(first.parts()), typed)?;
+        return Some(head.rebuild(found));
+    }
+
+    // A wildcard, or an opaque shape, which matches no more than one
+    let heads = column_heads(&rows);
+    if typed && complete_heads(&rows, &heads) {
+        return heads.iter().find_map(|head| {
+            let found = useful(&specialize(&rows, head), &with_parts(vec![Shape::Any; head.arity()]), typed)?;
+            Some(head.rebuild(found))
+        });
+    }
+    let mut found = useful(&default_rows(&rows), rest, typed)?;
+    found.insert(0, if typed { missing_head(&heads) } else { Shape::Any });
+    Some(found)
+}
+
+fn shapes(patterns: &[Pattern]) -> Vec<Shape> {
+    patterns.iter().map(Shape::of_pattern).collect()
+}
+
+impl Compiler {
+    // The clauses the earlier ones without a guard, taking the same number of
+    // arguments, together always match first. Clauses are (patterns, has guard).
+    pub(super) fn covered_clauses(clauses: &[(&[Pattern], bool)]) -> Vec<usize> {
+        let mut covered = Vec::new();
+        for (later, (patterns, _)) in clauses.iter().enumerate() {
+            let earlier: Vec<Vec<Shape>> = clauses[..later].iter()
+                .filter(|(earlier, guarded)| !guarded && earlier.len() == patterns.len())
+                .map(|(earlier, _)| shapes(earlier))
+                .collect();
+            if useful(&earlier, &shapes(patterns), false).is_none() {
+                covered.push(later);
+            }
+        }
+        covered
+    }
+
+    // For each number of arguments the clauses take, in the order they first
+    // do, arguments no clause without a guard matches, written (nil _) with a
+    // shape per argument
+    pub(super) fn uncovered_arguments(clauses: &[(&[Pattern], bool)]) -> Vec<String> {
+        let mut arities: Vec<usize> = Vec::new();
+        for (patterns, _) in clauses {
+            if !arities.contains(&patterns.len()) {
+                arities.push(patterns.len());
+            }
+        }
+        arities.into_iter()
+            .filter_map(|arity| {
+                let rows: Vec<Vec<Shape>> = clauses.iter()
+                    .filter(|(patterns, guarded)| !guarded && patterns.len() == arity)
+                    .map(|(patterns, _)| shapes(patterns))
+                    .collect();
+                let missing = useful(&rows, &vec![Shape::Any; arity], true)?;
+                let missing: Vec<String> = missing.iter().map(Shape::format).collect();
+                Some(format!("({})", missing.join(" ")))
+            })
+            .collect()
+    }
+}
@@ -0,0 +1,52 @@
+// Fixed-width integer builtins: (checked-add a b), (checked-sub a b),
+// (checked-mul a b) and their wrapping-add/sub/mul counterparts
+//
+// + - and * promote to bignums instead of overflowing. These stay within 64
+// bits: the checked ones fail when the result doesn't fit, the wrapping ones
+// reduce it modulo 2^64. When both operands are literals the call has already
+// folded in compile_located_expr, unless it is a checked one that overflows;
+// that is reported here, at the call, rather than left for every run to hit.
+
+use crate::vm::instructions::Instruction;
+use crate::vm::errors::CompileError;
+use crate::vm::value::Value;
+use crate::vm::VM;
+use super::Compiler;
+use super::super::ast::SourceExpr;
+
+impl Compiler {
+    pub(super) fn compile_fixed_width_builtin(&mut self, expr: &SourceExpr, operator: &str, items: &[SourceExpr]) -> Result<(), CompileError> {
+        if items.len() != 3 {
+            return Err(CompileError::new(
+                format!("{} expects exactly 2 arguments: ({} a b)", operator, operator),
+                expr.location.clone(),
+            ));
+        }
+        if let (Some(a), Some(b)) = (self.fold_constant(&items[1]), self.fold_constant(&items[2])) {
+            let is_integer = |value: &Value| matches!(value, Value::Integer(_) | Value::BigInt(_));
+            if is_integer(&a) && is_integer(&b) {
+                if let Err(err) = VM::fixed_width_arith(operator, &a, &b) {
+                    return Err(match err.suggestion {
+                        Some(suggestion) => CompileError::with_suggestion(err.message, expr.location.clone(), suggestion),
+                        None => CompileError::new(err.message, expr.location.clone()),
+                    });
+                }
+            }
+        }
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        self.compile_operand(&items[1])?;
+        self.compile_operand(&items[2])?;
+        self.stack_depth -= 2;
+        self.emit(match operator {
+            "checked-add" => Instruction::CheckedAdd,
+            "checked-sub" => Instruction::CheckedSub,
+            "checked-mul" => Instruction::CheckedMul,
+            "wrapping-add" => Instruction::WrappingAdd,
+            "wrapping-sub" => Instruction::WrappingSub,
+            _ => Instruction::WrappingMul,
+        });
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+}
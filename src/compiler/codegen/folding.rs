@@ -0,0 +1,143 @@
+// Constant folding: arithmetic and comparisons over integer literals, and `if`
+// with a literal (or folded) boolean condition, are evaluated at compile time.
+//
+// Folding only happens when the runtime result is certain. Arithmetic is done on
+// bignums and narrowed back the way the VM does, so an overflowing expression
+// folds to the same bignum the VM would promote it to. Division or modulo by zero
+// is left for the VM, so the error is still raised at runtime. Floats are not
+// folded here. The checked and wrapping builtins fold with the VM's 64-bit rules;
+// a checked one that overflows on literals is a compile error instead.
+
+use std::sync::Arc;
+
+use crate::vm::bigint::BigInt;
+use crate::vm::value::Value;
+use crate::vm::VM;
+use super::Compiler;
+use super::super::ast::{LispExpr, SourceExpr};
+
+impl Compiler {
+    /// Enable or disable constant folding and the peephole pass (on by default)
+    pub fn set_constant_folding(&mut self, enabled: bool) {
+        self.fold_constants = enabled;
+    }
+
+    /// Compile-time value of `expr`, if folding can compute it
+    pub(super) fn fold_constant(&self, expr: &SourceExpr) -> Option<Value> {
+        if !self.fold_constants {
+            return None;
+        }
+        match &expr.expr {
+            LispExpr::Number(n) => Some(Value::Integer(*n)),
+            LispExpr::Boolean(b) => Some(Value::Boolean(*b)),
+            LispExpr::Symbol(s) if !self.is_local_variable(s) => self.inlined_constant(s),
+            LispExpr::List(items) => {
+                let operator = match items.first().map(|item| &item.expr) {
+                    Some(LispExpr::Symbol(s)) => s,
+                    _ => return None,
+                };
+                // A local or macro of the same name is not the builtin operator
+                if self.is_local_variable(operator) || self.macros.contains_key(operator) {
+                    return None;
+                }
+                let args = &items[1..];
+                match operator.as_str() {
+                    "if" if args.len() == 3 => match self.fold_condition(&args[0])? {
+                        true => self.fold_constant(&args[1]),
+                        false => self.fold_constant(&args[2]),
+                    },
+                    "neg" if args.len() == 1 => Some(Value::from_bigint(self.fold_integer(&args[0])?.neg())),
+                    "+" | "-" | "*" | "/" | "%" if args.len() >= 2 => {
+                        let mut acc = self.fold_integer(&args[0])?;
+                        for arg in &args[1..] {
+                            let n = self.fold_integer(arg)?;
+                            acc = match operator.as_str() {
+                                "+" => acc.add(&n),
+                                "-" => acc.sub(&n),
+                                "*" => acc.mul(&n),
+                                // Truncating, like the VM; None for a zero divisor
+                                "/" => acc.div_rem(&n)?.0,
+                                _ => acc.div_rem(&n)?.1,
+                            };
+                        }
+                        Some(Value::from_bigint(acc))
+                    }
+                    "quotient" | "remainder" | "modulo" if args.len() == 2 => {
+                        let a = Value::from_bigint(self.fold_integer(&args[0])?);
+                        let b = Value::from_bigint(self.fold_integer(&args[1])?);
+                        VM::integer_division(operator, &a, &b).ok()
+                    }
+                    // An overflowing checked op doesn't fold; compile_fixed_width_builtin reports it
+                    "checked-add" | "checked-sub" | "checked-mul" |
+                    "wrapping-add" | "wrapping-sub" | "wrapping-mul" if args.len() == 2 => {
+                        let a = Value::from_bigint(self.fold_integer(&args[0])?);
+                        let b = Value::from_bigint(self.fold_integer(&args[1])?);
+                        VM::fixed_width_arith(operator, &a, &b).ok()
+                    }
+                    // Nor does a shift by a negative count; compile_bitwise_builtin reports it
+                    "bit-and" | "bit-or" | "bit-xor" | "shift-left" | "shift-right" if args.len() == 2 => {
+                        let a = Value::from_bigint(self.fold_integer(&args[0])?);
+                        let b = Value::from_bigint(self.fold_integer(&args[1])?);
+                        VM::bitwise_arith(operator, &a, Some(&b)).ok()
+                    }
+                    "bit-not" if args.len() == 1 => Some(Value::from_bigint(self.fold_integer(&args[0])?.neg().sub(&BigInt::from_i64(1)))),
+                    "<" | "<=" | ">" | ">=" | "=" | "==" | "!=" if args.len() == 2 => {
+                        let a = self.fold_integer(&args[0])?;
+                        let b = self.fold_integer(&args[1])?;
+                        let result = match operator.as_str() {
+                            "<" => a < b,
+                            "<=" => a <= b,
+                            ">" => a > b,
+                            ">=" => a >= b,
+                            "!=" => a != b,
+                            _ => a == b,
+                        };
+                        Some(Value::Boolean(result))
+                    }
+                    _ => None,
+                }
+            }
+            _ => None,
+        }
+    }
+
+    /// Value a defconst's initializer folds to. Floats and strings are immutable, so
+    /// literal ones can be inlined as well.
+    pub(super) fn constant_value(&self, expr: &SourceExpr) -> Option<Value> {
+        if !self.fold_constants {
+            return None;
+        }
+        match &expr.expr {
+            LispExpr::Float(f) => Some(Value::Float(*f)),
+            LispExpr::Symbol(s) if s.starts_with("__STRING__") => {
+                Some(Value::String(Arc::new(s["__STRING__".len()..].to_string())))
+            }
+            _ => self.fold_constant(expr),
+        }
+    }
+
+    /// Value of the defconst `name` refers to, when it has one to inline
+    pub(super) fn inlined_constant(&self, name: &str) -> Option<Value> {
+        if !self.fold_constants {
+            return None;
+        }
+        let resolved = self.resolve_global_name(name);
+        self.constants.get(&resolved)
+            .or_else(|| self.constants.get(name))
+            .and_then(|constant| constant.value.clone())
+    }
+
+    /// Branch an `if` always takes, when its condition folds to a constant:
+    /// the else branch for false, the then branch for anything else
+    pub(super) fn fold_condition(&self, condition: &SourceExpr) -> Option<bool> {
+        Some(!matches!(self.fold_constant(condition)?, Value::Boolean(false)))
+    }
+
+    /// Integer (or bignum) value `expr` folds to
+    fn fold_integer(&self, expr: &SourceExpr) -> Option<BigInt> {
+        match self.fold_constant(expr)? {
+            value @ (Value::Integer(_) | Value::BigInt(_)) => value.as_bigint(),
+            _ => None,
+        }
+    }
+}
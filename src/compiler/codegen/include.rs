@@ -0,0 +1,130 @@
+// Compile-time inclusion: (include "other.lisp")
+//
+// Before a program is compiled, each top-level include is replaced by the forms of
+// the file it names, so those defuns are part of the same compilation unit: calls
+// to them are arity-checked and tail calls to them reuse the frame, just as for
+// functions written in the including file. A relative path is taken from the
+// directory of the file the include is in. Included forms keep their own file in
+// their locations, so errors in them cite that file's path and lines.
+
+use std::borrow::Cow;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use crate::parser::Parser;
+use crate::vm::errors::{CompileError, Location};
+use super::Compiler;
+use super::super::ast::{LispExpr, SourceExpr};
+
+// An included file: its canonical path, to recognise it again, and the path its
+// forms' locations use
+type IncludedFile = (PathBuf, String);
+
+// ==================== INCLUDE ====================
+
+impl Compiler {
+    // The program's forms with every top-level include replaced by the included forms
+    pub(super) fn expand_includes<'a>(&mut self, exprs: &'a [SourceExpr]) -> Result<Cow<'a, [SourceExpr]>, CompileError> {
+        if !exprs.iter().any(|expr| Self::include_form(expr).is_some()) {
+            return Ok(Cow::Borrowed(exprs));
+        }
+
+        // The including file itself counts as part of the chain, so a file that
+        // includes it back is a cycle too
+        let mut chain = Vec::new();
+        if let Some(first) = exprs.first() {
+            if let Ok(canonical) = fs::canonicalize(&first.location.file) {
+                chain.push((canonical, first.location.file.clone()));
+            }
+        }
+
+        let mut expanded = Vec::with_capacity(exprs.len());
+        self.splice_includes(exprs, &mut chain, &mut expanded)?;
+        Ok(Cow::Owned(expanded))
+    }
+
+    fn splice_includes(&mut self, exprs: &[SourceExpr], chain: &mut Vec<IncludedFile>, expanded: &mut Vec<SourceExpr>) -> Result<(), CompileError> {
+        for expr in exprs {
+            let items = match Self::include_form(expr) {
+                Some(items) => items,
+                None => {
+                    expanded.push(expr.clone());
+                    continue;
+                }
+            };
+
+            let path = match items {
+                [_, path] => match &path.expr {
+                    LispExpr::Symbol(s) if s.starts_with("__STRING__") => &s["__STRING__".len()..],
+                    _ => {
+                        return Err(CompileError::new(
+                            "include expects a file path string: (include \"file.lisp\")".to_string(),
+                            path.location.clone(),
+                        ));
+                    }
+                },
+                _ => {
+                    return Err(CompileError::new(
+                        "include expects exactly one file path: (include \"file.lisp\")".to_string(),
+                        expr.location.clone(),
+                    ));
+                }
+            };
+
+            let file = Self::include_path(&expr.location.file, path);
+            let canonical = fs::canonicalize(&file).map_err(|e| {
+                CompileError::new(format!("Cannot include '{}': {}", file, e), expr.location.clone())
+            })?;
+            if let Some(start) = chain.iter().position(|(included, _)| *included == canonical) {
+                let cycle: Vec<&str> = chain[start..].iter()
+                    .map(|(_, name)| name.as_str())
+                    .chain(std::iter::once(file.as_str()))
+                    .collect();
+                return Err(CompileError::new(
+                    format!("Circular include: {}", cycle.join(" -> ")),
+                    expr.location.clone(),
+                ));
+            }
+
+            let source = fs::read_to_string(&file).map_err(|e| {
+                CompileError::new(format!("Cannot include '{}': {}", file, e), expr.location.clone())
+            })?;
+            let forms = Parser::new_with_file(&source, file.clone()).parse_all().map_err(|e| {
+                CompileError::new(format!("Cannot include '{}': {}", file, e), expr.location.clone())
+            })?;
+            self.included_sources.insert(file.clone(), source);
+
+            chain.push((canonical, file));
+            self.splice_includes(&forms, chain, expanded)?;
+            chain.pop();
+        }
+        Ok(())
+    }
+
+    // The items of an (include ...) form
+    fn include_form(expr: &SourceExpr) -> Option<&[SourceExpr]> {
+        match &expr.expr {
+            LispExpr::List(items) if matches!(items.first().map(|item| &item.expr), Some(LispExpr::Symbol(s)) if s == "include") => Some(items),
+            _ => None,
+        }
+    }
+
+    // Where an include of `path` in `including_file` reads from
+    fn include_path(including_file: &str, path: &str) -> String {
+        match Path::new(including_file).parent() {
+            Some(directory) if Path::new(path).is_relative() => directory.join(path).to_string_lossy().to_string(),
+            _ => path.to_string(),
+        }
+    }
+
+    /// Source text to show with a compile error: that of the included file the
+    /// error is in, or otherwise the program's own `source`
+    pub fn source_for<'a>(&'a self, error: &CompileError, source: &'a str) -> &'a str {
+        self.source_at(&error.location, source)
+    }
+
+    /// Source text of the file `location` is in, as for `source_for`
+    pub fn source_at<'a>(&'a self, location: &Location, source: &'a str) -> &'a str {
+        self.included_sources.get(&location.file).map_or(source, String::as_str)
+    }
+}
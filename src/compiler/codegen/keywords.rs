@@ -0,0 +1,206 @@
+// Keyword arguments: (defun connect (host &key (port 8080) (timeout 30)) ...)
+// called as (connect "localhost" :port 9000)
+//
+// Keywords like :port are symbols whose name starts with a colon; they
+// evaluate to themselves. A function with &key parameters takes whatever
+// follows its required arguments as keyword/value pairs, in any order, in a
+// hidden rest parameter. Its body starts by checking them (CheckKeywords
+// rejects a keyword it doesn't take), then binds each &key parameter, as let*
+// would, to the value given after its keyword or else to its default, so a
+// default can use the parameters before it. Direct calls are checked against
+// the keywords at compile time too, so a misspelt keyword is reported where
+// it is written.
+
+use crate::vm::instructions::Instruction;
+use crate::vm::errors::{CompileError, Location};
+use super::Compiler;
+use super::super::ast::{LispExpr, SourceExpr};
+
+// Holds the keyword/value pairs of a function with &key parameters
+const KEYWORD_ARGS: &str = "__keyword_args";
+
+// A &key parameter: `name` or `(name default)`
+pub(super) struct KeywordParam {
+    pub name: String,
+    pub default: Option<SourceExpr>,
+}
+
+impl Compiler {
+    pub(super) fn is_keyword(name: &str) -> bool {
+        name.len() > 1 && name.starts_with(':')
+    }
+
+    // Split (a b &key c (d 1)) into its required parameters and its &key ones;
+    // None when the list has no &key marker
+    pub(super) fn parse_keyword_params(params_expr: &SourceExpr) -> Result<Option<(Vec<String>, Vec<KeywordParam>)>, CompileError> {
+        let params = match &params_expr.expr {
+            LispExpr::List(params) => params,
+            _ => return Ok(None),
+        };
+        let marker = match params.iter().position(|p| matches!(&p.expr, LispExpr::Symbol(s) if s == "&key")) {
+            Some(marker) => marker,
+            None => return Ok(None),
+        };
+
+        let mut required = Vec::new();
+        for param in &params[..marker] {
+            match &param.expr {
+                LispExpr::Symbol(s) if s != "&rest" && s != "." => required.push(s.clone()),
+                LispExpr::Symbol(_) => {
+                    return Err(CompileError::new(
+                        "&key can't be combined with a rest parameter".to_string(),
+                        param.location.clone(),
+                    ));
+                }
+                _ => {
+                    return Err(CompileError::new(
+                        "Parameter must be a symbol".to_string(),
+                        param.location.clone(),
+                    ));
+                }
+            }
+        }
+
+        let mut keys: Vec<KeywordParam> = Vec::new();
+        for param in &params[marker + 1..] {
+            let key = match &param.expr {
+                LispExpr::Symbol(name) if !name.starts_with('&') => KeywordParam { name: name.clone(), default: None },
+                LispExpr::List(spec) if spec.len() == 2 && matches!(&spec[0].expr, LispExpr::Symbol(_)) => {
+                    let LispExpr::Symbol(name) = &spec[0].expr else { unreachable!() };
+                    KeywordParam { name: name.clone(), default: Some(spec[1].clone()) }
+                }
+                _ => {
+                    return Err(CompileError::with_suggestion(
+                        "Keyword parameter must be a name or (name default)".to_string(),
+                        param.location.clone(),
+                        "Use (defun f (a &key b (c 10)) ...) - b defaults to '(), c to 10".to_string(),
+                    ));
+                }
+            };
+            if required.contains(&key.name) || keys.iter().any(|k| k.name == key.name) {
+                return Err(CompileError::new(
+                    format!("Parameter '{}' appears more than once", key.name),
+                    param.location.clone(),
+                ));
+            }
+            keys.push(key);
+        }
+        if keys.is_empty() {
+            return Err(CompileError::new(
+                "&key must be followed by at least one parameter".to_string(),
+                params[marker].location.clone(),
+            ));
+        }
+        Ok(Some((required, keys)))
+    }
+
+    // Compile the defun as one taking its keyword arguments as a rest
+    // parameter, with a body that checks them and binds each &key parameter:
+    //   (do (__check-keywords f :b :c)
+    //       (let* ((b (__keyword-arg :b '())) (c (__keyword-arg :c 10))) body))
+    pub(super) fn compile_keyword_defun(
+        &mut self,
+        fn_name: &str,
+        params_expr: &SourceExpr,
+        required: Vec<String>,
+        keys: Vec<KeywordParam>,
+        body_expr: &SourceExpr,
+    ) -> Result<(), CompileError> {
+        let location = &params_expr.location;
+        let symbol = |name: &str| SourceExpr::new(LispExpr::Symbol(name.to_string()), location.clone());
+        let list = |items: Vec<SourceExpr>| SourceExpr::new(LispExpr::List(items), location.clone());
+
+        let params = SourceExpr::new(
+            LispExpr::DottedList(required.iter().map(|name| symbol(name)).collect(), Box::new(symbol(KEYWORD_ARGS))),
+            location.clone(),
+        );
+
+        let keywords: Vec<String> = keys.iter().map(|key| format!(":{}", key.name)).collect();
+        let mut check = vec![symbol("__check-keywords"), symbol(fn_name)];
+        check.extend(keywords.iter().map(|keyword| symbol(keyword)));
+
+        let bindings = keys.iter().zip(&keywords)
+            .map(|(key, keyword)| {
+                let default = key.default.clone()
+                    .unwrap_or_else(|| list(vec![symbol("quote"), list(Vec::new())]));
+                list(vec![symbol(&key.name), list(vec![symbol("__keyword-arg"), symbol(keyword), default])])
+            })
+            .collect();
+        let body = list(vec![
+            symbol("do"),
+            list(check),
+            list(vec![symbol("let*"), list(bindings), body_expr.clone()]),
+        ]);
+
+        let qualified_name = self.qualify_name(fn_name);
+        self.compile_single_clause_defun(fn_name, &params, &body)?;
+        self.function_keywords.insert(qualified_name, keywords);
+        Ok(())
+    }
+
+    // The forms compile_keyword_defun writes: (__check-keywords f :b ...) leaves
+    // the keyword arguments on the stack once checked, and (__keyword-arg :b default)
+    // pushes the value given for :b, or else the default
+    pub(super) fn compile_keyword_form(&mut self, operator: &str, items: &[SourceExpr]) -> Result<(), CompileError> {
+        let name = |item: &SourceExpr| match &item.expr {
+            LispExpr::Symbol(s) => s.clone(),
+            _ => unreachable!("keyword forms are only written by compile_keyword_defun"),
+        };
+        let args = SourceExpr::new(LispExpr::Symbol(KEYWORD_ARGS.to_string()), items[0].location.clone());
+
+        if operator == "__check-keywords" {
+            self.compile_expr(&args)?;
+            self.emit(Instruction::CheckKeywords(name(&items[1]), items[2..].iter().map(name).collect()));
+            return Ok(());
+        }
+
+        let keyword = name(&items[1]);
+        self.compile_expr(&args)?;
+        self.emit(Instruction::HasKeyword(keyword.clone()));
+        let jmp_if_missing = self.bytecode.len();
+        self.emit(Instruction::JmpIfFalse(0));
+        self.compile_expr(&args)?;
+        self.emit(Instruction::GetKeyword(keyword));
+        let jmp_to_end = self.bytecode.len();
+        self.emit(Instruction::Jmp(0));
+        self.bytecode[jmp_if_missing] = Instruction::JmpIfFalse(self.instruction_address);
+        self.compile_expr(&items[2])?;
+        self.bytecode[jmp_to_end] = Instruction::Jmp(self.instruction_address);
+        Ok(())
+    }
+
+    // Error for a direct call giving a keyword the callee doesn't take, or a
+    // keyword without a value. Pairs are checked up to the first keyword that
+    // isn't written literally; the function checks the rest when called.
+    pub(super) fn keyword_error(&self, name: &str, args: &[SourceExpr], location: &Location) -> Option<CompileError> {
+        let keywords = self.function_keywords.get(name)?;
+        let (required, _) = *self.function_arities.get(name)?;
+        for pair in args.get(required..)?.chunks(2) {
+            let keyword = match &pair[0].expr {
+                LispExpr::Symbol(s) if Self::is_keyword(s) => s,
+                _ => return None,
+            };
+            if !keywords.contains(keyword) {
+                let similar = keywords.iter()
+                    .filter(|k| Self::levenshtein_distance(keyword, k) <= 2)
+                    .min_by_key(|k| Self::levenshtein_distance(keyword, k));
+                let suggestion = match similar {
+                    Some(similar) => format!("Did you mean {}? '{}' takes {}", similar, name, keywords.join(", ")),
+                    None => format!("'{}' takes {}", name, keywords.join(", ")),
+                };
+                return Some(CompileError::with_suggestion(
+                    format!("Unknown keyword argument {} for '{}'", keyword, name),
+                    pair[0].location.clone(),
+                    suggestion,
+                ));
+            }
+            if pair.len() == 1 {
+                return Some(CompileError::new(
+                    format!("Keyword argument {} for '{}' has no value", keyword, name),
+                    location.clone(),
+                ));
+            }
+        }
+        None
+    }
+}
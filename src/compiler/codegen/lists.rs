@@ -0,0 +1,64 @@
+// List builtins: (list-ref lst i), (nth i lst), (length lst), (list-length lst),
+// (reverse lst) and (append lst ...)
+//
+// Each compiles inline to VM instructions rather than a call. They live apart
+// from the other builtins to keep compile_located_expr's frame small, since
+// every nested form recurses through it.
+
+use crate::vm::instructions::Instruction;
+use crate::vm::errors::CompileError;
+use crate::vm::value::{List, Value};
+use super::Compiler;
+use super::super::ast::SourceExpr;
+
+impl Compiler {
+    pub(super) fn compile_list_builtin(&mut self, expr: &SourceExpr, operator: &str, items: &[SourceExpr]) -> Result<(), CompileError> {
+        if operator == "append" {
+            return self.compile_append(items);
+        }
+        let (arity, usage, instruction) = match operator {
+            "list-ref" => (2, "(list-ref lst i)", Instruction::ListRef),
+            "nth" => (2, "(nth i lst)", Instruction::Nth),
+            "reverse" => (1, "(reverse lst)", Instruction::ListReverse),
+            "list-length" => (1, "(list-length lst)", Instruction::ListLength),
+            _ => (1, "(length lst)", Instruction::ListLength),
+        };
+        if items.len() != arity + 1 {
+            let plural = if arity == 1 { "" } else { "s" };
+            return Err(CompileError::new(
+                format!("{} expects exactly {} argument{}: {}", operator, arity, plural, usage),
+                expr.location.clone(),
+            ));
+        }
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        for arg in &items[1..] {
+            self.compile_operand(arg)?;
+        }
+        self.stack_depth -= arity;
+        self.emit(instruction);
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+
+    /// (append) is '() and (append lst) is lst itself. With more, the lists are
+    /// joined from the right, so each Append copies one list onto a shared tail.
+    fn compile_append(&mut self, items: &[SourceExpr]) -> Result<(), CompileError> {
+        let args = &items[1..];
+        if args.is_empty() {
+            self.emit(Instruction::Push(Value::List(List::Nil)));
+            return Ok(());
+        }
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        for arg in args {
+            self.compile_operand(arg)?;
+        }
+        self.stack_depth -= args.len();
+        for _ in 1..args.len() {
+            self.emit(Instruction::Append);
+        }
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+}
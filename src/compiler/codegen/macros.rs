@@ -1,6 +1,10 @@
-// Macro system: defmacro, expand_macro, value_to_expr
+// Macro system: defmacro, expand_macro, expansion_to_expr
 
-use crate::vm::value::Value;
+use std::collections::HashMap;
+use std::rc::Rc;
+use std::sync::Arc;
+
+use crate::vm::value::{Value, List, ConsCell};
 use crate::vm::instructions::Instruction;
 use crate::vm::errors::{CompileError, Location};
 use crate::vm::vm::VM;
@@ -11,6 +15,8 @@ use super::super::ast::{LispExpr, SourceExpr};
 
 // ==================== MACRO SYSTEM ====================
 
+pub(super) const DEFAULT_MACRO_EXPANSION_LIMIT: usize = 500;
+
 impl Compiler {
     // Compile defmacro: (defmacro name (params) body)
     pub(super) fn compile_defmacro(&mut self, expr: &SourceExpr) -> Result<(), CompileError> {
@@ -24,8 +30,8 @@ impl Compiler {
             }
         };
 
-        // Check format: (defmacro name (params) body)
-        if items.len() != 4 {
+        // Check format: (defmacro name (params) body ...)
+        if items.len() < 4 {
             return Err(CompileError::new(
                 "defmacro expects: (defmacro name (params) body)".to_string(),
                 expr.location.clone(),
@@ -43,35 +49,41 @@ impl Compiler {
             }
         };
 
-        // Extract parameters
-        let params = match &items[2].expr {
-            LispExpr::List(p) => {
-                let mut param_names = Vec::new();
-                for param in p {
-                    match &param.expr {
-                        LispExpr::Symbol(s) => param_names.push(s.clone()),
-                        _ => {
-                            return Err(CompileError::new(
-                                "Macro parameters must be symbols".to_string(),
-                                param.location.clone(),
-                            ));
-                        }
-                    }
-                }
-                param_names
-            }
-            _ => {
-                return Err(CompileError::new(
-                    "Macro parameters must be a list".to_string(),
-                    items[2].location.clone(),
-                ));
-            }
+        // Special forms always compile as themselves, so a macro can't take their name
+        if Self::is_special_form(&macro_name) {
+            return Err(CompileError::with_suggestion(
+                format!("Cannot define macro '{}': it is a special form", macro_name),
+                items[1].location.clone(),
+                "Give the macro another name".to_string(),
+            ));
+        }
+
+        // Extract parameters: (a b), (a . rest) or (a &rest rest)
+        if !matches!(&items[2].expr, LispExpr::List(_) | LispExpr::DottedList(_, _)) {
+            return Err(CompileError::new(
+                "Macro parameters must be a list".to_string(),
+                items[2].location.clone(),
+            ));
+        }
+        let parsed = Self::parse_params(&items[2]).map_err(|e| {
+            CompileError::new("Macro parameters must be symbols".to_string(), e.location)
+        })?;
+
+        // Several body expressions run in sequence, as in (do ...)
+        let body = if items.len() == 4 {
+            items[3].clone()
+        } else {
+            let mut body = vec![SourceExpr::new(LispExpr::Symbol("do".to_string()), items[0].location.clone())];
+            body.extend(items[3..].iter().cloned());
+            SourceExpr::new(LispExpr::List(body), expr.location.clone())
         };
 
         // Store macro definition (body is unevaluated)
         let macro_def = MacroDef {
-            params,
-            body: items[3].clone(),
+            params: parsed.required,
+            rest: parsed.rest,
+            body,
+            location: expr.location.clone(),
         };
 
         self.macros.insert(macro_name, macro_def);
@@ -79,137 +91,227 @@ impl Compiler {
         Ok(())
     }
 
-    // Expand a macro call at compile time
-    pub(super) fn expand_macro(&mut self, macro_def: &MacroDef, args: &[SourceExpr]) -> Result<SourceExpr, CompileError> {
+    // Compile (gensym) or (gensym "prefix"): a symbol unequal to every other, for
+    // the temporaries a macro expansion binds
+    pub(super) fn compile_gensym(&mut self, expr: &SourceExpr, items: &[SourceExpr]) -> Result<(), CompileError> {
+        match items.len() {
+            1 => self.emit(Instruction::GenSym),
+            2 => {
+                let saved_tail = self.in_tail_position;
+                self.in_tail_position = false;
+                self.compile_expr(&items[1])?;
+                self.emit(Instruction::GenSymPrefix);
+                self.in_tail_position = saved_tail;
+            }
+            _ => {
+                return Err(CompileError::new(
+                    "gensym expects at most 1 argument: an optional prefix string".to_string(),
+                    expr.location.clone(),
+                ));
+            }
+        }
+        Ok(())
+    }
+
+    /// Maximum nesting of macro expansions before expansion is reported as runaway
+    pub fn set_macro_expansion_limit(&mut self, limit: usize) {
+        self.macro_expansion_limit = limit;
+    }
+
+    // Compile a macro call: expand it and compile the resulting form.
+    // An expansion that is itself a macro call is expanded again right here, so a
+    // macro that keeps expanding hits the depth limit instead of growing the stack.
+    pub(super) fn compile_macro_call(&mut self, call: &SourceExpr) -> Result<(), CompileError> {
+        let saved_depth = self.macro_depth;
+        let saved_expansion = self.expansion.clone();
+        let mut form = call.clone();
+        while let Some((name, macro_def, args)) = self.macro_call_parts(&form) {
+            if self.macro_depth >= self.macro_expansion_limit {
+                self.macro_depth = saved_depth;
+                return Err(CompileError::with_suggestion(
+                    format!("macro expansion too deep: '{}' expanded more than {} levels", name, self.macro_expansion_limit),
+                    call.location.clone(),
+                    "Check that the macro's expansion stops calling it, or raise the limit with set_macro_expansion_limit".to_string(),
+                ));
+            }
+            self.macro_depth += 1;
+            self.expansion = Some(Self::expansion_note(&name, &macro_def));
+            form = match self.expand_macro(&name, &macro_def, &args, &call.location) {
+                Ok(expanded) => expanded,
+                Err(e) => {
+                    self.macro_depth = saved_depth;
+                    return Err(self.in_expansion(e, saved_expansion));
+                }
+            };
+        }
+
+        let result = self.compile_expr(&form);
+        self.macro_depth = saved_depth;
+        match result {
+            Ok(_) => {
+                self.expansion = saved_expansion;
+                Ok(())
+            }
+            Err(e) => Err(self.in_expansion(e, saved_expansion)),
+        }
+    }
+
+    // Note citing the defmacro whose expansion an error came from
+    fn expansion_note(name: &str, macro_def: &MacroDef) -> (String, Location) {
+        (format!("in the expansion of macro '{}', defined here", name), macro_def.location.clone())
+    }
+
+    // Leave the current expansion, pointing an error from it at the macro that
+    // produced the code. An error from a nested expansion keeps the innermost macro.
+    fn in_expansion(&mut self, error: CompileError, saved_expansion: Option<(String, Location)>) -> CompileError {
+        let expansion = std::mem::replace(&mut self.expansion, saved_expansion);
+        match expansion {
+            Some((note, location)) if error.note.is_none() => error.with_note(note, location),
+            _ => error,
+        }
+    }
+
+    // Name, definition and argument forms of a macro call, or None for any other form
+    fn macro_call_parts(&self, form: &SourceExpr) -> Option<(String, MacroDef, Vec<SourceExpr>)> {
+        let items = match &form.expr {
+            LispExpr::List(items) => items,
+            _ => return None,
+        };
+        let name = match items.first().map(|item| &item.expr) {
+            Some(LispExpr::Symbol(name)) if !self.is_local_variable(name) => name,
+            _ => return None,
+        };
+        let macro_def = self.macros.get(name)?.clone();
+        Some((name.clone(), macro_def, items[1..].to_vec()))
+    }
+
+    // Expand a macro call at compile time. Errors carry the location of the call site,
+    // as does every form of the expansion except the argument forms the macro passed
+    // through unchanged, which keep their own locations.
+    pub(super) fn expand_macro(
+        &mut self,
+        name: &str,
+        macro_def: &MacroDef,
+        args: &[SourceExpr],
+        call_site: &Location,
+    ) -> Result<SourceExpr, CompileError> {
         // Check arity
-        if args.len() != macro_def.params.len() {
+        let required = macro_def.params.len();
+        let arity_ok = match macro_def.rest {
+            Some(_) => args.len() >= required,
+            None => args.len() == required,
+        };
+        if !arity_ok {
+            let expected = match macro_def.rest {
+                Some(_) => format!("at least {}", required),
+                None => required.to_string(),
+            };
             return Err(CompileError::new(
-                format!("Macro arity mismatch: expected {}, got {}", macro_def.params.len(), args.len()),
-                Location::unknown(),
+                format!("Macro '{}' expects {} arguments, got {}", name, expected, args.len()),
+                call_site.clone(),
             ));
         }
 
-        // Create a new compiler for evaluating the macro
+        // Create a new compiler for evaluating the macro (it may use other macros)
         let mut macro_compiler = Compiler::new();
+        macro_compiler.macros = self.macros.clone();
+        macro_compiler.macro_depth = self.macro_depth;
+        macro_compiler.macro_expansion_limit = self.macro_expansion_limit;
 
         // Set up macro parameters as "arguments"
         macro_compiler.param_names = macro_def.params.clone();
+        macro_compiler.param_names.extend(macro_def.rest.clone());
 
         // Compile macro body
-        macro_compiler.compile_expr(&macro_def.body)?;
+        macro_compiler.compile_expr(&macro_def.body).map_err(|e| {
+            CompileError::new(format!("In expansion of macro '{}': {}", name, e.message), call_site.clone())
+        })?;
         macro_compiler.emit(Instruction::Halt);
 
         let macro_bytecode = std::mem::take(&mut macro_compiler.bytecode);
 
-        // Create a VM and run the macro
+        // Create a VM and run the macro; functions defined so far can be called from it
         let mut vm = VM::new();
-        vm.current_bytecode = macro_bytecode;
+        vm.functions.extend(self.functions.iter().map(|(name, code)| (name.clone(), code.clone())));
+        vm.current_bytecode = Rc::new(macro_bytecode);
 
         // Create a frame with the quoted arguments
         let mut arg_values = Vec::new();
-        for arg_expr in args {
-            arg_values.push(self.expr_to_value(arg_expr)?);
+        let mut origins = HashMap::new();
+        for arg_expr in &args[..required] {
+            let value = self.expr_to_value(arg_expr)?;
+            Self::record_origins(arg_expr, &value, &mut origins);
+            arg_values.push(value);
+        }
+        if macro_def.rest.is_some() {
+            let mut rest = Vec::new();
+            for arg_expr in &args[required..] {
+                let value = self.expr_to_value(arg_expr)?;
+                Self::record_origins(arg_expr, &value, &mut origins);
+                rest.push(value);
+            }
+            arg_values.push(Value::List(List::from_vec(rest)));
         }
 
         let frame = Frame {
             return_address: 0,
             locals: arg_values,
-            return_bytecode: Vec::new(),
+            return_bytecode: Rc::new(Vec::new()),
             function_name: "<macro>".to_string(),
             captured: Vec::new(),
             stack_base: 0, // Macro expansion uses a fresh VM
-            loop_start: None,
-            loop_bindings_start: None,
-            loop_bindings_count: None,
+            multiple_values: false,
         };
         vm.call_stack.push(frame);
 
         // Run the VM
         if let Err(runtime_error) = vm.run() {
             return Err(CompileError::new(
-                format!("Macro expansion failed: {}", runtime_error.message),
-                Location::unknown(),
+                format!("Macro expansion of '{}' failed: {}", name, runtime_error.message),
+                call_site.clone(),
             ));
         }
 
         // Get the result from the stack
-        if vm.value_stack.is_empty() {
-            return Err(CompileError::new(
-                "Macro expansion produced no value".to_string(),
-                Location::unknown(),
-            ));
-        }
-
-        let result_value = vm.value_stack.pop().unwrap();
+        let result_value = vm.value_stack.pop().ok_or_else(|| {
+            CompileError::new(format!("Macro '{}' produced no value", name), call_site.clone())
+        })?;
 
         // Convert the result back to a SourceExpr
-        self.value_to_expr(&result_value)
+        self.expansion_to_expr(&result_value, &origins, call_site).map_err(|e| {
+            CompileError::new(format!("In expansion of macro '{}': {}", name, e.message), call_site.clone())
+        })
     }
 
-    // Convert a Value back to a SourceExpr (inverse of expr_to_value)
-    pub(super) fn value_to_expr(&self, value: &Value) -> Result<SourceExpr, CompileError> {
-        match value {
-            Value::Integer(n) => Ok(SourceExpr::unknown(LispExpr::Number(*n))),
-            Value::Float(f) => Ok(SourceExpr::unknown(LispExpr::Float(*f))),
-            Value::Boolean(b) => Ok(SourceExpr::unknown(LispExpr::Boolean(*b))),
-            Value::Symbol(s) => Ok(SourceExpr::unknown(LispExpr::Symbol(s.to_string()))),
-            Value::String(s) => {
-                // Strings are represented as special symbols in the AST
-                Ok(SourceExpr::unknown(LispExpr::Symbol(format!("__STRING__{}", s))))
+    // Remember which argument form each list of an argument's value was made from.
+    // Lists are immutable, so an expansion holding one of these same cells holds that
+    // form exactly.
+    fn record_origins<'a>(expr: &'a SourceExpr, value: &Value, origins: &mut HashMap<*const ConsCell, &'a SourceExpr>) {
+        if let Value::List(list @ List::Cons(cell)) = value {
+            origins.insert(Arc::as_ptr(cell), expr);
+            if let LispExpr::List(items) = &expr.expr {
+                for (item, item_value) in items.iter().zip(list.iter()) {
+                    Self::record_origins(item, item_value, origins);
+                }
             }
-            Value::List(items) => {
+        }
+    }
+
+    // Convert a macro's result to a SourceExpr: argument forms it passed through
+    // come back as written, and everything else is placed at the call site
+    fn expansion_to_expr(&self, value: &Value, origins: &HashMap<*const ConsCell, &SourceExpr>, call_site: &Location) -> Result<SourceExpr, CompileError> {
+        match value {
+            Value::List(list @ List::Cons(cell)) => {
+                if let Some(origin) = origins.get(&Arc::as_ptr(cell)) {
+                    return Ok((*origin).clone());
+                }
                 let mut exprs = Vec::new();
-                for item in items.iter() {
-                    exprs.push(self.value_to_expr(item)?);
+                for item in list.iter() {
+                    exprs.push(self.expansion_to_expr(item, origins, call_site)?);
                 }
-                Ok(SourceExpr::unknown(LispExpr::List(exprs)))
-            }
-            Value::Function(name) => {
-                // Functions become symbols in the macro expansion
-                Ok(SourceExpr::unknown(LispExpr::Symbol(name.to_string())))
-            }
-            Value::Closure(_) => {
-                Err(CompileError::new(
-                    "Cannot convert closure to expression in macro expansion".to_string(),
-                    Location::unknown(),
-                ))
-            }
-            Value::HashMap(_) => {
-                Err(CompileError::new(
-                    "Cannot convert hashmap to expression in macro expansion".to_string(),
-                    Location::unknown(),
-                ))
-            }
-            Value::Vector(_) => {
-                Err(CompileError::new(
-                    "Cannot convert vector to expression in macro expansion".to_string(),
-                    Location::unknown(),
-                ))
-            }
-            Value::TcpListener(_) => {
-                Err(CompileError::new(
-                    "Cannot convert tcp-listener to expression in macro expansion".to_string(),
-                    Location::unknown(),
-                ))
-            }
-            Value::TcpStream(_) => {
-                Err(CompileError::new(
-                    "Cannot convert tcp-stream to expression in macro expansion".to_string(),
-                    Location::unknown(),
-                ))
-            }
-            Value::SharedTcpListener(_) => {
-                Err(CompileError::new(
-                    "Cannot convert shared-tcp-listener to expression in macro expansion".to_string(),
-                    Location::unknown(),
-                ))
-            }
-            Value::Pointer(_) => {
-                Err(CompileError::new(
-                    "Cannot convert pointer to expression in macro expansion".to_string(),
-                    Location::unknown(),
-                ))
+                Ok(SourceExpr::new(LispExpr::List(exprs), call_site.clone()))
             }
+            _ => SourceExpr::from_value(value, call_site),
         }
     }
 }
@@ -4,6 +4,24 @@ mod modules;
 mod utils;
 mod special_forms;
 mod macros;
+mod patterns;
+mod coverage;
+mod folding;
+mod peephole;
+mod resolution;
+mod structs;
+mod case;
+mod include;
+mod testing;
+mod chars;
+mod lists;
+mod fixed_width;
+mod bitwise;
+mod pretty;
+mod primitives;
+mod promises;
+mod keywords;
+mod warnings;
 
 use std::collections::HashMap;
 use std::sync::Arc;
@@ -11,11 +29,13 @@ use std::sync::Arc;
 use crate::vm::value::{Value, List};
 use crate::vm::instructions::{Instruction, FfiType};
 use crate::vm::ffi::parse_ffi_type;
-use crate::vm::errors::{CompileError, Location};
+use crate::vm::errors::{CompileError, CompileWarning, Location};
+use crate::vm::source_map::{SourceMap, SourceMaps, SlotNames, ProgramSlotNames};
 use super::ast::{LispExpr, SourceExpr};
 
 // Re-export types used internally
-pub(self) use types::{ValueLocation, MacroDef, ParsedParams, Pattern, FunctionClause};
+pub(self) use types::{ValueLocation, MacroDef, Constant, ParsedParams, Pattern, FunctionClause, LoopTarget};
+use resolution::UnresolvedName;
 
 // ==================== COMPILER STRUCT ====================
 
@@ -23,21 +43,45 @@ pub struct Compiler {
     bytecode: Vec<Instruction>,
     pub functions: HashMap<String, Vec<Instruction>>,
     macros: HashMap<String, MacroDef>, // Macro definitions
+    structs: HashMap<String, Vec<String>>, // defstruct types and their field names, for patterns
+    macro_depth: usize, // Macro expansions enclosing the expression being compiled
+    expansion: Option<(String, Location)>, // Note for errors in the innermost expansion being compiled
+    macro_expansion_limit: usize, // Deeper expansion is reported as runaway
+    fold_constants: bool, // Evaluate constant arithmetic and branches at compile time, and run the peephole pass
+    check_unresolved: bool, // Report names the program never defines, after compiling all of it
+    unresolved: Option<Vec<UnresolvedName>>, // Names not defined yet, collected while compiling a program
+    defines_at_runtime: bool, // The program calls load, require or eval, which can define functions unseen here
     global_vars: HashMap<String, bool>, // Track global variables (value is mutable flag)
     known_functions: std::collections::HashSet<String>, // Functions known from runtime context (for eval)
     known_globals: std::collections::HashSet<String>, // Globals known from runtime context (for eval)
+    constant_globals: std::collections::HashSet<String>, // Top-level def names, which set! can't reassign even before the def is compiled
+    constants: HashMap<String, Constant>, // defconst names, with the values inlined at their uses
     instruction_address: usize,
     param_names: Vec<String>, // Track parameter names for LoadArg
     pattern_bindings: HashMap<String, ValueLocation>, // Track pattern match bindings
     local_bindings: HashMap<String, ValueLocation>, // Track let-bound variables
     stack_depth: usize, // Track current stack depth for let bindings
     in_tail_position: bool, // Track if current expression is in tail position (for TCO)
+    open_handlers: usize, // handler-case and catch forms around this expression inside the innermost loop (recur can't cross them)
+    innermost_loop: Option<LoopTarget>, // The loop recur jumps back to, inside the current function body
     pattern_match_jumps: Vec<usize>, // Temporary storage for pattern match jump indices
+    current_location: Location, // Source position of the expression being compiled
+    locations: SourceMap, // Source positions of the bytecode being emitted
+    function_locations: HashMap<String, SourceMap>, // Source positions of compiled functions
+    function_params: HashMap<String, Vec<String>>, // Parameter names of compiled functions, for the debugger
+    record_slot_names: bool, // Keep the let-bound names in scope at each instruction, for the debugger
+    slot_names: SlotNames, // Let-bound names in scope across the bytecode being emitted
+    function_slot_names: HashMap<String, SlotNames>, // Let-bound names in scope across compiled functions
+    function_arities: HashMap<String, (usize, bool)>, // Required parameter count and whether a rest parameter follows, of defuns seen so far
+    function_keywords: HashMap<String, Vec<String>>, // Keywords of defuns with &key parameters, for checking direct calls
     // Module system fields
     current_module: Option<String>,                              // Current module being compiled (None = top-level)
     pub module_exports: HashMap<String, std::collections::HashSet<String>>, // Module name -> exported symbols
     imported_symbols: HashMap<String, String>,                   // Alias -> qualified name (e.g., "add" -> "math/add")
     module_functions: std::collections::HashSet<String>,         // Functions declared in current module (for forward references)
+    included_sources: HashMap<String, String>,                   // Text of each included file, for errors in it
+    tests: Vec<(String, Location)>,                              // deftest names in definition order, with where each is named
+    warnings: Vec<CompileWarning>,                               // Unused bindings in the last program compiled
 }
 
 impl Compiler {
@@ -47,21 +91,45 @@ impl Compiler {
             bytecode: Vec::new(),
             functions: HashMap::new(),
             macros: HashMap::new(),
+            structs: HashMap::new(),
+            macro_depth: 0,
+            expansion: None,
+            macro_expansion_limit: macros::DEFAULT_MACRO_EXPANSION_LIMIT,
+            fold_constants: true,
+            check_unresolved: true,
+            unresolved: None,
+            defines_at_runtime: false,
             global_vars: HashMap::new(),
             known_functions: std::collections::HashSet::new(),
             known_globals: std::collections::HashSet::new(),
+            constant_globals: std::collections::HashSet::new(),
+            constants: HashMap::new(),
             instruction_address: 0,
             param_names: Vec::new(),
             pattern_bindings: HashMap::new(),
             local_bindings: HashMap::new(),
             stack_depth: 0,
             in_tail_position: false,
+            open_handlers: 0,
+            innermost_loop: None,
             pattern_match_jumps: Vec::new(),
+            current_location: Location::unknown(),
+            locations: SourceMap::new(),
+            function_locations: HashMap::new(),
+            function_params: HashMap::new(),
+            record_slot_names: false,
+            slot_names: SlotNames::new(),
+            function_slot_names: HashMap::new(),
+            function_arities: HashMap::new(),
+            function_keywords: HashMap::new(),
             // Module system fields
             current_module: None,
             module_exports: HashMap::new(),
             imported_symbols: HashMap::new(),
             module_functions: std::collections::HashSet::new(),
+            included_sources: HashMap::new(),
+            tests: Vec::new(),
+            warnings: Vec::new(),
         }
     }
 
@@ -87,21 +155,100 @@ impl Compiler {
         }
     }
 
+    // Make the macros, struct types and constants another compiler has defined available here
+    // This lets the REPL compile each input separately without losing earlier definitions
+    pub fn with_definitions_from(&mut self, other: &Compiler) {
+        self.macros.extend(other.macros.iter().map(|(name, def)| (name.clone(), def.clone())));
+        self.structs.extend(other.structs.iter().map(|(name, fields)| (name.clone(), fields.clone())));
+        self.constants.extend(other.constants.iter().map(|(name, constant)| (name.clone(), constant.clone())));
+    }
+
     // Clear main bytecode (used after loading stdlib to avoid accumulating bytecode)
     pub fn clear_main_bytecode(&mut self) {
         self.bytecode.clear();
+        self.locations = SourceMap::new();
+        self.slot_names = SlotNames::new();
         self.instruction_address = 0;
     }
 
+    // Source maps for everything compiled so far (main bytecode and named functions)
+    /// Parameter names of each compiled single-clause function, in argument order
+    pub fn function_params(&self) -> &HashMap<String, Vec<String>> {
+        &self.function_params
+    }
+
+    pub fn source_maps(&self) -> SourceMaps {
+        SourceMaps {
+            main: self.locations.clone(),
+            functions: self.function_locations.clone(),
+        }
+    }
+
+    /// Record the let-bound names in scope at each instruction, which the
+    /// debugger shows with a frame's locals
+    pub fn set_record_slot_names(&mut self, enabled: bool) {
+        self.record_slot_names = enabled;
+    }
+
+    /// Let-bound names recorded for everything compiled so far
+    pub fn slot_names(&self) -> ProgramSlotNames {
+        ProgramSlotNames {
+            main: self.slot_names.clone(),
+            functions: self.function_slot_names.clone(),
+        }
+    }
+
+    // Stack slots of the let and match bindings in scope, with their names
+    fn slots_in_scope(&self) -> Vec<(usize, String)> {
+        let mut slots: Vec<(usize, String)> = self.local_bindings.iter()
+            .chain(self.pattern_bindings.iter())
+            .filter_map(|(name, location)| match location {
+                ValueLocation::Local(slot) => Some((*slot, name.clone())),
+                ValueLocation::Cell(inner, _) => match **inner {
+                    ValueLocation::Local(slot) => Some((slot, name.clone())),
+                    _ => None,
+                },
+                _ => None,
+            })
+            .collect();
+        slots.sort();
+        slots
+    }
+
     fn emit(&mut self, instruction: Instruction) {
+        self.locations.record(self.bytecode.len(), &self.current_location);
+        if self.record_slot_names {
+            let slots = self.slots_in_scope();
+            self.slot_names.record(self.bytecode.len(), slots);
+        }
         self.bytecode.push(instruction);
         self.instruction_address += 1;
     }
 
+    // Compile an operand that stays on the stack while the next ones are compiled.
+    // It counts towards stack_depth, so let and match slots in later operands land
+    // above it; the caller takes it back off once an instruction consumes it.
+    fn compile_operand(&mut self, expr: &SourceExpr) -> Result<usize, CompileError> {
+        let start = self.compile_expr(expr)?;
+        self.stack_depth += 1;
+        Ok(start)
+    }
+
     // ==================== EXPRESSION COMPILATION ====================
 
     // Returns the starting address of compiled bytecode
+    // Instructions emitted for the expression are attributed to its source position
     fn compile_expr(&mut self, expr: &SourceExpr) -> Result<usize, CompileError> {
+        let saved_location = self.current_location.clone();
+        if expr.location.file != "<unknown>" {
+            self.current_location = expr.location.clone();
+        }
+        let result = self.compile_located_expr(expr);
+        self.current_location = saved_location;
+        result
+    }
+
+    fn compile_located_expr(&mut self, expr: &SourceExpr) -> Result<usize, CompileError> {
         let start_address = self.instruction_address;
 
         match &expr.expr {
@@ -115,6 +262,9 @@ impl Compiler {
             LispExpr::Boolean(b) => {
                 self.emit(Instruction::Push(Value::Boolean(*b)));
             }
+            LispExpr::Char(c) => {
+                self.emit(Instruction::Push(Value::Char(*c)));
+            }
 
             // Case: DottedList - only valid in patterns
             LispExpr::DottedList(_, _) => {
@@ -131,6 +281,9 @@ impl Compiler {
                 if s.starts_with("__STRING__") {
                     let string_content = s["__STRING__".len()..].to_string();
                     self.emit(Instruction::Push(Value::String(Arc::new(string_content))));
+                } else if Self::is_keyword(s) {
+                    // Keywords like :port evaluate to themselves
+                    self.emit(Instruction::Push(Value::symbol(s)));
                 } else {
                     // Check local bindings first (let bindings)
                     if let Some(location) = self.local_bindings.get(s) {
@@ -143,6 +296,9 @@ impl Compiler {
                     } else if let Some(idx) = self.param_names.iter().position(|p| p == s) {
                         // Check if this symbol is a parameter
                         self.emit(Instruction::LoadArg(idx));
+                    } else if let Some(value) = self.inlined_constant(s) {
+                        // A defconst with a known value needs no global lookup
+                        self.emit(Instruction::Push(value));
                     } else {
                         // Resolve the symbol name (handles imports and module context)
                         let resolved = self.resolve_global_name(s);
@@ -167,6 +323,9 @@ impl Compiler {
                                 s.clone()
                             };
                             self.emit(Instruction::Push(Value::Function(Arc::new(fn_name))));
+                        } else if self.defer_unresolved(s, &expr.location, false) {
+                            // Defined later in the program, or reported with the other undefined names
+                            self.emit(Instruction::LoadGlobal(s.clone()));
                         } else {
                             // Generate helpful suggestion for undefined variable
                             let suggestion = self.suggest_similar_name(s);
@@ -190,8 +349,21 @@ impl Compiler {
                     ));
                 }
 
-                // Check if operator is a symbol
-                if let LispExpr::Symbol(operator) = &items[0].expr {
+                // Locally bound names (let/letrec bindings, parameters) shadow special forms,
+                // so a named let called `loop` still calls the local closure. User macros
+                // can't be named after a special form, but can replace `when` or `unless`.
+                let local_operator = matches!(&items[0].expr, LispExpr::Symbol(s) if self.is_local_variable(s));
+                let macro_operator = matches!(&items[0].expr, LispExpr::Symbol(s) if self.macros.contains_key(s));
+
+                if let Some(value) = self.fold_constant(expr) {
+                    // Constant arithmetic and comparisons compile to their result
+                    self.emit(Instruction::Push(value));
+                } else if local_operator {
+                    self.compile_closure_variable_call(items)?;
+                } else if macro_operator {
+                    // Expand at compile time and compile the result
+                    self.compile_macro_call(expr)?;
+                } else if let LispExpr::Symbol(operator) = &items[0].expr {
                     // Operator is a symbol - might be special form, built-in, or function call
                     match operator.as_str() {
                     // Arithmetic operators: +, -, *, /
@@ -208,7 +380,7 @@ impl Compiler {
                         self.in_tail_position = false;
 
                         // Compile first argument
-                        self.compile_expr(&items[1])?;
+                        self.compile_operand(&items[1])?;
 
                         // For each remaining argument, compile it and emit Add
                         // This transforms (+ 1 2 3 4) into (+ 1 (+ 2 (+ 3 4)))
@@ -216,6 +388,7 @@ impl Compiler {
                             self.compile_expr(&items[i])?;
                             self.emit(Instruction::Add);
                         }
+                        self.stack_depth -= 1;
 
                         // Restore tail position
                         self.in_tail_position = saved_tail;
@@ -233,7 +406,7 @@ impl Compiler {
                         self.in_tail_position = false;
 
                         // Compile first argument
-                        self.compile_expr(&items[1])?;
+                        self.compile_operand(&items[1])?;
 
                         // For each remaining argument, compile it and emit Sub
                         // This does left-associative subtraction: (- 10 2 3) = (- (- 10 2) 3) = 5
@@ -241,6 +414,7 @@ impl Compiler {
                             self.compile_expr(&items[i])?;
                             self.emit(Instruction::Sub);
                         }
+                        self.stack_depth -= 1;
 
                         self.in_tail_position = saved_tail;
                     }
@@ -256,7 +430,7 @@ impl Compiler {
                         self.in_tail_position = false;
 
                         // Compile first argument
-                        self.compile_expr(&items[1])?;
+                        self.compile_operand(&items[1])?;
 
                         // For each remaining argument, compile it and emit Mul
                         // This transforms (* 2 3 4) into (* 2 (* 3 4)) = (* 2 12) = 24
@@ -264,6 +438,7 @@ impl Compiler {
                             self.compile_expr(&items[i])?;
                             self.emit(Instruction::Mul);
                         }
+                        self.stack_depth -= 1;
 
                         self.in_tail_position = saved_tail;
                     }
@@ -279,14 +454,36 @@ impl Compiler {
                         self.in_tail_position = false;
 
                         // Compile first argument
-                        self.compile_expr(&items[1])?;
+                        self.compile_operand(&items[1])?;
 
                         // For each remaining argument, compile it and emit Div
                         // This transforms (/ 20 2 2) into (/ (/ 20 2) 2) = (/ 10 2) = 5
+                        // Two integers truncate toward zero: (/ 7 2) is 3, (/ -7 2) is -3
                         for i in 2..items.len() {
                             self.compile_expr(&items[i])?;
                             self.emit(Instruction::Div);
                         }
+                        self.stack_depth -= 1;
+
+                        self.in_tail_position = saved_tail;
+                    }
+                    // Float division: (/. 1 2) => 0.5, whereas (/ 1 2) truncates to 0
+                    "/." => {
+                        if items.len() < 3 {
+                            return Err(CompileError::new(
+                                "/. expects at least 2 arguments".to_string(),
+                                expr.location.clone(),
+                            ));
+                        }
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+
+                        self.compile_operand(&items[1])?;
+                        for i in 2..items.len() {
+                            self.compile_expr(&items[i])?;
+                            self.emit(Instruction::FloatDiv);
+                        }
+                        self.stack_depth -= 1;
 
                         self.in_tail_position = saved_tail;
                     }
@@ -302,7 +499,7 @@ impl Compiler {
                         self.in_tail_position = false;
 
                         // Compile first argument
-                        self.compile_expr(&items[1])?;
+                        self.compile_operand(&items[1])?;
 
                         // For each remaining argument, compile it and emit Mod
                         // This transforms (% 10 3 2) into (% (% 10 3) 2) = (% 1 2) = 1
@@ -310,9 +507,30 @@ impl Compiler {
                             self.compile_expr(&items[i])?;
                             self.emit(Instruction::Mod);
                         }
+                        self.stack_depth -= 1;
 
                         self.in_tail_position = saved_tail;
                     }
+                    // Integer division compiles inline, so division by zero points at the call
+                    "quotient" | "remainder" | "modulo" => {
+                        if items.len() != 3 {
+                            return Err(CompileError::new(
+                                format!("{} expects exactly 2 arguments", operator),
+                                expr.location.clone(),
+                            ));
+                        }
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        self.compile_operand(&items[1])?;
+                        self.compile_operand(&items[2])?;
+                        self.stack_depth -= 2;
+                        self.emit(match operator.as_str() {
+                            "quotient" => Instruction::Quotient,
+                            "remainder" => Instruction::Remainder,
+                            _ => Instruction::Modulo,
+                        });
+                        self.in_tail_position = saved_tail;
+                    }
                     "neg" => {
                         if items.len() != 2 {
                             return Err(CompileError::new(
@@ -337,9 +555,10 @@ impl Compiler {
                         }
                         let saved_tail = self.in_tail_position;
                         self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
+                        self.compile_operand(&items[1])?;
                         self.compile_expr(&items[2])?;
                         self.emit(Instruction::Leq);
+                        self.stack_depth -= 1;
                         self.in_tail_position = saved_tail;
                     }
                     "<" => {
@@ -349,9 +568,13 @@ impl Compiler {
                                 expr.location.clone(),
                             ));
                         }
-                        self.compile_expr(&items[1])?;
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        self.compile_operand(&items[1])?;
                         self.compile_expr(&items[2])?;
                         self.emit(Instruction::Lt);
+                        self.stack_depth -= 1;
+                        self.in_tail_position = saved_tail;
                     }
                     ">" => {
                         if items.len() != 3 {
@@ -360,9 +583,13 @@ impl Compiler {
                                 expr.location.clone(),
                             ));
                         }
-                        self.compile_expr(&items[1])?;
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        self.compile_operand(&items[1])?;
                         self.compile_expr(&items[2])?;
                         self.emit(Instruction::Gt);
+                        self.stack_depth -= 1;
+                        self.in_tail_position = saved_tail;
                     }
                     ">=" => {
                         if items.len() != 3 {
@@ -371,20 +598,29 @@ impl Compiler {
                                 expr.location.clone(),
                             ));
                         }
-                        self.compile_expr(&items[1])?;
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        self.compile_operand(&items[1])?;
                         self.compile_expr(&items[2])?;
                         self.emit(Instruction::Gte);
+                        self.stack_depth -= 1;
+                        self.in_tail_position = saved_tail;
                     }
-                    "==" => {
+                    "==" | "=" => {
                         if items.len() != 3 {
                             return Err(CompileError::new(
-                                "== expects exactly 2 arguments".to_string(),
+                                format!("{} expects exactly 2 arguments", operator),
                                 expr.location.clone(),
                             ));
                         }
-                        self.compile_expr(&items[1])?;
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        self.compile_operand(&items[1])?;
                         self.compile_expr(&items[2])?;
-                        self.emit(Instruction::Eq);
+                        // = is numeric equality; == compares any two values
+                        self.emit(if operator == "=" { Instruction::NumEq } else { Instruction::Eq });
+                        self.stack_depth -= 1;
+                        self.in_tail_position = saved_tail;
                     }
                     "!=" => {
                         if items.len() != 3 {
@@ -393,9 +629,19 @@ impl Compiler {
                                 expr.location.clone(),
                             ));
                         }
-                        self.compile_expr(&items[1])?;
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        self.compile_operand(&items[1])?;
                         self.compile_expr(&items[2])?;
                         self.emit(Instruction::Neq);
+                        self.stack_depth -= 1;
+                        self.in_tail_position = saved_tail;
+                    }
+
+                    // Conditional with a constant condition: only the taken branch is compiled
+                    "if" if items.len() == 4 && self.fold_condition(&items[1]).is_some() => {
+                        let taken = if self.fold_condition(&items[1]) == Some(true) { &items[2] } else { &items[3] };
+                        self.compile_expr(taken)?;
                     }
 
                     // Conditional: (if condition then-branch else-branch)
@@ -455,14 +701,7 @@ impl Compiler {
                             ));
                         }
 
-                        if items.len() == 2 {
-                            // Single expression: just compile it
-                            self.compile_expr(&items[1])?;
-                        } else {
-                            // Multiple expressions: compile as nested if expressions
-                            // (and a b c) => (if a (if b c false) false)
-                            self.compile_and_helper(&items[1..], expr)?;
-                        }
+                        self.compile_short_circuit(&items[1..], Instruction::JmpIfFalseOrPop)?;
                     }
 
                     // Logical or: (or expr1 expr2 ...) - short-circuit on true
@@ -474,25 +713,12 @@ impl Compiler {
                             ));
                         }
 
-                        if items.len() == 2 {
-                            // Single expression: just compile it
-                            self.compile_expr(&items[1])?;
-                        } else {
-                            // Multiple expressions: compile as nested if expressions
-                            // (or a b c) => (if a true (if b true c))
-                            self.compile_or_helper(&items[1..], expr)?;
-                        }
+                        self.compile_short_circuit(&items[1..], Instruction::JmpIfTrueOrPop)?;
                     }
 
                     // Cond: (cond (test1 expr1) (test2 expr2) ... (else default))
+                    // An empty (cond) evaluates to nil
                     "cond" => {
-                        if items.len() < 2 {
-                            return Err(CompileError::new(
-                                "cond expects at least 1 clause".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-
                         self.compile_cond(&items[1..], expr)?;
                     }
 
@@ -575,12 +801,12 @@ impl Compiler {
                         self.in_tail_position = saved_tail;
                     }
 
-                    // Do/Begin: (do expr1 expr2 ... exprN) or (begin expr1 expr2 ... exprN)
+                    // Do/Begin/Progn: (do expr1 expr2 ... exprN), likewise begin and progn
                     // Sequences side effects - evaluates all expressions, returns last value
-                    "do" | "begin" => {
+                    "do" | "begin" | "progn" => {
                         if items.len() < 2 {
                             return Err(CompileError::new(
-                                "do/begin expects at least 1 expression".to_string(),
+                                format!("{} expects at least 1 expression", operator),
                                 expr.location.clone(),
                             ));
                         }
@@ -603,15 +829,121 @@ impl Compiler {
                     }
 
                     // Print: (print expr)
-                    "print" => {
-                        if items.len() != 2 {
+                    // (print value) writes to stdout, (print value port) to an output port.
+                    // println is the same. print displays the value and a newline;
+                    // write shows it as the reader reads it back, display for people,
+                    // and neither adds a newline
+                    "print" | "println" | "write" | "display" => {
+                        if items.len() != 2 && items.len() != 3 {
+                            return Err(CompileError::new(
+                                format!("{} expects 1 or 2 arguments: the value and an optional output port", operator),
+                                expr.location.clone(),
+                            ));
+                        }
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        for arg in &items[1..] {
+                            self.compile_operand(arg)?;
+                        }
+                        self.stack_depth -= items.len() - 1;
+                        let instruction = match (operator.as_str(), items.len()) {
+                            ("write", 2) => Instruction::Write,
+                            ("write", _) => Instruction::WriteTo,
+                            ("display", 2) => Instruction::Display,
+                            ("display", _) => Instruction::DisplayTo,
+                            (_, 2) => Instruction::Print,
+                            _ => Instruction::PrintTo,
+                        };
+                        self.emit(instruction);
+                        self.in_tail_position = saved_tail;
+                    }
+
+                    // (newline) ends the line on stdout, (newline port) on an output port
+                    "newline" => {
+                        if items.len() > 2 {
+                            return Err(CompileError::new(
+                                "newline expects at most 1 argument: an optional output port".to_string(),
+                                expr.location.clone(),
+                            ));
+                        }
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        self.emit(Instruction::Push(Value::string("\n")));
+                        if items.len() == 2 {
+                            self.stack_depth += 1;
+                            self.compile_expr(&items[1])?;
+                            self.stack_depth -= 1;
+                            self.emit(Instruction::DisplayTo);
+                        } else {
+                            self.emit(Instruction::Display);
+                        }
+                        self.in_tail_position = saved_tail;
+                    }
+
+                    // (pp value) writes a value cut down to a depth and length, over lines that fit
+                    "pp" => self.compile_pp(expr, items)?,
+
+                    // (gensym) and (gensym "prefix") make a symbol no other equals
+                    "gensym" => self.compile_gensym(expr, items)?,
+
+                    // (read-line) reads from stdin, (read-line port) from an input port
+                    "read-line" => {
+                        if items.len() > 2 {
+                            return Err(CompileError::new(
+                                "read-line expects at most 1 argument: an optional input port".to_string(),
+                                expr.location.clone(),
+                            ));
+                        }
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        if items.len() == 2 {
+                            self.compile_expr(&items[1])?;
+                            self.emit(Instruction::ReadLineFrom);
+                        } else {
+                            self.emit(Instruction::ReadLine);
+                        }
+                        self.in_tail_position = saved_tail;
+                    }
+
+                    // Values: (values expr ...) - return several values to call-with-values
+                    "values" => {
+                        let count = items.len() - 1;
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        for arg in &items[1..] {
+                            self.compile_operand(arg)?;
+                        }
+                        self.stack_depth -= items.len() - 1;
+                        self.in_tail_position = saved_tail;
+
+                        if self.leaves_function(saved_tail) {
+                            // Returning from the function: the caller decides how many it wants
+                            self.emit(Instruction::Values(count));
+                        } else if count == 0 {
+                            self.emit(Instruction::Push(Value::List(List::Nil)));
+                        } else if count > 1 {
+                            // Used as an ordinary expression: keep only the primary value
+                            self.emit(Instruction::PopN(count - 1));
+                        }
+                    }
+
+                    // Call-with-values: (call-with-values producer consumer) - call producer
+                    // with no arguments, then call consumer with every value it returned
+                    "call-with-values" => {
+                        if items.len() != 3 {
                             return Err(CompileError::new(
-                                "print expects exactly 1 argument".to_string(),
+                                "call-with-values expects exactly 2 arguments: producer and consumer".to_string(),
                                 expr.location.clone(),
                             ));
                         }
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        self.compile_operand(&items[2])?;
                         self.compile_expr(&items[1])?;
-                        self.emit(Instruction::Print);
+                        self.stack_depth -= 1;
+                        self.emit(Instruction::CallForValues);
+                        self.emit(Instruction::ApplyValues);
+                        self.in_tail_position = saved_tail;
                     }
 
                     // Quote: (quote expr) - return expr unevaluated as a list
@@ -665,7 +997,7 @@ impl Compiler {
                                     if let Some(macro_def) = self.macros.get(name).cloned() {
                                         // It's a macro - expand it
                                         let args = &form_items[1..];
-                                        let expanded = self.expand_macro(&macro_def, args)?;
+                                        let expanded = self.expand_macro(name, &macro_def, args, &actual_form.location)?;
                                         // Return the expanded form as a value
                                         let value = self.expr_to_value(&expanded)?;
                                         self.emit(Instruction::Push(value));
@@ -694,35 +1026,98 @@ impl Compiler {
                     "list" => {
                         // list is variadic - compile all arguments and use MakeList
                         let arg_count = items.len() - 1; // Exclude 'list' itself
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
                         for arg in &items[1..] {
-                            self.compile_expr(arg)?;
+                            self.compile_operand(arg)?;
                         }
+                        self.stack_depth -= items.len() - 1;
                         self.emit(Instruction::MakeList(arg_count));
+                        self.in_tail_position = saved_tail;
                     }
 
-                    "hash-map" => {
+                    "hash-map" | "make-map" | "make-hash-table" => {
                         // hash-map expects key-value pairs: (hash-map "key1" val1 "key2" val2 ...)
+                        // make-map is the same, and is what {key val ...} literals read as;
+                        // make-hash-table names the same map for the hash-* builtins
                         let arg_count = items.len() - 1; // Exclude 'hash-map' itself
                         if arg_count % 2 != 0 {
                             return Err(CompileError::new(
-                                "hash-map expects an even number of arguments (key-value pairs)".to_string(),
+                                format!("{} expects an even number of arguments (key-value pairs)", operator),
                                 expr.location.clone(),
                             ));
                         }
                         // Compile all key-value pairs
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
                         for arg in &items[1..] {
-                            self.compile_expr(arg)?;
+                            self.compile_operand(arg)?;
                         }
+                        self.stack_depth -= items.len() - 1;
                         self.emit(Instruction::MakeHashMap(arg_count / 2));
+                        self.in_tail_position = saved_tail;
+                    }
+
+                    // Map-get: (map-get map key) or (map-get map key default), hash-ref is the same
+                    "map-get" | "hash-ref" => {
+                        if items.len() != 3 && items.len() != 4 {
+                            return Err(CompileError::new(
+                                format!("{} expects 2 or 3 arguments: map, key and an optional default", operator),
+                                expr.location.clone(),
+                            ));
+                        }
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        for arg in &items[1..] {
+                            self.compile_operand(arg)?;
+                        }
+                        self.stack_depth -= items.len() - 1;
+                        if items.len() == 4 {
+                            self.emit(Instruction::HashMapGetOr);
+                        } else {
+                            self.emit(Instruction::HashMapGet);
+                        }
+                        self.in_tail_position = saved_tail;
+                    }
+
+                    // Vector access compiles inline, so an index error points at the call
+                    "vector-ref" | "vector-set!" | "vector-length" => {
+                        let (arg_count, params) = match operator.as_str() {
+                            "vector-ref" => (2, "vector and index"),
+                            "vector-set!" => (3, "vector, index and value"),
+                            _ => (1, "vector"),
+                        };
+                        if items.len() != arg_count + 1 {
+                            return Err(CompileError::new(
+                                format!("{} expects {} argument(s): {}", operator, arg_count, params),
+                                expr.location.clone(),
+                            ));
+                        }
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        for arg in &items[1..] {
+                            self.compile_operand(arg)?;
+                        }
+                        self.stack_depth -= arg_count;
+                        self.emit(match operator.as_str() {
+                            "vector-ref" => Instruction::VectorGet,
+                            "vector-set!" => Instruction::VectorSetInPlace,
+                            _ => Instruction::VectorLength,
+                        });
+                        self.in_tail_position = saved_tail;
                     }
 
                     "vector" => {
                         // vector is variadic - compile all arguments and use MakeVector
                         let arg_count = items.len() - 1; // Exclude 'vector' itself
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
                         for arg in &items[1..] {
-                            self.compile_expr(arg)?;
+                            self.compile_operand(arg)?;
                         }
+                        self.stack_depth -= items.len() - 1;
                         self.emit(Instruction::MakeVector(arg_count));
+                        self.in_tail_position = saved_tail;
                     }
 
                     // FFI call: (ffi-call func-ptr (arg-types...) return-type arg1 arg2 ...)
@@ -753,16 +1148,22 @@ impl Compiler {
                             ));
                         }
 
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+
                         // Compile function pointer expression
-                        self.compile_expr(&items[1])?;
+                        self.compile_operand(&items[1])?;
 
                         // Compile all arguments
                         for arg in &items[4..] {
-                            self.compile_expr(arg)?;
+                            self.compile_operand(arg)?;
                         }
+                        self.stack_depth -= items.len() - 3;
 
                         // Emit FFI call instruction with type info
                         self.emit(Instruction::FfiCall(arg_types, return_type));
+
+                        self.in_tail_position = saved_tail;
                     }
 
                     // Quasiquote: (quasiquote expr) - like quote but allows unquote and unquote-splicing
@@ -773,447 +1174,377 @@ impl Compiler {
                                 expr.location.clone(),
                             ));
                         }
-                        self.compile_quasiquote(&items[1])?;
+                        // Unquoted expressions are assembled into a list, never in tail position
+                        let saved_tail = self.in_tail_position;
+                        self.in_tail_position = false;
+                        self.compile_quasiquote(&items[1], 1)?;
+                        self.in_tail_position = saved_tail;
                     }
 
                     // Let: (let ((var val) ...) body)
                     "let" => {
-                        if items.len() != 3 {
-                            return Err(CompileError::new(
-                                "let expects exactly 2 arguments: bindings and body".to_string(),
-                                expr.location.clone(),
-                            ));
+                        match (items.len(), &items.get(1).map(|i| &i.expr)) {
+                            // Named let: (let name ((var init) ...) body)
+                            (4, Some(LispExpr::Symbol(name))) => {
+                                self.compile_named_let(name, &items[2], &items[3], expr)?;
+                            }
+                            (3, _) => {
+                                self.compile_let("let", &items[1], &items[2])?;
+                            }
+                            _ => {
+                                return Err(CompileError::new(
+                                    "let expects exactly 2 arguments: bindings and body".to_string(),
+                                    expr.location.clone(),
+                                ));
+                            }
                         }
-
-                        self.compile_let(&items[1], &items[2])?;
                     }
 
-                    // Loop: (loop [bindings] body)
-                    "loop" => {
+                    // Let*: (let* ((var val) ...) body) - each binding sees the ones before it
+                    "let*" => {
                         if items.len() != 3 {
                             return Err(CompileError::new(
-                                "loop expects exactly 2 arguments: bindings and body".to_string(),
+                                "let* expects exactly 2 arguments: bindings and body".to_string(),
                                 expr.location.clone(),
                             ));
                         }
 
-                        self.compile_loop(&items[1], &items[2])?;
+                        self.compile_let("let*", &items[1], &items[2])?;
                     }
 
-                    // Recur: (recur new-values...)
-                    "recur" => {
-                        if items.len() < 1 {
+                    // Letrec: (letrec ((name val) ...) body) - bindings visible in their own initializers
+                    "letrec" => {
+                        if items.len() != 3 {
                             return Err(CompileError::new(
-                                "recur expects at least 0 arguments".to_string(),
+                                "letrec expects exactly 2 arguments: bindings and body".to_string(),
                                 expr.location.clone(),
                             ));
                         }
 
-                        self.compile_recur(&items[1..])?;
+                        self.compile_letrec(&items[1], &items[2])?;
                     }
 
-                    // Lambda: (lambda (params) body)
-                    "lambda" => {
+                    // Loop: (loop [bindings] body)
+                    "loop" => {
                         if items.len() != 3 {
                             return Err(CompileError::new(
-                                "lambda expects exactly 2 arguments: parameters and body".to_string(),
+                                "loop expects exactly 2 arguments: bindings and body".to_string(),
                                 expr.location.clone(),
                             ));
                         }
-                        self.compile_lambda(&items[1], &items[2])?;
+
+                        self.compile_loop(&items[1], &items[2])?;
                     }
 
-                    // List operations
-                    "cons" => {
-                        if items.len() != 3 {
-                            return Err(CompileError::new(
-                                "cons expects exactly 2 arguments".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.compile_expr(&items[2])?;
-                        self.emit(Instruction::Cons);
-                        self.in_tail_position = saved_tail;
+                    // Dotimes: (dotimes (i n) body...) and dolist: (dolist (x lst) body...)
+                    "dotimes" => {
+                        self.compile_dotimes(expr, items)?;
                     }
-                    "car" => {
-                        if items.len() != 2 {
-                            return Err(CompileError::new(
-                                "car expects exactly 1 argument".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::Car);
-                        self.in_tail_position = saved_tail;
+                    "dolist" => {
+                        self.compile_dolist(expr, items)?;
                     }
-                    "cdr" => {
-                        if items.len() != 2 {
-                            return Err(CompileError::new(
-                                "cdr expects exactly 1 argument".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::Cdr);
-                        self.in_tail_position = saved_tail;
+
+                    // Recur: (recur new-values...)
+                    "recur" => {
+                        self.compile_recur(expr, &items[1..])?;
                     }
-                    "list?" => {
-                        if items.len() != 2 {
-                            return Err(CompileError::new(
-                                "list? expects exactly 1 argument".to_string(),
-                                expr.location.clone(),
-                            ));
+
+                    // Lambda: (lambda (params) body)
+                    "lambda" => {
+                        match items.len() {
+                            0..=2 => {
+                                return Err(CompileError::new(
+                                    "lambda expects parameters and a body".to_string(),
+                                    expr.location.clone(),
+                                ));
+                            }
+                            3 => self.compile_lambda(&items[1], &items[2])?,
+                            _ => {
+                                // Several body expressions run in sequence, as in (do ...)
+                                let mut body = vec![SourceExpr::new(LispExpr::Symbol("do".to_string()), items[0].location.clone())];
+                                body.extend(items[2..].iter().cloned());
+                                let body = SourceExpr::new(LispExpr::List(body), expr.location.clone());
+                                self.compile_lambda(&items[1], &body)?;
+                            }
                         }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::IsList);
-                        self.in_tail_position = saved_tail;
                     }
 
-                    // String/Symbol operations
-                    "string?" => {
-                        if items.len() != 2 {
-                            return Err(CompileError::new(
-                                "string? expects exactly 1 argument".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::IsString);
-                        self.in_tail_position = saved_tail;
+                    // Set!: (set! name value) - assign an existing local binding, returns the value
+                    "set!" => {
+                        self.compile_set(expr, items)?;
                     }
-                    "symbol?" => {
-                        if items.len() != 2 {
-                            return Err(CompileError::new(
-                                "symbol? expects exactly 1 argument".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::IsSymbol);
-                        self.in_tail_position = saved_tail;
+
+                    // Handler-case: (handler-case expr (catch (e) body...)) - the value of expr,
+                    // or of the catch body with e bound to whatever was raised evaluating it
+                    "handler-case" => {
+                        self.compile_handler_case(expr, items)?;
                     }
-                    "symbol->string" => {
+
+                    // Raise: (raise value) - unwind to the innermost handler-case with value
+                    "raise" => {
                         if items.len() != 2 {
                             return Err(CompileError::new(
-                                "symbol->string expects exactly 1 argument".to_string(),
+                                "raise expects exactly 1 argument".to_string(),
                                 expr.location.clone(),
                             ));
                         }
                         let saved_tail = self.in_tail_position;
                         self.in_tail_position = false;
                         self.compile_expr(&items[1])?;
-                        self.emit(Instruction::SymbolToString);
+                        self.emit(Instruction::Raise);
                         self.in_tail_position = saved_tail;
                     }
-                    "string->symbol" => {
-                        if items.len() != 2 {
-                            return Err(CompileError::new(
-                                "string->symbol expects exactly 1 argument".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::StringToSymbol);
-                        self.in_tail_position = saved_tail;
+
+                    // Include: only top-level includes are replaced, before compiling
+                    "include" => {
+                        return Err(CompileError::new(
+                            "include is only allowed at the top level of a file".to_string(),
+                            expr.location.clone(),
+                        ));
                     }
-                    "string-length" => {
-                        if items.len() != 2 {
-                            return Err(CompileError::new(
-                                "string-length expects exactly 1 argument".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::StringLength);
-                        self.in_tail_position = saved_tail;
+
+                    // Case: (case key (keys body...) ... (else body...)) - dispatch on literal keys, nil when none match
+                    "case" => {
+                        self.compile_case(expr, items)?;
                     }
-                    "substring" => {
-                        if items.len() != 4 {
-                            return Err(CompileError::new(
-                                "substring expects exactly 3 arguments (string, start, end)".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?; // string
-                        self.compile_expr(&items[2])?; // start
-                        self.compile_expr(&items[3])?; // end
-                        self.emit(Instruction::Substring);
-                        self.in_tail_position = saved_tail;
+
+                    // Match: (match expr (pattern body...) ...) - the body of the first clause whose pattern matches
+                    "match" => {
+                        self.compile_match(expr, items)?;
+                    }
+
+                    // Catch: (catch tag body...) - the value of the body, or the value thrown to tag inside it
+                    "catch" => {
+                        self.compile_catch(expr, items)?;
                     }
-                    "string-append" => {
+
+                    // Throw: (throw tag value) - unwind to the innermost catch for tag, which returns value
+                    "throw" => {
                         if items.len() != 3 {
                             return Err(CompileError::new(
-                                "string-append expects exactly 2 arguments".to_string(),
+                                "throw expects a tag and a value".to_string(),
                                 expr.location.clone(),
                             ));
                         }
                         let saved_tail = self.in_tail_position;
                         self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
+                        // The tag holds a stack slot below the value's bindings
+                        self.compile_operand(&items[1])?;
                         self.compile_expr(&items[2])?;
-                        self.emit(Instruction::StringAppend);
+                        self.stack_depth -= 1;
+                        self.emit(Instruction::Throw);
                         self.in_tail_position = saved_tail;
                     }
-                    "string->list" => {
-                        if items.len() != 2 {
+
+                    // Time: (time body...) - evaluate the body and report how long it took
+                    "time" => {
+                        if items.len() < 2 {
                             return Err(CompileError::new(
-                                "string->list expects exactly 1 argument".to_string(),
+                                "time expects at least 1 expression".to_string(),
                                 expr.location.clone(),
                             ));
                         }
+                        let body = if items.len() == 2 {
+                            items[1].clone()
+                        } else {
+                            let mut body = vec![SourceExpr::new(LispExpr::Symbol("do".to_string()), items[0].location.clone())];
+                            body.extend(items[1..].iter().cloned());
+                            SourceExpr::new(LispExpr::List(body), expr.location.clone())
+                        };
                         let saved_tail = self.in_tail_position;
                         self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::StringToList);
+                        // The three readings stay on the stack below the body's bindings
+                        self.emit(Instruction::TimeStart);
+                        self.stack_depth += 3;
+                        self.compile_expr(&body)?;
+                        self.stack_depth -= 3;
+                        self.emit(Instruction::TimeEnd);
                         self.in_tail_position = saved_tail;
                     }
-                    "list->string" => {
-                        if items.len() != 2 {
-                            return Err(CompileError::new(
-                                "list->string expects exactly 1 argument".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::ListToString);
-                        self.in_tail_position = saved_tail;
+
+                    // Assert: (assert expr) - true, or an error quoting expr when it is false
+                    "assert" => {
+                        self.compile_assert(expr, items)?;
                     }
 
-                    // File I/O operations
-                    "read-file" => {
-                        if items.len() != 2 {
-                            return Err(CompileError::new(
-                                "read-file expects exactly 1 argument (path)".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::ReadFile);
-                        self.in_tail_position = saved_tail;
+                    // Assert-equal: (assert-equal expected actual) - true, or an error showing both values
+                    "assert-equal" => {
+                        self.compile_assert_equal(expr, items)?;
                     }
-                    "write-file" => {
-                        if items.len() != 3 {
-                            return Err(CompileError::new(
-                                "write-file expects exactly 2 arguments (path, content)".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?; // path
-                        self.compile_expr(&items[2])?; // content
-                        self.emit(Instruction::WriteFile);
-                        self.in_tail_position = saved_tail;
+
+                    // Deftest: only at the top level, where the test runner can find it
+                    "deftest" => {
+                        return Err(CompileError::new(
+                            "deftest is only allowed at the top level of a file".to_string(),
+                            expr.location.clone(),
+                        ));
                     }
-                    "file-exists?" => {
-                        if items.len() != 2 {
+
+                    // Apply: (apply f a b ... lst) - call f with a, b, ... and the elements of lst
+                    "apply" => {
+                        if items.len() < 3 {
                             return Err(CompileError::new(
-                                "file-exists? expects exactly 1 argument (path)".to_string(),
+                                "apply expects a function and an argument list".to_string(),
                                 expr.location.clone(),
                             ));
                         }
                         let saved_tail = self.in_tail_position;
                         self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::FileExists);
+                        for arg in &items[1..] {
+                            self.compile_operand(arg)?;
+                        }
+                        self.stack_depth -= items.len() - 1;
+                        let leading = items.len() - 3;
+                        if leading > 0 {
+                            self.emit(Instruction::PrependArgs(leading));
+                        }
+                        // In tail position the applied function replaces the current frame
+                        if self.leaves_function(saved_tail) {
+                            self.emit(Instruction::TailApply);
+                        } else {
+                            self.emit(Instruction::Apply);
+                        }
                         self.in_tail_position = saved_tail;
                     }
 
+                    // List, string, rounding and file primitives
+                    "cons" | "car" | "cdr" | "list?" | "string?" | "symbol?" | "symbol->string" | "string->symbol" |
+                    "string-length" | "substring" | "string-append" | "eq?" | "eqv?" | "equal?" | "string=?" | "string->list" | "list->string" |
+                    "floor" | "ceil" | "round" |
+                    "read-file" | "write-file" | "file-exists?" | "write-binary-file" | "char-code" => {
+                        self.compile_primitive(expr, operator, items)?;
+                    }
+
                     // Command-line arguments
-                    "get-args" => {
+                    "get-args" | "command-line-args" => {
                         if items.len() != 1 {
                             return Err(CompileError::new(
-                                "get-args expects no arguments".to_string(),
+                                format!("{} expects no arguments", operator),
                                 expr.location.clone(),
                             ));
                         }
                         self.emit(Instruction::GetArgs);
                     }
-                    "write-binary-file" => {
-                        if items.len() != 3 {
-                            return Err(CompileError::new(
-                                "write-binary-file expects exactly 2 arguments (path, bytes)".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?; // path
-                        self.compile_expr(&items[2])?; // bytes list
-                        self.emit(Instruction::WriteBinaryFile);
-                        self.in_tail_position = saved_tail;
+                    "char->integer" | "integer->char" | "char=?" | "char<?" | "string-ref" |
+                    "char-alphabetic?" | "char-numeric?" | "char-whitespace?" => {
+                        self.compile_char_builtin(expr, operator, items)?;
                     }
-                    "char-code" => {
-                        if items.len() != 2 {
-                            return Err(CompileError::new(
-                                "char-code expects exactly 1 argument (single-char string)".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::CharCode);
-                        self.in_tail_position = saved_tail;
+                    "checked-add" | "checked-sub" | "checked-mul" |
+                    "wrapping-add" | "wrapping-sub" | "wrapping-mul" => {
+                        self.compile_fixed_width_builtin(expr, operator, items)?;
+                    }
+                    "bit-and" | "bit-or" | "bit-xor" | "bit-not" | "shift-left" | "shift-right" => {
+                        self.compile_bitwise_builtin(expr, operator, items)?;
                     }
 
                     // List operations
-                    "list-ref" => {
-                        if items.len() != 3 {
-                            return Err(CompileError::new(
-                                "list-ref expects exactly 2 arguments (list, index)".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?; // list
-                        self.compile_expr(&items[2])?; // index
-                        self.emit(Instruction::ListRef);
-                        self.in_tail_position = saved_tail;
+                    "list-ref" | "nth" | "list-length" | "length" | "reverse" | "append" => {
+                        self.compile_list_builtin(expr, operator, items)?;
                     }
-                    "list-length" => {
-                        if items.len() != 2 {
-                            return Err(CompileError::new(
-                                "list-length expects exactly 1 argument (list)".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::ListLength);
-                        self.in_tail_position = saved_tail;
+
+                    // Written only by compile_keyword_defun, for the body of a function with &key parameters
+                    "__check-keywords" | "__keyword-arg" => {
+                        self.compile_keyword_form(operator, items)?;
                     }
-                    "append" => {
-                        if items.len() != 3 {
-                            return Err(CompileError::new(
-                                "append expects exactly 2 arguments (list1, list2)".to_string(),
-                                expr.location.clone(),
-                            ));
-                        }
-                        let saved_tail = self.in_tail_position;
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[1])?; // first list
-                        self.compile_expr(&items[2])?; // second list
-                        self.emit(Instruction::Append);
-                        self.in_tail_position = saved_tail;
+
+                    // Promises: (delay expr) and (cons-stream a b) don't evaluate the delayed expression
+                    "delay" | "cons-stream" => {
+                        self.compile_promise_form(expr, operator, items)?;
                     }
 
-                    // Number operations
-                    "number->string" => {
-                        if items.len() != 2 {
+                    // Number conversions: (number->string n) or (number->string n radix),
+                    // string->number is the same
+                    "number->string" | "string->number" => {
+                        if items.len() != 2 && items.len() != 3 {
                             return Err(CompileError::new(
-                                "number->string expects exactly 1 argument (integer)".to_string(),
+                                format!("{} expects 1 or 2 arguments: the value and an optional radix (2, 8, 10 or 16)", operator),
                                 expr.location.clone(),
                             ));
                         }
                         let saved_tail = self.in_tail_position;
                         self.in_tail_position = false;
-                        self.compile_expr(&items[1])?;
-                        self.emit(Instruction::NumberToString);
+                        for arg in &items[1..] {
+                            self.compile_operand(arg)?;
+                        }
+                        self.stack_depth -= items.len() - 1;
+                        let instruction = match (operator.as_str(), items.len()) {
+                            ("number->string", 2) => Instruction::NumberToString,
+                            ("number->string", _) => Instruction::NumberToStringRadix,
+                            (_, 2) => Instruction::StringToNumber,
+                            _ => Instruction::StringToNumberRadix,
+                        };
+                        self.emit(instruction);
                         self.in_tail_position = saved_tail;
                     }
 
-                    // User-defined function call or closure variable or macro
+                    // User-defined function call or closure variable
                     _ => {
-                        // Check if it's a macro
-                        if let Some(macro_def) = self.macros.get(operator).cloned() {
-                            // It's a macro - expand it at compile time
-                            let args: Vec<SourceExpr> = items[1..].to_vec();
-                            let expanded = self.expand_macro(&macro_def, &args)?;
-                            // Compile the expanded expression
-                            self.compile_expr(&expanded)?;
+                        // Check if operator is a variable (could be a closure)
+                        if self.is_local_variable(operator) || self.is_global_variable(operator) {
+                            self.compile_closure_variable_call(items)?;
                         } else {
-                            // Check if operator is a variable (could be a closure)
-                            let is_variable = self.local_bindings.contains_key(operator)
-                                || self.pattern_bindings.contains_key(operator)
-                                || self.param_names.contains(operator);
-
-                            if is_variable {
-                                // It's a variable - load it as a closure and use CallClosure
-                                let saved_tail = self.in_tail_position;
-
-                                // Closure and arguments are not in tail position
-                                self.in_tail_position = false;
-                                self.compile_variable_load(operator)?;
-
-                                // Compile all arguments
-                                let arg_count = items.len() - 1;
-                                for i in 1..items.len() {
-                                    self.compile_expr(&items[i])?;
-                                }
+                            // It's a regular function call
+                            let arg_count = items.len() - 1;
+                            let is_tail_call = self.in_tail_position;
 
-                                // Call the closure
-                                self.emit(Instruction::CallClosure(arg_count));
+                            // Arguments are not in tail position
+                            self.in_tail_position = false;
+                            for i in 1..items.len() {
+                                self.compile_operand(&items[i])?;
+                            }
+                            self.stack_depth -= arg_count;
+
+                            // Resolve the function name:
+                            // 1. Check for imported symbol alias
+                            // 2. If in a module and no "/" in name, try module-local first
+                            // 3. Otherwise use the operator as-is (may be qualified like "math/add")
+                            let resolved_name = self.resolve_function_name(operator);
+                            if !self.is_defined_function(&resolved_name) {
+                                self.defer_unresolved(&resolved_name, &items[0].location, true);
+                            } else if let Some(error) = self.arity_error(&resolved_name, arg_count, &expr.location) {
+                                return Err(error);
+                            } else if let Some(error) = self.keyword_error(&resolved_name, &items[1..], &expr.location) {
+                                return Err(error);
+                            } else if matches!(resolved_name.as_str(), "load" | "require" | "eval") {
+                                self.defines_at_runtime = true;
+                            }
 
-                                self.in_tail_position = saved_tail;
+                            // Emit TailCall if in tail position, otherwise Call
+                            if self.leaves_function(is_tail_call) {
+                                self.emit(Instruction::TailCall(resolved_name, arg_count));
                             } else {
-                                // It's a regular function call
-                                let arg_count = items.len() - 1;
-                                let is_tail_call = self.in_tail_position;
-
-                                // Arguments are not in tail position
-                                self.in_tail_position = false;
-                                for i in 1..items.len() {
-                                    self.compile_expr(&items[i])?;
-                                }
-
-                                // Resolve the function name:
-                                // 1. Check for imported symbol alias
-                                // 2. If in a module and no "/" in name, try module-local first
-                                // 3. Otherwise use the operator as-is (may be qualified like "math/add")
-                                let resolved_name = self.resolve_function_name(operator);
-
-                                // Emit TailCall if in tail position, otherwise Call
-                                if is_tail_call {
-                                    self.emit(Instruction::TailCall(resolved_name, arg_count));
-                                } else {
-                                    self.emit(Instruction::Call(resolved_name, arg_count));
-                                }
-
-                                // Restore tail position
-                                self.in_tail_position = is_tail_call;
+                                self.emit(Instruction::Call(resolved_name, arg_count));
                             }
+
+                            // Restore tail position
+                            self.in_tail_position = is_tail_call;
                         }
                     }
                 }
             } else {
                 // Non-symbol operator - should be a closure expression
+                // Operator and arguments are not in tail position
+                let saved_tail = self.in_tail_position;
+                self.in_tail_position = false;
+
                 // Compile the operator expression (should produce a closure)
-                self.compile_expr(&items[0])?;
+                self.compile_operand(&items[0])?;
 
                 // Compile all arguments
                 let arg_count = items.len() - 1;
                 for i in 1..items.len() {
-                    self.compile_expr(&items[i])?;
+                    self.compile_operand(&items[i])?;
                 }
+                self.stack_depth -= items.len();
 
-                // Call the closure
-                self.emit(Instruction::CallClosure(arg_count));
+                // Call the closure (reusing the frame when in tail position)
+                if self.leaves_function(saved_tail) {
+                    self.emit(Instruction::TailCallClosure(arg_count));
+                } else {
+                    self.emit(Instruction::CallClosure(arg_count));
+                }
+
+                self.in_tail_position = saved_tail;
             }
             }
         }
@@ -1223,49 +1554,25 @@ impl Compiler {
 
     // Convert a SourceExpr to a runtime Value (for quote)
     fn expr_to_value(&self, expr: &SourceExpr) -> Result<Value, CompileError> {
-        match &expr.expr {
-            LispExpr::Number(n) => Ok(Value::Integer(*n)),
-            LispExpr::Float(f) => Ok(Value::Float(*f)),
-            LispExpr::Boolean(b) => Ok(Value::Boolean(*b)),
-            LispExpr::Symbol(s) => {
-                // Symbols in quoted expressions become Symbol values
-                Ok(Value::Symbol(Arc::new(s.clone())))
-            }
-            LispExpr::List(items) => {
-                let mut values = Vec::new();
-                for item in items {
-                    values.push(self.expr_to_value(item)?);
-                }
-                Ok(Value::List(List::from_vec(values)))
-            }
-            LispExpr::DottedList(items, rest) => {
-                // '(a b . rest) - cons a and b onto rest
-                let rest_value = self.expr_to_value(rest)?;
-
-                // Rest must be a list
-                if let Value::List(rest_list) = rest_value {
-                    // Prepend items to rest_list (from back to front)
-                    let mut result = rest_list;
-                    for item in items.iter().rev() {
-                        result = List::cons(self.expr_to_value(item)?, result);
-                    }
-                    Ok(Value::List(result))
-                } else {
-                    Err(CompileError::new(
-                        "Rest of dotted list must be a list".to_string(),
-                        rest.location.clone(),
-                    ))
-                }
-            }
-        }
+        expr.to_value()
     }
 
     fn compile_def(&mut self, expr: &SourceExpr) -> Result<(), CompileError> {
+        self.compile_global_definition(expr, "def", false)
+    }
+
+    // Compile define: (define name value) - like def, but a later define of the
+    // same name overwrites the value instead of being an error
+    fn compile_define(&mut self, expr: &SourceExpr) -> Result<(), CompileError> {
+        self.compile_global_definition(expr, "define", true)
+    }
+
+    fn compile_global_definition(&mut self, expr: &SourceExpr, form: &str, mutable: bool) -> Result<(), CompileError> {
         let items = match &expr.expr {
             LispExpr::List(items) => items,
             _ => {
                 return Err(CompileError::new(
-                    "def expects a list".to_string(),
+                    format!("{} expects a list", form),
                     expr.location.clone(),
                 ));
             }
@@ -1274,14 +1581,11 @@ impl Compiler {
         // Check length: (def name value)
         if items.len() != 3 {
             return Err(CompileError::new(
-                "def expects exactly: (def name value)".to_string(),
+                format!("{} expects exactly: ({} name value)", form, form),
                 expr.location.clone(),
             ));
         }
 
-// ==================== COMPILER CORE ====================
-
-
         // Extract variable name
         let var_name = match &items[1].expr {
             LispExpr::Symbol(s) => s.clone(),
@@ -1296,16 +1600,24 @@ impl Compiler {
         // Qualify with module name if in a module
         let qualified_name = self.qualify_name(&var_name);
 
-        // Enforce immutability - no redefinition allowed
-        if self.global_vars.contains_key(&qualified_name) {
-            return Err(CompileError::new(
-                format!("Cannot redefine constant '{}' - all bindings are immutable", qualified_name),
-                items[1].location.clone(),
-            ));
+        if let Some(constant) = self.constants.get(&qualified_name) {
+            return Err(Self::constant_redefined(&qualified_name, &items[1], constant));
         }
 
-        // Register as immutable global variable (false = immutable)
-        self.global_vars.insert(qualified_name.clone(), false);
+        // Enforce immutability - only a define can replace an earlier define
+        match self.global_vars.get(&qualified_name) {
+            Some(true) if mutable => {}
+            Some(_) => {
+                return Err(CompileError::new(
+                    format!("Cannot redefine constant '{}' - all bindings are immutable", qualified_name),
+                    items[1].location.clone(),
+                ));
+            }
+            None => {}
+        }
+
+        // Register the global (the flag records whether define may replace it)
+        self.global_vars.insert(qualified_name.clone(), mutable);
 
         // Compile the value expression
         self.compile_expr(&items[2])?;
@@ -1313,7 +1625,68 @@ impl Compiler {
         // Emit StoreGlobal to store the value
         self.emit(Instruction::StoreGlobal(qualified_name));
 
-        Ok(())
+        Ok(())
+    }
+
+    // Compile defconst: (defconst name value) - a global that can never be reassigned.
+    // When the value folds to a constant it's inlined at each use; the global is
+    // still stored, for eval and code compiled separately.
+    fn compile_defconst(&mut self, expr: &SourceExpr) -> Result<(), CompileError> {
+        let (name_expr, value_expr) = match &expr.expr {
+            LispExpr::List(items) if items.len() == 3 => (&items[1], &items[2]),
+            _ => {
+                return Err(CompileError::new(
+                    "defconst expects exactly: (defconst name value)".to_string(),
+                    expr.location.clone(),
+                ));
+            }
+        };
+        let name = match &name_expr.expr {
+            LispExpr::Symbol(s) => self.qualify_name(s),
+            _ => {
+                return Err(CompileError::new(
+                    "Variable name must be a symbol".to_string(),
+                    name_expr.location.clone(),
+                ));
+            }
+        };
+
+        // Top-level defconsts were registered before compiling; one in a module is registered here
+        match self.constants.get(&name) {
+            Some(constant) if constant.location != expr.location => {
+                return Err(Self::constant_redefined(&name, name_expr, constant));
+            }
+            Some(_) => {}
+            None => {
+                let constant = Constant { value: self.constant_value(value_expr), location: expr.location.clone() };
+                self.constants.insert(name.clone(), constant);
+            }
+        }
+        if self.global_vars.contains_key(&name) {
+            return Err(CompileError::new(
+                format!("Cannot redefine constant '{}' - all bindings are immutable", name),
+                name_expr.location.clone(),
+            ));
+        }
+        self.global_vars.insert(name.clone(), false);
+        self.constant_globals.insert(name.clone());
+
+        match self.constants[&name].value.clone() {
+            Some(value) => self.emit(Instruction::Push(value)),
+            None => {
+                self.compile_expr(value_expr)?;
+            }
+        }
+        self.emit(Instruction::StoreGlobal(name));
+        Ok(())
+    }
+
+    // A definition of `name` after its defconst, reported at the new definition
+    fn constant_redefined(name: &str, name_expr: &SourceExpr, constant: &Constant) -> CompileError {
+        CompileError::new(
+            format!("Cannot redefine constant '{}'", name),
+            name_expr.location.clone(),
+        ).with_note(format!("'{}' is defined with defconst here", name), constant.location.clone())
     }
 
     fn compile_defun(&mut self, expr: &SourceExpr) -> Result<(), CompileError> {
@@ -1357,17 +1730,28 @@ impl Compiler {
             }
         };
 
+        // Known before the body is compiled, so the function can pass itself as a value,
+        // e.g. (apply loop args)
+        self.known_functions.insert(self.qualify_name(&fn_name));
+        self.function_keywords.remove(&self.qualify_name(&fn_name));
+
         // Determine if this is a multi-clause or single-clause defun
         // Multi-clause: (defun name ((pattern) body) ((pattern) body) ...)
-        // Single-clause: (defun name (params) body)
+        // Single-clause: (defun name (params) body...)
         //
-        // Heuristic: if items.len() == 4 and items[2] is a list/dotted-list that looks
-        // like parameters (only contains symbols), it's single-clause.
+        // Heuristic: if items[2] is a list/dotted-list that looks like parameters
+        // (only contains symbols), it's single-clause.
         // Otherwise, if items[2] looks like a clause (a list starting with a list), it's multi-clause.
 
         if items.len() == 4 && self.looks_like_param_list(&items[2]) {
             // Single-clause defun: (defun name (params) body)
             self.compile_single_clause_defun(&fn_name, &items[2], &items[3])
+        } else if items.len() > 4 && self.looks_like_param_list(&items[2]) {
+            // Several body forms are an implicit do, so the last one is in tail position
+            let mut body = vec![SourceExpr::new(LispExpr::Symbol("do".to_string()), items[0].location.clone())];
+            body.extend(items[3..].iter().cloned());
+            let body = SourceExpr::new(LispExpr::List(body), items[3].location.clone());
+            self.compile_single_clause_defun(&fn_name, &items[2], &body)
         } else {
             // Multi-clause defun: (defun name clause1 clause2 ...)
             let clauses = &items[2..];
@@ -1387,6 +1771,10 @@ impl Compiler {
                         }
                     }
                 }
+                // &key parameters can have defaults: (a &key b (c 10)); parse_keyword_params checks them
+                if let Some(marker) = params.iter().position(|p| matches!(&p.expr, LispExpr::Symbol(s) if s == "&key")) {
+                    return params[..marker].iter().all(|p| matches!(&p.expr, LispExpr::Symbol(_)));
+                }
                 // Regular param list: all symbols
                 params.iter().all(|p| matches!(&p.expr, LispExpr::Symbol(_)))
             }
@@ -1456,6 +1844,49 @@ impl Compiler {
                     }
                 }
 
+                if let Some(marker) = params.iter().find(|p| matches!(&p.expr, LispExpr::Symbol(s) if s == "&key")) {
+                    return Err(CompileError::new(
+                        "&key parameters are only supported in defun".to_string(),
+                        marker.location.clone(),
+                    ));
+                }
+
+                // &rest marker: (a b &rest others) is equivalent to (a b . others)
+                if let Some(marker_pos) = params.iter().position(|p| matches!(&p.expr, LispExpr::Symbol(s) if s == "&rest")) {
+                    if marker_pos + 2 != params.len() {
+                        return Err(CompileError::with_suggestion(
+                            "&rest must be followed by exactly one parameter name".to_string(),
+                            params[marker_pos].location.clone(),
+                            "Use (a b &rest others) - the rest parameter must come last".to_string(),
+                        ));
+                    }
+
+                    let rest = match &params[marker_pos + 1].expr {
+                        LispExpr::Symbol(s) => s.clone(),
+                        _ => {
+                            return Err(CompileError::new(
+                                "Rest parameter must be a symbol".to_string(),
+                                params[marker_pos + 1].location.clone(),
+                            ));
+                        }
+                    };
+
+                    let mut required = Vec::new();
+                    for param in &params[..marker_pos] {
+                        match &param.expr {
+                            LispExpr::Symbol(s) => required.push(s.clone()),
+                            _ => {
+                                return Err(CompileError::new(
+                                    "Parameter must be a symbol".to_string(),
+                                    param.location.clone(),
+                                ));
+                            }
+                        }
+                    }
+
+                    return Ok(ParsedParams { required, rest: Some(rest) });
+                }
+
                 // Regular parameter list
                 let mut required = Vec::new();
                 for param in params {
@@ -1489,6 +1920,10 @@ impl Compiler {
         params_expr: &SourceExpr,
         body_expr: &SourceExpr,
     ) -> Result<(), CompileError> {
+        if let Some((required, keys)) = Self::parse_keyword_params(params_expr)? {
+            return self.compile_keyword_defun(fn_name, params_expr, required, keys, body_expr);
+        }
+
         // Parse parameters (handles both regular and variadic)
         let parsed_params = Self::parse_params(params_expr)?;
 
@@ -1500,14 +1935,26 @@ impl Compiler {
 
         // Save current compilation context
         let saved_bytecode = std::mem::take(&mut self.bytecode);
+        let saved_locations = std::mem::take(&mut self.locations);
+        let saved_slot_names = std::mem::take(&mut self.slot_names);
         let saved_params = std::mem::take(&mut self.param_names);
+        let saved_local_bindings = self.local_bindings.clone();
         let saved_address = self.instruction_address;
+        let saved_stack_depth = self.stack_depth;
         let saved_tail_position = self.in_tail_position;
+        let saved_loop = self.innermost_loop.take();
 
         // Set up new context for function
         self.bytecode = Vec::new();
-        self.param_names = all_params;
+        self.function_params.insert(self.qualify_name(fn_name), all_params.clone());
+        // Recorded before the body, so recursive calls are checked too
+        self.function_arities.insert(
+            self.qualify_name(fn_name),
+            (parsed_params.required.len(), parsed_params.rest.is_some()),
+        );
+        self.param_names = all_params.clone();
         self.instruction_address = 0;
+        self.stack_depth = 0;
         self.in_tail_position = true; // Function body is in tail position
 
         // If variadic, emit PackRestArgs at the start of function
@@ -1516,21 +1963,35 @@ impl Compiler {
         }
 
         // Compile function body
+        let boxed_params = self.box_mutated_params(&all_params, body_expr);
         self.compile_expr(body_expr)?;
+        if boxed_params > 0 {
+            self.emit(Instruction::Slide(boxed_params));
+        }
 
         // Emit return instruction
         self.emit(Instruction::Ret);
 
         // Store compiled function (qualified with module name if in a module)
-        let fn_bytecode = std::mem::take(&mut self.bytecode);
+        let mut fn_bytecode = std::mem::take(&mut self.bytecode);
+        let mut fn_locations = std::mem::replace(&mut self.locations, saved_locations);
+        let mut fn_slot_names = std::mem::replace(&mut self.slot_names, saved_slot_names);
+        self.peephole(&mut fn_bytecode, &mut fn_locations, &mut fn_slot_names);
         let qualified_name = self.qualify_name(fn_name);
+        self.function_locations.insert(qualified_name.clone(), fn_locations);
+        if !fn_slot_names.is_empty() {
+            self.function_slot_names.insert(qualified_name.clone(), fn_slot_names);
+        }
         self.functions.insert(qualified_name, fn_bytecode);
 
         // Restore context
         self.bytecode = saved_bytecode;
         self.param_names = saved_params;
+        self.local_bindings = saved_local_bindings;
         self.instruction_address = saved_address;
+        self.stack_depth = saved_stack_depth;
         self.in_tail_position = saved_tail_position;
+        self.innermost_loop = saved_loop;
 
         Ok(())
     }
@@ -1571,10 +2032,13 @@ impl Compiler {
 
         // Save current compilation context
         let saved_bytecode = std::mem::take(&mut self.bytecode);
+        let saved_locations = std::mem::take(&mut self.locations);
+        let saved_slot_names = std::mem::take(&mut self.slot_names);
         let saved_params = std::mem::take(&mut self.param_names);
         let saved_address = self.instruction_address;
         let saved_tail_position = self.in_tail_position;
-        let saved_local_bindings = std::mem::take(&mut self.local_bindings);
+        let saved_loop = self.innermost_loop.take();
+        let saved_local_bindings = self.local_bindings.clone();
         let saved_stack_depth = self.stack_depth;
 
         // Set up new context for function
@@ -1590,8 +2054,12 @@ impl Compiler {
         //   <pattern checks for clause 0>
         //   JmpIfFalse(clause_1)
         //   <bind variables for clause 0>
+        //   [<guard for clause 0>
+        //    JmpIfFalse(guard_failed_0)]       # Only for ((patterns) when guard body...)
         //   <body for clause 0>
         //   Ret
+        // [guard_failed_0:
+        //   PopN(bindings)]                    # Drop the bindings before trying the next clause
         // clause_1:
         //   CheckArity(expected_arity_1, clause_2)  # Jump if arg count doesn't match
         //   <pattern checks for clause 1>
@@ -1618,21 +2086,40 @@ impl Compiler {
             let arity_check_idx = self.bytecode.len();
             self.emit(Instruction::CheckArity(clause_arity, 0)); // placeholder jump address
 
-            // Compile pattern checks for this clause
-            // If any pattern fails, jump to next clause
-            self.pattern_match_jumps.clear();
-            let _jump_count = self.compile_pattern_checks(&clause.patterns, clause_arity)?;
-
             // Save the jump indices to patch later (both arity check and pattern checks)
             let mut jumps_to_patch: Vec<usize> = vec![arity_check_idx];
-            jumps_to_patch.extend(self.pattern_match_jumps.clone());
 
-            // All patterns matched! Bind variables from patterns
-            self.bind_pattern_variables(&clause.patterns, clause_arity)?;
+            if Self::needs_pattern_paths(&clause.patterns) {
+                // Try each alternative in turn; all of them bind the same variables
+                // and continue into the shared body below
+                let roots: Vec<Instruction> = (0..clause_arity).map(Instruction::LoadArg).collect();
+                jumps_to_patch.extend(self.compile_pattern_alternatives(&roots, &clause.patterns)?);
+            } else {
+                // Compile pattern checks for this clause
+                // If any pattern fails, jump to next clause
+                self.pattern_match_jumps.clear();
+                let _jump_count = self.compile_pattern_checks(&clause.patterns, clause_arity)?;
+                jumps_to_patch.extend(self.pattern_match_jumps.clone());
+
+                // All patterns matched! Bind variables from patterns
+                self.bind_pattern_variables(&clause.patterns, clause_arity)?;
+            }
+
+            // Check the guard with the bindings in scope; it is not in tail position
+            let guard_jump_idx = match &clause.guard {
+                Some(guard) => {
+                    self.in_tail_position = false;
+                    self.compile_expr(guard)?;
+                    let jump_idx = self.instruction_address;
+                    self.emit(Instruction::JmpIfFalse(0)); // placeholder, patched to guard_failed
+                    Some(jump_idx)
+                }
+                None => None,
+            };
 
             // Compile the body in tail position
             self.in_tail_position = true;
-            self.compile_expr(&clause.body)?;
+            self.compile_sequence(&clause.body)?;
 
             // Clean up any stack values from pattern bindings
             if self.stack_depth > 0 {
@@ -1642,26 +2129,41 @@ impl Compiler {
             // Return
             self.emit(Instruction::Ret);
 
+            // guard_failed: the patterns matched and pushed their bindings, so pop
+            // them before falling through to the next clause
+            if let Some(jump_idx) = guard_jump_idx {
+                let guard_failed = self.instruction_address;
+                self.patch_jump(jump_idx, guard_failed);
+                if self.stack_depth > 0 {
+                    self.emit(Instruction::PopN(self.stack_depth));
+                }
+            }
+
             // Patch all jump addresses to point to the next clause (or error)
             let target = self.instruction_address;
             for jump_idx in jumps_to_patch {
                 self.patch_jump(jump_idx, target);
             }
 
-            // If this is the last clause, emit error handler
+            // If this is the last clause, raise the error for no matching clause,
+            // located at the defun
             if clause_idx == num_clauses - 1 {
-                // Emit error for no matching clause
-                self.emit(Instruction::Push(Value::String(Arc::new(
-                    format!("No matching clause in function '{}'", fn_name)
-                ))));
-                self.emit(Instruction::Print);
-                self.emit(Instruction::Halt);
+                let saved_location = std::mem::replace(&mut self.current_location, location.clone());
+                self.emit(Instruction::ClauseFailed(fn_name.to_string()));
+                self.current_location = saved_location;
             }
         }
 
         // Store compiled function (qualified with module name if in a module)
-        let fn_bytecode = std::mem::take(&mut self.bytecode);
+        let mut fn_bytecode = std::mem::take(&mut self.bytecode);
+        let mut fn_locations = std::mem::replace(&mut self.locations, saved_locations);
+        let mut fn_slot_names = std::mem::replace(&mut self.slot_names, saved_slot_names);
+        self.peephole(&mut fn_bytecode, &mut fn_locations, &mut fn_slot_names);
         let qualified_name = self.qualify_name(fn_name);
+        self.function_locations.insert(qualified_name.clone(), fn_locations);
+        if !fn_slot_names.is_empty() {
+            self.function_slot_names.insert(qualified_name.clone(), fn_slot_names);
+        }
         self.functions.insert(qualified_name, fn_bytecode);
 
         // Restore context
@@ -1669,6 +2171,7 @@ impl Compiler {
         self.param_names = saved_params;
         self.instruction_address = saved_address;
         self.in_tail_position = saved_tail_position;
+        self.innermost_loop = saved_loop;
         self.local_bindings = saved_local_bindings;
         self.stack_depth = saved_stack_depth;
 
@@ -1695,14 +2198,17 @@ impl Compiler {
     // Emits JmpIfFalse for failure conditions, which get collected in pattern_match_jumps
     fn compile_pattern_check_for_arg(&mut self, pattern: &Pattern, arg_idx: usize) -> Result<(), CompileError> {
         match pattern {
+            Pattern::Or(_) | Pattern::Struct(_, _) | Pattern::As(_, _) | Pattern::Type(_, _) => {
+                unreachable!("clauses with or-, struct, as- or type patterns go through compile_pattern_alternatives")
+            }
             Pattern::Variable(_) | Pattern::Wildcard => {
                 // Always matches - no check needed
             }
             Pattern::Literal(value) => {
-                // Load argument and check equality
+                // Load argument and check equality, as equal? does
                 self.emit(Instruction::LoadArg(arg_idx));
                 self.emit(Instruction::Push(value.clone()));
-                self.emit(Instruction::Eq);
+                self.emit(Instruction::Equal);
                 let jump_idx = self.instruction_address;
                 self.emit(Instruction::JmpIfFalse(0));
                 self.pattern_match_jumps.push(jump_idx);
@@ -1710,7 +2216,7 @@ impl Compiler {
             Pattern::QuotedSymbol(s) => {
                 // Load argument and check equality with symbol
                 self.emit(Instruction::LoadArg(arg_idx));
-                self.emit(Instruction::Push(Value::Symbol(Arc::new(s.clone()))));
+                self.emit(Instruction::Push(Value::symbol(s.as_str())));
                 self.emit(Instruction::Eq);
                 let jump_idx = self.instruction_address;
                 self.emit(Instruction::JmpIfFalse(0));
@@ -1783,6 +2289,9 @@ impl Compiler {
     // Compile check for a pattern against a list element
     fn compile_pattern_check_for_list_element(&mut self, pattern: &Pattern, arg_idx: usize, elem_idx: usize) -> Result<(), CompileError> {
         match pattern {
+            Pattern::Or(_) | Pattern::Struct(_, _) | Pattern::As(_, _) | Pattern::Type(_, _) => {
+                unreachable!("clauses with or-, struct, as- or type patterns go through compile_pattern_alternatives")
+            }
             Pattern::Variable(_) | Pattern::Wildcard => {
                 // Always matches - no check needed
             }
@@ -1794,7 +2303,7 @@ impl Compiler {
                 }
                 self.emit(Instruction::Car);
                 self.emit(Instruction::Push(value.clone()));
-                self.emit(Instruction::Eq);
+                self.emit(Instruction::Equal);
                 let jump_idx = self.instruction_address;
                 self.emit(Instruction::JmpIfFalse(0));
                 self.pattern_match_jumps.push(jump_idx);
@@ -1805,7 +2314,7 @@ impl Compiler {
                     self.emit(Instruction::Cdr);
                 }
                 self.emit(Instruction::Car);
-                self.emit(Instruction::Push(Value::Symbol(Arc::new(s.clone()))));
+                self.emit(Instruction::Push(Value::symbol(s.as_str())));
                 self.emit(Instruction::Eq);
                 let jump_idx = self.instruction_address;
                 self.emit(Instruction::JmpIfFalse(0));
@@ -1863,6 +2372,7 @@ impl Compiler {
             Instruction::JmpIfFalse(addr) => *addr = target,
             Instruction::Jmp(addr) => *addr = target,
             Instruction::CheckArity(_, addr) => *addr = target,
+            Instruction::JmpIfFalseOrPop(addr) | Instruction::JmpIfTrueOrPop(addr) => *addr = target,
             _ => panic!("Expected jump instruction at index {}", idx),
         }
     }
@@ -1878,6 +2388,9 @@ impl Compiler {
     // Bind variables from a single pattern
     fn bind_pattern_variable(&mut self, pattern: &Pattern, arg_idx: usize) -> Result<(), CompileError> {
         match pattern {
+            Pattern::Or(_) | Pattern::Struct(_, _) | Pattern::As(_, _) | Pattern::Type(_, _) => {
+                unreachable!("clauses with or-, struct, as- or type patterns go through compile_pattern_alternatives")
+            }
             Pattern::Variable(name) => {
                 // Bind variable to argument position
                 // We'll track this in param_names and use LoadArg
@@ -1915,6 +2428,9 @@ impl Compiler {
     // Bind a variable from a nested pattern (element of a list)
     fn bind_nested_pattern_variable(&mut self, pattern: &Pattern, arg_idx: usize, elem_idx: usize) -> Result<(), CompileError> {
         match pattern {
+            Pattern::Or(_) | Pattern::Struct(_, _) | Pattern::As(_, _) | Pattern::Type(_, _) => {
+                unreachable!("clauses with or-, struct, as- or type patterns go through compile_pattern_alternatives")
+            }
             Pattern::Variable(name) => {
                 // Load the argument, extract the element, and bind
                 self.emit(Instruction::LoadArg(arg_idx));
@@ -2048,6 +2564,9 @@ impl Compiler {
     // Example: for ((((x . _) . _)) ...), we need to navigate multiple levels deep
     fn bind_deeply_nested_pattern_variable(&mut self, pattern: &Pattern, arg_idx: usize, elem_idx: usize, sub_elem_idx: usize) -> Result<(), CompileError> {
         match pattern {
+            Pattern::Or(_) | Pattern::Struct(_, _) | Pattern::As(_, _) | Pattern::Type(_, _) => {
+                unreachable!("clauses with or-, struct, as- or type patterns go through compile_pattern_alternatives")
+            }
             Pattern::Variable(name) => {
                 // Load the argument, navigate to outer element, then to inner element
                 self.emit(Instruction::LoadArg(arg_idx));
@@ -2194,6 +2713,25 @@ impl Compiler {
             }
         };
 
+        // Guarded clause: ((patterns...) when guard body...)
+        let is_guarded = matches!(items.get(1).map(|i| &i.expr), Some(LispExpr::Symbol(s)) if s == "when")
+            && items.len() > 2;
+
+        if is_guarded {
+            if items.len() < 4 {
+                return Err(CompileError::new(
+                    "Guarded clause must have a guard and a body: ((patterns...) when guard body...)".to_string(),
+                    expr.location.clone(),
+                ));
+            }
+
+            let patterns = self.parse_patterns(&items[0])?;
+            let guard = Some(items[2].clone());
+            let body = items[3..].to_vec();
+
+            return Ok(FunctionClause { patterns, location: expr.location.clone(), guard, body });
+        }
+
         if items.len() != 2 {
             return Err(CompileError::new(
                 "Clause must have exactly 2 elements: ((patterns...) body)".to_string(),
@@ -2203,9 +2741,9 @@ impl Compiler {
 
         // Parse patterns from first element
         let patterns = self.parse_patterns(&items[0])?;
-        let body = items[1].clone();
+        let body = vec![items[1].clone()];
 
-        Ok(FunctionClause { patterns, body })
+        Ok(FunctionClause { patterns, location: expr.location.clone(), guard: None, body })
     }
 
     // Parse patterns list: (pattern1 pattern2 ...)
@@ -2243,10 +2781,14 @@ impl Compiler {
     // Parse a single pattern
     fn parse_pattern(&self, expr: &SourceExpr) -> Result<Pattern, CompileError> {
         match &expr.expr {
-            // Simple symbol: variable or wildcard
+            // Simple symbol: variable or wildcard, or a string or nil literal
             LispExpr::Symbol(s) => {
                 if s == "_" {
                     Ok(Pattern::Wildcard)
+                } else if let Some(content) = s.strip_prefix("__STRING__") {
+                    Ok(Pattern::Literal(Value::String(Arc::new(content.to_string()))))
+                } else if s == "nil" {
+                    Ok(Pattern::EmptyList)
                 } else {
                     Ok(Pattern::Variable(s.clone()))
                 }
@@ -2263,6 +2805,10 @@ impl Compiler {
             LispExpr::Boolean(b) => {
                 Ok(Pattern::Literal(Value::Boolean(*b)))
             }
+            // Char literal
+            LispExpr::Char(c) => {
+                Ok(Pattern::Literal(Value::Char(*c)))
+            }
             // List pattern: could be a list pattern or quoted expression
             LispExpr::List(items) => {
                 // Check for quote: '() or 'symbol
@@ -2273,6 +2819,28 @@ impl Compiler {
                         }
                     }
                 }
+                // Or-pattern: (or pat1 pat2 ...)
+                if let Some(LispExpr::Symbol(s)) = items.first().map(|i| &i.expr) {
+                    if s == "or" {
+                        return self.parse_or_pattern(expr, &items[1..]);
+                    }
+                    // As-pattern: (@ name pattern)
+                    if s == "@" {
+                        return self.parse_as_pattern(expr, &items[1..]);
+                    }
+                    // Cons pattern: (cons head tail)
+                    if s == "cons" {
+                        return self.parse_cons_pattern(expr, &items[1..]);
+                    }
+                    // Type pattern: (:integer x)
+                    if Self::is_keyword(s) {
+                        return self.parse_type_pattern(expr, s, &items[1..]);
+                    }
+                }
+                // Struct pattern: (point x y), when point is a defstruct type
+                if let Some(pattern) = self.parse_struct_pattern(expr, items) {
+                    return pattern;
+                }
                 // Regular list pattern: (a b c)
                 let sub_patterns: Vec<Pattern> = items
                     .iter()
@@ -2323,10 +2891,14 @@ impl Compiler {
     // Parse elements within a quoted list (they're all literals)
     fn parse_quoted_list_element(&self, expr: &SourceExpr) -> Result<Pattern, CompileError> {
         match &expr.expr {
-            LispExpr::Symbol(s) => Ok(Pattern::QuotedSymbol(s.clone())),
+            LispExpr::Symbol(s) => match s.strip_prefix("__STRING__") {
+                Some(content) => Ok(Pattern::Literal(Value::String(Arc::new(content.to_string())))),
+                None => Ok(Pattern::QuotedSymbol(s.clone())),
+            },
             LispExpr::Number(n) => Ok(Pattern::Literal(Value::Integer(*n))),
             LispExpr::Float(f) => Ok(Pattern::Literal(Value::Float(*f))),
             LispExpr::Boolean(b) => Ok(Pattern::Literal(Value::Boolean(*b))),
+            LispExpr::Char(c) => Ok(Pattern::Literal(Value::Char(*c))),
             LispExpr::List(items) if items.is_empty() => Ok(Pattern::EmptyList),
             LispExpr::List(items) => {
                 let sub_patterns: Vec<Pattern> = items
@@ -2441,14 +3013,27 @@ impl Compiler {
         // Find free variables in body (variables not in all_params)
         let free_vars = self.find_free_variables(body_expr, &all_params);
 
+        // Free variables that live in letrec cells stay cells inside the closure
+        let captured_cells: Vec<Option<String>> = free_vars.iter()
+            .map(|var_name| {
+                match self.local_bindings.get(var_name).or_else(|| self.pattern_bindings.get(var_name)) {
+                    Some(ValueLocation::Cell(_, name)) => Some(name.clone()),
+                    _ => None,
+                }
+            })
+            .collect();
+
         // Save current compilation context
         let saved_bytecode = std::mem::take(&mut self.bytecode);
+        let saved_locations = std::mem::take(&mut self.locations);
+        let saved_slot_names = std::mem::take(&mut self.slot_names);
         let saved_params = std::mem::take(&mut self.param_names);
         let saved_local_bindings = self.local_bindings.clone();
         let saved_pattern_bindings = self.pattern_bindings.clone();
         let saved_address = self.instruction_address;
         let saved_stack_depth = self.stack_depth;
         let saved_tail_position = self.in_tail_position;
+        let saved_loop = self.innermost_loop.take();
 
         // Set up new context for closure body
         self.bytecode = Vec::new();
@@ -2461,29 +3046,47 @@ impl Compiler {
 
         // Set up captured variables as "LoadCaptured" locations
         for (i, var_name) in free_vars.iter().enumerate() {
-            self.pattern_bindings.insert(var_name.clone(), ValueLocation::Captured(i));
+            let location = match &captured_cells[i] {
+                Some(name) => ValueLocation::Cell(Box::new(ValueLocation::Captured(i)), name.clone()),
+                None => ValueLocation::Captured(i),
+            };
+            self.pattern_bindings.insert(var_name.clone(), location);
         }
 
         // Compile body
+        let boxed_params = self.box_mutated_params(&all_params, body_expr);
         self.compile_expr(body_expr)?;
+        if boxed_params > 0 {
+            self.emit(Instruction::Slide(boxed_params));
+        }
         self.emit(Instruction::Ret);
 
         // Get compiled body
         let body_bytecode = std::mem::take(&mut self.bytecode);
 
-        // Restore context
+        // Restore context (closure bodies carry no source map of their own)
         self.bytecode = saved_bytecode;
+        self.locations = saved_locations;
+        self.slot_names = saved_slot_names;
         self.param_names = saved_params;
         self.local_bindings = saved_local_bindings;
         self.pattern_bindings = saved_pattern_bindings;
         self.instruction_address = saved_address;
         self.stack_depth = saved_stack_depth;
         self.in_tail_position = saved_tail_position;
+        self.innermost_loop = saved_loop;
 
         // Emit code to push captured variable values onto stack
         for var_name in &free_vars {
-            // Load the value of this free variable
-            self.compile_variable_load(var_name)?;
+            // Load the value of this free variable (letrec cells are captured as cells)
+            let cell_location = match self.local_bindings.get(var_name).or_else(|| self.pattern_bindings.get(var_name)) {
+                Some(location @ ValueLocation::Cell(_, _)) => Some(location.clone()),
+                _ => None,
+            };
+            match cell_location {
+                Some(location) => location.emit_capture(self),
+                None => self.compile_variable_load(var_name)?,
+            }
         }
 
         // Emit appropriate closure instruction based on whether it's variadic
@@ -2501,6 +3104,148 @@ impl Compiler {
         Ok(())
     }
 
+    // Names among `names` that need a cell: assigned with set! and referenced from a
+    // lambda somewhere in `exprs`, so the frame and every closure share one slot.
+    // Captured but never assigned variables stay flat copies in the closure.
+    fn mutated_captures(names: &[String], exprs: &[&SourceExpr]) -> Vec<String> {
+        let mut assigned = std::collections::HashSet::new();
+        let mut captured = std::collections::HashSet::new();
+        for expr in exprs {
+            Self::collect_assigned(expr, &mut assigned);
+            Self::collect_lambda_references(expr, names, false, &mut captured);
+        }
+        names.iter()
+            .filter(|name| assigned.contains(*name) && captured.contains(*name))
+            .cloned()
+            .collect()
+    }
+
+    // Targets of every set! in an expression
+    fn collect_assigned(expr: &SourceExpr, assigned: &mut std::collections::HashSet<String>) {
+        if let LispExpr::List(items) = &expr.expr {
+            match items.first().map(|item| &item.expr) {
+                Some(LispExpr::Symbol(s)) if s == "quote" => return,
+                Some(LispExpr::Symbol(s)) if s == "set!" => {
+                    if let Some(LispExpr::Symbol(target)) = items.get(1).map(|item| &item.expr) {
+                        assigned.insert(target.clone());
+                    }
+                }
+                _ => {}
+            }
+            for item in items {
+                Self::collect_assigned(item, assigned);
+            }
+        }
+    }
+
+    // Names from `names` used inside a lambda body (a lambda's own parameters shadow them)
+    fn collect_lambda_references(
+        expr: &SourceExpr,
+        names: &[String],
+        in_lambda: bool,
+        captured: &mut std::collections::HashSet<String>,
+    ) {
+        match &expr.expr {
+            LispExpr::Symbol(s) if in_lambda && names.contains(s) => {
+                captured.insert(s.clone());
+            }
+            LispExpr::List(items) => {
+                match items.first().map(|item| &item.expr) {
+                    Some(LispExpr::Symbol(s)) if s == "quote" => return,
+                    Some(LispExpr::Symbol(s)) if s == "handler-case" && items.len() == 3 => {
+                        // The catch clause is compiled as a lambda of the raised value
+                        Self::collect_lambda_references(&items[1], names, in_lambda, captured);
+                        if let LispExpr::List(clause) = &items[2].expr {
+                            if let Some(LispExpr::List(vars)) = clause.get(1).map(|v| &v.expr) {
+                                let visible: Vec<String> = names.iter()
+                                    .filter(|name| !vars.iter().any(|v| matches!(&v.expr, LispExpr::Symbol(s) if s == *name)))
+                                    .cloned()
+                                    .collect();
+                                for body in &clause[2..] {
+                                    Self::collect_lambda_references(body, &visible, true, captured);
+                                }
+                            }
+                        }
+                        return;
+                    }
+                    Some(LispExpr::Symbol(s)) if s == "let" && items.len() >= 4 && matches!(items[1].expr, LispExpr::Symbol(_)) => {
+                        // A named let's body is the body of a lambda of its variables;
+                        // the initial values are evaluated outside it
+                        let mut params = vec![items[1].clone()];
+                        if let LispExpr::List(bindings) = &items[2].expr {
+                            for binding in bindings {
+                                match &binding.expr {
+                                    LispExpr::List(pair) if pair.len() == 2 => {
+                                        Self::collect_lambda_references(&pair[1], names, in_lambda, captured);
+                                        params.push(pair[0].clone());
+                                    }
+                                    _ => Self::collect_lambda_references(binding, names, in_lambda, captured),
+                                }
+                            }
+                        }
+                        let visible: Vec<String> = names.iter()
+                            .filter(|name| !params.iter().any(|p| matches!(&p.expr, LispExpr::Symbol(s) if s == *name)))
+                            .cloned()
+                            .collect();
+                        for body in &items[3..] {
+                            Self::collect_lambda_references(body, &visible, true, captured);
+                        }
+                        return;
+                    }
+                    Some(LispExpr::Symbol(s)) if s == "delay" && items.len() == 2 => {
+                        // The delayed expression is the body of a thunk
+                        Self::collect_lambda_references(&items[1], names, true, captured);
+                        return;
+                    }
+                    Some(LispExpr::Symbol(s)) if s == "cons-stream" && items.len() == 3 => {
+                        Self::collect_lambda_references(&items[1], names, in_lambda, captured);
+                        Self::collect_lambda_references(&items[2], names, true, captured);
+                        return;
+                    }
+                    Some(LispExpr::Symbol(s)) if s == "lambda" && items.len() >= 3 => {
+                        let params = match Self::parse_params(&items[1]) {
+                            Ok(parsed) => parsed.required.into_iter().chain(parsed.rest).collect(),
+                            Err(_) => Vec::new(),
+                        };
+                        let visible: Vec<String> = names.iter().filter(|name| !params.contains(name)).cloned().collect();
+                        for body in &items[2..] {
+                            Self::collect_lambda_references(body, &visible, true, captured);
+                        }
+                        return;
+                    }
+                    _ => {}
+                }
+                for item in items {
+                    Self::collect_lambda_references(item, names, in_lambda, captured);
+                }
+            }
+            LispExpr::DottedList(items, rest) => {
+                for item in items {
+                    Self::collect_lambda_references(item, names, in_lambda, captured);
+                }
+                Self::collect_lambda_references(rest, names, in_lambda, captured);
+            }
+            _ => {}
+        }
+    }
+
+    // Move parameters that closures capture and set! assigns into cells on the stack,
+    // so LoadArg copies never go stale. Returns how many cells to slide off before Ret.
+    fn box_mutated_params(&mut self, params: &[String], body_expr: &SourceExpr) -> usize {
+        let boxed = Self::mutated_captures(params, &[body_expr]);
+        for name in &boxed {
+            let idx = params.iter().position(|p| p == name).unwrap();
+            let position = self.stack_depth;
+            self.emit(Instruction::MakeCell);
+            self.emit(Instruction::LoadArg(idx));
+            self.emit(Instruction::GetLocal(position));
+            self.emit(Instruction::CellSet);
+            self.stack_depth += 1;
+            self.local_bindings.insert(name.clone(), ValueLocation::Cell(Box::new(ValueLocation::Local(position)), name.clone()));
+        }
+        boxed.len()
+    }
+
     // Find free variables in an expression (variables not in bound_vars)
     fn find_free_variables(&self, expr: &SourceExpr, bound_vars: &[String]) -> Vec<String> {
         let mut free_vars = Vec::new();
@@ -2560,7 +3305,66 @@ impl Compiler {
                                 return;
                             }
                         }
-                        "lambda" if items.len() == 3 => {
+                        "let" if items.len() == 4 => {
+                            // Named let: the loop name and variables are bound in the body
+                            if let (LispExpr::Symbol(name), LispExpr::List(bindings)) = (&items[1].expr, &items[2].expr) {
+                                let mut new_bound = bound_vars.to_vec();
+                                new_bound.push(name.clone());
+                                for binding in bindings {
+                                    if let LispExpr::List(pair) = &binding.expr {
+                                        if pair.len() == 2 {
+                                            self.collect_free_variables(&pair[1], bound_vars, free_vars);
+                                            if let LispExpr::Symbol(var) = &pair[0].expr {
+                                                new_bound.push(var.clone());
+                                            }
+                                        }
+                                    }
+                                }
+                                self.collect_free_variables(&items[3], &new_bound, free_vars);
+                                return;
+                            }
+                        }
+                        "let*" if items.len() == 3 => {
+                            // let* bindings are in scope for the value expressions that follow them
+                            if let LispExpr::List(bindings) = &items[1].expr {
+                                let mut new_bound = bound_vars.to_vec();
+                                for binding in bindings {
+                                    if let LispExpr::List(pair) = &binding.expr {
+                                        if pair.len() == 2 {
+                                            self.collect_free_variables(&pair[1], &new_bound, free_vars);
+                                            if let LispExpr::Symbol(var) = &pair[0].expr {
+                                                new_bound.push(var.clone());
+                                            }
+                                        }
+                                    }
+                                }
+                                self.collect_free_variables(&items[2], &new_bound, free_vars);
+                                return;
+                            }
+                        }
+                        "letrec" if items.len() == 3 => {
+                            // letrec bindings are in scope for the value expressions too
+                            if let LispExpr::List(bindings) = &items[1].expr {
+                                let mut new_bound = bound_vars.to_vec();
+                                for binding in bindings {
+                                    if let LispExpr::List(pair) = &binding.expr {
+                                        if let Some(LispExpr::Symbol(var)) = pair.first().map(|p| &p.expr) {
+                                            new_bound.push(var.clone());
+                                        }
+                                    }
+                                }
+                                for binding in bindings {
+                                    if let LispExpr::List(pair) = &binding.expr {
+                                        if pair.len() == 2 {
+                                            self.collect_free_variables(&pair[1], &new_bound, free_vars);
+                                        }
+                                    }
+                                }
+                                self.collect_free_variables(&items[2], &new_bound, free_vars);
+                                return;
+                            }
+                        }
+                        "lambda" if items.len() >= 3 => {
                             // lambda introduces new parameters
                             if let LispExpr::List(params) = &items[1].expr {
                                 let mut new_bound = bound_vars.to_vec();
@@ -2569,10 +3373,60 @@ impl Compiler {
                                         new_bound.push(p.clone());
                                     }
                                 }
-                                self.collect_free_variables(&items[2], &new_bound, free_vars);
+                                for body in &items[2..] {
+                                    self.collect_free_variables(body, &new_bound, free_vars);
+                                }
                                 return;
                             }
                         }
+                        "handler-case" if items.len() == 3 => {
+                            // The catch clause binds the raised value in its body
+                            if let LispExpr::List(clause) = &items[2].expr {
+                                if let Some(LispExpr::List(vars)) = clause.get(1).map(|v| &v.expr) {
+                                    self.collect_free_variables(&items[1], bound_vars, free_vars);
+                                    let mut new_bound = bound_vars.to_vec();
+                                    if let Some(LispExpr::Symbol(var)) = vars.first().map(|v| &v.expr) {
+                                        new_bound.push(var.clone());
+                                    }
+                                    for body in &clause[2..] {
+                                        self.collect_free_variables(body, &new_bound, free_vars);
+                                    }
+                                    return;
+                                }
+                            }
+                        }
+                        "case" if items.len() >= 2 => {
+                            // Clause keys are literals, only the key and the bodies are code
+                            self.collect_free_variables(&items[1], bound_vars, free_vars);
+                            for clause in &items[2..] {
+                                if let LispExpr::List(parts) = &clause.expr {
+                                    for item in parts.iter().skip(1) {
+                                        self.collect_free_variables(item, bound_vars, free_vars);
+                                    }
+                                }
+                            }
+                            return;
+                        }
+                        "match" if items.len() >= 3 => {
+                            // Each clause's pattern binds its variables in that clause's body
+                            self.collect_free_variables(&items[1], bound_vars, free_vars);
+                            for clause in &items[2..] {
+                                if let LispExpr::List(parts) = &clause.expr {
+                                    if let Some((pattern, body)) = parts.split_first() {
+                                        let mut vars = std::collections::BTreeSet::new();
+                                        if let Ok(pattern) = self.parse_pattern(pattern) {
+                                            Self::pattern_variables(&pattern, &mut vars);
+                                        }
+                                        let mut new_bound = bound_vars.to_vec();
+                                        new_bound.extend(vars);
+                                        for item in body {
+                                            self.collect_free_variables(item, &new_bound, free_vars);
+                                        }
+                                    }
+                                }
+                            }
+                            return;
+                        }
                         "quote" => {
                             // Quoted expressions don't have free variables
                             return;
@@ -2596,6 +3450,46 @@ impl Compiler {
         }
     }
 
+    // Check if a name refers to a local variable (let binding, pattern binding or parameter)
+    fn is_local_variable(&self, name: &str) -> bool {
+        self.local_bindings.contains_key(name)
+            || self.pattern_bindings.contains_key(name)
+            || self.param_names.iter().any(|p| p == name)
+    }
+
+    // Check if a name refers to a global variable (def, or known from the runtime context)
+    fn is_global_variable(&self, name: &str) -> bool {
+        let resolved = self.resolve_global_name(name);
+        self.global_vars.contains_key(&resolved) || self.known_globals.contains(&resolved)
+            || self.global_vars.contains_key(name) || self.known_globals.contains(name)
+    }
+
+    // Compile a call whose operator is a local or global variable holding a closure or function
+    fn compile_closure_variable_call(&mut self, items: &[SourceExpr]) -> Result<(), CompileError> {
+        let saved_tail = self.in_tail_position;
+
+        // Closure and arguments are not in tail position
+        self.in_tail_position = false;
+        self.compile_operand(&items[0])?;
+
+        // Compile all arguments
+        let arg_count = items.len() - 1;
+        for i in 1..items.len() {
+            self.compile_operand(&items[i])?;
+        }
+        self.stack_depth -= items.len();
+
+        // Call the closure (reusing the frame when in tail position)
+        if self.leaves_function(saved_tail) {
+            self.emit(Instruction::TailCallClosure(arg_count));
+        } else {
+            self.emit(Instruction::CallClosure(arg_count));
+        }
+
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+
     // Helper to load a variable (for capturing)
     fn compile_variable_load(&mut self, var_name: &str) -> Result<(), CompileError> {
         // Check local bindings first
@@ -2644,25 +3538,33 @@ impl Compiler {
     }
 
     // Compile quasiquote expression
-    // Quasiquote is like quote, but allows unquote (,) and unquote-splicing (,@)
-    fn compile_quasiquote(&mut self, expr: &SourceExpr) -> Result<(), CompileError> {
+    // Quasiquote is like quote, but allows unquote (,) and unquote-splicing (,@).
+    // `depth` counts the enclosing quasiquotes: each nested ` adds one and each , removes
+    // one, and only unquotes that bring it to zero are evaluated. The rest stay as data.
+    fn compile_quasiquote(&mut self, expr: &SourceExpr, depth: usize) -> Result<(), CompileError> {
         match &expr.expr {
-            // Check for unquote: (unquote expr)
-            LispExpr::List(items) if items.len() == 2 => {
-                if let LispExpr::Symbol(s) = &items[0].expr {
-                    if s == "unquote" {
+            // Unquote, splice or a nested quasiquote: (unquote expr), (quasiquote expr), ...
+            LispExpr::List(items) if Self::quasiquote_form(&expr.expr).is_some() => {
+                match Self::quasiquote_form(&expr.expr) {
+                    Some(("unquote", inner)) if depth == 1 => {
                         // Unquote: evaluate the expression
-                        self.compile_expr(&items[1])?;
-                        return Ok(());
+                        self.compile_expr(inner)?;
                     }
+                    Some(("unquote-splicing", _)) if depth == 1 => {
+                        return Err(CompileError::new(
+                            "unquote-splicing (,@) is only allowed inside a list".to_string(),
+                            expr.location.clone(),
+                        ));
+                    }
+                    // Deeper unquotes are kept, with their argument one level shallower
+                    Some(("quasiquote", _)) => self.compile_quasiquote_list(items, depth + 1)?,
+                    _ => self.compile_quasiquote_list(items, depth - 1)?,
                 }
-                // Not an unquote, process as normal list
-                self.compile_quasiquote_list(items)?;
             }
 
             // Empty list or regular list
             LispExpr::List(items) => {
-                self.compile_quasiquote_list(items)?;
+                self.compile_quasiquote_list(items, depth)?;
             }
 
             // Dotted list
@@ -2683,27 +3585,30 @@ impl Compiler {
         Ok(())
     }
 
+    // Split (unquote x), (unquote-splicing x) and (quasiquote x) into the form name and x
+    fn quasiquote_form(expr: &LispExpr) -> Option<(&str, &SourceExpr)> {
+        match expr {
+            LispExpr::List(items) if items.len() == 2 => match &items[0].expr {
+                LispExpr::Symbol(s) if s == "unquote" || s == "unquote-splicing" || s == "quasiquote" => {
+                    Some((s.as_str(), &items[1]))
+                }
+                _ => None,
+            },
+            _ => None,
+        }
+    }
+
     // Helper to compile a quasiquoted list
     // Handles unquote-splicing and builds the list at runtime
-    fn compile_quasiquote_list(&mut self, items: &[SourceExpr]) -> Result<(), CompileError> {
+    fn compile_quasiquote_list(&mut self, items: &[SourceExpr], depth: usize) -> Result<(), CompileError> {
         if items.is_empty() {
             // Empty list
             self.emit(Instruction::Push(Value::List(List::Nil)));
             return Ok(());
         }
 
-        // Check if we have any unquotes or splicing - if not, we can just quote the whole thing
-        let has_unquote_or_splice = items.iter().any(|item| {
-            if let LispExpr::List(inner) = &item.expr {
-                if inner.len() == 2 {
-                    if let LispExpr::Symbol(s) = &inner[0].expr {
-                        return s == "unquote" || s == "unquote-splicing";
-                    }
-                }
-            }
-            // Recursively check for unquotes in nested expressions
-            self.contains_unquote(item)
-        });
+        // Check if we have any unquotes that get evaluated - if not, we can just quote the whole thing
+        let has_unquote_or_splice = items.iter().any(|item| self.contains_unquote(item, depth));
 
         if !has_unquote_or_splice {
             // No unquotes at all - just convert to a value and push it
@@ -2716,80 +3621,48 @@ impl Compiler {
         }
 
         // We have unquotes - need to build the list at runtime
-        // Strategy: collect all elements into a vector of code that pushes each element
-        // Then build the list using cons operations
-
-        // For simplicity, let's build forward using an explicit loop
-        // We'll push all elements onto the stack, then build the list
+        // Push all elements onto the stack, then build the list
 
         let mut elem_count = 0;
 
-        // Check for splicing first
-        let has_splicing = items.iter().any(|item| {
-            if let LispExpr::List(inner) = &item.expr {
-                if inner.len() == 2 {
-                    if let LispExpr::Symbol(s) = &inner[0].expr {
-                        return s == "unquote-splicing";
-                    }
-                }
-            }
-            false
+        // Check for splicing first (only a splice at this level spreads its elements)
+        let has_splicing = depth == 1 && items.iter().any(|item| {
+            matches!(Self::quasiquote_form(&item.expr), Some(("unquote-splicing", _)))
         });
 
         if has_splicing {
             // Complex case with splicing
-            // We'll build the list in forward order differently
             // Collect segments and splice them together
 
             // Build forward: start with list containing all non-splice elements and splice points
             self.emit(Instruction::Push(Value::List(List::Nil)));
+            // The accumulator stays below every element
+            self.stack_depth += 1;
 
             for item in items.iter() {
-                if let LispExpr::List(inner) = &item.expr {
-                    if inner.len() == 2 {
-                        if let LispExpr::Symbol(s) = &inner[0].expr {
-                            if s == "unquote-splicing" {
-                                // Evaluate the list to splice and append it
-                                self.compile_expr(&inner[1])?;
-                                // Stack: [accumulator, splice_list]
-                                // We want: [accumulator..., splice_list...]
-                                self.emit_append()?;
-                                continue;
-                            } else if s == "unquote" {
-                                // Regular unquote - cons the element
-                                self.compile_expr(&inner[1])?;
-                                // Stack: [accumulator, elem]
-                                // We need to make a single-element list and append
-                                self.emit(Instruction::MakeList(1));
-                                self.emit_append()?;
-                                continue;
-                            }
-                        }
-                    }
+                if let Some(("unquote-splicing", inner)) = Self::quasiquote_form(&item.expr) {
+                    // Evaluate the list to splice and append it
+                    self.compile_expr(inner)?;
+                    // Stack: [accumulator, splice_list]
+                    // We want: [accumulator..., splice_list...]
+                    self.emit_append()?;
+                    continue;
                 }
                 // Regular element - quasiquote it and append as single-element list
-                self.compile_quasiquote(item)?;
+                self.compile_quasiquote(item, depth)?;
                 self.emit(Instruction::MakeList(1));
                 self.emit_append()?;
             }
+            self.stack_depth -= 1;
         } else {
             // No splicing - simpler case
             // Push all elements onto stack, then use MakeList
             for item in items {
-                if let LispExpr::List(inner) = &item.expr {
-                    if inner.len() == 2 {
-                        if let LispExpr::Symbol(s) = &inner[0].expr {
-                            if s == "unquote" {
-                                self.compile_expr(&inner[1])?;
-                                elem_count += 1;
-                                continue;
-                            }
-                        }
-                    }
-                }
-                self.compile_quasiquote(item)?;
+                self.compile_quasiquote(item, depth)?;
                 elem_count += 1;
+                self.stack_depth += 1;
             }
+            self.stack_depth -= elem_count;
 
             // Now create a list from the elements on the stack
             self.emit(Instruction::MakeList(elem_count));
@@ -2798,21 +3671,19 @@ impl Compiler {
         Ok(())
     }
 
-    // Helper to check if an expression contains unquote or unquote-splicing
-    fn contains_unquote(&self, expr: &SourceExpr) -> bool {
+    // Helper to check if an expression contains an unquote or unquote-splicing that is
+    // evaluated at this quasiquote depth
+    fn contains_unquote(&self, expr: &SourceExpr, depth: usize) -> bool {
         match &expr.expr {
             LispExpr::List(items) => {
-                if items.len() == 2 {
-                    if let LispExpr::Symbol(s) = &items[0].expr {
-                        if s == "unquote" || s == "unquote-splicing" {
-                            return true;
-                        }
-                    }
+                match Self::quasiquote_form(&expr.expr) {
+                    Some(("quasiquote", inner)) => self.contains_unquote(inner, depth + 1),
+                    Some((_, inner)) => depth == 1 || self.contains_unquote(inner, depth - 1),
+                    None => items.iter().any(|item| self.contains_unquote(item, depth)),
                 }
-                items.iter().any(|item| self.contains_unquote(item))
             }
             LispExpr::DottedList(items, rest) => {
-                items.iter().any(|item| self.contains_unquote(item)) || self.contains_unquote(rest)
+                items.iter().any(|item| self.contains_unquote(item, depth)) || self.contains_unquote(rest, depth)
             }
             _ => false,
         }
@@ -2828,7 +3699,67 @@ impl Compiler {
 
 
     pub fn compile_program(&mut self, exprs: &[SourceExpr]) -> Result<(HashMap<String, Vec<Instruction>>, Vec<Instruction>), CompileError> {
-        // First pass: compile all defun, defmacro, def, module, and import expressions
+        // Undefined names are collected while compiling and checked once the whole
+        // program is known, so forward references are not errors
+        self.unresolved = if self.check_unresolved { Some(Vec::new()) } else { None };
+        self.defines_at_runtime = false;
+        self.warnings.clear();
+        let result = self.expand_includes(exprs)
+            .and_then(|exprs| self.compile_top_level_forms(&exprs).map(|()| exprs));
+        let unresolved = self.unresolved.take();
+        let exprs = result?;
+        if let Some(unresolved) = unresolved {
+            self.check_unresolved_names(unresolved)?;
+        }
+        self.warnings = self.unused_binding_warnings(&exprs);
+
+        // Return (functions, main bytecode)
+        Ok((self.functions.clone(), self.bytecode.clone()))
+    }
+
+    fn compile_top_level_forms(&mut self, exprs: &[SourceExpr]) -> Result<(), CompileError> {
+        // Top-level function and global names can be referenced before their
+        // definition, so mutually recursive functions can apply each other
+        for expr in exprs {
+            if let LispExpr::List(items) = &expr.expr {
+                if let (Some(LispExpr::Symbol(head)), Some(LispExpr::Symbol(name))) =
+                    (items.first().map(|item| &item.expr), items.get(1).map(|item| &item.expr)) {
+                    if head == "defun" {
+                        self.known_functions.insert(name.clone());
+                        // A call above the defun may be meant for it rather than an
+                        // earlier definition of the same name (e.g. from the stdlib)
+                        self.function_arities.remove(name);
+                        self.function_keywords.remove(name);
+                    } else if head == "def" || head == "define" {
+                        self.known_globals.insert(name.clone());
+                        if head == "def" {
+                            self.constant_globals.insert(name.clone());
+                        }
+                    } else if head == "defconst" {
+                        self.known_globals.insert(name.clone());
+                        self.constant_globals.insert(name.clone());
+                        // Folded now, so uses in functions above the defconst are inlined
+                        // too; the first defconst of a name is the one that counts
+                        if !self.constants.contains_key(name) && items.len() == 3 {
+                            let value = self.constant_value(&items[2]);
+                            self.constants.insert(name.clone(), Constant { value, location: expr.location.clone() });
+                        }
+                    } else if head == "defstruct" {
+                        // Patterns in earlier defuns can name the type too
+                        if let Ok((name, fields)) = Self::parse_defstruct(expr) {
+                            for fn_name in Self::struct_function_names(&name, &fields) {
+                                self.known_functions.insert(fn_name.clone());
+                                self.function_arities.remove(&fn_name);
+                            }
+                            self.structs.insert(name, fields);
+                        }
+                    }
+                }
+            }
+        }
+
+        // First pass: compile all defun, defmacro, defstruct, def, module, and import
+        // expressions; a define's initializer runs in source order, with the rest
         for expr in exprs {
             if let LispExpr::List(items) = &expr.expr {
                 if let Some(first) = items.first() {
@@ -2837,8 +3768,14 @@ impl Compiler {
                             self.compile_defun(expr)?;
                         } else if s == "defmacro" {
                             self.compile_defmacro(expr)?;
+                        } else if s == "defstruct" {
+                            self.compile_defstruct(expr)?;
+                        } else if s == "deftest" {
+                            self.compile_deftest(expr)?;
                         } else if s == "def" {
                             self.compile_def(expr)?;
+                        } else if s == "defconst" {
+                            self.compile_defconst(expr)?;
                         } else if s == "module" {
                             self.compile_module(expr)?;
                         } else if s == "import" {
@@ -2849,57 +3786,46 @@ impl Compiler {
                                 "'defvar' has been removed - use 'def' for immutable bindings".to_string(),
                                 expr.location.clone(),
                             ));
-                        } else if s == "defconst" {
-                            // defconst has been renamed - provide helpful error
-                            return Err(CompileError::new(
-                                "'defconst' has been renamed to 'def'".to_string(),
-                                expr.location.clone(),
-                            ));
                         }
                     }
                 }
             }
         }
 
-        // Second pass: compile non-definition expressions into main bytecode
-        // We need to track and pop intermediate results
-        let non_def_exprs: Vec<_> = exprs.iter().enumerate().filter_map(|(i, expr)| {
-            let is_definition = if let LispExpr::List(items) = &expr.expr {
-                if let Some(first) = items.first() {
-                    if let LispExpr::Symbol(s) = &first.expr {
-                        s == "defun" || s == "defmacro" || s == "def" || s == "module" || s == "import"
-                    } else {
-                        false
-                    }
-                } else {
-                    false
-                }
-            } else {
-                false
-            };
-
-            if !is_definition {
-                Some((i, expr))
-            } else {
-                None
+        // Second pass: compile the other expressions into main bytecode, defines
+        // among them, so (define x 1) (print x) (define x 2) prints 1
+        let head_of = |expr: &SourceExpr| match &expr.expr {
+            LispExpr::List(items) => match items.first().map(|first| &first.expr) {
+                Some(LispExpr::Symbol(s)) => Some(s.clone()),
+                _ => None,
+            },
+            _ => None,
+        };
+        let in_order: Vec<(&SourceExpr, bool)> = exprs.iter().filter_map(|expr| {
+            match head_of(expr).as_deref() {
+                Some("defun" | "defmacro" | "defstruct" | "deftest" | "def" | "defconst" | "module" | "import") => None,
+                Some("define") => Some((expr, true)),
+                _ => Some((expr, false)),
             }
         }).collect();
 
-        let num_non_defs = non_def_exprs.len();
-        for (idx, (_, expr)) in non_def_exprs.iter().enumerate() {
+        // A define leaves nothing on the stack; every other expression's result is
+        // popped but the last one's, so values don't accumulate between them
+        let last_value = in_order.iter().rposition(|(_, is_define)| !is_define);
+        for (idx, (expr, is_define)) in in_order.iter().enumerate() {
+            if *is_define {
+                self.compile_define(expr)?;
+                continue;
+            }
             self.compile_expr(expr)?;
-            // Pop the result if it's not the last expression
-            // This prevents values from accumulating on the stack between top-level expressions
-            if idx < num_non_defs - 1 {
+            if Some(idx) != last_value {
                 self.emit(Instruction::PopN(1));
             }
         }
 
         // Emit Halt at end of main bytecode
         self.emit(Instruction::Halt);
-
-        // Return (functions, main bytecode)
-        Ok((self.functions.clone(), self.bytecode.clone()))
+        Ok(())
     }
 
     // ==================== FFI TYPE PARSING ====================
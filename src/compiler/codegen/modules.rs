@@ -119,7 +119,10 @@ impl Compiler {
                             }
                             "defun" => self.compile_defun(item)?,
                             "defmacro" => self.compile_defmacro(item)?,
+                            "defstruct" => self.compile_defstruct(item)?,
                             "def" => self.compile_def(item)?,
+                            "define" => self.compile_define(item)?,
+                            "defconst" => self.compile_defconst(item)?,
                             _ => {
                                 // Other expressions in module body - compile as main code
                                 self.compile_expr(item)?;
@@ -0,0 +1,638 @@
+// Or-patterns, struct patterns, as-patterns, cons patterns and type patterns for
+// multi-clause defun: (or pat1 pat2 ...), (point x y), (@ whole pat),
+// (cons head tail) and (:integer x), and the match expression built on the same
+// checks
+//
+// A clause containing or-patterns is expanded into or-free alternatives, tried in
+// order. Each alternative is checked against the arguments along explicit car/cdr
+// paths (so nested destructuring is checked at any depth), then pushes its bindings
+// in a fixed order so every alternative jumps to one shared body with the same
+// stack layout. Struct patterns use the same paths, with StructGet steps for fields,
+// and an as-pattern binds its name to the path its inner pattern is checked at.
+// A type pattern compares type-of at its path before checking its inner pattern
+// there; :number and :function stand for more than one type, so they parse as
+// or-patterns of the types they cover.
+
+use std::collections::{BTreeMap, BTreeSet};
+
+use crate::vm::value::{Value, List};
+use crate::vm::instructions::Instruction;
+use crate::vm::errors::CompileError;
+use super::Compiler;
+use super::types::{Pattern, ValueLocation};
+use super::super::ast::{LispExpr, SourceExpr};
+
+// ==================== OR-PATTERNS ====================
+
+impl Compiler {
+    // Parse the alternatives of (or pat1 pat2 ...), requiring that all of them bind
+    // the same set of variables
+    pub(super) fn parse_or_pattern(
+        &self,
+        expr: &SourceExpr,
+        alternatives: &[SourceExpr],
+    ) -> Result<Pattern, CompileError> {
+        if alternatives.is_empty() {
+            return Err(CompileError::new(
+                "or-pattern needs at least one alternative: (or pat1 pat2 ...)".to_string(),
+                expr.location.clone(),
+            ));
+        }
+
+        let mut patterns = Vec::with_capacity(alternatives.len());
+        let mut expected: Option<BTreeSet<String>> = None;
+
+        for alternative in alternatives {
+            let pattern = self.parse_pattern(alternative)?;
+            let mut vars = BTreeSet::new();
+            Self::pattern_variables(&pattern, &mut vars);
+
+            match &expected {
+                None => expected = Some(vars),
+                Some(first) if *first != vars => {
+                    return Err(CompileError::with_suggestion(
+                        format!(
+                            "or-pattern alternatives must bind the same variables: the first binds {}, this one binds {}",
+                            Self::format_variable_set(first),
+                            Self::format_variable_set(&vars),
+                        ),
+                        alternative.location.clone(),
+                        "Bind every variable in every alternative, using _ for the parts you don't need".to_string(),
+                    ));
+                }
+                Some(_) => {}
+            }
+
+            patterns.push(pattern);
+        }
+
+        Ok(Pattern::Or(patterns))
+    }
+
+    // Parse (@ name pattern): match `pattern` and bind the whole value to `name`
+    pub(super) fn parse_as_pattern(
+        &self,
+        expr: &SourceExpr,
+        parts: &[SourceExpr],
+    ) -> Result<Pattern, CompileError> {
+        match parts {
+            [name, inner] => match &name.expr {
+                LispExpr::Symbol(name) if name != "_" => {
+                    Ok(Pattern::As(name.clone(), Box::new(self.parse_pattern(inner)?)))
+                }
+                _ => Err(CompileError::with_suggestion(
+                    "as-pattern name must be a variable".to_string(),
+                    name.location.clone(),
+                    "Write (@ whole pattern), with the name that binds the whole value first".to_string(),
+                )),
+            },
+            _ => Err(CompileError::new(
+                "as-pattern expects a name and a pattern: (@ name pattern)".to_string(),
+                expr.location.clone(),
+            )),
+        }
+    }
+
+    // Parse (cons head tail): a pair whose car matches `head` and cdr matches
+    // `tail`, the same pattern as (head . tail)
+    pub(super) fn parse_cons_pattern(
+        &self,
+        expr: &SourceExpr,
+        parts: &[SourceExpr],
+    ) -> Result<Pattern, CompileError> {
+        match parts {
+            [head, tail] => Ok(Pattern::DottedList(
+                vec![self.parse_pattern(head)?],
+                Box::new(self.parse_pattern(tail)?),
+            )),
+            _ => Err(CompileError::new(
+                "cons pattern expects a head and a tail pattern: (cons head tail)".to_string(),
+                expr.location.clone(),
+            )),
+        }
+    }
+
+    // Parse (:type pattern): a value of that type, matched against `pattern`
+    pub(super) fn parse_type_pattern(
+        &self,
+        expr: &SourceExpr,
+        keyword: &str,
+        parts: &[SourceExpr],
+    ) -> Result<Pattern, CompileError> {
+        let types: &[&str] = match keyword {
+            ":integer" => &["integer"],
+            ":float" => &["float"],
+            ":number" => &["integer", "float"],
+            ":string" => &["string"],
+            ":symbol" => &["symbol"],
+            ":char" => &["char"],
+            ":boolean" => &["boolean"],
+            ":list" => &["list"],
+            ":vector" => &["vector"],
+            ":hashmap" => &["hashmap"],
+            ":function" => &["function", "closure"],
+            _ => {
+                return Err(CompileError::with_suggestion(
+                    format!("Unknown type pattern '{}'", keyword),
+                    expr.location.clone(),
+                    "Type patterns are :integer, :float, :number, :string, :symbol, :char, :boolean, :list, :vector, :hashmap and :function".to_string(),
+                ));
+            }
+        };
+        let inner = match parts {
+            [inner] => self.parse_pattern(inner)?,
+            _ => {
+                return Err(CompileError::new(
+                    format!("type pattern expects one pattern: ({} x)", keyword),
+                    expr.location.clone(),
+                ));
+            }
+        };
+        let mut alternatives: Vec<Pattern> = types.iter()
+            .map(|name| Pattern::Type(name.to_string(), Box::new(inner.clone())))
+            .collect();
+        Ok(match alternatives.len() {
+            1 => alternatives.remove(0),
+            _ => Pattern::Or(alternatives),
+        })
+    }
+
+    // Collect the variables a pattern binds (alternatives of an or all bind the same set)
+    pub(super) fn pattern_variables(pattern: &Pattern, vars: &mut BTreeSet<String>) {
+        match pattern {
+            Pattern::Variable(name) => {
+                vars.insert(name.clone());
+            }
+            Pattern::Wildcard | Pattern::Literal(_) | Pattern::QuotedSymbol(_) | Pattern::EmptyList => {}
+            Pattern::List(items) => {
+                for item in items {
+                    Self::pattern_variables(item, vars);
+                }
+            }
+            Pattern::DottedList(head, tail) => {
+                for item in head {
+                    Self::pattern_variables(item, vars);
+                }
+                Self::pattern_variables(tail, vars);
+            }
+            Pattern::Or(alternatives) => {
+                if let Some(first) = alternatives.first() {
+                    Self::pattern_variables(first, vars);
+                }
+            }
+            Pattern::Struct(_, fields) => {
+                for field in fields {
+                    Self::pattern_variables(field, vars);
+                }
+            }
+            Pattern::As(name, inner) => {
+                vars.insert(name.clone());
+                Self::pattern_variables(inner, vars);
+            }
+            Pattern::Type(_, inner) => Self::pattern_variables(inner, vars),
+        }
+    }
+
+    fn format_variable_set(vars: &BTreeSet<String>) -> String {
+        if vars.is_empty() {
+            "no variables".to_string()
+        } else {
+            let names: Vec<&str> = vars.iter().map(|v| v.as_str()).collect();
+            format!("{{{}}}", names.join(", "))
+        }
+    }
+
+    // Whether any pattern contains an or-, struct, as- or type pattern, or a list
+    // pattern nested in another, which only the path-based checks below handle;
+    // the per-argument checks only look one list deep
+    pub(super) fn needs_pattern_paths(patterns: &[Pattern]) -> bool {
+        let is_flat = |pattern: &Pattern| matches!(pattern,
+            Pattern::Variable(_) | Pattern::Wildcard | Pattern::Literal(_) | Pattern::QuotedSymbol(_) | Pattern::EmptyList);
+        patterns.iter().any(|pattern| match pattern {
+            Pattern::Or(_) | Pattern::Struct(_, _) | Pattern::As(_, _) | Pattern::Type(_, _) => true,
+            Pattern::List(items) => !items.iter().all(is_flat),
+            Pattern::DottedList(head, tail) => {
+                !head.iter().all(is_flat) || !matches!(tail.as_ref(), Pattern::Variable(_) | Pattern::Wildcard | Pattern::EmptyList)
+            }
+            _ => false,
+        })
+    }
+
+    // Whether two or-free patterns match exactly the same values: the same shape
+    // and literals, whatever names they bind
+    fn same_pattern(a: &Pattern, b: &Pattern) -> bool {
+        let all_same = |a: &[Pattern], b: &[Pattern]| a.len() == b.len() && a.iter().zip(b).all(|(a, b)| Self::same_pattern(a, b));
+        match (a, b) {
+            (Pattern::As(_, a), b) | (b, Pattern::As(_, a)) => Self::same_pattern(a, b),
+            (Pattern::Variable(_) | Pattern::Wildcard, Pattern::Variable(_) | Pattern::Wildcard) => true,
+            (Pattern::Literal(a), Pattern::Literal(b)) => a == b,
+            (Pattern::QuotedSymbol(a), Pattern::QuotedSymbol(b)) => a == b,
+            (Pattern::EmptyList, Pattern::EmptyList) => true,
+            (Pattern::List(a), Pattern::List(b)) => all_same(a, b),
+            (Pattern::DottedList(a, a_tail), Pattern::DottedList(b, b_tail)) => all_same(a, b) && Self::same_pattern(a_tail, b_tail),
+            (Pattern::Struct(a_name, a), Pattern::Struct(b_name, b)) => a_name == b_name && all_same(a, b),
+            (Pattern::Type(a_name, a), Pattern::Type(b_name, b)) => a_name == b_name && Self::same_pattern(a, b),
+            _ => false,
+        }
+    }
+
+    // For each clause that can never match, its index and the index of the earlier
+    // clause that always matches first: one without a guard that has the same
+    // patterns as every alternative of it. Clauses are (patterns, has guard).
+    pub(super) fn unreachable_clauses(clauses: &[(&[Pattern], bool)]) -> Vec<(usize, usize)> {
+        let expanded: Vec<Vec<Vec<Pattern>>> = clauses.iter().map(|(patterns, _)| Self::expand_or_patterns(patterns)).collect();
+        let same = |a: &[Pattern], b: &[Pattern]| a.len() == b.len() && a.iter().zip(b).all(|(a, b)| Self::same_pattern(a, b));
+        let mut unreachable = Vec::new();
+        for later in 1..clauses.len() {
+            let earlier = (0..later).find(|&earlier| {
+                !clauses[earlier].1 && expanded[later].iter()
+                    .all(|alternative| expanded[earlier].iter().any(|covering| same(covering, alternative)))
+            });
+            if let Some(earlier) = earlier {
+                unreachable.push((later, earlier));
+            }
+        }
+        unreachable
+    }
+
+    // Expand a pattern into its or-free alternatives, in the order they should be tried
+    fn expand_or_pattern(pattern: &Pattern) -> Vec<Pattern> {
+        match pattern {
+            Pattern::Or(alternatives) => alternatives.iter().flat_map(Self::expand_or_pattern).collect(),
+            Pattern::List(items) => Self::expand_or_patterns(items).into_iter().map(Pattern::List).collect(),
+            Pattern::DottedList(head, tail) => {
+                let mut parts = head.clone();
+                parts.push(tail.as_ref().clone());
+                Self::expand_or_patterns(&parts)
+                    .into_iter()
+                    .map(|mut parts| {
+                        let tail = parts.pop().expect("dotted pattern has a tail");
+                        Pattern::DottedList(parts, Box::new(tail))
+                    })
+                    .collect()
+            }
+            Pattern::Struct(name, fields) => Self::expand_or_patterns(fields)
+                .into_iter()
+                .map(|fields| Pattern::Struct(name.clone(), fields))
+                .collect(),
+            Pattern::As(name, inner) => Self::expand_or_pattern(inner)
+                .into_iter()
+                .map(|inner| Pattern::As(name.clone(), Box::new(inner)))
+                .collect(),
+            Pattern::Type(name, inner) => Self::expand_or_pattern(inner)
+                .into_iter()
+                .map(|inner| Pattern::Type(name.clone(), Box::new(inner)))
+                .collect(),
+            _ => vec![pattern.clone()],
+        }
+    }
+
+    // Expand a sequence of patterns; earlier positions vary slowest, so
+    // alternatives are tried left to right
+    fn expand_or_patterns(patterns: &[Pattern]) -> Vec<Vec<Pattern>> {
+        let mut expanded: Vec<Vec<Pattern>> = vec![Vec::new()];
+        for pattern in patterns {
+            let alternatives = Self::expand_or_pattern(pattern);
+            expanded = expanded
+                .into_iter()
+                .flat_map(|prefix| {
+                    alternatives.iter().map(move |alternative| {
+                        let mut next = prefix.clone();
+                        next.push(alternative.clone());
+                        next
+                    })
+                })
+                .collect();
+        }
+        expanded
+    }
+
+    // Compile the checks and bindings for a clause, matching each pattern against the
+    // value its root instruction loads (a clause without or-patterns is its only
+    // alternative). Bindings are pushed above the current stack depth. Every
+    // alternative but the last jumps to the shared body once it has bound its
+    // variables; the last falls through into it. Returns the jumps taken when the
+    // last alternative fails, which should go to the next clause.
+    pub(super) fn compile_pattern_alternatives(&mut self, roots: &[Instruction], patterns: &[Pattern]) -> Result<Vec<usize>, CompileError> {
+        let alternatives = Self::expand_or_patterns(patterns);
+        let mut body_jumps = Vec::new();
+        let outer_bindings = self.local_bindings.clone();
+        let outer_depth = self.stack_depth;
+
+        for (i, alternative) in alternatives.iter().enumerate() {
+            self.pattern_match_jumps.clear();
+            for (root, pattern) in roots.iter().zip(alternative) {
+                self.compile_pattern_check_at(pattern, std::slice::from_ref(root))?;
+            }
+            let failure_jumps = std::mem::take(&mut self.pattern_match_jumps);
+
+            // Bind in name order so every alternative produces the same stack layout
+            let mut bindings = BTreeMap::new();
+            for (root, pattern) in roots.iter().zip(alternative) {
+                Self::collect_pattern_paths(pattern, std::slice::from_ref(root), &mut bindings);
+            }
+            self.local_bindings = outer_bindings.clone();
+            self.stack_depth = outer_depth;
+            for (name, path) in bindings {
+                self.emit_pattern_path_load(&path);
+                self.local_bindings.insert(name, ValueLocation::Local(self.stack_depth));
+                self.stack_depth += 1;
+            }
+
+            if i == alternatives.len() - 1 {
+                let body = self.instruction_address;
+                for jump_idx in body_jumps {
+                    self.patch_jump(jump_idx, body);
+                }
+                return Ok(failure_jumps);
+            }
+
+            body_jumps.push(self.instruction_address);
+            self.emit(Instruction::Jmp(0)); // placeholder, patched to the shared body
+
+            let next_alternative = self.instruction_address;
+            for jump_idx in failure_jumps {
+                self.patch_jump(jump_idx, next_alternative);
+            }
+        }
+
+        unreachable!("an or-pattern always expands to at least one alternative")
+    }
+
+    // Load the value found by following `path`: a root load, then Car/Cdr/StructGet steps
+    fn emit_pattern_path_load(&mut self, path: &[Instruction]) {
+        for step in path {
+            self.emit(step.clone());
+        }
+    }
+
+    // Compare the value at `path` with a constant as equal? does (so 1 doesn't
+    // match 1.0), failing the alternative if they differ
+    fn emit_pattern_path_eq(&mut self, path: &[Instruction], value: Value) {
+        self.emit_pattern_path_load(path);
+        self.emit(Instruction::Push(value));
+        self.emit(Instruction::Equal);
+        self.pattern_match_jumps.push(self.instruction_address);
+        self.emit(Instruction::JmpIfFalse(0));
+    }
+
+    // Check an or-free pattern against the value at `path`. Structure is checked
+    // before any element is loaded, so the loads never fail at runtime.
+    fn compile_pattern_check_at(&mut self, pattern: &Pattern, path: &[Instruction]) -> Result<(), CompileError> {
+        match pattern {
+            Pattern::Variable(_) | Pattern::Wildcard => {}
+            Pattern::Literal(value) => {
+                self.emit_pattern_path_eq(path, value.clone());
+            }
+            Pattern::QuotedSymbol(s) => {
+                self.emit_pattern_path_eq(path, Value::symbol(s.as_str()));
+            }
+            Pattern::EmptyList => {
+                self.emit_pattern_path_eq(path, Value::List(List::Nil));
+            }
+            Pattern::List(items) => {
+                self.emit_pattern_path_load(path);
+                self.emit(Instruction::IsList);
+                self.pattern_match_jumps.push(self.instruction_address);
+                self.emit(Instruction::JmpIfFalse(0));
+
+                self.emit_pattern_path_load(path);
+                self.emit(Instruction::ListLength);
+                self.emit(Instruction::Push(Value::Integer(items.len() as i64)));
+                self.emit(Instruction::Eq);
+                self.pattern_match_jumps.push(self.instruction_address);
+                self.emit(Instruction::JmpIfFalse(0));
+
+                for (elem_idx, item) in items.iter().enumerate() {
+                    self.compile_pattern_check_at(item, &Self::element_path(path, elem_idx))?;
+                }
+            }
+            Pattern::DottedList(head, tail) => {
+                self.emit_pattern_path_load(path);
+                self.emit(Instruction::IsList);
+                self.pattern_match_jumps.push(self.instruction_address);
+                self.emit(Instruction::JmpIfFalse(0));
+
+                if !head.is_empty() {
+                    self.emit_pattern_path_load(path);
+                    self.emit(Instruction::ListLength);
+                    self.emit(Instruction::Push(Value::Integer(head.len() as i64)));
+                    self.emit(Instruction::Gte);
+                    self.pattern_match_jumps.push(self.instruction_address);
+                    self.emit(Instruction::JmpIfFalse(0));
+                }
+
+                for (elem_idx, item) in head.iter().enumerate() {
+                    self.compile_pattern_check_at(item, &Self::element_path(path, elem_idx))?;
+                }
+                self.compile_pattern_check_at(tail, &Self::rest_path(path, head.len()))?;
+            }
+            Pattern::Struct(name, fields) => {
+                self.emit_pattern_path_load(path);
+                self.emit(Instruction::IsStruct(name.clone()));
+                self.pattern_match_jumps.push(self.instruction_address);
+                self.emit(Instruction::JmpIfFalse(0));
+
+                for (field_idx, field) in fields.iter().enumerate() {
+                    self.compile_pattern_check_at(field, &Self::field_path(path, name, field_idx))?;
+                }
+            }
+            Pattern::As(_, inner) => {
+                self.compile_pattern_check_at(inner, path)?;
+            }
+            Pattern::Type(name, inner) => {
+                self.emit_pattern_path_load(path);
+                self.emit(Instruction::TypeOf);
+                self.emit(Instruction::Push(Value::symbol(name.as_str())));
+                self.emit(Instruction::Eq);
+                self.pattern_match_jumps.push(self.instruction_address);
+                self.emit(Instruction::JmpIfFalse(0));
+
+                self.compile_pattern_check_at(inner, path)?;
+            }
+            Pattern::Or(_) => unreachable!("or-patterns are expanded before checks are compiled"),
+        }
+        Ok(())
+    }
+
+    // Record the path to every variable in an or-free pattern. A name bound twice
+    // keeps its last occurrence, matching the other pattern binders.
+    fn collect_pattern_paths(
+        pattern: &Pattern,
+        path: &[Instruction],
+        bindings: &mut BTreeMap<String, Vec<Instruction>>,
+    ) {
+        match pattern {
+            Pattern::Variable(name) => {
+                bindings.insert(name.clone(), path.to_vec());
+            }
+            Pattern::Wildcard | Pattern::Literal(_) | Pattern::QuotedSymbol(_) | Pattern::EmptyList => {}
+            Pattern::List(items) => {
+                for (elem_idx, item) in items.iter().enumerate() {
+                    Self::collect_pattern_paths(item, &Self::element_path(path, elem_idx), bindings);
+                }
+            }
+            Pattern::DottedList(head, tail) => {
+                for (elem_idx, item) in head.iter().enumerate() {
+                    Self::collect_pattern_paths(item, &Self::element_path(path, elem_idx), bindings);
+                }
+                Self::collect_pattern_paths(tail, &Self::rest_path(path, head.len()), bindings);
+            }
+            Pattern::Struct(name, fields) => {
+                for (field_idx, field) in fields.iter().enumerate() {
+                    Self::collect_pattern_paths(field, &Self::field_path(path, name, field_idx), bindings);
+                }
+            }
+            Pattern::As(name, inner) => {
+                bindings.insert(name.clone(), path.to_vec());
+                Self::collect_pattern_paths(inner, path, bindings);
+            }
+            Pattern::Type(_, inner) => {
+                Self::collect_pattern_paths(inner, path, bindings);
+            }
+            Pattern::Or(_) => unreachable!("or-patterns are expanded before bindings are collected"),
+        }
+    }
+
+    // Path to the element at `index` of the list found at `path`
+    fn element_path(path: &[Instruction], index: usize) -> Vec<Instruction> {
+        let mut element = Self::rest_path(path, index);
+        element.push(Instruction::Car);
+        element
+    }
+
+    // Path to the list found at `path` with its first `skip` elements dropped
+    fn rest_path(path: &[Instruction], skip: usize) -> Vec<Instruction> {
+        let mut rest = path.to_vec();
+        rest.extend(std::iter::repeat(Instruction::Cdr).take(skip));
+        rest
+    }
+
+    // Path to field `index` of the `name` struct found at `path`
+    fn field_path(path: &[Instruction], name: &str, index: usize) -> Vec<Instruction> {
+        let mut field = path.to_vec();
+        field.push(Instruction::StructGet(name.to_string(), index));
+        field
+    }
+}
+
+// ==================== MATCH ====================
+
+impl Compiler {
+    // Compile match expression: (match expr (pattern body...) ...)
+    // The scrutinee is evaluated once into a local slot and each clause is checked
+    // against it in order. A clause that matches pushes its bindings above the slot,
+    // and its body slides them and the slot off, so every clause leaves just its
+    // value where the match started. A value no pattern matches is a runtime error.
+    //
+    // A clause can have a guard, (pattern (when guard) body...) or, as in defun,
+    // (pattern when guard body...). The guard runs with the bindings pushed; when
+    // it's false they are popped and matching goes on with the next clause.
+    pub(super) fn compile_match(&mut self, expr: &SourceExpr, items: &[SourceExpr]) -> Result<(), CompileError> {
+        if items.len() < 3 {
+            return Err(CompileError::new(
+                "match expects a value and at least 1 clause: (match expr (pattern body...) ...)".to_string(),
+                expr.location.clone(),
+            ));
+        }
+
+        let mut clauses = Vec::with_capacity(items.len() - 2);
+        for clause in &items[2..] {
+            match &clause.expr {
+                LispExpr::List(parts) if parts.len() >= 2 => {
+                    let (guard, body) = Self::split_match_guard(clause, &parts[1..])?;
+                    clauses.push((self.parse_pattern(&parts[0])?, guard, body));
+                }
+                _ => {
+                    return Err(CompileError::new(
+                        "match clause expects (pattern body...)".to_string(),
+                        clause.location.clone(),
+                    ));
+                }
+            }
+        }
+
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        self.compile_expr(&items[1])?;
+        let scrutinee = Instruction::GetLocal(self.stack_depth);
+        self.stack_depth += 1;
+
+        let saved_bindings = self.local_bindings.clone();
+        let saved_depth = self.stack_depth;
+        let mut end_jumps = Vec::with_capacity(clauses.len());
+
+        for (pattern, guard, body) in &clauses {
+            let failure_jumps = self.compile_pattern_alternatives(std::slice::from_ref(&scrutinee), std::slice::from_ref(pattern))?;
+            let bound = self.stack_depth - saved_depth;
+
+            // The guard sees the bindings; it is not in tail position
+            let guard_jump = match guard {
+                Some(guard) => {
+                    self.in_tail_position = false;
+                    self.compile_expr(guard)?;
+                    let jump_idx = self.instruction_address;
+                    self.emit(Instruction::JmpIfFalse(0)); // placeholder, patched to guard_failed
+                    Some(jump_idx)
+                }
+                None => None,
+            };
+
+            self.in_tail_position = saved_tail;
+            self.compile_sequence(body)?;
+            // The bindings and the scrutinee go, the value stays
+            self.emit(Instruction::Slide(self.stack_depth - saved_depth + 1));
+            end_jumps.push(self.instruction_address);
+            self.emit(Instruction::Jmp(0)); // placeholder, patched to the end
+
+            // guard_failed: pop the bindings, leaving the scrutinee for the next clause
+            if let Some(jump_idx) = guard_jump {
+                let guard_failed = self.instruction_address;
+                self.patch_jump(jump_idx, guard_failed);
+                if bound > 0 {
+                    self.emit(Instruction::PopN(bound));
+                }
+            }
+
+            self.local_bindings = saved_bindings.clone();
+            self.stack_depth = saved_depth;
+            let next_clause = self.instruction_address;
+            for jump_idx in failure_jumps {
+                self.patch_jump(jump_idx, next_clause);
+            }
+        }
+
+        // Only the scrutinee is left on the stack when every clause has failed
+        self.emit(Instruction::MatchFailed);
+
+        let end = self.instruction_address;
+        for jump_idx in end_jumps {
+            self.patch_jump(jump_idx, end);
+        }
+        self.stack_depth -= 1;
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+
+    // Split what follows a match clause's pattern into its guard, if it has one,
+    // and its body. (when guard) only counts as a guard when a body follows it,
+    // so a clause whose body is a when expression keeps it.
+    pub(super) fn split_match_guard<'a>(clause: &SourceExpr, rest: &'a [SourceExpr]) -> Result<(Option<&'a SourceExpr>, &'a [SourceExpr]), CompileError> {
+        let is_when = |item: &SourceExpr| matches!(&item.expr, LispExpr::Symbol(s) if s == "when");
+        if is_when(&rest[0]) {
+            if rest.len() < 3 {
+                return Err(CompileError::new(
+                    "Guarded match clause must have a guard and a body: (pattern when guard body...)".to_string(),
+                    clause.location.clone(),
+                ));
+            }
+            return Ok((Some(&rest[1]), &rest[2..]));
+        }
+        if let LispExpr::List(parts) = &rest[0].expr {
+            if parts.len() == 2 && is_when(&parts[0]) && rest.len() >= 2 {
+                return Ok((Some(&parts[1]), &rest[1..]));
+            }
+        }
+        Ok((None, rest))
+    }
+}
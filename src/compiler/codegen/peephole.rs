@@ -0,0 +1,290 @@
+// Peephole pass over a finished function body. It deletes instructions that do
+// nothing: jumps to the next instruction, Slide(0) and PopN(0), a value pushed
+// only to be popped, and code no path reaches, such as what follows an
+// unconditional jump, a return or a tail call. A jump to a jump goes straight to
+// the final target, and two argument or local loads feeding an Add become one
+// fused instruction. Every jump target, the source map and the slot names are
+// relocated to match, and each change can expose more (a jump over dead code
+// becomes a jump to the next instruction), so it repeats until nothing changes;
+// running it on its own output changes nothing.
+
+use std::collections::HashSet;
+
+use crate::vm::instructions::Instruction;
+use crate::vm::source_map::{relocation_table, SourceMap, SlotNames};
+use super::Compiler;
+
+impl Compiler {
+    /// Run the peephole pass, when optimizations are on
+    pub(super) fn peephole(&self, bytecode: &mut Vec<Instruction>, locations: &mut SourceMap, slot_names: &mut SlotNames) {
+        if !self.fold_constants {
+            return;
+        }
+        loop {
+            let threaded = thread_jumps(bytecode);
+            let kept = simplify(bytecode);
+            if !threaded && kept.iter().all(|keep| *keep) {
+                return;
+            }
+            relocate(bytecode, &kept);
+            locations.retain(&kept);
+            slot_names.retain(&kept);
+        }
+    }
+}
+
+/// Rewrite instructions in place where a shorter sequence does the same, and
+/// flag the ones that can then be deleted
+fn simplify(bytecode: &mut [Instruction]) -> Vec<bool> {
+    let mut kept = removable(bytecode).iter().map(|remove| !remove).collect::<Vec<bool>>();
+    // Only the first instruction of a sequence may be jumped to, or the
+    // sequence doesn't always run as a whole
+    let targets: HashSet<usize> = bytecode.iter().flat_map(jump_targets).collect();
+    let joinable = |kept: &[bool], from: usize, len: usize| {
+        from + len <= kept.len() && (from..from + len).all(|i| kept[i]) && (from + 1..from + len).all(|i| !targets.contains(&i))
+    };
+
+    let mut i = 0;
+    while i < bytecode.len() {
+        if joinable(&kept, i, 3) {
+            let fused = match (&bytecode[i], &bytecode[i + 1], &bytecode[i + 2]) {
+                (Instruction::LoadArg(a), Instruction::LoadArg(b), Instruction::Add) => Some(Instruction::AddArgs(*a, *b)),
+                (Instruction::GetLocal(a), Instruction::GetLocal(b), Instruction::Add) => Some(Instruction::AddLocals(*a, *b)),
+                _ => None,
+            };
+            if let Some(fused) = fused {
+                // The fused instruction takes the Add's place, so errors keep its location
+                bytecode[i + 2] = fused;
+                kept[i] = false;
+                kept[i + 1] = false;
+                i += 3;
+                continue;
+            }
+        }
+        if joinable(&kept, i, 2) {
+            let pushes = matches!(bytecode[i], Instruction::Push(_) | Instruction::LoadArg(_) | Instruction::GetLocal(_));
+            if let (true, Instruction::PopN(n)) = (pushes, &bytecode[i + 1]) {
+                if *n > 0 {
+                    bytecode[i + 1] = Instruction::PopN(n - 1);
+                    kept[i] = false;
+                    i += 2;
+                    continue;
+                }
+            }
+        }
+        i += 1;
+    }
+    kept
+}
+
+/// Which instructions can be deleted without changing what the body does
+fn removable(bytecode: &[Instruction]) -> Vec<bool> {
+    let reachable = reachable(bytecode);
+    (0..bytecode.len())
+        .map(|i| {
+            !reachable.contains(&i) || match &bytecode[i] {
+                Instruction::Jmp(target) => *target == i + 1,
+                Instruction::Slide(0) | Instruction::PopN(0) => true,
+                _ => false,
+            }
+        })
+        .collect()
+}
+
+/// Point each jump whose target is an unconditional jump at where that one
+/// goes. An and/or jump that lands on another of its kind would take that one
+/// too, since the value it leaves is the one tested there. Returns whether any
+/// target changed.
+fn thread_jumps(bytecode: &mut [Instruction]) -> bool {
+    let mut changed = false;
+    for i in 0..bytecode.len() {
+        let mut instruction = bytecode[i].clone();
+        for_each_target(&mut instruction, |addr| {
+            let target = final_target(bytecode, &bytecode[i], *addr);
+            changed |= target != *addr;
+            *addr = target;
+        });
+        bytecode[i] = instruction;
+    }
+    changed
+}
+
+/// Where a jump from `from` to `target` ends up. A cycle of jumps (an empty
+/// infinite loop) has nowhere to end, so its jumps are left as they are
+fn final_target(bytecode: &[Instruction], from: &Instruction, target: usize) -> usize {
+    let mut visited = HashSet::new();
+    let mut current = target;
+    while visited.insert(current) {
+        current = match (from, bytecode.get(current)) {
+            (_, Some(Instruction::Jmp(next))) => *next,
+            (Instruction::JmpIfFalseOrPop(_), Some(Instruction::JmpIfFalseOrPop(next)))
+            | (Instruction::JmpIfTrueOrPop(_), Some(Instruction::JmpIfTrueOrPop(next))) => *next,
+            _ => return current,
+        };
+    }
+    target
+}
+
+/// Addresses some path from the entry reaches
+fn reachable(bytecode: &[Instruction]) -> HashSet<usize> {
+    let mut reached = HashSet::new();
+    let mut to_visit = vec![0];
+    while let Some(addr) = to_visit.pop() {
+        if addr >= bytecode.len() || !reached.insert(addr) {
+            continue;
+        }
+        to_visit.extend(jump_targets(&bytecode[addr]));
+        if falls_through(&bytecode[addr]) {
+            to_visit.push(addr + 1);
+        }
+    }
+    reached
+}
+
+/// Whether execution can continue with the next instruction. A function body
+/// always runs in a frame, which a tail call reuses, so it never comes back
+fn falls_through(instruction: &Instruction) -> bool {
+    !matches!(
+        instruction,
+        Instruction::Jmp(_) | Instruction::JumpTable(..) | Instruction::Ret | Instruction::Halt
+            | Instruction::Raise | Instruction::Throw | Instruction::MatchFailed | Instruction::ClauseFailed(_)
+            | Instruction::TailCall(..) | Instruction::TailCallClosure(_) | Instruction::TailApply
+    )
+}
+
+/// Addresses an instruction can transfer control to, other than the next one
+fn jump_targets(instruction: &Instruction) -> Vec<usize> {
+    let mut targets = Vec::new();
+    for_each_target(&mut instruction.clone(), |addr| targets.push(*addr));
+    targets
+}
+
+/// Call `f` on each jump target of an instruction
+fn for_each_target(instruction: &mut Instruction, mut f: impl FnMut(&mut usize)) {
+    match instruction {
+        Instruction::Jmp(addr) | Instruction::JmpIfFalse(addr) | Instruction::CheckArity(_, addr)
+        | Instruction::JmpIfFalseOrPop(addr) | Instruction::JmpIfTrueOrPop(addr)
+        | Instruction::PushHandler(addr) | Instruction::PushCatch(addr) => f(addr),
+        Instruction::JumpTable(_, targets, default) => {
+            targets.iter_mut().for_each(&mut f);
+            f(default);
+        }
+        _ => {}
+    }
+}
+
+/// Delete the instructions whose `kept` flag is false and point every jump at
+/// the new address of its target
+fn relocate(bytecode: &mut Vec<Instruction>, kept: &[bool]) {
+    let new_offsets = relocation_table(kept);
+    let mut index = 0;
+    bytecode.retain_mut(|instruction| {
+        let keep = kept[index];
+        index += 1;
+        for_each_target(instruction, |addr| *addr = new_offsets[(*addr).min(kept.len())]);
+        keep
+    });
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::vm::value::Value;
+    use Instruction::*;
+
+    /// The body after the pass, with one source map entry per instruction to
+    /// check they stay in step
+    fn optimize(mut bytecode: Vec<Instruction>) -> Vec<Instruction> {
+        let mut locations = SourceMap::new();
+        for i in 0..bytecode.len() {
+            locations.record(i, &crate::vm::errors::Location::new(i + 1, 1, "body".to_string()));
+        }
+        let mut slot_names = SlotNames::new();
+        Compiler::new().peephole(&mut bytecode, &mut locations, &mut slot_names);
+        bytecode
+    }
+
+    fn int(n: i64) -> Instruction {
+        Push(Value::Integer(n))
+    }
+
+    #[test]
+    fn test_push_then_pop_is_removed() {
+        assert_eq!(optimize(vec![int(1), PopN(1), LoadArg(0), Ret]), vec![LoadArg(0), Ret]);
+        assert_eq!(optimize(vec![LoadArg(0), int(1), PopN(2), LoadArg(1), Ret]), vec![LoadArg(1), Ret]);
+    }
+
+    #[test]
+    fn test_pop_that_is_a_jump_target_is_kept() {
+        // Another path reaches the PopN with its own value to drop
+        let body = vec![LoadArg(0), JmpIfFalse(4), int(1), Jmp(5), int(2), PopN(1), int(3), Ret];
+        let optimized = optimize(body);
+        assert!(optimized.contains(&PopN(1)), "got: {:?}", optimized);
+    }
+
+    #[test]
+    fn test_jump_chains_collapse() {
+        // 1 jumps to 3, which jumps to 5, which jumps to 6; then the jumps over
+        // nothing go too
+        let body = vec![LoadArg(0), JmpIfFalse(3), Jmp(6), Jmp(5), int(9), Jmp(6), int(1), Ret];
+        assert_eq!(optimize(body), vec![LoadArg(0), JmpIfFalse(2), int(1), Ret]);
+        // An and jumping to another and's jump takes that one too
+        let body = vec![LoadArg(0), JmpIfFalseOrPop(3), LoadArg(1), JmpIfFalseOrPop(5), LoadArg(2), Ret];
+        assert_eq!(optimize(body)[1], JmpIfFalseOrPop(5));
+    }
+
+    #[test]
+    fn test_forward_jumps_are_relocated() {
+        // The unreachable Push(99) before the target shifts it down by one
+        let body = vec![LoadArg(0), JmpIfFalse(5), int(1), Ret, int(99), int(2), Ret];
+        assert_eq!(optimize(body), vec![LoadArg(0), JmpIfFalse(4), int(1), Ret, int(2), Ret]);
+    }
+
+    #[test]
+    fn test_backward_jumps_are_relocated() {
+        // A loop whose head moves when the dead code before it goes
+        let body = vec![
+            Jmp(3), int(99), int(98),
+            GetLocal(0), JmpIfFalse(8), int(1), PopN(1), Jmp(3),
+            int(0), Ret,
+        ];
+        assert_eq!(optimize(body), vec![GetLocal(0), JmpIfFalse(3), Jmp(0), int(0), Ret]);
+    }
+
+    #[test]
+    fn test_code_after_a_tail_call_is_removed() {
+        let body = vec![LoadArg(0), TailCall("f".to_string(), 1), Ret];
+        assert_eq!(optimize(body), vec![LoadArg(0), TailCall("f".to_string(), 1)]);
+        let body = vec![LoadArg(0), LoadArg(1), TailCallClosure(1), Ret];
+        assert_eq!(optimize(body), vec![LoadArg(0), LoadArg(1), TailCallClosure(1)]);
+    }
+
+    #[test]
+    fn test_loads_feeding_add_are_fused() {
+        assert_eq!(optimize(vec![LoadArg(0), LoadArg(1), Add, Ret]), vec![AddArgs(0, 1), Ret]);
+        assert_eq!(optimize(vec![GetLocal(2), GetLocal(2), Add, Ret]), vec![AddLocals(2, 2), Ret]);
+        // Not when a jump lands between the loads
+        let body = vec![LoadArg(0), JmpIfFalse(4), LoadArg(0), Jmp(5), LoadArg(1), LoadArg(1), Add, Ret];
+        assert!(optimize(body).contains(&LoadArg(1)));
+    }
+
+    #[test]
+    fn test_pass_is_idempotent() {
+        let bodies = vec![
+            vec![LoadArg(0), JmpIfFalse(3), Jmp(6), Jmp(5), int(9), Jmp(6), int(1), Ret],
+            vec![Jmp(3), int(99), int(98), GetLocal(0), JmpIfFalse(8), int(1), PopN(1), Jmp(3), int(0), Ret],
+            vec![LoadArg(0), LoadArg(1), Add, int(1), PopN(1), Ret],
+            vec![LoadArg(0), JmpIfFalseOrPop(2), JmpIfFalseOrPop(3), Ret],
+        ];
+        for body in bodies {
+            let once = optimize(body);
+            assert_eq!(optimize(once.clone()), once);
+        }
+    }
+
+    #[test]
+    fn test_jump_cycles_terminate() {
+        assert_eq!(optimize(vec![Jmp(1), Jmp(0)]), vec![Jmp(0)]);
+        assert_eq!(optimize(vec![LoadArg(0), Jmp(2), Jmp(3), Jmp(1)]), vec![LoadArg(0), Jmp(1)]);
+    }
+}
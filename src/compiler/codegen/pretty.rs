@@ -0,0 +1,34 @@
+// (pp value) and (pp value depth length): write a value for reading at a
+// glance, cut down to a depth and a length per list (by default those of error
+// messages) and broken over lines to fit
+
+use crate::vm::instructions::Instruction;
+use crate::vm::errors::CompileError;
+use crate::vm::printer;
+use crate::vm::value::Value;
+use super::Compiler;
+use super::super::ast::SourceExpr;
+
+impl Compiler {
+    pub(super) fn compile_pp(&mut self, expr: &SourceExpr, items: &[SourceExpr]) -> Result<(), CompileError> {
+        if items.len() != 2 && items.len() != 4 {
+            return Err(CompileError::new(
+                "pp expects 1 or 3 arguments: the value, then optionally a max depth and a max length".to_string(),
+                expr.location.clone(),
+            ));
+        }
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        for arg in &items[1..] {
+            self.compile_operand(arg)?;
+        }
+        self.stack_depth -= items.len() - 1;
+        if items.len() == 2 {
+            self.emit(Instruction::Push(Value::Integer(printer::DEFAULT_MAX_DEPTH as i64)));
+            self.emit(Instruction::Push(Value::Integer(printer::DEFAULT_MAX_LENGTH as i64)));
+        }
+        self.emit(Instruction::PrettyPrint);
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+}
@@ -0,0 +1,61 @@
+// Fixed-arity primitives: (cons a lst), (car lst), (cdr lst), the type
+// predicates, the symbol and string conversions, (eq? a b) and friends,
+// floor, ceil and round, and simple file I/O like (read-file path)
+//
+// Each compiles inline to a single instruction. Like the character builtins
+// they are kept out of compile_located_expr, whose frame every nested form
+// pays for.
+
+use crate::vm::instructions::Instruction;
+use crate::vm::errors::CompileError;
+use super::Compiler;
+use super::super::ast::SourceExpr;
+
+impl Compiler {
+    pub(super) fn compile_primitive(&mut self, expr: &SourceExpr, operator: &str, items: &[SourceExpr]) -> Result<(), CompileError> {
+        // The usage is appended to the arity error, where there is one
+        let (arity, usage, instruction) = match operator {
+            "cons" => (2, "", Instruction::Cons),
+            "car" => (1, "", Instruction::Car),
+            "cdr" => (1, "", Instruction::Cdr),
+            "list?" => (1, "", Instruction::IsList),
+            "string?" => (1, "", Instruction::IsString),
+            "symbol?" => (1, "", Instruction::IsSymbol),
+            "symbol->string" => (1, "", Instruction::SymbolToString),
+            "string->symbol" => (1, "", Instruction::StringToSymbol),
+            "string-length" => (1, "", Instruction::StringLength),
+            "substring" => (3, " (string, start, end)", Instruction::Substring),
+            "string-append" => (2, "", Instruction::StringAppend),
+            "eq?" => (2, "", Instruction::IsEq),
+            "eqv?" => (2, "", Instruction::IsEqv),
+            "equal?" => (2, "", Instruction::Equal),
+            "string=?" => (2, "", Instruction::StringEq),
+            "string->list" => (1, "", Instruction::StringToList),
+            "list->string" => (1, "", Instruction::ListToString),
+            "floor" => (1, "", Instruction::Floor),
+            "ceil" => (1, "", Instruction::Ceil),
+            "round" => (1, "", Instruction::Round),
+            "read-file" => (1, " (path)", Instruction::ReadFile),
+            "write-file" => (2, " (path, content)", Instruction::WriteFile),
+            "file-exists?" => (1, " (path)", Instruction::FileExists),
+            "write-binary-file" => (2, " (path, bytes)", Instruction::WriteBinaryFile),
+            _ => (1, " (char or single-char string)", Instruction::CharCode),
+        };
+        if items.len() != arity + 1 {
+            let plural = if arity == 1 { "" } else { "s" };
+            return Err(CompileError::new(
+                format!("{} expects exactly {} argument{}{}", operator, arity, plural, usage),
+                expr.location.clone(),
+            ));
+        }
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        for arg in &items[1..] {
+            self.compile_operand(arg)?;
+        }
+        self.stack_depth -= arity;
+        self.emit(instruction);
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+}
@@ -0,0 +1,46 @@
+// Promises: (delay expr) and (cons-stream a b)
+//
+// delay compiles expr as the body of a thunk, (lambda () expr), wrapped in a
+// promise; force (a VM function) calls the thunk the first time and keeps its
+// value. (cons-stream a b) is (cons a (delay b)), the pair stream-car and
+// stream-cdr take apart.
+
+use crate::vm::instructions::Instruction;
+use crate::vm::errors::CompileError;
+use super::Compiler;
+use super::super::ast::{LispExpr, SourceExpr};
+
+impl Compiler {
+    pub(super) fn compile_promise_form(&mut self, expr: &SourceExpr, operator: &str, items: &[SourceExpr]) -> Result<(), CompileError> {
+        if operator == "delay" {
+            if items.len() != 2 {
+                return Err(CompileError::new(
+                    "delay expects exactly 1 expression: (delay expr)".to_string(),
+                    expr.location.clone(),
+                ));
+            }
+            return self.compile_delay(expr, &items[1]);
+        }
+        if items.len() != 3 {
+            return Err(CompileError::new(
+                "cons-stream expects exactly 2 arguments: (cons-stream first rest)".to_string(),
+                expr.location.clone(),
+            ));
+        }
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        self.compile_operand(&items[1])?;
+        self.compile_delay(expr, &items[2])?;
+        self.emit(Instruction::Cons);
+        self.stack_depth -= 1;
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+
+    fn compile_delay(&mut self, expr: &SourceExpr, body: &SourceExpr) -> Result<(), CompileError> {
+        let no_params = SourceExpr::new(LispExpr::List(Vec::new()), expr.location.clone());
+        self.compile_lambda(&no_params, body)?;
+        self.emit(Instruction::MakePromise);
+        Ok(())
+    }
+}
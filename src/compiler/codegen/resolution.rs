@@ -0,0 +1,144 @@
+// Resolution of global names across a whole program.
+//
+// While compile_program runs, references to names that are not defined yet are
+// collected instead of failing on the first one. Functions reached by a call may
+// still be defined further down the file (or inside a module), so the check runs
+// once every top-level form has been compiled, and all names still undefined are
+// reported in a single error. Calls are not checked in a program that loads or
+// evaluates code, since that code can define more functions.
+//
+// A direct call to a defun compiled earlier is also checked against its parameter
+// list. Calls to functions defined further down are not, so forward references
+// never cause a false error.
+
+use std::collections::HashSet;
+use std::sync::OnceLock;
+
+use crate::vm::errors::{CompileError, Location};
+use crate::vm::vm::VM;
+use super::Compiler;
+
+/// A reference to a global name that was not defined when it was compiled
+#[derive(Debug, Clone)]
+pub(super) struct UnresolvedName {
+    pub name: String,
+    pub location: Location,
+    pub is_call: bool, // Called by name, rather than read as a variable
+    pub expansion: Option<(String, Location)>, // Note for a name from a macro's expansion
+}
+
+/// Names of the functions every VM starts with
+fn vm_builtin_functions() -> &'static HashSet<String> {
+    static BUILTINS: OnceLock<HashSet<String>> = OnceLock::new();
+    BUILTINS.get_or_init(|| VM::new().functions.into_keys().collect())
+}
+
+impl Compiler {
+    /// Report calls to functions that are never defined (on by default).
+    /// With the check off, a call may name a function that only exists at runtime,
+    /// as in the REPL where a later input can define it.
+    pub fn set_check_unresolved(&mut self, enabled: bool) {
+        self.check_unresolved = enabled;
+    }
+
+    // Whether a named call can be resolved to a function
+    pub(super) fn is_defined_function(&self, name: &str) -> bool {
+        self.functions.contains_key(name)
+            || self.known_functions.contains(name)
+            || self.module_functions.contains(name)
+            || Self::is_builtin_function(name)
+            || vm_builtin_functions().contains(name)
+    }
+
+    // Remember a name that isn't defined yet; returns false when names aren't being
+    // collected, so the caller reports it right away
+    pub(super) fn defer_unresolved(&mut self, name: &str, location: &Location, is_call: bool) -> bool {
+        match self.unresolved.as_mut() {
+            Some(unresolved) => {
+                unresolved.push(UnresolvedName { name: name.to_string(), location: location.clone(), is_call, expansion: self.expansion.clone() });
+                true
+            }
+            None => false,
+        }
+    }
+
+    // Error for a direct call whose argument count the callee's definition rules out
+    pub(super) fn arity_error(&self, name: &str, arg_count: usize, location: &Location) -> Option<CompileError> {
+        let (required, has_rest) = *self.function_arities.get(name)?;
+        let (matches, expected) = if has_rest {
+            (arg_count >= required, format!("at least {}", required))
+        } else {
+            (arg_count == required, required.to_string())
+        };
+        if matches {
+            return None;
+        }
+
+        let params = self.function_params.get(name).cloned().unwrap_or_default();
+        let keywords = self.function_keywords.get(name);
+        let params = match (has_rest, params.split_last()) {
+            // The rest parameter holds the keyword arguments
+            (true, Some((_, required))) if keywords.is_some() => {
+                let keys: Vec<&str> = keywords.into_iter().flatten().map(|keyword| &keyword[1..]).collect();
+                required.iter().map(String::as_str).chain(["&key"]).chain(keys).collect::<Vec<_>>().join(" ")
+            }
+            (true, Some((rest, required))) if required.is_empty() => format!(". {}", rest),
+            (true, Some((rest, required))) => format!("{} . {}", required.join(" "), rest),
+            _ => params.join(" "),
+        };
+        Some(CompileError::with_suggestion(
+            format!("'{}' expects {} argument(s), got {}", name, expected, arg_count),
+            location.clone(),
+            format!("It is defined as (defun {} ({}) ...)", name, params),
+        ))
+    }
+
+    // Error for every collected name that the whole program doesn't define
+    pub(super) fn check_unresolved_names(&self, unresolved: Vec<UnresolvedName>) -> Result<(), CompileError> {
+        let mut seen = HashSet::new();
+        let mut remaining: Vec<UnresolvedName> = unresolved.into_iter()
+            .filter(|entry| {
+                if entry.is_call {
+                    // Loaded or evaluated code may define the function
+                    !self.defines_at_runtime && !self.is_defined_function(&entry.name)
+                } else {
+                    !self.global_vars.contains_key(&entry.name)
+                }
+            })
+            .filter(|entry| seen.insert(entry.name.clone()))
+            .collect();
+        remaining.sort_by_key(|entry| (entry.location.line, entry.location.column));
+
+        let first = match remaining.first() {
+            Some(first) => first,
+            None => return Ok(()),
+        };
+        if remaining.len() == 1 {
+            let (kind, suggestion) = if first.is_call {
+                ("function", format!("Check the spelling, or define it with (defun {} ...)", first.name))
+            } else {
+                ("variable", self.suggest_similar_name(&first.name))
+            };
+            let error = CompileError::with_suggestion(
+                format!("Undefined {} '{}'", kind, first.name),
+                first.location.clone(),
+                suggestion,
+            );
+            return Err(match &first.expansion {
+                Some((note, location)) => error.with_note(note.clone(), location.clone()),
+                None => error,
+            });
+        }
+
+        let names: Vec<String> = remaining.iter()
+            .map(|entry| {
+                let kind = if entry.is_call { "function" } else { "variable" };
+                format!("{} '{}' ({}:{})", kind, entry.name, entry.location.line, entry.location.column)
+            })
+            .collect();
+        Err(CompileError::new(
+            format!("{} undefined names: {}", remaining.len(), names.join(", ")),
+            first.location.clone(),
+        ))
+    }
+}
@@ -1,18 +1,23 @@
-// Special forms: let, loop, recur, cond, and, or
+// Special forms: let, let*, set!, handler-case, catch, loop, recur, dotimes, dolist, cond, and, or
 
-use crate::vm::value::Value;
+use crate::vm::value::{Value, List};
 use crate::vm::instructions::Instruction;
 use crate::vm::errors::CompileError;
 use super::Compiler;
-use super::types::ValueLocation;
+use super::types::{ValueLocation, LoopTarget};
 use super::super::ast::{LispExpr, SourceExpr};
 
-// ==================== SPECIAL FORMS (LET, LOOP, RECUR, COND, AND, OR) ====================
+// ==================== SPECIAL FORMS (LET, LET*, SET!, HANDLER-CASE, CATCH, LOOP, RECUR, DOTIMES, DOLIST, COND, AND, OR) ====================
 
 impl Compiler {
     // Compile let expression: (let ((pattern value) ...) body)
+    // Each binding is in scope before the next value is compiled, which is exactly
+    // what let* promises, so both forms share this code (`form` names the caller in errors).
+    // A binding that shadows an earlier one still gets its own stack slot, so the
+    // final Slide pops every value that was pushed.
     pub(super) fn compile_let(
         &mut self,
+        form: &str,
         bindings_expr: &SourceExpr,
         body_expr: &SourceExpr,
     ) -> Result<(), CompileError> {
@@ -21,7 +26,7 @@ impl Compiler {
             LispExpr::List(b) => b,
             _ => {
                 return Err(CompileError::new(
-                    "let bindings must be a list".to_string(),
+                    format!("{} bindings must be a list", form),
                     bindings_expr.location.clone(),
                 ));
             }
@@ -31,6 +36,18 @@ impl Compiler {
         let saved_bindings = self.local_bindings.clone();
         let saved_stack_depth = self.stack_depth;
 
+        // Bindings that a closure captures and set! assigns live in cells
+        let names: Vec<String> = bindings.iter()
+            .filter_map(|binding| match &binding.expr {
+                LispExpr::List(pair) => match pair.first().map(|p| &p.expr) {
+                    Some(LispExpr::Symbol(name)) => Some(name.clone()),
+                    _ => None,
+                },
+                _ => None,
+            })
+            .collect();
+        let boxed = Self::mutated_captures(&names, &[bindings_expr, body_expr]);
+
         let mut num_bindings = 0;
 
         // Process each binding
@@ -59,6 +76,24 @@ impl Compiler {
             let saved_tail = self.in_tail_position;
             self.in_tail_position = false;
 
+            if let LispExpr::Symbol(name) = &pattern.expr {
+                if boxed.contains(name) {
+                    // The slot holds the cell; the value is stored into it, as letrec does
+                    self.emit(Instruction::MakeCell);
+                    let position = self.stack_depth;
+                    self.stack_depth += 1;
+                    num_bindings += 1;
+                    self.compile_expr(value_expr)?;
+                    self.emit(Instruction::GetLocal(position));
+                    self.emit(Instruction::CellSet);
+                    self.in_tail_position = saved_tail;
+
+                    let location = ValueLocation::Cell(Box::new(ValueLocation::Local(position)), name.clone());
+                    self.local_bindings.insert(name.clone(), location);
+                    continue;
+                }
+            }
+
             // Compile the value expression (pushes result onto stack)
             self.compile_expr(value_expr)?;
 
@@ -92,6 +127,342 @@ impl Compiler {
         Ok(())
     }
 
+    // Compile set! expression: (set! name value)
+    // Writes through the binding's cell when closures share it, otherwise into the
+    // stack slot, argument slot or global (a define, not a def). Leaves the new
+    // value on the stack.
+    pub(super) fn compile_set(&mut self, expr: &SourceExpr, items: &[SourceExpr]) -> Result<(), CompileError> {
+        if items.len() != 3 {
+            return Err(CompileError::new(
+                "set! expects exactly 2 arguments: variable and value".to_string(),
+                expr.location.clone(),
+            ));
+        }
+        let name = match &items[1].expr {
+            LispExpr::Symbol(name) => name.clone(),
+            _ => {
+                return Err(CompileError::new(
+                    "set! target must be a variable name".to_string(),
+                    items[1].location.clone(),
+                ));
+            }
+        };
+
+        let location = self.local_bindings.get(&name).or_else(|| self.pattern_bindings.get(&name)).cloned();
+        let param_index = self.param_names.iter().position(|p| *p == name);
+
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        match (location, param_index) {
+            (Some(location @ ValueLocation::Cell(_, _)), _) => {
+                self.compile_expr(&items[2])?;
+                location.emit_capture(self);
+                self.emit(Instruction::CellSet);
+                location.emit_load(self);
+            }
+            (Some(ValueLocation::Local(position)), _) => {
+                self.compile_expr(&items[2])?;
+                self.emit(Instruction::SetLocal(position));
+                self.emit(Instruction::GetLocal(position));
+            }
+            (Some(ValueLocation::Captured(_)), _) => {
+                return Err(CompileError::new(
+                    format!("Cannot set! '{}' here: this closure holds a copy of it", name),
+                    items[1].location.clone(),
+                ));
+            }
+            (Some(_), _) => {
+                return Err(CompileError::new(
+                    format!("Cannot set! '{}': it is bound by a destructuring pattern", name),
+                    items[1].location.clone(),
+                ));
+            }
+            (None, Some(index)) => {
+                self.compile_expr(&items[2])?;
+                self.emit(Instruction::StoreArg(index));
+                self.emit(Instruction::LoadArg(index));
+            }
+            (None, None) if self.is_global_variable(&name) => {
+                let resolved = self.resolve_global_name(&name);
+                let global = if self.global_vars.contains_key(&resolved) || self.known_globals.contains(&resolved) {
+                    resolved
+                } else {
+                    name.clone()
+                };
+                if let Some(constant) = self.constants.get(&global) {
+                    return Err(CompileError::new(
+                        format!("Cannot set! constant '{}'", global),
+                        items[1].location.clone(),
+                    ).with_note(format!("'{}' is defined with defconst here", global), constant.location.clone()));
+                }
+                if self.global_vars.get(&global) == Some(&false) || self.constant_globals.contains(&global) {
+                    return Err(CompileError::with_suggestion(
+                        format!("Cannot set! constant '{}' - def bindings are immutable", global),
+                        items[1].location.clone(),
+                        format!("Use (define {} ...) for a global that set! can reassign", name),
+                    ));
+                }
+                self.compile_expr(&items[2])?;
+                self.emit(Instruction::StoreGlobal(global.clone()));
+                self.emit(Instruction::LoadGlobal(global));
+            }
+            (None, None) if self.is_defined_function(&self.resolve_function_name(&name)) => {
+                return Err(CompileError::with_suggestion(
+                    format!("Cannot set! '{}': it names a function, not a variable", name),
+                    items[1].location.clone(),
+                    format!("Redefine it with (defun {} ...), or use (define {} ...) for a global that set! can reassign", name, name),
+                ));
+            }
+            (None, None) => {
+                return Err(CompileError::with_suggestion(
+                    format!("Cannot set! '{}': it is not bound in any enclosing scope", name),
+                    items[1].location.clone(),
+                    format!("set! only reassigns existing bindings; use (define {} ...) to create a global", name),
+                ));
+            }
+        }
+        self.in_tail_position = saved_tail;
+
+        Ok(())
+    }
+
+    // Compile handler-case expression: (handler-case expr (catch (e) body...))
+    // The catch clause becomes (lambda (e) body...), created before the handler is
+    // installed. On a raise the VM restores the stack depth recorded by PushHandler,
+    // which leaves that closure on top, and pushes the raised value as its argument.
+    // expr is never a tail call, since its frame has to survive for the handler.
+    pub(super) fn compile_handler_case(&mut self, expr: &SourceExpr, items: &[SourceExpr]) -> Result<(), CompileError> {
+        let usage = "handler-case expects an expression and a (catch (var) body...) clause";
+        if items.len() != 3 {
+            return Err(CompileError::new(usage.to_string(), expr.location.clone()));
+        }
+        let clause = match &items[2].expr {
+            LispExpr::List(clause) if clause.len() >= 3
+                && matches!(&clause[0].expr, LispExpr::Symbol(s) if s == "catch") => clause,
+            _ => return Err(CompileError::new(usage.to_string(), items[2].location.clone())),
+        };
+        match &clause[1].expr {
+            LispExpr::List(vars) if vars.len() == 1 && matches!(vars[0].expr, LispExpr::Symbol(_)) => {}
+            _ => return Err(CompileError::new(usage.to_string(), clause[1].location.clone())),
+        }
+
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        // recur can't leave the protected expression or the catch clause
+        self.open_handlers += 1;
+
+        let body = if clause.len() == 3 {
+            clause[2].clone()
+        } else {
+            let mut body = vec![SourceExpr::new(LispExpr::Symbol("do".to_string()), clause[0].location.clone())];
+            body.extend(clause[2..].iter().cloned());
+            SourceExpr::new(LispExpr::List(body), items[2].location.clone())
+        };
+        self.compile_lambda(&clause[1], &body)?;
+
+        let push_handler_index = self.bytecode.len();
+        self.emit(Instruction::PushHandler(0));
+        // The catch closure holds a stack slot below expr's bindings
+        self.stack_depth += 1;
+        self.compile_expr(&items[1])?;
+        self.stack_depth -= 1;
+        self.emit(Instruction::PopHandler);
+        self.emit(Instruction::Slide(1));
+        let jmp_to_end_index = self.bytecode.len();
+        self.emit(Instruction::Jmp(0));
+
+        // Catch: the closure and the raised value are on the stack. The handler is
+        // gone by now, so calling the clause can be a tail call.
+        let catch_addr = self.instruction_address;
+        self.bytecode[push_handler_index] = Instruction::PushHandler(catch_addr);
+        if self.leaves_function(saved_tail) {
+            self.emit(Instruction::TailCallClosure(1));
+        } else {
+            self.emit(Instruction::CallClosure(1));
+        }
+
+        let end_addr = self.instruction_address;
+        self.bytecode[jmp_to_end_index] = Instruction::Jmp(end_addr);
+
+        self.open_handlers -= 1;
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+
+    // Compile catch expression: (catch tag body...)
+    // PushCatch takes the evaluated tag and records the stack depth without it. A
+    // throw to the tag restores that depth and resumes after the body with the
+    // thrown value pushed, so either way one value is left where the catch started.
+    // The body is never a tail call, since its frame has to survive for the catch.
+    pub(super) fn compile_catch(&mut self, expr: &SourceExpr, items: &[SourceExpr]) -> Result<(), CompileError> {
+        if items.len() < 3 {
+            return Err(CompileError::new(
+                "catch expects a tag and at least 1 body expression".to_string(),
+                expr.location.clone(),
+            ));
+        }
+
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        self.compile_expr(&items[1])?;
+        // recur can't leave the body either
+        self.open_handlers += 1;
+
+        let push_catch_index = self.bytecode.len();
+        self.emit(Instruction::PushCatch(0));
+        if items.len() == 3 {
+            self.compile_expr(&items[2])?;
+        } else {
+            let mut body = vec![SourceExpr::new(LispExpr::Symbol("do".to_string()), expr.location.clone())];
+            body.extend(items[2..].iter().cloned());
+            self.compile_expr(&SourceExpr::new(LispExpr::List(body), expr.location.clone()))?;
+        }
+        self.emit(Instruction::PopHandler);
+
+        let end_addr = self.instruction_address;
+        self.bytecode[push_catch_index] = Instruction::PushCatch(end_addr);
+
+        self.open_handlers -= 1;
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+
+    // Compile letrec expression: (letrec ((name value) ...) body)
+    // Every name gets a cell slot before any initializer runs, so lambdas in the
+    // initializers can refer to themselves and to each other.
+    pub(super) fn compile_letrec(
+        &mut self,
+        bindings_expr: &SourceExpr,
+        body_expr: &SourceExpr,
+    ) -> Result<(), CompileError> {
+        let bindings = match &bindings_expr.expr {
+            LispExpr::List(b) => b,
+            _ => {
+                return Err(CompileError::new(
+                    "letrec bindings must be a list".to_string(),
+                    bindings_expr.location.clone(),
+                ));
+            }
+        };
+
+        // Save current local bindings and stack depth
+        let saved_bindings = self.local_bindings.clone();
+        let saved_stack_depth = self.stack_depth;
+
+        // First pass: allocate an uninitialized cell for every binding
+        let mut slots = Vec::new();
+        for binding in bindings {
+            let (name, value_expr) = match &binding.expr {
+                LispExpr::List(pair) if pair.len() == 2 => match &pair[0].expr {
+                    LispExpr::Symbol(name) => (name.clone(), &pair[1]),
+                    _ => {
+                        return Err(CompileError::new(
+                            "letrec binding name must be a symbol".to_string(),
+                            pair[0].location.clone(),
+                        ));
+                    }
+                },
+                _ => {
+                    return Err(CompileError::new(
+                        "Each letrec binding must have exactly 2 elements: (name value)".to_string(),
+                        binding.location.clone(),
+                    ));
+                }
+            };
+
+            self.emit(Instruction::MakeCell);
+            let position = self.stack_depth;
+            self.stack_depth += 1;
+
+            let location = ValueLocation::Cell(Box::new(ValueLocation::Local(position)), name.clone());
+            self.local_bindings.insert(name, location);
+            slots.push((position, value_expr));
+        }
+
+        // Second pass: compile initializers with all cells in scope, then assign
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        for (position, value_expr) in &slots {
+            self.compile_expr(value_expr)?;
+            self.emit(Instruction::GetLocal(*position));
+            self.emit(Instruction::CellSet);
+        }
+        self.in_tail_position = saved_tail;
+
+        // Compile body with bindings available (body inherits tail position from letrec)
+        self.compile_expr(body_expr)?;
+
+        // Clean up letrec cells from stack, same as let
+        if !slots.is_empty() {
+            self.emit(Instruction::Slide(slots.len()));
+        }
+
+        // Restore binding context
+        self.local_bindings = saved_bindings;
+        self.stack_depth = saved_stack_depth;
+
+        Ok(())
+    }
+
+    // Compile named let: (let name ((var init) ...) body)
+    // Desugared to ((letrec ((name (lambda (var ...) body))) name) init ...), so the
+    // initializers see the outer scope and a self-call in tail position reuses the frame.
+    pub(super) fn compile_named_let(
+        &mut self,
+        name: &str,
+        bindings_expr: &SourceExpr,
+        body_expr: &SourceExpr,
+        context: &SourceExpr,
+    ) -> Result<(), CompileError> {
+        let bindings = match &bindings_expr.expr {
+            LispExpr::List(b) => b,
+            _ => {
+                return Err(CompileError::new(
+                    "named let bindings must be a list".to_string(),
+                    bindings_expr.location.clone(),
+                ));
+            }
+        };
+
+        let mut vars = Vec::new();
+        let mut inits = Vec::new();
+        for binding in bindings {
+            match &binding.expr {
+                LispExpr::List(pair) if pair.len() == 2 && matches!(&pair[0].expr, LispExpr::Symbol(_)) => {
+                    vars.push(pair[0].clone());
+                    inits.push(pair[1].clone());
+                }
+                _ => {
+                    return Err(CompileError::new(
+                        "Each named let binding must be (name value)".to_string(),
+                        binding.location.clone(),
+                    ));
+                }
+            }
+        }
+
+        let loc = context.location.clone();
+        let node = |expr: LispExpr| SourceExpr::new(expr, loc.clone());
+        let name_expr = node(LispExpr::Symbol(name.to_string()));
+
+        let lambda = node(LispExpr::List(vec![
+            node(LispExpr::Symbol("lambda".to_string())),
+            node(LispExpr::List(vars)),
+            body_expr.clone(),
+        ]));
+        let letrec = node(LispExpr::List(vec![
+            node(LispExpr::Symbol("letrec".to_string())),
+            node(LispExpr::List(vec![node(LispExpr::List(vec![name_expr.clone(), lambda]))])),
+            name_expr,
+        ]));
+
+        let mut call = vec![letrec];
+        call.extend(inits);
+        self.compile_expr(&node(LispExpr::List(call)))?;
+
+        Ok(())
+    }
+
     pub(super) fn compile_loop(
         &mut self,
         bindings_expr: &SourceExpr,
@@ -112,8 +483,20 @@ impl Compiler {
         let saved_bindings = self.local_bindings.clone();
         let saved_stack_depth = self.stack_depth;
 
+        // Variables that a closure captures and set! assigns live in cells, as in let
+        let names: Vec<String> = bindings.iter()
+            .filter_map(|binding| match &binding.expr {
+                LispExpr::List(pair) => match pair.first().map(|p| &p.expr) {
+                    Some(LispExpr::Symbol(name)) => Some(name.clone()),
+                    _ => None,
+                },
+                _ => None,
+            })
+            .collect();
+        let boxed = Self::mutated_captures(&names, &[bindings_expr, body_expr]);
+        let mut cells = Vec::new();
+
         let mut num_bindings = 0;
-        let mut _binding_names = Vec::new();
 
         // Process each binding
         for binding in bindings {
@@ -151,27 +534,45 @@ impl Compiler {
             // Compile the value expression (pushes result onto stack)
             let saved_tail = self.in_tail_position;
             self.in_tail_position = false;
-            self.compile_expr(value_expr)?;
-            self.in_tail_position = saved_tail;
-
-            // The value is now on the stack at position stack_depth
             let value_position = self.stack_depth;
-            self.stack_depth += 1;
+            let location = if boxed.contains(&name) {
+                self.emit(Instruction::MakeCell);
+                self.stack_depth += 1;
+                self.compile_expr(value_expr)?;
+                self.emit(Instruction::GetLocal(value_position));
+                self.emit(Instruction::CellSet);
+                ValueLocation::Cell(Box::new(ValueLocation::Local(value_position)), name.clone())
+            } else {
+                self.compile_expr(value_expr)?;
+                self.stack_depth += 1;
+                ValueLocation::Local(value_position)
+            };
+            self.in_tail_position = saved_tail;
             num_bindings += 1;
+            cells.push(boxed.contains(&name));
 
             // Create local binding
-            self.local_bindings.insert(name.clone(), ValueLocation::Local(value_position));
-            _binding_names.push(name);
+            self.local_bindings.insert(name, location);
         }
 
-        // Emit BeginLoop instruction to mark loop start
-        self.emit(Instruction::BeginLoop(num_bindings));
-
-        // Compile body (body is in tail position - recur will jump back)
+        // The body starts with the variables in their slots. recur stores the
+        // new values there and jumps back to it; other calls in the tail of the
+        // body only leave the function if the loop itself is in tail position.
+        // Handlers around the loop stay in place while it iterates.
         let saved_tail = self.in_tail_position;
-        self.in_tail_position = true; // Body of loop is in tail position for recur
+        let saved_loop = self.innermost_loop.replace(LoopTarget {
+            start: self.instruction_address,
+            first_slot: saved_stack_depth,
+            arity: num_bindings,
+            cells,
+            returns: self.leaves_function(saved_tail),
+        });
+        let saved_handlers = std::mem::take(&mut self.open_handlers);
+        self.in_tail_position = true;
         self.compile_expr(body_expr)?;
         self.in_tail_position = saved_tail;
+        self.open_handlers = saved_handlers;
+        self.innermost_loop = saved_loop;
 
         // Clean up loop bindings from stack (only executed if body returns without recur)
         if num_bindings > 0 {
@@ -185,195 +586,352 @@ impl Compiler {
         Ok(())
     }
 
-    pub(super) fn compile_recur(&mut self, args: &[SourceExpr]) -> Result<(), CompileError> {
-        // Compile arguments (similar to function call)
-        let saved_tail = self.in_tail_position;
-        self.in_tail_position = false;
-
-        for arg in args {
-            self.compile_expr(arg)?;
+    // Compile recur: (recur new-values...) - store one new value per loop
+    // variable, drop whatever the body bound since, and jump back to the top of
+    // the loop. It has to be the last thing the loop body does.
+    pub(super) fn compile_recur(&mut self, expr: &SourceExpr, args: &[SourceExpr]) -> Result<(), CompileError> {
+        let target = match &self.innermost_loop {
+            Some(target) => target.clone(),
+            None => {
+                return Err(CompileError::new(
+                    "recur is only allowed inside a loop".to_string(),
+                    expr.location.clone(),
+                ));
+            }
+        };
+        if self.open_handlers > 0 {
+            return Err(CompileError::new(
+                "recur cannot jump out of a handler-case expression, its catch clause or a catch body".to_string(),
+                expr.location.clone(),
+            ));
+        }
+        if !self.in_tail_position {
+            return Err(CompileError::new(
+                "recur must be in tail position of its loop".to_string(),
+                expr.location.clone(),
+            ));
+        }
+        if args.len() != target.arity {
+            return Err(CompileError::new(
+                format!("recur expects {} argument(s) to match the loop bindings, got {}", target.arity, args.len()),
+                expr.location.clone(),
+            ));
         }
 
-        self.in_tail_position = saved_tail;
+        self.in_tail_position = false;
+        for (arg, cell) in args.iter().zip(&target.cells) {
+            if *cell {
+                // A fresh cell each iteration, so closures made in earlier ones keep theirs
+                let position = self.stack_depth;
+                self.emit(Instruction::MakeCell);
+                self.stack_depth += 1;
+                self.compile_expr(arg)?;
+                self.emit(Instruction::GetLocal(position));
+                self.emit(Instruction::CellSet);
+            } else {
+                self.compile_operand(arg)?;
+            }
+        }
+        self.stack_depth -= args.len();
+        self.in_tail_position = true;
 
-        // Emit Recur instruction
-        self.emit(Instruction::Recur(args.len()));
+        // The last value is on top, so it is stored first
+        for slot in (target.first_slot..target.first_slot + target.arity).rev() {
+            self.emit(Instruction::SetLocal(slot));
+        }
+        let bound_since = self.stack_depth - (target.first_slot + target.arity);
+        if bound_since > 0 {
+            self.emit(Instruction::PopN(bound_since));
+        }
+        self.emit(Instruction::Jmp(target.start));
 
         Ok(())
     }
 
-    // Helper for compiling and: (and a b c) => (if a (if b c false) false)
-    pub(super) fn compile_and_helper(&mut self, exprs: &[SourceExpr], context: &SourceExpr) -> Result<(), CompileError> {
-        if exprs.is_empty() {
-            // Empty and is true
-            self.emit(Instruction::Push(Value::Boolean(true)));
-            return Ok(());
-        }
+    /// Whether the tail of the expression being compiled also ends the function,
+    /// so a call there can reuse the frame. Inside a loop that is itself an
+    /// operand, the tail of the body only ends one iteration.
+    pub(super) fn leaves_function(&self, tail: bool) -> bool {
+        tail && self.innermost_loop.as_ref().map_or(true, |target| target.returns)
+    }
 
-        if exprs.len() == 1 {
-            // Last expression - just compile it
-            self.compile_expr(&exprs[0])?;
-            return Ok(());
-        }
+    // Compile dotimes: (dotimes (var count) body...) - run body with var bound to
+    // 0, 1, ... count-1, then evaluate to nil. The count is evaluated once into a
+    // hidden slot next to the index; the body jumps back in place, without a call.
+    pub(super) fn compile_dotimes(&mut self, expr: &SourceExpr, items: &[SourceExpr]) -> Result<(), CompileError> {
+        let (var, count_expr) = Self::parse_iteration_spec("dotimes", "(dotimes (var count) body...)", expr, items)?;
 
-        // Multiple expressions: if first then (and rest...) else false
         let saved_tail = self.in_tail_position;
-
-        // Compile first expression (not in tail position)
+        let saved_bindings = self.local_bindings.clone();
+        let saved_stack_depth = self.stack_depth;
         self.in_tail_position = false;
-        self.compile_expr(&exprs[0])?;
 
-        // Emit JmpIfFalse with placeholder
-        let jmp_if_false_index = self.bytecode.len();
+        self.compile_expr(count_expr)?;
+        let count_slot = self.stack_depth;
+        self.emit(Instruction::Push(Value::Integer(0)));
+        let index_slot = count_slot + 1;
+        self.stack_depth += 2;
+
+        // while index < count
+        let loop_start = self.instruction_address;
+        self.emit(Instruction::GetLocal(index_slot));
+        self.emit(Instruction::GetLocal(count_slot));
+        self.emit(Instruction::Lt);
+        let exit_jump = self.bytecode.len();
         self.emit(Instruction::JmpIfFalse(0));
 
-        // Compile rest (inherits tail position)
-        self.in_tail_position = saved_tail;
-        self.compile_and_helper(&exprs[1..], context)?;
-
-        // Emit Jmp to skip false branch
-        let jmp_to_end_index = self.bytecode.len();
-        self.emit(Instruction::Jmp(0));
+        self.compile_iteration_body(&var, "__dotimes_index", index_slot, expr, &items[2..])?;
 
-        // False branch
-        let false_addr = self.instruction_address;
-        self.bytecode[jmp_if_false_index] = Instruction::JmpIfFalse(false_addr);
-        self.emit(Instruction::Push(Value::Boolean(false)));
+        // index = index + 1
+        self.emit(Instruction::GetLocal(index_slot));
+        self.emit(Instruction::Push(Value::Integer(1)));
+        self.emit(Instruction::Add);
+        self.emit(Instruction::SetLocal(index_slot));
+        self.emit(Instruction::Jmp(loop_start));
 
-        // End
         let end_addr = self.instruction_address;
-        self.bytecode[jmp_to_end_index] = Instruction::Jmp(end_addr);
+        self.bytecode[exit_jump] = Instruction::JmpIfFalse(end_addr);
+        self.emit(Instruction::Push(Value::List(List::Nil)));
+        self.emit(Instruction::Slide(2));
 
+        self.local_bindings = saved_bindings;
+        self.stack_depth = saved_stack_depth;
         self.in_tail_position = saved_tail;
         Ok(())
     }
 
-    // Helper for compiling or: (or a b c) => (if a true (if b true c))
-    pub(super) fn compile_or_helper(&mut self, exprs: &[SourceExpr], context: &SourceExpr) -> Result<(), CompileError> {
-        if exprs.is_empty() {
-            // Empty or is false
-            self.emit(Instruction::Push(Value::Boolean(false)));
-            return Ok(());
-        }
-
-        if exprs.len() == 1 {
-            // Last expression - just compile it
-            self.compile_expr(&exprs[0])?;
-            return Ok(());
-        }
+    // Compile dolist: (dolist (var list) body...) - run body with var bound to each
+    // element in turn, then evaluate to nil. The rest of the list is kept in a
+    // hidden slot that each iteration advances.
+    pub(super) fn compile_dolist(&mut self, expr: &SourceExpr, items: &[SourceExpr]) -> Result<(), CompileError> {
+        let (var, list_expr) = Self::parse_iteration_spec("dolist", "(dolist (var list) body...)", expr, items)?;
 
-        // Multiple expressions: if first then true else (or rest...)
         let saved_tail = self.in_tail_position;
-
-        // Compile first expression (not in tail position)
+        let saved_bindings = self.local_bindings.clone();
+        let saved_stack_depth = self.stack_depth;
         self.in_tail_position = false;
-        self.compile_expr(&exprs[0])?;
 
-        // Emit JmpIfFalse with placeholder
-        let jmp_if_false_index = self.bytecode.len();
-        self.emit(Instruction::JmpIfFalse(0));
-
-        // True branch
-        self.emit(Instruction::Push(Value::Boolean(true)));
+        self.compile_expr(list_expr)?;
+        let rest_slot = self.stack_depth;
+        self.stack_depth += 1;
 
-        // Emit Jmp to skip rest
-        let jmp_to_end_index = self.bytecode.len();
+        // while rest is not empty
+        let loop_start = self.instruction_address;
+        self.emit(Instruction::GetLocal(rest_slot));
+        self.emit(Instruction::Push(Value::List(List::Nil)));
+        self.emit(Instruction::Eq);
+        let body_jump = self.bytecode.len();
+        self.emit(Instruction::JmpIfFalse(0));
+        let exit_jump = self.bytecode.len();
         self.emit(Instruction::Jmp(0));
+        let body_addr = self.instruction_address;
+        self.bytecode[body_jump] = Instruction::JmpIfFalse(body_addr);
+
+        // The element is pushed above the rest of the list, where the body's let binds it
+        let element_slot = self.stack_depth;
+        self.emit(Instruction::GetLocal(rest_slot));
+        self.emit(Instruction::Car);
+        self.stack_depth += 1;
+        self.compile_iteration_body(&var, "__dolist_element", element_slot, expr, &items[2..])?;
+        self.emit(Instruction::PopN(1));
+        self.stack_depth -= 1;
+
+        // rest = (cdr rest)
+        self.emit(Instruction::GetLocal(rest_slot));
+        self.emit(Instruction::Cdr);
+        self.emit(Instruction::SetLocal(rest_slot));
+        self.emit(Instruction::Jmp(loop_start));
 
-        // Rest branch
-        let rest_addr = self.instruction_address;
-        self.bytecode[jmp_if_false_index] = Instruction::JmpIfFalse(rest_addr);
+        let end_addr = self.instruction_address;
+        self.bytecode[exit_jump] = Instruction::Jmp(end_addr);
+        self.emit(Instruction::Push(Value::List(List::Nil)));
+        self.emit(Instruction::Slide(1));
 
+        self.local_bindings = saved_bindings;
+        self.stack_depth = saved_stack_depth;
         self.in_tail_position = saved_tail;
-        self.compile_or_helper(&exprs[1..], context)?;
+        Ok(())
+    }
 
-        // End
-        let end_addr = self.instruction_address;
-        self.bytecode[jmp_to_end_index] = Instruction::Jmp(end_addr);
+    // The (var expr) part of dotimes and dolist, and a check that there is a body
+    fn parse_iteration_spec<'a>(
+        form: &str,
+        usage: &str,
+        expr: &SourceExpr,
+        items: &'a [SourceExpr],
+    ) -> Result<(String, &'a SourceExpr), CompileError> {
+        if items.len() < 3 {
+            return Err(CompileError::new(format!("{} expects {}", form, usage), expr.location.clone()));
+        }
+        match &items[1].expr {
+            LispExpr::List(spec) if spec.len() == 2 => match &spec[0].expr {
+                LispExpr::Symbol(var) => Ok((var.clone(), &spec[1])),
+                _ => Err(CompileError::new(
+                    format!("{} variable must be a symbol", form),
+                    spec[0].location.clone(),
+                )),
+            },
+            _ => Err(CompileError::new(format!("{} expects {}", form, usage), items[1].location.clone())),
+        }
+    }
 
-        self.in_tail_position = saved_tail;
+    // Compile one iteration's body as (let ((var <slot>)) body...), so every
+    // iteration has a fresh binding (captured by closures like any let binding)
+    // that is gone after the loop, and discard its value
+    fn compile_iteration_body(
+        &mut self,
+        var: &str,
+        slot_name: &str,
+        slot: usize,
+        expr: &SourceExpr,
+        body: &[SourceExpr],
+    ) -> Result<(), CompileError> {
+        let location = &expr.location;
+        self.local_bindings.insert(slot_name.to_string(), ValueLocation::Local(slot));
+        let binding = SourceExpr::new(LispExpr::List(vec![
+            SourceExpr::new(LispExpr::Symbol(var.to_string()), location.clone()),
+            SourceExpr::new(LispExpr::Symbol(slot_name.to_string()), location.clone()),
+        ]), location.clone());
+        let bindings = SourceExpr::new(LispExpr::List(vec![binding]), location.clone());
+        let body = if body.len() == 1 {
+            body[0].clone()
+        } else {
+            let mut forms = vec![SourceExpr::new(LispExpr::Symbol("do".to_string()), location.clone())];
+            forms.extend(body.iter().cloned());
+            SourceExpr::new(LispExpr::List(forms), location.clone())
+        };
+        self.compile_let("let", &bindings, &body)?;
+        self.emit(Instruction::PopN(1));
         Ok(())
     }
 
-    // Helper for compiling cond: (cond (test1 expr1) (test2 expr2) ... (else default))
-    pub(super) fn compile_cond(&mut self, clauses: &[SourceExpr], context: &SourceExpr) -> Result<(), CompileError> {
-        if clauses.is_empty() {
-            // No clauses - push false
-            self.emit(Instruction::Push(Value::Boolean(false)));
-            return Ok(());
+    // Helper for compiling and/or: (and a b c) returns the first false value or
+    // else c, and (or a b c) the first value that isn't false or else c. Lowered to
+    // a flat chain where `exit` is JmpIfFalseOrPop (and) or JmpIfTrueOrPop (or):
+    // each operand but the last either jumps to the end keeping its value, or is
+    // popped before the next is evaluated. Only the last operand inherits the
+    // tail position, since nothing runs after it.
+    pub(super) fn compile_short_circuit(&mut self, exprs: &[SourceExpr], exit: fn(usize) -> Instruction) -> Result<(), CompileError> {
+        let saved_tail = self.in_tail_position;
+        let (last, rest) = exprs.split_last().expect("and/or has at least one operand");
+        let mut end_jumps = Vec::with_capacity(rest.len());
+
+        self.in_tail_position = false;
+        for operand in rest {
+            self.compile_expr(operand)?;
+            end_jumps.push(self.instruction_address);
+            self.emit(exit(0)); // placeholder, patched to the end
         }
 
+        self.in_tail_position = saved_tail;
+        self.compile_expr(last)?;
+
+        let end = self.instruction_address;
+        for jump_idx in end_jumps {
+            self.patch_jump(jump_idx, end);
+        }
+        Ok(())
+    }
+
+    // Helper for compiling cond: (cond (test1 expr1...) (test2 expr2...) ... (else default...))
+    // Lowered to a flat chain of JmpIfFalse tests; every clause body jumps straight
+    // to the single end label, so no Jmp-to-Jmp chains are produced.
+    pub(super) fn compile_cond(&mut self, clauses: &[SourceExpr], _context: &SourceExpr) -> Result<(), CompileError> {
         let saved_tail = self.in_tail_position;
+        let mut end_jumps = Vec::new();
+        let mut has_else = false;
 
         for (i, clause) in clauses.iter().enumerate() {
             let is_last = i == clauses.len() - 1;
 
-            match &clause.expr {
-                LispExpr::List(items) if items.len() == 2 => {
-                    // Check if this is an else clause
-                    let is_else = match &items[0].expr {
-                        LispExpr::Symbol(s) if s == "else" => true,
-                        _ => false,
-                    };
-
-                    if is_else {
-                        // Else clause - just compile the expression
-                        if !is_last {
-                            return Err(CompileError::new(
-                                "else clause must be the last clause in cond".to_string(),
-                                clause.location.clone(),
-                            ));
-                        }
-                        self.in_tail_position = saved_tail;
-                        self.compile_expr(&items[1])?;
-                    } else {
-                        // Regular clause: (test expr)
-                        // Compile test (not in tail position)
-                        self.in_tail_position = false;
-                        self.compile_expr(&items[0])?;
-
-                        // Emit JmpIfFalse with placeholder
-                        let jmp_if_false_index = self.bytecode.len();
-                        self.emit(Instruction::JmpIfFalse(0));
-
-                        // Compile then branch (inherits tail position)
-                        self.in_tail_position = saved_tail;
-                        self.compile_expr(&items[1])?;
-
-                        // Emit Jmp to end
-                        let jmp_to_end_index = self.bytecode.len();
-                        self.emit(Instruction::Jmp(0));
-
-                        // Record else/next branch address
-                        let else_addr = self.instruction_address;
-                        self.bytecode[jmp_if_false_index] = Instruction::JmpIfFalse(else_addr);
-
-                        // If this is the last clause and not else, compile remaining clauses
-                        if !is_last {
-                            self.compile_cond(&clauses[i + 1..], context)?;
-                        } else {
-                            // Last clause without else - push false
-                            self.emit(Instruction::Push(Value::Boolean(false)));
-                        }
-
-                        // Patch jump to end
-                        let end_addr = self.instruction_address;
-                        self.bytecode[jmp_to_end_index] = Instruction::Jmp(end_addr);
-
-                        // Important: break after processing to avoid double-processing
-                        break;
-                    }
-                }
+            let items = match &clause.expr {
+                LispExpr::List(items) if !items.is_empty() => items,
                 _ => {
                     return Err(CompileError::new(
-                        "cond clause must be a list of (test expr)".to_string(),
+                        "cond clause must be a list of (test expr...)".to_string(),
                         clause.location.clone(),
                     ));
                 }
+            };
+
+            // Check if this is an else clause
+            let is_else = matches!(&items[0].expr, LispExpr::Symbol(s) if s == "else");
+
+            if is_else {
+                if !is_last {
+                    return Err(CompileError::new(
+                        "else clause must be the last clause in cond".to_string(),
+                        clause.location.clone(),
+                    ));
+                }
+                // Else clause - just compile the body (inherits tail position)
+                self.in_tail_position = saved_tail;
+                if items.len() == 1 {
+                    self.emit(Instruction::Push(Value::List(List::Nil)));
+                } else {
+                    self.compile_sequence(&items[1..])?;
+                }
+                has_else = true;
+                break;
             }
+
+            // Regular clause: compile test (not in tail position)
+            self.in_tail_position = false;
+            self.compile_expr(&items[0])?;
+
+            // Emit JmpIfFalse with placeholder (patched to the next clause)
+            let jmp_if_false_index = self.bytecode.len();
+            self.emit(Instruction::JmpIfFalse(0));
+
+            // Compile clause body (inherits tail position). A clause without a body
+            // evaluates to its test, which can only be true once the jump falls through
+            self.in_tail_position = saved_tail;
+            if items.len() == 1 {
+                self.emit(Instruction::Push(Value::Boolean(true)));
+            } else {
+                self.compile_sequence(&items[1..])?;
+            }
+
+            // Emit Jmp to end with placeholder
+            end_jumps.push(self.bytecode.len());
+            self.emit(Instruction::Jmp(0));
+
+            // Next clause starts here
+            let next_addr = self.instruction_address;
+            self.bytecode[jmp_if_false_index] = Instruction::JmpIfFalse(next_addr);
+        }
+
+        // No clause matched and no else - evaluate to nil
+        if !has_else {
+            self.emit(Instruction::Push(Value::List(List::Nil)));
+        }
+
+        // Patch all clause exits to the end
+        let end_addr = self.instruction_address;
+        for idx in end_jumps {
+            self.bytecode[idx] = Instruction::Jmp(end_addr);
         }
 
         self.in_tail_position = saved_tail;
         Ok(())
     }
+
+    // Compile a body sequence: evaluates all expressions, keeps only the last value.
+    // The last expression inherits the current tail position.
+    pub(super) fn compile_sequence(&mut self, exprs: &[SourceExpr]) -> Result<(), CompileError> {
+        let saved_tail = self.in_tail_position;
+
+        for expr in &exprs[..exprs.len() - 1] {
+            self.in_tail_position = false;
+            self.compile_expr(expr)?;
+            // Pop the result since we don't need it (side effects only)
+            self.emit(Instruction::PopN(1));
+        }
+
+        self.in_tail_position = saved_tail;
+        self.compile_expr(&exprs[exprs.len() - 1])?;
+
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
 }
@@ -0,0 +1,144 @@
+// Struct types: (defstruct point x y)
+//
+// A defstruct generates a constructor (make-point x y), an accessor for each field
+// (point-x p) and a predicate (point? p), all as ordinary named functions. Instances
+// carry their type name, so (point ...) patterns and accessors can tell two struct
+// types with the same fields apart.
+
+use crate::vm::instructions::Instruction;
+use crate::vm::errors::{CompileError, Location};
+use crate::vm::source_map::SourceMap;
+use super::Compiler;
+use super::types::Pattern;
+use super::super::ast::{LispExpr, SourceExpr};
+
+// ==================== DEFSTRUCT ====================
+
+impl Compiler {
+    // Parse (defstruct name field ...) into the type name and its field names
+    pub(super) fn parse_defstruct(expr: &SourceExpr) -> Result<(String, Vec<String>), CompileError> {
+        let items = match &expr.expr {
+            LispExpr::List(items) if items.len() >= 2 => items,
+            _ => {
+                return Err(CompileError::new(
+                    "defstruct expects: (defstruct name field ...)".to_string(),
+                    expr.location.clone(),
+                ));
+            }
+        };
+
+        let name = match &items[1].expr {
+            LispExpr::Symbol(s) => s.clone(),
+            _ => {
+                return Err(CompileError::new(
+                    "Struct name must be a symbol".to_string(),
+                    items[1].location.clone(),
+                ));
+            }
+        };
+
+        let mut fields: Vec<String> = Vec::with_capacity(items.len() - 2);
+        for item in &items[2..] {
+            match &item.expr {
+                LispExpr::Symbol(field) if fields.contains(field) => {
+                    return Err(CompileError::new(
+                        format!("Struct '{}' declares field '{}' twice", name, field),
+                        item.location.clone(),
+                    ));
+                }
+                LispExpr::Symbol(field) => fields.push(field.clone()),
+                _ => {
+                    return Err(CompileError::new(
+                        format!("Fields of struct '{}' must be symbols", name),
+                        item.location.clone(),
+                    ));
+                }
+            }
+        }
+
+        Ok((name, fields))
+    }
+
+    // Names of the functions a defstruct generates: constructor, predicate, accessors
+    pub(super) fn struct_function_names(name: &str, fields: &[String]) -> Vec<String> {
+        let mut names = vec![format!("make-{}", name), format!("{}?", name)];
+        names.extend(fields.iter().map(|field| format!("{}-{}", name, field)));
+        names
+    }
+
+    // Compile defstruct: record the type for patterns and generate its functions
+    pub(super) fn compile_defstruct(&mut self, expr: &SourceExpr) -> Result<(), CompileError> {
+        let (name, fields) = Self::parse_defstruct(expr)?;
+        let tag = self.qualify_name(&name);
+        self.structs.insert(tag.clone(), fields.clone());
+
+        let mut constructor: Vec<Instruction> = (0..fields.len()).map(Instruction::LoadArg).collect();
+        constructor.push(Instruction::MakeStruct(tag.clone(), fields.len()));
+        constructor.push(Instruction::Ret);
+        self.define_struct_function(&format!("make-{}", name), fields.clone(), constructor, &expr.location);
+
+        let predicate = vec![Instruction::LoadArg(0), Instruction::IsStruct(tag.clone()), Instruction::Ret];
+        self.define_struct_function(&format!("{}?", name), vec!["value".to_string()], predicate, &expr.location);
+
+        for (index, field) in fields.iter().enumerate() {
+            let accessor = vec![Instruction::LoadArg(0), Instruction::StructGet(tag.clone(), index), Instruction::Ret];
+            self.define_struct_function(&format!("{}-{}", name, field), vec![name.clone()], accessor, &expr.location);
+        }
+
+        Ok(())
+    }
+
+    // Store a generated function, with its instructions attributed to the defstruct
+    fn define_struct_function(&mut self, fn_name: &str, params: Vec<String>, body: Vec<Instruction>, location: &Location) {
+        let qualified_name = self.qualify_name(fn_name);
+        let mut locations = SourceMap::new();
+        for offset in 0..body.len() {
+            locations.record(offset, location);
+        }
+        self.function_arities.insert(qualified_name.clone(), (params.len(), false));
+        self.function_params.insert(qualified_name.clone(), params);
+        self.function_locations.insert(qualified_name.clone(), locations);
+        self.known_functions.insert(qualified_name.clone());
+        self.functions.insert(qualified_name, body);
+    }
+
+    // Field names of the struct type a pattern head refers to, if it names one
+    fn lookup_struct(&self, name: &str) -> Option<(String, &Vec<String>)> {
+        let qualified = self.qualify_name(name);
+        if let Some(fields) = self.structs.get(&qualified) {
+            return Some((qualified, fields));
+        }
+        self.structs.get(name).map(|fields| (name.to_string(), fields))
+    }
+
+    // Parse (point x y) as a struct pattern when point is a struct type. The field
+    // count has to match the definition; fields are bound by position.
+    pub(super) fn parse_struct_pattern(&self, expr: &SourceExpr, items: &[SourceExpr]) -> Option<Result<Pattern, CompileError>> {
+        let name = match items.first().map(|item| &item.expr) {
+            Some(LispExpr::Symbol(s)) => s,
+            _ => return None,
+        };
+        let (tag, fields) = self.lookup_struct(name)?;
+
+        let given = items.len() - 1;
+        if given != fields.len() {
+            return Some(Err(CompileError::with_suggestion(
+                format!(
+                    "Pattern for struct '{}' has {} field{}, but the struct is defined with {}",
+                    name,
+                    given,
+                    if given == 1 { "" } else { "s" },
+                    fields.len(),
+                ),
+                expr.location.clone(),
+                format!("Match every field in order: ({} {})", name, fields.join(" ")),
+            )));
+        }
+
+        Some(items[1..]
+            .iter()
+            .map(|item| self.parse_pattern(item))
+            .collect::<Result<Vec<_>, _>>()
+            .map(|fields| Pattern::Struct(tag, fields)))
+    }
+}
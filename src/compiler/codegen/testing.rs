@@ -0,0 +1,119 @@
+// In-language tests: (assert expr ["message"]), (assert-equal expected actual)
+// and (deftest name body...)
+//
+// An assertion that passes returns nil. One that fails raises a built-in runtime
+// error, so it carries the location of the assertion and handler-case can catch
+// it like any other. The message quotes the assertion as written, which the
+// compiler prints back from the parsed source. A deftest compiles to a function of no arguments that the
+// test runner calls; its name can't be written in source, so a test can share
+// its name with the function it tests.
+
+use crate::vm::instructions::Instruction;
+use crate::vm::errors::CompileError;
+use super::Compiler;
+use super::super::ast::{LispExpr, SourceExpr};
+
+// ==================== ASSERTIONS ====================
+
+impl Compiler {
+    // Compile (assert expr) or (assert expr "message"): nil, or an error quoting
+    // expr and adding the message when expr is false. The message is a literal, so
+    // a passing assertion costs no more than the check.
+    pub(super) fn compile_assert(&mut self, expr: &SourceExpr, items: &[SourceExpr]) -> Result<(), CompileError> {
+        if items.len() != 2 && items.len() != 3 {
+            return Err(CompileError::new(
+                "assert expects 1 or 2 arguments: (assert expr) or (assert expr \"message\")".to_string(),
+                expr.location.clone(),
+            ));
+        }
+        let failure = match items.get(2).map(|message| &message.expr) {
+            None => expr.to_source(),
+            Some(LispExpr::Symbol(s)) if s.starts_with("__STRING__") => {
+                format!("(assert {}): {}", items[1].to_source(), &s["__STRING__".len()..])
+            }
+            Some(_) => {
+                return Err(CompileError::new(
+                    "assert message must be a string literal".to_string(),
+                    items[2].location.clone(),
+                ));
+            }
+        };
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        self.compile_expr(&items[1])?;
+        self.emit(Instruction::Assert(failure));
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+
+    // Compile (assert-equal expected actual): nil, or an error showing both values
+    // when they are not equal?
+    pub(super) fn compile_assert_equal(&mut self, expr: &SourceExpr, items: &[SourceExpr]) -> Result<(), CompileError> {
+        if items.len() != 3 {
+            return Err(CompileError::new(
+                "assert-equal expects exactly 2 arguments: (assert-equal expected actual)".to_string(),
+                expr.location.clone(),
+            ));
+        }
+        let saved_tail = self.in_tail_position;
+        self.in_tail_position = false;
+        self.compile_operand(&items[1])?;
+        self.compile_operand(&items[2])?;
+        self.stack_depth -= 2;
+        self.emit(Instruction::AssertEqual(expr.to_source()));
+        self.in_tail_position = saved_tail;
+        Ok(())
+    }
+}
+
+// ==================== DEFTEST ====================
+
+impl Compiler {
+    /// Name of the function a deftest compiles to
+    pub fn test_function(test: &str) -> String {
+        format!("deftest {}", test)
+    }
+
+    /// Names of the deftests compiled so far, in the order they were defined
+    pub fn tests(&self) -> Vec<&str> {
+        self.tests.iter().map(|(name, _)| name.as_str()).collect()
+    }
+
+    // Compile (deftest name body...) as a function of no arguments
+    pub(super) fn compile_deftest(&mut self, expr: &SourceExpr) -> Result<(), CompileError> {
+        let items = match &expr.expr {
+            LispExpr::List(items) if items.len() >= 3 => items,
+            _ => {
+                return Err(CompileError::new(
+                    "deftest expects a name and a body: (deftest name body...)".to_string(),
+                    expr.location.clone(),
+                ));
+            }
+        };
+        let name = match &items[1].expr {
+            LispExpr::Symbol(name) if !name.starts_with("__STRING__") => name.clone(),
+            _ => {
+                return Err(CompileError::new(
+                    "Test name must be a symbol".to_string(),
+                    items[1].location.clone(),
+                ));
+            }
+        };
+        if let Some((_, earlier)) = self.tests.iter().find(|(test, _)| *test == name) {
+            return Err(CompileError::new(
+                format!("Test '{}' is defined twice", name),
+                items[1].location.clone(),
+            ).with_note("first defined here".to_string(), earlier.clone()));
+        }
+
+        let mut defun = vec![
+            SourceExpr::new(LispExpr::Symbol("defun".to_string()), items[0].location.clone()),
+            SourceExpr::new(LispExpr::Symbol(Self::test_function(&name)), items[1].location.clone()),
+            SourceExpr::new(LispExpr::List(Vec::new()), items[1].location.clone()),
+        ];
+        defun.extend(items[2..].iter().cloned());
+        self.compile_defun(&SourceExpr::new(LispExpr::List(defun), expr.location.clone()))?;
+        self.tests.push((name, items[1].location.clone()));
+        Ok(())
+    }
+}
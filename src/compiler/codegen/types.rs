@@ -2,6 +2,7 @@
 
 use crate::vm::value::Value;
 use crate::vm::instructions::Instruction;
+use crate::vm::errors::Location;
 use super::Compiler;
 use super::super::ast::SourceExpr;
 
@@ -13,6 +14,7 @@ pub(super) enum ValueLocation {
     Captured(usize),                               // Captured variable in closure
     ListElement(Box<ValueLocation>, usize),        // i-th element of a list
     ListRest(Box<ValueLocation>, usize),           // Rest after skipping n elements
+    Cell(Box<ValueLocation>, String),              // letrec cell stored at location, named binding
 }
 
 impl ValueLocation {
@@ -42,6 +44,20 @@ impl ValueLocation {
                     compiler.emit(Instruction::Cdr);
                 }
             }
+            ValueLocation::Cell(cell_loc, name) => {
+                // Load the cell, then read its contents
+                cell_loc.emit_load(compiler);
+                compiler.emit(Instruction::CellGet(name.clone()));
+            }
+        }
+    }
+
+    // Emit instructions to load the value for capture by a closure.
+    // Cells are captured as-is so the closure sees later assignments.
+    pub(super) fn emit_capture(&self, compiler: &mut Compiler) {
+        match self {
+            ValueLocation::Cell(cell_loc, _) => cell_loc.emit_load(compiler),
+            _ => self.emit_load(compiler),
         }
     }
 }
@@ -50,7 +66,26 @@ impl ValueLocation {
 #[derive(Debug, Clone)]
 pub(super) struct MacroDef {
     pub params: Vec<String>,
+    pub rest: Option<String>, // Receives the remaining argument forms as a list
     pub body: SourceExpr,
+    pub location: Location, // The defmacro form, cited in errors from its expansions
+}
+
+// A defconst: its value when the initializer folds to one, inlined at every use
+#[derive(Debug, Clone)]
+pub(super) struct Constant {
+    pub value: Option<Value>,
+    pub location: Location, // The defconst, shown when something tries to reassign it
+}
+
+// A loop being compiled, which recur in the tail of its body jumps back to
+#[derive(Debug, Clone)]
+pub(super) struct LoopTarget {
+    pub start: usize,       // Address of the first instruction of the body
+    pub first_slot: usize,  // Stack slot of the first loop variable; the others follow it
+    pub arity: usize,       // Number of loop variables, which recur must give new values for
+    pub cells: Vec<bool>,   // For each loop variable, whether its slot holds a cell that closures share
+    pub returns: bool,      // The loop is in tail position, so the tail of its body also ends the function
 }
 
 // Helper struct for parsed parameters (supports variadic syntax)
@@ -69,11 +104,17 @@ pub(super) enum Pattern {
     EmptyList,                  // Matches empty list: '()
     List(Vec<Pattern>),         // Matches fixed-length list: (a b c)
     DottedList(Vec<Pattern>, Box<Pattern>), // Matches cons pattern: (h . t)
+    Or(Vec<Pattern>),           // Matches if any alternative does: (or p1 p2 ...)
+    Struct(String, Vec<Pattern>), // Matches a defstruct instance field by field: (point x y)
+    As(String, Box<Pattern>),   // Matches the inner pattern, also binding the whole value: (@ whole (h . t))
+    Type(String, Box<Pattern>), // Matches a value whose type-of is the name, then the inner pattern: (:integer x)
 }
 
 // A single clause in a multi-clause function definition
 #[derive(Debug)]
 pub(super) struct FunctionClause {
     pub patterns: Vec<Pattern>,     // Patterns for each argument
-    pub body: SourceExpr,           // Body to execute if patterns match
+    pub location: Location,         // Where the clause is written, for warnings about it
+    pub guard: Option<SourceExpr>,  // Optional `when` guard, evaluated with the pattern bindings
+    pub body: Vec<SourceExpr>,      // Body to execute if patterns match (and the guard holds)
 }
@@ -7,35 +7,74 @@ impl Compiler {
     pub(super) fn is_builtin_function(name: &str) -> bool {
         matches!(name,
             // Arithmetic
-            "+" | "-" | "*" | "/" | "%" | "neg" |
+            "+" | "-" | "*" | "/" | "/." | "%" | "neg" |
+            "quotient" | "remainder" | "modulo" |
+            "checked-add" | "checked-sub" | "checked-mul" | "wrapping-add" | "wrapping-sub" | "wrapping-mul" |
+            "bit-and" | "bit-or" | "bit-xor" | "bit-not" | "shift-left" | "shift-right" |
             // Comparison
-            "<=" | "<" | ">" | ">=" | "==" | "!=" |
+            "<=" | "<" | ">" | ">=" | "==" | "=" | "!=" | "equal?" | "eqv?" | "eq?" |
             // List operations
-            "cons" | "car" | "cdr" | "list?" | "append" | "list-ref" | "list-length" | "null?" | "list" |
+            "cons" | "car" | "cdr" | "list?" | "append" | "list-ref" | "list-length" | "length" | "reverse" | "nth" | "null?" | "list" |
+            "member" | "memq" | "assoc" | "assq" | "sort" |
+            "map" | "filter" | "reduce" |
             // Type predicates
             "integer?" | "boolean?" | "function?" | "closure?" | "procedure?" | "number?" |
             // String operations
             "string?" | "symbol?" | "symbol->string" | "string->symbol" |
-            "string-length" | "substring" | "string-append" | "string->list" |
+            "string-length" | "substring" | "string-append" | "string=?" | "string->list" |
             "list->string" | "char-code" | "number->string" | "string->number" |
+            "char->integer" | "integer->char" | "char=?" | "char<?" | "string-ref" |
+            "char-alphabetic?" | "char-numeric?" | "char-whitespace?" |
             "string-split" | "string-join" | "string-trim" | "string-replace" |
             "string-starts-with?" | "string-ends-with?" | "string-contains?" |
             "string-upcase" | "string-downcase" |
             // File I/O
-            "read-file" | "write-file" | "file-exists?" | "write-binary-file" | "load" | "require" |
+            "read-file" | "write-file" | "append-file" | "file-exists?" | "write-binary-file" | "load" | "require" |
+            "read-line" | "read" | "read-from-string" | "open-input-file" | "open-output-file" | "close-port" |
             // HashMap operations
             "hashmap?" | "hashmap-get" | "hashmap-set" | "hashmap-keys" |
             "hashmap-values" | "hashmap-contains-key?" | "hash-map" |
+            "make-map" | "map-get" | "map-set!" | "map-remove!" | "map-contains?" | "map-keys" | "map-count" |
+            "make-hash-table" | "hash-ref" | "hash-set!" | "hash-remove!" | "hash-keys" |
             // Vector operations
-            "vector?" | "vector-ref" | "vector-set" | "vector-push" | "vector-pop" |
-            "vector-length" | "vector" |
+            "vector?" | "vector-ref" | "vector-set" | "vector-set!" | "vector-push" | "vector-pop" |
+            "vector-length" | "vector" | "make-vector" |
             // Type conversions
             "list->vector" | "vector->list" |
             // Metaprogramming & Reflection
-            "eval" |
+            "eval" | "trace" | "untrace" | "gensym" |
             "function-arity" | "function-params" | "closure-captured" | "function-name" |
-            // Other
-            "get-args" | "print"
+            "disassemble" |
+            // Errors
+            "raise" |
+            // Promises
+            "force" | "promise?" | "stream-car" | "stream-cdr" |
+            // Tasks
+            "spawn" | "yield" | "sleep" | "make-channel" | "chan-send" | "chan-recv" | "task-result" | "task-status" |
+            // Process
+            "get-args" | "command-line-args" | "getenv" | "exit" |
+            // Output
+            "print" | "println" | "write" | "display" | "newline" | "pp"
+        )
+    }
+
+    // Check if a name is a special form that a macro can't redefine. when and
+    // unless are compiled specially too, but stay open to user macros.
+    pub(super) fn is_special_form(name: &str) -> bool {
+        matches!(name,
+            // Binding and functions
+            "let" | "letrec" | "lambda" | "set!" |
+            // Control flow
+            "if" | "and" | "or" | "cond" | "case" | "match" | "do" | "begin" | "progn" |
+            "loop" | "recur" | "dotimes" | "dolist" |
+            // Non-local exits
+            "handler-case" | "catch" | "throw" |
+            // Quoting
+            "quote" | "quasiquote" |
+            // Promises
+            "delay" | "cons-stream" |
+            // Definitions
+            "defun" | "defmacro" | "defstruct" | "deftest" | "def" | "define" | "defconst" | "module" | "import" | "export" | "include"
         )
     }
 
@@ -0,0 +1,436 @@
+// Warnings for bindings that are never used: let bindings, function parameters
+// and the variables patterns bind; for clauses of a match or multi-clause
+// defun that can never match, because an earlier clause without a guard has the
+// same patterns; and for a multi-clause defun, clauses the earlier ones match
+// everything of together and arguments no clause matches (see coverage.rs)
+//
+// Once a program compiles, a walk over its source forms tracks the names each
+// binding form brings into scope. A symbol refers to the innermost binding of its
+// name, so when an inner binding shadows an outer one only the inner one counts
+// as used. A binding still unused when its scope ends is reported, unless its
+// name starts with an underscore (as does the _ wildcard). The variables of
+// dotimes, dolist, loop and catch clauses are tracked for shadowing but never
+// reported. Forms that macros expand to aren't walked, so a name a macro call
+// mentions counts as used.
+
+use std::collections::BTreeSet;
+
+use crate::vm::errors::{CompileWarning, Location};
+use super::Compiler;
+use super::types::Pattern;
+use super::super::ast::{LispExpr, SourceExpr};
+
+// A name in scope, with what to call it in a warning (None for names never reported)
+struct Binding {
+    name: String,
+    kind: Option<&'static str>,
+    location: Location,
+    used: bool,
+}
+
+// The scopes enclosing the expression being walked, innermost last
+struct UnusedBindings<'a> {
+    compiler: &'a Compiler,
+    scopes: Vec<Vec<Binding>>,
+    warnings: Vec<CompileWarning>,
+}
+
+impl Compiler {
+    /// Warnings from the last compile_program, in source order
+    pub fn warnings(&self) -> &[CompileWarning] {
+        &self.warnings
+    }
+
+    // Warn about the bindings in `exprs` that are never used
+    pub(super) fn unused_binding_warnings(&self, exprs: &[SourceExpr]) -> Vec<CompileWarning> {
+        let mut walk = UnusedBindings { compiler: self, scopes: Vec::new(), warnings: Vec::new() };
+        let mut warnings = Vec::new();
+        for expr in exprs {
+            walk.expr(expr);
+            // Inner scopes end first; each form comes from one file, so line order is source order
+            walk.warnings.sort_by_key(|warning| (warning.location.line, warning.location.column));
+            warnings.append(&mut walk.warnings);
+        }
+        warnings
+    }
+}
+
+impl UnusedBindings<'_> {
+    fn enter(&mut self) {
+        self.scopes.push(Vec::new());
+    }
+
+    fn leave(&mut self) {
+        for binding in self.scopes.pop().unwrap_or_default() {
+            if let Some(kind) = binding.kind.filter(|_| !binding.used && !binding.name.starts_with('_')) {
+                let width = binding.name.chars().count();
+                self.warnings.push(CompileWarning::new(
+                    format!("Unused {} '{}'", kind, binding.name),
+                    binding.location,
+                    width,
+                ));
+            }
+        }
+    }
+
+    fn declare(&mut self, name: &str, kind: Option<&'static str>, location: &Location) {
+        if let Some(scope) = self.scopes.last_mut() {
+            scope.push(Binding { name: name.to_string(), kind, location: location.clone(), used: false });
+        }
+    }
+
+    // Mark the innermost binding of `name` used; later bindings in a scope shadow earlier ones
+    fn reference(&mut self, name: &str) {
+        for scope in self.scopes.iter_mut().rev() {
+            if let Some(binding) = scope.iter_mut().rev().find(|binding| binding.name == name) {
+                binding.used = true;
+                return;
+            }
+        }
+    }
+
+    // Declare the variables a pattern binds, each at its first mention in the pattern
+    fn declare_pattern(&mut self, pattern: &SourceExpr, kind: &'static str) {
+        let mut vars = BTreeSet::new();
+        match self.compiler.parse_pattern(pattern) {
+            Ok(parsed) => Compiler::pattern_variables(&parsed, &mut vars),
+            Err(_) => return,
+        }
+        for var in vars {
+            let location = Self::find_symbol(pattern, &var).unwrap_or(&pattern.location).clone();
+            self.declare(&var, Some(kind), &location);
+        }
+    }
+
+    fn find_symbol<'e>(expr: &'e SourceExpr, name: &str) -> Option<&'e Location> {
+        match &expr.expr {
+            LispExpr::Symbol(s) if s == name => Some(&expr.location),
+            LispExpr::List(items) if matches!(items.first().map(|item| &item.expr), Some(LispExpr::Symbol(s)) if s == "quote") => None,
+            LispExpr::List(items) => items.iter().find_map(|item| Self::find_symbol(item, name)),
+            LispExpr::DottedList(items, rest) => items.iter()
+                .find_map(|item| Self::find_symbol(item, name))
+                .or_else(|| Self::find_symbol(rest, name)),
+            _ => None,
+        }
+    }
+
+    fn exprs(&mut self, exprs: &[SourceExpr]) {
+        for expr in exprs {
+            self.expr(expr);
+        }
+    }
+
+    fn expr(&mut self, expr: &SourceExpr) {
+        match &expr.expr {
+            LispExpr::Symbol(s) if !s.starts_with("__STRING__") => self.reference(s),
+            LispExpr::List(items) => self.form(items),
+            LispExpr::DottedList(items, rest) => {
+                self.exprs(items);
+                self.expr(rest);
+            }
+            _ => {}
+        }
+    }
+
+    fn form(&mut self, items: &[SourceExpr]) {
+        let head = match items.first().map(|item| &item.expr) {
+            Some(LispExpr::Symbol(head)) => head.as_str(),
+            _ => return self.exprs(items),
+        };
+        match (head, items.len()) {
+            ("quote" | "defmacro" | "defstruct" | "import" | "export" | "include", _) => {}
+            ("quasiquote", _) => self.unquoted(&items[1..]),
+            ("let", 4) if matches!(items[1].expr, LispExpr::Symbol(_)) => self.named_let(items),
+            ("let" | "let*", 3) => self.let_bindings(&items[1], &items[2]),
+            ("letrec", 3) => self.letrec(&items[1], &items[2]),
+            ("loop", 3) => self.loop_bindings(&items[1], &items[2]),
+            ("dotimes" | "dolist", 3..) => self.iteration(items),
+            ("lambda", 3..) => self.function(&items[1], &items[2..]),
+            ("defun", 3..) if self.compiler.looks_like_param_list(&items[2]) => self.function(&items[2], &items[3..]),
+            ("defun", 3..) => {
+                for clause in &items[2..] {
+                    self.clause(clause);
+                }
+                let parsed: Result<Vec<_>, _> = items[2..].iter().map(|clause| self.compiler.parse_clause(clause)).collect();
+                if let Ok(parsed) = parsed {
+                    let clauses: Vec<_> = parsed.iter().map(|clause| (clause.patterns.as_slice(), clause.guard.is_some(), &clause.location)).collect();
+                    self.unreachable_clauses(&clauses);
+                    self.defun_coverage(&items[1], &clauses);
+                }
+            }
+            ("deftest" | "define" | "def" | "defconst", _) => self.exprs(items.get(2..).unwrap_or_default()),
+            ("match", 3..) => self.match_clauses(items),
+            ("handler-case", 3) => self.handler_case(items),
+            ("case", 2..) => {
+                // The keys are literals, only the bodies refer to bindings
+                self.expr(&items[1]);
+                for clause in &items[2..] {
+                    if let LispExpr::List(parts) = &clause.expr {
+                        self.exprs(parts.get(1..).unwrap_or_default());
+                    }
+                }
+            }
+            _ => self.exprs(items),
+        }
+    }
+
+    // Only the unquoted parts of a quasiquote are evaluated
+    fn unquoted(&mut self, exprs: &[SourceExpr]) {
+        for expr in exprs {
+            match &expr.expr {
+                LispExpr::List(items) if matches!(items.first().map(|item| &item.expr),
+                    Some(LispExpr::Symbol(s)) if s == "unquote" || s == "unquote-splicing") => self.exprs(&items[1..]),
+                LispExpr::List(items) => self.unquoted(items),
+                LispExpr::DottedList(items, rest) => {
+                    self.unquoted(items);
+                    self.unquoted(std::slice::from_ref(rest.as_ref()));
+                }
+                _ => {}
+            }
+        }
+    }
+
+    // (let ((pattern value) ...) body): each value sees the bindings before it
+    fn let_bindings(&mut self, bindings: &SourceExpr, body: &SourceExpr) {
+        self.enter();
+        if let LispExpr::List(bindings) = &bindings.expr {
+            for binding in bindings {
+                match &binding.expr {
+                    LispExpr::List(pair) if pair.len() == 2 => {
+                        self.expr(&pair[1]);
+                        self.declare_pattern(&pair[0], "let binding");
+                    }
+                    _ => self.expr(binding),
+                }
+            }
+        }
+        self.expr(body);
+        self.leave();
+    }
+
+    // The (name value) pairs of a binding list
+    fn binding_pairs(bindings: &SourceExpr) -> Vec<&[SourceExpr]> {
+        match &bindings.expr {
+            LispExpr::List(bindings) => bindings.iter()
+                .filter_map(|binding| match &binding.expr {
+                    LispExpr::List(pair) if pair.len() == 2 => Some(pair.as_slice()),
+                    _ => None,
+                })
+                .collect(),
+            _ => Vec::new(),
+        }
+    }
+
+    // (letrec ((name value) ...) body): every name is in scope in every value
+    fn letrec(&mut self, bindings: &SourceExpr, body: &SourceExpr) {
+        self.enter();
+        let pairs = Self::binding_pairs(bindings);
+        for pair in &pairs {
+            if let LispExpr::Symbol(name) = &pair[0].expr {
+                self.declare(name, Some("let binding"), &pair[0].location);
+            }
+        }
+        for pair in &pairs {
+            self.expr(&pair[1]);
+        }
+        self.expr(body);
+        self.leave();
+    }
+
+    // (let name ((var init) ...) body): the inits are outside the loop
+    fn named_let(&mut self, items: &[SourceExpr]) {
+        let pairs = Self::binding_pairs(&items[2]);
+        for pair in &pairs {
+            self.expr(&pair[1]);
+        }
+        self.enter();
+        if let LispExpr::Symbol(name) = &items[1].expr {
+            self.declare(name, None, &items[1].location);
+        }
+        for pair in &pairs {
+            if let LispExpr::Symbol(var) = &pair[0].expr {
+                self.declare(var, Some("let binding"), &pair[0].location);
+            }
+        }
+        self.expr(&items[3]);
+        self.leave();
+    }
+
+    // (loop ((var init) ...) body)
+    fn loop_bindings(&mut self, bindings: &SourceExpr, body: &SourceExpr) {
+        self.enter();
+        if let LispExpr::List(bindings) = &bindings.expr {
+            for binding in bindings {
+                match &binding.expr {
+                    LispExpr::List(pair) if pair.len() == 2 => {
+                        self.expr(&pair[1]);
+                        if let LispExpr::Symbol(var) = &pair[0].expr {
+                            self.declare(var, None, &pair[0].location);
+                        }
+                    }
+                    _ => self.expr(binding),
+                }
+            }
+        }
+        self.expr(body);
+        self.leave();
+    }
+
+    // (dotimes (var count) body...) and (dolist (var list) body...)
+    fn iteration(&mut self, items: &[SourceExpr]) {
+        match &items[1].expr {
+            LispExpr::List(spec) if spec.len() == 2 => {
+                self.expr(&spec[1]);
+                self.enter();
+                if let LispExpr::Symbol(var) = &spec[0].expr {
+                    self.declare(var, None, &spec[0].location);
+                }
+                self.exprs(&items[2..]);
+                self.leave();
+            }
+            _ => self.exprs(&items[1..]),
+        }
+    }
+
+    // A lambda or single-clause defun: (params) body...
+    fn function(&mut self, params: &SourceExpr, body: &[SourceExpr]) {
+        self.enter();
+        if let (Ok(Some(_)), LispExpr::List(items)) = (Compiler::parse_keyword_params(params), &params.expr) {
+            // Each &key default can use the parameters before it
+            for param in items {
+                match &param.expr {
+                    LispExpr::Symbol(name) if name != "&key" => self.declare(name, Some("parameter"), &param.location),
+                    LispExpr::List(spec) => {
+                        self.expr(&spec[1]);
+                        if let LispExpr::Symbol(name) = &spec[0].expr {
+                            self.declare(name, Some("parameter"), &spec[0].location);
+                        }
+                    }
+                    _ => {}
+                }
+            }
+        } else if Compiler::parse_params(params).is_ok() {
+            let symbols: Vec<&SourceExpr> = match &params.expr {
+                LispExpr::List(items) => items.iter().collect(),
+                LispExpr::DottedList(items, rest) => items.iter().chain(std::iter::once(rest.as_ref())).collect(),
+                _ => Vec::new(),
+            };
+            for param in symbols {
+                if let LispExpr::Symbol(name) = &param.expr {
+                    // The markers before a rest parameter aren't names
+                    if name != "." && name != "&rest" {
+                        self.declare(name, Some("parameter"), &param.location);
+                    }
+                }
+            }
+        }
+        self.exprs(body);
+        self.leave();
+    }
+
+    // A multi-clause defun clause: ((patterns...) [when guard] body...)
+    fn clause(&mut self, clause: &SourceExpr) {
+        let items = match &clause.expr {
+            LispExpr::List(items) if !items.is_empty() => items,
+            _ => return,
+        };
+        self.enter();
+        match &items[0].expr {
+            LispExpr::List(patterns) => {
+                for pattern in patterns {
+                    self.declare_pattern(pattern, "pattern variable");
+                }
+            }
+            LispExpr::DottedList(patterns, rest) => {
+                for pattern in patterns.iter().chain(std::iter::once(rest.as_ref())) {
+                    self.declare_pattern(pattern, "pattern variable");
+                }
+            }
+            _ => {}
+        }
+        self.exprs(&items[1..]);
+        self.leave();
+    }
+
+    // (match expr (pattern body...) ...)
+    fn match_clauses(&mut self, items: &[SourceExpr]) {
+        self.expr(&items[1]);
+        let mut parsed = Vec::new();
+        for clause in &items[2..] {
+            match &clause.expr {
+                LispExpr::List(parts) if parts.len() >= 2 => {
+                    self.enter();
+                    self.declare_pattern(&parts[0], "pattern variable");
+                    self.exprs(&parts[1..]);
+                    self.leave();
+                    if let (Ok(pattern), Ok((guard, _))) = (self.compiler.parse_pattern(&parts[0]), Compiler::split_match_guard(clause, &parts[1..])) {
+                        parsed.push((vec![pattern], guard.is_some(), &clause.location));
+                    }
+                }
+                _ => self.expr(clause),
+            }
+        }
+        // A clause that doesn't parse fails the compile, so there is nothing to check
+        if parsed.len() == items.len() - 2 {
+            let clauses: Vec<_> = parsed.iter().map(|(patterns, guarded, location)| (patterns.as_slice(), *guarded, *location)).collect();
+            self.unreachable_clauses(&clauses);
+        }
+    }
+
+    // Warn about each clause an earlier one always matches first
+    fn unreachable_clauses(&mut self, clauses: &[(&[Pattern], bool, &Location)]) {
+        let shapes: Vec<(&[Pattern], bool)> = clauses.iter().map(|(patterns, guarded, _)| (*patterns, *guarded)).collect();
+        for (later, earlier) in Compiler::unreachable_clauses(&shapes) {
+            self.warnings.push(CompileWarning::new(
+                format!("Unreachable clause: the clause on line {} has the same pattern and always matches first", clauses[earlier].2.line),
+                clauses[later].2.clone(),
+                1,
+            ));
+        }
+    }
+
+    // Warn about each clause of a multi-clause defun the earlier ones together
+    // always match first, but for those warned about above, and about the
+    // arguments no clause matches
+    fn defun_coverage(&mut self, name: &SourceExpr, clauses: &[(&[Pattern], bool, &Location)]) {
+        let shapes: Vec<(&[Pattern], bool)> = clauses.iter().map(|(patterns, guarded, _)| (*patterns, *guarded)).collect();
+        let same: Vec<usize> = Compiler::unreachable_clauses(&shapes).into_iter().map(|(later, _)| later).collect();
+        for later in Compiler::covered_clauses(&shapes) {
+            if !same.contains(&later) {
+                self.warnings.push(CompileWarning::new(
+                    "Unreachable clause: the clauses before it already match everything it does".to_string(),
+                    clauses[later].2.clone(),
+                    1,
+                ));
+            }
+        }
+        let LispExpr::Symbol(function) = &name.expr else { return };
+        for missing in Compiler::uncovered_arguments(&shapes) {
+            self.warnings.push(CompileWarning::new(
+                format!("Non-exhaustive function '{}': clauses do not cover: {}", function, missing),
+                name.location.clone(),
+                function.chars().count(),
+            ));
+        }
+    }
+
+    // (handler-case expr (catch (var) body...))
+    fn handler_case(&mut self, items: &[SourceExpr]) {
+        self.expr(&items[1]);
+        match &items[2].expr {
+            LispExpr::List(clause) if clause.len() >= 3 => {
+                self.enter();
+                if let LispExpr::List(vars) = &clause[1].expr {
+                    for var in vars {
+                        if let LispExpr::Symbol(name) = &var.expr {
+                            self.declare(name, None, &var.location);
+                        }
+                    }
+                }
+                self.exprs(&clause[2..]);
+                self.leave();
+            }
+            _ => self.expr(&items[2]),
+        }
+    }
+}
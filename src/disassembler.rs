@@ -11,6 +11,16 @@ pub struct DisassemblerStats {
 pub fn disassemble_bytecode(
     functions: &HashMap<String, Vec<Instruction>>,
     main: &[Instruction],
+) -> String {
+    disassemble_bytecode_with_params(functions, main, &HashMap::new())
+}
+
+/// Disassemble a program, naming argument slots after the parameters in `param_names`
+/// (as collected by `Compiler::function_params`)
+pub fn disassemble_bytecode_with_params(
+    functions: &HashMap<String, Vec<Instruction>>,
+    main: &[Instruction],
+    param_names: &HashMap<String, Vec<String>>,
 ) -> String {
     let mut output = String::new();
 
@@ -22,9 +32,8 @@ pub fn disassemble_bytecode(
         sorted_functions.sort_by_key(|(name, _)| *name);
 
         for (name, bytecode) in sorted_functions {
-            output.push_str(&format!("Function: {}\n", name));
-            output.push_str(&format!("  {} instruction(s)\n", bytecode.len()));
-            output.push_str(&disassemble_instructions(bytecode));
+            let params = param_names.get(name).map(Vec::as_slice).unwrap_or(&[]);
+            output.push_str(&disassemble_function_with_params(name, bytecode, params));
             output.push_str("\n");
         }
     }
@@ -32,7 +41,7 @@ pub fn disassemble_bytecode(
     // Disassemble main bytecode
     output.push_str("=== Main ===\n");
     output.push_str(&format!("  {} instruction(s)\n", main.len()));
-    output.push_str(&disassemble_instructions(main));
+    output.push_str(&disassemble_instructions(main, None, &[], ""));
 
     // Add statistics
     output.push_str("\n");
@@ -41,24 +50,152 @@ pub fn disassemble_bytecode(
     output
 }
 
-fn disassemble_instructions(bytecode: &[Instruction]) -> String {
+/// Disassemble a single named function.
+/// Jump targets are given labels (L0, L1, ...) in address order, so the output
+/// is stable across runs and can be asserted on in tests.
+pub fn disassemble_function(name: &str, bytecode: &[Instruction]) -> String {
+    disassemble_function_with_params(name, bytecode, &[])
+}
+
+/// Disassemble a single named function whose arguments are called `params`
+pub fn disassemble_function_with_params(name: &str, bytecode: &[Instruction], params: &[String]) -> String {
+    let mut output = String::new();
+    output.push_str(&format!("Function: {}\n", name));
+    output.push_str(&format!("  {} instruction(s)\n", bytecode.len()));
+    output.push_str(&disassemble_instructions(bytecode, Some(name), params, ""));
+    output
+}
+
+/// List `bytecode` with every line prefixed by `indent`. The body of each closure
+/// it creates is listed right below, indented one level further.
+fn disassemble_instructions(
+    bytecode: &[Instruction],
+    function_name: Option<&str>,
+    params: &[String],
+    indent: &str,
+) -> String {
+    let labels = collect_labels(bytecode);
     let mut output = String::new();
 
     for (addr, instr) in bytecode.iter().enumerate() {
-        output.push_str(&format!("  {:4}: {}\n", addr, format_instruction(instr)));
+        if let Some(label) = labels.get(&addr) {
+            output.push_str(&format!("{}{}:\n", indent, label));
+        }
+
+        let text = format_instruction(instr);
+        match annotate_instruction(instr, &labels, function_name, params) {
+            Some(note) => output.push_str(&format!("{}  {:4}: {:<32} ; {}\n", indent, addr, text, note)),
+            None => output.push_str(&format!("{}  {:4}: {}\n", indent, addr, text)),
+        }
+
+        let nested = match instr {
+            Instruction::MakeClosure(closure_params, body, _) => Some((closure_params.clone(), body)),
+            Instruction::MakeVariadicClosure(required, rest, body, _) => {
+                let mut closure_params = required.clone();
+                closure_params.push(rest.clone());
+                Some((closure_params, body))
+            }
+            _ => None,
+        };
+        if let Some((closure_params, body)) = nested {
+            let nested_indent = format!("{}        ", indent);
+            output.push_str(&disassemble_instructions(body, None, &closure_params, &nested_indent));
+        }
+    }
+
+    // A jump past the last instruction still gets its label printed
+    if let Some(label) = labels.get(&bytecode.len()) {
+        output.push_str(&format!("{}{}:\n", indent, label));
     }
 
     output
 }
 
-fn format_instruction(instr: &Instruction) -> String {
+/// Assign a label to every address that is the target of a jump
+fn collect_labels(bytecode: &[Instruction]) -> HashMap<usize, String> {
+    let mut targets: Vec<usize> = bytecode.iter()
+        .flat_map(|instr| match instr {
+            Instruction::Jmp(addr) | Instruction::JmpIfFalse(addr) | Instruction::CheckArity(_, addr)
+            | Instruction::JmpIfFalseOrPop(addr) | Instruction::JmpIfTrueOrPop(addr)
+            | Instruction::PushHandler(addr) | Instruction::PushCatch(addr) => vec![*addr],
+            Instruction::JumpTable(_, targets, default) => {
+                targets.iter().copied().chain(std::iter::once(*default)).collect()
+            }
+            _ => Vec::new(),
+        })
+        .collect();
+    targets.sort();
+    targets.dedup();
+
+    targets.into_iter()
+        .enumerate()
+        .map(|(i, addr)| (addr, format!("L{}", i)))
+        .collect()
+}
+
+/// Resolved operand information shown next to control-flow, stack and argument instructions
+fn annotate_instruction(
+    instr: &Instruction,
+    labels: &HashMap<usize, String>,
+    function_name: Option<&str>,
+    params: &[String],
+) -> Option<String> {
+    match instr {
+        Instruction::LoadArg(idx) => params.get(*idx).cloned(),
+        Instruction::AddArgs(a, b) => match (params.get(*a), params.get(*b)) {
+            (Some(a), Some(b)) => Some(format!("{} + {}", a, b)),
+            _ => None,
+        },
+        Instruction::StoreArg(idx) => params.get(*idx).map(|name| format!("set! {}", name)),
+        Instruction::Jmp(addr) | Instruction::JmpIfFalse(addr) | Instruction::CheckArity(_, addr)
+        | Instruction::JmpIfFalseOrPop(addr) | Instruction::JmpIfTrueOrPop(addr) => {
+            labels.get(addr).map(|label| format!("-> {}", label))
+        }
+        Instruction::PushHandler(addr) => labels.get(addr).map(|label| format!("on error -> {}", label)),
+        Instruction::PushCatch(addr) => labels.get(addr).map(|label| format!("on throw -> {}", label)),
+        Instruction::JumpTable(min, targets, default) => {
+            let label = |addr: &usize| labels.get(addr).cloned().unwrap_or_else(|| addr.to_string());
+            let entries: Vec<String> = targets.iter()
+                .enumerate()
+                .map(|(i, addr)| format!("{} -> {}", *min + i as i64, label(addr)))
+                .collect();
+            Some(format!("{}, else -> {}", entries.join(", "), label(default)))
+        }
+        Instruction::TailCall(name, _) | Instruction::TailCallCached(name, _, _) if Some(name.as_str()) == function_name => {
+            Some("-> self (frame reused)".to_string())
+        }
+        Instruction::TailCall(name, _) | Instruction::TailCallCached(name, _, _) => Some(format!("-> {} (frame reused)", name)),
+        Instruction::TailCallClosure(_) => Some("-> closure (frame reused)".to_string()),
+        Instruction::TailApply => Some("-> applied function (frame reused)".to_string()),
+        Instruction::Slide(n) => Some(format!("keep top, drop {} below", n)),
+        _ => None,
+    }
+}
+
+pub fn format_instruction(instr: &Instruction) -> String {
     match instr {
         Instruction::Push(val) => format!("Push({:?})", val),
         Instruction::Add => "Add".to_string(),
         Instruction::Sub => "Sub".to_string(),
         Instruction::Mul => "Mul".to_string(),
         Instruction::Div => "Div".to_string(),
+        Instruction::FloatDiv => "FloatDiv".to_string(),
         Instruction::Mod => "Mod".to_string(),
+        Instruction::Quotient => "Quotient".to_string(),
+        Instruction::Remainder => "Remainder".to_string(),
+        Instruction::Modulo => "Modulo".to_string(),
+        Instruction::CheckedAdd => "CheckedAdd".to_string(),
+        Instruction::CheckedSub => "CheckedSub".to_string(),
+        Instruction::CheckedMul => "CheckedMul".to_string(),
+        Instruction::WrappingAdd => "WrappingAdd".to_string(),
+        Instruction::WrappingSub => "WrappingSub".to_string(),
+        Instruction::WrappingMul => "WrappingMul".to_string(),
+        Instruction::BitAnd => "BitAnd".to_string(),
+        Instruction::BitOr => "BitOr".to_string(),
+        Instruction::BitXor => "BitXor".to_string(),
+        Instruction::BitNot => "BitNot".to_string(),
+        Instruction::ShiftLeft => "ShiftLeft".to_string(),
+        Instruction::ShiftRight => "ShiftRight".to_string(),
         Instruction::Neg => "Neg".to_string(),
         Instruction::Leq => "Leq".to_string(),
         Instruction::Lt => "Lt".to_string(),
@@ -66,12 +203,19 @@ fn format_instruction(instr: &Instruction) -> String {
         Instruction::Gte => "Gte".to_string(),
         Instruction::Eq => "Eq".to_string(),
         Instruction::Neq => "Neq".to_string(),
+        Instruction::NumEq => "NumEq".to_string(),
         Instruction::JmpIfFalse(addr) => format!("JmpIfFalse({})", addr),
+        Instruction::JmpIfFalseOrPop(addr) => format!("JmpIfFalseOrPop({})", addr),
+        Instruction::JmpIfTrueOrPop(addr) => format!("JmpIfTrueOrPop({})", addr),
         Instruction::Jmp(addr) => format!("Jmp({})", addr),
         Instruction::Call(name, argc) => format!("Call(\"{}\", {})", name, argc),
         Instruction::TailCall(name, argc) => format!("TailCall(\"{}\", {})", name, argc),
+        Instruction::CallCached(name, argc, slot) => format!("CallCached(\"{}\", {}, slot {})", name, argc, slot),
+        Instruction::TailCallCached(name, argc, slot) => format!("TailCallCached(\"{}\", {}, slot {})", name, argc, slot),
         Instruction::Ret => "Ret".to_string(),
         Instruction::LoadArg(idx) => format!("LoadArg({})", idx),
+        Instruction::AddArgs(a, b) => format!("AddArgs({}, {})", a, b),
+        Instruction::AddLocals(a, b) => format!("AddLocals({}, {})", a, b),
         Instruction::Print => "Print".to_string(),
         Instruction::Halt => "Halt".to_string(),
         Instruction::Cons => "Cons".to_string(),
@@ -84,16 +228,48 @@ fn format_instruction(instr: &Instruction) -> String {
         Instruction::StringToSymbol => "StringToSymbol".to_string(),
         Instruction::GetLocal(pos) => format!("GetLocal({})", pos),
         Instruction::SetLocal(pos) => format!("SetLocal({})", pos),
-        Instruction::BeginLoop(count) => format!("BeginLoop({})", count),
-        Instruction::Recur(count) => format!("Recur({})", count),
+        Instruction::StoreArg(idx) => format!("StoreArg({})", idx),
+        Instruction::MakeCell => "MakeCell".to_string(),
+        Instruction::CellGet(name) => format!("CellGet(\"{}\")", name),
+        Instruction::CellSet => "CellSet".to_string(),
         Instruction::PopN(n) => format!("PopN({})", n),
         Instruction::Slide(n) => format!("Slide({})", n),
+        Instruction::Values(n) => format!("Values({})", n),
+        Instruction::CallForValues => "CallForValues".to_string(),
+        Instruction::ApplyValues => "ApplyValues".to_string(),
+        Instruction::PushHandler(addr) => format!("PushHandler({})", addr),
+        Instruction::PopHandler => "PopHandler".to_string(),
+        Instruction::Raise => "Raise".to_string(),
+        Instruction::PushCatch(addr) => format!("PushCatch({})", addr),
+        Instruction::Throw => "Throw".to_string(),
+        Instruction::CollectGarbage => "CollectGarbage".to_string(),
+        Instruction::GetGcStats => "GetGcStats".to_string(),
+        Instruction::MakePromise => "MakePromise".to_string(),
+        Instruction::IsPromise => "IsPromise".to_string(),
+        Instruction::ForceBegin => "ForceBegin".to_string(),
+        Instruction::ForceEnd => "ForceEnd".to_string(),
+        Instruction::MakeStruct(name, n) => format!("MakeStruct(\"{}\", {})", name, n),
+        Instruction::StructGet(name, index) => format!("StructGet(\"{}\", {})", name, index),
+        Instruction::IsStruct(name) => format!("IsStruct(\"{}\")", name),
+        Instruction::MatchFailed => "MatchFailed".to_string(),
+        Instruction::ClauseFailed(name) => format!("ClauseFailed({:?})", name),
+        Instruction::JumpTable(min, targets, default) => format!("JumpTable({}, {:?}, {})", min, targets, default),
+        Instruction::IsEq => "IsEq".to_string(),
+        Instruction::IsEqv => "IsEqv".to_string(),
+        Instruction::Equal => "Equal".to_string(),
+        Instruction::TimeStart => "TimeStart".to_string(),
+        Instruction::TimeEnd => "TimeEnd".to_string(),
+        Instruction::Assert(source) => format!("Assert({:?})", source),
+        Instruction::AssertEqual(source) => format!("AssertEqual({:?})", source),
         Instruction::CheckArity(arity, addr) => format!("CheckArity({}, {})", arity, addr),
         Instruction::MakeClosure(params, body, num_captured) => {
             format!("MakeClosure({:?}, {} instructions, {} captured)", params, body.len(), num_captured)
         }
         Instruction::CallClosure(argc) => format!("CallClosure({})", argc),
+        Instruction::TailCallClosure(argc) => format!("TailCallClosure({})", argc),
         Instruction::Apply => "Apply".to_string(),
+        Instruction::TailApply => "TailApply".to_string(),
+        Instruction::PrependArgs(n) => format!("PrependArgs({})", n),
         Instruction::LoadCaptured(idx) => format!("LoadCaptured({})", idx),
         Instruction::Append => "Append".to_string(),
         Instruction::MakeList(n) => format!("MakeList({})", n),
@@ -102,31 +278,77 @@ fn format_instruction(instr: &Instruction) -> String {
         Instruction::StringLength => "StringLength".to_string(),
         Instruction::Substring => "Substring".to_string(),
         Instruction::StringAppend => "StringAppend".to_string(),
+        Instruction::StringEq => "StringEq".to_string(),
         Instruction::StringToList => "StringToList".to_string(),
         Instruction::ListToString => "ListToString".to_string(),
         Instruction::CharCode => "CharCode".to_string(),
+        Instruction::CharToInteger => "CharToInteger".to_string(),
+        Instruction::IntegerToChar => "IntegerToChar".to_string(),
+        Instruction::CharEq => "CharEq".to_string(),
+        Instruction::StringRef => "StringRef".to_string(),
+        Instruction::CharLt => "CharLt".to_string(),
+        Instruction::IsAlphabetic => "IsAlphabetic".to_string(),
+        Instruction::IsNumeric => "IsNumeric".to_string(),
+        Instruction::IsWhitespace => "IsWhitespace".to_string(),
         Instruction::ReadFile => "ReadFile".to_string(),
         Instruction::WriteFile => "WriteFile".to_string(),
         Instruction::FileExists => "FileExists".to_string(),
         Instruction::GetArgs => "GetArgs".to_string(),
+        Instruction::GetEnv => "GetEnv".to_string(),
+        Instruction::Exit => "Exit".to_string(),
+        Instruction::CheckKeywords(function, keywords) => format!("CheckKeywords(\"{}\", {})", function, keywords.join(" ")),
+        Instruction::HasKeyword(keyword) => format!("HasKeyword({})", keyword),
+        Instruction::GetKeyword(keyword) => format!("GetKeyword({})", keyword),
         Instruction::WriteBinaryFile => "WriteBinaryFile".to_string(),
         Instruction::LoadFile => "LoadFile".to_string(),
         Instruction::RequireFile => "RequireFile".to_string(),
         Instruction::ListRef => "ListRef".to_string(),
+        Instruction::Nth => "Nth".to_string(),
         Instruction::ListLength => "ListLength".to_string(),
+        Instruction::ListReverse => "ListReverse".to_string(),
+        Instruction::Transpose => "Transpose".to_string(),
+        Instruction::Member => "Member".to_string(),
+        Instruction::Memq => "Memq".to_string(),
+        Instruction::Assoc => "Assoc".to_string(),
+        Instruction::Assq => "Assq".to_string(),
+        Instruction::Sort => "Sort".to_string(),
         Instruction::NumberToString => "NumberToString".to_string(),
         // HashMap operations
         Instruction::MakeHashMap(n) => format!("MakeHashMap({})", n),
         Instruction::HashMapGet => "HashMapGet".to_string(),
         Instruction::HashMapSet => "HashMapSet".to_string(),
+        Instruction::HashMapSetInPlace => "HashMapSetInPlace".to_string(),
         Instruction::HashMapKeys => "HashMapKeys".to_string(),
         Instruction::HashMapValues => "HashMapValues".to_string(),
         Instruction::HashMapContainsKey => "HashMapContainsKey".to_string(),
         Instruction::IsHashMap => "IsHashMap".to_string(),
         // Vector operations
         Instruction::MakeVector(n) => format!("MakeVector({})", n),
+        Instruction::MakeVectorFilled => "MakeVectorFilled".to_string(),
+        Instruction::HashMapGetOr => "HashMapGetOr".to_string(),
+        Instruction::HashMapRemove => "HashMapRemove".to_string(),
+        Instruction::HashMapCount => "HashMapCount".to_string(),
         Instruction::VectorGet => "VectorGet".to_string(),
         Instruction::VectorSet => "VectorSet".to_string(),
+        Instruction::VectorSetInPlace => "VectorSetInPlace".to_string(),
+        Instruction::AppendFile => "AppendFile".to_string(),
+        Instruction::ReadLine => "ReadLine".to_string(),
+        Instruction::ReadLineFrom => "ReadLineFrom".to_string(),
+        Instruction::Read => "Read".to_string(),
+        Instruction::ReadFromString => "ReadFromString".to_string(),
+        Instruction::Trace => "Trace".to_string(),
+        Instruction::Untrace => "Untrace".to_string(),
+        Instruction::TraceCall(name) => format!("TraceCall(\"{}\")", name),
+        Instruction::TraceReturn => "TraceReturn".to_string(),
+        Instruction::OpenInputFile => "OpenInputFile".to_string(),
+        Instruction::OpenOutputFile => "OpenOutputFile".to_string(),
+        Instruction::ClosePort => "ClosePort".to_string(),
+        Instruction::PrintTo => "PrintTo".to_string(),
+        Instruction::Write => "Write".to_string(),
+        Instruction::WriteTo => "WriteTo".to_string(),
+        Instruction::Display => "Display".to_string(),
+        Instruction::DisplayTo => "DisplayTo".to_string(),
+        Instruction::PrettyPrint => "PrettyPrint".to_string(),
         Instruction::VectorPush => "VectorPush".to_string(),
         Instruction::VectorPop => "VectorPop".to_string(),
         Instruction::VectorLength => "VectorLength".to_string(),
@@ -139,6 +361,8 @@ fn format_instruction(instr: &Instruction) -> String {
         Instruction::IsProcedure => "IsProcedure".to_string(),
         // Type conversions
         Instruction::StringToNumber => "StringToNumber".to_string(),
+        Instruction::NumberToStringRadix => "NumberToStringRadix".to_string(),
+        Instruction::StringToNumberRadix => "StringToNumberRadix".to_string(),
         Instruction::ListToVector => "ListToVector".to_string(),
         Instruction::VectorToList => "VectorToList".to_string(),
         // Variadic function support
@@ -163,6 +387,7 @@ fn format_instruction(instr: &Instruction) -> String {
         Instruction::Exp => "Exp".to_string(),
         Instruction::Floor => "Floor".to_string(),
         Instruction::Ceil => "Ceil".to_string(),
+        Instruction::Round => "Round".to_string(),
         Instruction::Abs => "Abs".to_string(),
         Instruction::Pow => "Pow".to_string(),
         Instruction::Random => "Random".to_string(),
@@ -175,6 +400,7 @@ fn format_instruction(instr: &Instruction) -> String {
         Instruction::StringReplace => "StringReplace".to_string(),
         // Date/Time operations
         Instruction::CurrentTimestamp => "CurrentTimestamp".to_string(),
+        Instruction::CurrentTimeMillis => "CurrentTimeMillis".to_string(),
         Instruction::FormatTimestamp => "FormatTimestamp".to_string(),
         // Metaprogramming
         Instruction::Eval => "Eval".to_string(),
@@ -183,9 +409,11 @@ fn format_instruction(instr: &Instruction) -> String {
         Instruction::FunctionParams => "FunctionParams".to_string(),
         Instruction::ClosureCaptured => "ClosureCaptured".to_string(),
         Instruction::FunctionName => "FunctionName".to_string(),
+        Instruction::Disassemble => "Disassemble".to_string(),
         // Type inspection and symbol generation
         Instruction::TypeOf => "TypeOf".to_string(),
         Instruction::GenSym => "GenSym".to_string(),
+        Instruction::GenSymPrefix => "GenSymPrefix".to_string(),
         // Parallel Collections
         Instruction::PMap => "PMap".to_string(),
         Instruction::PFilter => "PFilter".to_string(),
@@ -196,6 +424,21 @@ fn format_instruction(instr: &Instruction) -> String {
         Instruction::HttpReadRequest => "HttpReadRequest".to_string(),
         Instruction::HttpSendResponse => "HttpSendResponse".to_string(),
         Instruction::HttpClose => "HttpClose".to_string(),
+        Instruction::TcpListen => "TcpListen".to_string(),
+        Instruction::TcpAccept => "TcpAccept".to_string(),
+        Instruction::SocketRead => "SocketRead".to_string(),
+        Instruction::SocketWrite => "SocketWrite".to_string(),
+        Instruction::SocketClose => "SocketClose".to_string(),
+        // Cooperative tasks
+        Instruction::Spawn => "Spawn".to_string(),
+        Instruction::Yield => "Yield".to_string(),
+        Instruction::Sleep => "Sleep".to_string(),
+        Instruction::MakeChannel => "MakeChannel".to_string(),
+        Instruction::ChanSend => "ChanSend".to_string(),
+        Instruction::ChanRecv => "ChanRecv".to_string(),
+        Instruction::TaskResult => "TaskResult".to_string(),
+        Instruction::TaskStatus => "TaskStatus".to_string(),
+        Instruction::TaskExit => "TaskExit".to_string(),
         // Multi-threaded HTTP
         Instruction::HttpListenShared => "HttpListenShared".to_string(),
         Instruction::HttpServeParallel => "HttpServeParallel".to_string(),
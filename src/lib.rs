@@ -7,10 +7,12 @@ pub mod parser;
 pub mod disassembler;
 pub mod repl;
 pub mod optimizer;
+pub mod test_runner;
+pub mod prelude;
 
 // Re-export commonly used types for backward compatibility
-pub use vm::{VM, Value, Instruction, List, FfiType};
-pub use vm::errors::{CompileError, RuntimeError, Location};
+pub use vm::{VM, Value, Instruction, List, MapKey, FfiType, Symbol};
+pub use vm::errors::{CompileError, CompileWarning, RuntimeError, Location};
 pub use vm::stack::Frame;
 pub use vm::bytecode;
 
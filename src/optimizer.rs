@@ -114,7 +114,7 @@ impl Optimizer {
             if i + 1 < bytecode.len() {
                 let folded = match (&bytecode[i], &bytecode[i + 1]) {
                     (Instruction::Push(Value::Integer(n)), Instruction::Neg) => {
-                        Some(Value::Integer(-n))
+                        n.checked_neg().map(Value::Integer)
                     }
                     (Instruction::Push(Value::Float(f)), Instruction::Neg) => {
                         Some(Value::Float(-f))
@@ -138,12 +138,13 @@ impl Optimizer {
     }
 
     fn fold_int_int(&self, a: i64, b: i64, op: &Instruction) -> Option<Value> {
+        // Overflowing operations are left for the VM to promote to bignums
         match op {
-            Instruction::Add => Some(Value::Integer(a + b)),
-            Instruction::Sub => Some(Value::Integer(a - b)),
-            Instruction::Mul => Some(Value::Integer(a * b)),
-            Instruction::Div if b != 0 => Some(Value::Integer(a / b)),
-            Instruction::Mod if b != 0 => Some(Value::Integer(a % b)),
+            Instruction::Add => a.checked_add(b).map(Value::Integer),
+            Instruction::Sub => a.checked_sub(b).map(Value::Integer),
+            Instruction::Mul => a.checked_mul(b).map(Value::Integer),
+            Instruction::Div if b != 0 => a.checked_div(b).map(Value::Integer),
+            Instruction::Mod if b != 0 => a.checked_rem(b).map(Value::Integer),
             Instruction::Leq => Some(Value::Boolean(a <= b)),
             Instruction::Lt => Some(Value::Boolean(a < b)),
             Instruction::Gt => Some(Value::Boolean(a > b)),
@@ -329,13 +330,18 @@ impl Optimizer {
                 Instruction::Jmp(target) => {
                     to_visit.push(*target);
                 }
-                Instruction::JmpIfFalse(target) => {
+                Instruction::JmpIfFalse(target) | Instruction::JmpIfFalseOrPop(target) | Instruction::JmpIfTrueOrPop(target)
+                | Instruction::PushHandler(target) | Instruction::PushCatch(target) => {
                     to_visit.push(*target);
                     if addr + 1 < bytecode.len() {
                         to_visit.push(addr + 1);
                     }
                 }
-                Instruction::Halt | Instruction::Ret => {
+                Instruction::JumpTable(_, targets, default) => {
+                    to_visit.extend(targets.iter().copied());
+                    to_visit.push(*default);
+                }
+                Instruction::Halt | Instruction::Ret | Instruction::Raise | Instruction::Throw | Instruction::MatchFailed | Instruction::ClauseFailed(_) => {
                 }
                 _ => {
                     if addr + 1 < bytecode.len() {
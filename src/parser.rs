@@ -1,16 +1,51 @@
 use crate::{LispExpr, Location, SourceExpr};
+use crate::vm::value::{parse_char_name, parse_special_float};
 
 #[derive(Debug, Clone)]
 struct Token {
     text: String,
     line: usize,
     column: usize,
+    end: usize, // Byte offset just past the token
 }
 
 pub struct Parser {
     tokens: Vec<Token>,
     pos: usize,
     file: String,
+    error: Option<String>, // Input that couldn't be split into tokens, reported by parse_all
+}
+
+/// Why read_datum failed. `incomplete` is set when the input ended partway
+/// through a datum, so that more input could still complete it.
+#[derive(Debug, Clone, PartialEq)]
+pub struct ReadError {
+    pub message: String,
+    pub incomplete: bool,
+}
+
+/// Read the first datum in `input`, for read and read-from-string. Returns the
+/// datum and the byte offset just past it, or None when the input holds only
+/// whitespace and comments.
+pub fn read_datum(input: &str, file: &str) -> Result<Option<(SourceExpr, usize)>, ReadError> {
+    let mut parser = Parser::new_with_file(input, file.to_string());
+    if let Some(message) = parser.error.take() {
+        // Only an unclosed string or block comment stops tokenizing
+        return Err(ReadError { message, incomplete: true });
+    }
+    let datum = match parser.skip_datum_comments() {
+        Ok(()) if parser.pos >= parser.tokens.len() => return Ok(None),
+        Ok(()) => parser.parse_expr(),
+        Err(message) => Err(message),
+    };
+    match datum {
+        Ok(datum) => {
+            let end = parser.tokens[parser.pos - 1].end;
+            Ok(Some((datum, end)))
+        }
+        // Parsing fails before the last token only at a real mistake
+        Err(message) => Err(ReadError { message, incomplete: parser.pos >= parser.tokens.len() }),
+    }
 }
 
 impl Parser {
@@ -19,21 +54,49 @@ impl Parser {
     }
 
     pub fn new_with_file(input: &str, file: String) -> Self {
-        let tokens = tokenize(input);
-        Parser { tokens, pos: 0, file }
+        let (tokens, error) = match tokenize(input) {
+            Ok(tokens) => (tokens, None),
+            Err(message) => (Vec::new(), Some(message)),
+        };
+        Parser { tokens, pos: 0, file, error }
     }
 
     pub fn parse_all(&mut self) -> Result<Vec<SourceExpr>, String> {
+        if let Some(message) = self.error.take() {
+            return Err(message);
+        }
         let mut exprs = Vec::new();
         while self.pos < self.tokens.len() {
+            self.skip_datum_comments()?;
+            if self.pos >= self.tokens.len() {
+                break;
+            }
             exprs.push(self.parse_expr()?);
         }
         Ok(exprs)
     }
 
+    // Skip any #; datum comments at the current position. Each discards the next
+    // complete form, so #;#;a b discards both a and b.
+    fn skip_datum_comments(&mut self) -> Result<(), String> {
+        while self.pos + 1 < self.tokens.len() && self.tokens[self.pos].text == "#" && self.tokens[self.pos + 1].text == ";" {
+            let comment = &self.tokens[self.pos];
+            let (line, column) = (comment.line, comment.column);
+            self.pos += 2; // consume '#' and ';'
+            if self.pos >= self.tokens.len() {
+                return Err(format!("Expected a form to comment out after #; at line {}, column {}", line, column));
+            }
+            self.parse_expr()?;
+        }
+        Ok(())
+    }
+
     fn parse_expr(&mut self) -> Result<SourceExpr, String> {
         if self.pos >= self.tokens.len() {
-            return Err("Unexpected end of input".to_string());
+            return Err(match self.tokens.last() {
+                Some(last) => format!("Unexpected end of input after '{}' at line {}, column {}", last.text, last.line, last.column),
+                None => "Unexpected end of input".to_string(),
+            });
         }
 
         let token = &self.tokens[self.pos];
@@ -42,7 +105,11 @@ impl Parser {
         if token.text == "(" {
             self.parse_list()
         } else if token.text == ")" {
-            Err("Unexpected closing parenthesis".to_string())
+            Err(format!("Unexpected closing parenthesis at line {}, column {}", token.line, token.column))
+        } else if token.text == "{" {
+            self.parse_map_literal()
+        } else if token.text == "}" {
+            Err(format!("Unexpected closing brace at line {}, column {}", token.line, token.column))
         } else if token.text == "'" {
             // Quote syntax: 'expr → (quote expr)
             self.pos += 1;
@@ -113,7 +180,8 @@ impl Parser {
                 self.pos += 1;
                 Ok(SourceExpr::new(LispExpr::Boolean(false), location))
             } else if dispatch_char == ";" {
-                // Comment out next expression: #;expr → (nothing)
+                // Comment out next expression: #;expr → (nothing). Lists and the top
+                // level skip these themselves; this is for one after a prefix like '
                 self.pos += 1; // consume ';'
 
                 // Parse and discard the next expression
@@ -121,13 +189,19 @@ impl Parser {
 
                 // Now parse and return the expression after the discarded one
                 self.parse_expr()
+            } else if let Some(name) = dispatch_char.strip_prefix('\\') {
+                // Character literal: #\a, #\space, #\x41
+                let c = parse_char_name(name)
+                    .ok_or_else(|| format!("Unknown character name: #\\{} at line {}, column {}", name, location.line, location.column))?;
+                self.pos += 1;
+                Ok(SourceExpr::new(LispExpr::Char(c), location))
             } else if dispatch_char == "'" {
                 // Function quote: #'symbol → symbol
                 // In our Lisp, function names are already first-class values
                 self.pos += 1; // consume '
                 self.parse_expr()
             } else {
-                Err(format!("Unknown reader macro: #{}", dispatch_char))
+                Err(format!("Unknown reader macro: #{} at line {}, column {}", dispatch_char, location.line, location.column))
             }
         } else if token.text == "true" {
             self.pos += 1;
@@ -143,6 +217,9 @@ impl Parser {
             // This is a temporary hack, there should be a String variant to LispExpr
             // for simplicity, just a special symbol so the compiler can recognise
             Ok(SourceExpr::new(LispExpr::Symbol(format!("__STRING__{}", string_content)), location))
+        } else if let Some(f) = parse_special_float(&token.text) {
+            self.pos += 1;
+            Ok(SourceExpr::new(LispExpr::Float(f), location))
         } else if token.text.contains('.') || token.text.contains('e') || token.text.contains('E') {
             // Try parsing as float (contains decimal point or scientific notation)
             if let Ok(f) = token.text.parse::<f64>() {
@@ -176,23 +253,36 @@ impl Parser {
         let mut items = Vec::new();
 
         while self.pos < self.tokens.len() {
+            self.skip_datum_comments()?;
+            if self.pos >= self.tokens.len() {
+                break;
+            }
             if self.tokens[self.pos].text == ")" {
                 self.pos += 1; // consume ')'
                 return Ok(SourceExpr::new(LispExpr::List(items), location));
             }
 
             items.push(self.parse_expr()?);
+            self.skip_datum_comments()?;
 
             // Check for dot syntax: (a b . rest)
             if self.pos < self.tokens.len() && self.tokens[self.pos].text == "." {
                 self.pos += 1; // consume '.'
 
                 // Parse the rest expression
+                self.skip_datum_comments()?;
+                if self.pos >= self.tokens.len() {
+                    break;
+                }
                 let rest = self.parse_expr()?;
+                self.skip_datum_comments()?;
 
                 // Expect closing paren
                 if self.pos >= self.tokens.len() || self.tokens[self.pos].text != ")" {
-                    return Err("Expected ')' after dotted pair".to_string());
+                    return Err(format!(
+                        "Expected ')' after dotted pair in the list at line {}, column {}",
+                        location.line, location.column
+                    ));
                 }
                 self.pos += 1; // consume ')'
 
@@ -203,23 +293,95 @@ impl Parser {
             }
         }
 
-        Err("Unclosed list - missing closing parenthesis".to_string())
+        Err(format!(
+            "Unclosed list starting at line {}, column {} - missing closing parenthesis",
+            location.line, location.column
+        ))
+    }
+
+    // Map literal: {k1 v1 k2 v2} → (make-map k1 v1 k2 v2)
+    fn parse_map_literal(&mut self) -> Result<SourceExpr, String> {
+        let start_token = &self.tokens[self.pos];
+        let location = Location::new(start_token.line, start_token.column, self.file.clone());
+
+        self.pos += 1; // consume '{'
+
+        let mut items = vec![SourceExpr::new(LispExpr::Symbol("make-map".to_string()), location.clone())];
+
+        while self.pos < self.tokens.len() {
+            self.skip_datum_comments()?;
+            if self.pos >= self.tokens.len() {
+                break;
+            }
+            if self.tokens[self.pos].text == "}" {
+                if items.len() % 2 == 0 {
+                    return Err(format!(
+                        "Map literal at line {}, column {} needs a value for every key",
+                        location.line, location.column
+                    ));
+                }
+                self.pos += 1; // consume '}'
+                return Ok(SourceExpr::new(LispExpr::List(items), location));
+            }
+            items.push(self.parse_expr()?);
+        }
+
+        Err(format!(
+            "Unclosed map literal starting at line {}, column {} - missing closing brace",
+            location.line, location.column
+        ))
     }
 }
 
-fn tokenize(input: &str) -> Vec<Token> {
+// Split source into tokens. Fails only on a string or #| block comment that never closes.
+fn tokenize(input: &str) -> Result<Vec<Token>, String> {
     let mut tokens = Vec::new();
     let mut current = String::new();
     let mut line = 1;
     let mut column = 1;
     let mut token_start_column = 1;
     let mut in_string = false;
+    let mut escape_next = false;
     let mut string_content = String::new();
     let mut string_start_line = 1;
     let mut string_start_column = 1;
     let mut in_comment = false;
-
-    for ch in input.chars() {
+    let mut block_comment_depth = 0; // #| |# comments nest
+    let mut block_comment_start = (1, 1);
+    let mut prev_char = None;
+    let mut char_literal_next = false;
+
+    for (index, ch) in input.char_indices() {
+        if block_comment_depth > 0 {
+            let closes = prev_char == Some('|') && ch == '#';
+            let opens = prev_char == Some('#') && ch == '|';
+            if closes {
+                block_comment_depth -= 1;
+            } else if opens {
+                block_comment_depth += 1;
+            }
+            if ch == '\n' {
+                line += 1;
+                column = 1;
+            } else {
+                column += 1;
+            }
+            token_start_column = column;
+            // The second character of |# or #| can't start another one, as in #|#
+            prev_char = if closes || opens { None } else { Some(ch) };
+            continue;
+        }
+        if ch == '|' && prev_char == Some('#') && !in_comment && !in_string && current.is_empty()
+            && tokens.last().map_or(false, |token: &Token| token.text == "#") {
+            // #| starts a block comment; the '#' was taken for a reader macro
+            let hash = tokens.pop().unwrap();
+            block_comment_start = (hash.line, hash.column);
+            block_comment_depth = 1;
+            column += 1;
+            token_start_column = column;
+            prev_char = None;
+            continue;
+        }
         if in_comment {
             // Skip everything until newline
             if ch == '\n' {
@@ -231,20 +393,37 @@ fn tokenize(input: &str) -> Vec<Token> {
                 column += 1;
             }
         } else if in_string {
-            if ch == '"' {
+            if escape_next {
+                let decoded = match ch {
+                    'n' => '\n',
+                    't' => '\t',
+                    'r' => '\r',
+                    '0' => '\0',
+                    other => other, // \" and \\ decode to themselves
+                };
+                string_content.push(decoded);
+                escape_next = false;
+                if ch == '\n' {
+                    line += 1;
+                    column = 1;
+                } else {
+                    column += 1;
+                }
+            } else if ch == '"' {
                 // End of string
                 tokens.push(Token {
                     text: format!("\"{}\"", string_content),
                     line: string_start_line,
                     column: string_start_column,
+                    end: index + 1,
                 });
                 string_content.clear();
                 in_string = false;
                 column += 1;
                 token_start_column = column;
             } else if ch == '\\' {
-                // Handle escape sequences (basic support)
-                string_content.push(ch);
+                // Escape sequence, decoded from the next character
+                escape_next = true;
                 column += 1;
             } else {
                 string_content.push(ch);
@@ -255,6 +434,22 @@ fn tokenize(input: &str) -> Vec<Token> {
                     column += 1;
                 }
             }
+        } else if char_literal_next {
+            // The character after #\ is part of the literal, even a delimiter
+            current.push(ch);
+            char_literal_next = false;
+            if ch == '\n' {
+                line += 1;
+                column = 1;
+            } else {
+                column += 1;
+            }
+        } else if ch == '\\' && prev_char == Some('#') && current.is_empty() {
+            // Start of a character literal; its name runs to the next delimiter
+            token_start_column = column;
+            current.push(ch);
+            char_literal_next = true;
+            column += 1;
         } else {
             match ch {
                 '"' => {
@@ -264,6 +459,7 @@ fn tokenize(input: &str) -> Vec<Token> {
                             text: current.clone(),
                             line,
                             column: token_start_column,
+                            end: index,
                         });
                         current.clear();
                     }
@@ -273,8 +469,8 @@ fn tokenize(input: &str) -> Vec<Token> {
                     column += 1;
                 }
                 ';' => {
-                    // Check if previous token was '#' - if so, this is part of #; reader macro
-                    let is_reader_macro = !tokens.is_empty() && tokens.last().unwrap().text == "#";
+                    // Right after '#', this is part of the #; reader macro
+                    let is_reader_macro = prev_char == Some('#') && tokens.last().map_or(false, |token| token.text == "#");
 
                     if is_reader_macro {
                         // Treat ';' as a special token (part of #; reader macro)
@@ -283,6 +479,7 @@ fn tokenize(input: &str) -> Vec<Token> {
                                 text: current.clone(),
                                 line,
                                 column: token_start_column,
+                                end: index,
                             });
                             current.clear();
                         }
@@ -290,6 +487,7 @@ fn tokenize(input: &str) -> Vec<Token> {
                             text: ";".to_string(),
                             line,
                             column,
+                            end: index + 1,
                         });
                         column += 1;
                         token_start_column = column;
@@ -300,6 +498,7 @@ fn tokenize(input: &str) -> Vec<Token> {
                                 text: current.clone(),
                                 line,
                                 column: token_start_column,
+                                end: index,
                             });
                             current.clear();
                         }
@@ -307,12 +506,13 @@ fn tokenize(input: &str) -> Vec<Token> {
                         column += 1;
                     }
                 }
-                '(' | ')' | '\'' | '`' | ',' | '@' | '#' => {
+                '(' | ')' | '{' | '}' | '\'' | '`' | ',' | '@' | '#' => {
                     if !current.is_empty() {
                         tokens.push(Token {
                             text: current.clone(),
                             line,
                             column: token_start_column,
+                            end: index,
                         });
                         current.clear();
                     }
@@ -320,6 +520,7 @@ fn tokenize(input: &str) -> Vec<Token> {
                         text: ch.to_string(),
                         line,
                         column,
+                        end: index + 1,
                     });
                     column += 1;
                     token_start_column = column;
@@ -330,6 +531,7 @@ fn tokenize(input: &str) -> Vec<Token> {
                             text: current.clone(),
                             line,
                             column: token_start_column,
+                            end: index,
                         });
                         current.clear();
                     }
@@ -343,6 +545,7 @@ fn tokenize(input: &str) -> Vec<Token> {
                             text: current.clone(),
                             line,
                             column: token_start_column,
+                            end: index,
                         });
                         current.clear();
                     }
@@ -358,6 +561,18 @@ fn tokenize(input: &str) -> Vec<Token> {
                 }
             }
         }
+        prev_char = Some(ch);
+    }
+
+    if block_comment_depth > 0 {
+        let (line, column) = block_comment_start;
+        return Err(format!("Unclosed block comment starting at line {}, column {} - missing |#", line, column));
+    }
+    if in_string {
+        return Err(format!(
+            "Unclosed string starting at line {}, column {} - missing closing quote",
+            string_start_line, string_start_column
+        ));
     }
 
     if !current.is_empty() {
@@ -365,10 +580,11 @@ fn tokenize(input: &str) -> Vec<Token> {
             text: current,
             line,
             column: token_start_column,
+            end: input.len(),
         });
     }
 
-    tokens
+    Ok(tokens)
 }
 
 #[cfg(test)]
@@ -527,6 +743,24 @@ mod tests {
         assert!(result.unwrap_err().contains("missing closing parenthesis"));
     }
 
+    #[test]
+    fn test_read_datum_stops_after_the_first_datum() {
+        let (datum, end) = read_datum("(a \"b c\") rest", "test").unwrap().unwrap();
+        assert_eq!(datum.to_source(), "(a \"b c\")");
+        assert_eq!(end, 9);
+        assert_eq!(read_datum("  ; nothing\n#;(skipped)", "test").unwrap(), None);
+    }
+
+    #[test]
+    fn test_read_datum_tells_partial_input_from_mistakes() {
+        for partial in ["(1 (2", "'", "\"abc", "#| open", "{a 1", "(a ."] {
+            assert!(read_datum(partial, "test").unwrap_err().incomplete, "{} is partial", partial);
+        }
+        for mistake in [")", "(a . b c)", "#z", "{a}"] {
+            assert!(!read_datum(mistake, "test").unwrap_err().incomplete, "{} is a mistake", mistake);
+        }
+    }
+
     #[test]
     fn test_parse_location_tracking() {
         let mut parser = Parser::new_with_file("42", "test.lisp".to_string());
@@ -765,4 +999,102 @@ mod tests {
             _ => panic!("Expected List"),
         }
     }
+
+    #[test]
+    fn test_parse_char_literals() {
+        let mut parser = Parser::new("(#\\a #\\space #\\) b)");
+        let exprs = parser.parse_all().unwrap();
+        match &exprs[0].expr {
+            LispExpr::List(items) => {
+                assert_eq!(items.len(), 4);
+                assert_eq!(items[0].expr, LispExpr::Char('a'));
+                assert_eq!(items[1].expr, LispExpr::Char(' '));
+                assert_eq!(items[2].expr, LispExpr::Char(')'));
+                assert_eq!(items[3].expr, LispExpr::Symbol("b".to_string()));
+                assert_eq!((items[1].location.line, items[1].location.column), (1, 6));
+            }
+            _ => panic!("Expected List"),
+        }
+    }
+
+    #[test]
+    fn test_parse_expression_comment_before_closing_paren() {
+        let mut parser = Parser::new("(a b #;c) (d . #;e f) {1 2 #;3}");
+        let exprs = parser.parse_all().unwrap();
+        assert_eq!(exprs.len(), 3);
+        assert_eq!(exprs[0].to_source(), "(a b)");
+        assert_eq!(exprs[1].to_source(), "(d . f)");
+        assert_eq!(exprs[2].to_source(), "(make-map 1 2)");
+    }
+
+    #[test]
+    fn test_parse_expression_comment_at_end_of_input() {
+        let mut parser = Parser::new("42 #;(defun unused () 1)");
+        let exprs = parser.parse_all().unwrap();
+        assert_eq!(exprs.len(), 1);
+        assert_eq!(exprs[0].expr, LispExpr::Number(42));
+
+        let err = Parser::new("(list 1 #;").parse_all().unwrap_err();
+        assert_eq!(err, "Expected a form to comment out after #; at line 1, column 9");
+    }
+
+    #[test]
+    fn test_parse_block_comments_nest() {
+        let mut parser = Parser::new("#| outer #| inner |# still outer |# (a #|x|# b) #||# c");
+        let exprs = parser.parse_all().unwrap();
+        assert_eq!(exprs.len(), 2);
+        assert_eq!(exprs[0].to_source(), "(a b)");
+        assert_eq!(exprs[1].expr, LispExpr::Symbol("c".to_string()));
+
+        let err = Parser::new("(a)\n#| #| |# never closed").parse_all().unwrap_err();
+        assert_eq!(err, "Unclosed block comment starting at line 2, column 1 - missing |#");
+    }
+
+    #[test]
+    fn test_parse_positions_after_block_comment() {
+        let mut parser = Parser::new("#| one\ntwo |# a\n  ; line\n  (b #|\n|# c)");
+        let exprs = parser.parse_all().unwrap();
+        assert_eq!((exprs[0].location.line, exprs[0].location.column), (2, 8));
+        assert_eq!((exprs[1].location.line, exprs[1].location.column), (4, 3));
+        match &exprs[1].expr {
+            LispExpr::List(items) => {
+                assert_eq!((items[1].location.line, items[1].location.column), (5, 4));
+            }
+            _ => panic!("Expected List"),
+        }
+    }
+
+    #[test]
+    fn test_parse_block_comment_markers_in_strings_and_chars() {
+        let mut parser = Parser::new(r##""#| text |#" #\| x"##);
+        let exprs = parser.parse_all().unwrap();
+        assert_eq!(exprs.len(), 3);
+        assert_eq!(exprs[0].expr, LispExpr::Symbol("__STRING__#| text |#".to_string()));
+        assert_eq!(exprs[1].expr, LispExpr::Char('|'));
+    }
+
+    #[test]
+    fn test_parse_string_escape_sequences() {
+        let mut parser = Parser::new(r#""a\nb\tc \"q\" \\ end""#);
+        let exprs = parser.parse_all().unwrap();
+        assert_eq!(exprs.len(), 1);
+        assert_eq!(
+            exprs[0].expr,
+            LispExpr::Symbol("__STRING__a\nb\tc \"q\" \\ end".to_string())
+        );
+    }
+
+    #[test]
+    fn test_parse_escaped_quote_does_not_end_string() {
+        let mut parser = Parser::new(r#"(f "say \"hi\"" 1)"#);
+        let exprs = parser.parse_all().unwrap();
+        match &exprs[0].expr {
+            LispExpr::List(items) => {
+                assert_eq!(items.len(), 3);
+                assert_eq!(items[1].expr, LispExpr::Symbol("__STRING__say \"hi\"".to_string()));
+                assert_eq!(items[2].expr, LispExpr::Number(1));
+            }
+            _ => panic!("Expected List"),
+        }
+    }
 }
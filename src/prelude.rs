@@ -0,0 +1,66 @@
+// The prelude: library functions written in Lisp (stdlib.lisp), embedded in the
+// binaries so every run has them, wherever it is started from
+//
+// The prelude is compiled into the same compiler as the program, before it, so
+// the program calls its functions like its own and can redefine them. Its
+// top-level forms run on the VM before the program's, so any globals it
+// defines are set when the program starts.
+//
+// A prelude that fails to parse, compile or run is reported as the prelude's
+// error, with its own positions (in <prelude>), never as the program's.
+
+use std::collections::HashMap;
+use std::rc::Rc;
+
+use crate::compiler::Compiler;
+use crate::parser::Parser;
+use crate::vm::instructions::Instruction;
+use crate::vm::VM;
+
+/// Source of the prelude, compiled into the binaries
+pub const PRELUDE_SOURCE: &str = include_str!("../stdlib.lisp");
+
+/// File name prelude positions are reported under
+pub const PRELUDE_FILE: &str = "<prelude>";
+
+/// Compile the prelude into `compiler`, ahead of the program. Returns the
+/// functions compiled so far and the prelude's top-level code, which must run
+/// (see `run`) before the program's. The compiler's main bytecode is left empty.
+pub fn compile(compiler: &mut Compiler) -> Result<(HashMap<String, Vec<Instruction>>, Vec<Instruction>), String> {
+    let exprs = Parser::new_with_file(PRELUDE_SOURCE, PRELUDE_FILE.to_string())
+        .parse_all()
+        .map_err(|msg| error(&format!("Parse error: {}", msg)))?;
+    let program = compiler.compile_program(&exprs)
+        .map_err(|compile_error| error(&compile_error.format(Some(PRELUDE_SOURCE))))?;
+    compiler.clear_main_bytecode();
+    Ok(program)
+}
+
+/// Run the prelude's top-level code. The VM needs its functions already, and
+/// is left ready for the program's main bytecode.
+pub fn run(vm: &mut VM, main: Vec<Instruction>) -> Result<(), String> {
+    let program = std::mem::replace(&mut vm.current_bytecode, Rc::new(main));
+    vm.instruction_pointer = 0;
+    vm.halted = false;
+    let result = vm.run();
+    vm.current_bytecode = program;
+    vm.instruction_pointer = 0;
+    vm.halted = false;
+    vm.value_stack.clear();
+    vm.call_stack.clear();
+    result.map_err(|runtime_error| error(&runtime_error.format()))
+}
+
+/// Compile the prelude and run it on `vm`, for a session that compiles
+/// everything it runs with `compiler`
+pub fn load(compiler: &mut Compiler, vm: &mut VM) -> Result<(), String> {
+    let (functions, main) = compile(compiler)?;
+    vm.functions.extend(functions);
+    vm.source_maps = compiler.source_maps();
+    run(vm, main)
+}
+
+/// A prelude failure, marked so it isn't mistaken for the program's own
+fn error(detail: &str) -> String {
+    format!("Error in the prelude (the built-in library loaded before your program; run with --no-prelude to skip it):\n{}", detail)
+}
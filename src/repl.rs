@@ -1,6 +1,7 @@
-use crate::{Compiler, VM, parser::Parser, disassembler, Value};
+use crate::{Compiler, VM, parser::Parser, disassembler, prelude, Value};
+use crate::vm::printer::{self, PrintOptions};
 use std::io::{self, Write};
-use std::sync::Arc;
+use std::rc::Rc;
 
 pub struct Repl {
     compiler: Compiler,
@@ -13,8 +14,10 @@ impl Repl {
         let mut compiler = Compiler::new();
         let mut vm = VM::new();
 
-        // Auto-load stdlib.lisp if it exists
-        Self::load_stdlib(&mut compiler, &mut vm);
+        // The session starts with the prelude's definitions
+        if let Err(e) = prelude::load(&mut compiler, &mut vm) {
+            eprintln!("{}", e);
+        }
 
         Repl {
             compiler,
@@ -23,36 +26,6 @@ impl Repl {
         }
     }
 
-    fn load_stdlib(compiler: &mut Compiler, vm: &mut VM) {
-        use std::fs;
-        use std::env;
-
-        let stdlib_paths = vec![
-            "stdlib.lisp".to_string(),
-            format!("{}/stdlib.lisp", env::current_dir().unwrap().display()),
-            format!("{}/../../stdlib.lisp", env::current_exe().unwrap().parent().unwrap().display()),
-        ];
-
-        for stdlib_path in stdlib_paths {
-            if let Ok(stdlib_source) = fs::read_to_string(&stdlib_path) {
-                let mut stdlib_parser = Parser::new_with_file(&stdlib_source, stdlib_path.clone());
-                if let Ok(stdlib_exprs) = stdlib_parser.parse_all() {
-                    // Compile stdlib
-                    if let Ok((stdlib_functions, stdlib_main)) = compiler.compile_program(&stdlib_exprs) {
-                        // Merge functions into VM
-                        vm.functions.extend(stdlib_functions);
-                        // Execute stdlib initialization code
-                        vm.current_bytecode = stdlib_main;
-                        vm.instruction_pointer = 0;
-                        vm.halted = false;
-                        let _ = vm.run(); // Ignore errors during stdlib loading
-                        break;
-                    }
-                }
-            }
-        }
-    }
-
     pub fn run(&mut self) {
         println!("Lisp REPL v0.1.0");
         println!("Type :help for commands, :quit to exit");
@@ -78,7 +51,7 @@ impl Repl {
                         continue;
                     }
 
-                    if self.input_buffer.is_empty() && trimmed.starts_with(':') {
+                    if self.input_buffer.is_empty() && (trimmed.starts_with(':') || trimmed.starts_with(',')) {
                         if !self.handle_command(trimmed) {
                             break;
                         }
@@ -90,6 +63,12 @@ impl Repl {
                     if self.is_complete_input() {
                         self.eval_and_print();
                         self.input_buffer.clear();
+                        if let Some(code) = self.vm.exit_code {
+                            // Drop the session's VM first, closing its output ports
+                            self.vm = VM::new();
+                            io::stdout().flush().unwrap();
+                            std::process::exit(code);
+                        }
                     }
                 }
                 Err(e) => {
@@ -105,122 +84,99 @@ impl Repl {
     pub fn is_complete_input(&self) -> bool {
         let mut depth = 0;
         let mut in_string = false;
+        let mut previous = ' ';
         let mut chars = self.input_buffer.chars().peekable();
 
         while let Some(ch) = chars.next() {
             match ch {
                 '"' => in_string = !in_string,
-                '(' if !in_string => depth += 1,
-                ')' if !in_string => depth -= 1,
+                '\\' if in_string => {
+                    chars.next(); // escaped character never closes the string
+                }
+                // A comment runs to the end of the line (#; comments out a datum instead)
+                ';' if !in_string && previous != '#' => {
+                    while chars.next_if(|&next| next != '\n').is_some() {}
+                }
+                '(' | '{' if !in_string => depth += 1,
+                ')' | '}' if !in_string => depth -= 1,
                 _ => {}
             }
+            previous = ch;
         }
 
         depth == 0 && !self.input_buffer.trim().is_empty()
     }
 
     fn eval_and_print(&mut self) {
-        let input = self.input_buffer.trim();
+        let input = self.input_buffer.trim().to_string();
+        match self.eval_input(&input) {
+            Ok(Some(result)) => println!("=> {}", self.format_value(&result)),
+            Ok(None) => {}
+            Err(message) => eprintln!("{}", message),
+        }
+    }
 
-        let mut parser = Parser::new(input);
-        let exprs = match parser.parse_all() {
-            Ok(exprs) => exprs,
-            Err(e) => {
-                eprintln!("Parse error: {}", e);
-                return;
-            }
-        };
+    /// Compile `source` against everything defined so far and run it on the
+    /// session's VM, returning the value it leaves. Errors come back formatted,
+    /// and leave the session usable.
+    pub fn eval_input(&mut self, source: &str) -> Result<Option<Value>, String> {
+        self.eval_source(source, Parser::new(source))
+    }
+
+    /// Run a file in the session, so its functions and globals stay defined
+    pub fn load_file(&mut self, path: &str) -> Result<(), String> {
+        let source = std::fs::read_to_string(path)
+            .map_err(|e| format!("Cannot read '{}': {}", path, e))?;
+        self.eval_source(&source, Parser::new_with_file(&source, path.to_string()))?;
+        Ok(())
+    }
+
+    fn eval_source(&mut self, source: &str, mut parser: Parser) -> Result<Option<Value>, String> {
+        let exprs = parser.parse_all().map_err(|e| format!("Parse error: {}", e))?;
 
         if exprs.is_empty() {
-            return;
+            return Ok(None);
         }
 
         // Create a fresh compiler with runtime context from the VM
-        // This allows the REPL to reference functions and globals from previous lines
+        // This allows the REPL to reference functions, globals, macros and structs from previous lines
         let mut fresh_compiler = Compiler::new();
         fresh_compiler.with_known_functions(self.vm.functions.keys());
         fresh_compiler.with_known_globals(self.vm.global_vars.keys());
+        fresh_compiler.with_definitions_from(&self.compiler);
+        // Macro expanders can call functions from earlier inputs
+        fresh_compiler.functions = (*self.vm.functions).clone();
+        // A function called here may be defined by a later input
+        fresh_compiler.set_check_unresolved(false);
 
-        let (new_functions, main_bytecode) = match fresh_compiler.compile_program(&exprs) {
-            Ok(result) => result,
-            Err(e) => {
-                let source_lines: Vec<&str> = input.lines().collect();
-                let source_line = if e.location.line > 0 && e.location.line <= source_lines.len() {
-                    Some(source_lines[e.location.line - 1])
-                } else {
-                    None
-                };
-                eprintln!("{}", e.format(source_line));
-                return;
-            }
-        };
+        let (new_functions, main_bytecode) = fresh_compiler.compile_program(&exprs)
+            .map_err(|e| e.format(Some(fresh_compiler.source_for(&e, source))))?;
 
+        // Calls go through the function table by name, so a redefinition is seen
+        // by every caller, including functions defined earlier
         for (name, bytecode) in new_functions {
             self.vm.functions.insert(name, bytecode);
         }
+        let source_maps = fresh_compiler.source_maps();
+        self.vm.source_maps.functions.extend(source_maps.functions);
+        self.vm.source_maps.main = source_maps.main;
+        // Keep its macros and struct types for later inputs
+        self.compiler = fresh_compiler;
 
-        self.vm.current_bytecode = main_bytecode;
+        self.vm.current_bytecode = Rc::new(main_bytecode);
         self.vm.value_stack.clear();
         self.vm.call_stack.clear();
+        self.vm.handlers.clear();
         self.vm.instruction_pointer = 0;
         self.vm.halted = false;
 
-        match self.vm.run() {
-            Ok(_) => {
-                if let Some(result) = self.vm.value_stack.last() {
-                    println!("=> {}", self.format_value(result));
-                }
-            }
-            Err(runtime_error) => {
-                eprintln!("{}", runtime_error.format());
-            }
-        }
+        self.vm.run().map_err(|e| e.format())?;
+        Ok(self.vm.value_stack.last().cloned())
     }
 
     pub fn format_value(&self, value: &Value) -> String {
-        match value {
-            Value::Integer(n) => n.to_string(),
-            Value::Float(f) => {
-                // Format float nicely - show decimal point even for whole numbers
-                if f.fract() == 0.0 && f.is_finite() {
-                    format!("{}.0", f)
-                } else {
-                    f.to_string()
-                }
-            }
-            Value::Boolean(b) => b.to_string(),
-            Value::List(items) => {
-                let formatted_items: Vec<String> = items
-                    .iter()
-                    .map(|v| self.format_value(v))
-                    .collect();
-                format!("({})", formatted_items.join(" "))
-            }
-            Value::Symbol(s) => s.to_string(),
-            Value::String(s) => format!("\"{}\"", s),
-            Value::Function(name) => format!("<function {}>", name),
-            Value::Closure(closure_data) => {
-                format!("<closure ({})>", closure_data.params.join(" "))
-            }
-            Value::HashMap(map) => {
-                let mut items: Vec<String> = map.iter()
-                    .map(|(k, v)| format!("{} {}", self.format_value(&Value::String(Arc::new(k.clone()))), self.format_value(v)))
-                    .collect();
-                items.sort(); // Sort for consistent output
-                format!("{{{}}}", items.join(" "))
-            }
-            Value::Vector(items) => {
-                let formatted_items: Vec<String> = items
-                    .iter()
-                    .map(|v| self.format_value(v))
-                    .collect();
-                format!("[{}]", formatted_items.join(" "))
-            }
-            Value::TcpListener(_) => "<tcp-listener>".to_string(),
-            Value::TcpStream(_) => "<tcp-stream>".to_string(),
-            Value::SharedTcpListener(_) => "<shared-tcp-listener>".to_string(),
-            Value::Pointer(p) => format!("<pointer 0x{:x}>", p),
-        }
+        let options = PrintOptions { closure_params: true, ..PrintOptions::write() };
+        printer::print_value(value, &options)
     }
 
     fn handle_command(&mut self, cmd: &str) -> bool {
@@ -229,10 +185,21 @@ impl Repl {
             return true;
         }
 
-        match parts[0] {
+        // Commands can start with ':' or ','
+        let command = format!(":{}", &parts[0][1..]);
+        match command.as_str() {
             ":quit" | ":exit" | ":q" => {
                 return false;
             }
+            ":load" | ":l" => {
+                if parts.len() != 2 {
+                    eprintln!("Usage: :load <file>");
+                } else if let Err(message) = self.load_file(parts[1]) {
+                    eprintln!("{}", message);
+                } else {
+                    println!("Loaded {}", parts[1]);
+                }
+            }
             ":help" | ":h" => {
                 self.print_help();
             }
@@ -263,9 +230,11 @@ impl Repl {
         println!("Available commands:");
         println!("  :help, :h           - Show this help message");
         println!("  :quit, :exit, :q    - Exit the REPL");
+        println!("  :load <file>, :l    - Run a file, keeping its definitions");
         println!("  :functions, :f      - List all defined functions");
         println!("  :clear, :c          - Clear all state (reset VM and compiler)");
         println!("  :bytecode <expr>    - Show bytecode for an expression");
+        println!("Commands can also start with ',' (,quit, ,load <file>)");
         println!();
         println!("Examples:");
         println!("  (+ 2 3)");
@@ -305,20 +274,16 @@ impl Repl {
         };
 
         let mut temp_compiler = Compiler::new();
-        for (name, bytecode) in &self.vm.functions {
+        temp_compiler.set_check_unresolved(false);
+        temp_compiler.with_definitions_from(&self.compiler);
+        for (name, bytecode) in self.vm.functions.iter() {
             temp_compiler.functions.insert(name.clone(), bytecode.clone());
         }
 
         let (functions, main) = match temp_compiler.compile_program(&exprs) {
             Ok(result) => result,
             Err(e) => {
-                let source_lines: Vec<&str> = expr.lines().collect();
-                let source_line = if e.location.line > 0 && e.location.line <= source_lines.len() {
-                    Some(source_lines[e.location.line - 1])
-                } else {
-                    None
-                };
-                eprintln!("{}", e.format(source_line));
+                eprintln!("{}", e.format(Some(temp_compiler.source_for(&e, expr))));
                 return;
             }
         };
@@ -0,0 +1,72 @@
+// Test runner for deftest: `lisp-vm --test file.lisp`
+//
+// The program's top-level forms run first, so tests see its definitions. Each
+// test then runs on its own, starting from an empty stack, and an error in one
+// (a failed assertion or any other) is recorded as its failure without stopping
+// the rest.
+
+use std::rc::Rc;
+
+use crate::compiler::Compiler;
+use crate::vm::errors::RuntimeError;
+use crate::vm::instructions::Instruction;
+use crate::vm::VM;
+
+/// Outcome of one deftest
+pub struct TestResult {
+    pub name: String,
+    pub error: Option<RuntimeError>, // Why the test failed; None when it passed
+}
+
+/// Outcomes of every deftest, in the order they were defined
+pub struct TestReport {
+    pub results: Vec<TestResult>,
+}
+
+impl TestReport {
+    pub fn passed(&self) -> usize {
+        self.results.iter().filter(|result| result.error.is_none()).count()
+    }
+
+    pub fn failed(&self) -> usize {
+        self.results.len() - self.passed()
+    }
+
+    /// A line per test, the error of each failed test in the boxed diagnostic
+    /// format, and the counts
+    pub fn format(&self) -> String {
+        let mut output = String::new();
+        for result in &self.results {
+            let status = if result.error.is_none() { "PASS" } else { "FAIL" };
+            output.push_str(&format!("{} {}\n", status, result.name));
+        }
+        for result in &self.results {
+            if let Some(error) = &result.error {
+                output.push_str(&error.format_titled(&format!("Test Failed: {}", result.name)));
+            }
+        }
+        output.push_str(&format!("\n{} passed, {} failed\n", self.passed(), self.failed()));
+        output
+    }
+}
+
+/// Run each of `tests` (deftest names) on a VM that has run the program
+pub fn run_tests(vm: &mut VM, tests: &[&str]) -> TestReport {
+    let results = tests.iter()
+        .map(|name| TestResult {
+            name: name.to_string(),
+            error: run_test(vm, name).err(),
+        })
+        .collect();
+    TestReport { results }
+}
+
+fn run_test(vm: &mut VM, name: &str) -> Result<(), RuntimeError> {
+    vm.current_bytecode = Rc::new(vec![Instruction::Call(Compiler::test_function(name), 0), Instruction::Halt]);
+    vm.value_stack.clear();
+    vm.call_stack.clear();
+    vm.handlers.clear();
+    vm.instruction_pointer = 0;
+    vm.halted = false;
+    vm.run()
+}
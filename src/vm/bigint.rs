@@ -0,0 +1,374 @@
+// Arbitrary-precision integers
+// Only produced when fixnum arithmetic overflows; Value::from_bigint demotes
+// results that fit back into an i64, so small integers stay on the fast path
+
+use std::cmp::Ordering;
+use std::fmt;
+
+/// Sign-magnitude integer with base 2^32 limbs, least significant first.
+/// The magnitude never has trailing zero limbs, and zero is never negative,
+/// so the derived equality compares values.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct BigInt {
+    negative: bool,
+    limbs: Vec<u32>,
+}
+
+impl BigInt {
+    pub fn zero() -> Self {
+        BigInt { negative: false, limbs: Vec::new() }
+    }
+
+    pub fn from_i64(n: i64) -> Self {
+        let mut magnitude = n.unsigned_abs();
+        let mut limbs = Vec::new();
+        while magnitude > 0 {
+            limbs.push(magnitude as u32);
+            magnitude >>= 32;
+        }
+        BigInt { negative: n < 0, limbs }
+    }
+
+    /// The integer part of a float, truncated toward zero; None for NaN and
+    /// the infinities
+    pub fn from_f64(f: f64) -> Option<Self> {
+        if !f.is_finite() {
+            return None;
+        }
+        // f is mantissa * 2^exponent, with the mantissa read off the bits
+        let bits = f.to_bits();
+        let biased = ((bits >> 52) & 0x7ff) as i64;
+        let fraction = bits & ((1u64 << 52) - 1);
+        let (mantissa, exponent) = if biased == 0 {
+            (fraction, -1074)
+        } else {
+            (fraction | (1u64 << 52), biased - 1075)
+        };
+        let magnitude = if exponent >= 0 {
+            BigInt::from_i64(mantissa as i64).shift_left(exponent as usize)
+        } else if exponent > -64 {
+            BigInt::from_i64((mantissa >> -exponent) as i64)
+        } else {
+            BigInt::zero()
+        };
+        Some(if f < 0.0 { magnitude.neg() } else { magnitude })
+    }
+
+    /// Build from raw parts, restoring the canonical form
+    pub fn from_parts(negative: bool, mut limbs: Vec<u32>) -> Self {
+        while limbs.last() == Some(&0) {
+            limbs.pop();
+        }
+        let negative = negative && !limbs.is_empty();
+        BigInt { negative, limbs }
+    }
+
+    pub fn is_zero(&self) -> bool {
+        self.limbs.is_empty()
+    }
+
+    pub fn is_negative(&self) -> bool {
+        self.negative
+    }
+
+    pub fn limbs(&self) -> &[u32] {
+        &self.limbs
+    }
+
+    /// Convert back to a fixnum if the value fits
+    pub fn to_i64(&self) -> Option<i64> {
+        if self.limbs.len() > 2 {
+            return None;
+        }
+        let magnitude = self.limbs.iter().rev().fold(0u64, |acc, &limb| (acc << 32) | limb as u64);
+        if self.negative {
+            if magnitude <= i64::MAX as u64 + 1 {
+                Some((magnitude as i64).wrapping_neg())
+            } else {
+                None
+            }
+        } else {
+            i64::try_from(magnitude).ok()
+        }
+    }
+
+    pub fn to_f64(&self) -> f64 {
+        let magnitude = self.limbs.iter().rev().fold(0.0, |acc, &limb| acc * 4294967296.0 + limb as f64);
+        if self.negative { -magnitude } else { magnitude }
+    }
+
+    pub fn neg(&self) -> BigInt {
+        BigInt::from_parts(!self.negative, self.limbs.clone())
+    }
+
+    pub fn add(&self, other: &BigInt) -> BigInt {
+        if self.negative == other.negative {
+            return BigInt::from_parts(self.negative, add_magnitudes(&self.limbs, &other.limbs));
+        }
+        match cmp_magnitudes(&self.limbs, &other.limbs) {
+            Ordering::Equal => BigInt::zero(),
+            Ordering::Greater => BigInt::from_parts(self.negative, sub_magnitudes(&self.limbs, &other.limbs)),
+            Ordering::Less => BigInt::from_parts(other.negative, sub_magnitudes(&other.limbs, &self.limbs)),
+        }
+    }
+
+    pub fn sub(&self, other: &BigInt) -> BigInt {
+        self.add(&other.neg())
+    }
+
+    pub fn mul(&self, other: &BigInt) -> BigInt {
+        if self.is_zero() || other.is_zero() {
+            return BigInt::zero();
+        }
+        let mut result = vec![0u32; self.limbs.len() + other.limbs.len()];
+        for (i, &a) in self.limbs.iter().enumerate() {
+            let mut carry = 0u64;
+            for (j, &b) in other.limbs.iter().enumerate() {
+                let t = result[i + j] as u64 + a as u64 * b as u64 + carry;
+                result[i + j] = t as u32;
+                carry = t >> 32;
+            }
+            result[i + other.limbs.len()] = carry as u32;
+        }
+        BigInt::from_parts(self.negative != other.negative, result)
+    }
+
+    /// Truncating division, matching i64 semantics: the quotient rounds toward
+    /// zero and the remainder takes the sign of the dividend.
+    /// Returns None when dividing by zero.
+    pub fn div_rem(&self, other: &BigInt) -> Option<(BigInt, BigInt)> {
+        if other.is_zero() {
+            return None;
+        }
+        let mut quotient = vec![0u32; self.limbs.len()];
+        let mut remainder: Vec<u32> = Vec::new();
+        for bit in (0..self.limbs.len() * 32).rev() {
+            shift_left_one(&mut remainder);
+            if (self.limbs[bit / 32] >> (bit % 32)) & 1 == 1 {
+                if remainder.is_empty() {
+                    remainder.push(1);
+                } else {
+                    remainder[0] |= 1;
+                }
+            }
+            if cmp_magnitudes(&remainder, &other.limbs) != Ordering::Less {
+                remainder = sub_magnitudes(&remainder, &other.limbs);
+                quotient[bit / 32] |= 1 << (bit % 32);
+            }
+        }
+        Some((
+            BigInt::from_parts(self.negative != other.negative, quotient),
+            BigInt::from_parts(self.negative, remainder),
+        ))
+    }
+
+    /// Combine two integers bit by bit, as if both were written in two's
+    /// complement with as many bits as that takes: bit-and, bit-or and bit-xor
+    pub fn bitwise(&self, other: &BigInt, op: fn(u32, u32) -> u32) -> BigInt {
+        // A limb more than either needs holds the sign bit
+        let width = self.limbs.len().max(other.limbs.len()) + 1;
+        let (a, b) = (self.twos_complement(width), other.twos_complement(width));
+        let limbs = a.iter().zip(&b).map(|(&x, &y)| op(x, y)).collect();
+        BigInt::from_twos_complement(limbs)
+    }
+
+    /// Multiply by 2^n
+    pub fn shift_left(&self, n: usize) -> BigInt {
+        let mut limbs = vec![0u32; n / 32];
+        let bits = n % 32;
+        let mut carry = 0u32;
+        for &limb in &self.limbs {
+            if bits == 0 {
+                limbs.push(limb);
+            } else {
+                limbs.push((limb << bits) | carry);
+                carry = limb >> (32 - bits);
+            }
+        }
+        limbs.push(carry);
+        BigInt::from_parts(self.negative, limbs)
+    }
+
+    /// Divide by 2^n rounding toward negative infinity, the arithmetic shift
+    /// two's complement gives: -5 shifted right by 1 is -3
+    pub fn shift_right(&self, n: usize) -> BigInt {
+        if !self.negative {
+            return BigInt::from_parts(false, shift_right_magnitude(&self.limbs, n));
+        }
+        // -m >> n is -(((m - 1) >> n) + 1)
+        let below = shift_right_magnitude(&sub_magnitudes(&self.limbs, &[1]), n);
+        BigInt::from_parts(true, add_magnitudes(&below, &[1]))
+    }
+
+    fn twos_complement(&self, width: usize) -> Vec<u32> {
+        let mut limbs = self.limbs.clone();
+        limbs.resize(width, 0);
+        if self.negative {
+            for limb in limbs.iter_mut() {
+                *limb = !*limb;
+            }
+            increment(&mut limbs);
+        }
+        limbs
+    }
+
+    fn from_twos_complement(mut limbs: Vec<u32>) -> BigInt {
+        let negative = limbs.last().is_some_and(|&top| top >> 31 == 1);
+        if negative {
+            for limb in limbs.iter_mut() {
+                *limb = !*limb;
+            }
+            increment(&mut limbs);
+        }
+        BigInt::from_parts(negative, limbs)
+    }
+
+    /// Digits in radix 2 to 36, with lowercase letters past 9
+    pub fn to_string_radix(&self, radix: u32) -> String {
+        if self.is_zero() {
+            return "0".to_string();
+        }
+
+        // Peel off chunks of as many digits as fit in a limb, least significant first
+        let mut chunk_digits = 1;
+        let mut chunk_base = radix as u64;
+        while chunk_base * (radix as u64) <= u32::MAX as u64 {
+            chunk_base *= radix as u64;
+            chunk_digits += 1;
+        }
+        let mut chunks = Vec::new();
+        let mut magnitude = self.limbs.clone();
+        while !magnitude.is_empty() {
+            let mut rem = 0u64;
+            for limb in magnitude.iter_mut().rev() {
+                let t = (rem << 32) | *limb as u64;
+                *limb = (t / chunk_base) as u32;
+                rem = t % chunk_base;
+            }
+            while magnitude.last() == Some(&0) {
+                magnitude.pop();
+            }
+            chunks.push(rem);
+        }
+
+        let mut digits = String::new();
+        for (i, chunk) in chunks.iter().rev().enumerate() {
+            let mut chunk_text = Vec::new();
+            let mut rest = *chunk;
+            while rest > 0 {
+                chunk_text.push(std::char::from_digit((rest % radix as u64) as u32, radix).expect("digit below radix"));
+                rest /= radix as u64;
+            }
+            // Every chunk after the most significant keeps its leading zeros
+            if i > 0 {
+                chunk_text.resize(chunk_digits, '0');
+            }
+            digits.extend(chunk_text.iter().rev());
+        }
+        if self.negative {
+            format!("-{}", digits)
+        } else {
+            digits
+        }
+    }
+}
+
+impl Ord for BigInt {
+    fn cmp(&self, other: &Self) -> Ordering {
+        match (self.negative, other.negative) {
+            (false, true) => Ordering::Greater,
+            (true, false) => Ordering::Less,
+            (false, false) => cmp_magnitudes(&self.limbs, &other.limbs),
+            (true, true) => cmp_magnitudes(&other.limbs, &self.limbs),
+        }
+    }
+}
+
+impl PartialOrd for BigInt {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl fmt::Display for BigInt {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "{}", self.to_string_radix(10))
+    }
+}
+
+fn cmp_magnitudes(a: &[u32], b: &[u32]) -> Ordering {
+    a.len().cmp(&b.len()).then_with(|| a.iter().rev().cmp(b.iter().rev()))
+}
+
+fn add_magnitudes(a: &[u32], b: &[u32]) -> Vec<u32> {
+    let (long, short) = if a.len() >= b.len() { (a, b) } else { (b, a) };
+    let mut result = Vec::with_capacity(long.len() + 1);
+    let mut carry = 0u64;
+    for (i, &limb) in long.iter().enumerate() {
+        let t = limb as u64 + short.get(i).copied().unwrap_or(0) as u64 + carry;
+        result.push(t as u32);
+        carry = t >> 32;
+    }
+    if carry > 0 {
+        result.push(carry as u32);
+    }
+    result
+}
+
+/// Subtract magnitudes, requires a >= b
+fn sub_magnitudes(a: &[u32], b: &[u32]) -> Vec<u32> {
+    let mut result = Vec::with_capacity(a.len());
+    let mut borrow = 0i64;
+    for (i, &limb) in a.iter().enumerate() {
+        let mut t = limb as i64 - b.get(i).copied().unwrap_or(0) as i64 - borrow;
+        if t < 0 {
+            t += 1 << 32;
+            borrow = 1;
+        } else {
+            borrow = 0;
+        }
+        result.push(t as u32);
+    }
+    while result.last() == Some(&0) {
+        result.pop();
+    }
+    result
+}
+
+fn shift_left_one(limbs: &mut Vec<u32>) {
+    let mut carry = 0u32;
+    for limb in limbs.iter_mut() {
+        let next = *limb >> 31;
+        *limb = (*limb << 1) | carry;
+        carry = next;
+    }
+    if carry > 0 {
+        limbs.push(carry);
+    }
+}
+
+fn shift_right_magnitude(limbs: &[u32], n: usize) -> Vec<u32> {
+    let skipped = n / 32;
+    let bits = n % 32;
+    if skipped >= limbs.len() {
+        return Vec::new();
+    }
+    let kept = &limbs[skipped..];
+    kept.iter().enumerate()
+        .map(|(i, &limb)| {
+            let high = kept.get(i + 1).copied().unwrap_or(0);
+            if bits == 0 { limb } else { (limb >> bits) | (high << (32 - bits)) }
+        })
+        .collect()
+}
+
+/// Add one in place, dropping a carry out of the top limb
+fn increment(limbs: &mut [u32]) {
+    for limb in limbs.iter_mut() {
+        let (sum, overflowed) = limb.overflowing_add(1);
+        *limb = sum;
+        if !overflowed {
+            break;
+        }
+    }
+}
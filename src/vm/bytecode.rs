@@ -4,7 +4,10 @@ use std::io::{Read, Write};
 use std::sync::Arc;
 
 use super::instructions::{Instruction, FfiType};
-use super::value::{Value, List, ClosureData};
+use super::value::{Value, List, ClosureData, MapKey};
+use super::bigint::BigInt;
+use super::errors::Location;
+use super::source_map::{SourceMap, SourceMaps};
 
 // FFI type serialization helpers
 fn ffi_type_to_byte(ffi_type: &FfiType) -> u8 {
@@ -46,17 +49,61 @@ fn byte_to_ffi_type(byte: u8) -> Result<FfiType, String> {
 
 // Bytecode file format serialization
 
+/// Magic number at the start of every bytecode file: "LISP" in ASCII
+pub const BYTECODE_MAGIC: &[u8; 4] = b"LISP";
+
+/// Format version, bumped whenever the encoding of instructions or values changes.
+/// 8: letrec cells, closure tail calls, float division, multiple values and make-vector (opcodes 133-143)
+/// 9: hash map keys may be integers, strings or symbols; map builtins (opcodes 144-146)
+/// 10: set! on parameters (opcode 147)
+/// 11: handler-case and raise (opcodes 148, 149 and 170)
+/// 12: apply with leading arguments and in tail position (opcodes 171-172)
+/// 13: time (opcodes 173-174)
+/// 14: catch and throw (opcodes 175-176)
+/// 15: gc (opcode 177)
+/// 16: defstruct (opcodes 178-180)
+/// 17: match (opcode 181)
+/// 18: case jump tables (opcode 182)
+/// 19: eq? (opcode 183)
+/// 20: map, filter and reduce builtins (opcodes 184-185)
+/// 21: number->string and string->number with a radix (opcodes 186-187)
+/// 22: vector-set! stores in place (opcode 188)
+/// 23: line input, append-file and file ports (opcodes 189-195)
+/// 24: quotient, remainder and modulo (opcodes 196-198)
+/// 25: raw TCP sockets (opcodes 199-203)
+/// 26: value-returning and/or jumps (opcodes 204-205)
+/// 27: assert and assert-equal (opcodes 206-207)
+/// 28: char values and char builtins (opcodes 208-211)
+/// 29: char ordering and classes; string->list yields chars (opcodes 212-215)
+/// 30: fused argument and local adds from the peephole pass (opcodes 216-217)
+/// 31: recur compiles to SetLocal and Jmp; BeginLoop and Recur (opcodes 112-113) are gone
+/// 32: checked and wrapping integer arithmetic (opcodes 218-223)
+/// 33: nth (opcode 224)
+/// 34: current-time-millis and gc-stats (opcodes 225-226); TimeStart also records allocations
+/// 35: promises for delay and force (opcodes 227-230)
+/// 36: = only compares numbers, eqv? and a cycle-safe equal? (opcodes 231-233)
+/// 37: getenv and exit (opcodes 234-235)
+/// 38: keyword arguments for &key functions (opcodes 236-238)
+/// 39: write and display (opcodes 239-242); strings are written with escapes
+/// 40: member, memq, assoc, assq and sort (opcodes 243-247)
+/// 41: read and read-from-string (opcodes 248-249)
+/// 42: trace and untrace (opcodes 250-253)
+/// 43: bitwise operators (opcodes 255 0-5); opcode 255 starts a two-byte opcode
+/// 44: gensym with a prefix (opcode 255 6)
+/// 45: pp (opcode 255 7)
+/// 46: cooperative tasks and channels (opcodes 255 8-16)
+/// 47: map-set! and map-remove! change the map in place (opcode 255 17)
+/// 48: a defun with no matching clause raises an error (opcode 255 18)
+pub const BYTECODE_VERSION: u8 = 48;
+
 pub fn serialize_bytecode(
     functions: &HashMap<String, Vec<Instruction>>,
     main_bytecode: &[Instruction],
 ) -> Vec<u8> {
     let mut bytes = Vec::new();
 
-    // Magic number: "LISP" in ASCII
-    bytes.extend_from_slice(b"LISP");
-
-    // Version: 7 (added HashMap and Vector support)
-    bytes.push(7);
+    bytes.extend_from_slice(BYTECODE_MAGIC);
+    bytes.push(BYTECODE_VERSION);
 
     // Serialize functions
     write_u32(&mut bytes, functions.len() as u32);
@@ -71,19 +118,53 @@ pub fn serialize_bytecode(
     bytes
 }
 
+/// Serialize bytecode followed by an optional source map section.
+/// Readers that ignore the section still load the file unchanged.
+pub fn serialize_bytecode_with_source_maps(
+    functions: &HashMap<String, Vec<Instruction>>,
+    main_bytecode: &[Instruction],
+    source_maps: &SourceMaps,
+) -> Vec<u8> {
+    let mut bytes = serialize_bytecode(functions, main_bytecode);
+
+    // Only keep maps for functions that are actually in the file
+    let function_maps: Vec<(&String, &SourceMap)> = source_maps.functions.iter()
+        .filter(|(name, map)| functions.contains_key(*name) && !map.is_empty())
+        .collect();
+
+    write_source_map(&mut bytes, &source_maps.main);
+    write_u32(&mut bytes, function_maps.len() as u32);
+    for (name, map) in function_maps {
+        write_string(&mut bytes, name);
+        write_source_map(&mut bytes, map);
+    }
+
+    bytes
+}
+
 pub fn deserialize_bytecode(bytes: &[u8]) -> Result<(HashMap<String, Vec<Instruction>>, Vec<Instruction>), String> {
+    let (functions, main_bytecode, _) = read_program(bytes)?;
+    Ok((functions, main_bytecode))
+}
+
+// Read the functions and main bytecode, also returning where they end in the file
+fn read_program(bytes: &[u8]) -> Result<(HashMap<String, Vec<Instruction>>, Vec<Instruction>, usize), String> {
     let mut pos = 0;
 
     // Check magic number
-    if bytes.len() < 5 || &bytes[0..4] != b"LISP" {
+    if bytes.len() < 4 || &bytes[0..4] != BYTECODE_MAGIC {
         return Err("Invalid bytecode file: bad magic number".to_string());
     }
     pos += 4;
 
-    // Check version
-    let version = bytes[pos];
-    if version != 7 {
-        return Err(format!("Unsupported bytecode version: {} (expected 7)", version));
+    // Check version: instructions from another version may decode to the wrong
+    // operations, so refuse the file rather than guess
+    let version = *bytes.get(pos).ok_or_else(|| "Invalid bytecode file: missing version".to_string())?;
+    if version != BYTECODE_VERSION {
+        return Err(format!(
+            "Unsupported bytecode version: {} (expected {}); recompile the source with bytecomp or lisp-vm compile",
+            version, BYTECODE_VERSION
+        ));
     }
     pos += 1;
 
@@ -100,7 +181,28 @@ pub fn deserialize_bytecode(bytes: &[u8]) -> Result<(HashMap<String, Vec<Instruc
     // Deserialize main bytecode
     let main_bytecode = read_bytecode(bytes, &mut pos)?;
 
-    Ok((functions, main_bytecode))
+    Ok((functions, main_bytecode, pos))
+}
+
+/// Deserialize bytecode along with its source map section, if present
+pub fn deserialize_bytecode_with_source_maps(
+    bytes: &[u8],
+) -> Result<(HashMap<String, Vec<Instruction>>, Vec<Instruction>, SourceMaps), String> {
+    let (functions, main_bytecode, mut pos) = read_program(bytes)?;
+
+    // The source map section is optional and follows the main bytecode
+    let mut source_maps = SourceMaps::new();
+    if pos < bytes.len() {
+        source_maps.main = read_source_map(bytes, &mut pos)?;
+        let map_count = read_u32(bytes, &mut pos)?;
+        for _ in 0..map_count {
+            let name = read_string(bytes, &mut pos)?;
+            let map = read_source_map(bytes, &mut pos)?;
+            source_maps.functions.insert(name, map);
+        }
+    }
+
+    Ok((functions, main_bytecode, source_maps))
 }
 
 pub fn save_bytecode_file(
@@ -114,6 +216,18 @@ pub fn save_bytecode_file(
     Ok(())
 }
 
+pub fn save_bytecode_file_with_source_maps(
+    path: &str,
+    functions: &HashMap<String, Vec<Instruction>>,
+    main_bytecode: &[Instruction],
+    source_maps: &SourceMaps,
+) -> Result<(), String> {
+    let bytes = serialize_bytecode_with_source_maps(functions, main_bytecode, source_maps);
+    let mut file = File::create(path).map_err(|e| format!("Failed to create file: {}", e))?;
+    file.write_all(&bytes).map_err(|e| format!("Failed to write file: {}", e))?;
+    Ok(())
+}
+
 pub fn load_bytecode_file(path: &str) -> Result<(HashMap<String, Vec<Instruction>>, Vec<Instruction>), String> {
     let mut file = File::open(path).map_err(|e| format!("Failed to open file: {}", e))?;
     let mut bytes = Vec::new();
@@ -121,6 +235,15 @@ pub fn load_bytecode_file(path: &str) -> Result<(HashMap<String, Vec<Instruction
     deserialize_bytecode(&bytes)
 }
 
+pub fn load_bytecode_file_with_source_maps(
+    path: &str,
+) -> Result<(HashMap<String, Vec<Instruction>>, Vec<Instruction>, SourceMaps), String> {
+    let mut file = File::open(path).map_err(|e| format!("Failed to open file: {}", e))?;
+    let mut bytes = Vec::new();
+    file.read_to_end(&mut bytes).map_err(|e| format!("Failed to read file: {}", e))?;
+    deserialize_bytecode_with_source_maps(&bytes)
+}
+
 // Helper functions for serialization
 
 fn write_u32(bytes: &mut Vec<u8>, value: u32) {
@@ -152,6 +275,51 @@ fn read_string(bytes: &[u8], pos: &mut usize) -> Result<String, String> {
     Ok(s)
 }
 
+// Source maps are written with a file name table, since nearly every
+// entry in a map shares the same file
+fn write_source_map(bytes: &mut Vec<u8>, map: &SourceMap) {
+    let mut files: Vec<&str> = Vec::new();
+    for (_, location) in map.entries() {
+        if !files.contains(&location.file.as_str()) {
+            files.push(&location.file);
+        }
+    }
+    write_u32(bytes, files.len() as u32);
+    for file in &files {
+        write_string(bytes, file);
+    }
+
+    write_u32(bytes, map.entries().len() as u32);
+    for (offset, location) in map.entries() {
+        let file_index = files.iter().position(|f| *f == location.file).unwrap_or(0);
+        write_u32(bytes, *offset as u32);
+        write_u32(bytes, location.line as u32);
+        write_u32(bytes, location.column as u32);
+        write_u32(bytes, file_index as u32);
+    }
+}
+
+fn read_source_map(bytes: &[u8], pos: &mut usize) -> Result<SourceMap, String> {
+    let file_count = read_u32(bytes, pos)? as usize;
+    let mut files = Vec::with_capacity(file_count);
+    for _ in 0..file_count {
+        files.push(read_string(bytes, pos)?);
+    }
+
+    let entry_count = read_u32(bytes, pos)?;
+    let mut map = SourceMap::new();
+    for _ in 0..entry_count {
+        let offset = read_u32(bytes, pos)? as usize;
+        let line = read_u32(bytes, pos)? as usize;
+        let column = read_u32(bytes, pos)? as usize;
+        let file_index = read_u32(bytes, pos)? as usize;
+        let file = files.get(file_index)
+            .ok_or_else(|| format!("Invalid source map file index: {}", file_index))?;
+        map.record(offset, &Location::new(line, column, file.clone()));
+    }
+    Ok(map)
+}
+
 fn write_bytecode(bytes: &mut Vec<u8>, bytecode: &[Instruction]) {
     write_u32(bytes, bytecode.len() as u32);
     for instr in bytecode {
@@ -187,7 +355,9 @@ fn write_instruction(bytes: &mut Vec<u8>, instr: &Instruction) {
             bytes.push(7);
             write_u32(bytes, *addr as u32);
         }
-        Instruction::Call(name, argc) => {
+        // A linked call is saved as the call it was linked from; its cache slot
+        // only means something in the VM that linked it
+        Instruction::Call(name, argc) | Instruction::CallCached(name, argc, _) => {
             bytes.push(8);
             write_string(bytes, name);
             write_u32(bytes, *argc as u32);
@@ -268,7 +438,7 @@ fn write_instruction(bytes: &mut Vec<u8>, instr: &Instruction) {
             bytes.push(36);
             write_u32(bytes, *n as u32);
         }
-        Instruction::TailCall(name, argc) => {
+        Instruction::TailCall(name, argc) | Instruction::TailCallCached(name, argc, _) => {
             bytes.push(37);
             write_string(bytes, name);
             write_u32(bytes, *argc as u32);
@@ -382,6 +552,245 @@ fn write_instruction(bytes: &mut Vec<u8>, instr: &Instruction) {
         Instruction::StringUpcase => bytes.push(129),
         Instruction::StringDowncase => bytes.push(130),
         Instruction::Format => bytes.push(131),
+        Instruction::Disassemble => bytes.push(132),
+        // Letrec cells (133-135)
+        Instruction::MakeCell => bytes.push(133),
+        Instruction::CellGet(name) => {
+            bytes.push(134);
+            write_string(bytes, name);
+        }
+        Instruction::CellSet => bytes.push(135),
+        Instruction::TailCallClosure(argc) => {
+            bytes.push(136);
+            write_u32(bytes, *argc as u32);
+        }
+        Instruction::StringEq => bytes.push(137),
+        Instruction::FloatDiv => bytes.push(138),
+        Instruction::Round => bytes.push(139),
+        // Multiple values (140-142)
+        Instruction::Values(n) => {
+            bytes.push(140);
+            write_u32(bytes, *n as u32);
+        }
+        Instruction::CallForValues => bytes.push(141),
+        Instruction::ApplyValues => bytes.push(142),
+        Instruction::MakeVectorFilled => bytes.push(143),
+        Instruction::HashMapGetOr => bytes.push(144),
+        Instruction::HashMapRemove => bytes.push(145),
+        Instruction::HashMapCount => bytes.push(146),
+        Instruction::StoreArg(idx) => {
+            bytes.push(147);
+            write_u32(bytes, *idx as u32);
+        }
+        // Error handlers (148-149, then 170 after the FFI range)
+        Instruction::PushHandler(addr) => {
+            bytes.push(148);
+            write_u32(bytes, *addr as u32);
+        }
+        Instruction::PopHandler => bytes.push(149),
+        Instruction::Raise => bytes.push(170),
+        // apply (171-172)
+        Instruction::TailApply => bytes.push(171),
+        Instruction::PrependArgs(n) => {
+            bytes.push(172);
+            write_u32(bytes, *n as u32);
+        }
+        // time (173-174)
+        Instruction::TimeStart => bytes.push(173),
+        Instruction::TimeEnd => bytes.push(174),
+        // catch and throw (175-176)
+        Instruction::PushCatch(addr) => {
+            bytes.push(175);
+            write_u32(bytes, *addr as u32);
+        }
+        Instruction::Throw => bytes.push(176),
+        // gc (177)
+        Instruction::CollectGarbage => bytes.push(177),
+        // defstruct (178-180)
+        Instruction::MakeStruct(name, n) => {
+            bytes.push(178);
+            write_string(bytes, name);
+            write_u32(bytes, *n as u32);
+        }
+        Instruction::StructGet(name, index) => {
+            bytes.push(179);
+            write_string(bytes, name);
+            write_u32(bytes, *index as u32);
+        }
+        Instruction::IsStruct(name) => {
+            bytes.push(180);
+            write_string(bytes, name);
+        }
+        // match (181)
+        Instruction::MatchFailed => bytes.push(181),
+        // case (182)
+        Instruction::JumpTable(min, targets, default) => {
+            bytes.push(182);
+            bytes.extend_from_slice(&min.to_le_bytes());
+            write_u32(bytes, targets.len() as u32);
+            for target in targets {
+                write_u32(bytes, *target as u32);
+            }
+            write_u32(bytes, *default as u32);
+        }
+        // eq? (183)
+        Instruction::IsEq => bytes.push(183),
+        // map, filter and reduce (184-185)
+        Instruction::ListReverse => bytes.push(184),
+        Instruction::Transpose => bytes.push(185),
+        // Number conversions with a radix (186-187)
+        Instruction::NumberToStringRadix => bytes.push(186),
+        Instruction::StringToNumberRadix => bytes.push(187),
+        // In-place vector store (188)
+        Instruction::VectorSetInPlace => bytes.push(188),
+        // Line input, append-file and file ports (189-195)
+        Instruction::AppendFile => bytes.push(189),
+        Instruction::ReadLine => bytes.push(190),
+        Instruction::ReadLineFrom => bytes.push(191),
+        Instruction::OpenInputFile => bytes.push(192),
+        Instruction::OpenOutputFile => bytes.push(193),
+        Instruction::ClosePort => bytes.push(194),
+        Instruction::PrintTo => bytes.push(195),
+        // Integer division (196-198)
+        Instruction::Quotient => bytes.push(196),
+        Instruction::Remainder => bytes.push(197),
+        Instruction::Modulo => bytes.push(198),
+        // Raw TCP sockets (199-203)
+        Instruction::TcpListen => bytes.push(199),
+        Instruction::TcpAccept => bytes.push(200),
+        Instruction::SocketRead => bytes.push(201),
+        Instruction::SocketWrite => bytes.push(202),
+        Instruction::SocketClose => bytes.push(203),
+        // Value-returning and/or (204-205)
+        Instruction::JmpIfFalseOrPop(addr) => {
+            bytes.push(204);
+            write_u32(bytes, *addr as u32);
+        }
+        Instruction::JmpIfTrueOrPop(addr) => {
+            bytes.push(205);
+            write_u32(bytes, *addr as u32);
+        }
+        // Assertions (206-207)
+        Instruction::Assert(source) => {
+            bytes.push(206);
+            write_string(bytes, source);
+        }
+        Instruction::AssertEqual(source) => {
+            bytes.push(207);
+            write_string(bytes, source);
+        }
+        // Characters (208-215)
+        Instruction::CharToInteger => bytes.push(208),
+        Instruction::IntegerToChar => bytes.push(209),
+        Instruction::CharEq => bytes.push(210),
+        Instruction::StringRef => bytes.push(211),
+        Instruction::CharLt => bytes.push(212),
+        Instruction::IsAlphabetic => bytes.push(213),
+        Instruction::IsNumeric => bytes.push(214),
+        Instruction::IsWhitespace => bytes.push(215),
+        // Fused loads and add (216-217)
+        Instruction::AddArgs(a, b) => {
+            bytes.push(216);
+            write_u32(bytes, *a as u32);
+            write_u32(bytes, *b as u32);
+        }
+        Instruction::AddLocals(a, b) => {
+            bytes.push(217);
+            write_u32(bytes, *a as u32);
+            write_u32(bytes, *b as u32);
+        }
+        // Checked and wrapping integer arithmetic (218-223)
+        Instruction::CheckedAdd => bytes.push(218),
+        Instruction::CheckedSub => bytes.push(219),
+        Instruction::CheckedMul => bytes.push(220),
+        Instruction::WrappingAdd => bytes.push(221),
+        Instruction::WrappingSub => bytes.push(222),
+        Instruction::WrappingMul => bytes.push(223),
+        // List access with the index first (224)
+        Instruction::Nth => bytes.push(224),
+        // Benchmarking introspection (225-226)
+        Instruction::CurrentTimeMillis => bytes.push(225),
+        Instruction::GetGcStats => bytes.push(226),
+        // Promises (227-230)
+        Instruction::MakePromise => bytes.push(227),
+        Instruction::IsPromise => bytes.push(228),
+        Instruction::ForceBegin => bytes.push(229),
+        Instruction::ForceEnd => bytes.push(230),
+        // Equality: =, eqv? and equal? (231-233)
+        Instruction::NumEq => bytes.push(231),
+        Instruction::IsEqv => bytes.push(232),
+        Instruction::Equal => bytes.push(233),
+        // Process: getenv and exit (234-235)
+        Instruction::GetEnv => bytes.push(234),
+        Instruction::Exit => bytes.push(235),
+        // Keyword arguments (236-238)
+        Instruction::CheckKeywords(function, keywords) => {
+            bytes.push(236);
+            write_string(bytes, function);
+            write_u32(bytes, keywords.len() as u32);
+            for keyword in keywords {
+                write_string(bytes, keyword);
+            }
+        }
+        Instruction::HasKeyword(keyword) => {
+            bytes.push(237);
+            write_string(bytes, keyword);
+        }
+        Instruction::GetKeyword(keyword) => {
+            bytes.push(238);
+            write_string(bytes, keyword);
+        }
+        // write and display (239-242)
+        Instruction::Write => bytes.push(239),
+        Instruction::WriteTo => bytes.push(240),
+        Instruction::Display => bytes.push(241),
+        Instruction::DisplayTo => bytes.push(242),
+        // member, memq, assoc, assq and sort (243-247)
+        Instruction::Member => bytes.push(243),
+        Instruction::Memq => bytes.push(244),
+        Instruction::Assoc => bytes.push(245),
+        Instruction::Assq => bytes.push(246),
+        Instruction::Sort => bytes.push(247),
+        // read and read-from-string (248-249)
+        Instruction::Read => bytes.push(248),
+        Instruction::ReadFromString => bytes.push(249),
+        // trace and untrace (250-253)
+        Instruction::Trace => bytes.push(250),
+        Instruction::Untrace => bytes.push(251),
+        Instruction::TraceCall(name) => {
+            bytes.push(252);
+            write_string(bytes, name);
+        }
+        Instruction::TraceReturn => bytes.push(253),
+        // Opcode 255 is followed by a second byte once the single bytes run out
+        // Bitwise operators (255 0-5)
+        Instruction::BitAnd => bytes.extend_from_slice(&[255, 0]),
+        Instruction::BitOr => bytes.extend_from_slice(&[255, 1]),
+        Instruction::BitXor => bytes.extend_from_slice(&[255, 2]),
+        Instruction::BitNot => bytes.extend_from_slice(&[255, 3]),
+        Instruction::ShiftLeft => bytes.extend_from_slice(&[255, 4]),
+        Instruction::ShiftRight => bytes.extend_from_slice(&[255, 5]),
+        // gensym with a prefix (255 6)
+        Instruction::GenSymPrefix => bytes.extend_from_slice(&[255, 6]),
+        // pp (255 7)
+        Instruction::PrettyPrint => bytes.extend_from_slice(&[255, 7]),
+        // Cooperative tasks (255 8-16)
+        Instruction::Spawn => bytes.extend_from_slice(&[255, 8]),
+        Instruction::Yield => bytes.extend_from_slice(&[255, 9]),
+        Instruction::Sleep => bytes.extend_from_slice(&[255, 10]),
+        Instruction::MakeChannel => bytes.extend_from_slice(&[255, 11]),
+        Instruction::ChanSend => bytes.extend_from_slice(&[255, 12]),
+        Instruction::ChanRecv => bytes.extend_from_slice(&[255, 13]),
+        Instruction::TaskResult => bytes.extend_from_slice(&[255, 14]),
+        Instruction::TaskStatus => bytes.extend_from_slice(&[255, 15]),
+        Instruction::TaskExit => bytes.extend_from_slice(&[255, 16]),
+        // In-place map store (255 17)
+        Instruction::HashMapSetInPlace => bytes.extend_from_slice(&[255, 17]),
+        // Multi-clause defun with no matching clause (255 18)
+        Instruction::ClauseFailed(name) => {
+            bytes.extend_from_slice(&[255, 18]);
+            write_string(bytes, name);
+        }
         // Date/Time operations (109-110)
         Instruction::CurrentTimestamp => bytes.push(109),
         Instruction::FormatTimestamp => bytes.push(110),
@@ -405,19 +814,11 @@ fn write_instruction(bytes: &mut Vec<u8>, instr: &Instruction) {
         Instruction::HttpReadRequest => bytes.push(121),
         Instruction::HttpSendResponse => bytes.push(122),
         Instruction::HttpClose => bytes.push(123),
-        // Loop/recur instructions (111-113)
+        // Local slot assignment (111)
         Instruction::SetLocal(pos) => {
             bytes.push(111);
             write_u32(bytes, *pos as u32);
         }
-        Instruction::BeginLoop(count) => {
-            bytes.push(112);
-            write_u32(bytes, *count as u32);
-        }
-        Instruction::Recur(count) => {
-            bytes.push(113);
-            write_u32(bytes, *count as u32);
-        }
         // Multi-threaded HTTP (124-125)
         Instruction::HttpListenShared => bytes.push(124),
         Instruction::HttpServeParallel => bytes.push(125),
@@ -640,10 +1041,8 @@ fn read_instruction(bytes: &[u8], pos: &mut usize) -> Result<Instruction, String
         121 => Ok(Instruction::HttpReadRequest),
         122 => Ok(Instruction::HttpSendResponse),
         123 => Ok(Instruction::HttpClose),
-        // Loop/recur instructions (111-113)
+        // Local slot assignment (111)
         111 => Ok(Instruction::SetLocal(read_u32(bytes, pos)? as usize)),
-        112 => Ok(Instruction::BeginLoop(read_u32(bytes, pos)? as usize)),
-        113 => Ok(Instruction::Recur(read_u32(bytes, pos)? as usize)),
         // Multi-threaded HTTP (124-125)
         124 => Ok(Instruction::HttpListenShared),
         125 => Ok(Instruction::HttpServeParallel),
@@ -654,6 +1053,176 @@ fn read_instruction(bytes: &[u8], pos: &mut usize) -> Result<Instruction, String
         129 => Ok(Instruction::StringUpcase),
         130 => Ok(Instruction::StringDowncase),
         131 => Ok(Instruction::Format),
+        132 => Ok(Instruction::Disassemble),
+        // Letrec cells (133-135)
+        133 => Ok(Instruction::MakeCell),
+        134 => Ok(Instruction::CellGet(read_string(bytes, pos)?)),
+        135 => Ok(Instruction::CellSet),
+        136 => Ok(Instruction::TailCallClosure(read_u32(bytes, pos)? as usize)),
+        137 => Ok(Instruction::StringEq),
+        138 => Ok(Instruction::FloatDiv),
+        139 => Ok(Instruction::Round),
+        // Multiple values (140-142)
+        140 => Ok(Instruction::Values(read_u32(bytes, pos)? as usize)),
+        141 => Ok(Instruction::CallForValues),
+        142 => Ok(Instruction::ApplyValues),
+        143 => Ok(Instruction::MakeVectorFilled),
+        144 => Ok(Instruction::HashMapGetOr),
+        145 => Ok(Instruction::HashMapRemove),
+        146 => Ok(Instruction::HashMapCount),
+        147 => Ok(Instruction::StoreArg(read_u32(bytes, pos)? as usize)),
+        // Error handlers (148-149, then 170 after the FFI range)
+        148 => Ok(Instruction::PushHandler(read_u32(bytes, pos)? as usize)),
+        149 => Ok(Instruction::PopHandler),
+        170 => Ok(Instruction::Raise),
+        // apply (171-172)
+        171 => Ok(Instruction::TailApply),
+        172 => Ok(Instruction::PrependArgs(read_u32(bytes, pos)? as usize)),
+        // time (173-174)
+        173 => Ok(Instruction::TimeStart),
+        174 => Ok(Instruction::TimeEnd),
+        // catch and throw (175-176)
+        175 => Ok(Instruction::PushCatch(read_u32(bytes, pos)? as usize)),
+        176 => Ok(Instruction::Throw),
+        // gc (177)
+        177 => Ok(Instruction::CollectGarbage),
+        // defstruct (178-180)
+        178 => {
+            let name = read_string(bytes, pos)?;
+            Ok(Instruction::MakeStruct(name, read_u32(bytes, pos)? as usize))
+        }
+        179 => {
+            let name = read_string(bytes, pos)?;
+            Ok(Instruction::StructGet(name, read_u32(bytes, pos)? as usize))
+        }
+        180 => Ok(Instruction::IsStruct(read_string(bytes, pos)?)),
+        // match (181)
+        181 => Ok(Instruction::MatchFailed),
+        // case (182)
+        182 => {
+            if *pos + 8 > bytes.len() {
+                return Err("Unexpected end of bytecode".to_string());
+            }
+            let mut min = [0u8; 8];
+            min.copy_from_slice(&bytes[*pos..*pos + 8]);
+            *pos += 8;
+            let len = read_u32(bytes, pos)? as usize;
+            let mut targets = Vec::with_capacity(len);
+            for _ in 0..len {
+                targets.push(read_u32(bytes, pos)? as usize);
+            }
+            Ok(Instruction::JumpTable(i64::from_le_bytes(min), targets, read_u32(bytes, pos)? as usize))
+        }
+        // eq? (183)
+        183 => Ok(Instruction::IsEq),
+        // map, filter and reduce (184-185)
+        184 => Ok(Instruction::ListReverse),
+        185 => Ok(Instruction::Transpose),
+        // Number conversions with a radix (186-187)
+        186 => Ok(Instruction::NumberToStringRadix),
+        187 => Ok(Instruction::StringToNumberRadix),
+        // In-place vector store (188)
+        188 => Ok(Instruction::VectorSetInPlace),
+        // Line input, append-file and file ports (189-195)
+        189 => Ok(Instruction::AppendFile),
+        190 => Ok(Instruction::ReadLine),
+        191 => Ok(Instruction::ReadLineFrom),
+        192 => Ok(Instruction::OpenInputFile),
+        193 => Ok(Instruction::OpenOutputFile),
+        194 => Ok(Instruction::ClosePort),
+        195 => Ok(Instruction::PrintTo),
+        // Integer division (196-198)
+        196 => Ok(Instruction::Quotient),
+        197 => Ok(Instruction::Remainder),
+        198 => Ok(Instruction::Modulo),
+        // Raw TCP sockets (199-203)
+        199 => Ok(Instruction::TcpListen),
+        200 => Ok(Instruction::TcpAccept),
+        201 => Ok(Instruction::SocketRead),
+        202 => Ok(Instruction::SocketWrite),
+        203 => Ok(Instruction::SocketClose),
+        // Value-returning and/or (204-205)
+        204 => Ok(Instruction::JmpIfFalseOrPop(read_u32(bytes, pos)? as usize)),
+        205 => Ok(Instruction::JmpIfTrueOrPop(read_u32(bytes, pos)? as usize)),
+        // Assertions (206-207)
+        206 => Ok(Instruction::Assert(read_string(bytes, pos)?)),
+        207 => Ok(Instruction::AssertEqual(read_string(bytes, pos)?)),
+        // Characters (208-215)
+        208 => Ok(Instruction::CharToInteger),
+        209 => Ok(Instruction::IntegerToChar),
+        210 => Ok(Instruction::CharEq),
+        211 => Ok(Instruction::StringRef),
+        212 => Ok(Instruction::CharLt),
+        213 => Ok(Instruction::IsAlphabetic),
+        214 => Ok(Instruction::IsNumeric),
+        215 => Ok(Instruction::IsWhitespace),
+        // Fused loads and add (216-217)
+        216 => {
+            let a = read_u32(bytes, pos)? as usize;
+            let b = read_u32(bytes, pos)? as usize;
+            Ok(Instruction::AddArgs(a, b))
+        }
+        217 => {
+            let a = read_u32(bytes, pos)? as usize;
+            let b = read_u32(bytes, pos)? as usize;
+            Ok(Instruction::AddLocals(a, b))
+        }
+        // Checked and wrapping integer arithmetic (218-223)
+        218 => Ok(Instruction::CheckedAdd),
+        219 => Ok(Instruction::CheckedSub),
+        220 => Ok(Instruction::CheckedMul),
+        221 => Ok(Instruction::WrappingAdd),
+        222 => Ok(Instruction::WrappingSub),
+        223 => Ok(Instruction::WrappingMul),
+        // List access with the index first (224)
+        224 => Ok(Instruction::Nth),
+        // Benchmarking introspection (225-226)
+        225 => Ok(Instruction::CurrentTimeMillis),
+        226 => Ok(Instruction::GetGcStats),
+        // Promises (227-230)
+        227 => Ok(Instruction::MakePromise),
+        228 => Ok(Instruction::IsPromise),
+        229 => Ok(Instruction::ForceBegin),
+        230 => Ok(Instruction::ForceEnd),
+        // Equality: =, eqv? and equal? (231-233)
+        231 => Ok(Instruction::NumEq),
+        232 => Ok(Instruction::IsEqv),
+        233 => Ok(Instruction::Equal),
+        // Process: getenv and exit (234-235)
+        234 => Ok(Instruction::GetEnv),
+        235 => Ok(Instruction::Exit),
+        // Keyword arguments (236-238)
+        236 => {
+            let function = read_string(bytes, pos)?;
+            let count = read_u32(bytes, pos)? as usize;
+            let mut keywords = Vec::with_capacity(count);
+            for _ in 0..count {
+                keywords.push(read_string(bytes, pos)?);
+            }
+            Ok(Instruction::CheckKeywords(function, keywords))
+        }
+        237 => Ok(Instruction::HasKeyword(read_string(bytes, pos)?)),
+        238 => Ok(Instruction::GetKeyword(read_string(bytes, pos)?)),
+        // write and display (239-242)
+        239 => Ok(Instruction::Write),
+        240 => Ok(Instruction::WriteTo),
+        241 => Ok(Instruction::Display),
+        242 => Ok(Instruction::DisplayTo),
+        // member, memq, assoc, assq and sort (243-247)
+        243 => Ok(Instruction::Member),
+        244 => Ok(Instruction::Memq),
+        245 => Ok(Instruction::Assoc),
+        246 => Ok(Instruction::Assq),
+        247 => Ok(Instruction::Sort),
+        // read and read-from-string (248-249)
+        248 => Ok(Instruction::Read),
+        249 => Ok(Instruction::ReadFromString),
+        // trace and untrace (250-253)
+        250 => Ok(Instruction::Trace),
+        251 => Ok(Instruction::Untrace),
+        252 => Ok(Instruction::TraceCall(read_string(bytes, pos)?)),
+        253 => Ok(Instruction::TraceReturn),
+        255 => read_extended_instruction(bytes, pos),
         // FFI instructions (150-169)
         150 => Ok(Instruction::FfiLoadLibrary),
         151 => Ok(Instruction::FfiGetSymbol),
@@ -701,6 +1270,44 @@ fn read_instruction(bytes: &[u8], pos: &mut usize) -> Result<Instruction, String
     }
 }
 
+/// The second byte of an opcode that starts with 255
+fn read_extended_instruction(bytes: &[u8], pos: &mut usize) -> Result<Instruction, String> {
+    if *pos >= bytes.len() {
+        return Err("Unexpected end of bytecode".to_string());
+    }
+    let opcode = bytes[*pos];
+    *pos += 1;
+
+    match opcode {
+        // Bitwise operators (255 0-5)
+        0 => Ok(Instruction::BitAnd),
+        1 => Ok(Instruction::BitOr),
+        2 => Ok(Instruction::BitXor),
+        3 => Ok(Instruction::BitNot),
+        4 => Ok(Instruction::ShiftLeft),
+        5 => Ok(Instruction::ShiftRight),
+        // gensym with a prefix (255 6)
+        6 => Ok(Instruction::GenSymPrefix),
+        // pp (255 7)
+        7 => Ok(Instruction::PrettyPrint),
+        // Cooperative tasks (255 8-16)
+        8 => Ok(Instruction::Spawn),
+        9 => Ok(Instruction::Yield),
+        10 => Ok(Instruction::Sleep),
+        11 => Ok(Instruction::MakeChannel),
+        12 => Ok(Instruction::ChanSend),
+        13 => Ok(Instruction::ChanRecv),
+        14 => Ok(Instruction::TaskResult),
+        15 => Ok(Instruction::TaskStatus),
+        16 => Ok(Instruction::TaskExit),
+        // In-place map store (255 17)
+        17 => Ok(Instruction::HashMapSetInPlace),
+        // Multi-clause defun with no matching clause (255 18)
+        18 => Ok(Instruction::ClauseFailed(read_string(bytes, pos)?)),
+        _ => Err(format!("Unknown opcode: 255 {}", opcode)),
+    }
+}
+
 fn write_value(bytes: &mut Vec<u8>, value: &Value) {
     match value {
         Value::Integer(n) => {
@@ -762,16 +1369,18 @@ fn write_value(bytes: &mut Vec<u8>, value: &Value) {
             }
         }
         Value::HashMap(map) => {
+            let map = map.borrow();
             bytes.push(7);
             // Write number of entries
             write_u32(bytes, map.len() as u32);
             // Write key-value pairs
             for (key, value) in map.iter() {
-                write_string(bytes, key);
+                write_value(bytes, &key.to_value());
                 write_value(bytes, value);
             }
         }
         Value::Vector(vec) => {
+            let vec = vec.borrow();
             bytes.push(8);
             // Write number of elements
             write_u32(bytes, vec.len() as u32);
@@ -793,6 +1402,36 @@ fn write_value(bytes: &mut Vec<u8>, value: &Value) {
             bytes.push(10);  // Tag 10 for Pointer
             bytes.extend_from_slice(&p.to_le_bytes());
         }
+        Value::BigInt(n) => {
+            bytes.push(11);
+            bytes.push(if n.is_negative() { 1 } else { 0 });
+            write_u32(bytes, n.limbs().len() as u32);
+            for limb in n.limbs() {
+                write_u32(bytes, *limb);
+            }
+        }
+        Value::Char(c) => {
+            bytes.push(12);
+            write_u32(bytes, *c as u32);
+        }
+        Value::Cell(_) => {
+            panic!("Cannot serialize Cell to bytecode - runtime value only");
+        }
+        Value::Struct(_) => {
+            panic!("Cannot serialize struct to bytecode - runtime value only");
+        }
+        Value::Port(_) => {
+            panic!("Cannot serialize port to bytecode - runtime value only");
+        }
+        Value::Promise(_) => {
+            panic!("Cannot serialize promise to bytecode - runtime value only");
+        }
+        Value::Task(_) => {
+            panic!("Cannot serialize task to bytecode - runtime value only");
+        }
+        Value::Channel(_) => {
+            panic!("Cannot serialize channel to bytecode - runtime value only");
+        }
     }
 }
 
@@ -837,7 +1476,7 @@ fn read_value(bytes: &[u8], pos: &mut usize) -> Result<Value, String> {
             }
             Ok(Value::List(List::from_vec(items)))
         }
-        3 => Ok(Value::Symbol(Arc::new(read_string(bytes, pos)?))),
+        3 => Ok(Value::symbol(read_string(bytes, pos)?)),
         4 => Ok(Value::String(Arc::new(read_string(bytes, pos)?))),
         5 => Ok(Value::Function(Arc::new(read_string(bytes, pos)?))),
         6 => {
@@ -876,11 +1515,13 @@ fn read_value(bytes: &[u8], pos: &mut usize) -> Result<Value, String> {
             let len = read_u32(bytes, pos)? as usize;
             let mut map = HashMap::new();
             for _ in 0..len {
-                let key = read_string(bytes, pos)?;
+                let key = read_value(bytes, pos)?;
+                let key = MapKey::from_value(&key)
+                    .ok_or_else(|| "Invalid hashmap key in bytecode file".to_string())?;
                 let value = read_value(bytes, pos)?;
                 map.insert(key, value);
             }
-            Ok(Value::HashMap(Arc::new(map)))
+            Ok(Value::hashmap(map))
         }
         8 => {
             // Read Vector
@@ -889,7 +1530,7 @@ fn read_value(bytes: &[u8], pos: &mut usize) -> Result<Value, String> {
             for _ in 0..len {
                 vec.push(read_value(bytes, pos)?);
             }
-            Ok(Value::Vector(Arc::new(vec)))
+            Ok(Value::vector(vec))
         }
         9 => {
             // Read Float
@@ -927,6 +1568,27 @@ fn read_value(bytes: &[u8], pos: &mut usize) -> Result<Value, String> {
             *pos += 8;
             Ok(Value::Pointer(p))
         }
+        11 => {
+            // Read BigInt: sign byte, limb count, then limbs least significant first
+            if *pos >= bytes.len() {
+                return Err("Unexpected end of bytecode".to_string());
+            }
+            let negative = bytes[*pos] != 0;
+            *pos += 1;
+            let count = read_u32(bytes, pos)? as usize;
+            let mut limbs = Vec::with_capacity(count);
+            for _ in 0..count {
+                limbs.push(read_u32(bytes, pos)?);
+            }
+            Ok(Value::from_bigint(BigInt::from_parts(negative, limbs)))
+        }
+        12 => {
+            // Read Char as its code point
+            let code = read_u32(bytes, pos)?;
+            char::from_u32(code)
+                .map(Value::Char)
+                .ok_or_else(|| format!("Invalid character code in bytecode: {}", code))
+        }
         _ => Err(format!("Unknown value tag: {}", tag)),
     }
 }
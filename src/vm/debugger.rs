@@ -0,0 +1,427 @@
+// Stepping debugger: pauses the VM before instructions and reads commands
+// The VM only calls into it when a debugger is attached (see VM::run)
+
+use std::collections::HashMap;
+use std::io::{self, BufRead, Write};
+
+use super::errors::Location;
+use super::source_map::ProgramSlotNames;
+use super::value::Value;
+use super::vm::VM;
+use crate::disassembler::format_instruction;
+
+/// How many stack entries to show at each pause
+const STACK_PREVIEW: usize = 5;
+
+/// Where execution should pause
+#[derive(Debug, Clone, PartialEq)]
+pub enum Breakpoint {
+    /// Instruction index within a function (None = the main program)
+    Instruction(Option<String>, usize),
+    /// First instruction of a function, whether it was called or tail-called
+    Function(String),
+    /// First instruction run on a source line, in any file or (Some) in the file
+    /// whose path ends with the given name
+    Line(Option<String>, usize),
+}
+
+// A frame as the debugger shows it: main, then each call on the VM's call stack
+struct FrameView<'a> {
+    function: Option<&'a str>, // None = the main program
+    offset: usize,             // Instruction the frame is at (its call, for callers)
+    stack_base: usize,
+}
+
+pub struct Debugger {
+    input: Box<dyn BufRead>,
+    output: Box<dyn Write>,
+    stepping: bool,
+    step_over: Option<usize>, // `next`: pause once the call stack is back to this depth
+    breakpoints: Vec<Breakpoint>,
+    param_names: HashMap<String, Vec<String>>, // Function name -> parameter names, for locals
+    slot_names: ProgramSlotNames,              // Let-bound names of stack slots, for locals
+    sources: HashMap<String, String>,          // File -> text, to show the line paused on
+    last_line: Option<(usize, String, usize)>, // Call depth, file and line of the last instruction, for line breakpoints
+}
+
+impl Debugger {
+    /// Debugger reading commands from stdin and writing to stdout
+    pub fn new() -> Self {
+        Debugger::with_io(Box::new(io::BufReader::new(io::stdin())), Box::new(io::stdout()))
+    }
+
+    pub fn with_io(input: Box<dyn BufRead>, output: Box<dyn Write>) -> Self {
+        Debugger {
+            input,
+            output,
+            stepping: true,
+            step_over: None,
+            breakpoints: Vec::new(),
+            param_names: HashMap::new(),
+            slot_names: ProgramSlotNames::default(),
+            sources: HashMap::new(),
+            last_line: None,
+        }
+    }
+
+    /// Parameter names of compiled functions, so locals can be shown and printed by name
+    pub fn set_param_names(&mut self, param_names: HashMap<String, Vec<String>>) {
+        self.param_names = param_names;
+    }
+
+    /// Names of let-bound stack slots, from a compiler that recorded them
+    pub fn set_slot_names(&mut self, slot_names: ProgramSlotNames) {
+        self.slot_names = slot_names;
+    }
+
+    /// Source text of a file, so pauses in it show the line with a caret
+    pub fn add_source(&mut self, file: String, source: String) {
+        self.sources.insert(file, source);
+    }
+
+    pub fn add_breakpoint(&mut self, breakpoint: Breakpoint) {
+        if !self.breakpoints.contains(&breakpoint) {
+            self.breakpoints.push(breakpoint);
+        }
+    }
+
+    pub fn breakpoints(&self) -> &[Breakpoint] {
+        &self.breakpoints
+    }
+
+    /// Called before each instruction. Pauses and reads commands when stepping or
+    /// at a breakpoint; `quit` halts the VM.
+    pub fn before_instruction(&mut self, vm: &mut VM) {
+        // Checked first, so line breakpoints see every instruction
+        let at_breakpoint = self.at_breakpoint(vm);
+        let stepped_over = matches!(self.step_over, Some(depth) if vm.call_stack.len() <= depth);
+        if !self.stepping && !stepped_over && !at_breakpoint {
+            return;
+        }
+        self.step_over = None;
+
+        self.show_position(vm);
+        loop {
+            let _ = write!(self.output, "(debug) ");
+            let _ = self.output.flush();
+
+            let mut line = String::new();
+            match self.input.read_line(&mut line) {
+                Ok(0) | Err(_) => {
+                    // No more commands: run the rest of the program
+                    self.stepping = false;
+                    return;
+                }
+                Ok(_) => {}
+            }
+
+            let mut words = line.split_whitespace();
+            let command = words.next().unwrap_or("step");
+            let argument = words.next();
+            match command {
+                "step" | "s" => {
+                    self.stepping = true;
+                    return;
+                }
+                "next" | "n" => {
+                    // Run any call this instruction makes to its return
+                    self.stepping = false;
+                    self.step_over = Some(vm.call_stack.len());
+                    return;
+                }
+                "continue" | "c" => {
+                    self.stepping = false;
+                    return;
+                }
+                "break" | "b" => match (argument, words.next()) {
+                    (Some("line"), Some(line)) => match line.parse::<usize>() {
+                        Ok(line) => self.set_breakpoint(Breakpoint::Line(None, line)),
+                        Err(_) => {
+                            let _ = writeln!(self.output, "Usage: break line <number>");
+                        }
+                    },
+                    (Some(target), _) => {
+                        let breakpoint = Self::parse_breakpoint(target, Self::current_function(vm));
+                        self.set_breakpoint(breakpoint);
+                    }
+                    (None, _) => self.list_breakpoints(),
+                },
+                "print" | "p" => match argument {
+                    Some(name) => self.print_variable(vm, name),
+                    None => {
+                        let _ = writeln!(self.output, "Usage: print <name>");
+                    }
+                },
+                "locals" | "l" => self.show_locals(vm),
+                "stack" => self.show_frames(vm),
+                "backtrace" | "bt" => self.show_backtrace(vm),
+                "quit" | "q" => {
+                    vm.halted = true;
+                    return;
+                }
+                "help" | "h" => self.show_help(),
+                _ => {
+                    let _ = writeln!(self.output, "Unknown command '{}' (type 'help' for commands)", command);
+                }
+            }
+        }
+    }
+
+    fn current_function(vm: &VM) -> Option<&str> {
+        vm.call_stack.last().map(|frame| frame.function_name.as_str())
+    }
+
+    fn current_location(vm: &VM) -> Option<Location> {
+        vm.source_location(Self::current_function(vm), vm.instruction_pointer)
+    }
+
+    fn at_breakpoint(&mut self, vm: &VM) -> bool {
+        let function = Self::current_function(vm);
+        let ip = vm.instruction_pointer;
+        let at_instruction = self.breakpoints.iter().any(|breakpoint| match breakpoint {
+            Breakpoint::Instruction(name, index) => *index == ip && name.as_deref() == function,
+            // A tail call reuses the frame, renaming it and starting over at 0
+            Breakpoint::Function(name) => ip == 0 && function == Some(name.as_str()),
+            Breakpoint::Line(_, _) => false,
+        });
+        self.arrived_at_line_breakpoint(vm) || at_instruction
+    }
+
+    // Line breakpoints stop at the first instruction run on the line, rather than
+    // at each of the instructions it compiled to
+    fn arrived_at_line_breakpoint(&mut self, vm: &VM) -> bool {
+        if !self.breakpoints.iter().any(|breakpoint| matches!(breakpoint, Breakpoint::Line(_, _))) {
+            return false;
+        }
+        let location = match Self::current_location(vm) {
+            Some(location) => location,
+            None => {
+                self.last_line = None;
+                return false;
+            }
+        };
+        let position = (vm.call_stack.len(), location.file.clone(), location.line);
+        if self.last_line.as_ref() == Some(&position) {
+            return false;
+        }
+        self.last_line = Some(position);
+        self.breakpoints.iter().any(|breakpoint| match breakpoint {
+            Breakpoint::Line(file, line) => {
+                *line == location.line && file.as_ref().map_or(true, |file| location.file.ends_with(file.as_str()))
+            }
+            _ => false,
+        })
+    }
+
+    // <index> = instruction in the current function, <function>:<index> = instruction
+    // in that function ("main" for the program), <file>.lisp:<line> = source line,
+    // anything else = function entry
+    fn parse_breakpoint(target: &str, current: Option<&str>) -> Breakpoint {
+        if let Ok(index) = target.parse::<usize>() {
+            return Breakpoint::Instruction(current.map(|name| name.to_string()), index);
+        }
+        if let Some((name, index)) = target.rsplit_once(':') {
+            if let Ok(index) = index.parse::<usize>() {
+                if name.ends_with(".lisp") {
+                    return Breakpoint::Line(Some(name.to_string()), index);
+                }
+                let function = if name == "main" { None } else { Some(name.to_string()) };
+                return Breakpoint::Instruction(function, index);
+            }
+        }
+        Breakpoint::Function(target.to_string())
+    }
+
+    fn describe_breakpoint(breakpoint: &Breakpoint) -> String {
+        match breakpoint {
+            Breakpoint::Instruction(name, index) => format!("{}:{}", name.as_deref().unwrap_or("main"), index),
+            Breakpoint::Function(name) => format!("entry of '{}'", name),
+            Breakpoint::Line(Some(file), line) => format!("line {} of {}", line, file),
+            Breakpoint::Line(None, line) => format!("line {}", line),
+        }
+    }
+
+    fn set_breakpoint(&mut self, breakpoint: Breakpoint) {
+        let _ = writeln!(self.output, "Breakpoint set at {}", Self::describe_breakpoint(&breakpoint));
+        self.add_breakpoint(breakpoint);
+    }
+
+    fn list_breakpoints(&mut self) {
+        if self.breakpoints.is_empty() {
+            let _ = writeln!(self.output, "No breakpoints");
+        }
+        for (i, breakpoint) in self.breakpoints.iter().enumerate() {
+            let _ = writeln!(self.output, "  #{}: {}", i, Self::describe_breakpoint(breakpoint));
+        }
+    }
+
+    fn show_position(&mut self, vm: &VM) {
+        let function = Self::current_function(vm).unwrap_or("main");
+        let instruction = vm.current_bytecode.get(vm.instruction_pointer)
+            .map(format_instruction)
+            .unwrap_or_else(|| "<end of bytecode>".to_string());
+        let _ = writeln!(self.output, "-> {}:{}  {}", function, vm.instruction_pointer, instruction);
+        if let Some(location) = Self::current_location(vm) {
+            let _ = writeln!(self.output, "   at {}", location.format());
+            if let Some(source) = self.sources.get(&location.file) {
+                for line in location.source_context(source) {
+                    let _ = writeln!(self.output, "   {}", line);
+                }
+            }
+        }
+        self.show_stack(vm, STACK_PREVIEW);
+        if !vm.call_stack.is_empty() || !self.current_slots(vm).is_empty() {
+            self.show_locals(vm);
+        }
+    }
+
+    // Show the top `count` stack entries, top of stack last
+    fn show_stack(&mut self, vm: &VM, count: usize) {
+        let len = vm.value_stack.len();
+        let shown = &vm.value_stack[len - count.min(len)..];
+        let values: Vec<String> = shown.iter().map(VM::format_diagnostic).collect();
+        if shown.len() < len {
+            let _ = writeln!(self.output, "   stack: ...{} more, {}", len - shown.len(), values.join(" "));
+        } else {
+            let _ = writeln!(self.output, "   stack: [{}]", values.join(" "));
+        }
+    }
+
+    // Main and each call, outermost first, with the instruction each is at
+    fn frames(vm: &VM) -> Vec<FrameView<'_>> {
+        let mut frames = vec![FrameView { function: None, offset: 0, stack_base: 0 }];
+        for frame in &vm.call_stack {
+            // A caller is at the call that made the frame above it
+            if let Some(caller) = frames.last_mut() {
+                caller.offset = frame.return_address.saturating_sub(1);
+            }
+            frames.push(FrameView {
+                function: Some(frame.function_name.as_str()),
+                offset: 0,
+                stack_base: frame.stack_base,
+            });
+        }
+        if let Some(top) = frames.last_mut() {
+            top.offset = vm.instruction_pointer;
+        }
+        frames
+    }
+
+    // The let-bound slots of a frame that hold a value, with their absolute stack index
+    fn named_slots(&self, vm: &VM, frame: &FrameView) -> Vec<(usize, String)> {
+        let names = match frame.function {
+            Some(name) if name != "<main>" => self.slot_names.functions.get(name),
+            _ => Some(&self.slot_names.main),
+        };
+        names.map(|names| names.lookup(frame.offset)).unwrap_or(&[]).iter()
+            .map(|(slot, name)| (frame.stack_base + slot, name.clone()))
+            .filter(|(index, _)| *index < vm.value_stack.len())
+            .collect()
+    }
+
+    fn current_slots(&self, vm: &VM) -> Vec<(usize, String)> {
+        let frames = Self::frames(vm);
+        self.named_slots(vm, frames.last().expect("main is always a frame"))
+    }
+
+    fn show_locals(&mut self, vm: &VM) {
+        let mut locals = Vec::new();
+        if let Some(frame) = vm.call_stack.last() {
+            let names = self.param_names.get(&frame.function_name);
+            locals.extend(frame.locals.iter().enumerate().map(|(i, value)| {
+                let name = names.and_then(|names| names.get(i)).cloned().unwrap_or_else(|| format!("arg{}", i));
+                format!("{} = {}", name, Self::format_local(value))
+            }));
+        }
+        for (index, name) in self.current_slots(vm) {
+            locals.push(format!("{} = {}", name, Self::format_local(&vm.value_stack[index])));
+        }
+        let _ = writeln!(self.output, "   locals: {}", if locals.is_empty() { "none".to_string() } else { locals.join(", ") });
+    }
+
+    // A local's value; a boxed (set!) binding shows what its cell holds
+    fn format_local(value: &Value) -> String {
+        match value {
+            Value::Cell(contents) => contents.borrow().as_ref().map_or("<unassigned>".to_string(), VM::format_diagnostic),
+            value => VM::format_diagnostic(value),
+        }
+    }
+
+    // The whole value stack, split into the part each frame pushed
+    fn show_frames(&mut self, vm: &VM) {
+        let frames = Self::frames(vm);
+        for (i, frame) in frames.iter().enumerate() {
+            let end = frames.get(i + 1).map_or(vm.value_stack.len(), |next| next.stack_base);
+            let names: HashMap<usize, String> = self.named_slots(vm, frame).into_iter().collect();
+            let _ = writeln!(self.output, "   {}:", frame.function.unwrap_or("main"));
+            for index in frame.stack_base.min(end)..end {
+                let value = VM::format_diagnostic(&vm.value_stack[index]);
+                match names.get(&index) {
+                    Some(name) => {
+                        let _ = writeln!(self.output, "     [{}] {}  ({})", index, value, name);
+                    }
+                    None => {
+                        let _ = writeln!(self.output, "     [{}] {}", index, value);
+                    }
+                }
+            }
+        }
+    }
+
+    fn show_backtrace(&mut self, vm: &VM) {
+        for frame in Self::frames(vm) {
+            let name = frame.function.unwrap_or("main");
+            match vm.source_location(frame.function, frame.offset) {
+                Some(location) => {
+                    let _ = writeln!(self.output, "  {} at {}", name, location.format());
+                }
+                None => {
+                    let _ = writeln!(self.output, "  {}", name);
+                }
+            }
+        }
+    }
+
+    // Look the name up among the current frame's parameters and let bindings, then the globals
+    fn print_variable(&mut self, vm: &VM, name: &str) {
+        let parameter = vm.call_stack.last().and_then(|frame| {
+            let index = self.param_names.get(&frame.function_name)?.iter().position(|param| param == name)?;
+            frame.locals.get(index)
+        });
+        let slot = self.current_slots(vm).into_iter()
+            .find(|(_, slot_name)| slot_name == name)
+            .map(|(index, _)| &vm.value_stack[index]);
+        match slot.or(parameter).or_else(|| vm.global_vars.get(name)) {
+            Some(value) => {
+                let _ = writeln!(self.output, "{} = {}", name, Self::format_local(value));
+            }
+            None => {
+                let _ = writeln!(self.output, "No variable named '{}' in this frame or the globals", name);
+            }
+        }
+    }
+
+    fn show_help(&mut self) {
+        let _ = writeln!(self.output, "Commands:");
+        let _ = writeln!(self.output, "  step, s (or empty line)   Execute one instruction");
+        let _ = writeln!(self.output, "  next, n                   Execute one instruction, running any call it makes to its return");
+        let _ = writeln!(self.output, "  continue, c               Run until the next breakpoint");
+        let _ = writeln!(self.output, "  break, b <index>          Break at an instruction of the current function");
+        let _ = writeln!(self.output, "  break, b <fn>:<index>     Break at an instruction of a function (main = program)");
+        let _ = writeln!(self.output, "  break, b <fn>             Break when a function is entered");
+        let _ = writeln!(self.output, "  break, b line <n>         Break when a source line is reached");
+        let _ = writeln!(self.output, "  break, b <file>:<n>       Break when a line of a .lisp file is reached");
+        let _ = writeln!(self.output, "  break, b                  List breakpoints");
+        let _ = writeln!(self.output, "  print, p <name>           Print a local or global variable");
+        let _ = writeln!(self.output, "  locals, l                 Print the current frame's parameters and let bindings");
+        let _ = writeln!(self.output, "  stack                     Print the whole value stack, frame by frame");
+        let _ = writeln!(self.output, "  backtrace, bt             Print the call stack with source positions");
+        let _ = writeln!(self.output, "  quit, q                   Stop the program");
+    }
+}
+
+impl Default for Debugger {
+    fn default() -> Self {
+        Debugger::new()
+    }
+}
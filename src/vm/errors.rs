@@ -1,3 +1,5 @@
+use super::value::Value;
+
 #[derive(Debug, Clone, PartialEq)]
 pub struct Location {
     pub line: usize,
@@ -25,6 +27,34 @@ impl Location {
             format!("{}:{}:{}", self.file, self.line, self.column)
         }
     }
+
+    /// The lines of `source` around this location, numbered, with a caret under
+    /// the column. Empty when the line is not in `source`.
+    pub fn source_context(&self, source: &str) -> Vec<String> {
+        self.source_context_spanning(source, 1)
+    }
+
+    /// Like `source_context`, underlining `width` characters from the column
+    pub fn source_context_spanning(&self, source: &str, width: usize) -> Vec<String> {
+        let lines: Vec<&str> = source.lines().collect();
+        if self.line == 0 || self.line > lines.len() {
+            return Vec::new();
+        }
+
+        let mut context = Vec::new();
+        // Show line before (if exists)
+        if self.line > 1 {
+            context.push(format!("{:4} │ {}", self.line - 1, lines[self.line - 2]));
+        }
+        // Show the line itself, with a pointer to the column
+        context.push(format!("{:4} │ {}", self.line, lines[self.line - 1]));
+        context.push(format!("     │ {}{}", " ".repeat(self.column.saturating_sub(1)), "^".repeat(width.max(1))));
+        // Show line after (if exists)
+        if self.line < lines.len() {
+            context.push(format!("{:4} │ {}", self.line + 1, lines[self.line]));
+        }
+        context
+    }
 }
 
 #[derive(Debug, Clone)]
@@ -32,6 +62,7 @@ pub struct CompileError {
     pub message: String,
     pub location: Location,
     pub suggestion: Option<String>,
+    pub note: Option<(String, Location)>, // Related source position, e.g. an earlier definition
 }
 
 impl CompileError {
@@ -40,6 +71,7 @@ impl CompileError {
             message,
             location,
             suggestion: None,
+            note: None,
         }
     }
 
@@ -48,9 +80,16 @@ impl CompileError {
             message,
             location,
             suggestion: Some(suggestion),
+            note: None,
         }
     }
 
+    /// Point at another source position that explains the error
+    pub fn with_note(mut self, message: String, location: Location) -> Self {
+        self.note = Some((message, location));
+        self
+    }
+
     /// Format the error with optional source code context
     /// If source is provided, it should be the full source file content
     pub fn format(&self, source: Option<&str>) -> String {
@@ -64,41 +103,23 @@ impl CompileError {
 
         // Show source context if available
         if let Some(src) = source {
-            let lines: Vec<&str> = src.lines().collect();
-            if self.location.line > 0 && self.location.line <= lines.len() {
+            let context = self.location.source_context(src);
+            if !context.is_empty() {
                 output.push_str(&format!("├─────────────────────────────────────────────\n"));
-
-                // Show line before (if exists)
-                if self.location.line > 1 {
-                    output.push_str(&format!(
-                        "│ {:4} │ {}\n",
-                        self.location.line - 1,
-                        lines[self.location.line - 2]
-                    ));
+                for line in context {
+                    output.push_str(&format!("│ {}\n", line));
                 }
+            }
+        }
 
-                // Show error line with pointer
-                let error_line = lines[self.location.line - 1];
-                output.push_str(&format!(
-                    "│ {:4} │ {}\n",
-                    self.location.line,
-                    error_line
-                ));
-
-                // Add pointer to error location
-                let pointer_padding = self.location.column.saturating_sub(1);
-                output.push_str(&format!(
-                    "│      │ {}^\n",
-                    " ".repeat(pointer_padding)
-                ));
-
-                // Show line after (if exists)
-                if self.location.line < lines.len() {
-                    output.push_str(&format!(
-                        "│ {:4} │ {}\n",
-                        self.location.line + 1,
-                        lines[self.location.line]
-                    ));
+        // Show the note, with its line when it's in the same source
+        if let Some((message, location)) = &self.note {
+            output.push_str("├─ Note ──────────────────────────────────────\n");
+            output.push_str(&format!("│ {} ({})\n", message, location.format()));
+            if let Some(src) = source.filter(|_| location.file == self.location.file) {
+                if let Some(line) = src.lines().nth(location.line.wrapping_sub(1)) {
+                    output.push_str(&format!("│ {:4} │ {}\n", location.line, line));
+                    output.push_str(&format!("│      │ {}^\n", " ".repeat(location.column.saturating_sub(1))));
                 }
             }
         }
@@ -151,12 +172,53 @@ impl CompileError {
     }
 }
 
+/// A problem the compiler reports without failing, e.g. a binding that is never used
+#[derive(Debug, Clone, PartialEq)]
+pub struct CompileWarning {
+    pub message: String,
+    pub location: Location,
+    pub width: usize, // Characters to underline from the location, e.g. the length of a name
+}
+
+impl CompileWarning {
+    pub fn new(message: String, location: Location, width: usize) -> Self {
+        CompileWarning { message, location, width }
+    }
+
+    /// The boxed format of compile errors, titled as a warning, with what it is
+    /// about underlined when `source` is given
+    pub fn format(&self, source: Option<&str>) -> String {
+        let mut output = String::new();
+
+        output.push_str("\n╭─ Warning ───────────────────────────────────\n");
+        output.push_str(&format!("│ {}\n", self.location.format()));
+        output.push_str("├─────────────────────────────────────────────\n");
+        output.push_str(&format!("│ {}\n", self.message));
+
+        if let Some(src) = source {
+            let context = self.location.source_context_spanning(src, self.width);
+            if !context.is_empty() {
+                output.push_str("├─────────────────────────────────────────────\n");
+                for line in context {
+                    output.push_str(&format!("│ {}\n", line));
+                }
+            }
+        }
+
+        output.push_str("╰─────────────────────────────────────────────\n");
+        output
+    }
+}
+
 #[derive(Debug, Clone)]
 pub struct RuntimeError {
     pub message: String,
     pub call_stack: Vec<String>,
+    pub call_sites: Vec<Option<Location>>, // Where each call_stack frame was called from
     pub location: Option<Location>,
     pub suggestion: Option<String>,
+    pub raised: Option<Value>, // Value given to raise or throw; built-in errors have none
+    pub thrown_to: Option<Value>, // Catch tag a throw unwinds to; raised holds the thrown value
 }
 
 impl RuntimeError {
@@ -164,8 +226,11 @@ impl RuntimeError {
         RuntimeError {
             message,
             call_stack: Vec::new(),
+            call_sites: Vec::new(),
             location: None,
             suggestion: None,
+            raised: None,
+            thrown_to: None,
         }
     }
 
@@ -173,8 +238,11 @@ impl RuntimeError {
         RuntimeError {
             message,
             call_stack: Vec::new(),
+            call_sites: Vec::new(),
             location: None,
             suggestion: Some(suggestion),
+            raised: None,
+            thrown_to: None,
         }
     }
 
@@ -182,8 +250,11 @@ impl RuntimeError {
         RuntimeError {
             message,
             call_stack,
+            call_sites: Vec::new(),
             location: None,
             suggestion: None,
+            raised: None,
+            thrown_to: None,
         }
     }
 
@@ -191,8 +262,11 @@ impl RuntimeError {
         RuntimeError {
             message,
             call_stack: Vec::new(),
+            call_sites: Vec::new(),
             location: Some(location),
             suggestion: None,
+            raised: None,
+            thrown_to: None,
         }
     }
 
@@ -204,16 +278,42 @@ impl RuntimeError {
         RuntimeError {
             message,
             call_stack,
+            call_sites: Vec::new(),
             location,
             suggestion: None,
+            raised: None,
+            thrown_to: None,
+        }
+    }
+
+    /// Error carrying a value raised by the program, for handler-case to bind
+    pub fn raised(message: String, value: Value) -> Self {
+        RuntimeError {
+            raised: Some(value),
+            ..RuntimeError::new(message)
+        }
+    }
+
+    /// Error unwinding to the innermost catch for tag, which takes value as its result
+    pub fn thrown(message: String, tag: Value, value: Value) -> Self {
+        RuntimeError {
+            raised: Some(value),
+            thrown_to: Some(tag),
+            ..RuntimeError::new(message)
         }
     }
 
     pub fn format(&self) -> String {
+        self.format_titled("Runtime Error")
+    }
+
+    /// The boxed format with another title, e.g. for a failed test
+    pub fn format_titled(&self, title: &str) -> String {
         let mut output = String::new();
 
-        // Header
-        output.push_str("\n╭─ Runtime Error ─────────────────────────────\n");
+        // Header, as wide as the rest of the box
+        let rule = "─".repeat(42usize.saturating_sub(title.chars().count()).max(3));
+        output.push_str(&format!("\n╭─ {} {}\n", title, rule));
 
         // Show location if available
         if let Some(loc) = &self.location {
@@ -227,8 +327,14 @@ impl RuntimeError {
         // Call stack
         if !self.call_stack.is_empty() {
             output.push_str("├─ Call Stack ────────────────────────────────\n");
+            let depth = self.call_stack.len();
             for (i, frame) in self.call_stack.iter().rev().enumerate() {
-                output.push_str(&format!("│ #{}: {}\n", i, frame));
+                match self.call_sites.get(depth - 1 - i) {
+                    Some(Some(site)) => {
+                        output.push_str(&format!("│ #{}: {} called at {}\n", i, frame, site.format()));
+                    }
+                    _ => output.push_str(&format!("│ #{}: {}\n", i, frame)),
+                }
             }
         }
 
@@ -502,8 +502,10 @@ pub fn ffi_type_size(ffi_type: &FfiType) -> usize {
 fn value_type_name(value: &Value) -> &'static str {
     match value {
         Value::Integer(_) => "integer",
+        Value::BigInt(_) => "integer",
         Value::Float(_) => "float",
         Value::Boolean(_) => "boolean",
+        Value::Char(_) => "char",
         Value::List(_) => "list",
         Value::Symbol(_) => "symbol",
         Value::String(_) => "string",
@@ -515,6 +517,12 @@ fn value_type_name(value: &Value) -> &'static str {
         Value::TcpStream(_) => "tcp-stream",
         Value::SharedTcpListener(_) => "shared-tcp-listener",
         Value::Pointer(_) => "pointer",
+        Value::Cell(_) => "cell",
+        Value::Struct(_) => "struct",
+        Value::Port(_) => "port",
+        Value::Promise(_) => "promise",
+        Value::Task(_) => "task",
+        Value::Channel(_) => "channel",
     }
 }
 
@@ -0,0 +1,165 @@
+// The function table, and the inline caches that let calls skip looking it up
+//
+// Call and TailCall name the function they call, so a call looks the name up
+// every time. The first time a function is called, the VM links a copy of its
+// bytecode: each call in it becomes a cached call, which carries a slot in the
+// call cache. The slot remembers the callee's linked bytecode along with the
+// table's generation when it was resolved; while the generation is unchanged
+// the call uses it without a lookup. Any change to the table, such as a
+// redefinition from the REPL, load or eval, bumps the generation, so every slot
+// resolves its name again the next time it runs and calls stay late-bound.
+
+use std::collections::HashMap;
+use std::ops::Deref;
+use std::rc::Rc;
+use std::sync::atomic::{AtomicU64, Ordering};
+
+use super::instructions::Instruction;
+
+// Generations come from one counter, so a table that replaces another (say a
+// VM's, by assignment) never reuses a generation its caches were filled in
+fn next_generation() -> u64 {
+    static NEXT: AtomicU64 = AtomicU64::new(0);
+    NEXT.fetch_add(1, Ordering::Relaxed)
+}
+
+/// Functions by name. Reads go straight to the map; changes go through
+/// `insert` and `extend`, which move it to a new generation call caches check.
+#[derive(Debug, Clone)]
+pub struct FunctionTable {
+    functions: HashMap<String, Vec<Instruction>>,
+    generation: u64,
+}
+
+impl FunctionTable {
+    pub fn new() -> Self {
+        FunctionTable::from(HashMap::new())
+    }
+
+    /// Changes whenever a function is defined or redefined
+    pub fn generation(&self) -> u64 {
+        self.generation
+    }
+
+    pub fn insert(&mut self, name: String, bytecode: Vec<Instruction>) -> Option<Vec<Instruction>> {
+        self.generation = next_generation();
+        self.functions.insert(name, bytecode)
+    }
+
+    pub fn extend<I: IntoIterator<Item = (String, Vec<Instruction>)>>(&mut self, functions: I) {
+        self.generation = next_generation();
+        self.functions.extend(functions);
+    }
+
+    pub fn into_keys(self) -> impl Iterator<Item = String> {
+        self.functions.into_keys()
+    }
+}
+
+impl From<HashMap<String, Vec<Instruction>>> for FunctionTable {
+    fn from(functions: HashMap<String, Vec<Instruction>>) -> Self {
+        FunctionTable { functions, generation: next_generation() }
+    }
+}
+
+impl Default for FunctionTable {
+    fn default() -> Self {
+        FunctionTable::new()
+    }
+}
+
+impl Deref for FunctionTable {
+    type Target = HashMap<String, Vec<Instruction>>;
+
+    fn deref(&self) -> &Self::Target {
+        &self.functions
+    }
+}
+
+impl IntoIterator for FunctionTable {
+    type Item = (String, Vec<Instruction>);
+    type IntoIter = std::collections::hash_map::IntoIter<String, Vec<Instruction>>;
+
+    fn into_iter(self) -> Self::IntoIter {
+        self.functions.into_iter()
+    }
+}
+
+// What a cache slot last resolved its callee to
+struct CallSlot {
+    generation: Option<u64>, // Table generation the bytecode is current for; None until first resolved
+    bytecode: Rc<Vec<Instruction>>,
+}
+
+// A function's linked bytecode, and the generation it was linked in
+struct LinkedFunction {
+    generation: u64,
+    bytecode: Rc<Vec<Instruction>>,
+}
+
+/// Linked bytecode of the functions called so far, and the slots their calls
+/// cache their callees in
+#[derive(Default)]
+pub struct CallCache {
+    linked: HashMap<String, LinkedFunction>,
+    slots: Vec<CallSlot>,
+    // Slot of each call site: the calling function, the call's offset and the callee.
+    // Relinking a function finds its sites' slots again, so they don't pile up
+    slot_ids: HashMap<(String, usize, String), usize>,
+}
+
+impl CallCache {
+    pub fn new() -> Self {
+        CallCache::default()
+    }
+
+    /// The callee a slot cached, if the table hasn't changed since
+    #[inline(always)]
+    pub fn cached(&self, slot: usize, generation: u64) -> Option<&Rc<Vec<Instruction>>> {
+        let slot = &self.slots[slot];
+        (slot.generation == Some(generation)).then_some(&slot.bytecode)
+    }
+
+    /// Resolve `name` for the call in `slot`, remembering it there
+    pub fn resolve_slot(&mut self, slot: usize, name: &str, table: &FunctionTable) -> Option<Rc<Vec<Instruction>>> {
+        let bytecode = self.resolve(name, table)?;
+        self.slots[slot] = CallSlot { generation: Some(table.generation()), bytecode: bytecode.clone() };
+        Some(bytecode)
+    }
+
+    /// Linked bytecode of `name`, linking it again if the table changed since
+    pub fn resolve(&mut self, name: &str, table: &FunctionTable) -> Option<Rc<Vec<Instruction>>> {
+        if let Some(linked) = self.linked.get(name) {
+            if linked.generation == table.generation() {
+                return Some(linked.bytecode.clone());
+            }
+        }
+        let bytecode = Rc::new(self.link(name, table.get(name)?));
+        self.linked.insert(name.to_string(), LinkedFunction { generation: table.generation(), bytecode: bytecode.clone() });
+        Some(bytecode)
+    }
+
+    // Copy of `bytecode` whose calls each have a slot. Nothing else changes, so
+    // offsets (and source maps) stay the same.
+    fn link(&mut self, function: &str, bytecode: &[Instruction]) -> Vec<Instruction> {
+        bytecode.iter().enumerate()
+            .map(|(offset, instruction)| match instruction {
+                Instruction::Call(callee, argc) => {
+                    Instruction::CallCached(callee.clone(), *argc, self.slot_id(function, offset, callee))
+                }
+                Instruction::TailCall(callee, argc) => {
+                    Instruction::TailCallCached(callee.clone(), *argc, self.slot_id(function, offset, callee))
+                }
+                other => other.clone(),
+            })
+            .collect()
+    }
+
+    fn slot_id(&mut self, function: &str, offset: usize, callee: &str) -> usize {
+        let slots = &mut self.slots;
+        *self.slot_ids.entry((function.to_string(), offset, callee.to_string())).or_insert_with(|| {
+            slots.push(CallSlot { generation: None, bytecode: Rc::new(Vec::new()) });
+            slots.len() - 1
+        })
+    }
+}
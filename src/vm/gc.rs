@@ -0,0 +1,216 @@
+// Tracing garbage collection for the VM heap
+//
+// Pairs, strings, vectors, hash maps, structs, closures and promises are reference
+// counted, so they are freed as soon as the last reference to them is dropped.
+// Reference counting can't free a cycle, and cycles are built through cells: a
+// letrec binding holds a closure that captures the binding's own cell. Every cell
+// is registered here, and a collection traces everything reachable from the roots
+// (value stack, call frames, globals, catch tags and the tasks waiting to run).
+// A live cell the trace didn't reach is only kept alive by a cycle, so emptying
+// it frees the whole cycle.
+//
+// A collection is due once enough objects have been allocated since the last one.
+// The VM only collects between instructions of the outermost run. Load, require
+// and eval run nested code inside an instruction, and an instruction may hold
+// values it popped in its own locals, where the trace can't find them.
+
+use std::cell::RefCell;
+use std::collections::HashSet;
+use std::rc::{Rc, Weak};
+use std::sync::Arc;
+
+use super::value::{List, Promise, Value};
+
+/// Allocations between collections when LISP_VM_GC_THRESHOLD isn't set
+pub const DEFAULT_GC_THRESHOLD: usize = 100_000;
+
+/// Environment variable overriding the collection threshold
+pub const GC_THRESHOLD_ENV: &str = "LISP_VM_GC_THRESHOLD";
+
+/// Environment variable that turns on stress mode when set to anything but 0
+pub const GC_STRESS_ENV: &str = "LISP_VM_GC_STRESS";
+
+/// Counters describing the collections run so far
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct GcStats {
+    pub collections: u64,
+    pub allocated: u64, // Objects allocated over the whole run
+    pub cells_reclaimed: u64, // Unreachable cells emptied, freeing their cycles
+    pub objects_reclaimed: u64, // Objects those cycles freed, the cells included
+    pub live_objects: usize, // Heap objects the last collection reached
+    pub peak_live_objects: usize, // Most heap objects any collection reached
+}
+
+#[derive(Debug)]
+pub struct Heap {
+    cells: Vec<Weak<RefCell<Option<Value>>>>,
+    allocated: usize, // Objects allocated since the last collection
+    threshold: usize,
+    stress: bool, // Collect after every allocation
+    due: bool,
+    pub stats: GcStats,
+}
+
+impl Heap {
+    /// A heap configured from LISP_VM_GC_THRESHOLD and LISP_VM_GC_STRESS
+    pub fn new() -> Self {
+        let threshold = std::env::var(GC_THRESHOLD_ENV).ok()
+            .and_then(|value| value.trim().parse::<usize>().ok())
+            .unwrap_or(DEFAULT_GC_THRESHOLD);
+        let stress = std::env::var(GC_STRESS_ENV).map_or(false, |value| value != "0");
+        Heap {
+            cells: Vec::new(),
+            allocated: 0,
+            threshold: threshold.max(1),
+            stress,
+            due: false,
+            stats: GcStats::default(),
+        }
+    }
+
+    pub fn threshold(&self) -> usize {
+        self.threshold
+    }
+
+    /// Allocations after which a collection is due. A larger live heap raises it,
+    /// so tracing costs stay proportional to what was allocated.
+    pub fn set_threshold(&mut self, threshold: usize) {
+        self.threshold = threshold.max(1);
+    }
+
+    pub fn is_stress(&self) -> bool {
+        self.stress
+    }
+
+    /// Collect after every allocation, to flush out values the trace misses
+    pub fn set_stress(&mut self, stress: bool) {
+        self.stress = stress;
+    }
+
+    /// Cells that haven't been freed yet
+    pub fn live_cells(&self) -> usize {
+        self.cells.iter().filter(|cell| cell.strong_count() > 0).count()
+    }
+
+    /// Count allocated objects towards the next collection
+    #[inline]
+    pub fn note_allocations(&mut self, count: usize) {
+        self.allocated += count;
+        self.stats.allocated += count as u64;
+        if self.stress || self.allocated >= self.threshold.max(self.stats.live_objects) {
+            self.due = true;
+        }
+    }
+
+    /// A new, uninitialized cell that later collections can reclaim
+    pub fn new_cell(&mut self) -> Value {
+        let cell = Rc::new(RefCell::new(None));
+        self.cells.push(Rc::downgrade(&cell));
+        self.note_allocations(1);
+        Value::Cell(cell)
+    }
+
+    #[inline]
+    pub fn collection_due(&self) -> bool {
+        self.due
+    }
+
+    /// Trace from `roots` and empty every registered cell the trace didn't reach.
+    /// Returns how many objects that frees: the cells, and whatever only they kept alive.
+    pub fn collect<'a>(&mut self, roots: impl Iterator<Item = &'a Value>) -> usize {
+        let mut seen: HashSet<usize> = HashSet::new();
+        trace(roots.cloned().collect(), &mut seen);
+        let live = seen.len();
+
+        let unreachable: Vec<Rc<RefCell<Option<Value>>>> = self.cells.iter()
+            .filter_map(|weak| weak.upgrade())
+            .filter(|cell| !seen.contains(&(Rc::as_ptr(cell) as usize)))
+            .collect();
+        // Everything reachable from here on is garbage
+        trace(unreachable.iter().map(|cell| Value::Cell(cell.clone())).collect(), &mut seen);
+        let reclaimed = seen.len() - live;
+
+        for cell in &unreachable {
+            // Dropped outside the borrow, since it may free other cells
+            let contents = cell.borrow_mut().take();
+            drop(contents);
+        }
+        self.stats.cells_reclaimed += unreachable.len() as u64;
+        drop(unreachable);
+        self.cells.retain(|cell| cell.strong_count() > 0);
+
+        self.stats.collections += 1;
+        self.stats.objects_reclaimed += reclaimed as u64;
+        self.stats.live_objects = live;
+        self.stats.peak_live_objects = self.stats.peak_live_objects.max(live);
+        self.allocated = 0;
+        self.due = false;
+        reclaimed
+    }
+}
+
+/// Add every heap object reachable from `pending` to `seen`, by address
+fn trace(mut pending: Vec<Value>, seen: &mut HashSet<usize>) {
+    while let Some(value) = pending.pop() {
+        match &value {
+            Value::List(List::Cons(pair)) => {
+                if seen.insert(Arc::as_ptr(pair) as usize) {
+                    pending.push(pair.head.clone());
+                    pending.push(Value::List(pair.tail.clone()));
+                }
+            }
+            Value::Closure(closure) => {
+                if seen.insert(Arc::as_ptr(closure) as usize) {
+                    pending.extend(closure.captured.iter().map(|(_, captured)| captured.clone()));
+                }
+            }
+            Value::Vector(items) => {
+                if seen.insert(Rc::as_ptr(items) as usize) {
+                    pending.extend(items.borrow().iter().cloned());
+                }
+            }
+            Value::HashMap(map) => {
+                if seen.insert(Rc::as_ptr(map) as usize) {
+                    pending.extend(map.borrow().values().cloned());
+                }
+            }
+            Value::Struct(data) => {
+                if seen.insert(Arc::as_ptr(data) as usize) {
+                    pending.extend(data.fields.iter().cloned());
+                }
+            }
+            Value::Cell(cell) => {
+                if seen.insert(Rc::as_ptr(cell) as usize) {
+                    pending.extend(cell.borrow().clone());
+                }
+            }
+            Value::Promise(promise) => {
+                if seen.insert(Rc::as_ptr(promise) as usize) {
+                    match &*promise.borrow() {
+                        Promise::Delayed(value) | Promise::Forcing(value) | Promise::Forced(value) => pending.push(value.clone()),
+                    }
+                }
+            }
+            Value::Task(task) => {
+                if seen.insert(Rc::as_ptr(task) as usize) {
+                    pending.extend(task.borrow().values());
+                }
+            }
+            Value::Channel(channel) => {
+                if seen.insert(Rc::as_ptr(channel) as usize) {
+                    pending.extend(channel.borrow().values());
+                }
+            }
+            Value::String(s) => {
+                seen.insert(Arc::as_ptr(s) as usize);
+            }
+            _ => {}
+        }
+    }
+}
+
+impl Default for Heap {
+    fn default() -> Self {
+        Self::new()
+    }
+}
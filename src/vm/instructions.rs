@@ -6,8 +6,24 @@ pub enum Instruction {
     Add,
     Sub,
     Mul,
-    Div,
+    Div,      // Pop two numbers, push their quotient; two integers truncate toward zero, (/ 7 2) is 3
+    FloatDiv, // Pop two numbers, push their quotient as a float (/.)
     Mod,
+    Quotient,  // Pop two integers, push their quotient truncated toward zero
+    Remainder, // Pop two integers, push the remainder with the sign of the dividend
+    Modulo,    // Pop two integers, push the remainder with the sign of the divisor
+    CheckedAdd,  // Pop two integers, push their sum; error if it doesn't fit in 64 bits
+    CheckedSub,  // Pop two integers, push their difference; error if it doesn't fit in 64 bits
+    CheckedMul,  // Pop two integers, push their product; error if it doesn't fit in 64 bits
+    WrappingAdd, // Pop two integers, push their sum modulo 2^64 as a signed integer
+    WrappingSub, // Pop two integers, push their difference modulo 2^64 as a signed integer
+    WrappingMul, // Pop two integers, push their product modulo 2^64 as a signed integer
+    BitAnd,      // Pop two integers, push the bits set in both, as two's complement
+    BitOr,       // Pop two integers, push the bits set in either, as two's complement
+    BitXor,      // Pop two integers, push the bits set in exactly one, as two's complement
+    BitNot,      // Pop integer n, push its complement -n - 1
+    ShiftLeft,   // Pop integer and count, push integer * 2^count, promoting to a bignum
+    ShiftRight,  // Pop integer and count, push integer / 2^count rounded toward negative infinity
     Neg,
     Leq,
     Lt,
@@ -15,13 +31,20 @@ pub enum Instruction {
     Gte,
     Eq,
     Neq,
-    JmpIfFalse(usize),
+    NumEq, // Pop two numbers, push whether they're equal (=); anything else is a type error
+    JmpIfFalse(usize),      // Pop value, jump if it is false; every other value counts as true
+    JmpIfFalseOrPop(usize), // and: if the top value is false, jump leaving it there; otherwise pop it
+    JmpIfTrueOrPop(usize),  // or: if the top value is anything but false, jump leaving it there; otherwise pop it
     Jmp(usize),
     Call(String, usize),
     TailCall(String, usize), // Tail call: reuse current frame instead of pushing new one
+    CallCached(String, usize, usize),     // Call through inline cache slot N; the VM links each Call into one, the compiler never emits it
+    TailCallCached(String, usize, usize), // TailCall through inline cache slot N, linked like CallCached
     Ret,
     LoadArg(usize),
     GetLocal(usize), // Load from value stack at position (from bottom)
+    AddArgs(usize, usize),   // Push the sum of two arguments (LoadArg, LoadArg, Add fused by the peephole pass)
+    AddLocals(usize, usize), // Push the sum of two stack positions (GetLocal, GetLocal, Add fused by the peephole pass)
     PopN(usize),     // Pop N values from the stack
     Slide(usize),    // Pop top value, pop N values, push top value back (cleanup let bindings)
     CheckArity(usize, usize), // Check if frame.locals.len() == expected_arity, jump to addr if not
@@ -29,11 +52,43 @@ pub enum Instruction {
     MakeClosure(Vec<String>, Vec<Instruction>, usize), // Create closure: (params, body, num_captured_vars)
     MakeVariadicClosure(Vec<String>, String, Vec<Instruction>, usize), // Variadic closure: (required_params, rest_param, body, num_captured)
     CallClosure(usize), // Call closure with N arguments (pops closure + args from stack)
+    TailCallClosure(usize), // Tail call closure with N arguments: reuse current frame instead of pushing one
     Apply,              // Apply function to list of arguments: pop list, pop function/closure, call with list elements as args
+    TailApply,          // Apply in tail position: reuse the current frame instead of pushing one
+    PrependArgs(usize), // Pop list and N values below it, push the values followed by the list's elements
     LoadCaptured(usize), // Load captured variable at index from current closure's environment
     SetLocal(usize),    // Set local variable at position on value stack
-    BeginLoop(usize),   // Mark loop start with N bindings
-    Recur(usize),       // Recur with N new values: update loop bindings and jump back
+    StoreArg(usize),    // Pop value, store it in argument slot N of the current frame (set! on a parameter)
+    MakeCell,           // Push a new uninitialized cell (letrec binding slot)
+    CellGet(String),    // Pop cell, push its contents (error naming the binding if uninitialized)
+    CellSet,            // Pop cell, pop value, store value into the cell
+    Values(usize),      // Pop N values; return them all plus a count to call-with-values, else keep only the first
+    CallForValues,      // Pop producer, call it with no arguments, collecting every value it returns
+    ApplyValues,        // Pop value count, that many values, then the consumer; call the consumer with the values
+    PushHandler(usize), // Install an error handler that resumes at the address with the raised value pushed
+    PopHandler,         // Remove the innermost handler once its protected expression has returned
+    Raise,              // Pop value, unwind to the innermost handler and give it the value
+    PushCatch(usize),   // Pop tag, install a catch for it that resumes at the address with the thrown value pushed
+    Throw,              // Pop value and tag, unwind to the innermost catch for the tag and give it the value
+    CollectGarbage,     // Run a garbage collection now, push the number of objects it reclaimed
+    GetGcStats,         // Push a map of the collector's counters, for (gc-stats)
+    MakeStruct(String, usize), // Pop n fields, push an instance of the named struct type
+    StructGet(String, usize),  // Pop an instance of the named struct type, push its field at the index
+    IsStruct(String),   // Pop value, push whether it's an instance of the named struct type
+    MatchFailed,        // Pop the value a match expression was given, raise a no-matching-clause error showing it
+    ClauseFailed(String), // Raise a no-matching-clause error naming the multi-clause function
+    JumpTable(i64, Vec<usize>, usize), // Pop integer key, jump to the entry at key - min, or to the default when it's out of range
+    MakePromise,        // Pop thunk closure, push a promise that calls it the first time it's forced
+    IsPromise,          // Pop value, push whether it's a promise
+    ForceBegin,         // Pop value, push its forced value and true, or mark the promise Forcing and push its thunk and false
+    ForceEnd,           // Pop promise and its thunk's result, store the result in the promise and push it
+    IsEq,               // Pop two values, push whether they're the same object (eq?); symbols compare by id
+    IsEqv,              // Pop two values, push eqv?: like eq?, but numbers of one type compare by value
+    Equal,              // Pop two values, push equal?: contents compared structurally (error on a cycle)
+    TimeStart,          // Push the instruction count, allocation count and clock reading that TimeEnd measures from
+    TimeEnd,            // Pop result and TimeStart's readings, report the time taken, push result back
+    Assert(String),     // Pop value, raise an assertion error quoting the source text if it's false, else push nil
+    AssertEqual(String), // Pop actual and expected, raise an assertion error showing both unless they're equal?, else push nil
     Print,
     Halt,
     // List operations
@@ -57,9 +112,18 @@ pub enum Instruction {
     StringLength,   // Pop string, push integer length
     Substring,      // Pop string, start, end; push substring
     StringAppend,   // Pop two strings, push concatenation
-    StringToList,   // Pop string, push list of single-char strings
+    StringEq,       // Pop two strings, push boolean indicating equal contents
+    StringToList,   // Pop string, push list of its chars
     ListToString,   // Pop list of strings/chars, push concatenated string
-    CharCode,       // Pop single-char string, push ASCII code as integer
+    CharCode,       // Pop char or single-char string, push its code as integer
+    CharToInteger,  // Pop char, push its Unicode code point
+    IntegerToChar,  // Pop integer code point, push the char
+    CharEq,         // Pop two chars, push boolean indicating they're the same char
+    StringRef,      // Pop string and index, push the char at that index
+    CharLt,         // Pop two chars, push boolean indicating the first has the lower code point
+    IsAlphabetic,   // Pop char, push boolean indicating it's a letter
+    IsNumeric,      // Pop char, push boolean indicating it's a digit
+    IsWhitespace,   // Pop char, push boolean indicating it's whitespace
     StringSplit,    // Pop string and delimiter, push list of substrings
     StringJoin,     // Pop list of strings and delimiter, push joined string
     StringTrim,     // Pop string, push trimmed string (remove leading/trailing whitespace)
@@ -75,15 +139,39 @@ pub enum Instruction {
     Append,         // Pop two lists, push their concatenation (second appended to first)
     MakeList(usize), // Pop N values from stack and create a list from them (in order)
     ListRef,        // Pop list and index, push element at that index (0-based)
+    Nth,            // Pop index and list, push element at that index (0-based), for (nth i lst)
     ListLength,     // Pop list, push its length as integer
+    ListReverse,    // Pop list, push its elements in reverse order
+    Transpose,      // Pop list of lists, push a list of each position's elements, as long as the shortest list
+    Member,         // Pop list and item, push the tail starting at the first element equal? to it, or '()
+    Memq,           // Like Member, comparing with eq?
+    Assoc,          // Pop alist and key, push the first entry whose car is equal? to the key, or '()
+    Assq,           // Like Assoc, comparing with eq?
+    Sort,           // Pop list and comparison, push the list stably sorted by calling the comparison
     // Number operations
-    NumberToString, // Pop integer, push string representation
-    StringToNumber, // Pop string, push integer (or error if not a valid number)
+    NumberToString, // Pop number, push its decimal representation
+    StringToNumber, // Pop string, push the number it spells, or nil if it is not one
+    NumberToStringRadix, // Pop radix (2, 8, 10 or 16) and integer, push its digits in that radix
+    StringToNumberRadix, // Pop radix (2, 8, 10 or 16) and string, push the integer it spells, or nil
     // File I/O operations
     ReadFile,       // Pop string path, push file contents as string (or error)
     WriteFile,      // Pop string path, string content; push boolean success
     FileExists,     // Pop string path, push boolean indicating if file exists
     WriteBinaryFile, // Pop string path, list of integers (bytes); write binary file
+    AppendFile,     // Pop string path, string content; add the content to the end of the file, push true
+    ReadLine,       // Push the next line of input without its newline, or nil at end of input
+    ReadLineFrom,   // Pop input port, push its next line without the newline, or nil at end of file
+    Read,           // Push the next datum of input, as quote would give it, or nil at end of input
+    ReadFromString, // Pop string, push the first datum written in it
+    OpenInputFile,  // Pop string path, push an input port reading the file
+    OpenOutputFile, // Pop string path, push an output port writing the file (created or truncated)
+    ClosePort,      // Pop port, flush and release its file (nothing if already closed), push true
+    PrintTo,        // Pop port and value, write the value as print does to the port, push the value
+    Write,          // Pop value, write it to stdout as the reader would read it back (no newline), push the value
+    WriteTo,        // Pop port and value, write it as write does to the port, push the value
+    Display,        // Pop value, write it to stdout for people: strings and chars as their text (no newline), push the value
+    DisplayTo,      // Pop port and value, write it as display does to the port, push the value
+    PrettyPrint,    // Pop max length, max depth and value, write the value to stdout cut to those limits and broken to fit the line, push the value
     LoadFile,       // Pop string path, load and execute Lisp file in current environment
     RequireFile,    // Pop string path, load and execute Lisp file only if not already loaded
     // Global variables
@@ -91,18 +179,30 @@ pub enum Instruction {
     StoreGlobal(String), // Pop value from stack and store in global variable
     // Command-line arguments
     GetArgs,             // Push command-line arguments as a list of strings
+    GetEnv,              // Pop variable name, push its value in the environment as a string, or nil if unset
+    Exit,                // Pop exit code (0-255), stop the program: the VM unwinds and run returns with exit_code set
+    // Keyword arguments of &key functions, with the keywords as ":name" symbols
+    CheckKeywords(String, Vec<String>), // Check the keyword argument list on top of the stack gives only (function, keywords), each once; leave it there
+    HasKeyword(String),  // Pop keyword argument list, push whether it gives the keyword
+    GetKeyword(String),  // Pop keyword argument list, push the value it gives the keyword
     // HashMap operations
     MakeHashMap(usize),  // Pop N key-value pairs from stack (key1, val1, key2, val2, ...) and create a hashmap
     HashMapGet,          // Pop hashmap and key, push value (or error if not found)
     HashMapSet,          // Pop hashmap, key, value; push new hashmap with key-value set
+    HashMapSetInPlace,   // Pop hashmap, key, value; set the key in the hashmap itself and push the hashmap
     HashMapKeys,         // Pop hashmap, push list of keys
     HashMapValues,       // Pop hashmap, push list of values
     HashMapContainsKey,  // Pop hashmap and key, push boolean
+    HashMapGetOr,        // Pop hashmap, key, default; push value, or the default if the key is missing
+    HashMapRemove,       // Pop hashmap and key, remove the key from the hashmap itself and push the hashmap
+    HashMapCount,        // Pop hashmap, push its number of entries
     IsHashMap,           // Pop value, push boolean indicating if it's a hashmap
     // Vector operations
     MakeVector(usize),   // Pop N values from stack and create a vector from them (in order)
+    MakeVectorFilled,    // Pop fill value and size, push vector of that size with every slot set to the fill
     VectorGet,           // Pop vector and index, push element at that index (0-based)
     VectorSet,           // Pop vector, index, value; push new vector with element at index set
+    VectorSetInPlace,    // Pop vector, index, value; store value at index in that vector and push it
     VectorPush,          // Pop vector and value, push new vector with value appended
     VectorPop,           // Pop vector, push vector without last element and the last element
     VectorLength,        // Pop vector, push its length as integer
@@ -121,6 +221,7 @@ pub enum Instruction {
     Atan2,               // Pop y and x, push atan2(y, x) as float
     Floor,               // Pop number, push floor as integer
     Ceil,                // Pop number, push ceiling as integer
+    Round,               // Pop number, push nearest integer (halfway cases round away from zero)
     Abs,                 // Pop number, push absolute value (same type)
     Pow,                 // Pop base and exponent, push power as float
     Log,                 // Pop number, push natural logarithm as float
@@ -130,28 +231,52 @@ pub enum Instruction {
     SeedRandom,          // Pop seed, set random seed (returns seed)
     // Date/Time operations
     CurrentTimestamp,    // Push current Unix timestamp as integer (seconds since epoch)
+    CurrentTimeMillis,   // Push milliseconds since the Unix epoch as integer
     FormatTimestamp,     // Pop timestamp and format string, push formatted date string
     // Metaprogramming
-    Eval,                // Pop string, parse and evaluate as Lisp code, push result
+    Eval,                // Pop a form or a string of code, compile and run it, push its value
     // Reflection - Function Introspection
     FunctionArity,       // Pop function/closure, push arity as integer (-1 for variadic)
     FunctionParams,      // Pop closure, push list of parameter names as strings
     ClosureCaptured,     // Pop closure, push list of (name, value) pairs for captured variables
     FunctionName,        // Pop function, push name as string (error if closure)
+    Disassemble,         // Pop function name/function/closure, push disassembly listing as string
+    // Tracing: a traced function's bytecode is [TraceCall(name), TraceReturn, Ret]
+    Trace,               // Pop function or name, make its calls print as they enter and return, push its name
+    Untrace,             // Pop function or name, restore the definition it had before trace, push its name
+    TraceCall(String),   // Print the call of the current frame, then run the traced function's own bytecode in a new frame
+    TraceReturn,         // Print the value on top of the stack as a traced call's result
     // Type inspection
     TypeOf,              // Pop value, push symbol representing its type
     // Symbol generation
     GenSym,              // Push a unique symbol
+    GenSymPrefix,        // Pop a prefix string, push a unique symbol named after it
     // Parallel Collections (Phase 12a)
     PMap,                // Pop list and function, parallel map, push result list
     PFilter,             // Pop list and predicate, parallel filter, push result list
     PReduce,             // Pop list, initial value, and binary function, parallel reduce, push result
     // HTTP/Networking (Phase 14)
     HttpListen,          // Pop port (integer), push TcpListener
-    HttpAccept,          // Pop TcpListener, push TcpStream (blocking)
+    HttpAccept,          // Pop TcpListener, push TcpStream (blocking, or letting other tasks run while none is waiting)
     HttpReadRequest,     // Pop TcpStream, push request hashmap (method, path, headers, body)
     HttpSendResponse,    // Pop TcpStream and response hashmap (status, headers, body), push boolean success
     HttpClose,           // Pop TcpStream, close connection
+    // Raw TCP sockets
+    TcpListen,           // Pop port (integer), push TcpListener
+    TcpAccept,           // Pop TcpListener, push TcpStream for the next connection (blocking, or letting other tasks run meanwhile)
+    SocketRead,          // Pop TcpStream and max byte count, push up to that many bytes as a string, or nil once the peer closes
+    SocketWrite,         // Pop TcpStream and string, send all of it, push the number of bytes written
+    SocketClose,         // Pop TcpStream, shut down both directions (nothing if already closed), push true
+    // Cooperative tasks, switched between in the outermost run
+    Spawn,               // Pop thunk, push a new task that will call it, queued behind the runnable ones
+    Yield,               // Push true, let every other runnable task run before going on
+    Sleep,               // Pop milliseconds, push true once that long has passed, other tasks running meanwhile
+    MakeChannel,         // Push a new unbuffered channel
+    ChanSend,            // Pop value and channel, push true once a receiver has taken the value
+    ChanRecv,            // Pop channel, push the value a sender gives it, waiting for one
+    TaskResult,          // Pop task, push its thunk's value, or the error that ended it, waiting for it to finish
+    TaskStatus,          // Pop task, push its state: running, runnable, blocked, sleeping, done or failed
+    TaskExit,            // Pop a spawned task's thunk value, finish the task with it and run the next one
     // Multi-threaded HTTP (Phase 14b)
     HttpListenShared,    // Pop port (integer), push SharedTcpListener (thread-safe)
     HttpServeParallel,   // Pop SharedTcpListener, handler closure, num_workers, max_requests; parallel request handling
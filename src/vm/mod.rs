@@ -2,18 +2,30 @@
 // This module contains all the runtime execution components
 
 pub mod value;
+pub mod symbol;
+pub mod bigint;
 pub mod instructions;
 pub mod bytecode;
 pub mod stack;
+pub mod functions;
 pub mod vm;
 pub mod env;
 pub mod builtins;
 pub mod errors;
+pub mod source_map;
+pub mod debugger;
+pub mod profiler;
+pub mod tracer;
+pub mod printer;
+pub mod tasks;
+pub mod port;
 pub mod object;
+pub mod gc;
 pub mod ffi;
 
 // Re-export commonly used types for convenience
-pub use value::{Value, List};
+pub use value::{Value, List, MapKey};
+pub use symbol::Symbol;
 pub use instructions::{Instruction, FfiType};
 pub use vm::VM;
 pub use ffi::FfiState;
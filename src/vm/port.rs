@@ -0,0 +1,86 @@
+// File ports: opened by open-input-file / open-output-file, read with read-line,
+// written with print / println, and released by close-port
+
+use std::fs::File;
+use std::io::{self, BufRead, BufReader, BufWriter, Write};
+
+pub enum Port {
+    Input(BufReader<File>),
+    Output(BufWriter<File>),
+    Closed,
+}
+
+impl Port {
+    pub fn open_input(path: &str) -> io::Result<Port> {
+        Ok(Port::Input(BufReader::new(File::open(path)?)))
+    }
+
+    /// Create the file, or truncate it if it exists
+    pub fn open_output(path: &str) -> io::Result<Port> {
+        Ok(Port::Output(BufWriter::new(File::create(path)?)))
+    }
+
+    /// Next line without its line ending, or None at end of file
+    pub fn read_line(&mut self) -> io::Result<Option<String>> {
+        match self {
+            Port::Input(reader) => read_line(reader),
+            Port::Output(_) => Err(io::Error::new(io::ErrorKind::InvalidInput, "port is an output port")),
+            Port::Closed => Err(io::Error::new(io::ErrorKind::InvalidInput, "port is closed")),
+        }
+    }
+
+    pub fn write_line(&mut self, text: &str) -> io::Result<()> {
+        self.write_text(text)?;
+        self.write_text("\n")
+    }
+
+    pub fn write_text(&mut self, text: &str) -> io::Result<()> {
+        match self {
+            Port::Output(writer) => write!(writer, "{}", text),
+            Port::Input(_) => Err(io::Error::new(io::ErrorKind::InvalidInput, "port is an input port")),
+            Port::Closed => Err(io::Error::new(io::ErrorKind::InvalidInput, "port is closed")),
+        }
+    }
+
+    /// Flush and release the file. Closing a closed port does nothing.
+    pub fn close(&mut self) -> io::Result<()> {
+        let port = std::mem::replace(self, Port::Closed);
+        if let Port::Output(mut writer) = port {
+            writer.flush()?;
+        }
+        Ok(())
+    }
+
+    pub fn is_closed(&self) -> bool {
+        matches!(self, Port::Closed)
+    }
+
+    pub fn kind(&self) -> &'static str {
+        match self {
+            Port::Input(_) => "input",
+            Port::Output(_) => "output",
+            Port::Closed => "closed",
+        }
+    }
+}
+
+/// Read a line from any reader, stripping "\n" or "\r\n". None at end of input.
+pub fn read_line(reader: &mut impl BufRead) -> io::Result<Option<String>> {
+    let mut line = String::new();
+    if reader.read_line(&mut line)? == 0 {
+        return Ok(None);
+    }
+    if line.ends_with('\n') {
+        line.pop();
+        if line.ends_with('\r') {
+            line.pop();
+        }
+    }
+    Ok(Some(line))
+}
+
+impl std::fmt::Debug for Port {
+    fn fmt(&self, f: &mut std::fmt::Formatter) -> std::fmt::Result {
+        write!(f, "Port({})", self.kind())
+    }
+}
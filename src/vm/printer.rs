@@ -0,0 +1,339 @@
+// Value printer behind write, display, print, pp and every message that shows a
+// value. Two things keep what it prints finite:
+//
+//   - a vector or map, the containers a program can change, can end up inside
+//     itself; such a container is labelled #0= where it is first shown and
+//     printed as #0# each time it comes round again
+//   - bounded options (pp, error messages, the tracer and debugger) show
+//     containers only so many levels deep and so many elements long, with ...
+//     standing for the rest
+//
+//   (define v (vector 1 2)) (vector-set! v 1 v)
+//   (write v)                                  #0=#(1 #0#)
+//   (define m (make-hash-table)) (hash-set! m 'me m)
+//   (write m)                                  #0={me #0#}
+//   (pp '(1 (2 (3 (4 (5 (6 (7 (8 (9)))))))))) (1 (2 (3 (4 (5 (6 (7 (8 ...))))))))
+
+use std::collections::{HashMap, HashSet};
+use std::rc::Rc;
+
+use super::value::{Value, List, MapKey, format_char, format_float, format_string};
+
+/// Levels of nested containers a bounded printer shows
+pub const DEFAULT_MAX_DEPTH: usize = 8;
+/// Elements of each container a bounded printer shows
+pub const DEFAULT_MAX_LENGTH: usize = 20;
+/// Columns pp fits its lines to where it can
+pub const LINE_WIDTH: usize = 80;
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct PrintOptions {
+    /// Strings and chars as the reader reads them back (write), or as their text (display)
+    pub readable: bool,
+    /// Levels of lists, vectors, maps and structs shown; deeper ones print as ...
+    pub max_depth: Option<usize>,
+    /// Elements of each list, vector, map or struct shown before a closing ...
+    pub max_length: Option<usize>,
+    /// Label a vector or map shown twice even when it isn't inside itself
+    pub label_shared: bool,
+    /// Closures with their parameter names, <closure (a b)>, rather than <closure/2>
+    pub closure_params: bool,
+}
+
+impl PrintOptions {
+    /// All of a value, as the reader reads it back
+    pub fn write() -> Self {
+        PrintOptions {
+            readable: true,
+            max_depth: None,
+            max_length: None,
+            label_shared: false,
+            closure_params: false,
+        }
+    }
+
+    /// All of a value, strings and chars as their text
+    pub fn display() -> Self {
+        PrintOptions { readable: false, ..Self::write() }
+    }
+
+    /// A value cut down to the default depth and length, with shared vectors labelled
+    pub fn bounded() -> Self {
+        PrintOptions {
+            max_depth: Some(DEFAULT_MAX_DEPTH),
+            max_length: Some(DEFAULT_MAX_LENGTH),
+            label_shared: true,
+            ..Self::write()
+        }
+    }
+
+    pub fn with_limits(self, max_depth: Option<usize>, max_length: Option<usize>) -> Self {
+        PrintOptions { max_depth, max_length, ..self }
+    }
+}
+
+/// `value` on one line
+pub fn print_value(value: &Value, options: &PrintOptions) -> String {
+    let mut out = String::new();
+    Printer::new(value, options).doc(value, 0).write_flat(&mut out);
+    out
+}
+
+/// `value` with each list that doesn't fit in `width` columns broken one
+/// element per line, the elements lined up under each other
+pub fn pretty_print(value: &Value, options: &PrintOptions, width: usize) -> String {
+    let mut out = String::new();
+    Printer::new(value, options).doc(value, 0).write_pretty(&mut out, 0, width);
+    out
+}
+
+// A vector or map, by address
+type ContainerRef = usize;
+
+// A value laid out as text: an atom, or a container whose elements can go on
+// one line or on several
+enum Doc {
+    Text(String),
+    Group { open: String, items: Vec<Doc>, close: String, width: usize },
+}
+
+impl Doc {
+    fn text(text: &str) -> Doc {
+        Doc::Text(text.to_string())
+    }
+
+    fn group(open: String, items: Vec<Doc>, close: &str) -> Doc {
+        let spaces = items.len().saturating_sub(1);
+        let width = open.chars().count() + items.iter().map(Doc::width).sum::<usize>() + spaces + close.chars().count();
+        Doc::Group { open, items, close: close.to_string(), width }
+    }
+
+    // Columns the doc takes on one line
+    fn width(&self) -> usize {
+        match self {
+            Doc::Text(text) => text.chars().count(),
+            Doc::Group { width, .. } => *width,
+        }
+    }
+
+    fn write_flat(&self, out: &mut String) {
+        match self {
+            Doc::Text(text) => out.push_str(text),
+            Doc::Group { open, items, close, .. } => {
+                out.push_str(open);
+                for (i, item) in items.iter().enumerate() {
+                    if i > 0 {
+                        out.push(' ');
+                    }
+                    item.write_flat(out);
+                }
+                out.push_str(close);
+            }
+        }
+    }
+
+    fn write_pretty(&self, out: &mut String, column: usize, width: usize) {
+        match self {
+            Doc::Group { open, items, close, width: flat_width } if column + flat_width > width => {
+                out.push_str(open);
+                let mut indent = column + open.chars().count();
+                // An atom heading a list stays on its line, (let ..., and the
+                // rest line up under the element after it
+                let mut items = &items[..];
+                if let [head @ Doc::Text(_), _, ..] = items {
+                    head.write_flat(out);
+                    out.push(' ');
+                    indent += head.width() + 1;
+                    items = &items[1..];
+                }
+                for (i, item) in items.iter().enumerate() {
+                    if i > 0 {
+                        out.push('\n');
+                        out.push_str(&" ".repeat(indent));
+                    }
+                    item.write_pretty(out, indent, width);
+                }
+                out.push_str(close);
+            }
+            doc => doc.write_flat(out),
+        }
+    }
+}
+
+struct Printer<'a> {
+    options: &'a PrintOptions,
+    labels: HashMap<ContainerRef, Option<usize>>, // Vectors and maps to label, with their label once shown
+    next_label: usize,
+}
+
+impl<'a> Printer<'a> {
+    // Printer for `value`, knowing already which of its vectors need labels
+    fn new(value: &Value, options: &'a PrintOptions) -> Self {
+        let mut printer = Printer { options, labels: HashMap::new(), next_label: 0 };
+        printer.find_labels(value, 0, &mut HashSet::new(), &mut HashSet::new());
+        printer
+    }
+
+    fn shows_contents(&self, depth: usize) -> bool {
+        self.options.max_depth.map_or(true, |max| depth < max)
+    }
+
+    fn shown_length(&self) -> usize {
+        self.options.max_length.unwrap_or(usize::MAX)
+    }
+
+    // Walk what will be printed, in the order it is printed, marking each vector
+    // or map met again while inside itself (or met again at all, for
+    // label_shared). `inside` holds the containers enclosing `value`, `seen`
+    // every one walked.
+    fn find_labels(&mut self, value: &Value, depth: usize, inside: &mut HashSet<ContainerRef>, seen: &mut HashSet<ContainerRef>) {
+        if !self.shows_contents(depth) {
+            return;
+        }
+        let length = self.shown_length();
+        match value {
+            Value::List(list) => {
+                for item in list.iter().take(length) {
+                    self.find_labels(item, depth + 1, inside, seen);
+                }
+            }
+            Value::Vector(_) | Value::HashMap(_) => {
+                let container = container_ref(value);
+                if inside.contains(&container) || (self.options.label_shared && seen.contains(&container)) {
+                    self.labels.insert(container, None);
+                    return;
+                }
+                if !seen.insert(container) {
+                    return;
+                }
+                inside.insert(container);
+                let items: Vec<Value> = match value {
+                    Value::Vector(items) => items.borrow().iter().take(length).cloned().collect(),
+                    Value::HashMap(map) => sorted_entries(&map.borrow()).into_iter().take(length).map(|(_, item)| item.clone()).collect(),
+                    _ => Vec::new(),
+                };
+                for item in &items {
+                    self.find_labels(item, depth + 1, inside, seen);
+                }
+                inside.remove(&container);
+            }
+            Value::Struct(data) => {
+                for field in data.fields.iter().take(length) {
+                    self.find_labels(field, depth + 1, inside, seen);
+                }
+            }
+            _ => {}
+        }
+    }
+
+    fn doc(&mut self, value: &Value, depth: usize) -> Doc {
+        let is_container = matches!(value, Value::List(List::Cons(_)) | Value::Vector(_) | Value::HashMap(_) | Value::Struct(_));
+        if is_container && !self.shows_contents(depth) {
+            return Doc::text("...");
+        }
+        match value {
+            Value::Integer(n) => Doc::Text(n.to_string()),
+            Value::BigInt(n) => Doc::Text(n.to_string()),
+            Value::Float(f) => Doc::Text(format_float(*f)),
+            Value::Boolean(b) => Doc::Text(b.to_string()),
+            Value::Char(c) if self.options.readable => Doc::Text(format_char(*c)),
+            Value::Char(c) => Doc::Text(c.to_string()),
+            Value::String(s) if self.options.readable => Doc::Text(format_string(s)),
+            Value::String(s) => Doc::Text(s.to_string()),
+            Value::Symbol(s) => Doc::Text(s.to_string()),
+            Value::List(list) => {
+                let items = self.items(list.iter(), depth);
+                Doc::group("(".to_string(), items, ")")
+            }
+            Value::Vector(items) => {
+                let open = match self.label(value) {
+                    Ok(label) => format!("{}#(", label),
+                    Err(seen) => return seen,
+                };
+                let items = self.items(items.borrow().iter(), depth);
+                Doc::group(open, items, ")")
+            }
+            Value::HashMap(map) => {
+                let open = match self.label(value) {
+                    Ok(label) => format!("{}{{", label),
+                    Err(seen) => return seen,
+                };
+                let length = self.shown_length();
+                let map = map.borrow();
+                let entries = sorted_entries(&map);
+                let mut items: Vec<Doc> = entries.iter().take(length)
+                    .map(|(key, item)| {
+                        let pair = vec![self.doc(&key.to_value(), depth + 1), self.doc(item, depth + 1)];
+                        Doc::group(String::new(), pair, "")
+                    })
+                    .collect();
+                if entries.len() > length {
+                    items.push(Doc::text("..."));
+                }
+                Doc::group(open, items, "}")
+            }
+            Value::Struct(data) => {
+                let mut items = vec![Doc::Text(data.name.to_string())];
+                items.extend(self.items(data.fields.iter(), depth));
+                Doc::group("#<".to_string(), items, ">")
+            }
+            Value::Function(name) => Doc::Text(format!("<function {}>", name)),
+            Value::Closure(closure_data) if self.options.closure_params => {
+                Doc::Text(format!("<closure ({})>", closure_data.params.join(" ")))
+            }
+            Value::Closure(closure_data) => Doc::Text(format!("<closure/{}>", closure_data.params.len())),
+            Value::TcpListener(_) => Doc::text("<tcp-listener>"),
+            Value::TcpStream(_) => Doc::text("<tcp-stream>"),
+            Value::SharedTcpListener(_) => Doc::text("<shared-tcp-listener>"),
+            Value::Pointer(p) => Doc::Text(format!("<pointer 0x{:x}>", p)),
+            Value::Cell(_) => Doc::text("<cell>"),
+            Value::Port(port) => Doc::Text(format!("<{}-port>", port.borrow().kind())),
+            Value::Promise(_) => Doc::text("<promise>"),
+            Value::Task(task) => Doc::Text(format!("<task {}>", task.borrow().id)),
+            Value::Channel(_) => Doc::text("<channel>"),
+        }
+    }
+
+    // The #0= to open a labelled container with, empty for one without a label,
+    // or Err with the #0# it prints as once its label was shown
+    fn label(&mut self, container: &Value) -> Result<String, Doc> {
+        match self.labels.get_mut(&container_ref(container)) {
+            Some(Some(n)) => Err(Doc::Text(format!("#{}#", n))),
+            Some(label) => {
+                *label = Some(self.next_label);
+                self.next_label += 1;
+                Ok(format!("#{}=", self.next_label - 1))
+            }
+            None => Ok(String::new()),
+        }
+    }
+
+    // The elements of a container one level below `depth`, up to the length limit
+    fn items<'v>(&mut self, values: impl Iterator<Item = &'v Value>, depth: usize) -> Vec<Doc> {
+        let length = self.shown_length();
+        let mut docs = Vec::new();
+        for (i, value) in values.enumerate() {
+            if i == length {
+                docs.push(Doc::text("..."));
+                break;
+            }
+            docs.push(self.doc(value, depth + 1));
+        }
+        docs
+    }
+}
+
+fn container_ref(value: &Value) -> ContainerRef {
+    match value {
+        Value::Vector(items) => Rc::as_ptr(items) as usize,
+        Value::HashMap(map) => Rc::as_ptr(map) as usize,
+        _ => 0,
+    }
+}
+
+// Entries sorted by key, so a map always prints the same way
+fn sorted_entries(map: &HashMap<MapKey, Value>) -> Vec<(&MapKey, &Value)> {
+    let mut entries: Vec<(&MapKey, &Value)> = map.iter().collect();
+    entries.sort_by(|a, b| a.0.cmp(b.0));
+    entries
+}
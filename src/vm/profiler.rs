@@ -0,0 +1,265 @@
+// Execution profiler: per-function call counts, instruction counts and wall time,
+// and how often each opcode ran. The VM only calls into it when one is attached (see VM::run)
+
+use std::collections::HashMap;
+use std::mem::Discriminant;
+use std::time::{Duration, Instant};
+
+use super::instructions::Instruction;
+use super::stack::Frame;
+
+/// Name the top-level program is profiled under
+pub const MAIN: &str = "<main>";
+
+/// What one function cost over a run. Inclusive figures count the functions it
+/// called as well; a recursive function's inclusive figures count each outermost
+/// call once.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct FunctionProfile {
+    pub calls: u64,
+    pub exclusive_instructions: u64,
+    pub inclusive_instructions: u64,
+    pub exclusive_time: Duration,
+    pub inclusive_time: Duration,
+}
+
+struct OpcodeCount {
+    name: String,
+    count: u64,
+}
+
+// A call the profiler is inside, mirroring a frame of the VM's call stack
+struct ActiveCall {
+    function: String,
+    entered: Instant,
+    instructions_at_entry: u64,
+}
+
+pub struct Profiler {
+    functions: HashMap<String, FunctionProfile>,
+    opcodes: HashMap<Discriminant<Instruction>, OpcodeCount>,
+    active: Vec<ActiveCall>,               // <main> first, then one per VM frame
+    active_depths: HashMap<String, usize>, // Active calls per function, so recursion is inclusive once
+    instructions: u64,
+    started: Option<Instant>,
+    last_switch: Instant, // When the running function last changed, for exclusive time
+    total_time: Duration,
+}
+
+impl Profiler {
+    pub fn new() -> Self {
+        Profiler {
+            functions: HashMap::new(),
+            opcodes: HashMap::new(),
+            active: Vec::new(),
+            active_depths: HashMap::new(),
+            instructions: 0,
+            started: None,
+            last_switch: Instant::now(),
+            total_time: Duration::ZERO,
+        }
+    }
+
+    /// Begin a run whose call stack already holds `frames`
+    pub(super) fn start(&mut self, frames: &[Frame]) {
+        let now = Instant::now();
+        self.started = Some(now);
+        self.last_switch = now;
+        self.enter(MAIN, now);
+        for frame in frames {
+            self.enter(&frame.function_name, now);
+        }
+    }
+
+    /// Count the instruction about to run against the function running it
+    pub(super) fn count_instruction(&mut self, instruction: &Instruction) {
+        self.instructions += 1;
+        if let Some(call) = self.active.last() {
+            self.functions.get_mut(&call.function).expect("active function is profiled").exclusive_instructions += 1;
+        }
+        self.opcodes.entry(std::mem::discriminant(instruction))
+            .or_insert_with(|| OpcodeCount { name: opcode_name(instruction), count: 0 })
+            .count += 1;
+    }
+
+    /// Catch up with the call stack after an instruction. `reused_frame` is set when
+    /// the instruction was a tail call that replaced the top frame, which ends the
+    /// caller's call and starts the callee's.
+    pub(super) fn sync_calls(&mut self, frames: &[Frame], reused_frame: bool) {
+        let depth = frames.len() + 1;
+        if self.active.len() == depth && !reused_frame {
+            return;
+        }
+        let now = Instant::now();
+        while self.active.len() > depth {
+            self.exit(now);
+        }
+        if reused_frame && self.active.len() == depth && depth > 1 {
+            self.exit(now);
+        }
+        while self.active.len() < depth {
+            self.enter(&frames[self.active.len() - 1].function_name, now);
+        }
+    }
+
+    /// End the run, closing the calls still active when it stopped
+    pub(super) fn finish(&mut self) {
+        let now = Instant::now();
+        while !self.active.is_empty() {
+            self.exit(now);
+        }
+        if let Some(started) = self.started.take() {
+            self.total_time += now - started;
+        }
+    }
+
+    fn enter(&mut self, function: &str, now: Instant) {
+        self.charge_running(now);
+        self.functions.entry(function.to_string()).or_default().calls += 1;
+        *self.active_depths.entry(function.to_string()).or_default() += 1;
+        self.active.push(ActiveCall {
+            function: function.to_string(),
+            entered: now,
+            instructions_at_entry: self.instructions,
+        });
+    }
+
+    fn exit(&mut self, now: Instant) {
+        self.charge_running(now);
+        let call = match self.active.pop() {
+            Some(call) => call,
+            None => return,
+        };
+        let depth = self.active_depths.get_mut(&call.function).expect("active function has a depth");
+        *depth -= 1;
+        if *depth == 0 {
+            let profile = self.functions.get_mut(&call.function).expect("active function is profiled");
+            profile.inclusive_instructions += self.instructions - call.instructions_at_entry;
+            profile.inclusive_time += now - call.entered;
+        }
+    }
+
+    // Give the time since the last switch to the function that was running
+    fn charge_running(&mut self, now: Instant) {
+        if let Some(call) = self.active.last() {
+            self.functions.get_mut(&call.function).expect("active function is profiled").exclusive_time += now - self.last_switch;
+        }
+        self.last_switch = now;
+    }
+
+    pub fn function(&self, name: &str) -> Option<&FunctionProfile> {
+        self.functions.get(name)
+    }
+
+    /// Profiled functions, the one that ran the most instructions itself first.
+    /// Instruction counts are the same on every run, so the order is too.
+    pub fn functions(&self) -> Vec<(&str, &FunctionProfile)> {
+        let mut functions: Vec<(&str, &FunctionProfile)> = self.functions.iter()
+            .map(|(name, profile)| (name.as_str(), profile))
+            .collect();
+        functions.sort_by(|(a_name, a), (b_name, b)| {
+            b.exclusive_instructions.cmp(&a.exclusive_instructions).then_with(|| a_name.cmp(b_name))
+        });
+        functions
+    }
+
+    /// How many times each opcode ran, most frequent first
+    pub fn opcodes(&self) -> Vec<(&str, u64)> {
+        let mut opcodes: Vec<(&str, u64)> = self.opcodes.values()
+            .map(|opcode| (opcode.name.as_str(), opcode.count))
+            .collect();
+        opcodes.sort_by(|(a_name, a), (b_name, b)| b.cmp(a).then_with(|| a_name.cmp(b_name)));
+        opcodes
+    }
+
+    pub fn total_instructions(&self) -> u64 {
+        self.instructions
+    }
+
+    /// Tables of the functions and opcodes, for printing when the program exits
+    pub fn report(&self) -> String {
+        let mut output = String::new();
+        output.push_str(&format!(
+            "Profile: {} instructions in {:.3} ms\n\n",
+            self.instructions,
+            millis(self.total_time)
+        ));
+        output.push_str(&format!(
+            "{:<24} {:>10} {:>14} {:>14} {:>12} {:>12}\n",
+            "function", "calls", "excl instrs", "incl instrs", "excl ms", "incl ms"
+        ));
+        for (name, profile) in self.functions() {
+            output.push_str(&format!(
+                "{:<24} {:>10} {:>14} {:>14} {:>12.3} {:>12.3}\n",
+                name,
+                profile.calls,
+                profile.exclusive_instructions,
+                profile.inclusive_instructions,
+                millis(profile.exclusive_time),
+                millis(profile.inclusive_time)
+            ));
+        }
+        output.push_str(&format!("\n{:<24} {:>14} {:>8}\n", "opcode", "count", "%"));
+        for (name, count) in self.opcodes() {
+            let percent = 100.0 * count as f64 / self.instructions.max(1) as f64;
+            output.push_str(&format!("{:<24} {:>14} {:>7.2}%\n", name, count, percent));
+        }
+        output
+    }
+
+    /// The profile as JSON, for the benchmark scripts. Times are in microseconds.
+    pub fn to_json(&self) -> String {
+        let functions: Vec<String> = self.functions().iter()
+            .map(|(name, profile)| format!(
+                "{{\"name\": {}, \"calls\": {}, \"exclusive_instructions\": {}, \"inclusive_instructions\": {}, \"exclusive_time_us\": {}, \"inclusive_time_us\": {}}}",
+                json_string(name),
+                profile.calls,
+                profile.exclusive_instructions,
+                profile.inclusive_instructions,
+                profile.exclusive_time.as_micros(),
+                profile.inclusive_time.as_micros()
+            ))
+            .collect();
+        let opcodes: Vec<String> = self.opcodes().iter()
+            .map(|(name, count)| format!("{{\"opcode\": {}, \"count\": {}}}", json_string(name), count))
+            .collect();
+        format!(
+            "{{\n  \"total_instructions\": {},\n  \"total_time_us\": {},\n  \"functions\": [\n    {}\n  ],\n  \"opcodes\": [\n    {}\n  ]\n}}\n",
+            self.instructions,
+            self.total_time.as_micros(),
+            functions.join(",\n    "),
+            opcodes.join(",\n    ")
+        )
+    }
+}
+
+impl Default for Profiler {
+    fn default() -> Self {
+        Profiler::new()
+    }
+}
+
+// The variant name of an instruction, without its operands
+fn opcode_name(instruction: &Instruction) -> String {
+    let debug = format!("{:?}", instruction);
+    let end = debug.find(|c: char| c == '(' || c == ' ' || c == '{').unwrap_or(debug.len());
+    debug[..end].to_string()
+}
+
+fn millis(duration: Duration) -> f64 {
+    duration.as_secs_f64() * 1000.0
+}
+
+fn json_string(s: &str) -> String {
+    let mut quoted = String::from("\"");
+    for c in s.chars() {
+        match c {
+            '"' => quoted.push_str("\\\""),
+            '\\' => quoted.push_str("\\\\"),
+            c if (c as u32) < 0x20 => quoted.push_str(&format!("\\u{:04x}", c as u32)),
+            c => quoted.push(c),
+        }
+    }
+    quoted.push('"');
+    quoted
+}
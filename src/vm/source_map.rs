@@ -0,0 +1,153 @@
+// Source maps: side tables from instruction offsets back to source positions
+// Used to attach call site locations to runtime error stack traces
+
+use std::collections::HashMap;
+
+use super::errors::Location;
+
+/// Run-length table for one bytecode sequence. Each entry covers the
+/// instructions from its offset up to the next entry's offset.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct SourceMap {
+    entries: Vec<(usize, Location)>,
+}
+
+impl SourceMap {
+    pub fn new() -> Self {
+        SourceMap { entries: Vec::new() }
+    }
+
+    /// Record that instructions from `offset` onwards come from `location`
+    pub fn record(&mut self, offset: usize, location: &Location) {
+        if let Some((last_offset, last_location)) = self.entries.last_mut() {
+            if last_location == location {
+                return;
+            }
+            if *last_offset == offset {
+                *last_location = location.clone();
+                return;
+            }
+        }
+        self.entries.push((offset, location.clone()));
+    }
+
+    /// Find the source position of the instruction at `offset`
+    pub fn lookup(&self, offset: usize) -> Option<&Location> {
+        let index = match self.entries.binary_search_by_key(&offset, |(start, _)| *start) {
+            Ok(i) => i,
+            Err(0) => return None,
+            Err(i) => i - 1,
+        };
+        let location = &self.entries[index].1;
+        if location.file == "<unknown>" {
+            None
+        } else {
+            Some(location)
+        }
+    }
+
+    pub fn entries(&self) -> &[(usize, Location)] {
+        &self.entries
+    }
+
+    /// Follow a pass that deleted the instructions whose `kept` flag is false
+    pub fn retain(&mut self, kept: &[bool]) {
+        let new_offsets = relocation_table(kept);
+        let mut relocated = SourceMap::new();
+        for (offset, location) in &self.entries {
+            relocated.record(new_offsets[(*offset).min(kept.len())], location);
+        }
+        *self = relocated;
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.entries.is_empty()
+    }
+}
+
+/// Source maps for a whole program: the main bytecode plus each named function
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct SourceMaps {
+    pub main: SourceMap,
+    pub functions: HashMap<String, SourceMap>,
+}
+
+impl SourceMaps {
+    pub fn new() -> Self {
+        SourceMaps::default()
+    }
+}
+
+/// Run-length table of the let-bound names in scope across one bytecode sequence,
+/// as (stack slot from the frame's base, name) pairs. The debugger uses it to name
+/// the values a frame keeps on the value stack.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct SlotNames {
+    entries: Vec<(usize, Vec<(usize, String)>)>,
+}
+
+impl SlotNames {
+    pub fn new() -> Self {
+        SlotNames { entries: Vec::new() }
+    }
+
+    /// Record that from `offset` onwards the named slots are `slots`
+    pub fn record(&mut self, offset: usize, slots: Vec<(usize, String)>) {
+        if let Some((last_offset, last_slots)) = self.entries.last_mut() {
+            if *last_slots == slots {
+                return;
+            }
+            if *last_offset == offset {
+                *last_slots = slots;
+                return;
+            }
+        }
+        self.entries.push((offset, slots));
+    }
+
+    /// Follow a pass that deleted the instructions whose `kept` flag is false
+    pub fn retain(&mut self, kept: &[bool]) {
+        let new_offsets = relocation_table(kept);
+        let mut relocated = SlotNames::new();
+        for (offset, slots) in &self.entries {
+            relocated.record(new_offsets[(*offset).min(kept.len())], slots.clone());
+        }
+        *self = relocated;
+    }
+
+    /// The named slots at the instruction at `offset`
+    pub fn lookup(&self, offset: usize) -> &[(usize, String)] {
+        let index = match self.entries.binary_search_by_key(&offset, |(start, _)| *start) {
+            Ok(i) => i,
+            Err(0) => return &[],
+            Err(i) => i - 1,
+        };
+        &self.entries[index].1
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.entries.is_empty()
+    }
+}
+
+/// Slot names for a whole program: the main bytecode plus each named function
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct ProgramSlotNames {
+    pub main: SlotNames,
+    pub functions: HashMap<String, SlotNames>,
+}
+
+/// New offset of every old offset (and of the end) once the instructions whose
+/// `kept` flag is false are deleted. A deleted instruction maps to the next kept one.
+pub fn relocation_table(kept: &[bool]) -> Vec<usize> {
+    let mut offsets = Vec::with_capacity(kept.len() + 1);
+    let mut next = 0;
+    for &keep in kept {
+        offsets.push(next);
+        if keep {
+            next += 1;
+        }
+    }
+    offsets.push(next);
+    offsets
+}
@@ -1,3 +1,5 @@
+use std::rc::Rc;
+
 use super::value::Value;
 use super::instructions::Instruction;
 
@@ -5,19 +7,17 @@ use super::instructions::Instruction;
 pub struct Frame {
     pub return_address: usize,
     pub locals: Vec<Value>,
-    pub return_bytecode: Vec<Instruction>, // Bytecode to return to after function call
+    pub return_bytecode: Rc<Vec<Instruction>>, // Bytecode to return to after function call
     pub function_name: String, // For stack traces
     pub captured: Vec<Value>, // Captured variables for closures
     pub stack_base: usize, // Base position of this function's locals on the value stack
-    pub loop_start: Option<usize>, // Address of loop start for recur
-    pub loop_bindings_start: Option<usize>, // Stack position where loop bindings start
-    pub loop_bindings_count: Option<usize>, // Number of loop bindings
+    pub multiple_values: bool, // Called by call-with-values: return every value plus a count
 }
 
 impl Frame {
     pub fn new(
         return_address: usize,
-        return_bytecode: Vec<Instruction>,
+        return_bytecode: Rc<Vec<Instruction>>,
         function_name: String,
         stack_base: usize,
     ) -> Self {
@@ -28,9 +28,20 @@ impl Frame {
             function_name,
             captured: Vec::new(),
             stack_base,
-            loop_start: None,
-            loop_bindings_start: None,
-            loop_bindings_count: None,
+            multiple_values: false,
         }
     }
 }
+
+/// An error handler installed by handler-case, or a catch for a throw tag. Raising
+/// (or throwing to the tag) unwinds to the state recorded here and resumes at the
+/// catch address with the raised value pushed.
+#[derive(Debug)]
+pub struct Handler {
+    pub catch_address: usize,
+    pub bytecode: Rc<Vec<Instruction>>, // Bytecode containing the catch address
+    pub call_depth: usize, // Frames below the handler, kept when unwinding
+    pub stack_depth: usize, // Value stack length when the handler was installed
+    pub run_depth: usize, // Nested run (load, require, eval) that installed the handler
+    pub tag: Option<Value>, // Tag a catch takes throws for; handler-case handlers have none
+}
@@ -0,0 +1,127 @@
+// Interned symbols
+//
+// Every symbol name is stored once in a process-wide table, and a symbol value is
+// just its index there. The compiler interns the symbols it emits and
+// string->symbol interns at run time, so two symbols with the same name always
+// share an id and comparing them is an integer comparison. Names are never freed;
+// a program only has as many distinct symbols as it spells out or builds.
+//
+// gensym adds names no other symbol has yet. Each starts with #:, where the
+// reader ends a symbol, so no symbol read from source can ever equal one.
+
+use std::cmp::Ordering;
+use std::collections::HashMap;
+use std::fmt;
+use std::ops::Deref;
+use std::sync::{OnceLock, RwLock};
+
+#[derive(Default)]
+struct SymbolTable {
+    ids: HashMap<&'static str, u32>,
+    names: Vec<&'static str>,
+    gensyms: usize, // Counter for the names gensym makes
+}
+
+impl SymbolTable {
+    fn insert(&mut self, name: &str) -> u32 {
+        let id = self.names.len() as u32;
+        let name: &'static str = Box::leak(name.to_string().into_boxed_str());
+        self.names.push(name);
+        self.ids.insert(name, id);
+        id
+    }
+}
+
+fn table() -> &'static RwLock<SymbolTable> {
+    static TABLE: OnceLock<RwLock<SymbolTable>> = OnceLock::new();
+    TABLE.get_or_init(|| RwLock::new(SymbolTable::default()))
+}
+
+/// A symbol, identified by its index in the symbol table
+#[derive(Clone, Copy, PartialEq, Eq, Hash)]
+pub struct Symbol(u32);
+
+impl Symbol {
+    /// The symbol with this name, adding the name to the table the first time it's seen
+    pub fn intern(name: &str) -> Symbol {
+        if let Some(&id) = table().read().unwrap().ids.get(name) {
+            return Symbol(id);
+        }
+
+        let mut table = table().write().unwrap();
+        // Another thread may have added it between the two locks
+        if let Some(&id) = table.ids.get(name) {
+            return Symbol(id);
+        }
+        Symbol(table.insert(name))
+    }
+
+    /// A symbol never seen before: #:, `prefix` and a counter, skipping any name
+    /// string->symbol got to first
+    pub fn gensym(prefix: &str) -> Symbol {
+        let mut table = table().write().unwrap();
+        loop {
+            let name = format!("#:{}{}", prefix, table.gensyms);
+            table.gensyms += 1;
+            if !table.ids.contains_key(name.as_str()) {
+                return Symbol(table.insert(&name));
+            }
+        }
+    }
+
+    /// The symbol's name, looked up in the table
+    pub fn name(self) -> &'static str {
+        table().read().unwrap().names[self.0 as usize]
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        self.name()
+    }
+
+    pub fn id(self) -> u32 {
+        self.0
+    }
+}
+
+impl Deref for Symbol {
+    type Target = str;
+
+    fn deref(&self) -> &str {
+        self.name()
+    }
+}
+
+impl From<&str> for Symbol {
+    fn from(name: &str) -> Self {
+        Symbol::intern(name)
+    }
+}
+
+/// Symbols sort by name, so maps keyed by symbols print in the same order in every run
+impl Ord for Symbol {
+    fn cmp(&self, other: &Self) -> Ordering {
+        if self.0 == other.0 {
+            Ordering::Equal
+        } else {
+            self.name().cmp(other.name())
+        }
+    }
+}
+
+impl PartialOrd for Symbol {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl fmt::Debug for Symbol {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{:?}", self.name())
+    }
+}
+
+impl fmt::Display for Symbol {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.name())
+    }
+}
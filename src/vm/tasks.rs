@@ -0,0 +1,283 @@
+// Cooperative tasks: spawn, yield, sleep, channels and task-result
+//
+// Tasks share the VM's globals and functions. Each has a value stack, call
+// frames and handlers of its own. One runs at a time, until it yields, sleeps,
+// waits on a channel or another task, waits on a socket with nothing to read,
+// or finishes. Then the next runnable task takes over, round robin. The
+// program's main code is a task too, created when the first task is spawned,
+// and the run ends when it does, whatever tasks are still waiting.
+//
+// A channel has no buffer. chan-send waits for a receiver and chan-recv for a
+// sender, so each value passes straight from one task to the other.
+//
+// Tasks only switch in the outermost run. Code that load, require or eval run
+// inside an instruction yields as a no-op and can't wait.
+
+use std::cell::RefCell;
+use std::collections::VecDeque;
+use std::fmt;
+use std::rc::Rc;
+use std::time::Instant;
+
+use super::instructions::Instruction;
+use super::stack::{Frame, Handler};
+use super::value::Value;
+
+pub type TaskRef = Rc<RefCell<Task>>;
+pub type ChannelRef = Rc<RefCell<Channel>>;
+
+/// The part of the VM's state belonging to one task, kept here while it isn't running
+#[derive(Debug, Default)]
+pub struct TaskContext {
+    pub value_stack: Vec<Value>,
+    pub call_stack: Vec<Frame>,
+    pub bytecode: Rc<Vec<Instruction>>,
+    pub instruction_pointer: usize,
+    pub handlers: Vec<Handler>,
+    pub trace_depths: Vec<usize>,
+}
+
+impl TaskContext {
+    // Every value the context holds, for the collector
+    fn values(&self) -> impl Iterator<Item = &Value> {
+        let frames = self.call_stack.iter().flat_map(|frame| frame.locals.iter().chain(frame.captured.iter()));
+        let tags = self.handlers.iter().filter_map(|handler| handler.tag.as_ref());
+        self.value_stack.iter().chain(frames).chain(tags)
+    }
+}
+
+#[derive(Debug, Clone)]
+pub enum TaskState {
+    Running,            // The task the VM is running
+    Runnable,           // In the run queue
+    Blocked(Wait),      // Parked until another task wakes it
+    Sleeping(Instant),  // Parked until the time given
+    Done(Value),        // Finished, with the thunk's value
+    Failed(Value),      // Ended by an error no handler caught, as handler-case binds it
+}
+
+/// What a blocked task is waiting for
+#[derive(Debug, Clone)]
+pub enum Wait {
+    Send(ChannelRef), // A receiver on the channel
+    Recv(ChannelRef), // A sender on the channel
+    Task(TaskRef),    // The task to finish
+}
+
+pub struct Task {
+    pub id: usize,
+    pub state: TaskState,
+    pub context: Option<TaskContext>, // Saved while the task isn't running
+    pub joiners: Vec<TaskRef>,        // Tasks waiting in task-result for this one
+}
+
+impl Task {
+    /// The value or error a finished task ended with
+    pub fn result(&self) -> Option<&Value> {
+        match &self.state {
+            TaskState::Done(value) | TaskState::Failed(value) => Some(value),
+            _ => None,
+        }
+    }
+
+    /// Name of the state, as task-status returns it
+    pub fn status(&self) -> &'static str {
+        match self.state {
+            TaskState::Running => "running",
+            TaskState::Runnable => "runnable",
+            TaskState::Blocked(_) => "blocked",
+            TaskState::Sleeping(_) => "sleeping",
+            TaskState::Done(_) => "done",
+            TaskState::Failed(_) => "failed",
+        }
+    }
+
+    // Resume a parked task with `value` as the result of the instruction it waited in
+    pub fn wake_with(&mut self, value: Value) {
+        if let Some(context) = &mut self.context {
+            context.value_stack.push(value);
+        }
+        self.state = TaskState::Runnable;
+    }
+
+    /// Every value the task holds, for the collector
+    pub fn values(&self) -> Vec<Value> {
+        let mut values: Vec<Value> = self.context.iter().flat_map(TaskContext::values).cloned().collect();
+        match &self.state {
+            TaskState::Blocked(Wait::Send(channel) | Wait::Recv(channel)) => values.push(Value::Channel(channel.clone())),
+            TaskState::Blocked(Wait::Task(task)) => values.push(Value::Task(task.clone())),
+            TaskState::Done(value) | TaskState::Failed(value) => values.push(value.clone()),
+            _ => {}
+        }
+        values
+    }
+}
+
+// A task's saved state can reach the task itself, through a channel it waits on
+impl fmt::Debug for Task {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "Task({}, {})", self.id, self.status())
+    }
+}
+
+/// An unbuffered channel: the tasks parked sending on it, with their values,
+/// and the tasks parked receiving
+#[derive(Default)]
+pub struct Channel {
+    pub senders: VecDeque<(TaskRef, Value)>,
+    pub receivers: VecDeque<TaskRef>,
+}
+
+impl Channel {
+    /// Every value the channel holds, for the collector
+    pub fn values(&self) -> Vec<Value> {
+        let senders = self.senders.iter().map(|(task, value)| (task, Some(value)));
+        let receivers = self.receivers.iter().map(|task| (task, None));
+        let mut values = Vec::new();
+        for (task, sent) in senders.chain(receivers) {
+            values.push(Value::Task(task.clone()));
+            values.extend(sent.cloned());
+        }
+        values
+    }
+}
+
+impl fmt::Debug for Channel {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "Channel({} sending, {} receiving)", self.senders.len(), self.receivers.len())
+    }
+}
+
+#[derive(Debug, Default)]
+pub struct Scheduler {
+    current: Option<TaskRef>,     // The running task, None until the first spawn
+    run_queue: VecDeque<TaskRef>,
+    sleepers: Vec<TaskRef>,
+    live: Vec<TaskRef>,           // Every task not finished, the running one included
+    next_id: usize,
+    idle_polls: usize,            // Tasks that waited on a socket in a row, with nothing else done
+}
+
+impl Scheduler {
+    pub fn new() -> Self {
+        Scheduler::default()
+    }
+
+    /// The running task, the main task if none was spawned yet
+    pub fn current(&mut self) -> TaskRef {
+        if let Some(task) = &self.current {
+            return task.clone();
+        }
+        let main = self.new_task(TaskState::Running, None);
+        self.current = Some(main.clone());
+        main
+    }
+
+    /// Whether the running task is one spawn created, rather than the main task
+    pub fn in_spawned_task(&self) -> bool {
+        self.current.as_ref().map_or(false, |task| task.borrow().id != 0)
+    }
+
+    /// Whether any task besides the running one could run now or later by itself
+    pub fn others_can_run(&self) -> bool {
+        !self.run_queue.is_empty() || !self.sleepers.is_empty()
+    }
+
+    pub fn spawn(&mut self, context: TaskContext) -> TaskRef {
+        self.current();
+        let task = self.new_task(TaskState::Runnable, Some(context));
+        self.run_queue.push_back(task.clone());
+        task
+    }
+
+    fn new_task(&mut self, state: TaskState, context: Option<TaskContext>) -> TaskRef {
+        let task = Rc::new(RefCell::new(Task { id: self.next_id, state, context, joiners: Vec::new() }));
+        self.next_id += 1;
+        self.live.push(task.clone());
+        task
+    }
+
+    /// Queue a task whose state was just made Runnable or Sleeping
+    pub fn enqueue(&mut self, task: TaskRef) {
+        if matches!(task.borrow().state, TaskState::Sleeping(_)) {
+            self.sleepers.push(task);
+        } else {
+            self.run_queue.push_back(task);
+        }
+    }
+
+    /// Drop a finished task from the live ones, returning the tasks that waited for it
+    pub fn finish(&mut self, task: &TaskRef) -> Vec<TaskRef> {
+        self.live.retain(|live| !Rc::ptr_eq(live, task));
+        std::mem::take(&mut task.borrow_mut().joiners)
+    }
+
+    /// Count a task that went back to the queue to wait on a socket; true once
+    /// every queued task did so in turn, when the caller should pause a little
+    pub fn idle_poll(&mut self) -> bool {
+        self.idle_polls += 1;
+        if self.idle_polls > self.run_queue.len() {
+            self.idle_polls = 0;
+            return true;
+        }
+        false
+    }
+
+    /// Take the next task to run, waiting for the earliest sleeper when none is
+    /// runnable. None when every task is blocked: nothing can wake any of them.
+    pub fn next_task(&mut self, polled: bool) -> Option<TaskRef> {
+        if !polled {
+            self.idle_polls = 0;
+        }
+        if self.run_queue.is_empty() {
+            let wake = self.sleepers.iter().filter_map(|task| match task.borrow().state {
+                TaskState::Sleeping(wake) => Some(wake),
+                _ => None,
+            }).min()?;
+            let now = Instant::now();
+            if wake > now {
+                std::thread::sleep(wake - now);
+            }
+        }
+        self.wake_sleepers();
+        let next = self.run_queue.pop_front()?;
+        next.borrow_mut().state = TaskState::Running;
+        self.current = Some(next.clone());
+        Some(next)
+    }
+
+    // Move every sleeper whose time has come to the run queue, earliest first
+    fn wake_sleepers(&mut self) {
+        let now = Instant::now();
+        let mut due: Vec<(Instant, TaskRef)> = Vec::new();
+        self.sleepers.retain(|task| match task.borrow().state {
+            TaskState::Sleeping(wake) if wake <= now => {
+                due.push((wake, task.clone()));
+                false
+            }
+            _ => true,
+        });
+        due.sort_by_key(|(wake, _)| *wake);
+        for (_, task) in due {
+            task.borrow_mut().state = TaskState::Runnable;
+            self.run_queue.push_back(task);
+        }
+    }
+
+    /// The main task, for an error no other task can take
+    pub fn main_task(&self) -> Option<TaskRef> {
+        self.live.iter().find(|task| task.borrow().id == 0).cloned()
+    }
+
+    /// Make `task` the running one
+    pub fn set_current(&mut self, task: TaskRef) {
+        task.borrow_mut().state = TaskState::Running;
+        self.current = Some(task);
+    }
+
+    /// Values held by tasks that aren't running, for the collector; the running
+    /// task's are the VM's own
+    pub fn roots(&self) -> Vec<Value> {
+        self.live.iter().flat_map(|task| task.borrow().values()).collect()
+    }
+}
@@ -0,0 +1,92 @@
+// Call tracer: logs each function entry with its arguments and each exit with its
+// return value, indented by call depth. The VM only calls into it when one is
+// attached (see VM::run)
+//
+//   → (fact 2)        a call that pushed a frame
+//   ↪ (loop 9)        a tail call that reused the caller's frame
+//   ← fact = 2        a return, with the value returned
+//   ← fact (unwound)  a frame dropped by an error a handler caught
+
+use std::io::{self, Write};
+
+use super::instructions::Instruction;
+use super::stack::Frame;
+use super::value::Value;
+use super::vm::VM;
+
+pub struct CallTracer {
+    output: Box<dyn Write>,
+    active: Vec<String>, // Function of each frame the trace has shown entering
+    returning: bool,     // The instruction being run is a return
+}
+
+impl CallTracer {
+    /// Tracer writing to stderr, apart from the program's own output
+    pub fn new() -> Self {
+        CallTracer::with_output(Box::new(io::stderr()))
+    }
+
+    pub fn with_output(output: Box<dyn Write>) -> Self {
+        CallTracer {
+            output,
+            active: Vec::new(),
+            returning: false,
+        }
+    }
+
+    /// Begin a run whose call stack already holds `frames`, which are not shown
+    pub(super) fn start(&mut self, frames: &[Frame]) {
+        self.active = frames.iter().map(|frame| frame.function_name.clone()).collect();
+    }
+
+    pub(super) fn before_instruction(&mut self, instruction: &Instruction) {
+        self.returning = matches!(instruction, Instruction::Ret);
+    }
+
+    /// Show the calls and returns an instruction made. `reused_frame` is set when it
+    /// was a tail call that replaced the top frame.
+    pub(super) fn sync_calls(&mut self, frames: &[Frame], stack: &[Value], reused_frame: bool) {
+        let depth = frames.len();
+        if self.active.len() == depth && !reused_frame {
+            return;
+        }
+
+        if self.returning && self.active.len() == depth + 1 {
+            let function = self.active.pop().expect("a frame returned");
+            let value = stack.last().map(VM::format_diagnostic).unwrap_or_default();
+            self.write_line(depth, &format!("← {} = {}", function, value));
+        }
+        while self.active.len() > depth {
+            let function = self.active.pop().expect("a frame was unwound");
+            self.write_line(self.active.len(), &format!("← {} (unwound)", function));
+        }
+
+        if reused_frame && depth > 0 && self.active.len() == depth {
+            let frame = &frames[depth - 1];
+            self.active[depth - 1] = frame.function_name.clone();
+            self.write_line(depth - 1, &format!("↪ {}", Self::call(frame)));
+        }
+        while self.active.len() < depth {
+            let frame = &frames[self.active.len()];
+            self.write_line(self.active.len(), &format!("→ {}", Self::call(frame)));
+            self.active.push(frame.function_name.clone());
+        }
+    }
+
+    // A frame as the call that made it: (name arg ...)
+    fn call(frame: &Frame) -> String {
+        let mut parts = vec![frame.function_name.clone()];
+        parts.extend(frame.locals.iter().map(VM::format_diagnostic));
+        format!("({})", parts.join(" "))
+    }
+
+    fn write_line(&mut self, depth: usize, line: &str) {
+        let _ = writeln!(self.output, "{}{}", "  ".repeat(depth), line);
+    }
+}
+
+impl Default for CallTracer {
+    fn default() -> Self {
+        CallTracer::new()
+    }
+}
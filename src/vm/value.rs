@@ -1,9 +1,14 @@
 use super::instructions::Instruction;
+use super::bigint::BigInt;
+use super::symbol::Symbol;
+use super::port::Port;
+use super::tasks::{ChannelRef, TaskRef};
 use std::collections::HashMap;
 use std::sync::Arc;
-use std::cell::RefCell;
+use std::cell::{Ref, RefCell};
 use std::rc::Rc;
 use std::net::{TcpListener, TcpStream};
+use std::fmt;
 
 /// Cons-cell based list structure for O(1) cons/car/cdr operations.
 /// Uses Arc for structural sharing - cdr returns a reference to existing tail.
@@ -193,49 +198,389 @@ pub struct ClosureData {
     pub captured: Vec<(String, Value)>,
 }
 
+/// Instance of a type declared with defstruct. The type name is compared along
+/// with the fields, so instances of two types with the same fields differ.
+#[derive(Debug, Clone, PartialEq)]
+pub struct StructData {
+    pub name: Arc<String>,
+    pub fields: Vec<Value>,
+}
+
 #[derive(Debug, Clone)]
 pub enum Value {
     Integer(i64),
+    BigInt(Arc<BigInt>), // Integer outside the i64 range, only created on overflow
     Float(f64),
     Boolean(bool),
+    Char(char),
     List(List),
-    Symbol(Arc<String>),
+    Symbol(Symbol), // Interned: compares by id
     String(Arc<String>),
     Function(Arc<String>), // Reference to a named function
     Closure(Arc<ClosureData>),
-    HashMap(Arc<HashMap<String, Value>>), // Hash map with string keys
-    Vector(Arc<Vec<Value>>), // Efficient array with O(1) indexed access
+    HashMap(Rc<RefCell<HashMap<MapKey, Value>>>), // Hash map with integer, string or symbol keys, map-set! changes it in place
+    Vector(Rc<RefCell<Vec<Value>>>), // Array with O(1) indexed access, vector-set! changes it in place
     TcpListener(Rc<RefCell<TcpListener>>), // TCP listener for HTTP server
     TcpStream(Rc<RefCell<TcpStream>>), // TCP stream for HTTP connections
     SharedTcpListener(Arc<std::net::TcpListener>), // Thread-safe TCP listener for parallel serving
     Pointer(i64), // Raw pointer for FFI (null = 0)
+    Cell(Rc<RefCell<Option<Value>>>), // Mutable binding slot (letrec), None until initialized
+    Struct(Arc<StructData>), // Instance of a defstruct type
+    Port(Rc<RefCell<Port>>), // File opened by open-input-file or open-output-file
+    Promise(Rc<RefCell<Promise>>), // Delayed expression made by delay, run once by force
+    Task(TaskRef), // Cooperative task made by spawn
+    Channel(ChannelRef), // Unbuffered channel between tasks, made by make-channel
+}
+
+/// State of a promise. Forcing still holds the thunk, so a promise whose force
+/// was abandoned by an error can be forced again.
+#[derive(Debug, Clone)]
+pub enum Promise {
+    Delayed(Value), // Thunk not run yet
+    Forcing(Value), // Thunk running, under a force
+    Forced(Value),  // The thunk's value, returned by every force from now on
+}
+
+/// Hash map key. Only integers, strings and symbols can be keys, since they
+/// hash and compare by value (floats, closures and containers cannot)
+#[derive(Debug, Clone, PartialEq, Eq, Hash, PartialOrd, Ord)]
+pub enum MapKey {
+    Integer(i64),
+    String(Arc<String>),
+    Symbol(Symbol),
+}
+
+impl MapKey {
+    /// Key for a value, or None if the value is not hashable
+    pub fn from_value(value: &Value) -> Option<MapKey> {
+        match value {
+            Value::Integer(n) => Some(MapKey::Integer(*n)),
+            Value::String(s) => Some(MapKey::String(s.clone())),
+            Value::Symbol(s) => Some(MapKey::Symbol(*s)),
+            _ => None,
+        }
+    }
+
+    pub fn to_value(&self) -> Value {
+        match self {
+            MapKey::Integer(n) => Value::Integer(*n),
+            MapKey::String(s) => Value::String(s.clone()),
+            MapKey::Symbol(s) => Value::Symbol(*s),
+        }
+    }
+}
+
+impl From<&str> for MapKey {
+    fn from(s: &str) -> Self {
+        MapKey::String(Arc::new(s.to_string()))
+    }
+}
+
+impl From<String> for MapKey {
+    fn from(s: String) -> Self {
+        MapKey::String(Arc::new(s))
+    }
+}
+
+/// Key contents without quotes, as format strings show them
+impl fmt::Display for MapKey {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            MapKey::Integer(n) => write!(f, "{}", n),
+            MapKey::String(s) => write!(f, "{}", s),
+            MapKey::Symbol(s) => write!(f, "{}", s),
+        }
+    }
+}
+
+/// Render a float so the reader parses it back to the same value: whole numbers
+/// keep a trailing ".0" and non-finite values use the +inf.0 / -inf.0 / +nan.0 spellings
+pub fn format_float(f: f64) -> String {
+    if f.is_nan() {
+        "+nan.0".to_string()
+    } else if f.is_infinite() {
+        if f > 0.0 { "+inf.0".to_string() } else { "-inf.0".to_string() }
+    } else if f.fract() == 0.0 {
+        format!("{:.1}", f)
+    } else {
+        f.to_string()
+    }
+}
+
+/// Parse the non-finite spellings written by format_float
+pub fn parse_special_float(text: &str) -> Option<f64> {
+    match text {
+        "+inf.0" => Some(f64::INFINITY),
+        "-inf.0" => Some(f64::NEG_INFINITY),
+        "+nan.0" | "-nan.0" => Some(f64::NAN),
+        _ => None,
+    }
+}
+
+/// Render a string as a literal the reader parses back: quoted, with the
+/// escapes the reader decodes for quotes, backslashes and control characters
+pub fn format_string(s: &str) -> String {
+    let mut literal = String::with_capacity(s.len() + 2);
+    literal.push('"');
+    for c in s.chars() {
+        match c {
+            '"' => literal.push_str("\\\""),
+            '\\' => literal.push_str("\\\\"),
+            '\n' => literal.push_str("\\n"),
+            '\t' => literal.push_str("\\t"),
+            '\r' => literal.push_str("\\r"),
+            '\0' => literal.push_str("\\0"),
+            c => literal.push(c),
+        }
+    }
+    literal.push('"');
+    literal
 }
 
-// Custom PartialEq to handle NaN in floats
+/// Names of the characters written as #\name rather than #\c
+const CHAR_NAMES: [(&str, char); 6] = [
+    ("space", ' '),
+    ("newline", '\n'),
+    ("tab", '\t'),
+    ("return", '\r'),
+    ("nul", '\0'),
+    ("delete", '\x7f'),
+];
+
+/// Render a character so the reader parses it back: #\a, a name like #\space,
+/// or a hex escape like #\x1b for other control characters
+pub fn format_char(c: char) -> String {
+    if let Some((name, _)) = CHAR_NAMES.iter().find(|(_, named)| *named == c) {
+        format!("#\\{}", name)
+    } else if c.is_control() {
+        format!("#\\x{:x}", c as u32)
+    } else {
+        format!("#\\{}", c)
+    }
+}
+
+/// Character that the text after #\ stands for: a single character, a name
+/// written by format_char, or x followed by a hex code point
+pub fn parse_char_name(text: &str) -> Option<char> {
+    let mut chars = text.chars();
+    if let (Some(c), None) = (chars.next(), chars.next()) {
+        return Some(c);
+    }
+    if let Some((_, c)) = CHAR_NAMES.iter().find(|(name, _)| *name == text) {
+        return Some(*c);
+    }
+    text.strip_prefix('x')
+        .and_then(|hex| u32::from_str_radix(hex, 16).ok())
+        .and_then(char::from_u32)
+}
+
+/// Parse the text of a number in the given radix. Integers may carry a sign and
+/// must fit in an i64; radix 10 also accepts the float syntax the reader does.
+/// Anything else, including surrounding whitespace, is None.
+pub fn parse_number(text: &str, radix: u32) -> Option<Value> {
+    let digits = text.strip_prefix(|c| c == '-' || c == '+').unwrap_or(text);
+    if !digits.is_empty() && digits.chars().all(|c| c.is_digit(radix)) {
+        return i64::from_str_radix(text, radix).ok().map(Value::Integer);
+    }
+    if radix != 10 {
+        return None;
+    }
+    let is_float_syntax = !text.chars().any(|c| c.is_alphabetic() && c != 'e' && c != 'E');
+    parse_special_float(text)
+        .or_else(|| text.parse::<f64>().ok().filter(|_| is_float_syntax))
+        .map(Value::Float)
+}
+
+// Custom PartialEq to handle NaN in floats, and vectors that contain themselves
 impl PartialEq for Value {
     fn eq(&self, other: &Self) -> bool {
-        match (self, other) {
-            (Value::Integer(a), Value::Integer(b)) => a == b,
-            (Value::Float(a), Value::Float(b)) => {
-                // NaN != NaN, but we treat them as equal for Value comparison
-                if a.is_nan() && b.is_nan() {
+        equal_values(self, other, &mut Vec::new())
+    }
+}
+
+// Vector and map pairs being compared further up, by address: vector-set! and
+// map-set! can put a container inside itself, and meeting the same pair again
+// means that cycle matched so far
+type ContainerPairs = Vec<(usize, usize)>;
+
+// Structural equality of a and b, with `comparing` holding the enclosing container pairs
+fn equal_values(a: &Value, b: &Value, comparing: &mut ContainerPairs) -> bool {
+    match (a, b) {
+        (Value::Integer(a), Value::Integer(b)) => a == b,
+        (Value::BigInt(a), Value::BigInt(b)) => a == b,
+        (Value::Float(a), Value::Float(b)) => {
+            // NaN != NaN, but we treat them as equal for Value comparison
+            if a.is_nan() && b.is_nan() {
+                true
+            } else {
+                a == b
+            }
+        }
+        (Value::Boolean(a), Value::Boolean(b)) => a == b,
+        (Value::Char(a), Value::Char(b)) => a == b,
+        (Value::List(a), Value::List(b)) => {
+            let (mut a, mut b) = (a, b);
+            loop {
+                match (a, b) {
+                    (List::Nil, List::Nil) => return true,
+                    (List::Cons(cell_a), List::Cons(cell_b)) => {
+                        if !equal_values(&cell_a.head, &cell_b.head, comparing) {
+                            return false;
+                        }
+                        a = &cell_a.tail;
+                        b = &cell_b.tail;
+                    }
+                    _ => return false,
+                }
+            }
+        }
+        (Value::Symbol(a), Value::Symbol(b)) => a == b,
+        (Value::String(a), Value::String(b)) => a == b,
+        (Value::Function(a), Value::Function(b)) => a == b,
+        (Value::HashMap(a), Value::HashMap(b)) => {
+            let pair = (Rc::as_ptr(a) as usize, Rc::as_ptr(b) as usize);
+            if Rc::ptr_eq(a, b) || comparing.contains(&pair) {
+                return true;
+            }
+            comparing.push(pair);
+            let (map_a, map_b) = (a.borrow(), b.borrow());
+            let equal = map_a.len() == map_b.len() && map_a.iter().all(|(key, value)| {
+                map_b.get(key).map_or(false, |other| equal_values(value, other, comparing))
+            });
+            comparing.pop();
+            equal
+        }
+        (Value::Vector(a), Value::Vector(b)) => {
+            let pair = (Rc::as_ptr(a) as usize, Rc::as_ptr(b) as usize);
+            if Rc::ptr_eq(a, b) || comparing.contains(&pair) {
+                return true;
+            }
+            comparing.push(pair);
+            let (items_a, items_b) = (a.borrow(), b.borrow());
+            let equal = items_a.len() == items_b.len()
+                && items_a.iter().zip(items_b.iter()).all(|(x, y)| equal_values(x, y, comparing));
+            comparing.pop();
+            equal
+        }
+        (Value::Closure(a), Value::Closure(b)) => {
+            // Captured values can hold a vector the closure is in
+            Arc::ptr_eq(a, b)
+                || (a.params == b.params && a.rest_param == b.rest_param && a.body == b.body
+                    && a.captured.len() == b.captured.len()
+                    && a.captured.iter().zip(b.captured.iter())
+                        .all(|((name_a, x), (name_b, y))| name_a == name_b && equal_values(x, y, comparing)))
+        }
+        (Value::Pointer(a), Value::Pointer(b)) => a == b,
+        (Value::Cell(a), Value::Cell(b)) => Rc::ptr_eq(a, b),
+        (Value::Port(a), Value::Port(b)) => Rc::ptr_eq(a, b),
+        (Value::Promise(a), Value::Promise(b)) => Rc::ptr_eq(a, b),
+        (Value::Task(a), Value::Task(b)) => Rc::ptr_eq(a, b),
+        (Value::Channel(a), Value::Channel(b)) => Rc::ptr_eq(a, b),
+        (Value::Struct(a), Value::Struct(b)) => {
+            a.name == b.name
+                && a.fields.len() == b.fields.len()
+                && a.fields.iter().zip(b.fields.iter()).all(|(x, y)| equal_values(x, y, comparing))
+        }
+        _ => false,
+    }
+}
+
+// A step of equal?: compare two values, or leave a vector pair whose elements
+// have all been compared
+enum EqualStep {
+    Compare(Value, Value),
+    Leave,
+}
+
+// equal? of a and b. The pending comparisons are kept on a work stack rather
+// than the native one, so deeply nested values can't overflow it; `comparing`
+// holds the vector and map pairs whose contents are still being compared, and
+// meeting one of them again would go round the cycle forever.
+fn equal_contents(a: &Value, b: &Value) -> Result<bool, String> {
+    let mut comparing: ContainerPairs = Vec::new();
+    let mut steps = vec![EqualStep::Compare(a.clone(), b.clone())];
+    while let Some(step) = steps.pop() {
+        let (a, b) = match step {
+            EqualStep::Compare(a, b) => (a, b),
+            EqualStep::Leave => {
+                comparing.pop();
+                continue;
+            }
+        };
+        let equal = match (&a, &b) {
+            (Value::List(list_a), Value::List(list_b)) => match (list_a, list_b) {
+                (List::Nil, List::Nil) => true,
+                (List::Cons(cell_a), List::Cons(cell_b)) => {
+                    if !Arc::ptr_eq(cell_a, cell_b) {
+                        // The head is compared before the rest of the list
+                        steps.push(EqualStep::Compare(Value::List(cell_a.tail.clone()), Value::List(cell_b.tail.clone())));
+                        steps.push(EqualStep::Compare(cell_a.head.clone(), cell_b.head.clone()));
+                    }
+                    true
+                }
+                _ => false,
+            },
+            (Value::String(x), Value::String(y)) => x == y,
+            (Value::Vector(x), Value::Vector(y)) => {
+                if Rc::ptr_eq(x, y) {
+                    continue;
+                }
+                let pair = (Rc::as_ptr(x) as usize, Rc::as_ptr(y) as usize);
+                if comparing.contains(&pair) {
+                    return Err("equal? can't compare circular structures: a vector contains itself".to_string());
+                }
+                let (items_a, items_b) = (x.borrow(), y.borrow());
+                if items_a.len() == items_b.len() {
+                    comparing.push(pair);
+                    steps.push(EqualStep::Leave);
+                    for (item_a, item_b) in items_a.iter().zip(items_b.iter()).rev() {
+                        steps.push(EqualStep::Compare(item_a.clone(), item_b.clone()));
+                    }
                     true
                 } else {
-                    a == b
+                    false
                 }
             }
-            (Value::Boolean(a), Value::Boolean(b)) => a == b,
-            (Value::List(a), Value::List(b)) => a == b,
-            (Value::Symbol(a), Value::Symbol(b)) => a == b,
-            (Value::String(a), Value::String(b)) => a == b,
-            (Value::Function(a), Value::Function(b)) => a == b,
-            (Value::HashMap(a), Value::HashMap(b)) => a == b,
-            (Value::Vector(a), Value::Vector(b)) => a == b,
-            (Value::Closure(a), Value::Closure(b)) => a == b,
-            (Value::Pointer(a), Value::Pointer(b)) => a == b,
-            _ => false,
+            (Value::HashMap(x), Value::HashMap(y)) => {
+                if Rc::ptr_eq(x, y) {
+                    continue;
+                }
+                let pair = (Rc::as_ptr(x) as usize, Rc::as_ptr(y) as usize);
+                if comparing.contains(&pair) {
+                    return Err("equal? can't compare circular structures: a map contains itself".to_string());
+                }
+                let (map_a, map_b) = (x.borrow(), y.borrow());
+                if map_a.len() == map_b.len() {
+                    comparing.push(pair);
+                    steps.push(EqualStep::Leave);
+                    map_a.iter().all(|(key, value)| match map_b.get(key) {
+                        Some(other) => {
+                            steps.push(EqualStep::Compare(value.clone(), other.clone()));
+                            true
+                        }
+                        None => false,
+                    })
+                } else {
+                    false
+                }
+            }
+            (Value::Struct(x), Value::Struct(y)) => {
+                if x.name == y.name && x.fields.len() == y.fields.len() {
+                    for (field_a, field_b) in x.fields.iter().zip(y.fields.iter()).rev() {
+                        steps.push(EqualStep::Compare(field_a.clone(), field_b.clone()));
+                    }
+                    true
+                } else {
+                    false
+                }
+            }
+            _ => a.is_eqv(&b),
+        };
+        if !equal {
+            return Ok(false);
         }
     }
+    Ok(true)
 }
 
 impl Value {
@@ -248,7 +593,7 @@ impl Value {
     }
 
     pub fn is_number(&self) -> bool {
-        matches!(self, Value::Integer(_) | Value::Float(_))
+        matches!(self, Value::Integer(_) | Value::BigInt(_) | Value::Float(_))
     }
 
     pub fn is_bool(&self) -> bool {
@@ -283,6 +628,25 @@ impl Value {
         }
     }
 
+    /// Integer value as a bignum, for arithmetic that has left the fixnum range
+    pub fn as_bigint(&self) -> Option<BigInt> {
+        match self {
+            Value::Integer(n) => Some(BigInt::from_i64(*n)),
+            Value::BigInt(n) => Some((**n).clone()),
+            _ => None,
+        }
+    }
+
+    /// Any number converted to a float, for inexact arithmetic
+    pub fn as_f64(&self) -> Option<f64> {
+        match self {
+            Value::Integer(n) => Some(*n as f64),
+            Value::BigInt(n) => Some(n.to_f64()),
+            Value::Float(f) => Some(*f),
+            _ => None,
+        }
+    }
+
     pub fn as_float(&self) -> Option<f64> {
         if let Value::Float(f) = self {
             Some(*f)
@@ -309,7 +673,7 @@ impl Value {
 
     pub fn as_symbol(&self) -> Option<&str> {
         if let Value::Symbol(s) = self {
-            Some(s)
+            Some(s.name())
         } else {
             None
         }
@@ -335,9 +699,9 @@ impl Value {
         matches!(self, Value::HashMap(_))
     }
 
-    pub fn as_hashmap(&self) -> Option<&HashMap<String, Value>> {
+    pub fn as_hashmap(&self) -> Option<Ref<'_, HashMap<MapKey, Value>>> {
         if let Value::HashMap(map) = self {
-            Some(map)
+            Some(map.borrow())
         } else {
             None
         }
@@ -347,17 +711,85 @@ impl Value {
         matches!(self, Value::Vector(_))
     }
 
-    pub fn as_vector(&self) -> Option<&Vec<Value>> {
+    pub fn as_vector(&self) -> Option<Ref<'_, Vec<Value>>> {
         if let Value::Vector(vec) = self {
-            Some(vec)
+            Some(vec.borrow())
         } else {
             None
         }
     }
 
-    /// Helper to create a Symbol from a string
-    pub fn symbol(s: impl Into<String>) -> Self {
-        Value::Symbol(Arc::new(s.into()))
+    /// Helper to create an integer from a bignum, demoting to a fixnum when it fits
+    pub fn from_bigint(n: BigInt) -> Self {
+        match n.to_i64() {
+            Some(small) => Value::Integer(small),
+            None => Value::BigInt(Arc::new(n)),
+        }
+    }
+
+    /// Helper to create a Symbol from a string, interning the name
+    pub fn symbol(s: impl AsRef<str>) -> Self {
+        Value::Symbol(Symbol::intern(s.as_ref()))
+    }
+
+    /// Identity, as eq? tests it: immediates and symbols compare by value, heap
+    /// objects by address. Two lists built separately are different objects.
+    pub fn is_eq(&self, other: &Value) -> bool {
+        match (self, other) {
+            (Value::Symbol(a), Value::Symbol(b)) => a == b,
+            (Value::Integer(a), Value::Integer(b)) => a == b,
+            (Value::Float(a), Value::Float(b)) => a.to_bits() == b.to_bits(),
+            (Value::Boolean(a), Value::Boolean(b)) => a == b,
+            (Value::Char(a), Value::Char(b)) => a == b,
+            (Value::Pointer(a), Value::Pointer(b)) => a == b,
+            (Value::List(List::Nil), Value::List(List::Nil)) => true,
+            (Value::List(List::Cons(a)), Value::List(List::Cons(b))) => Arc::ptr_eq(a, b),
+            (Value::BigInt(a), Value::BigInt(b)) => Arc::ptr_eq(a, b),
+            (Value::String(a), Value::String(b)) => Arc::ptr_eq(a, b),
+            (Value::Function(a), Value::Function(b)) => a == b, // A name refers to one function
+            (Value::Closure(a), Value::Closure(b)) => Arc::ptr_eq(a, b),
+            (Value::HashMap(a), Value::HashMap(b)) => Rc::ptr_eq(a, b),
+            (Value::Vector(a), Value::Vector(b)) => Rc::ptr_eq(a, b),
+            (Value::Struct(a), Value::Struct(b)) => Arc::ptr_eq(a, b),
+            (Value::Cell(a), Value::Cell(b)) => Rc::ptr_eq(a, b),
+            (Value::Port(a), Value::Port(b)) => Rc::ptr_eq(a, b),
+            (Value::Promise(a), Value::Promise(b)) => Rc::ptr_eq(a, b),
+            (Value::Task(a), Value::Task(b)) => Rc::ptr_eq(a, b),
+            (Value::Channel(a), Value::Channel(b)) => Rc::ptr_eq(a, b),
+            (Value::TcpListener(a), Value::TcpListener(b)) => Rc::ptr_eq(a, b),
+            (Value::TcpStream(a), Value::TcpStream(b)) => Rc::ptr_eq(a, b),
+            (Value::SharedTcpListener(a), Value::SharedTcpListener(b)) => Arc::ptr_eq(a, b),
+            _ => false,
+        }
+    }
+
+    /// eqv?: identity like eq?, except that numbers of the same type compare by
+    /// value, so equal bignums are eqv? and so are 0.0 and -0.0. An integer and a
+    /// float are never eqv?, even when = holds.
+    pub fn is_eqv(&self, other: &Value) -> bool {
+        match (self, other) {
+            (Value::BigInt(a), Value::BigInt(b)) => a == b,
+            (Value::Float(a), Value::Float(b)) => a == b,
+            _ => self.is_eq(other),
+        }
+    }
+
+    /// equal?: lists, vectors, strings, hash maps and structs compare by their
+    /// contents, and everything else as eqv? does, so a closure is only equal to
+    /// itself. Fails rather than running forever on circular structures, which
+    /// only vectors and maps can build.
+    pub fn is_equal(&self, other: &Value) -> Result<bool, String> {
+        equal_contents(self, other)
+    }
+
+    /// Helper to create a Vector value
+    pub fn vector(items: Vec<Value>) -> Self {
+        Value::Vector(Rc::new(RefCell::new(items)))
+    }
+
+    /// Helper to create a HashMap value
+    pub fn hashmap(map: HashMap<MapKey, Value>) -> Self {
+        Value::HashMap(Rc::new(RefCell::new(map)))
     }
 
     /// Helper to create a String value
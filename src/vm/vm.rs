@@ -3,28 +3,76 @@ use std::collections::HashSet;
 use std::sync::Arc;
 use std::cell::RefCell;
 use std::rc::Rc;
+use std::cmp::Ordering;
+use std::time::Instant;
+use std::io::{BufRead, Write};
 
-use super::value::{Value, List, ClosureData};
+use super::value::{Value, List, ClosureData, MapKey, Promise, StructData, format_float, format_string, parse_number};
+use super::symbol::Symbol;
+use super::bigint::BigInt;
 use super::instructions::{Instruction, FfiType};
-use super::stack::Frame;
-use super::errors::RuntimeError;
+use super::stack::{Frame, Handler};
+use super::functions::{CallCache, FunctionTable};
+use super::errors::{RuntimeError, Location};
+use super::source_map::SourceMaps;
+use super::debugger::Debugger;
+use super::profiler::Profiler;
+use super::tracer::CallTracer;
+use super::printer::{self, PrintOptions};
+use super::port::{self, Port};
+use super::gc::Heap;
+use super::tasks::{Channel, Scheduler, TaskContext, TaskRef, TaskState, Wait};
 use super::ffi::{FfiState, ffi_type_size};
-use crate::parser::Parser;
-use crate::compiler::Compiler;
+use crate::parser::{self, Parser};
+use crate::compiler::{Compiler, SourceExpr};
+
+/// Frames the call stack may hold before a call fails with a stack depth error
+pub const DEFAULT_MAX_CALL_DEPTH: usize = 10_000;
+
+/// Instructions a handler may run after catching an instruction budget error,
+/// before the run stops whatever handlers remain
+pub const INSTRUCTION_BUDGET_GRACE: u64 = 10_000;
+
+/// Values the value stack may hold when a call is made before it fails with a stack depth error
+pub const DEFAULT_MAX_VALUE_STACK: usize = 1_000_000;
 
 pub struct VM {
     pub instruction_pointer: usize,
     pub value_stack: Vec<Value>,
     pub call_stack: Vec<Frame>,
-    pub functions: HashMap<String, Vec<Instruction>>,
-    pub current_bytecode: Vec<Instruction>,
+    pub functions: FunctionTable,            // Functions by name; calls cache what they resolve in call_cache
+    pub current_bytecode: Rc<Vec<Instruction>>,
     pub halted: bool,
     pub global_vars: HashMap<String, Value>, // Global variables
     pub args: Vec<String>, // Command-line arguments
     pub loaded_modules: HashSet<String>,     // Track loaded modules for require
     pub loading_modules: Vec<String>,        // Stack of modules currently being loaded (for circular dep detection)
+    pub current_file: Option<String>,        // File being run, which relative load and require paths start from
     pub module_exports: HashMap<String, HashSet<String>>, // Module name -> exported symbols
     pub ffi_state: FfiState,                 // FFI state for foreign function interface
+    pub source_maps: SourceMaps,             // Instruction offset -> source position, for error reports
+    pub debugger: Option<Debugger>,          // Stepping debugger, consulted before each instruction when attached
+    pub profiler: Option<Profiler>,          // Execution profiler, counting each instruction when attached
+    pub call_tracer: Option<CallTracer>,     // Logs each call and return when attached
+    pub line_input: Option<Box<dyn BufRead>>, // Where read-line without a port reads, stdin when None
+    read_buffer: String,                     // Input read past the last datum read, which read and read-line take first
+    pub time_output: Option<Box<dyn Write>>, // Where (time ...) reports go, stdout when None
+    pub trace_output: Option<Box<dyn Write>>, // Where traced functions' calls and returns are printed, stdout when None
+    traced: HashMap<String, Vec<Instruction>>, // Definitions of the traced functions, which trace replaced
+    trace_depths: Vec<usize>,                // Call stack depth of each traced call still running, outermost first
+    pub handlers: Vec<Handler>,              // Installed handler-case handlers, innermost last
+    pub exit_code: Option<i32>,              // Set when the program called exit, the status to exit the process with
+    call_cache: CallCache,                   // Linked bytecode and inline cache slots of the calls run so far
+    run_depth: usize,                        // Nested runs (load, require, eval) inside the current instruction
+    pub instructions_executed: u64,          // Instructions dispatched so far, read by (time ...)
+    instruction_budget: Option<u64>,         // Instructions the budget set with set_instruction_budget allows
+    instruction_limit: u64,                  // Count of instructions_executed at which the budget runs out
+    in_budget_grace: bool,                   // The budget ran out and a handler is running on the grace instructions
+    pub heap: Heap,                          // Collection threshold, cell registry and GC counters
+    tasks: Scheduler,                        // Tasks spawn made and the one running
+    clock: Instant,                          // Reference point for the clock readings TimeStart pushes
+    pub max_call_depth: usize,               // Frames allowed on the call stack; a call beyond fails, catchably
+    pub max_value_stack: usize,              // Values allowed on the value stack at a call; a call beyond fails, catchably
 }
 
 impl VM {
@@ -34,15 +82,39 @@ impl VM {
             instruction_pointer: 0,
             value_stack: Vec::new(),
             call_stack: Vec::new(),
-            functions: HashMap::new(),
-            current_bytecode: Vec::new(),
+            functions: FunctionTable::new(),
+            current_bytecode: Rc::new(Vec::new()),
             halted: false,
             global_vars: HashMap::new(),
             args: Vec::new(),
             loaded_modules: HashSet::new(),
             loading_modules: Vec::new(),
+            current_file: None,
             module_exports: HashMap::new(),
             ffi_state: FfiState::new(),
+            source_maps: SourceMaps::new(),
+            debugger: None,
+            profiler: None,
+            call_tracer: None,
+            line_input: None,
+            read_buffer: String::new(),
+            time_output: None,
+            trace_output: None,
+            traced: HashMap::new(),
+            trace_depths: Vec::new(),
+            handlers: Vec::new(),
+            exit_code: None,
+            call_cache: CallCache::new(),
+            run_depth: 0,
+            instructions_executed: 0,
+            instruction_budget: None,
+            instruction_limit: u64::MAX,
+            in_budget_grace: false,
+            heap: Heap::new(),
+            tasks: Scheduler::new(),
+            clock: Instant::now(),
+            max_call_depth: DEFAULT_MAX_CALL_DEPTH,
+            max_value_stack: DEFAULT_MAX_VALUE_STACK,
         };
         vm.register_builtins();
         vm
@@ -56,7 +128,23 @@ impl VM {
         self.functions.insert("-".to_string(), vec![LoadArg(0), LoadArg(1), Sub, Ret]);
         self.functions.insert("*".to_string(), vec![LoadArg(0), LoadArg(1), Mul, Ret]);
         self.functions.insert("/".to_string(), vec![LoadArg(0), LoadArg(1), Div, Ret]);
+        self.functions.insert("/.".to_string(), vec![LoadArg(0), LoadArg(1), FloatDiv, Ret]);
         self.functions.insert("%".to_string(), vec![LoadArg(0), LoadArg(1), Mod, Ret]);
+        self.functions.insert("quotient".to_string(), vec![LoadArg(0), LoadArg(1), Quotient, Ret]);
+        self.functions.insert("remainder".to_string(), vec![LoadArg(0), LoadArg(1), Remainder, Ret]);
+        self.functions.insert("modulo".to_string(), vec![LoadArg(0), LoadArg(1), Modulo, Ret]);
+        self.functions.insert("checked-add".to_string(), vec![LoadArg(0), LoadArg(1), CheckedAdd, Ret]);
+        self.functions.insert("checked-sub".to_string(), vec![LoadArg(0), LoadArg(1), CheckedSub, Ret]);
+        self.functions.insert("checked-mul".to_string(), vec![LoadArg(0), LoadArg(1), CheckedMul, Ret]);
+        self.functions.insert("wrapping-add".to_string(), vec![LoadArg(0), LoadArg(1), WrappingAdd, Ret]);
+        self.functions.insert("wrapping-sub".to_string(), vec![LoadArg(0), LoadArg(1), WrappingSub, Ret]);
+        self.functions.insert("wrapping-mul".to_string(), vec![LoadArg(0), LoadArg(1), WrappingMul, Ret]);
+        self.functions.insert("bit-and".to_string(), vec![LoadArg(0), LoadArg(1), BitAnd, Ret]);
+        self.functions.insert("bit-or".to_string(), vec![LoadArg(0), LoadArg(1), BitOr, Ret]);
+        self.functions.insert("bit-xor".to_string(), vec![LoadArg(0), LoadArg(1), BitXor, Ret]);
+        self.functions.insert("bit-not".to_string(), vec![LoadArg(0), BitNot, Ret]);
+        self.functions.insert("shift-left".to_string(), vec![LoadArg(0), LoadArg(1), ShiftLeft, Ret]);
+        self.functions.insert("shift-right".to_string(), vec![LoadArg(0), LoadArg(1), ShiftRight, Ret]);
         // Arithmetic operations (unary)
         self.functions.insert("neg".to_string(), vec![LoadArg(0), Neg, Ret]);
 
@@ -66,17 +154,79 @@ impl VM {
         self.functions.insert(">".to_string(), vec![LoadArg(0), LoadArg(1), Gt, Ret]);
         self.functions.insert(">=".to_string(), vec![LoadArg(0), LoadArg(1), Gte, Ret]);
         self.functions.insert("==".to_string(), vec![LoadArg(0), LoadArg(1), Eq, Ret]);
+        self.functions.insert("=".to_string(), vec![LoadArg(0), LoadArg(1), NumEq, Ret]); // Numbers only
         self.functions.insert("!=".to_string(), vec![LoadArg(0), LoadArg(1), Neq, Ret]);
+        self.functions.insert("equal?".to_string(), vec![LoadArg(0), LoadArg(1), Equal, Ret]); // Structural: contents compare element-wise
+        self.functions.insert("eqv?".to_string(), vec![LoadArg(0), LoadArg(1), IsEqv, Ret]); // Identity, and numbers of one type by value
+        self.functions.insert("eq?".to_string(), vec![LoadArg(0), LoadArg(1), IsEq, Ret]); // Identity: same object, or same symbol
 
         // List operations
         self.functions.insert("cons".to_string(), vec![LoadArg(0), LoadArg(1), Cons, Ret]);
         self.functions.insert("car".to_string(), vec![LoadArg(0), Car, Ret]);
         self.functions.insert("cdr".to_string(), vec![LoadArg(0), Cdr, Ret]);
         self.functions.insert("list?".to_string(), vec![LoadArg(0), IsList, Ret]);
-        self.functions.insert("append".to_string(), vec![LoadArg(0), LoadArg(1), Append, Ret]);
+        self.functions.insert("list".to_string(), vec![PackRestArgs(0), LoadArg(0), Ret]);
         self.functions.insert("list-ref".to_string(), vec![LoadArg(0), LoadArg(1), ListRef, Ret]);
+        self.functions.insert("nth".to_string(), vec![LoadArg(0), LoadArg(1), Nth, Ret]);
+        self.functions.insert("length".to_string(), vec![LoadArg(0), ListLength, Ret]);
         self.functions.insert("list-length".to_string(), vec![LoadArg(0), ListLength, Ret]);
-        self.functions.insert("null?".to_string(), vec![LoadArg(0), ListLength, Push(Value::Integer(0)), Eq, Ret]);
+        self.functions.insert("reverse".to_string(), vec![LoadArg(0), ListReverse, Ret]);
+        self.functions.insert("member".to_string(), vec![LoadArg(0), LoadArg(1), Member, Ret]);
+        self.functions.insert("memq".to_string(), vec![LoadArg(0), LoadArg(1), Memq, Ret]);
+        self.functions.insert("assoc".to_string(), vec![LoadArg(0), LoadArg(1), Assoc, Ret]);
+        self.functions.insert("assq".to_string(), vec![LoadArg(0), LoadArg(1), Assq, Ret]);
+        self.functions.insert("sort".to_string(), vec![LoadArg(0), LoadArg(1), Sort, Ret]); // Stable; (sort cmp lst)
+        self.functions.insert("null?".to_string(), vec![LoadArg(0), Push(Value::List(List::Nil)), Eq, Ret]); // O(1), unlike comparing the length
+
+        // Higher-order list operations. Each walks its list in a loop, calling the
+        // function through the usual call protocol, so it may be any closure,
+        // defun or builtin. Results are consed onto a list in local slot 0 and
+        // reversed at the end.
+        let nil = || Push(Value::List(List::Nil));
+        // append takes any number of lists and joins them from the right, so
+        // each is copied once and the last is shared rather than copied
+        self.functions.insert("append".to_string(), vec![
+            PackRestArgs(0), LoadArg(0), ListReverse, StoreArg(0), // (lists), last first
+            LoadArg(0), nil(), Eq, JmpIfFalse(10),           // 4: (append) is '()
+            nil(), Ret,
+            LoadArg(0), Car,                                 // 10: the result starts as the last list
+            LoadArg(0), Cdr, StoreArg(0),                    // 12: loop over the rest
+            LoadArg(0), nil(), Eq, JmpIfFalse(20),
+            Ret,
+            LoadArg(0), Car, GetLocal(0), Append, SetLocal(0), // 20: (append (car lists) result)
+            Jmp(12),
+        ]);
+        self.functions.insert("map".to_string(), vec![
+            PackRestArgs(2),                                 // (f lst more-lists)
+            LoadArg(2), nil(), Eq, JmpIfFalse(23),           // 1: more than one list
+            nil(),                                           // 5: results
+            LoadArg(1), nil(), Eq, JmpIfFalse(12),           // 6: loop until lst is empty
+            ListReverse, Ret,
+            LoadArg(0), LoadArg(1), Car, CallClosure(1),     // 12: (f (car lst))
+            GetLocal(0), Cons, SetLocal(0),
+            LoadArg(1), Cdr, StoreArg(1), Jmp(6),
+            LoadArg(1), LoadArg(2), Cons, Transpose, StoreArg(1), // 23: lst becomes each call's arguments
+            nil(),                                           // 28: results
+            LoadArg(1), nil(), Eq, JmpIfFalse(35),           // 29: loop until lst is empty
+            ListReverse, Ret,
+            LoadArg(0), LoadArg(1), Car, Apply,              // 35: (apply f (car lst))
+            GetLocal(0), Cons, SetLocal(0),
+            LoadArg(1), Cdr, StoreArg(1), Jmp(29),
+        ]);
+        self.functions.insert("filter".to_string(), vec![
+            nil(),                                           // 0: results
+            LoadArg(1), nil(), Eq, JmpIfFalse(7),            // 1: loop until lst is empty
+            ListReverse, Ret,
+            LoadArg(0), LoadArg(1), Car, CallClosure(1), JmpIfFalse(17), // 7: (pred (car lst))
+            LoadArg(1), Car, GetLocal(0), Cons, SetLocal(0),
+            LoadArg(1), Cdr, StoreArg(1), Jmp(1),            // 17
+        ]);
+        self.functions.insert("reduce".to_string(), vec![
+            LoadArg(2), nil(), Eq, JmpIfFalse(6),            // 0: loop until lst is empty
+            LoadArg(1), Ret,
+            LoadArg(0), LoadArg(1), LoadArg(2), Car, CallClosure(2), StoreArg(1), // 6: init = (f init (car lst))
+            LoadArg(2), Cdr, StoreArg(2), Jmp(0),
+        ]);
 
         // Type predicates
         self.functions.insert("integer?".to_string(), vec![LoadArg(0), IsInteger, Ret]);
@@ -95,9 +245,18 @@ impl VM {
         self.functions.insert("string-length".to_string(), vec![LoadArg(0), StringLength, Ret]);
         self.functions.insert("substring".to_string(), vec![LoadArg(0), LoadArg(1), LoadArg(2), Substring, Ret]);
         self.functions.insert("string-append".to_string(), vec![LoadArg(0), LoadArg(1), StringAppend, Ret]);
+        self.functions.insert("string=?".to_string(), vec![LoadArg(0), LoadArg(1), StringEq, Ret]);
         self.functions.insert("string->list".to_string(), vec![LoadArg(0), StringToList, Ret]);
         self.functions.insert("list->string".to_string(), vec![LoadArg(0), ListToString, Ret]);
         self.functions.insert("char-code".to_string(), vec![LoadArg(0), CharCode, Ret]);
+        self.functions.insert("char->integer".to_string(), vec![LoadArg(0), CharToInteger, Ret]);
+        self.functions.insert("integer->char".to_string(), vec![LoadArg(0), IntegerToChar, Ret]);
+        self.functions.insert("char=?".to_string(), vec![LoadArg(0), LoadArg(1), CharEq, Ret]);
+        self.functions.insert("string-ref".to_string(), vec![LoadArg(0), LoadArg(1), StringRef, Ret]);
+        self.functions.insert("char<?".to_string(), vec![LoadArg(0), LoadArg(1), CharLt, Ret]);
+        self.functions.insert("char-alphabetic?".to_string(), vec![LoadArg(0), IsAlphabetic, Ret]);
+        self.functions.insert("char-numeric?".to_string(), vec![LoadArg(0), IsNumeric, Ret]);
+        self.functions.insert("char-whitespace?".to_string(), vec![LoadArg(0), IsWhitespace, Ret]);
         self.functions.insert("number->string".to_string(), vec![LoadArg(0), NumberToString, Ret]);
         self.functions.insert("string->number".to_string(), vec![LoadArg(0), StringToNumber, Ret]);
         self.functions.insert("string-split".to_string(), vec![LoadArg(0), LoadArg(1), StringSplit, Ret]);
@@ -115,19 +274,54 @@ impl VM {
         // File I/O operations
         self.functions.insert("read-file".to_string(), vec![LoadArg(0), ReadFile, Ret]);
         self.functions.insert("write-file".to_string(), vec![LoadArg(0), LoadArg(1), WriteFile, Ret]);
+        self.functions.insert("append-file".to_string(), vec![LoadArg(0), LoadArg(1), AppendFile, Ret]);
         self.functions.insert("file-exists?".to_string(), vec![LoadArg(0), FileExists, Ret]);
+        self.functions.insert("read-line".to_string(), vec![ReadLine, Ret]);
+        self.functions.insert("read".to_string(), vec![Read, Ret]);
+        self.functions.insert("read-from-string".to_string(), vec![LoadArg(0), ReadFromString, Ret]);
+        self.functions.insert("open-input-file".to_string(), vec![LoadArg(0), OpenInputFile, Ret]);
+        self.functions.insert("open-output-file".to_string(), vec![LoadArg(0), OpenOutputFile, Ret]);
+        self.functions.insert("close-port".to_string(), vec![LoadArg(0), ClosePort, Ret]);
         self.functions.insert("write-binary-file".to_string(), vec![LoadArg(0), LoadArg(1), WriteBinaryFile, Ret]);
         self.functions.insert("load".to_string(), vec![LoadArg(0), LoadFile, Ret]);
         self.functions.insert("require".to_string(), vec![LoadArg(0), RequireFile, Ret]);
 
         // Date/Time operations
         self.functions.insert("current-timestamp".to_string(), vec![CurrentTimestamp, Ret]);
+        self.functions.insert("current-time-millis".to_string(), vec![CurrentTimeMillis, Ret]);
         self.functions.insert("format-timestamp".to_string(), vec![LoadArg(0), LoadArg(1), FormatTimestamp, Ret]);
 
         // Other operations
         self.functions.insert("get-args".to_string(), vec![GetArgs, Ret]);
+        self.functions.insert("command-line-args".to_string(), vec![GetArgs, Ret]);
+        self.functions.insert("getenv".to_string(), vec![LoadArg(0), GetEnv, Ret]);
+        self.functions.insert("exit".to_string(), vec![LoadArg(0), Exit, Ret]);
+        self.functions.insert("gc".to_string(), vec![CollectGarbage, Ret]);
+        self.functions.insert("gc-stats".to_string(), vec![GetGcStats, Ret]);
         self.functions.insert("print".to_string(), vec![LoadArg(0), Print, Ret]);
+        self.functions.insert("println".to_string(), vec![LoadArg(0), Print, Ret]);
+        self.functions.insert("write".to_string(), vec![LoadArg(0), Write, Ret]);
+        self.functions.insert("display".to_string(), vec![LoadArg(0), Display, Ret]);
+        self.functions.insert("pp".to_string(), vec![
+            LoadArg(0),
+            Push(Value::Integer(printer::DEFAULT_MAX_DEPTH as i64)),
+            Push(Value::Integer(printer::DEFAULT_MAX_LENGTH as i64)),
+            PrettyPrint,
+            Ret,
+        ]);
+        self.functions.insert("newline".to_string(), vec![Push(Value::string("\n")), Display, Ret]);
         self.functions.insert("apply".to_string(), vec![LoadArg(0), LoadArg(1), Apply, Ret]);
+        self.functions.insert("raise".to_string(), vec![LoadArg(0), Raise, Ret]);
+
+        // Promises, made by delay and cons-stream
+        self.functions.insert("promise?".to_string(), vec![LoadArg(0), IsPromise, Ret]);
+        self.functions.insert("force".to_string(), vec![
+            LoadArg(0), ForceBegin, JmpIfFalse(4),           // 0: nothing left to run
+            Ret,
+            CallClosure(0), LoadArg(0), ForceEnd, Ret,       // 4: run the thunk once and keep its value
+        ]);
+        self.functions.insert("stream-car".to_string(), vec![LoadArg(0), Car, Ret]);
+        self.functions.insert("stream-cdr".to_string(), vec![LoadArg(0), Cdr, Car, TailCall("force".to_string(), 1)]);
 
         // HashMap operations
         self.functions.insert("hashmap?".to_string(), vec![LoadArg(0), IsHashMap, Ret]);
@@ -136,11 +330,25 @@ impl VM {
         self.functions.insert("hashmap-keys".to_string(), vec![LoadArg(0), HashMapKeys, Ret]);
         self.functions.insert("hashmap-values".to_string(), vec![LoadArg(0), HashMapValues, Ret]);
         self.functions.insert("hashmap-contains-key?".to_string(), vec![LoadArg(0), LoadArg(1), HashMapContainsKey, Ret]);
+        self.functions.insert("map-get".to_string(), vec![LoadArg(0), LoadArg(1), HashMapGet, Ret]);
+        self.functions.insert("map-set!".to_string(), vec![LoadArg(0), LoadArg(1), LoadArg(2), HashMapSetInPlace, Ret]);
+        self.functions.insert("map-remove!".to_string(), vec![LoadArg(0), LoadArg(1), HashMapRemove, Ret]);
+        self.functions.insert("map-contains?".to_string(), vec![LoadArg(0), LoadArg(1), HashMapContainsKey, Ret]);
+        self.functions.insert("map-keys".to_string(), vec![LoadArg(0), HashMapKeys, Ret]);
+        self.functions.insert("map-count".to_string(), vec![LoadArg(0), HashMapCount, Ret]);
+        // hash-* names for the same maps
+        self.functions.insert("make-hash-table".to_string(), vec![MakeHashMap(0), Ret]);
+        self.functions.insert("hash-ref".to_string(), vec![LoadArg(0), LoadArg(1), HashMapGet, Ret]);
+        self.functions.insert("hash-set!".to_string(), vec![LoadArg(0), LoadArg(1), LoadArg(2), HashMapSetInPlace, Ret]);
+        self.functions.insert("hash-remove!".to_string(), vec![LoadArg(0), LoadArg(1), HashMapRemove, Ret]);
+        self.functions.insert("hash-keys".to_string(), vec![LoadArg(0), HashMapKeys, Ret]);
 
         // Vector operations
         self.functions.insert("vector?".to_string(), vec![LoadArg(0), IsVector, Ret]);
         self.functions.insert("vector-ref".to_string(), vec![LoadArg(0), LoadArg(1), VectorGet, Ret]);
         self.functions.insert("vector-set".to_string(), vec![LoadArg(0), LoadArg(1), LoadArg(2), VectorSet, Ret]);
+        self.functions.insert("vector-set!".to_string(), vec![LoadArg(0), LoadArg(1), LoadArg(2), VectorSetInPlace, Ret]);
+        self.functions.insert("make-vector".to_string(), vec![LoadArg(0), LoadArg(1), MakeVectorFilled, Ret]);
         self.functions.insert("vector-push".to_string(), vec![LoadArg(0), LoadArg(1), VectorPush, Ret]);
         self.functions.insert("vector-pop".to_string(), vec![LoadArg(0), VectorPop, Ret]);
         self.functions.insert("vector-length".to_string(), vec![LoadArg(0), VectorLength, Ret]);
@@ -162,6 +370,7 @@ impl VM {
         self.functions.insert("exp".to_string(), vec![LoadArg(0), Exp, Ret]);
         self.functions.insert("floor".to_string(), vec![LoadArg(0), Floor, Ret]);
         self.functions.insert("ceil".to_string(), vec![LoadArg(0), Ceil, Ret]);
+        self.functions.insert("round".to_string(), vec![LoadArg(0), Round, Ret]);
         self.functions.insert("abs".to_string(), vec![LoadArg(0), Abs, Ret]);
         self.functions.insert("pow".to_string(), vec![LoadArg(0), LoadArg(1), Pow, Ret]);
         self.functions.insert("random".to_string(), vec![Random, Ret]);
@@ -170,12 +379,15 @@ impl VM {
 
         // Metaprogramming
         self.functions.insert("eval".to_string(), vec![LoadArg(0), Eval, Ret]);
+        self.functions.insert("trace".to_string(), vec![LoadArg(0), Trace, Ret]);
+        self.functions.insert("untrace".to_string(), vec![LoadArg(0), Untrace, Ret]);
 
         // Reflection - Function Introspection
         self.functions.insert("function-arity".to_string(), vec![LoadArg(0), FunctionArity, Ret]);
         self.functions.insert("function-params".to_string(), vec![LoadArg(0), FunctionParams, Ret]);
         self.functions.insert("closure-captured".to_string(), vec![LoadArg(0), ClosureCaptured, Ret]);
         self.functions.insert("function-name".to_string(), vec![LoadArg(0), FunctionName, Ret]);
+        self.functions.insert("disassemble".to_string(), vec![LoadArg(0), Disassemble, Ret]);
 
         // Type inspection
         self.functions.insert("type-of".to_string(), vec![LoadArg(0), TypeOf, Ret]);
@@ -195,6 +407,23 @@ impl VM {
         self.functions.insert("http-send-response".to_string(), vec![LoadArg(0), LoadArg(1), HttpSendResponse, Ret]);
         self.functions.insert("http-close".to_string(), vec![LoadArg(0), HttpClose, Ret]);
 
+        // Raw TCP sockets
+        self.functions.insert("tcp-listen".to_string(), vec![LoadArg(0), TcpListen, Ret]);
+        self.functions.insert("tcp-accept".to_string(), vec![LoadArg(0), TcpAccept, Ret]);
+        self.functions.insert("socket-read".to_string(), vec![LoadArg(0), LoadArg(1), SocketRead, Ret]);
+        self.functions.insert("socket-write".to_string(), vec![LoadArg(0), LoadArg(1), SocketWrite, Ret]);
+        self.functions.insert("socket-close".to_string(), vec![LoadArg(0), SocketClose, Ret]);
+
+        // Cooperative tasks
+        self.functions.insert("spawn".to_string(), vec![LoadArg(0), Spawn, Ret]);
+        self.functions.insert("yield".to_string(), vec![Yield, Ret]);
+        self.functions.insert("sleep".to_string(), vec![LoadArg(0), Sleep, Ret]);
+        self.functions.insert("make-channel".to_string(), vec![MakeChannel, Ret]);
+        self.functions.insert("chan-send".to_string(), vec![LoadArg(0), LoadArg(1), ChanSend, Ret]);
+        self.functions.insert("chan-recv".to_string(), vec![LoadArg(0), ChanRecv, Ret]);
+        self.functions.insert("task-result".to_string(), vec![LoadArg(0), TaskResult, Ret]);
+        self.functions.insert("task-status".to_string(), vec![LoadArg(0), TaskStatus, Ret]);
+
         // Multi-threaded HTTP (Phase 14b)
         self.functions.insert("http-listen-shared".to_string(), vec![LoadArg(0), HttpListenShared, Ret]);
         self.functions.insert("http-serve-parallel".to_string(), vec![LoadArg(0), LoadArg(1), LoadArg(2), LoadArg(3), HttpServeParallel, Ret]);
@@ -220,6 +449,147 @@ impl VM {
     }
 
     pub fn execute_one_instruction(&mut self) -> Result<(), RuntimeError> {
+        if self.instructions_executed >= self.instruction_limit {
+            return self.exceed_instruction_budget();
+        }
+        self.instructions_executed += 1;
+        let result = match self.dispatch_instruction() {
+            Ok(()) => Ok(()),
+            Err(error) => self.unwind_to_handler(error),
+        };
+        if self.heap.collection_due() && self.run_depth == 0 {
+            self.collect_garbage();
+        }
+        result
+    }
+
+    /// Let the VM run `budget` more instructions, counted across every run from
+    /// now on; the one after fails with an instruction budget error. None lifts
+    /// the limit.
+    pub fn set_instruction_budget(&mut self, budget: Option<u64>) {
+        self.instruction_budget = budget;
+        self.instruction_limit = budget.map_or(u64::MAX, |budget| self.instructions_executed.saturating_add(budget));
+        self.in_budget_grace = false;
+    }
+
+    // The budget ran out. The error is catchable, once: a handler gets
+    // INSTRUCTION_BUDGET_GRACE instructions to report or clean up in, and when
+    // those run out too nothing catches it
+    fn exceed_instruction_budget(&mut self) -> Result<(), RuntimeError> {
+        let budget = self.instruction_budget.unwrap_or_default();
+        let error = RuntimeError::new(format!("Instruction budget exceeded: {} instructions executed", budget));
+        if !self.in_budget_grace {
+            self.in_budget_grace = true;
+            self.instruction_limit = self.instruction_limit.saturating_add(INSTRUCTION_BUDGET_GRACE);
+        }
+        self.unwind_to_handler(error)
+    }
+
+    /// Run a collection now, rooted at everything the program can still reach.
+    /// Returns the number of objects it reclaimed.
+    pub fn collect_garbage(&mut self) -> usize {
+        let frames = self.call_stack.iter().flat_map(|frame| frame.locals.iter().chain(frame.captured.iter()));
+        let tags = self.handlers.iter().filter_map(|handler| handler.tag.as_ref());
+        let waiting = self.tasks.roots();
+        let roots = self.value_stack.iter()
+            .chain(frames)
+            .chain(self.global_vars.values())
+            .chain(tags)
+            .chain(waiting.iter());
+        self.heap.collect(roots)
+    }
+
+    /// Resume at the innermost handler installed by this run, with the error's
+    /// value pushed, or pass the error on when no handler here can catch it
+    fn unwind_to_handler(&mut self, mut error: RuntimeError) -> Result<(), RuntimeError> {
+        // Nothing catches an exit
+        if self.exit_code.is_some() {
+            return Err(error);
+        }
+        if error.location.is_none() {
+            let function = self.call_stack.last().map(|frame| frame.function_name.as_str());
+            error.location = self.source_location(function, self.instruction_pointer);
+        }
+        // Nor, when its grace instructions ran out too, an instruction budget error
+        if self.in_budget_grace && self.instructions_executed >= self.instruction_limit {
+            return Err(error);
+        }
+        // A throw goes to the innermost catch for its tag, any other error to the
+        // innermost handler-case; handlers installed inside that one are dropped
+        let target = self.handlers.iter().rposition(|handler| match &error.thrown_to {
+            Some(tag) => handler.tag.as_ref() == Some(tag),
+            None => handler.tag.is_none(),
+        });
+        match target {
+            Some(index) if self.handlers[index].run_depth == self.run_depth => self.handlers.truncate(index + 1),
+            // Uncaught in a spawned task, it ends that task alone, with the
+            // error as its result
+            _ if self.run_depth == 0 && self.tasks.in_spawned_task() => {
+                let value = error.raised.take().unwrap_or_else(|| Self::error_value(&error));
+                return self.finish_task(TaskState::Failed(value)).or_else(|error| self.unwind_to_handler(error));
+            }
+            _ => return Err(error),
+        }
+
+        let handler = self.handlers.pop().expect("handler checked above");
+        let value = match error.raised.take() {
+            Some(value) => value,
+            None => Self::error_value(&error),
+        };
+        self.call_stack.truncate(handler.call_depth);
+        // Also drops the slots of any let the unwind left before its Slide ran
+        self.value_stack.truncate(handler.stack_depth);
+        self.value_stack.push(value);
+        self.current_bytecode = handler.bytecode;
+        self.instruction_pointer = handler.catch_address;
+        Ok(())
+    }
+
+    /// A built-in runtime error as the map handler-case binds:
+    /// {message "..." file "..." line N column N}, without the position when unknown
+    fn error_value(error: &RuntimeError) -> Value {
+        let mut map = HashMap::new();
+        let key = |name: &str| MapKey::Symbol(Symbol::intern(name));
+        map.insert(key("message"), Value::String(Arc::new(error.message.clone())));
+        if let Some(location) = &error.location {
+            map.insert(key("file"), Value::String(Arc::new(location.file.clone())));
+            map.insert(key("line"), Value::Integer(location.line as i64));
+            map.insert(key("column"), Value::Integer(location.column as i64));
+        }
+        Value::hashmap(map)
+    }
+
+    /// Message for a raised value nothing caught. Re-raising a caught built-in
+    /// error keeps its original message.
+    fn raised_message(value: &Value) -> String {
+        if let Value::HashMap(map) = value {
+            if let Some(Value::String(message)) = map.borrow().get(&MapKey::Symbol(Symbol::intern("message"))) {
+                return message.to_string();
+            }
+        }
+        format!("Uncaught raise: {}", Self::format_diagnostic(value))
+    }
+
+    /// Run the current bytecode to its end from inside an instruction (load, require, eval).
+    /// Handlers the nested code installs only catch its own errors; anything it doesn't
+    /// catch returns to the instruction, leaving handlers outside it to resume.
+    fn run_nested(&mut self) -> Result<(), RuntimeError> {
+        self.run_depth += 1;
+        let mut result = Ok(());
+        while !self.halted && self.instruction_pointer < self.current_bytecode.len() {
+            result = self.execute_one_instruction();
+            if result.is_err() {
+                break;
+            }
+        }
+        self.run_depth -= 1;
+        let run_depth = self.run_depth;
+        self.handlers.retain(|handler| handler.run_depth <= run_depth);
+        result
+    }
+
+    #[inline(always)]
+    fn dispatch_instruction(&mut self) -> Result<(), RuntimeError> {
         let ip = self.instruction_pointer;
         if ip >= self.current_bytecode.len() {
             self.halted = true;
@@ -237,27 +607,8 @@ impl VM {
             Instruction::Add => {
                 let b = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Add operation".to_string()))?;
                 let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Add operation".to_string()))?;
-                match (&a, &b) {
-                    (Value::Integer(x), Value::Integer(y)) => {
-                        self.value_stack.push(Value::Integer(x + y));
-                    }
-                    (Value::Float(x), Value::Float(y)) => {
-                        self.value_stack.push(Value::Float(x + y));
-                    }
-                    (Value::Integer(x), Value::Float(y)) => {
-                        self.value_stack.push(Value::Float(*x as f64 + y));
-                    }
-                    (Value::Float(x), Value::Integer(y)) => {
-                        self.value_stack.push(Value::Float(x + *y as f64));
-                    }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: '+' expects two numbers, got {} and {}",
-                            Self::type_name(&a),
-                            Self::type_name(&b)
-                        )));
-                    }
-                }
+                let sum = Self::add_values(&a, &b)?;
+                self.value_stack.push(sum);
                 self.instruction_pointer += 1;
             }
             Instruction::Sub => {
@@ -265,7 +616,12 @@ impl VM {
                 let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Sub operation".to_string()))?;
                 match (&a, &b) {
                     (Value::Integer(x), Value::Integer(y)) => {
-                        self.value_stack.push(Value::Integer(x - y));
+                        // Only allocate a bignum when the fixnum result overflows
+                        let result = match x.checked_sub(*y) {
+                            Some(n) => Value::Integer(n),
+                            None => Value::from_bigint(BigInt::from_i64(*x).sub(&BigInt::from_i64(*y))),
+                        };
+                        self.value_stack.push(result);
                     }
                     (Value::Float(x), Value::Float(y)) => {
                         self.value_stack.push(Value::Float(x - y));
@@ -276,13 +632,16 @@ impl VM {
                     (Value::Float(x), Value::Integer(y)) => {
                         self.value_stack.push(Value::Float(x - *y as f64));
                     }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: '-' expects two numbers, got {} and {}",
-                            Self::type_name(&a),
-                            Self::type_name(&b)
-                        )));
-                    }
+                    _ => match Self::bigint_arith(&a, &b, BigInt::sub, |x, y| x - y) {
+                        Some(result) => self.value_stack.push(result),
+                        None => {
+                            return Err(RuntimeError::new(format!(
+                                "Type error: '-' expects two numbers, got {} and {}",
+                                Self::type_name(&a),
+                                Self::type_name(&b)
+                            )));
+                        }
+                    },
                 }
                 self.instruction_pointer += 1;
             }
@@ -291,7 +650,12 @@ impl VM {
                 let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Mul operation".to_string()))?;
                 match (&a, &b) {
                     (Value::Integer(x), Value::Integer(y)) => {
-                        self.value_stack.push(Value::Integer(x * y));
+                        // Only allocate a bignum when the fixnum result overflows
+                        let result = match x.checked_mul(*y) {
+                            Some(n) => Value::Integer(n),
+                            None => Value::from_bigint(BigInt::from_i64(*x).mul(&BigInt::from_i64(*y))),
+                        };
+                        self.value_stack.push(result);
                     }
                     (Value::Float(x), Value::Float(y)) => {
                         self.value_stack.push(Value::Float(x * y));
@@ -302,13 +666,16 @@ impl VM {
                     (Value::Float(x), Value::Integer(y)) => {
                         self.value_stack.push(Value::Float(x * *y as f64));
                     }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: '*' expects two numbers, got {} and {}",
-                            Self::type_name(&a),
-                            Self::type_name(&b)
-                        )));
-                    }
+                    _ => match Self::bigint_arith(&a, &b, BigInt::mul, |x, y| x * y) {
+                        Some(result) => self.value_stack.push(result),
+                        None => {
+                            return Err(RuntimeError::new(format!(
+                                "Type error: '*' expects two numbers, got {} and {}",
+                                Self::type_name(&a),
+                                Self::type_name(&b)
+                            )));
+                        }
+                    },
                 }
                 self.instruction_pointer += 1;
             }
@@ -323,7 +690,12 @@ impl VM {
                                 "Check your divisor before dividing. You can use an if-expression to handle zero cases: (if (== y 0) 0 (/ x y))".to_string(),
                             ));
                         }
-                        self.value_stack.push(Value::Integer(x / y));
+                        // i64::MIN / -1 is the only overflowing quotient
+                        let result = match x.checked_div(*y) {
+                            Some(n) => Value::Integer(n),
+                            None => Value::from_bigint(BigInt::from_i64(*x).neg()),
+                        };
+                        self.value_stack.push(result);
                     }
                     (Value::Float(x), Value::Float(y)) => {
                         if *y == 0.0 {
@@ -352,9 +724,44 @@ impl VM {
                         }
                         self.value_stack.push(Value::Float(x / *y as f64));
                     }
+                    (Value::BigInt(_), Value::Integer(0)) => {
+                        return Err(RuntimeError::with_suggestion(
+                            "Division by zero".to_string(),
+                            "Check your divisor before dividing. You can use an if-expression to handle zero cases: (if (== y 0) 0 (/ x y))".to_string(),
+                        ));
+                    }
+                    _ => match Self::bigint_arith(&a, &b, |x, y| x.div_rem(y).expect("nonzero divisor").0, |x, y| x / y) {
+                        Some(result) => self.value_stack.push(result),
+                        None => {
+                            return Err(RuntimeError::with_suggestion(
+                                format!(
+                                    "Type error: '/' expects two numbers, got {} and {}",
+                                    Self::type_name(&a),
+                                    Self::type_name(&b)
+                                ),
+                                "/ on two integers truncates toward zero, so (/ 7 2) is 3; use /. for a float quotient: (/. 7 2) is 3.5".to_string(),
+                            ));
+                        }
+                    },
+                }
+                self.instruction_pointer += 1;
+            }
+            Instruction::FloatDiv => {
+                let b = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in FloatDiv operation".to_string()))?;
+                let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in FloatDiv operation".to_string()))?;
+                match (a.as_f64(), b.as_f64()) {
+                    (Some(_), Some(y)) if y == 0.0 => {
+                        return Err(RuntimeError::with_suggestion(
+                            "Division by zero".to_string(),
+                            "Check your divisor before dividing. You can use an if-expression to handle zero cases: (if (== y 0) 0.0 (/. x y))".to_string(),
+                        ));
+                    }
+                    (Some(x), Some(y)) => {
+                        self.value_stack.push(Value::Float(x / y));
+                    }
                     _ => {
                         return Err(RuntimeError::new(format!(
-                            "Type error: '/' expects two numbers, got {} and {}",
+                            "Type error: '/.' expects two numbers, got {} and {}",
                             Self::type_name(&a),
                             Self::type_name(&b)
                         )));
@@ -373,7 +780,7 @@ impl VM {
                                 "Check your divisor before using modulo. You can use an if-expression: (if (== y 0) 0 (% x y))".to_string(),
                             ));
                         }
-                        self.value_stack.push(Value::Integer(x % y));
+                        self.value_stack.push(Value::Integer(x.checked_rem(*y).unwrap_or(0)));
                     }
                     (Value::Float(x), Value::Float(y)) => {
                         if *y == 0.0 {
@@ -402,21 +809,70 @@ impl VM {
                         }
                         self.value_stack.push(Value::Float(x % (*y as f64)));
                     }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: '%' expects two numbers, got {} and {}",
-                            Self::type_name(&a),
-                            Self::type_name(&b)
-                        )));
+                    (Value::BigInt(_), Value::Integer(0)) => {
+                        return Err(RuntimeError::with_suggestion(
+                            "Modulo by zero".to_string(),
+                            "Check your divisor before using modulo. You can use an if-expression: (if (== y 0) 0 (% x y))".to_string(),
+                        ));
                     }
+                    _ => match Self::bigint_arith(&a, &b, |x, y| x.div_rem(y).expect("nonzero divisor").1, |x, y| x % y) {
+                        Some(result) => self.value_stack.push(result),
+                        None => {
+                            return Err(RuntimeError::new(format!(
+                                "Type error: '%' expects two numbers, got {} and {}",
+                                Self::type_name(&a),
+                                Self::type_name(&b)
+                            )));
+                        }
+                    },
                 }
                 self.instruction_pointer += 1;
             }
+            Instruction::Quotient => {
+                let b = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Quotient operation".to_string()))?;
+                let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Quotient operation".to_string()))?;
+                let result = Self::integer_division("quotient", &a, &b)?;
+                self.value_stack.push(result);
+                self.instruction_pointer += 1;
+            }
+            Instruction::Remainder => {
+                let b = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Remainder operation".to_string()))?;
+                let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Remainder operation".to_string()))?;
+                let result = Self::integer_division("remainder", &a, &b)?;
+                self.value_stack.push(result);
+                self.instruction_pointer += 1;
+            }
+            Instruction::Modulo => {
+                let b = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Modulo operation".to_string()))?;
+                let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Modulo operation".to_string()))?;
+                let result = Self::integer_division("modulo", &a, &b)?;
+                self.value_stack.push(result);
+                self.instruction_pointer += 1;
+            }
+            Instruction::CheckedAdd => self.fixed_width_instruction("checked-add")?,
+            Instruction::CheckedSub => self.fixed_width_instruction("checked-sub")?,
+            Instruction::CheckedMul => self.fixed_width_instruction("checked-mul")?,
+            Instruction::WrappingAdd => self.fixed_width_instruction("wrapping-add")?,
+            Instruction::WrappingSub => self.fixed_width_instruction("wrapping-sub")?,
+            Instruction::WrappingMul => self.fixed_width_instruction("wrapping-mul")?,
+            Instruction::BitAnd => self.bitwise_instruction("bit-and")?,
+            Instruction::BitOr => self.bitwise_instruction("bit-or")?,
+            Instruction::BitXor => self.bitwise_instruction("bit-xor")?,
+            Instruction::BitNot => self.bitwise_instruction("bit-not")?,
+            Instruction::ShiftLeft => self.bitwise_instruction("shift-left")?,
+            Instruction::ShiftRight => self.bitwise_instruction("shift-right")?,
             Instruction::Neg => {
                 let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Neg operation".to_string()))?;
                 match &a {
                     Value::Integer(x) => {
-                        self.value_stack.push(Value::Integer(-x));
+                        let result = match x.checked_neg() {
+                            Some(n) => Value::Integer(n),
+                            None => Value::from_bigint(BigInt::from_i64(*x).neg()),
+                        };
+                        self.value_stack.push(result);
+                    }
+                    Value::BigInt(x) => {
+                        self.value_stack.push(Value::from_bigint(x.neg()));
                     }
                     Value::Float(x) => {
                         self.value_stack.push(Value::Float(-x));
@@ -446,13 +902,16 @@ impl VM {
                     (Value::Float(x), Value::Integer(y)) => {
                         self.value_stack.push(Value::Boolean(*x <= (*y as f64)));
                     }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: '<=' expects two numbers, got {} and {}",
-                            Self::type_name(&a),
-                            Self::type_name(&b)
-                        )));
-                    }
+                    _ => match Self::bigint_compare(&a, &b, Ordering::is_le) {
+                        Some(result) => self.value_stack.push(Value::Boolean(result)),
+                        None => {
+                            return Err(RuntimeError::new(format!(
+                                "Type error: '<=' expects two numbers, got {} and {}",
+                                Self::type_name(&a),
+                                Self::type_name(&b)
+                            )));
+                        }
+                    },
                 }
                 self.instruction_pointer += 1;
             }
@@ -472,13 +931,16 @@ impl VM {
                     (Value::Float(x), Value::Integer(y)) => {
                         self.value_stack.push(Value::Boolean(*x < (*y as f64)));
                     }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: '<' expects two numbers, got {} and {}",
-                            Self::type_name(&a),
-                            Self::type_name(&b)
-                        )));
-                    }
+                    _ => match Self::bigint_compare(&a, &b, Ordering::is_lt) {
+                        Some(result) => self.value_stack.push(Value::Boolean(result)),
+                        None => {
+                            return Err(RuntimeError::new(format!(
+                                "Type error: '<' expects two numbers, got {} and {}",
+                                Self::type_name(&a),
+                                Self::type_name(&b)
+                            )));
+                        }
+                    },
                 }
                 self.instruction_pointer += 1;
             }
@@ -498,13 +960,16 @@ impl VM {
                     (Value::Float(x), Value::Integer(y)) => {
                         self.value_stack.push(Value::Boolean(*x > (*y as f64)));
                     }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: '>' expects two numbers, got {} and {}",
-                            Self::type_name(&a),
-                            Self::type_name(&b)
-                        )));
-                    }
+                    _ => match Self::bigint_compare(&a, &b, Ordering::is_gt) {
+                        Some(result) => self.value_stack.push(Value::Boolean(result)),
+                        None => {
+                            return Err(RuntimeError::new(format!(
+                                "Type error: '>' expects two numbers, got {} and {}",
+                                Self::type_name(&a),
+                                Self::type_name(&b)
+                            )));
+                        }
+                    },
                 }
                 self.instruction_pointer += 1;
             }
@@ -524,28 +989,23 @@ impl VM {
                     (Value::Float(x), Value::Integer(y)) => {
                         self.value_stack.push(Value::Boolean(*x >= (*y as f64)));
                     }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: '>=' expects two numbers, got {} and {}",
-                            Self::type_name(&a),
-                            Self::type_name(&b)
-                        )));
-                    }
+                    _ => match Self::bigint_compare(&a, &b, Ordering::is_ge) {
+                        Some(result) => self.value_stack.push(Value::Boolean(result)),
+                        None => {
+                            return Err(RuntimeError::new(format!(
+                                "Type error: '>=' expects two numbers, got {} and {}",
+                                Self::type_name(&a),
+                                Self::type_name(&b)
+                            )));
+                        }
+                    },
                 }
                 self.instruction_pointer += 1;
             }
             Instruction::Eq => {
                 let b = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Eq operation".to_string()))?;
                 let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Eq operation".to_string()))?;
-                // Handle numeric type coercion for equality
-                let result = match (&a, &b) {
-                    (Value::Integer(x), Value::Integer(y)) => x == y,
-                    (Value::Float(x), Value::Float(y)) => x == y,
-                    (Value::Integer(x), Value::Float(y)) => *x as f64 == *y,
-                    (Value::Float(x), Value::Integer(y)) => *x == *y as f64,
-                    _ => a == b, // For non-numeric types, use standard PartialEq
-                };
-                self.value_stack.push(Value::Boolean(result));
+                self.value_stack.push(Value::Boolean(Self::values_equal(&a, &b)));
                 self.instruction_pointer += 1;
             }
             Instruction::Neq => {
@@ -557,7 +1017,24 @@ impl VM {
                     (Value::Float(x), Value::Float(y)) => x != y,
                     (Value::Integer(x), Value::Float(y)) => *x as f64 != *y,
                     (Value::Float(x), Value::Integer(y)) => *x != *y as f64,
-                    _ => a != b, // For non-numeric types, use standard PartialEq
+                    _ => !Self::bigint_compare(&a, &b, Ordering::is_eq).unwrap_or(a == b), // Otherwise standard PartialEq
+                };
+                self.value_stack.push(Value::Boolean(result));
+                self.instruction_pointer += 1;
+            }
+            Instruction::NumEq => {
+                let b = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in NumEq operation".to_string()))?;
+                let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in NumEq operation".to_string()))?;
+                let result = match (&a, &b) {
+                    (Value::Integer(x), Value::Integer(y)) => x == y,
+                    (Value::Float(x), Value::Float(y)) => x == y,
+                    (Value::Integer(x), Value::Float(y)) => *x as f64 == *y,
+                    (Value::Float(x), Value::Integer(y)) => *x == *y as f64,
+                    _ => Self::bigint_compare(&a, &b, Ordering::is_eq).ok_or_else(|| RuntimeError::new(format!(
+                        "Type error: '=' expects two numbers, got {} and {}",
+                        Self::type_name(&a),
+                        Self::type_name(&b)
+                    )))?,
                 };
                 self.value_stack.push(Value::Boolean(result));
                 self.instruction_pointer += 1;
@@ -568,46 +1045,62 @@ impl VM {
             Instruction::JmpIfFalse(addr) => {
                 let addr = *addr;
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in JmpIfFalse operation".to_string()))?;
-                match value {
-                    Value::Boolean(false) => {
-                        self.instruction_pointer = addr;
-                    }
-                    Value::Boolean(true) => {
-                        self.instruction_pointer += 1;
-                    }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: conditional expects boolean, got {}",
-                            Self::type_name(&value)
-                        )));
-                    }
+                // Only false is falsy, as for and, or and assert
+                if matches!(value, Value::Boolean(false)) {
+                    self.instruction_pointer = addr;
+                } else {
+                    self.instruction_pointer += 1;
+                }
+            }
+            Instruction::JmpIfFalseOrPop(addr) => {
+                // Only false is falsy here, so and can return any value
+                let addr = *addr;
+                let value = self.value_stack.last().ok_or_else(|| RuntimeError::new("Stack underflow in JmpIfFalseOrPop operation".to_string()))?;
+                if matches!(value, Value::Boolean(false)) {
+                    self.instruction_pointer = addr;
+                } else {
+                    self.value_stack.pop();
+                    self.instruction_pointer += 1;
+                }
+            }
+            Instruction::JmpIfTrueOrPop(addr) => {
+                let addr = *addr;
+                let value = self.value_stack.last().ok_or_else(|| RuntimeError::new("Stack underflow in JmpIfTrueOrPop operation".to_string()))?;
+                if matches!(value, Value::Boolean(false)) {
+                    self.value_stack.pop();
+                    self.instruction_pointer += 1;
+                } else {
+                    self.instruction_pointer = addr;
                 }
             }
             Instruction::LoadArg(idx) => {
-                let idx = *idx;
-                let frame = self.call_stack.last().ok_or_else(|| RuntimeError::new("No frame to load arg from".to_string()))?;
-                let value = frame.locals.get(idx).ok_or_else(|| RuntimeError::new(format!("Arg index {} out of bounds", idx)))?.clone();
+                let value = self.arg(*idx)?;
                 self.value_stack.push(value);
                 self.instruction_pointer += 1;
             }
+            Instruction::AddArgs(a, b) => {
+                let sum = Self::add_values(&self.arg(*a)?, &self.arg(*b)?)?;
+                self.value_stack.push(sum);
+                self.instruction_pointer += 1;
+            }
+            Instruction::StoreArg(idx) => {
+                let idx = *idx;
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StoreArg".to_string()))?;
+                let frame = self.call_stack.last_mut().ok_or_else(|| RuntimeError::new("No frame to store arg in".to_string()))?;
+                let slot = frame.locals.get_mut(idx).ok_or_else(|| RuntimeError::new(format!("Arg index {} out of bounds", idx)))?;
+                *slot = value;
+                self.instruction_pointer += 1;
+            }
             Instruction::GetLocal(pos) => {
-                let pos = *pos;
-                // Load from value stack at position relative to current frame's stack base
-                let stack_base = if let Some(frame) = self.call_stack.last() {
-                    frame.stack_base
-                } else {
-                    0  // Main execution has stack_base 0
-                };
-                let absolute_pos = stack_base + pos;
-                let value = self.value_stack.get(absolute_pos)
-                    .ok_or_else(|| RuntimeError::new(format!(
-                        "Stack position {} (base {} + offset {}) out of bounds",
-                        absolute_pos, stack_base, pos
-                    )))?
-                    .clone();
+                let value = self.local(*pos)?;
                 self.value_stack.push(value);
                 self.instruction_pointer += 1;
             }
+            Instruction::AddLocals(a, b) => {
+                let sum = Self::add_values(&self.local(*a)?, &self.local(*b)?)?;
+                self.value_stack.push(sum);
+                self.instruction_pointer += 1;
+            }
             Instruction::SetLocal(pos) => {
                 let pos = *pos;
                 // Set local variable at position on value stack
@@ -629,81 +1122,133 @@ impl VM {
                 self.value_stack[absolute_pos] = value;
                 self.instruction_pointer += 1;
             }
-            Instruction::BeginLoop(bindings_count) => {
-                let bindings_count = *bindings_count;
-                // Mark the current position as a loop start
-                // The loop bindings are already on the value stack (pushed by the compiler)
-                // We just need to record where they are and where to jump back to
-                let loop_start = self.instruction_pointer + 1; // Next instruction after BeginLoop
-                let stack_base = if let Some(frame) = self.call_stack.last() {
-                    frame.stack_base
-                } else {
-                    0
+            Instruction::MakeCell => {
+                let cell = self.heap.new_cell();
+                self.value_stack.push(cell);
+                self.instruction_pointer += 1;
+            }
+            Instruction::CellGet(name) => {
+                let cell = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in CellGet".to_string()))?;
+                let value = match &cell {
+                    Value::Cell(contents) => contents.borrow().clone().ok_or_else(|| {
+                        RuntimeError::with_suggestion(
+                            format!("letrec binding '{}' used before initialization", name),
+                            "Only refer to letrec bindings from inside lambdas, or after all initializers have run".to_string(),
+                        )
+                    })?,
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: CellGet expects a cell, got {}",
+                            Self::type_name(&cell)
+                        )));
+                    }
                 };
-                let bindings_start = self.value_stack.len() - bindings_count;
-
-                // Update the current frame or create loop context on main
-                if let Some(frame) = self.call_stack.last_mut() {
-                    frame.loop_start = Some(loop_start);
-                    frame.loop_bindings_start = Some(bindings_start);
-                    frame.loop_bindings_count = Some(bindings_count);
-                } else {
-                    // We're in main execution - we need to track loop info differently
-                    // For now, we'll store it in a way that recur can access
-                    // Actually, let's create a dummy frame for main execution's loop
-                    // Or better, let's ensure main always has a frame
-                    // For simplicity, let's require that loops are only in functions
-                    // Actually, let's support loops in main too by creating a frame
-                    let frame = Frame::new(0, Vec::new(), "<main>".to_string(), stack_base);
-                    self.call_stack.push(frame);
-                    if let Some(frame) = self.call_stack.last_mut() {
-                        frame.loop_start = Some(loop_start);
-                        frame.loop_bindings_start = Some(bindings_start);
-                        frame.loop_bindings_count = Some(bindings_count);
+                self.value_stack.push(value);
+                self.instruction_pointer += 1;
+            }
+            Instruction::CellSet => {
+                let cell = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in CellSet".to_string()))?;
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in CellSet".to_string()))?;
+                match &cell {
+                    Value::Cell(contents) => {
+                        *contents.borrow_mut() = Some(value);
+                    }
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: CellSet expects a cell, got {}",
+                            Self::type_name(&cell)
+                        )));
                     }
                 }
-
                 self.instruction_pointer += 1;
             }
-            Instruction::Recur(arg_count) => {
-                let arg_count = *arg_count;
-                // Get loop information from current frame
-                let (loop_start, bindings_start, bindings_count) = if let Some(frame) = self.call_stack.last() {
-                    (
-                        frame.loop_start.ok_or_else(|| RuntimeError::new("recur used outside of loop".to_string()))?,
-                        frame.loop_bindings_start.ok_or_else(|| RuntimeError::new("recur used outside of loop".to_string()))?,
-                        frame.loop_bindings_count.ok_or_else(|| RuntimeError::new("recur used outside of loop".to_string()))?,
-                    )
-                } else {
-                    return Err(RuntimeError::new("recur used outside of loop".to_string()));
-                };
-
-                // Verify arg_count matches bindings_count
-                if arg_count != bindings_count {
-                    return Err(RuntimeError::new(format!(
-                        "recur expects {} arguments but got {}",
-                        bindings_count, arg_count
-                    )));
+            Instruction::Values(count) => {
+                let count = *count;
+                if self.value_stack.len() < count {
+                    return Err(RuntimeError::new("Stack underflow in Values".to_string()));
                 }
+                let values = self.value_stack.split_off(self.value_stack.len() - count);
 
-                // Pop the new values from the stack (in reverse order)
-                let mut new_values = Vec::new();
-                for _ in 0..arg_count {
-                    new_values.push(self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Recur".to_string()))?);
+                let wants_all = self.call_stack.last().map_or(false, |frame| frame.multiple_values);
+                if wants_all {
+                    // Return straight to call-with-values: every value, then the count
+                    let frame = self.call_stack.pop().ok_or_else(|| RuntimeError::new("No frame to return from".to_string()))?;
+                    self.value_stack.truncate(frame.stack_base);
+                    self.value_stack.extend(values);
+                    self.value_stack.push(Value::Integer(count as i64));
+                    self.current_bytecode = frame.return_bytecode;
+                    self.instruction_pointer = frame.return_address;
+                } else {
+                    // Any other caller sees only the primary value
+                    let primary = values.into_iter().next().unwrap_or(Value::List(List::Nil));
+                    self.value_stack.push(primary);
+                    self.instruction_pointer += 1;
                 }
-                new_values.reverse();
-
-                // Clean up stack: truncate everything after the loop bindings
-                // This removes all let-bindings created inside the loop body
-                self.value_stack.truncate(bindings_start + bindings_count);
-
-                // Update the loop bindings with new values
-                for (i, value) in new_values.into_iter().enumerate() {
-                    self.value_stack[bindings_start + i] = value;
+            }
+            Instruction::CallForValues => {
+                let producer = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in CallForValues".to_string()))?;
+                self.push_call_frame(&producer, Vec::new(), true, "call-with-values")?;
+            }
+            Instruction::ApplyValues => {
+                // Stack: ... <consumer> <value>... <count> (top)
+                let count = match self.value_stack.pop() {
+                    Some(Value::Integer(n)) if n >= 0 => n as usize,
+                    Some(other) => {
+                        return Err(RuntimeError::new(format!(
+                            "ApplyValues expects a value count, got {}",
+                            Self::type_name(&other)
+                        )));
+                    }
+                    None => return Err(RuntimeError::new("Stack underflow in ApplyValues".to_string())),
+                };
+                if self.value_stack.len() < count + 1 {
+                    return Err(RuntimeError::new("Stack underflow in ApplyValues".to_string()));
                 }
-
-                // Jump back to loop start
-                self.instruction_pointer = loop_start;
+                let args = self.value_stack.split_off(self.value_stack.len() - count);
+                let consumer = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ApplyValues".to_string()))?;
+                self.push_call_frame(&consumer, args, false, "call-with-values")?;
+            }
+            Instruction::PushHandler(addr) => {
+                let handler = Handler {
+                    catch_address: *addr,
+                    bytecode: self.current_bytecode.clone(),
+                    call_depth: self.call_stack.len(),
+                    stack_depth: self.value_stack.len(),
+                    run_depth: self.run_depth,
+                    tag: None,
+                };
+                self.handlers.push(handler);
+                self.instruction_pointer += 1;
+            }
+            Instruction::PopHandler => {
+                self.handlers.pop().ok_or_else(|| RuntimeError::new("PopHandler with no handler installed".to_string()))?;
+                self.instruction_pointer += 1;
+            }
+            Instruction::Raise => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Raise".to_string()))?;
+                return Err(RuntimeError::raised(Self::raised_message(&value), value));
+            }
+            Instruction::PushCatch(addr) => {
+                let tag = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in PushCatch".to_string()))?;
+                let handler = Handler {
+                    catch_address: *addr,
+                    bytecode: self.current_bytecode.clone(),
+                    call_depth: self.call_stack.len(),
+                    stack_depth: self.value_stack.len(),
+                    run_depth: self.run_depth,
+                    tag: Some(tag),
+                };
+                self.handlers.push(handler);
+                self.instruction_pointer += 1;
+            }
+            Instruction::Throw => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Throw".to_string()))?;
+                let tag = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Throw".to_string()))?;
+                let tag_name = Self::format_diagnostic(&tag);
+                if !self.handlers.iter().any(|handler| handler.tag.as_ref() == Some(&tag)) {
+                    return Err(RuntimeError::new(format!("throw to tag '{}' has no matching catch", tag_name)));
+                }
+                return Err(RuntimeError::thrown(format!("Uncaught throw to tag '{}'", tag_name), tag, value));
             }
             Instruction::PopN(n) => {
                 let n = *n;
@@ -785,6 +1330,7 @@ impl VM {
                 }));
 
                 self.value_stack.push(closure);
+                self.heap.note_allocations(1);
                 self.instruction_pointer += 1;
             }
             Instruction::MakeVariadicClosure(required_params, rest_param, body, num_captured) => {
@@ -814,6 +1360,7 @@ impl VM {
                 }));
 
                 self.value_stack.push(closure);
+                self.heap.note_allocations(1);
                 self.instruction_pointer += 1;
             }
             Instruction::CallClosure(arg_count) => {
@@ -831,9 +1378,8 @@ impl VM {
                 match callable {
                     Value::Function(ref fn_name) => {
                         // Call a named function (same as Call instruction)
-                        let fn_bytecode = self.functions.get(fn_name.as_str())
-                            .ok_or_else(|| RuntimeError::new(format!("Undefined function '{}'", fn_name)))?
-                            .clone();
+                        let fn_bytecode = self.call_cache.resolve(fn_name, &self.functions)
+                            .ok_or_else(|| RuntimeError::new(format!("Undefined function '{}'", fn_name)))?;
 
                         let frame = Frame {
                             return_address: self.instruction_pointer + 1,
@@ -842,60 +1388,32 @@ impl VM {
                             function_name: fn_name.to_string(),
                             captured: Vec::new(),
                             stack_base: self.value_stack.len(),
-                            loop_start: None,
-                            loop_bindings_start: None,
-                            loop_bindings_count: None,
+                            multiple_values: false,
                         };
-                        self.call_stack.push(frame);
+                        self.push_frame(frame)?;
 
                         self.current_bytecode = fn_bytecode;
                         self.instruction_pointer = 0;
                     }
                     Value::Closure(ref closure_data) => {
-                        // Verify arity
-                        match &closure_data.rest_param {
-                            None => {
-                                // Regular closure - exact arity match required
-                                if closure_data.params.len() != args.len() {
-                                    return Err(RuntimeError::new(format!(
-                                        "Closure arity mismatch: expected {} argument(s), got {}",
-                                        closure_data.params.len(),
-                                        args.len()
-                                    )));
-                                }
-                            }
-                            Some(_rest_name) => {
-                                // Variadic closure - need at least the required params
-                                if args.len() < closure_data.params.len() {
-                                    return Err(RuntimeError::new(format!(
-                                        "Variadic closure arity mismatch: expected at least {} argument(s), got {}",
-                                        closure_data.params.len(),
-                                        args.len()
-                                    )));
-                                }
-                                // Pack extra args into a list and append to args
-                                let rest_args: Vec<Value> = args.drain(closure_data.params.len()..).collect();
-                                args.push(Value::List(List::from_vec(rest_args)));
-                            }
-                        }
+                        // Verify arity and pack rest args
+                        let args = Self::bind_closure_args(closure_data, args)?;
 
                         // Create frame with arguments and captured environment
                         let frame = Frame {
                             return_address: self.instruction_pointer + 1,
                             locals: args,
-                            return_bytecode: self.current_bytecode.to_vec(),
+                            return_bytecode: self.current_bytecode.clone(),
                             function_name: "<closure>".to_string(),
                             captured: closure_data.captured.iter().map(|(_, v)| v.clone()).collect(),
                             stack_base: self.value_stack.len(), // Current stack top is base for this function
-                            loop_start: None,
-                            loop_bindings_start: None,
-                            loop_bindings_count: None,
+                            multiple_values: false,
                         };
 
-                        self.call_stack.push(frame);
+                        self.push_frame(frame)?;
 
                         // Switch to closure body bytecode
-                        self.current_bytecode = closure_data.body.clone();
+                        self.current_bytecode = Rc::new(closure_data.body.clone());
                         self.instruction_pointer = 0;
                     }
                     _ => {
@@ -906,6 +1424,20 @@ impl VM {
                     }
                 }
             }
+            Instruction::TailCallClosure(arg_count) => {
+                let arg_count = *arg_count;
+                // Pop arguments from stack (in reverse order)
+                let mut args = Vec::new();
+                for _ in 0..arg_count {
+                    args.push(self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in TailCallClosure".to_string()))?);
+                }
+                args.reverse();
+
+                // Pop the function/closure
+                let callable = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in TailCallClosure".to_string()))?;
+
+                self.reuse_call_frame(callable, args)?;
+            }
             Instruction::Apply => {
                 // Apply function to a list of arguments
                 // Stack: ... <function/closure> <list> (top)
@@ -930,9 +1462,8 @@ impl VM {
                 match callable {
                     Value::Function(ref fn_name) => {
                         // Call a named function
-                        let fn_bytecode = self.functions.get(fn_name.as_str())
-                            .ok_or_else(|| RuntimeError::new(format!("Undefined function '{}'", fn_name)))?
-                            .clone();
+                        let fn_bytecode = self.call_cache.resolve(fn_name, &self.functions)
+                            .ok_or_else(|| RuntimeError::new(format!("Undefined function '{}'", fn_name)))?;
 
                         let frame = Frame {
                             return_address: self.instruction_pointer + 1,
@@ -941,11 +1472,9 @@ impl VM {
                             function_name: fn_name.to_string(),
                             captured: Vec::new(),
                             stack_base: self.value_stack.len(),
-                            loop_start: None,
-                            loop_bindings_start: None,
-                            loop_bindings_count: None,
+                            multiple_values: false,
                         };
-                        self.call_stack.push(frame);
+                        self.push_frame(frame)?;
 
                         self.current_bytecode = fn_bytecode;
                         self.instruction_pointer = 0;
@@ -988,14 +1517,12 @@ impl VM {
                             function_name: "<closure>".to_string(),
                             captured: closure_data.captured.iter().map(|(_, v)| v.clone()).collect(),
                             stack_base: self.value_stack.len(),
-                            loop_start: None,
-                            loop_bindings_start: None,
-                            loop_bindings_count: None,
+                            multiple_values: false,
                         };
-                        self.call_stack.push(frame);
+                        self.push_frame(frame)?;
 
                         // Switch to closure body bytecode
-                        self.current_bytecode = closure_data.body.clone();
+                        self.current_bytecode = Rc::new(closure_data.body.clone());
                         self.instruction_pointer = 0;
                     }
                     _ => {
@@ -1006,6 +1533,208 @@ impl VM {
                     }
                 }
             }
+            Instruction::TailApply => {
+                let arg_list = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in TailApply".to_string()))?;
+                let args = match arg_list {
+                    Value::List(list) => list.to_vec(),
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error in apply: expected list of arguments, got {}",
+                            Self::type_name(&arg_list)
+                        )));
+                    }
+                };
+                let callable = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in TailApply".to_string()))?;
+                self.reuse_call_frame(callable, args)?;
+            }
+            Instruction::MakeStruct(name, n) => {
+                if self.value_stack.len() < *n {
+                    return Err(RuntimeError::new("Stack underflow in MakeStruct".to_string()));
+                }
+                let fields = self.value_stack.split_off(self.value_stack.len() - n);
+                let data = StructData { name: Arc::new(name.clone()), fields };
+                self.value_stack.push(Value::Struct(Arc::new(data)));
+                self.heap.note_allocations(1);
+                self.instruction_pointer += 1;
+            }
+            Instruction::StructGet(name, index) => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StructGet".to_string()))?;
+                match &value {
+                    Value::Struct(data) if data.name.as_str() == name => {
+                        self.value_stack.push(data.fields[*index].clone());
+                    }
+                    other => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: expected {} struct, got {}", name, Self::type_name(other)
+                        )));
+                    }
+                }
+                self.instruction_pointer += 1;
+            }
+            Instruction::IsStruct(name) => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in IsStruct".to_string()))?;
+                let matches = matches!(&value, Value::Struct(data) if data.name.as_str() == name);
+                self.value_stack.push(Value::Boolean(matches));
+                self.instruction_pointer += 1;
+            }
+            Instruction::MatchFailed => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in MatchFailed".to_string()))?;
+                return Err(RuntimeError::new(format!("No matching pattern in match for value {}", Self::format_diagnostic(&value))));
+            }
+            Instruction::ClauseFailed(name) => {
+                return Err(RuntimeError::new(format!("No matching clause in function '{}'", name)));
+            }
+            Instruction::IsEq => {
+                let b = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in IsEq".to_string()))?;
+                let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in IsEq".to_string()))?;
+                self.value_stack.push(Value::Boolean(a.is_eq(&b)));
+                self.instruction_pointer += 1;
+            }
+            Instruction::IsEqv => {
+                let b = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in IsEqv".to_string()))?;
+                let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in IsEqv".to_string()))?;
+                self.value_stack.push(Value::Boolean(a.is_eqv(&b)));
+                self.instruction_pointer += 1;
+            }
+            Instruction::Equal => {
+                let b = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Equal".to_string()))?;
+                let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Equal".to_string()))?;
+                let equal = a.is_equal(&b).map_err(RuntimeError::new)?;
+                self.value_stack.push(Value::Boolean(equal));
+                self.instruction_pointer += 1;
+            }
+            Instruction::JumpTable(min, targets, default) => {
+                let key = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in JumpTable".to_string()))?;
+                // Keys compare like =, so an integral float finds its integer's entry
+                let key = match key {
+                    Value::Integer(n) => Some(n),
+                    Value::Float(f) if f.fract() == 0.0 && f >= i64::MIN as f64 && f < i64::MAX as f64 => Some(f as i64),
+                    _ => None,
+                };
+                self.instruction_pointer = key
+                    .and_then(|n| n.checked_sub(*min))
+                    .and_then(|offset| usize::try_from(offset).ok())
+                    .and_then(|offset| targets.get(offset))
+                    .copied()
+                    .unwrap_or(*default);
+            }
+            Instruction::CollectGarbage => {
+                // Runs in the gc function's frame, which holds no values
+                let reclaimed = self.collect_garbage();
+                self.value_stack.push(Value::Integer(reclaimed as i64));
+                self.instruction_pointer += 1;
+            }
+            Instruction::GetGcStats => {
+                let stats = &self.heap.stats;
+                let mut map = HashMap::new();
+                let key = |name: &str| MapKey::Symbol(Symbol::intern(name));
+                map.insert(key("collections"), Value::Integer(stats.collections as i64));
+                map.insert(key("allocated"), Value::Integer(stats.allocated as i64));
+                map.insert(key("live-objects"), Value::Integer(stats.live_objects as i64));
+                map.insert(key("peak-live-objects"), Value::Integer(stats.peak_live_objects as i64));
+                map.insert(key("cells-reclaimed"), Value::Integer(stats.cells_reclaimed as i64));
+                map.insert(key("objects-reclaimed"), Value::Integer(stats.objects_reclaimed as i64));
+                self.value_stack.push(Value::hashmap(map));
+                self.instruction_pointer += 1;
+            }
+            Instruction::MakePromise => {
+                let thunk = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in MakePromise".to_string()))?;
+                self.value_stack.push(Value::Promise(Rc::new(RefCell::new(Promise::Delayed(thunk)))));
+                self.heap.note_allocations(1);
+                self.instruction_pointer += 1;
+            }
+            Instruction::IsPromise => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in IsPromise".to_string()))?;
+                self.value_stack.push(Value::Boolean(matches!(value, Value::Promise(_))));
+                self.instruction_pointer += 1;
+            }
+            Instruction::ForceBegin => {
+                self.force_begin()?;
+                self.instruction_pointer += 1;
+            }
+            Instruction::ForceEnd => {
+                let promise = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ForceEnd".to_string()))?;
+                let result = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ForceEnd".to_string()))?;
+                if let Value::Promise(promise) = promise {
+                    *promise.borrow_mut() = Promise::Forced(result.clone());
+                }
+                self.value_stack.push(result);
+                self.instruction_pointer += 1;
+            }
+            Instruction::TimeStart => {
+                let nanos = self.clock.elapsed().as_nanos() as i64;
+                self.value_stack.push(Value::Integer(self.instructions_executed as i64));
+                self.value_stack.push(Value::Integer(self.heap.stats.allocated as i64));
+                self.value_stack.push(Value::Integer(nanos));
+                self.instruction_pointer += 1;
+            }
+            Instruction::TimeEnd => {
+                let result = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in TimeEnd".to_string()))?;
+                let readings = (self.value_stack.pop(), self.value_stack.pop(), self.value_stack.pop());
+                let (start_count, start_allocated, start_nanos) = match readings {
+                    (Some(Value::Integer(nanos)), Some(Value::Integer(allocated)), Some(Value::Integer(count))) => {
+                        (count as u64, allocated as u64, nanos as u128)
+                    }
+                    _ => return Err(RuntimeError::new("TimeEnd without matching TimeStart".to_string())),
+                };
+                // Neither TimeStart nor this instruction is part of the measured expression
+                let count = self.instructions_executed - start_count - 1;
+                let allocated = self.heap.stats.allocated - start_allocated;
+                let elapsed = (self.clock.elapsed().as_nanos() - start_nanos) as f64 / 1_000_000.0;
+                // One line of key=value pairs, for benchmark scripts to scrape
+                let report = format!("time elapsed-ms={:.3} instructions={} allocated={}", elapsed, count, allocated);
+                match self.time_output.as_mut() {
+                    Some(output) => writeln!(output, "{}", report)
+                        .map_err(|e| RuntimeError::new(format!("Failed to write the time report: {}", e)))?,
+                    None => println!("{}", report),
+                }
+                self.value_stack.push(result);
+                self.instruction_pointer += 1;
+            }
+            Instruction::Assert(source) => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Assert".to_string()))?;
+                // Only false fails, as with and/or
+                if matches!(value, Value::Boolean(false)) {
+                    return Err(RuntimeError::new(format!("Assertion failed: {}", source)));
+                }
+                self.value_stack.push(Value::List(List::Nil));
+                self.instruction_pointer += 1;
+            }
+            Instruction::AssertEqual(source) => {
+                let actual = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in AssertEqual".to_string()))?;
+                let expected = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in AssertEqual".to_string()))?;
+                if !Self::values_equal(&expected, &actual) {
+                    return Err(RuntimeError::new(format!(
+                        "Assertion failed: {}: expected {}, got {}",
+                        source,
+                        Self::format_diagnostic(&expected),
+                        Self::format_diagnostic(&actual)
+                    )));
+                }
+                self.value_stack.push(Value::List(List::Nil));
+                self.instruction_pointer += 1;
+            }
+            Instruction::PrependArgs(count) => {
+                let count = *count;
+                let arg_list = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in PrependArgs".to_string()))?;
+                let mut list = match arg_list {
+                    Value::List(list) => list,
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error in apply: expected list of arguments as the last argument, got {}",
+                            Self::type_name(&arg_list)
+                        )));
+                    }
+                };
+                if self.value_stack.len() < count {
+                    return Err(RuntimeError::new("Stack underflow in PrependArgs".to_string()));
+                }
+                for value in self.value_stack.split_off(self.value_stack.len() - count).into_iter().rev() {
+                    list = List::cons(value, list);
+                }
+                self.value_stack.push(Value::List(list));
+                self.instruction_pointer += 1;
+            }
             Instruction::LoadCaptured(idx) => {
                 let idx = *idx;
                 // Load a captured variable from the current closure's environment
@@ -1018,93 +1747,44 @@ impl VM {
             }
             Instruction::Print => {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Print".to_string()))?;
-                println!("{}", Self::format_value(&value));
+                // print is display followed by a newline
+                println!("{}", Self::value_to_display_string(&value));
                 // Push the value back so print can be used in expressions
                 self.value_stack.push(value);
                 self.instruction_pointer += 1;
             }
             Instruction::Ret => {
                 let frame = self.call_stack.pop().ok_or_else(|| RuntimeError::new("No frame to return from".to_string()))?;
+                if frame.multiple_values {
+                    // A plain return to call-with-values is a single value
+                    self.value_stack.push(Value::Integer(1));
+                }
                 self.current_bytecode = frame.return_bytecode;
                 self.instruction_pointer = frame.return_address;
             }
             Instruction::Call(fn_name, arg_count) => {
                 let fn_name = fn_name.clone();
                 let arg_count = *arg_count;
-                let fn_bytecode = self.functions.get(&fn_name)
-                    .ok_or_else(|| RuntimeError::new(format!("Undefined function '{}'", fn_name)))?
-                    .clone();
-
-                // Pop arguments from value stack in reverse order
-                let mut args = Vec::new();
-                for _ in 0..arg_count {
-                    args.push(self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Call".to_string()))?);
-                }
-                args.reverse();
-
-                // Create new frame with return bytecode and function name for stack traces
-                let frame = Frame {
-                    return_address: self.instruction_pointer + 1,
-                    locals: args,
-                    return_bytecode: self.current_bytecode.clone(),
-                    function_name: fn_name,
-                    captured: Vec::new(), // Regular functions don't have captured variables
-                    stack_base: self.value_stack.len(), // Current stack top is base for this function
-                    loop_start: None,
-                    loop_bindings_start: None,
-                    loop_bindings_count: None,
-                };
-                self.call_stack.push(frame);
-
-                // Switch to function bytecode
-                self.current_bytecode = fn_bytecode;
-                self.instruction_pointer = 0;
+                let fn_bytecode = self.call_cache.resolve(&fn_name, &self.functions)
+                    .ok_or_else(|| RuntimeError::new(format!("Undefined function '{}'", fn_name)))?;
+                self.call_function(fn_name, arg_count, fn_bytecode)?;
             }
             Instruction::TailCall(fn_name, arg_count) => {
                 let fn_name = fn_name.clone();
                 let arg_count = *arg_count;
-                let fn_bytecode = self.functions.get(&fn_name)
-                    .ok_or_else(|| RuntimeError::new(format!("Undefined function '{}'", fn_name)))?
-                    .clone();
-
-                // Pop arguments from value stack in reverse order
-                let mut args = Vec::new();
-                for _ in 0..arg_count {
-                    args.push(self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in TailCall".to_string()))?);
-                }
-                args.reverse();
-
-                // Reuse current frame instead of pushing a new one
-                // This is the key to tail call optimization!
-                if let Some(frame) = self.call_stack.last_mut() {
-                    // Clear the value_stack back to this frame's base
-                    // This is crucial - any let bindings or temporary values should be removed
-                    self.value_stack.truncate(frame.stack_base);
-
-                    // Replace the locals (arguments) in the current frame
-                    frame.locals = args;
-                    // Update function name for stack traces
-                    frame.function_name = fn_name;
-                    // Keep the same return address, return bytecode, and stack_base
-                } else {
-                    // No frame exists (top-level call), treat as regular call
-                    let frame = Frame {
-                        return_address: self.instruction_pointer + 1,
-                        locals: args,
-                        return_bytecode: self.current_bytecode.clone(),
-                        function_name: fn_name,
-                        captured: Vec::new(),
-                        stack_base: self.value_stack.len(), // Current stack top is base for this function
-                        loop_start: None,
-                        loop_bindings_start: None,
-                        loop_bindings_count: None,
-                    };
-                    self.call_stack.push(frame);
-                }
-
-                // Switch to function bytecode
-                self.current_bytecode = fn_bytecode;
-                self.instruction_pointer = 0;
+                let fn_bytecode = self.call_cache.resolve(&fn_name, &self.functions)
+                    .ok_or_else(|| RuntimeError::new(format!("Undefined function '{}'", fn_name)))?;
+                self.tail_call_function(fn_name, arg_count, fn_bytecode)?;
+            }
+            Instruction::CallCached(fn_name, arg_count, slot) => {
+                let (fn_name, arg_count, slot) = (fn_name.clone(), *arg_count, *slot);
+                let fn_bytecode = self.cached_callee(&fn_name, slot)?;
+                self.call_function(fn_name, arg_count, fn_bytecode)?;
+            }
+            Instruction::TailCallCached(fn_name, arg_count, slot) => {
+                let (fn_name, arg_count, slot) = (fn_name.clone(), *arg_count, *slot);
+                let fn_bytecode = self.cached_callee(&fn_name, slot)?;
+                self.tail_call_function(fn_name, arg_count, fn_bytecode)?;
             }
             Instruction::Halt => {
                 self.halted = true;
@@ -1121,6 +1801,7 @@ impl VM {
                     other => List::cons(first, List::cons(other, List::Nil)),
                 };
                 self.value_stack.push(Value::List(new_list));
+                self.heap.note_allocations(1);
                 self.instruction_pointer += 1;
             }
             Instruction::Car => {
@@ -1167,7 +1848,7 @@ impl VM {
             }
             Instruction::IsInteger => {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in IsInteger".to_string()))?;
-                let is_integer = matches!(value, Value::Integer(_));
+                let is_integer = matches!(value, Value::Integer(_) | Value::BigInt(_));
                 self.value_stack.push(Value::Boolean(is_integer));
                 self.instruction_pointer += 1;
             }
@@ -1179,7 +1860,7 @@ impl VM {
             }
             Instruction::IsNumber => {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in IsNumber".to_string()))?;
-                let is_number = matches!(value, Value::Integer(_) | Value::Float(_));
+                let is_number = value.is_number();
                 self.value_stack.push(Value::Boolean(is_number));
                 self.instruction_pointer += 1;
             }
@@ -1223,7 +1904,7 @@ impl VM {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in SymbolToString".to_string()))?;
                 match value {
                     Value::Symbol(s) => {
-                        self.value_stack.push(Value::String(s));
+                        self.value_stack.push(Value::String(Arc::new(s.name().to_string())));
                     }
                     _ => {
                         return Err(RuntimeError::new(format!(
@@ -1238,7 +1919,8 @@ impl VM {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StringToSymbol".to_string()))?;
                 match value {
                     Value::String(s) => {
-                        self.value_stack.push(Value::Symbol(s));
+                        // Interned, so it's the same symbol as one spelled in the source
+                        self.value_stack.push(Value::Symbol(Symbol::intern(&s)));
                     }
                     _ => {
                         return Err(RuntimeError::new(format!(
@@ -1256,19 +1938,17 @@ impl VM {
 
                 match (&first, &second) {
                     (Value::List(first_list), Value::List(second_list)) => {
-                        // For append, we need to copy the first list and attach second to the end
-                        // This is O(n) in the first list length - append is inherently expensive
-                        let first_vec = first_list.to_vec();
-                        let second_vec = second_list.to_vec();
-                        let mut result = first_vec;
-                        result.extend(second_vec);
-                        self.value_stack.push(Value::List(List::from_vec(result)));
+                        // Copy the first list onto the front of the second, which is shared
+                        let copied = first_list.to_vec();
+                        self.heap.note_allocations(copied.len());
+                        let result = copied.into_iter().rev().fold(second_list.clone(), |tail, item| List::cons(item, tail));
+                        self.value_stack.push(Value::List(result));
                     }
                     _ => {
+                        let bad = if matches!(first, Value::List(_)) { &second } else { &first };
                         return Err(RuntimeError::new(format!(
-                            "Type error: 'append' expects two lists, got {} and {}",
-                            Self::type_name(&first),
-                            Self::type_name(&second)
+                            "Type error: 'append' expects lists, got {}",
+                            Self::type_name(bad)
                         )));
                     }
                 }
@@ -1283,46 +1963,23 @@ impl VM {
                 }
                 items.reverse(); // Reverse because we popped in reverse order
                 self.value_stack.push(Value::List(List::from_vec(items)));
+                self.heap.note_allocations(n);
                 self.instruction_pointer += 1;
             }
             Instruction::ListRef => {
                 // Pop index and list, push element at that index
                 let index = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ListRef".to_string()))?;
                 let list_val = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ListRef".to_string()))?;
-
-                match (&list_val, &index) {
-                    (Value::List(list), Value::Integer(idx)) => {
-                        if *idx < 0 {
-                            return Err(RuntimeError::new(format!("'list-ref' index cannot be negative: {}", idx)));
-                        }
-                        let idx_usize = *idx as usize;
-                        // Walk the list to the index position
-                        let mut current = list.clone();
-                        for _ in 0..idx_usize {
-                            match current.cdr() {
-                                Some(tail) => current = tail,
-                                None => return Err(RuntimeError::new(format!(
-                                    "'list-ref' index {} out of bounds for list of length {}",
-                                    idx, list.len()
-                                ))),
-                            }
-                        }
-                        match current.car() {
-                            Some(val) => self.value_stack.push(val.clone()),
-                            None => return Err(RuntimeError::new(format!(
-                                "'list-ref' index {} out of bounds for list of length {}",
-                                idx, list.len()
-                            ))),
-                        }
-                    }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: 'list-ref' expects a list and an integer, got {} and {}",
-                            Self::type_name(&list_val),
-                            Self::type_name(&index)
-                        )));
-                    }
-                }
+                let item = Self::list_element("list-ref", &list_val, &index)?;
+                self.value_stack.push(item);
+                self.instruction_pointer += 1;
+            }
+            Instruction::Nth => {
+                // Pop list and index, push element at that index
+                let list_val = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Nth".to_string()))?;
+                let index = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Nth".to_string()))?;
+                let item = Self::list_element("nth", &list_val, &index)?;
+                self.value_stack.push(item);
                 self.instruction_pointer += 1;
             }
             Instruction::ListLength => {
@@ -1334,53 +1991,93 @@ impl VM {
                     }
                     _ => {
                         return Err(RuntimeError::new(format!(
-                            "Type error: 'list-length' expects a list, got {}",
+                            "Type error: 'length' expects a list, got {}",
                             Self::type_name(&value)
                         )));
                     }
                 }
                 self.instruction_pointer += 1;
             }
-            Instruction::NumberToString => {
-                // Pop integer and push string representation
-                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in NumberToString".to_string()))?;
-                match value {
-                    Value::Integer(n) => {
-                        self.value_stack.push(Value::String(Arc::new(n.to_string())));
+            Instruction::ListReverse => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ListReverse".to_string()))?;
+                let list = value.as_list().ok_or_else(|| RuntimeError::new(format!(
+                    "Type error: 'reverse' expects a list, got {}",
+                    Self::type_name(&value)
+                )))?;
+                let reversed = list.iter().fold(List::Nil, |acc, item| List::cons(item.clone(), acc));
+                self.heap.note_allocations(list.len());
+                self.value_stack.push(Value::List(reversed));
+                self.instruction_pointer += 1;
+            }
+            Instruction::Transpose => {
+                // The argument lists for each call when map is given several lists
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Transpose".to_string()))?;
+                let outer = value.as_list().ok_or_else(|| RuntimeError::new(format!(
+                    "Type error: Transpose expects a list, got {}",
+                    Self::type_name(&value)
+                )))?;
+                let mut lists = Vec::new();
+                for list in outer.iter() {
+                    match list {
+                        Value::List(list) => lists.push(list.iter()),
+                        other => {
+                            return Err(RuntimeError::new(format!(
+                                "Type error: 'map' expects lists, got {}",
+                                Self::type_name(other)
+                            )));
+                        }
                     }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: 'number->string' expects an integer, got {}",
-                            Self::type_name(&value)
-                        )));
+                }
+
+                let mut rows = Vec::new();
+                'rows: while !lists.is_empty() {
+                    let mut row = Vec::with_capacity(lists.len());
+                    for list in lists.iter_mut() {
+                        match list.next() {
+                            Some(item) => row.push(item.clone()),
+                            None => break 'rows,
+                        }
                     }
+                    rows.push(Value::List(List::from_vec(row)));
                 }
+                self.heap.note_allocations(rows.len() * (lists.len() + 1));
+                self.value_stack.push(Value::List(List::from_vec(rows)));
+                self.instruction_pointer += 1;
+            }
+            Instruction::Member | Instruction::Memq | Instruction::Assoc | Instruction::Assq => {
+                let by_identity = matches!(self.current_bytecode[ip], Instruction::Memq | Instruction::Assq);
+                let entries = matches!(self.current_bytecode[ip], Instruction::Assoc | Instruction::Assq);
+                self.search_list(entries, by_identity)?;
+                self.instruction_pointer += 1;
+            }
+            Instruction::Sort => {
+                self.sort_list()?;
+                self.instruction_pointer += 1;
+            }
+            Instruction::NumberToString => {
+                // Pop number and push its decimal representation
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in NumberToString".to_string()))?;
+                self.value_stack.push(Self::number_to_string(&value, 10)?);
                 self.instruction_pointer += 1;
             }
             Instruction::StringToNumber => {
-                // Pop string and push integer (or error if not a valid number)
+                // Pop string and push the number it spells, or nil
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StringToNumber".to_string()))?;
-                match value {
-                    Value::String(s) => {
-                        match s.trim().parse::<i64>() {
-                            Ok(n) => {
-                                self.value_stack.push(Value::Integer(n));
-                            }
-                            Err(_) => {
-                                return Err(RuntimeError::new(format!(
-                                    "Type error: 'string->number' cannot parse '{}' as a number",
-                                    s
-                                )));
-                            }
-                        }
-                    }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: 'string->number' expects a string, got {}",
-                            Self::type_name(&value)
-                        )));
-                    }
-                }
+                self.value_stack.push(Self::string_to_number(&value, 10)?);
+                self.instruction_pointer += 1;
+            }
+            Instruction::NumberToStringRadix => {
+                let radix = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in NumberToStringRadix".to_string()))?;
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in NumberToStringRadix".to_string()))?;
+                let radix = Self::conversion_radix(&radix, "number->string")?;
+                self.value_stack.push(Self::number_to_string(&value, radix)?);
+                self.instruction_pointer += 1;
+            }
+            Instruction::StringToNumberRadix => {
+                let radix = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StringToNumberRadix".to_string()))?;
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StringToNumberRadix".to_string()))?;
+                let radix = Self::conversion_radix(&radix, "string->number")?;
+                self.value_stack.push(Self::string_to_number(&value, radix)?);
                 self.instruction_pointer += 1;
             }
             Instruction::LoadGlobal(name) => {
@@ -1401,7 +2098,7 @@ impl VM {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StringLength".to_string()))?;
                 match value {
                     Value::String(s) => {
-                        self.value_stack.push(Value::Integer(s.len() as i64));
+                        self.value_stack.push(Value::Integer(s.chars().count() as i64));
                     }
                     _ => {
                         return Err(RuntimeError::new(format!(
@@ -1419,16 +2116,22 @@ impl VM {
 
                 match (&string, &start, &end) {
                     (Value::String(s), Value::Integer(start_idx), Value::Integer(end_idx)) => {
-                        let start = (*start_idx).max(0) as usize;
-                        let end = (*end_idx).min(s.len() as i64) as usize;
-                        if start <= end && end <= s.len() {
-                            let result = s.chars().skip(start).take(end - start).collect::<String>();
+                        // Indices count characters, not bytes, and are never clamped
+                        let length = s.chars().count() as i64;
+                        if 0 <= *start_idx && start_idx <= end_idx && *end_idx <= length {
+                            let result = s.chars()
+                                .skip(*start_idx as usize)
+                                .take((end_idx - start_idx) as usize)
+                                .collect::<String>();
                             self.value_stack.push(Value::String(Arc::new(result)));
                         } else {
-                            return Err(RuntimeError::new(format!(
-                                "'substring' invalid indices: start={}, end={}, string length={}",
-                                start_idx, end_idx, s.len()
-                            )));
+                            return Err(RuntimeError::with_suggestion(
+                                format!(
+                                    "'substring' invalid indices: start={}, end={}, string length={}",
+                                    start_idx, end_idx, length
+                                ),
+                                "Indices must satisfy 0 <= start <= end <= (string-length s)".to_string(),
+                            ));
                         }
                     }
                     _ => {
@@ -1460,13 +2163,29 @@ impl VM {
                 }
                 self.instruction_pointer += 1;
             }
+            Instruction::StringEq => {
+                let second = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StringEq".to_string()))?;
+                let first = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StringEq".to_string()))?;
+
+                match (&first, &second) {
+                    (Value::String(s1), Value::String(s2)) => {
+                        self.value_stack.push(Value::Boolean(s1 == s2));
+                    }
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'string=?' expects two strings, got {} and {}",
+                            Self::type_name(&first),
+                            Self::type_name(&second)
+                        )));
+                    }
+                }
+                self.instruction_pointer += 1;
+            }
             Instruction::StringToList => {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StringToList".to_string()))?;
                 match value {
                     Value::String(s) => {
-                        let char_list: Vec<Value> = s.chars()
-                            .map(|c| Value::String(Arc::new(c.to_string())))
-                            .collect();
+                        let char_list: Vec<Value> = s.chars().map(Value::Char).collect();
                         self.value_stack.push(Value::List(List::from_vec(char_list)));
                     }
                     _ => {
@@ -1485,10 +2204,11 @@ impl VM {
                         let mut result = String::new();
                         for item in list.iter() {
                             match item {
+                                Value::Char(c) => result.push(*c),
                                 Value::String(s) => result.push_str(&s),
                                 _ => {
                                     return Err(RuntimeError::new(format!(
-                                        "Type error: 'list->string' expects a list of strings, but found {}",
+                                        "Type error: 'list->string' expects a list of chars or strings, but found {}",
                                         Self::type_name(item)
                                     )));
                                 }
@@ -1508,6 +2228,7 @@ impl VM {
             Instruction::CharCode => {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in CharCode".to_string()))?;
                 match &value {
+                    Value::Char(c) => self.value_stack.push(Value::Integer(*c as i64)),
                     Value::String(s) => {
                         if s.len() != 1 {
                             return Err(RuntimeError::new(format!(
@@ -1520,13 +2241,110 @@ impl VM {
                     }
                     _ => {
                         return Err(RuntimeError::new(format!(
-                            "Type error: 'char-code' expects a string, got {}",
+                            "Type error: 'char-code' expects a char or a string, got {}",
+                            Self::type_name(&value)
+                        )));
+                    }
+                }
+                self.instruction_pointer += 1;
+            }
+            Instruction::CharToInteger => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in CharToInteger".to_string()))?;
+                let c = Self::char_arg(&value, "char->integer")?;
+                self.value_stack.push(Value::Integer(c as i64));
+                self.instruction_pointer += 1;
+            }
+            Instruction::IntegerToChar => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in IntegerToChar".to_string()))?;
+                match value {
+                    Value::Integer(n) => {
+                        // Surrogates and values past 0x10FFFF are not characters
+                        let c = u32::try_from(n).ok().and_then(char::from_u32).ok_or_else(|| {
+                            RuntimeError::new(format!("'integer->char' expects a Unicode code point, got {}", n))
+                        })?;
+                        self.value_stack.push(Value::Char(c));
+                    }
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'integer->char' expects an integer, got {}",
                             Self::type_name(&value)
                         )));
                     }
                 }
                 self.instruction_pointer += 1;
             }
+            Instruction::CharEq => {
+                let second = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in CharEq".to_string()))?;
+                let first = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in CharEq".to_string()))?;
+                match (&first, &second) {
+                    (Value::Char(a), Value::Char(b)) => self.value_stack.push(Value::Boolean(a == b)),
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'char=?' expects two chars, got {} and {}",
+                            Self::type_name(&first),
+                            Self::type_name(&second)
+                        )));
+                    }
+                }
+                self.instruction_pointer += 1;
+            }
+            Instruction::CharLt => {
+                let second = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in CharLt".to_string()))?;
+                let first = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in CharLt".to_string()))?;
+                match (&first, &second) {
+                    (Value::Char(a), Value::Char(b)) => self.value_stack.push(Value::Boolean(a < b)),
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'char<?' expects two chars, got {} and {}",
+                            Self::type_name(&first),
+                            Self::type_name(&second)
+                        )));
+                    }
+                }
+                self.instruction_pointer += 1;
+            }
+            Instruction::IsAlphabetic => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in IsAlphabetic".to_string()))?;
+                let c = Self::char_arg(&value, "char-alphabetic?")?;
+                self.value_stack.push(Value::Boolean(c.is_alphabetic()));
+                self.instruction_pointer += 1;
+            }
+            Instruction::IsNumeric => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in IsNumeric".to_string()))?;
+                let c = Self::char_arg(&value, "char-numeric?")?;
+                self.value_stack.push(Value::Boolean(c.is_numeric()));
+                self.instruction_pointer += 1;
+            }
+            Instruction::IsWhitespace => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in IsWhitespace".to_string()))?;
+                let c = Self::char_arg(&value, "char-whitespace?")?;
+                self.value_stack.push(Value::Boolean(c.is_whitespace()));
+                self.instruction_pointer += 1;
+            }
+            Instruction::StringRef => {
+                let index = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StringRef".to_string()))?;
+                let string = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StringRef".to_string()))?;
+                match (&string, &index) {
+                    (Value::String(s), Value::Integer(idx)) => {
+                        // The index counts characters, as in substring
+                        let c = usize::try_from(*idx).ok().and_then(|i| s.chars().nth(i)).ok_or_else(|| {
+                            RuntimeError::new(format!(
+                                "'string-ref' index {} out of bounds for string of length {}",
+                                idx, s.chars().count()
+                            ))
+                        })?;
+                        self.value_stack.push(Value::Char(c));
+                    }
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'string-ref' expects a string and an integer, got {} and {}",
+                            Self::type_name(&string),
+                            Self::type_name(&index)
+                        )));
+                    }
+                }
+                self.instruction_pointer += 1;
+            }
             Instruction::StringSplit => {
                 let delimiter = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StringSplit".to_string()))?;
                 let string = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in StringSplit".to_string()))?;
@@ -1782,8 +2600,10 @@ impl VM {
                                 self.value_stack.push(Value::Boolean(true));
                             }
                             Err(e) => {
-                                eprintln!("write-file: failed to write '{}': {}", path_str, e);
-                                self.value_stack.push(Value::Boolean(false));
+                                return Err(RuntimeError::new(format!(
+                                    "'write-file' failed to write '{}': {}",
+                                    path_str, e
+                                )));
                             }
                         }
                     }
@@ -1797,9 +2617,115 @@ impl VM {
                 }
                 self.instruction_pointer += 1;
             }
-            Instruction::FileExists => {
-                let path = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in FileExists".to_string()))?;
-                match path {
+            Instruction::AppendFile => {
+                let content = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in AppendFile".to_string()))?;
+                let path = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in AppendFile".to_string()))?;
+
+                match (&path, &content) {
+                    (Value::String(path_str), Value::String(content_str)) => {
+                        use std::io::Write;
+                        let appended = std::fs::OpenOptions::new()
+                            .append(true)
+                            .create(true)
+                            .open(path_str.as_str())
+                            .and_then(|mut file| file.write_all(content_str.as_bytes()));
+                        if let Err(e) = appended {
+                            return Err(RuntimeError::new(format!(
+                                "'append-file' failed to write '{}': {}",
+                                path_str, e
+                            )));
+                        }
+                        self.value_stack.push(Value::Boolean(true));
+                    }
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'append-file' expects a string path and string content, got {} and {}",
+                            Self::type_name(&path),
+                            Self::type_name(&content)
+                        )));
+                    }
+                }
+                self.instruction_pointer += 1;
+            }
+            Instruction::ReadLine => {
+                let line = self.read_input_line().map_err(|e| RuntimeError::new(format!("'read-line' failed to read input: {}", e)))?;
+                self.value_stack.push(line.map_or(Value::List(List::Nil), Value::string));
+                self.instruction_pointer += 1;
+            }
+            Instruction::ReadLineFrom => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ReadLineFrom".to_string()))?;
+                let port = Self::port_arg(&value, "read-line")?;
+                let line = port.borrow_mut().read_line()
+                    .map_err(|e| RuntimeError::new(format!("'read-line' failed to read from port: {}", e)))?;
+                self.value_stack.push(line.map_or(Value::List(List::Nil), Value::string));
+                self.instruction_pointer += 1;
+            }
+            Instruction::Read => {
+                self.read_input_datum()?;
+                self.instruction_pointer += 1;
+            }
+            Instruction::ReadFromString => {
+                self.read_from_string()?;
+                self.instruction_pointer += 1;
+            }
+            Instruction::OpenInputFile => {
+                let path = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in OpenInputFile".to_string()))?;
+                let port = Self::open_port(&path, "open-input-file", Port::open_input)?;
+                self.value_stack.push(port);
+                self.instruction_pointer += 1;
+            }
+            Instruction::OpenOutputFile => {
+                let path = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in OpenOutputFile".to_string()))?;
+                let port = Self::open_port(&path, "open-output-file", Port::open_output)?;
+                self.value_stack.push(port);
+                self.instruction_pointer += 1;
+            }
+            Instruction::ClosePort => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ClosePort".to_string()))?;
+                let port = Self::port_arg(&value, "close-port")?;
+                port.borrow_mut().close()
+                    .map_err(|e| RuntimeError::new(format!("'close-port' failed to flush the port: {}", e)))?;
+                self.value_stack.push(Value::Boolean(true));
+                self.instruction_pointer += 1;
+            }
+            Instruction::PrintTo => {
+                let target = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in PrintTo".to_string()))?;
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in PrintTo".to_string()))?;
+                let port = Self::port_arg(&target, "print")?;
+                port.borrow_mut().write_line(&Self::value_to_display_string(&value))
+                    .map_err(|e| RuntimeError::new(format!("'print' failed to write to port: {}", e)))?;
+                self.value_stack.push(value);
+                self.instruction_pointer += 1;
+            }
+            Instruction::Write | Instruction::Display => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Write".to_string()))?;
+                let text = match &self.current_bytecode[ip] {
+                    Instruction::Write => Self::format_value(&value),
+                    _ => Self::value_to_display_string(&value),
+                };
+                // Without a newline to flush it, a prompt would wait in the buffer
+                let mut stdout = std::io::stdout();
+                let _ = stdout.write_all(text.as_bytes()).and_then(|_| stdout.flush());
+                self.value_stack.push(value);
+                self.instruction_pointer += 1;
+            }
+            Instruction::PrettyPrint => self.pretty_print_instruction()?,
+            Instruction::WriteTo | Instruction::DisplayTo => {
+                let target = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in WriteTo".to_string()))?;
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in WriteTo".to_string()))?;
+                let (name, text) = match &self.current_bytecode[ip] {
+                    Instruction::WriteTo => ("write", Self::format_value(&value)),
+                    _ => ("display", Self::value_to_display_string(&value)),
+                };
+                let port = Self::port_arg(&target, name)?;
+                port.borrow_mut().write_text(&text)
+                    .map_err(|e| RuntimeError::new(format!("'{}' failed to write to port: {}", name, e)))?;
+                self.value_stack.push(value);
+                self.instruction_pointer += 1;
+            }
+            Instruction::FileExists => {
+                let path = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in FileExists".to_string()))?;
+                match path {
                     Value::String(path_str) => {
                         let exists = std::path::Path::new(path_str.as_str()).exists();
                         self.value_stack.push(Value::Boolean(exists));
@@ -1859,40 +2785,48 @@ impl VM {
                 match path {
                     Value::String(path_str) => {
                         // Read the file
-                        let source = std::fs::read_to_string(path_str.as_str()).map_err(|e| {
+                        let path = self.resolve_load_path(&path_str);
+                        let source = std::fs::read_to_string(&path).map_err(|e| {
                             RuntimeError::new(format!("'load' failed to read '{}': {}", path_str, e))
                         })?;
 
                         // Parse the file
-                        let mut parser = Parser::new(&source);
+                        let mut parser = Parser::new_with_file(&source, path.clone());
                         let exprs = parser.parse_all().map_err(|e| {
                             RuntimeError::new(format!("'load' failed to parse '{}': {}", path_str, e))
                         })?;
 
-                        // Compile the file
+                        // Compile the file; it may call functions and read globals defined so far
                         let mut compiler = Compiler::new();
+                        compiler.with_known_functions(self.functions.keys());
+                        compiler.with_known_globals(self.global_vars.keys());
                         let (functions, main) = compiler.compile_program(&exprs).map_err(|e| {
                             RuntimeError::new(format!("'load' failed to compile '{}': {}", path_str, e.message))
                         })?;
 
                         // Merge compiled functions into VM's function table
                         self.functions.extend(functions);
+                        let source_maps = compiler.source_maps();
+                        self.source_maps.functions.extend(source_maps.functions);
 
                         // Execute the main bytecode from the loaded file
                         // Save current state
-                        let saved_bytecode = std::mem::replace(&mut self.current_bytecode, main);
+                        let saved_bytecode = std::mem::replace(&mut self.current_bytecode, Rc::new(main));
+                        let saved_main_map = std::mem::replace(&mut self.source_maps.main, source_maps.main);
+                        let saved_file = self.current_file.replace(path);
                         let saved_ip = self.instruction_pointer;
 
                         // Execute the loaded file's main code
                         self.instruction_pointer = 0;
-                        while !self.halted && self.instruction_pointer < self.current_bytecode.len() {
-                            self.execute_one_instruction()?;
-                        }
+                        let result = self.run_nested();
 
                         // Restore previous state
                         self.current_bytecode = saved_bytecode;
+                        self.source_maps.main = saved_main_map;
+                        self.current_file = saved_file;
                         self.instruction_pointer = saved_ip;
                         self.halted = false;
+                        result?;
 
                         // Push a success value (true) onto the stack
                         self.value_stack.push(Value::Boolean(true));
@@ -1911,8 +2845,9 @@ impl VM {
                 match path {
                     Value::String(path_str) => {
                         // Normalize the path to canonical form for consistent tracking
-                        let canonical_path = std::fs::canonicalize(path_str.as_str())
-                            .unwrap_or_else(|_| std::path::PathBuf::from(path_str.as_str()))
+                        let path = self.resolve_load_path(&path_str);
+                        let canonical_path = std::fs::canonicalize(&path)
+                            .unwrap_or_else(|_| std::path::PathBuf::from(&path))
                             .to_string_lossy()
                             .to_string();
 
@@ -1935,13 +2870,13 @@ impl VM {
                             self.loading_modules.push(canonical_path.clone());
 
                             // Read the file
-                            let source = std::fs::read_to_string(path_str.as_str()).map_err(|e| {
+                            let source = std::fs::read_to_string(&path).map_err(|e| {
                                 self.loading_modules.pop();
                                 RuntimeError::new(format!("'require' failed to read '{}': {}", path_str, e))
                             })?;
 
                             // Parse the file
-                            let mut parser = Parser::new(&source);
+                            let mut parser = Parser::new_with_file(&source, path.clone());
                             let exprs = parser.parse_all().map_err(|e| {
                                 self.loading_modules.pop();
                                 RuntimeError::new(format!("'require' failed to parse '{}': {}", path_str, e))
@@ -1949,6 +2884,7 @@ impl VM {
 
                             // Compile the file, passing existing module exports for import validation
                             let mut compiler = Compiler::new();
+                            compiler.with_known_functions(self.functions.keys());
                             for (module, exports) in &self.module_exports {
                                 compiler.with_known_module_exports(module, exports);
                             }
@@ -1957,6 +2893,8 @@ impl VM {
                                 RuntimeError::new(format!("'require' failed to compile '{}': {}", path_str, e.message))
                             })?;
 
+                            let source_maps = compiler.source_maps();
+
                             // Merge module exports from compiled file
                             for (module, exports) in compiler.module_exports {
                                 self.module_exports.insert(module, exports);
@@ -1964,26 +2902,30 @@ impl VM {
 
                             // Merge compiled functions into VM's function table
                             self.functions.extend(functions);
+                            self.source_maps.functions.extend(source_maps.functions);
 
                             // Execute the main bytecode from the loaded file
                             // Save current state
-                            let saved_bytecode = std::mem::replace(&mut self.current_bytecode, main);
+                            let saved_bytecode = std::mem::replace(&mut self.current_bytecode, Rc::new(main));
+                            let saved_main_map = std::mem::replace(&mut self.source_maps.main, source_maps.main);
+                            let saved_file = self.current_file.replace(path);
                             let saved_ip = self.instruction_pointer;
 
                             // Execute the loaded file's main code
                             self.instruction_pointer = 0;
-                            while !self.halted && self.instruction_pointer < self.current_bytecode.len() {
-                                self.execute_one_instruction()?;
-                            }
+                            let result = self.run_nested();
 
                             // Restore previous state
                             self.current_bytecode = saved_bytecode;
+                            self.source_maps.main = saved_main_map;
+                            self.current_file = saved_file;
                             self.instruction_pointer = saved_ip;
                             self.halted = false;
+                            self.loading_modules.pop();
+                            result?;
 
-                            // Mark as loaded and remove from loading stack
+                            // Mark as loaded
                             self.loaded_modules.insert(canonical_path);
-                            self.loading_modules.pop();
 
                             // Push a success value (true) onto the stack
                             self.value_stack.push(Value::Boolean(true));
@@ -2006,6 +2948,77 @@ impl VM {
                 self.value_stack.push(Value::List(List::from_vec(args_list)));
                 self.instruction_pointer += 1;
             }
+            Instruction::GetEnv => {
+                let name = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in GetEnv".to_string()))?;
+                let Value::String(name) = &name else {
+                    return Err(RuntimeError::new(format!("Type error: 'getenv' expects a string, got {}", Self::type_name(&name))));
+                };
+                // A value that isn't valid Unicode can't be a string, so reads as unset
+                let value = std::env::var(name.as_str()).ok();
+                self.value_stack.push(value.map_or(Value::List(List::Nil), Value::string));
+                self.instruction_pointer += 1;
+            }
+            Instruction::CheckKeywords(function, keywords) => {
+                let args = match self.value_stack.last() {
+                    Some(Value::List(args)) => args.to_vec(),
+                    _ => return Err(RuntimeError::new("Stack underflow in CheckKeywords".to_string())),
+                };
+                let mut given: Vec<&str> = Vec::new();
+                for pair in args.chunks(2) {
+                    let keyword = match pair[0].as_symbol() {
+                        Some(keyword) if keyword.starts_with(':') => keyword,
+                        _ => {
+                            return Err(RuntimeError::new(format!(
+                                "'{}' expects keyword arguments after its required ones, got {}",
+                                function, Self::format_diagnostic(&pair[0])
+                            )));
+                        }
+                    };
+                    if !keywords.iter().any(|k| k == keyword) {
+                        return Err(RuntimeError::new(format!(
+                            "Unknown keyword argument {} for '{}', expected one of {}",
+                            keyword, function, keywords.join(", ")
+                        )));
+                    }
+                    if pair.len() == 1 {
+                        return Err(RuntimeError::new(format!("Keyword argument {} for '{}' has no value", keyword, function)));
+                    }
+                    if given.contains(&keyword) {
+                        return Err(RuntimeError::new(format!("Keyword argument {} given twice to '{}'", keyword, function)));
+                    }
+                    given.push(keyword);
+                }
+                self.instruction_pointer += 1;
+            }
+            Instruction::HasKeyword(keyword) => {
+                let args = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HasKeyword".to_string()))?;
+                let given = Self::keyword_argument(&args, keyword).is_some();
+                self.value_stack.push(Value::Boolean(given));
+                self.instruction_pointer += 1;
+            }
+            Instruction::GetKeyword(keyword) => {
+                let args = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in GetKeyword".to_string()))?;
+                let value = Self::keyword_argument(&args, keyword).unwrap_or(Value::List(List::Nil));
+                self.value_stack.push(value);
+                self.instruction_pointer += 1;
+            }
+            Instruction::Exit => {
+                let code = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Exit".to_string()))?;
+                match code {
+                    Value::Integer(n) if (0..=255).contains(&n) => {
+                        // Unwinds like an error no handler can catch, out of any
+                        // nested runs too; run turns it back into a clean stop
+                        self.exit_code = Some(n as i32);
+                        return Err(RuntimeError::new(format!("exit {}", n)));
+                    }
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "'exit' expects an exit code from 0 to 255, got {}",
+                            Self::format_diagnostic(&code)
+                        )));
+                    }
+                }
+            }
             // HashMap operations
             Instruction::MakeHashMap(n) => {
                 let n = *n;
@@ -2020,19 +3033,9 @@ impl VM {
 
                 let mut map = std::collections::HashMap::new();
                 for (key, value) in pairs {
-                    match key {
-                        Value::String(s) => {
-                            map.insert(s.to_string(), value);
-                        }
-                        _ => {
-                            return Err(RuntimeError::new(format!(
-                                "Type error: hashmap keys must be strings, got {}",
-                                Self::type_name(&key)
-                            )));
-                        }
-                    }
+                    map.insert(Self::map_key(&key)?, value);
                 }
-                self.value_stack.push(Value::HashMap(Arc::new(map)));
+                self.value_stack.push(Value::hashmap(map));
                 self.instruction_pointer += 1;
             }
             Instruction::HashMapGet => {
@@ -2040,21 +3043,21 @@ impl VM {
                 let key = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapGet".to_string()))?;
                 let map = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapGet".to_string()))?;
 
-                match (&map, &key) {
-                    (Value::HashMap(m), Value::String(k)) => {
-                        match m.get(k.as_str()) {
+                match &map {
+                    Value::HashMap(m) => {
+                        match m.borrow().get(&Self::map_key(&key)?) {
                             Some(v) => self.value_stack.push(v.clone()),
                             None => {
                                 return Err(RuntimeError::new(format!(
-                                    "Key '{}' not found in hashmap",
-                                    k
+                                    "Key {} not found in hashmap",
+                                    Self::format_diagnostic(&key)
                                 )));
                             }
                         }
                     }
                     _ => {
                         return Err(RuntimeError::new(format!(
-                            "Type error: 'get' expects a hashmap and a string key, got {} and {}",
+                            "Type error: 'get' expects a hashmap and a key, got {} and {}",
                             Self::type_name(&map),
                             Self::type_name(&key)
                         )));
@@ -2062,21 +3065,73 @@ impl VM {
                 }
                 self.instruction_pointer += 1;
             }
+            Instruction::HashMapGetOr => {
+                // Pop default, key and hashmap, push value or the default
+                let default = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapGetOr".to_string()))?;
+                let key = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapGetOr".to_string()))?;
+                let map = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapGetOr".to_string()))?;
+
+                match &map {
+                    Value::HashMap(m) => {
+                        let value = m.borrow().get(&Self::map_key(&key)?).cloned().unwrap_or(default);
+                        self.value_stack.push(value);
+                    }
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'map-get' expects a hashmap, got {}",
+                            Self::type_name(&map)
+                        )));
+                    }
+                }
+                self.instruction_pointer += 1;
+            }
+            Instruction::HashMapRemove => {
+                // Pop key and hashmap, remove the key from the hashmap and push the hashmap
+                let key = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapRemove".to_string()))?;
+                let map = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapRemove".to_string()))?;
+
+                match &map {
+                    Value::HashMap(m) => {
+                        m.borrow_mut().remove(&Self::map_key(&key)?);
+                        self.value_stack.push(map.clone());
+                    }
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'map-remove!' expects a hashmap, got {}",
+                            Self::type_name(&map)
+                        )));
+                    }
+                }
+                self.instruction_pointer += 1;
+            }
+            Instruction::HashMapCount => {
+                let map = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapCount".to_string()))?;
+                match &map {
+                    Value::HashMap(m) => self.value_stack.push(Value::Integer(m.borrow().len() as i64)),
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'map-count' expects a hashmap, got {}",
+                            Self::type_name(&map)
+                        )));
+                    }
+                }
+                self.instruction_pointer += 1;
+            }
             Instruction::HashMapSet => {
                 // Pop value, key, and hashmap, push new hashmap with key-value set
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapSet".to_string()))?;
                 let key = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapSet".to_string()))?;
                 let map = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapSet".to_string()))?;
 
-                match (&map, &key) {
-                    (Value::HashMap(m), Value::String(k)) => {
-                        let mut new_map = (**m).clone();
-                        new_map.insert(k.to_string(), value);
-                        self.value_stack.push(Value::HashMap(Arc::new(new_map)));
+                match &map {
+                    Value::HashMap(m) => {
+                        let mut new_map = m.borrow().clone();
+                        new_map.insert(Self::map_key(&key)?, value);
+                        self.value_stack.push(Value::hashmap(new_map));
                     }
                     _ => {
                         return Err(RuntimeError::new(format!(
-                            "Type error: 'set' expects a hashmap and a string key, got {} and {}",
+                            "Type error: 'set' expects a hashmap and a key, got {} and {}",
                             Self::type_name(&map),
                             Self::type_name(&key)
                         )));
@@ -2084,13 +3139,21 @@ impl VM {
                 }
                 self.instruction_pointer += 1;
             }
+            Instruction::HashMapSetInPlace => {
+                self.map_set_in_place()?;
+                self.instruction_pointer += 1;
+            }
             Instruction::HashMapKeys => {
                 // Pop hashmap and push list of keys
                 let map = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapKeys".to_string()))?;
 
                 match map {
                     Value::HashMap(m) => {
-                        let keys: Vec<Value> = m.keys().map(|k| Value::String(Arc::new(k.clone()))).collect();
+                        // Sorted, so the order doesn't depend on hashing
+                        let m = m.borrow();
+                        let mut keys: Vec<&MapKey> = m.keys().collect();
+                        keys.sort();
+                        let keys: Vec<Value> = keys.into_iter().map(MapKey::to_value).collect();
                         self.value_stack.push(Value::List(List::from_vec(keys)));
                     }
                     _ => {
@@ -2108,7 +3171,11 @@ impl VM {
 
                 match map {
                     Value::HashMap(m) => {
-                        let values: Vec<Value> = m.values().cloned().collect();
+                        // In key order, matching hashmap-keys
+                        let m = m.borrow();
+                        let mut entries: Vec<(&MapKey, &Value)> = m.iter().collect();
+                        entries.sort_by(|a, b| a.0.cmp(b.0));
+                        let values: Vec<Value> = entries.into_iter().map(|(_, v)| v.clone()).collect();
                         self.value_stack.push(Value::List(List::from_vec(values)));
                     }
                     _ => {
@@ -2125,13 +3192,13 @@ impl VM {
                 let key = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapContainsKey".to_string()))?;
                 let map = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapContainsKey".to_string()))?;
 
-                match (&map, &key) {
-                    (Value::HashMap(m), Value::String(k)) => {
-                        self.value_stack.push(Value::Boolean(m.contains_key(k.as_str())));
+                match &map {
+                    Value::HashMap(m) => {
+                        self.value_stack.push(Value::Boolean(m.borrow().contains_key(&Self::map_key(&key)?)));
                     }
                     _ => {
                         return Err(RuntimeError::new(format!(
-                            "Type error: 'contains-key?' expects a hashmap and a string key, got {} and {}",
+                            "Type error: 'contains-key?' expects a hashmap and a key, got {} and {}",
                             Self::type_name(&map),
                             Self::type_name(&key)
                         )));
@@ -2154,7 +3221,26 @@ impl VM {
                     items.push(self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in MakeVector".to_string()))?);
                 }
                 items.reverse(); // Reverse because we popped in reverse order
-                self.value_stack.push(Value::Vector(Arc::new(items)));
+                self.value_stack.push(Value::vector(items));
+                self.instruction_pointer += 1;
+            }
+            Instruction::MakeVectorFilled => {
+                let fill = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in MakeVectorFilled".to_string()))?;
+                let size = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in MakeVectorFilled".to_string()))?;
+                match size {
+                    Value::Integer(n) if n >= 0 => {
+                        self.value_stack.push(Value::vector(vec![fill; n as usize]));
+                    }
+                    Value::Integer(n) => {
+                        return Err(RuntimeError::new(format!("'make-vector' size cannot be negative: {}", n)));
+                    }
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'make-vector' expects an integer size, got {}",
+                            Self::type_name(&size)
+                        )));
+                    }
+                }
                 self.instruction_pointer += 1;
             }
             Instruction::VectorGet => {
@@ -2164,11 +3250,9 @@ impl VM {
 
                 match (&vec, &index) {
                     (Value::Vector(items), Value::Integer(idx)) => {
-                        if *idx < 0 {
-                            return Err(RuntimeError::new(format!("'vector-ref' index cannot be negative: {}", idx)));
-                        }
+                        let items = items.borrow();
                         let idx_usize = *idx as usize;
-                        if idx_usize >= items.len() {
+                        if *idx < 0 || idx_usize >= items.len() {
                             return Err(RuntimeError::new(format!(
                                 "'vector-ref' index {} out of bounds for vector of length {}",
                                 idx, items.len()
@@ -2192,30 +3276,25 @@ impl VM {
                 let index = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in VectorSet".to_string()))?;
                 let vec = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in VectorSet".to_string()))?;
 
-                match (&vec, &index) {
-                    (Value::Vector(items), Value::Integer(idx)) => {
-                        if *idx < 0 {
-                            return Err(RuntimeError::new(format!("'vector-set!' index cannot be negative: {}", idx)));
-                        }
-                        let idx_usize = *idx as usize;
-                        if idx_usize >= items.len() {
-                            return Err(RuntimeError::new(format!(
-                                "'vector-set!' index {} out of bounds for vector of length {}",
-                                idx, items.len()
-                            )));
-                        }
-                        let mut new_vec = (**items).clone();
-                        new_vec[idx_usize] = value;
-                        self.value_stack.push(Value::Vector(Arc::new(new_vec)));
-                    }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: 'vector-set!' expects a vector, an integer, and a value, got {} and {}",
-                            Self::type_name(&vec),
-                            Self::type_name(&index)
-                        )));
-                    }
+                let idx_usize = Self::vector_index(&vec, &index, "vector-set")?;
+                if let Value::Vector(items) = &vec {
+                    let mut new_vec = items.borrow().clone();
+                    new_vec[idx_usize] = value;
+                    self.value_stack.push(Value::vector(new_vec));
+                }
+                self.instruction_pointer += 1;
+            }
+            Instruction::VectorSetInPlace => {
+                // Pop value, index, and vector, store the value in the vector and push the vector
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in VectorSetInPlace".to_string()))?;
+                let index = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in VectorSetInPlace".to_string()))?;
+                let vec = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in VectorSetInPlace".to_string()))?;
+
+                let idx_usize = Self::vector_index(&vec, &index, "vector-set!")?;
+                if let Value::Vector(items) = &vec {
+                    items.borrow_mut()[idx_usize] = value;
                 }
+                self.value_stack.push(vec);
                 self.instruction_pointer += 1;
             }
             Instruction::VectorPush => {
@@ -2225,9 +3304,9 @@ impl VM {
 
                 match vec {
                     Value::Vector(items) => {
-                        let mut new_items = (*items).clone();
+                        let mut new_items = items.borrow().clone();
                         new_items.push(value);
-                        self.value_stack.push(Value::Vector(Arc::new(new_items)));
+                        self.value_stack.push(Value::vector(new_items));
                     }
                     _ => {
                         return Err(RuntimeError::new(format!(
@@ -2244,12 +3323,10 @@ impl VM {
 
                 match vec {
                     Value::Vector(items) => {
-                        if items.is_empty() {
-                            return Err(RuntimeError::new("'vector-pop!' cannot pop from empty vector".to_string()));
-                        }
-                        let mut new_vec = (*items).clone();
-                        let last = new_vec.pop().unwrap();
-                        self.value_stack.push(Value::Vector(Arc::new(new_vec)));
+                        let mut new_vec = items.borrow().clone();
+                        let last = new_vec.pop()
+                            .ok_or_else(|| RuntimeError::new("'vector-pop!' cannot pop from empty vector".to_string()))?;
+                        self.value_stack.push(Value::vector(new_vec));
                         self.value_stack.push(last);
                     }
                     _ => {
@@ -2266,7 +3343,7 @@ impl VM {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in VectorLength".to_string()))?;
                 match value {
                     Value::Vector(items) => {
-                        self.value_stack.push(Value::Integer(items.len() as i64));
+                        self.value_stack.push(Value::Integer(items.borrow().len() as i64));
                     }
                     _ => {
                         return Err(RuntimeError::new(format!(
@@ -2288,7 +3365,7 @@ impl VM {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ListToVector".to_string()))?;
                 match value {
                     Value::List(list) => {
-                        self.value_stack.push(Value::Vector(Arc::new(list.to_vec())));
+                        self.value_stack.push(Value::vector(list.to_vec()));
                     }
                     _ => {
                         return Err(RuntimeError::new(format!(
@@ -2304,7 +3381,7 @@ impl VM {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in VectorToList".to_string()))?;
                 match value {
                     Value::Vector(vec) => {
-                        self.value_stack.push(Value::List(List::from_vec((*vec).clone())));
+                        self.value_stack.push(Value::List(List::from_vec(vec.borrow().clone())));
                     }
                     _ => {
                         return Err(RuntimeError::new(format!(
@@ -2392,32 +3469,20 @@ impl VM {
             }
             Instruction::Floor => {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Floor".to_string()))?;
-                let result = match value {
-                    Value::Float(f) => f.floor() as i64,
-                    Value::Integer(n) => n,
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: 'floor' expects a number, got {}",
-                            Self::type_name(&value)
-                        )));
-                    }
-                };
-                self.value_stack.push(Value::Integer(result));
+                let result = Self::float_to_integer("floor", value, f64::floor)?;
+                self.value_stack.push(result);
                 self.instruction_pointer += 1;
             }
             Instruction::Ceil => {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Ceil".to_string()))?;
-                let result = match value {
-                    Value::Float(f) => f.ceil() as i64,
-                    Value::Integer(n) => n,
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: 'ceil' expects a number, got {}",
-                            Self::type_name(&value)
-                        )));
-                    }
-                };
-                self.value_stack.push(Value::Integer(result));
+                let result = Self::float_to_integer("ceil", value, f64::ceil)?;
+                self.value_stack.push(result);
+                self.instruction_pointer += 1;
+            }
+            Instruction::Round => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Round".to_string()))?;
+                let result = Self::float_to_integer("round", value, f64::round)?;
+                self.value_stack.push(result);
                 self.instruction_pointer += 1;
             }
             Instruction::Abs => {
@@ -2616,6 +3681,14 @@ impl VM {
                 self.value_stack.push(Value::Integer(now.as_secs() as i64));
                 self.instruction_pointer += 1;
             }
+            Instruction::CurrentTimeMillis => {
+                use std::time::{SystemTime, UNIX_EPOCH};
+                let now = SystemTime::now()
+                    .duration_since(UNIX_EPOCH)
+                    .map_err(|e| RuntimeError::new(format!("System time error: {}", e)))?;
+                self.value_stack.push(Value::Integer(now.as_millis() as i64));
+                self.instruction_pointer += 1;
+            }
             Instruction::FormatTimestamp => {
                 let format = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in FormatTimestamp".to_string()))?;
                 let timestamp = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in FormatTimestamp".to_string()))?;
@@ -2638,56 +3711,7 @@ impl VM {
                 self.instruction_pointer += 1;
             }
             Instruction::Eval => {
-                let code = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Eval".to_string()))?;
-                match code {
-                    Value::String(source) => {
-                        // Parse the code
-                        let mut parser = Parser::new(&source);
-                        let exprs = parser.parse_all().map_err(|e| {
-                            RuntimeError::new(format!("'eval' failed to parse code: {}", e))
-                        })?;
-
-                        // Compile the code with runtime context
-                        // This allows eval'd code to reference functions and globals from parent context
-                        let mut compiler = Compiler::new();
-                        compiler.with_known_functions(self.functions.keys());
-                        compiler.with_known_globals(self.global_vars.keys());
-                        let (functions, main) = compiler.compile_program(&exprs).map_err(|e| {
-                            RuntimeError::new(format!("'eval' failed to compile code: {}", e.message))
-                        })?;
-
-                        // Merge compiled functions into VM's function table
-                        self.functions.extend(functions);
-
-                        // Execute the compiled code
-                        // Save current state
-                        let saved_bytecode = std::mem::replace(&mut self.current_bytecode, main);
-                        let saved_ip = self.instruction_pointer;
-
-                        // Execute the eval'd code
-                        self.instruction_pointer = 0;
-                        while !self.halted && self.instruction_pointer < self.current_bytecode.len() {
-                            self.execute_one_instruction()?;
-                        }
-
-                        // Restore previous state
-                        self.current_bytecode = saved_bytecode;
-                        self.instruction_pointer = saved_ip;
-                        self.halted = false;
-
-                        // The result is already on the stack from the eval'd code
-                        // If nothing was pushed, push nil (empty list)
-                        if self.value_stack.is_empty() {
-                            self.value_stack.push(Value::List(List::Nil));
-                        }
-                    }
-                    _ => {
-                        return Err(RuntimeError::new(format!(
-                            "Type error: 'eval' expects a string, got {}",
-                            Self::type_name(&code)
-                        )));
-                    }
-                }
+                self.eval_code()?;
                 self.instruction_pointer += 1;
             }
 
@@ -2721,6 +3745,10 @@ impl VM {
                                         // Track the highest argument index
                                         max_arg_index = Some(max_arg_index.map_or(*idx, |m| m.max(*idx)));
                                     }
+                                    Instruction::AddArgs(a, b) => {
+                                        let idx = *a.max(b);
+                                        max_arg_index = Some(max_arg_index.map_or(idx, |m| m.max(idx)));
+                                    }
                                     _ => {}
                                 }
                             }
@@ -2841,12 +3869,59 @@ impl VM {
                 self.instruction_pointer += 1;
             }
 
+            Instruction::Trace => {
+                self.set_traced(true)?;
+                self.instruction_pointer += 1;
+            }
+            Instruction::Untrace => {
+                self.set_traced(false)?;
+                self.instruction_pointer += 1;
+            }
+            Instruction::TraceCall(name) => {
+                let name = name.clone();
+                self.trace_call(name)?;
+            }
+            Instruction::TraceReturn => {
+                self.trace_return()?;
+                self.instruction_pointer += 1;
+            }
+            Instruction::Disassemble => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Disassemble".to_string()))?;
+                let name = match &value {
+                    Value::Symbol(name) => Some(name.name()),
+                    Value::String(name) | Value::Function(name) => Some(name.as_str()),
+                    _ => None,
+                };
+                let listing = match (&value, name) {
+                    (_, Some(name)) => {
+                        let bytecode = self.functions.get(name).ok_or_else(|| {
+                            RuntimeError::new(format!("Undefined function '{}' in disassemble", name))
+                        })?;
+                        crate::disassembler::disassemble_function(name, bytecode)
+                    }
+                    (Value::Closure(closure_data), _) => {
+                        let params: Vec<String> = closure_data.params.iter().chain(&closure_data.rest_param).cloned().collect();
+                        crate::disassembler::disassemble_function_with_params("<closure>", &closure_data.body, &params)
+                    }
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'disassemble' expects a function name or function, got {}",
+                            Self::type_name(&value)
+                        )));
+                    }
+                };
+                self.value_stack.push(Value::String(Arc::new(listing)));
+                self.instruction_pointer += 1;
+            }
+
             Instruction::TypeOf => {
                 let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in TypeOf".to_string()))?;
-                let type_symbol = match value {
+                let type_symbol = match &value {
                     Value::Integer(_) => "integer",
+                    Value::BigInt(_) => "integer",
                     Value::Float(_) => "float",
                     Value::Boolean(_) => "boolean",
+                    Value::Char(_) => "char",
                     Value::List(_) => "list",
                     Value::Symbol(_) => "symbol",
                     Value::String(_) => "string",
@@ -2858,17 +3933,31 @@ impl VM {
                     Value::TcpStream(_) => "tcp-stream",
                     Value::SharedTcpListener(_) => "shared-tcp-listener",
                     Value::Pointer(_) => "pointer",
+                    Value::Cell(_) => "cell",
+                    Value::Struct(data) => data.name.as_str(),
+                    Value::Port(_) => "port",
+                    Value::Promise(_) => "promise",
+                    Value::Task(_) => "task",
+                    Value::Channel(_) => "channel",
                 };
-                self.value_stack.push(Value::Symbol(Arc::new(type_symbol.to_string())));
+                self.value_stack.push(Value::symbol(type_symbol));
                 self.instruction_pointer += 1;
             }
 
             Instruction::GenSym => {
-                use std::sync::atomic::{AtomicUsize, Ordering};
-                static GENSYM_COUNTER: AtomicUsize = AtomicUsize::new(0);
-                let counter = GENSYM_COUNTER.fetch_add(1, Ordering::SeqCst);
-                let sym = format!("G__{}", counter);
-                self.value_stack.push(Value::Symbol(Arc::new(sym)));
+                self.value_stack.push(Value::Symbol(Symbol::gensym("G__")));
+                self.instruction_pointer += 1;
+            }
+
+            Instruction::GenSymPrefix => {
+                let prefix = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in GenSymPrefix".to_string()))?;
+                let Value::String(prefix) = &prefix else {
+                    return Err(RuntimeError::new(format!(
+                        "Type error: 'gensym' expects a string prefix, got {}",
+                        Self::type_name(&prefix)
+                    )));
+                };
+                self.value_stack.push(Value::Symbol(Symbol::gensym(prefix)));
                 self.instruction_pointer += 1;
             }
 
@@ -2994,7 +4083,7 @@ impl VM {
                                     &[item.clone()]
                                 )?;
 
-                                Ok((item.clone(), matches!(result, Value::Boolean(true))))
+                                Ok((item.clone(), !matches!(result, Value::Boolean(false))))
                             })
                             .collect();
 
@@ -3122,12 +4211,15 @@ impl VM {
 
                 match listener_val {
                     Value::TcpListener(listener_rc) => {
-                        let mut listener = listener_rc.borrow_mut();
-
-                        match listener.accept() {
-                            Ok((stream, _addr)) => {
+                        let accepted = self.accept_connection(&listener_rc.borrow());
+                        match accepted {
+                            Ok(Some(stream)) => {
                                 self.value_stack.push(Value::TcpStream(Rc::new(RefCell::new(stream))));
                             }
+                            Ok(None) => {
+                                self.value_stack.push(Value::TcpListener(listener_rc));
+                                return self.wait_for_socket();
+                            }
                             Err(e) => {
                                 return Err(RuntimeError::new(format!(
                                     "http-accept: failed to accept connection: {}",
@@ -3148,6 +4240,10 @@ impl VM {
             Instruction::HttpReadRequest => {
                 use std::io::{Read, BufRead, BufReader};
 
+                if self.socket_would_block(0) {
+                    return self.wait_for_socket();
+                }
+
                 let stream_val = self.value_stack.pop()
                     .ok_or_else(|| RuntimeError::new("Stack underflow in HttpReadRequest".to_string()))?;
 
@@ -3201,7 +4297,7 @@ impl VM {
                                     content_length = value.parse().unwrap_or(0);
                                 }
 
-                                headers.insert(key, Value::String(Arc::new(value)));
+                                headers.insert(MapKey::from(key), Value::String(Arc::new(value)));
                             }
                         }
 
@@ -3220,12 +4316,12 @@ impl VM {
 
                         // Build response hashmap with pre-allocated capacity
                         let mut request_map = HashMap::with_capacity(4);
-                        request_map.insert("method".to_string(), Value::String(Arc::new(method)));
-                        request_map.insert("path".to_string(), Value::String(Arc::new(path)));
-                        request_map.insert("body".to_string(), Value::String(Arc::new(body)));
-                        request_map.insert("headers".to_string(), Value::HashMap(Arc::new(headers)));
+                        request_map.insert(MapKey::from("method"), Value::String(Arc::new(method)));
+                        request_map.insert(MapKey::from("path"), Value::String(Arc::new(path)));
+                        request_map.insert(MapKey::from("body"), Value::String(Arc::new(body)));
+                        request_map.insert(MapKey::from("headers"), Value::hashmap(headers));
 
-                        self.value_stack.push(Value::HashMap(Arc::new(request_map)));
+                        self.value_stack.push(Value::hashmap(request_map));
                         } // close the else block for non-empty request
                     }
                     _ => {
@@ -3248,21 +4344,22 @@ impl VM {
                 match (stream_val, response_val) {
                     (Value::TcpStream(stream_rc), Value::HashMap(response_map)) => {
                         let mut stream = stream_rc.borrow_mut();
+                        let response_map = response_map.borrow();
 
                         // Extract status code (default 200)
-                        let status = match response_map.get("status") {
+                        let status = match response_map.get(&MapKey::from("status")) {
                             Some(Value::Integer(code)) => *code,
                             _ => 200,
                         };
 
                         // Extract body (default empty string)
-                        let body = match response_map.get("body") {
+                        let body = match response_map.get(&MapKey::from("body")) {
                             Some(Value::String(s)) => s.as_str(),
                             _ => "",
                         };
 
                         // Extract keep-alive flag (default false for backward compatibility)
-                        let keep_alive = match response_map.get("keep-alive") {
+                        let keep_alive = match response_map.get(&MapKey::from("keep-alive")) {
                             Some(Value::Boolean(b)) => *b,
                             _ => false,
                         };
@@ -3338,17 +4435,139 @@ impl VM {
                 }
                 self.instruction_pointer += 1;
             }
-            Instruction::HttpListenShared => {
-                let port = self.value_stack.pop()
-                    .ok_or_else(|| RuntimeError::new("Stack underflow in HttpListenShared".to_string()))?;
-
-                match port {
-                    Value::Integer(p) => {
-                        let addr = format!("0.0.0.0:{}", p);
-                        match std::net::TcpListener::bind(&addr) {
-                            Ok(listener) => {
-                                // Use Arc for thread-safe sharing
-                                self.value_stack.push(Value::SharedTcpListener(Arc::new(listener)));
+            Instruction::TcpListen => {
+                let port = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in TcpListen".to_string()))?;
+                let port_num = match port {
+                    Value::Integer(n) if (1..=65535).contains(&n) => n,
+                    Value::Integer(n) => {
+                        return Err(RuntimeError::new(format!("'tcp-listen' invalid port number {}, must be 1-65535", n)));
+                    }
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'tcp-listen' expects an integer port, got {}",
+                            Self::type_name(&port)
+                        )));
+                    }
+                };
+                // std binds with a backlog of 128
+                let listener = std::net::TcpListener::bind(("0.0.0.0", port_num as u16))
+                    .map_err(|e| RuntimeError::new(format!("'tcp-listen' failed to bind to port {}: {}", port_num, e)))?;
+                self.value_stack.push(Value::TcpListener(Rc::new(RefCell::new(listener))));
+                self.instruction_pointer += 1;
+            }
+            Instruction::TcpAccept => {
+                let listener = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in TcpAccept".to_string()))?;
+                let listener = match listener {
+                    Value::TcpListener(listener) => listener,
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'tcp-accept' expects a tcp-listener, got {}",
+                            Self::type_name(&listener)
+                        )));
+                    }
+                };
+                let accepted = self.accept_connection(&listener.borrow())
+                    .map_err(|e| RuntimeError::new(format!("'tcp-accept' failed to accept a connection: {}", e)))?;
+                let Some(stream) = accepted else {
+                    self.value_stack.push(Value::TcpListener(listener));
+                    return self.wait_for_socket();
+                };
+                self.value_stack.push(Value::TcpStream(Rc::new(RefCell::new(stream))));
+                self.instruction_pointer += 1;
+            }
+            Instruction::SocketRead => {
+                use std::io::Read;
+
+                if self.socket_would_block(1) {
+                    return self.wait_for_socket();
+                }
+
+                let max_bytes = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in SocketRead".to_string()))?;
+                let conn = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in SocketRead".to_string()))?;
+                let stream = Self::socket_arg(&conn, "socket-read")?;
+                let max_bytes = match max_bytes {
+                    Value::Integer(n) if n > 0 => n as usize,
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "'socket-read' expects a positive byte count, got {}",
+                            Self::format_diagnostic(&max_bytes)
+                        )));
+                    }
+                };
+                let mut buffer = vec![0u8; max_bytes];
+                let read = stream.borrow_mut().read(&mut buffer)
+                    .map_err(|e| RuntimeError::new(format!("'socket-read' failed: {}", e)))?;
+                if read == 0 {
+                    // The peer closed its end, or this end was closed with socket-close
+                    self.value_stack.push(Value::List(List::Nil));
+                } else {
+                    self.value_stack.push(Value::string(String::from_utf8_lossy(&buffer[..read])));
+                }
+                self.instruction_pointer += 1;
+            }
+            Instruction::SocketWrite => {
+                use std::io::Write;
+
+                let text = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in SocketWrite".to_string()))?;
+                let conn = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in SocketWrite".to_string()))?;
+                let stream = Self::socket_arg(&conn, "socket-write")?;
+                let text = match text {
+                    Value::String(s) => s,
+                    _ => {
+                        return Err(RuntimeError::new(format!(
+                            "Type error: 'socket-write' expects a string, got {}",
+                            Self::type_name(&text)
+                        )));
+                    }
+                };
+                stream.borrow_mut().write_all(text.as_bytes())
+                    .map_err(|e| RuntimeError::new(format!("'socket-write' failed: {}", e)))?;
+                self.value_stack.push(Value::Integer(text.len() as i64));
+                self.instruction_pointer += 1;
+            }
+            Instruction::SocketClose => {
+                let conn = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in SocketClose".to_string()))?;
+                let stream = Self::socket_arg(&conn, "socket-close")?;
+                match stream.borrow().shutdown(std::net::Shutdown::Both) {
+                    // Shutting down a socket twice, or one the peer already reset, reports NotConnected
+                    Ok(()) => {}
+                    Err(e) if e.kind() == std::io::ErrorKind::NotConnected => {}
+                    Err(e) => return Err(RuntimeError::new(format!("'socket-close' failed: {}", e))),
+                }
+                self.value_stack.push(Value::Boolean(true));
+                self.instruction_pointer += 1;
+            }
+            Instruction::Spawn => self.spawn_task()?,
+            Instruction::Yield => self.yield_task()?,
+            Instruction::Sleep => self.sleep_task()?,
+            Instruction::MakeChannel => {
+                self.value_stack.push(Value::Channel(Rc::new(RefCell::new(Channel::default()))));
+                self.instruction_pointer += 1;
+            }
+            Instruction::ChanSend => self.channel_send()?,
+            Instruction::ChanRecv => self.channel_recv()?,
+            Instruction::TaskResult => self.task_result()?,
+            Instruction::TaskStatus => {
+                let task = self.task_arg("task-status")?;
+                let status = task.borrow().status();
+                self.value_stack.push(Value::symbol(status));
+                self.instruction_pointer += 1;
+            }
+            Instruction::TaskExit => {
+                let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in TaskExit".to_string()))?;
+                self.finish_task(TaskState::Done(value))?;
+            }
+            Instruction::HttpListenShared => {
+                let port = self.value_stack.pop()
+                    .ok_or_else(|| RuntimeError::new("Stack underflow in HttpListenShared".to_string()))?;
+
+                match port {
+                    Value::Integer(p) => {
+                        let addr = format!("0.0.0.0:{}", p);
+                        match std::net::TcpListener::bind(&addr) {
+                            Ok(listener) => {
+                                // Use Arc for thread-safe sharing
+                                self.value_stack.push(Value::SharedTcpListener(Arc::new(listener)));
                             }
                             Err(e) => {
                                 return Err(RuntimeError::new(format!(
@@ -3453,7 +4672,7 @@ impl VM {
 
                         s.spawn(move || {
                             // Reconstruct function table from bytes in this thread
-                            let mut functions: HashMap<String, Vec<Instruction>> = HashMap::new();
+                            let mut functions = FunctionTable::new();
                             for (name, bytes) in &functions_bytes {
                                 if let Ok((_, bytecode)) = crate::vm::bytecode::deserialize_bytecode(bytes) {
                                     functions.insert(name.clone(), bytecode);
@@ -3550,7 +4769,7 @@ impl VM {
                                                 content_length = value.parse().unwrap_or(0);
                                             }
 
-                                            headers.insert(key, Value::String(Arc::new(value)));
+                                            headers.insert(MapKey::from(key), Value::String(Arc::new(value)));
                                         }
                                     }
 
@@ -3567,10 +4786,10 @@ impl VM {
 
                                     // Build request hashmap
                                     let mut request_map = HashMap::with_capacity(4);
-                                    request_map.insert("method".to_string(), Value::String(Arc::new(method)));
-                                    request_map.insert("path".to_string(), Value::String(Arc::new(path)));
-                                    request_map.insert("body".to_string(), Value::String(Arc::new(body)));
-                                    request_map.insert("headers".to_string(), Value::HashMap(Arc::new(headers)));
+                                    request_map.insert(MapKey::from("method"), Value::String(Arc::new(method)));
+                                    request_map.insert(MapKey::from("path"), Value::String(Arc::new(path)));
+                                    request_map.insert(MapKey::from("body"), Value::String(Arc::new(body)));
+                                    request_map.insert(MapKey::from("headers"), Value::hashmap(headers));
 
                                     // Create mini-VM and execute handler
                                     let mut thread_vm = VM::new();
@@ -3581,31 +4800,32 @@ impl VM {
                                         &func_params,
                                         &func_rest,
                                         &vec![], // No captured variables for serialized closures
-                                        &[Value::HashMap(Arc::new(request_map))]
+                                        &[Value::hashmap(request_map)]
                                     ) {
                                         Ok(val) => val,
                                         Err(_) => {
                                             // On error, create 500 response
                                             let mut err_map = HashMap::new();
-                                            err_map.insert("status".to_string(), Value::Integer(500));
-                                            err_map.insert("body".to_string(), Value::String(Arc::new("Internal Server Error".to_string())));
-                                            Value::HashMap(Arc::new(err_map))
+                                            err_map.insert(MapKey::from("status"), Value::Integer(500));
+                                            err_map.insert(MapKey::from("body"), Value::String(Arc::new("Internal Server Error".to_string())));
+                                            Value::hashmap(err_map)
                                         }
                                     };
 
                                     // Send response
                                     if let Value::HashMap(response_map) = response {
-                                        let status = match response_map.get("status") {
+                                        let response_map = response_map.borrow();
+                                        let status = match response_map.get(&MapKey::from("status")) {
                                             Some(Value::Integer(code)) => *code,
                                             _ => 200,
                                         };
 
-                                        let resp_body = match response_map.get("body") {
+                                        let resp_body = match response_map.get(&MapKey::from("body")) {
                                             Some(Value::String(s)) => s.as_str(),
                                             _ => "",
                                         };
 
-                                        let keep_alive = match response_map.get("keep-alive") {
+                                        let keep_alive = match response_map.get(&MapKey::from("keep-alive")) {
                                             Some(Value::Boolean(b)) => *b,
                                             _ => false,
                                         };
@@ -4103,11 +5323,908 @@ impl VM {
         Ok(())
     }
 
-    fn type_name(value: &Value) -> &str {
+    /// Arithmetic once a bignum is involved: exact with other integers, inexact
+    /// with floats. Returns None unless one operand is a bignum and both are numbers.
+    fn bigint_arith(a: &Value, b: &Value, int_op: fn(&BigInt, &BigInt) -> BigInt, float_op: fn(f64, f64) -> f64) -> Option<Value> {
+        match (a, b) {
+            (Value::BigInt(x), Value::Float(y)) => Some(Value::Float(float_op(x.to_f64(), *y))),
+            (Value::Float(x), Value::BigInt(y)) => Some(Value::Float(float_op(*x, y.to_f64()))),
+            (Value::BigInt(_), _) | (_, Value::BigInt(_)) => {
+                Some(Value::from_bigint(int_op(&a.as_bigint()?, &b.as_bigint()?)))
+            }
+            _ => None,
+        }
+    }
+
+    /// floor, ceil and round: integers pass through, a float is rounded by `op`
+    /// and becomes a bignum when that is outside the i64 range
+    fn float_to_integer(name: &str, value: Value, op: fn(f64) -> f64) -> Result<Value, RuntimeError> {
+        match value {
+            Value::Float(f) => {
+                let rounded = op(f);
+                // 2^63 is exact as a float; anything below it and at least -2^63 fits
+                if (-9223372036854775808.0..9223372036854775808.0).contains(&rounded) {
+                    return Ok(Value::Integer(rounded as i64));
+                }
+                BigInt::from_f64(rounded).map(Value::from_bigint).ok_or_else(|| RuntimeError::new(format!(
+                    "Type error: '{}' expects a finite number, got {}",
+                    name,
+                    Self::format_diagnostic(&value)
+                )))
+            }
+            Value::Integer(_) | Value::BigInt(_) => Ok(value),
+            _ => Err(RuntimeError::new(format!(
+                "Type error: '{}' expects a number, got {}",
+                name,
+                Self::type_name(&value)
+            ))),
+        }
+    }
+
+    /// Argument `idx` of the current frame, as LoadArg pushes it
+    fn arg(&self, idx: usize) -> Result<Value, RuntimeError> {
+        let frame = self.call_stack.last().ok_or_else(|| RuntimeError::new("No frame to load arg from".to_string()))?;
+        frame.locals.get(idx).cloned().ok_or_else(|| RuntimeError::new(format!("Arg index {} out of bounds", idx)))
+    }
+
+    /// The value at stack position `pos` from the current frame's base, as GetLocal pushes it
+    fn local(&self, pos: usize) -> Result<Value, RuntimeError> {
+        // Main execution has stack_base 0
+        let stack_base = self.call_stack.last().map_or(0, |frame| frame.stack_base);
+        let absolute_pos = stack_base + pos;
+        self.value_stack.get(absolute_pos).cloned().ok_or_else(|| RuntimeError::new(format!(
+            "Stack position {} (base {} + offset {}) out of bounds",
+            absolute_pos, stack_base, pos
+        )))
+    }
+
+    /// a + b, as Add computes it: fixnums overflow into bignums, and an integer
+    /// added to a float gives a float
+    fn add_values(a: &Value, b: &Value) -> Result<Value, RuntimeError> {
+        match (a, b) {
+            (Value::Integer(x), Value::Integer(y)) => {
+                // Only allocate a bignum when the fixnum result overflows
+                Ok(match x.checked_add(*y) {
+                    Some(n) => Value::Integer(n),
+                    None => Value::from_bigint(BigInt::from_i64(*x).add(&BigInt::from_i64(*y))),
+                })
+            }
+            (Value::Float(x), Value::Float(y)) => Ok(Value::Float(x + y)),
+            (Value::Integer(x), Value::Float(y)) => Ok(Value::Float(*x as f64 + y)),
+            (Value::Float(x), Value::Integer(y)) => Ok(Value::Float(x + *y as f64)),
+            _ => Self::bigint_arith(a, b, BigInt::add, |x, y| x + y).ok_or_else(|| {
+                RuntimeError::new(format!(
+                    "Type error: '+' expects two numbers, got {} and {}",
+                    Self::type_name(a),
+                    Self::type_name(b)
+                ))
+            }),
+        }
+    }
+
+    /// Equality as == and assert-equal see it: numbers compare by value across
+    /// integers, floats and bignums, anything else structurally
+    fn values_equal(a: &Value, b: &Value) -> bool {
+        match (a, b) {
+            (Value::Integer(x), Value::Integer(y)) => x == y,
+            (Value::Float(x), Value::Float(y)) => x == y,
+            (Value::Integer(x), Value::Float(y)) => *x as f64 == *y,
+            (Value::Float(x), Value::Integer(y)) => *x == *y as f64,
+            _ => Self::bigint_compare(a, b, Ordering::is_eq).unwrap_or(a == b),
+        }
+    }
+
+    /// quotient, remainder and modulo on integers and bignums. The quotient
+    /// truncates toward zero; remainder takes the sign of the dividend and
+    /// modulo the sign of the divisor, so (remainder -7 3) is -1 but (modulo -7 3) is 2.
+    pub(crate) fn integer_division(name: &str, a: &Value, b: &Value) -> Result<Value, RuntimeError> {
+        if let (Value::Integer(x), Value::Integer(y)) = (a, b) {
+            // Only i64::MIN / -1 and a zero divisor fall through to the bignum path
+            let fast = match name {
+                "quotient" => x.checked_div(*y),
+                "remainder" => x.checked_rem(*y),
+                _ => x.checked_rem(*y).map(|r| if r != 0 && (r < 0) != (*y < 0) { r + y } else { r }),
+            };
+            if let Some(n) = fast {
+                return Ok(Value::Integer(n));
+            }
+        }
+        let (x, y) = match (a.as_bigint(), b.as_bigint()) {
+            (Some(x), Some(y)) => (x, y),
+            _ => {
+                return Err(RuntimeError::new(format!(
+                    "Type error: '{}' expects two integers, got {} and {}",
+                    name,
+                    Self::type_name(a),
+                    Self::type_name(b)
+                )));
+            }
+        };
+        let (quotient, remainder) = x.div_rem(&y).ok_or_else(|| {
+            RuntimeError::with_suggestion(
+                format!("Division by zero in '{}'", name),
+                format!("Check your divisor first, for example: (if (= y 0) 0 ({} x y))", name),
+            )
+        })?;
+        let result = match name {
+            "quotient" => quotient,
+            "remainder" => remainder,
+            _ if !remainder.is_zero() && remainder.is_negative() != y.is_negative() => remainder.add(&y),
+            _ => remainder,
+        };
+        Ok(Value::from_bigint(result))
+    }
+
+    /// Element `index` of a list, for list-ref and nth
+    fn list_element(name: &str, list_val: &Value, index: &Value) -> Result<Value, RuntimeError> {
+        let (list, idx) = match (list_val, index) {
+            (Value::List(list), Value::Integer(idx)) => (list, *idx),
+            _ => {
+                let usage = if name == "nth" { "an integer and a list" } else { "a list and an integer" };
+                let (first, second) = if name == "nth" { (index, list_val) } else { (list_val, index) };
+                return Err(RuntimeError::new(format!(
+                    "Type error: '{}' expects {}, got {} and {}",
+                    name,
+                    usage,
+                    Self::type_name(first),
+                    Self::type_name(second)
+                )));
+            }
+        };
+        if idx < 0 {
+            return Err(RuntimeError::new(format!("'{}' index cannot be negative: {}", name, idx)));
+        }
+        list.iter().nth(idx as usize).cloned().ok_or_else(|| {
+            RuntimeError::new(format!("'{}' index {} out of bounds for list of length {}", name, idx, list.len()))
+        })
+    }
+
+    /// Pop a list and an item and push what member, memq, assoc or assq find:
+    /// the tail from the first element that is the item, or the first entry
+    /// whose car is, compared with equal? or else eq?; '() when there is none
+    fn search_list(&mut self, entries: bool, by_identity: bool) -> Result<(), RuntimeError> {
+        let (name, instruction) = match (entries, by_identity) {
+            (false, false) => ("member", "Member"),
+            (false, true) => ("memq", "Memq"),
+            (true, false) => ("assoc", "Assoc"),
+            (true, true) => ("assq", "Assq"),
+        };
+        let list_val = self.value_stack.pop().ok_or_else(|| RuntimeError::new(format!("Stack underflow in {}", instruction)))?;
+        let item = self.value_stack.pop().ok_or_else(|| RuntimeError::new(format!("Stack underflow in {}", instruction)))?;
+        let mut list = match list_val {
+            Value::List(list) => list,
+            _ => {
+                return Err(RuntimeError::new(format!(
+                    "Type error: '{}' expects a list, got {}",
+                    name,
+                    Self::type_name(&list_val)
+                )));
+            }
+        };
+        let same = |a: &Value, b: &Value| if by_identity { Ok(a.is_eq(b)) } else { a.is_equal(b).map_err(RuntimeError::new) };
+
+        while let Some(head) = list.car() {
+            let found = if entries {
+                let key = match head {
+                    Value::List(entry) => entry.car(),
+                    _ => None,
+                };
+                let key = key.ok_or_else(|| RuntimeError::new(format!(
+                    "Type error: '{}' expects a list of pairs, got the entry {}",
+                    name,
+                    Self::format_diagnostic(head)
+                )))?;
+                same(&item, key)?
+            } else {
+                same(&item, head)?
+            };
+            if found {
+                let result = if entries { head.clone() } else { Value::List(list.clone()) };
+                self.value_stack.push(result);
+                return Ok(());
+            }
+            list = list.cdr().unwrap_or(List::Nil);
+        }
+        self.value_stack.push(Value::List(List::Nil));
+        Ok(())
+    }
+
+    /// Pop a list and a comparison and push the list sorted, for sort
+    fn sort_list(&mut self) -> Result<(), RuntimeError> {
+        let list_val = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Sort".to_string()))?;
+        let compare = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Sort".to_string()))?;
+        let items = match &list_val {
+            Value::List(list) => list.to_vec(),
+            _ => {
+                return Err(RuntimeError::new(format!(
+                    "Type error: 'sort' expects a list, got {}",
+                    Self::type_name(&list_val)
+                )));
+            }
+        };
+        let sorted = self.merge_sort(&compare, items)?;
+        self.heap.note_allocations(sorted.len());
+        self.value_stack.push(Value::List(List::from_vec(sorted)));
+        Ok(())
+    }
+
+    /// Stable merge sort for the sort function: equal elements keep their order.
+    /// `compare` is called as (compare a b) and says whether a goes before b; an
+    /// inconsistent comparison gives some order rather than an error.
+    fn merge_sort(&mut self, compare: &Value, mut items: Vec<Value>) -> Result<Vec<Value>, RuntimeError> {
+        if items.len() <= 1 {
+            return Ok(items);
+        }
+        let right = items.split_off(items.len() / 2);
+        let left = self.merge_sort(compare, items)?;
+        let right = self.merge_sort(compare, right)?;
+
+        let mut merged = Vec::with_capacity(left.len() + right.len());
+        let mut left = left.into_iter().peekable();
+        let mut right = right.into_iter().peekable();
+        while let (Some(a), Some(b)) = (left.peek(), right.peek()) {
+            // Take from the right only when it goes strictly before the left
+            let before = match self.call_nested(compare, &[b.clone(), a.clone()])? {
+                Value::Boolean(before) => before,
+                other => {
+                    return Err(RuntimeError::new(format!(
+                        "Type error: 'sort' expects its comparison to return a boolean, got {}",
+                        Self::type_name(&other)
+                    )));
+                }
+            };
+            let next = if before { right.next() } else { left.next() };
+            merged.extend(next);
+        }
+        merged.extend(left);
+        merged.extend(right);
+        Ok(merged)
+    }
+
+    /// Next line of input for read-line: the rest of the line read's last datum
+    /// ended on, if any, and otherwise the next line of line_input or stdin
+    fn read_input_line(&mut self) -> std::io::Result<Option<String>> {
+        if self.read_buffer.is_empty() {
+            return self.next_input_line();
+        }
+        let end = self.read_buffer.find('\n').map_or(self.read_buffer.len(), |i| i + 1);
+        let line: String = self.read_buffer.drain(..end).collect();
+        port::read_line(&mut line.as_bytes())
+    }
+
+    // Next line of input from line_input, or stdin when there is none
+    fn next_input_line(&mut self) -> std::io::Result<Option<String>> {
+        match self.line_input.as_mut() {
+            Some(input) => port::read_line(input),
+            None => port::read_line(&mut std::io::stdin().lock()),
+        }
+    }
+
+    /// Push the next datum of input for read, taking lines until one is
+    /// complete; what follows it on its last line is kept for the next read
+    /// or read-line. At the end of input this is nil.
+    fn read_input_datum(&mut self) -> Result<(), RuntimeError> {
+        let mut text = std::mem::take(&mut self.read_buffer);
+        let mut at_end = false;
+        loop {
+            match parser::read_datum(&text, "<stdin>") {
+                Ok(Some((datum, end))) => {
+                    self.read_buffer = text[end..].to_string();
+                    self.value_stack.push(Self::datum_value(&datum, "read")?);
+                    return Ok(());
+                }
+                Ok(None) if at_end => {
+                    self.value_stack.push(Value::List(List::Nil));
+                    return Ok(());
+                }
+                Ok(None) => text.clear(), // Only whitespace and comments so far
+                Err(error) if at_end || !error.incomplete => {
+                    return Err(RuntimeError::new(format!("'read' failed to parse input: {}", error.message)));
+                }
+                Err(_) => {} // Partway through a datum; it may end on a later line
+            }
+            let line = self.next_input_line()
+                .map_err(|e| RuntimeError::new(format!("'read' failed to read input: {}", e)))?;
+            match line {
+                Some(line) => {
+                    text.push_str(&line);
+                    text.push('\n');
+                }
+                None => at_end = true,
+            }
+        }
+    }
+
+    /// Pop a string and push the first datum written in it, for read-from-string
+    fn read_from_string(&mut self) -> Result<(), RuntimeError> {
+        let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ReadFromString".to_string()))?;
+        let text = match &value {
+            Value::String(text) => text,
+            _ => {
+                return Err(RuntimeError::new(format!(
+                    "Type error: 'read-from-string' expects a string, got {}",
+                    Self::type_name(&value)
+                )));
+            }
+        };
+        let datum = match parser::read_datum(text, "<string>") {
+            Ok(Some((datum, _))) => Self::datum_value(&datum, "read-from-string")?,
+            Ok(None) => return Err(RuntimeError::new(format!("'read-from-string' found no datum in {}", format_string(text)))),
+            Err(error) => {
+                return Err(RuntimeError::new(format!(
+                    "'read-from-string' failed to parse {}: {}",
+                    format_string(text),
+                    error.message
+                )));
+            }
+        };
+        self.value_stack.push(datum);
+        Ok(())
+    }
+
+    fn datum_value(datum: &SourceExpr, name: &str) -> Result<Value, RuntimeError> {
+        datum.to_value().map_err(|e| {
+            RuntimeError::new(format!("'{}' can't read {}: {}", name, datum.to_source(), e.message))
+        })
+    }
+
+    /// Pop a function, or its name, trace or untrace it and push its name
+    fn set_traced(&mut self, on: bool) -> Result<(), RuntimeError> {
+        let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Trace".to_string()))?;
+        let name = match &value {
+            Value::Function(name) => name.to_string(),
+            Value::Symbol(name) => name.to_string(),
+            _ => {
+                return Err(RuntimeError::new(format!(
+                    "Type error: '{}' expects a function or its name, got {}",
+                    if on { "trace" } else { "untrace" },
+                    Self::type_name(&value)
+                )));
+            }
+        };
+        if on {
+            self.trace_function(&name)?;
+        } else {
+            self.untrace_function(&name)?;
+        }
+        self.value_stack.push(Value::symbol(name.as_str()));
+        Ok(())
+    }
+
+    /// Make every call of the function `name` print its arguments as it enters and
+    /// its value as it returns. Its definition is kept aside and replaced with
+    /// one that prints around running it, so calls of every kind, tail calls
+    /// included, go through the trace; only its own tail calls stop reusing frames.
+    pub fn trace_function(&mut self, name: &str) -> Result<(), RuntimeError> {
+        if !self.functions.contains_key(name) {
+            return Err(RuntimeError::new(format!("'trace' found no function named '{}'", name)));
+        }
+        self.forget_redefined_trace(name);
+        if !self.traced.contains_key(name) {
+            let wrapper = vec![Instruction::TraceCall(name.to_string()), Instruction::TraceReturn, Instruction::Ret];
+            if let Some(definition) = self.functions.insert(name.to_string(), wrapper) {
+                self.traced.insert(name.to_string(), definition);
+            }
+        }
+        Ok(())
+    }
+
+    /// Give a traced function back the definition it had when traced. Untracing
+    /// a function that isn't traced does nothing.
+    pub fn untrace_function(&mut self, name: &str) -> Result<(), RuntimeError> {
+        if !self.functions.contains_key(name) {
+            return Err(RuntimeError::new(format!("'untrace' found no function named '{}'", name)));
+        }
+        self.forget_redefined_trace(name);
+        if let Some(definition) = self.traced.remove(name) {
+            self.functions.insert(name.to_string(), definition);
+        }
+        Ok(())
+    }
+
+    // A traced function defined again since trace isn't traced any more, and
+    // untrace must not bring back the definition it replaced
+    fn forget_redefined_trace(&mut self, name: &str) {
+        let redefined = match self.functions.get(name) {
+            Some(bytecode) => !matches!(bytecode.first(), Some(Instruction::TraceCall(traced)) if traced == name),
+            None => true,
+        };
+        if redefined {
+            self.traced.remove(name);
+        }
+    }
+
+    /// Print the call of the frame running a traced function's wrapper, as
+    /// > (fact 5), and call its own definition with the same arguments
+    fn trace_call(&mut self, name: String) -> Result<(), RuntimeError> {
+        let definition = self.traced.get(&name).cloned()
+            .ok_or_else(|| RuntimeError::new(format!("'{}' is not traced", name)))?;
+        let args = self.call_stack.last().map(|frame| frame.locals.clone()).unwrap_or_default();
+        // Traced calls at this depth or deeper returned or were unwound
+        let depth = self.call_stack.len();
+        self.trace_depths.retain(|d| *d < depth);
+        let mut parts = vec![name.clone()];
+        parts.extend(args.iter().map(Self::format_diagnostic));
+        self.write_trace_line(&format!("> ({})", parts.join(" ")))?;
+        self.trace_depths.push(depth);
+
+        let frame = Frame {
+            return_address: self.instruction_pointer + 1,
+            locals: args,
+            return_bytecode: self.current_bytecode.clone(),
+            function_name: name,
+            captured: Vec::new(),
+            stack_base: self.value_stack.len(),
+            multiple_values: false,
+        };
+        self.push_frame(frame)?;
+        self.current_bytecode = Rc::new(definition);
+        self.instruction_pointer = 0;
+        Ok(())
+    }
+
+    /// Print the result of the traced call returning to its wrapper, as < 120
+    fn trace_return(&mut self) -> Result<(), RuntimeError> {
+        let depth = self.call_stack.len();
+        self.trace_depths.retain(|d| *d <= depth);
+        self.trace_depths.pop();
+        let value = self.value_stack.last().map(Self::format_diagnostic).unwrap_or_default();
+        self.write_trace_line(&format!("< {}", value))
+    }
+
+    // A trace line, indented by how many traced calls it is inside of
+    fn write_trace_line(&mut self, line: &str) -> Result<(), RuntimeError> {
+        let line = format!("{}{}", "  ".repeat(self.trace_depths.len()), line);
+        match self.trace_output.as_mut() {
+            Some(output) => writeln!(output, "{}", line)
+                .map_err(|e| RuntimeError::new(format!("Failed to write a trace line: {}", e))),
+            None => {
+                println!("{}", line);
+                Ok(())
+            }
+        }
+    }
+
+    /// Pop a form, or a string of code, compile it against the functions and
+    /// globals defined so far and push its value. The code runs in a nested run
+    /// above everything already on the value stack, and only its value is kept,
+    /// so it can't disturb the frame that called eval.
+    fn eval_code(&mut self) -> Result<(), RuntimeError> {
+        let code = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Eval".to_string()))?;
+        let (exprs, what) = match &code {
+            // A string is source code, which may hold several forms
+            Value::String(source) => {
+                let exprs = Parser::new(source).parse_all().map_err(|e| {
+                    RuntimeError::new(format!("'eval' failed to parse code: {}", e))
+                })?;
+                (exprs, "code".to_string())
+            }
+            _ => {
+                let expr = SourceExpr::from_value(&code, &Location::unknown()).map_err(|e| {
+                    RuntimeError::new(format!("'eval' can't evaluate {}: {}", Self::format_diagnostic(&code), e.message))
+                })?;
+                let what = expr.to_source();
+                (vec![expr], what)
+            }
+        };
+
+        // Compile with the runtime context, so the code can refer to the
+        // functions and globals defined before it
+        let mut compiler = Compiler::new();
+        compiler.with_known_functions(self.functions.keys());
+        compiler.with_known_globals(self.global_vars.keys());
+        let (functions, main) = compiler.compile_program(&exprs).map_err(|e| {
+            RuntimeError::new(format!("'eval' failed to compile {}: {}", what, e.message))
+        })?;
+        self.functions.extend(functions);
+
+        let saved_bytecode = std::mem::replace(&mut self.current_bytecode, Rc::new(main));
+        let saved_ip = self.instruction_pointer;
+        let saved_depth = self.value_stack.len();
+        self.instruction_pointer = 0;
+        let result = self.run_nested();
+        self.current_bytecode = saved_bytecode;
+        self.instruction_pointer = saved_ip;
+        self.halted = false;
+        result?;
+
+        // Code of only definitions leaves nothing, which evaluates to '()
+        let value = if self.value_stack.len() > saved_depth {
+            self.value_stack.pop().unwrap()
+        } else {
+            Value::List(List::Nil)
+        };
+        self.value_stack.truncate(saved_depth);
+        self.value_stack.push(value);
+        Ok(())
+    }
+
+    /// Call a function or closure from native code and return its result. It
+    /// runs to completion in a nested run, as eval's code does, so it can
+    /// recurse, allocate and raise errors freely.
+    fn call_nested(&mut self, callable: &Value, args: &[Value]) -> Result<Value, RuntimeError> {
+        let saved_bytecode = std::mem::replace(&mut self.current_bytecode, Rc::new(vec![Instruction::CallClosure(args.len())]));
+        let saved_ip = self.instruction_pointer;
+        self.value_stack.push(callable.clone());
+        self.value_stack.extend(args.iter().cloned());
+
+        self.instruction_pointer = 0;
+        let result = self.run_nested();
+
+        self.current_bytecode = saved_bytecode;
+        self.instruction_pointer = saved_ip;
+        self.halted = false;
+        result?;
+        self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow after a nested call".to_string()))
+    }
+
+    /// Start forcing the value on top of the stack, for the force function. A
+    /// value that isn't a promise, or a promise forced already, is pushed with
+    /// true. Otherwise the promise is marked Forcing and its thunk is pushed with
+    /// false, for force to call and then store the result with ForceEnd.
+    fn force_begin(&mut self) -> Result<(), RuntimeError> {
+        let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ForceBegin".to_string()))?;
+        let promise = match &value {
+            Value::Promise(promise) => promise.clone(),
+            _ => {
+                self.value_stack.push(value);
+                self.value_stack.push(Value::Boolean(true));
+                return Ok(());
+            }
+        };
+        let thunk = match &*promise.borrow() {
+            Promise::Forced(result) => {
+                self.value_stack.push(result.clone());
+                self.value_stack.push(Value::Boolean(true));
+                return Ok(());
+            }
+            Promise::Delayed(thunk) => thunk.clone(),
+            Promise::Forcing(thunk) => {
+                // Still Forcing after an error unwound its force is fine: only a
+                // force of this promise still running under this one makes it re-entrant
+                let outer_frames = &self.call_stack[..self.call_stack.len().saturating_sub(1)];
+                let running = outer_frames.iter().any(|frame| {
+                    frame.function_name == "force"
+                        && matches!(frame.locals.first(), Some(Value::Promise(p)) if Rc::ptr_eq(p, &promise))
+                });
+                if running {
+                    return Err(RuntimeError::new(
+                        "Re-entrant force: the promise's expression forced the promise itself, so its value depends on itself".to_string(),
+                    ));
+                }
+                thunk.clone()
+            }
+        };
+        *promise.borrow_mut() = Promise::Forcing(thunk.clone());
+        self.value_stack.push(thunk);
+        self.value_stack.push(Value::Boolean(false));
+        Ok(())
+    }
+
+    /// Pop two operands, apply a checked or wrapping builtin and push the result
+    fn fixed_width_instruction(&mut self, name: &str) -> Result<(), RuntimeError> {
+        let b = self.value_stack.pop().ok_or_else(|| RuntimeError::new(format!("Stack underflow in '{}'", name)))?;
+        let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new(format!("Stack underflow in '{}'", name)))?;
+        let result = Self::fixed_width_arith(name, &a, &b)?;
+        self.value_stack.push(result);
+        self.instruction_pointer += 1;
+        Ok(())
+    }
+
+    /// checked-add/sub/mul and wrapping-add/sub/mul: 64-bit integer arithmetic
+    /// that never promotes to a bignum. The checked ones fail when the result
+    /// doesn't fit; the wrapping ones reduce it modulo 2^64 as two's complement,
+    /// the way hashes and PRNGs expect. A bignum operand is reduced the same way
+    /// by the wrapping ones and is an overflow for the checked ones.
+    pub(crate) fn fixed_width_arith(name: &str, a: &Value, b: &Value) -> Result<Value, RuntimeError> {
+        let (x, y) = match (a.as_bigint(), b.as_bigint()) {
+            (Some(x), Some(y)) => (x, y),
+            _ => {
+                return Err(RuntimeError::new(format!(
+                    "Type error: '{}' expects two integers, got {} and {}",
+                    name,
+                    Self::type_name(a),
+                    Self::type_name(b)
+                )));
+            }
+        };
+        if let Some(op) = name.strip_prefix("wrapping-") {
+            let (x, y) = (Self::wrap_to_i64(&x), Self::wrap_to_i64(&y));
+            let result = match op {
+                "add" => x.wrapping_add(y),
+                "sub" => x.wrapping_sub(y),
+                _ => x.wrapping_mul(y),
+            };
+            return Ok(Value::Integer(result));
+        }
+        let result = match (x.to_i64(), y.to_i64()) {
+            (Some(x), Some(y)) => match name {
+                "checked-add" => x.checked_add(y),
+                "checked-sub" => x.checked_sub(y),
+                _ => x.checked_mul(y),
+            },
+            _ => None,
+        };
+        result.map(Value::Integer).ok_or_else(|| {
+            RuntimeError::with_suggestion(
+                format!(
+                    "Integer overflow in ({} {} {}): the result doesn't fit in 64 bits",
+                    name,
+                    x.to_string_radix(10),
+                    y.to_string_radix(10)
+                ),
+                format!(
+                    "Use ({} a b) to get a bignum, or (wrapping-{} a b) for arithmetic modulo 2^64",
+                    match name {
+                        "checked-add" => "+",
+                        "checked-sub" => "-",
+                        _ => "*",
+                    },
+                    &name["checked-".len()..]
+                ),
+            )
+        })
+    }
+
+    /// Low 64 bits of `n` in two's complement
+    fn wrap_to_i64(n: &BigInt) -> i64 {
+        let limbs = n.limbs();
+        let low = limbs.first().copied().unwrap_or(0) as u64 | (limbs.get(1).copied().unwrap_or(0) as u64) << 32;
+        let low = low as i64;
+        if n.is_negative() { low.wrapping_neg() } else { low }
+    }
+
+    /// Pop the operands of a bitwise builtin, apply it and push the result
+    fn bitwise_instruction(&mut self, name: &str) -> Result<(), RuntimeError> {
+        let b = match name {
+            "bit-not" => None,
+            _ => Some(self.value_stack.pop().ok_or_else(|| RuntimeError::new(format!("Stack underflow in '{}'", name)))?),
+        };
+        let a = self.value_stack.pop().ok_or_else(|| RuntimeError::new(format!("Stack underflow in '{}'", name)))?;
+        let result = Self::bitwise_arith(name, &a, b.as_ref())?;
+        self.value_stack.push(result);
+        self.instruction_pointer += 1;
+        Ok(())
+    }
+
+    /// bit-and, bit-or, bit-xor and bit-not treat integers as two's complement
+    /// of unlimited width, so negative numbers have infinitely many leading
+    /// ones. shift-left multiplies by 2^count, promoting to a bignum like *;
+    /// shift-right is arithmetic, dividing by 2^count rounded down. `b` is the
+    /// second operand, None for bit-not.
+    pub(crate) fn bitwise_arith(name: &str, a: &Value, b: Option<&Value>) -> Result<Value, RuntimeError> {
+        let Some(b) = b else {
+            return match a {
+                Value::Integer(x) => Ok(Value::Integer(!x)),
+                Value::BigInt(x) => Ok(Value::from_bigint(x.neg().sub(&BigInt::from_i64(1)))),
+                _ => Err(RuntimeError::new(format!(
+                    "Type error: 'bit-not' expects an integer, got {}",
+                    Self::type_name(a)
+                ))),
+            };
+        };
+        let (x, y) = match (a.as_bigint(), b.as_bigint()) {
+            (Some(x), Some(y)) => (x, y),
+            _ => {
+                return Err(RuntimeError::new(format!(
+                    "Type error: '{}' expects two integers, got {} and {}",
+                    name,
+                    Self::type_name(a),
+                    Self::type_name(b)
+                )));
+            }
+        };
+        if name.starts_with("shift-") {
+            if y.is_negative() {
+                return Err(RuntimeError::new(format!(
+                    "'{}' can't shift by a negative count: {}",
+                    name,
+                    y.to_string_radix(10)
+                )));
+            }
+            // A count past usize is too many bits to hold for a left shift and
+            // leaves only the sign for a right shift
+            let count = y.to_i64().and_then(|n| usize::try_from(n).ok());
+            if name == "shift-right" {
+                if let Value::Integer(n) = a {
+                    return Ok(Value::Integer(n >> count.unwrap_or(63).min(63)));
+                }
+                let result = match count {
+                    Some(count) => x.shift_right(count),
+                    None => BigInt::from_i64(if x.is_negative() { -1 } else { 0 }),
+                };
+                return Ok(Value::from_bigint(result));
+            }
+            if x.is_zero() {
+                return Ok(Value::Integer(0));
+            }
+            return match count {
+                Some(count) => Ok(Value::from_bigint(x.shift_left(count))),
+                None => Err(RuntimeError::new(format!(
+                    "'shift-left' can't shift by {} bits",
+                    y.to_string_radix(10)
+                ))),
+            };
+        }
+        if let (Value::Integer(x), Value::Integer(y)) = (a, b) {
+            return Ok(Value::Integer(match name {
+                "bit-and" => x & y,
+                "bit-or" => x | y,
+                _ => x ^ y,
+            }));
+        }
+        let op: fn(u32, u32) -> u32 = match name {
+            "bit-and" => |p, q| p & q,
+            "bit-or" => |p, q| p | q,
+            _ => |p, q| p ^ q,
+        };
+        Ok(Value::from_bigint(x.bitwise(&y, op)))
+    }
+
+    /// Numeric comparison once a bignum is involved, same contract as bigint_arith
+    fn bigint_compare(a: &Value, b: &Value, pred: fn(Ordering) -> bool) -> Option<bool> {
+        let ordering = match (a, b) {
+            (Value::BigInt(x), Value::Float(y)) => x.to_f64().partial_cmp(y),
+            (Value::Float(x), Value::BigInt(y)) => x.partial_cmp(&y.to_f64()),
+            (Value::BigInt(_), _) | (_, Value::BigInt(_)) => Some(a.as_bigint()?.cmp(&b.as_bigint()?)),
+            _ => return None,
+        };
+        // NaN compares false with everything
+        Some(ordering.map_or(false, pred))
+    }
+
+    fn open_port(path: &Value, name: &str, open: fn(&str) -> std::io::Result<Port>) -> Result<Value, RuntimeError> {
+        match path {
+            Value::String(path_str) => {
+                let port = open(path_str)
+                    .map_err(|e| RuntimeError::new(format!("'{}' failed to open '{}': {}", name, path_str, e)))?;
+                Ok(Value::Port(Rc::new(RefCell::new(port))))
+            }
+            _ => Err(RuntimeError::new(format!(
+                "Type error: '{}' expects a string path, got {}",
+                name,
+                Self::type_name(path)
+            ))),
+        }
+    }
+
+    fn char_arg(value: &Value, name: &str) -> Result<char, RuntimeError> {
+        match value {
+            Value::Char(c) => Ok(*c),
+            _ => Err(RuntimeError::new(format!(
+                "Type error: '{}' expects a char, got {}",
+                name,
+                Self::type_name(value)
+            ))),
+        }
+    }
+
+    fn port_arg(value: &Value, name: &str) -> Result<Rc<RefCell<Port>>, RuntimeError> {
+        match value {
+            Value::Port(port) => Ok(port.clone()),
+            _ => Err(RuntimeError::new(format!(
+                "Type error: '{}' expects a port, got {}",
+                name,
+                Self::type_name(value)
+            ))),
+        }
+    }
+
+    fn socket_arg(value: &Value, name: &str) -> Result<Rc<RefCell<std::net::TcpStream>>, RuntimeError> {
+        match value {
+            Value::TcpStream(stream) => Ok(stream.clone()),
+            _ => Err(RuntimeError::new(format!(
+                "Type error: '{}' expects a tcp-stream, got {}",
+                name,
+                Self::type_name(value)
+            ))),
+        }
+    }
+
+    // map-set! and hash-set!: pop value, key and map, store the value under the
+    // key in the map itself and push the map
+    fn map_set_in_place(&mut self) -> Result<(), RuntimeError> {
+        let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapSetInPlace".to_string()))?;
+        let key = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapSetInPlace".to_string()))?;
+        let map = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in HashMapSetInPlace".to_string()))?;
+        let Value::HashMap(entries) = &map else {
+            return Err(RuntimeError::new(format!(
+                "Type error: 'map-set!' expects a hashmap and a key, got {} and {}",
+                Self::type_name(&map),
+                Self::type_name(&key)
+            )));
+        };
+        entries.borrow_mut().insert(Self::map_key(&key)?, value);
+        self.value_stack.push(map);
+        Ok(())
+    }
+
+    // Check a vector-set or vector-set! target and index, giving the index to store at
+    fn vector_index(vec: &Value, index: &Value, name: &str) -> Result<usize, RuntimeError> {
+        match (vec, index) {
+            (Value::Vector(items), Value::Integer(idx)) => {
+                let len = items.borrow().len();
+                if *idx < 0 || *idx as usize >= len {
+                    return Err(RuntimeError::new(format!(
+                        "'{}' index {} out of bounds for vector of length {}",
+                        name, idx, len
+                    )));
+                }
+                Ok(*idx as usize)
+            }
+            _ => Err(RuntimeError::new(format!(
+                "Type error: '{}' expects a vector, an integer, and a value, got {} and {}",
+                name,
+                Self::type_name(vec),
+                Self::type_name(index)
+            ))),
+        }
+    }
+
+    // The radix argument of number->string and string->number
+    fn conversion_radix(radix: &Value, name: &str) -> Result<u32, RuntimeError> {
+        match radix {
+            Value::Integer(r @ (2 | 8 | 10 | 16)) => Ok(*r as u32),
+            other => Err(RuntimeError::new(format!(
+                "Type error: '{}' radix must be 2, 8, 10 or 16, got {}",
+                name,
+                Self::format_diagnostic(other)
+            ))),
+        }
+    }
+
+    fn number_to_string(value: &Value, radix: u32) -> Result<Value, RuntimeError> {
+        let text = match value {
+            Value::Integer(n) if radix == 10 => n.to_string(),
+            Value::Integer(n) => BigInt::from_i64(*n).to_string_radix(radix),
+            Value::BigInt(n) => n.to_string_radix(radix),
+            Value::Float(f) if radix == 10 => format_float(*f),
+            Value::Float(_) => {
+                return Err(RuntimeError::new(format!(
+                    "Type error: 'number->string' can only write floats in radix 10, got radix {}",
+                    radix
+                )));
+            }
+            _ => {
+                return Err(RuntimeError::new(format!(
+                    "Type error: 'number->string' expects a number, got {}",
+                    Self::type_name(value)
+                )));
+            }
+        };
+        Ok(Value::String(Arc::new(text)))
+    }
+
+    // Malformed text, surrounding whitespace and integers outside the i64 range all give nil
+    fn string_to_number(value: &Value, radix: u32) -> Result<Value, RuntimeError> {
+        match value {
+            Value::String(s) => Ok(parse_number(s, radix).unwrap_or(Value::List(List::Nil))),
+            _ => Err(RuntimeError::new(format!(
+                "Type error: 'string->number' expects a string, got {}",
+                Self::type_name(value)
+            ))),
+        }
+    }
+
+    // The value a keyword argument list gives `keyword`. CheckKeywords has made
+    // sure the list alternates keywords and values.
+    fn keyword_argument(args: &Value, keyword: &str) -> Option<Value> {
+        let mut items = args.as_list()?.iter();
+        while let (Some(key), Some(value)) = (items.next(), items.next()) {
+            if key.as_symbol() == Some(keyword) {
+                return Some(value.clone());
+            }
+        }
+        None
+    }
+
+    pub(crate) fn type_name(value: &Value) -> &str {
         match value {
             Value::Integer(_) => "integer",
+            Value::BigInt(_) => "integer",
             Value::Float(_) => "float",
             Value::Boolean(_) => "boolean",
+            Value::Char(_) => "char",
             Value::List(_) => "list",
             Value::Symbol(_) => "symbol",
             Value::String(_) => "string",
@@ -4119,113 +6236,658 @@ impl VM {
             Value::TcpStream(_) => "tcp-stream",
             Value::SharedTcpListener(_) => "shared-tcp-listener",
             Value::Pointer(_) => "pointer",
+            Value::Cell(_) => "cell",
+            Value::Struct(data) => data.name.as_str(),
+            Value::Port(_) => "port",
+            Value::Promise(_) => "promise",
+            Value::Task(_) => "task",
+            Value::Channel(_) => "channel",
+        }
+    }
+
+    /// A value as write shows it: numbers, strings, chars, symbols and the
+    /// lists, vectors and maps of them read back as equal values
+    pub(crate) fn format_value(value: &Value) -> String {
+        printer::print_value(value, &PrintOptions::write())
+    }
+
+    /// A value as an error message, the tracer or the debugger shows it: as write
+    /// does, cut down to the bounded printer's depth and length
+    pub(crate) fn format_diagnostic(value: &Value) -> String {
+        printer::print_value(value, &PrintOptions::bounded())
+    }
+
+    // pp: the value cut down to the depth and length given and broken over lines
+    // to fit, then a newline
+    fn pretty_print_instruction(&mut self) -> Result<(), RuntimeError> {
+        let max_length = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in PrettyPrint".to_string()))?;
+        let max_depth = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in PrettyPrint".to_string()))?;
+        let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in PrettyPrint".to_string()))?;
+        let limit = |limit: &Value, name: &str| match limit {
+            Value::Integer(n) if *n >= 0 => Ok(*n as usize),
+            other => Err(RuntimeError::new(format!(
+                "'pp' expects a non-negative integer {}, got {}",
+                name,
+                Self::format_diagnostic(other)
+            ))),
+        };
+        let options = PrintOptions::bounded().with_limits(Some(limit(&max_depth, "depth")?), Some(limit(&max_length, "length")?));
+        println!("{}", printer::pretty_print(&value, &options, printer::LINE_WIDTH));
+        self.value_stack.push(value);
+        self.instruction_pointer += 1;
+        Ok(())
+    }
+
+    // The running task's part of the VM state, taken out to park the task
+    fn take_task_context(&mut self) -> TaskContext {
+        TaskContext {
+            value_stack: std::mem::take(&mut self.value_stack),
+            call_stack: std::mem::take(&mut self.call_stack),
+            bytecode: std::mem::take(&mut self.current_bytecode),
+            instruction_pointer: self.instruction_pointer,
+            handlers: std::mem::take(&mut self.handlers),
+            trace_depths: std::mem::take(&mut self.trace_depths),
+        }
+    }
+
+    fn restore_task_context(&mut self, context: TaskContext) {
+        self.value_stack = context.value_stack;
+        self.call_stack = context.call_stack;
+        self.current_bytecode = context.bytecode;
+        self.instruction_pointer = context.instruction_pointer;
+        self.handlers = context.handlers;
+        self.trace_depths = context.trace_depths;
+    }
+
+    // Whether the running task can step aside for another now: only in the
+    // outermost run, and only when some other task could go on
+    fn can_switch_tasks(&self) -> bool {
+        self.run_depth == 0 && self.tasks.others_can_run()
+    }
+
+    // Park the running task in `state`, its instruction pointer already where it
+    // resumes, and run the next one. `polled` marks a task back in the queue
+    // only to try a socket again.
+    fn park_task(&mut self, state: TaskState, polled: bool) -> Result<(), RuntimeError> {
+        let task = self.tasks.current();
+        let queued = matches!(state, TaskState::Runnable | TaskState::Sleeping(_));
+        {
+            let mut parked = task.borrow_mut();
+            parked.context = Some(self.take_task_context());
+            parked.state = state;
+        }
+        if queued {
+            self.tasks.enqueue(task);
         }
+        self.run_next_task(polled)
     }
 
-    fn format_value(value: &Value) -> String {
+    fn run_next_task(&mut self, polled: bool) -> Result<(), RuntimeError> {
+        match self.tasks.next_task(polled) {
+            Some(task) => {
+                let context = task.borrow_mut().context.take().expect("a parked task keeps its context");
+                self.restore_task_context(context);
+                Ok(())
+            }
+            None => self.deadlock(),
+        }
+    }
+
+    // End the running spawned task and run the next one, waking the tasks that
+    // waited for it with its result
+    fn finish_task(&mut self, state: TaskState) -> Result<(), RuntimeError> {
+        let task = self.tasks.current();
+        task.borrow_mut().state = state;
+        let result = task.borrow().result().cloned().unwrap_or(Value::List(List::Nil));
+        for joiner in self.tasks.finish(&task) {
+            joiner.borrow_mut().wake_with(result.clone());
+            self.tasks.enqueue(joiner);
+        }
+        // Drop what the task held now, not when the next one's state replaces it
+        drop(self.take_task_context());
+        self.run_next_task(false)
+    }
+
+    // Every task is waiting on another, so none ever will stop waiting. The main
+    // task gives up its wait and gets the error, raised where it waited.
+    fn deadlock(&mut self) -> Result<(), RuntimeError> {
+        let main = self.tasks.main_task().expect("the main task is live until the run ends");
+        let state = std::mem::replace(&mut main.borrow_mut().state, TaskState::Running);
+        match state {
+            TaskState::Blocked(Wait::Send(channel)) => channel.borrow_mut().senders.retain(|(task, _)| !Rc::ptr_eq(task, &main)),
+            TaskState::Blocked(Wait::Recv(channel)) => channel.borrow_mut().receivers.retain(|task| !Rc::ptr_eq(task, &main)),
+            TaskState::Blocked(Wait::Task(task)) => task.borrow_mut().joiners.retain(|joiner| !Rc::ptr_eq(joiner, &main)),
+            _ => {}
+        }
+        let context = main.borrow_mut().context.take().expect("a parked task keeps its context");
+        self.tasks.set_current(main);
+        self.restore_task_context(context);
+        self.instruction_pointer -= 1;
+        Err(RuntimeError::new("Deadlock: every task is waiting on a channel or another task".to_string()))
+    }
+
+    // Park the running task on `wait`, resuming after the instruction that waits
+    fn block_task(&mut self, wait: Wait, name: &str) -> Result<(), RuntimeError> {
+        if self.run_depth > 0 {
+            return Err(RuntimeError::new(format!("'{}' can't wait inside load, require or eval", name)));
+        }
+        self.instruction_pointer += 1;
+        self.park_task(TaskState::Blocked(wait), false)
+    }
+
+    fn task_arg(&mut self, name: &str) -> Result<TaskRef, RuntimeError> {
+        match self.value_stack.pop() {
+            Some(Value::Task(task)) => Ok(task),
+            Some(other) => Err(RuntimeError::new(format!(
+                "Type error: '{}' expects a task, got {}",
+                name,
+                Self::type_name(&other)
+            ))),
+            None => Err(RuntimeError::new(format!("Stack underflow in '{}'", name))),
+        }
+    }
+
+    fn channel_arg(value: &Value, name: &str) -> Result<Rc<RefCell<Channel>>, RuntimeError> {
         match value {
-            Value::Integer(n) => n.to_string(),
-            Value::Float(f) => {
-                // Format float nicely - show decimal point even for whole numbers
-                if f.fract() == 0.0 && f.is_finite() {
-                    format!("{}.0", f)
-                } else {
-                    f.to_string()
-                }
+            Value::Channel(channel) => Ok(channel.clone()),
+            _ => Err(RuntimeError::new(format!(
+                "Type error: '{}' expects a channel, got {}",
+                name,
+                Self::type_name(value)
+            ))),
+        }
+    }
+
+    fn spawn_task(&mut self) -> Result<(), RuntimeError> {
+        let thunk = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Spawn".to_string()))?;
+        if !matches!(thunk, Value::Closure(_) | Value::Function(_)) {
+            return Err(RuntimeError::new(format!(
+                "Type error: 'spawn' expects a function of no arguments, got {}",
+                Self::type_name(&thunk)
+            )));
+        }
+        // The task applies the thunk to no arguments and finishes with its value
+        let task = self.tasks.spawn(TaskContext {
+            value_stack: vec![thunk, Value::List(List::Nil)],
+            bytecode: Rc::new(vec![Instruction::Apply, Instruction::TaskExit]),
+            ..TaskContext::default()
+        });
+        self.value_stack.push(Value::Task(task));
+        self.instruction_pointer += 1;
+        Ok(())
+    }
+
+    fn yield_task(&mut self) -> Result<(), RuntimeError> {
+        self.value_stack.push(Value::Boolean(true));
+        self.instruction_pointer += 1;
+        if self.can_switch_tasks() {
+            self.park_task(TaskState::Runnable, false)?;
+        }
+        Ok(())
+    }
+
+    fn sleep_task(&mut self) -> Result<(), RuntimeError> {
+        let ms = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Sleep".to_string()))?;
+        let duration = match ms {
+            Value::Integer(ms) if ms >= 0 => std::time::Duration::from_millis(ms as u64),
+            _ => {
+                return Err(RuntimeError::new(format!(
+                    "'sleep' expects a non-negative number of milliseconds, got {}",
+                    Self::format_diagnostic(&ms)
+                )));
             }
-            Value::Boolean(b) => b.to_string(),
-            Value::List(list) => {
-                let formatted_items: Vec<String> = list
-                    .iter()
-                    .map(|v| Self::format_value(v))
-                    .collect();
-                format!("({})", formatted_items.join(" "))
+        };
+        self.value_stack.push(Value::Boolean(true));
+        self.instruction_pointer += 1;
+        if self.can_switch_tasks() {
+            self.park_task(TaskState::Sleeping(Instant::now() + duration), false)?;
+        } else {
+            std::thread::sleep(duration);
+        }
+        Ok(())
+    }
+
+    fn channel_send(&mut self) -> Result<(), RuntimeError> {
+        let value = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ChanSend".to_string()))?;
+        let channel = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ChanSend".to_string()))?;
+        let channel = Self::channel_arg(&channel, "chan-send")?;
+        let receiver = channel.borrow_mut().receivers.pop_front();
+        if let Some(receiver) = receiver {
+            receiver.borrow_mut().wake_with(value);
+            self.tasks.enqueue(receiver);
+            self.value_stack.push(Value::Boolean(true));
+            self.instruction_pointer += 1;
+            return Ok(());
+        }
+        if self.run_depth == 0 {
+            let task = self.tasks.current();
+            channel.borrow_mut().senders.push_back((task, value));
+        }
+        self.block_task(Wait::Send(channel), "chan-send")
+    }
+
+    fn channel_recv(&mut self) -> Result<(), RuntimeError> {
+        let channel = self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in ChanRecv".to_string()))?;
+        let channel = Self::channel_arg(&channel, "chan-recv")?;
+        let sender = channel.borrow_mut().senders.pop_front();
+        if let Some((sender, value)) = sender {
+            sender.borrow_mut().wake_with(Value::Boolean(true));
+            self.tasks.enqueue(sender);
+            self.value_stack.push(value);
+            self.instruction_pointer += 1;
+            return Ok(());
+        }
+        if self.run_depth == 0 {
+            let task = self.tasks.current();
+            channel.borrow_mut().receivers.push_back(task);
+        }
+        self.block_task(Wait::Recv(channel), "chan-recv")
+    }
+
+    fn task_result(&mut self) -> Result<(), RuntimeError> {
+        let task = self.task_arg("task-result")?;
+        let result = task.borrow().result().cloned();
+        if let Some(result) = result {
+            self.value_stack.push(result);
+            self.instruction_pointer += 1;
+            return Ok(());
+        }
+        let current = self.tasks.current();
+        if Rc::ptr_eq(&task, &current) {
+            return Err(RuntimeError::new("'task-result' can't wait for the task running it".to_string()));
+        }
+        if self.run_depth == 0 {
+            task.borrow_mut().joiners.push(current);
+        }
+        self.block_task(Wait::Task(task), "task-result")
+    }
+
+    // With other tasks to run, a socket instruction whose socket has nothing
+    // ready yet goes back to the run queue to try again, rather than block them
+    fn wait_for_socket(&mut self) -> Result<(), RuntimeError> {
+        if self.tasks.idle_poll() {
+            // Every task is waiting on a socket: give them time to get something
+            std::thread::sleep(std::time::Duration::from_millis(1));
+        }
+        self.park_task(TaskState::Runnable, true)
+    }
+
+    // Accept on `listener`, or None when another task could run and no
+    // connection is waiting yet
+    fn accept_connection(&self, listener: &std::net::TcpListener) -> std::io::Result<Option<std::net::TcpStream>> {
+        if !self.can_switch_tasks() {
+            return listener.accept().map(|(stream, _addr)| Some(stream));
+        }
+        listener.set_nonblocking(true)?;
+        let accepted = listener.accept();
+        listener.set_nonblocking(false)?;
+        match accepted {
+            Ok((stream, _addr)) => {
+                stream.set_nonblocking(false)?;
+                Ok(Some(stream))
+            }
+            Err(e) if e.kind() == std::io::ErrorKind::WouldBlock => Ok(None),
+            Err(e) => Err(e),
+        }
+    }
+
+    // Whether the stream `depth` values below the top of the stack has nothing
+    // to read yet, while another task could run. Anything else, a closed peer
+    // or an error included, is left for the read itself.
+    fn socket_would_block(&self, depth: usize) -> bool {
+        if !self.can_switch_tasks() {
+            return false;
+        }
+        let Some(Value::TcpStream(stream)) = self.value_stack.iter().rev().nth(depth) else {
+            return false;
+        };
+        let stream = stream.borrow();
+        if stream.set_nonblocking(true).is_err() {
+            return false;
+        }
+        let peeked = stream.peek(&mut [0u8; 1]);
+        let _ = stream.set_nonblocking(false);
+        matches!(peeked, Err(e) if e.kind() == std::io::ErrorKind::WouldBlock)
+    }
+
+    /// A value as display and print show it, and format strings splice it in:
+    /// strings and chars as their text, at any depth
+    fn value_to_display_string(value: &Value) -> String {
+        printer::print_value(value, &PrintOptions::display())
+    }
+
+    pub fn run(&mut self) -> Result<(), RuntimeError> {
+        // Choose the loop once, so the plain dispatch loop never checks for a debugger,
+        // profiler or call tracer
+        let result = if let Some(debugger) = self.debugger.take() {
+            self.run_with_debugger(debugger)
+        } else if self.profiler.is_some() || self.call_tracer.is_some() {
+            let profiler = self.profiler.take();
+            let tracer = self.call_tracer.take();
+            self.run_instrumented(profiler, tracer)
+        } else {
+            self.run_instructions()
+        };
+
+        // The program called exit: drop everything it was in the middle of, so
+        // what its frames held (output ports, say) is closed, and stop cleanly
+        if self.exit_code.is_some() {
+            self.value_stack.clear();
+            self.call_stack.clear();
+            self.handlers.clear();
+            self.halted = true;
+            return Ok(());
+        }
+
+        // Capture stack trace on error
+        result.map_err(|mut error| {
+            // If the error doesn't already have a call stack, add it
+            if error.call_stack.is_empty() {
+                error.call_stack = self.get_stack_trace();
+                error.call_sites = self.get_call_sites();
             }
-            Value::Symbol(s) => s.to_string(),
-            Value::String(s) => format!("\"{}\"", s),
-            Value::Function(name) => format!("<function {}>", name),
-            Value::Closure(closure_data) => {
-                format!("<closure/{}>", closure_data.params.len())
+            if error.location.is_none() {
+                let function = self.call_stack.last().map(|frame| frame.function_name.as_str());
+                error.location = self.source_location(function, self.instruction_pointer);
             }
-            Value::HashMap(map) => {
-                let mut items: Vec<String> = map.iter()
-                    .map(|(k, v)| format!("{} {}", Self::format_value(&Value::String(Arc::new(k.clone()))), Self::format_value(v)))
-                    .collect();
-                items.sort(); // Sort for consistent output
-                format!("{{{}}}", items.join(" "))
+            error
+        })
+    }
+
+    fn run_instructions(&mut self) -> Result<(), RuntimeError> {
+        while !self.halted {
+            self.execute_one_instruction()?;
+        }
+        Ok(())
+    }
+
+    // The debugger is detached while it runs, so it can inspect and halt the VM
+    // (and nested runs from load/require execute without it)
+    fn run_with_debugger(&mut self, mut debugger: Debugger) -> Result<(), RuntimeError> {
+        let mut result = Ok(());
+        while !self.halted {
+            debugger.before_instruction(self);
+            if self.halted {
+                break;
             }
-            Value::Vector(items) => {
-                let formatted_items: Vec<String> = items
-                    .iter()
-                    .map(|v| Self::format_value(v))
-                    .collect();
-                format!("[{}]", formatted_items.join(" "))
+            result = self.execute_one_instruction();
+            if result.is_err() {
+                break;
             }
-            Value::TcpListener(_) => "<tcp-listener>".to_string(),
-            Value::TcpStream(_) => "<tcp-stream>".to_string(),
-            Value::SharedTcpListener(_) => "<shared-tcp-listener>".to_string(),
-            Value::Pointer(p) => format!("<pointer 0x{:x}>", p),
         }
+        self.debugger = Some(debugger);
+        result
     }
 
-    /// Format value for display in format strings (strings without quotes)
-    fn value_to_display_string(value: &Value) -> String {
-        match value {
-            Value::Integer(n) => n.to_string(),
-            Value::Float(f) => {
-                if f.fract() == 0.0 && f.is_finite() {
-                    format!("{}.0", f)
-                } else {
-                    f.to_string()
+    // The profiler and call tracer are detached while they run too, so a nested run
+    // from load/require counts as part of the instruction that started it
+    fn run_instrumented(&mut self, mut profiler: Option<Profiler>, mut tracer: Option<CallTracer>) -> Result<(), RuntimeError> {
+        if let Some(profiler) = &mut profiler {
+            profiler.start(&self.call_stack);
+        }
+        if let Some(tracer) = &mut tracer {
+            tracer.start(&self.call_stack);
+        }
+        let mut result = Ok(());
+        while !self.halted {
+            let tail_call = match self.current_bytecode.get(self.instruction_pointer) {
+                Some(instruction) => {
+                    if let Some(profiler) = &mut profiler {
+                        profiler.count_instruction(instruction);
+                    }
+                    if let Some(tracer) = &mut tracer {
+                        tracer.before_instruction(instruction);
+                    }
+                    matches!(instruction, Instruction::TailCall(..) | Instruction::TailCallCached(..) | Instruction::TailCallClosure(_) | Instruction::TailApply)
                 }
+                None => false,
+            };
+            result = self.execute_one_instruction();
+            if result.is_err() {
+                break;
             }
-            Value::Boolean(b) => b.to_string(),
-            Value::String(s) => s.to_string(), // No quotes for format strings
-            Value::Symbol(s) => s.to_string(),
-            Value::List(list) => {
-                let formatted_items: Vec<String> = list
-                    .iter()
-                    .map(|v| Self::value_to_display_string(v))
-                    .collect();
-                format!("({})", formatted_items.join(" "))
+            // A tail call that reused the frame starts the callee at its first instruction
+            let reused_frame = tail_call && self.instruction_pointer == 0;
+            if let Some(profiler) = &mut profiler {
+                profiler.sync_calls(&self.call_stack, reused_frame);
+            }
+            if let Some(tracer) = &mut tracer {
+                tracer.sync_calls(&self.call_stack, &self.value_stack, reused_frame);
+            }
+        }
+        if let Some(profiler) = &mut profiler {
+            profiler.finish();
+        }
+        self.profiler = profiler;
+        self.call_tracer = tracer;
+        result
+    }
+
+    /// Push a frame calling a function or closure with `args`. With `multiple_values`
+    /// set the callee returns every value it produces, followed by their count.
+    /// Bytecode cached in `slot` for a call to `name`, resolving the name again
+    /// if the function table changed since it was cached
+    #[inline(always)]
+    fn cached_callee(&mut self, name: &str, slot: usize) -> Result<Rc<Vec<Instruction>>, RuntimeError> {
+        if let Some(bytecode) = self.call_cache.cached(slot, self.functions.generation()) {
+            return Ok(bytecode.clone());
+        }
+        self.call_cache.resolve_slot(slot, name, &self.functions)
+            .ok_or_else(|| RuntimeError::new(format!("Undefined function '{}'", name)))
+    }
+
+    // Call a function by name, with its arguments on the value stack
+    fn call_function(&mut self, fn_name: String, arg_count: usize, fn_bytecode: Rc<Vec<Instruction>>) -> Result<(), RuntimeError> {
+        // Pop arguments from value stack in reverse order
+        let mut args = Vec::new();
+        for _ in 0..arg_count {
+            args.push(self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in Call".to_string()))?);
+        }
+        args.reverse();
+
+        // Create new frame with return bytecode and function name for stack traces
+        let frame = Frame {
+            return_address: self.instruction_pointer + 1,
+            locals: args,
+            return_bytecode: self.current_bytecode.clone(),
+            function_name: fn_name,
+            captured: Vec::new(), // Regular functions don't have captured variables
+            stack_base: self.value_stack.len(), // Current stack top is base for this function
+            multiple_values: false,
+        };
+        self.push_frame(frame)?;
+
+        // Switch to function bytecode
+        self.current_bytecode = fn_bytecode;
+        self.instruction_pointer = 0;
+        Ok(())
+    }
+
+    // Tail call a function by name, reusing the current frame
+    fn tail_call_function(&mut self, fn_name: String, arg_count: usize, fn_bytecode: Rc<Vec<Instruction>>) -> Result<(), RuntimeError> {
+        // Pop arguments from value stack in reverse order
+        let mut args = Vec::new();
+        for _ in 0..arg_count {
+            args.push(self.value_stack.pop().ok_or_else(|| RuntimeError::new("Stack underflow in TailCall".to_string()))?);
+        }
+        args.reverse();
+
+        // Reuse current frame instead of pushing a new one
+        // This is the key to tail call optimization!
+        if let Some(frame) = self.call_stack.last_mut() {
+            // Clear the value_stack back to this frame's base
+            // This is crucial - any let bindings or temporary values should be removed
+            self.value_stack.truncate(frame.stack_base);
+
+            // Replace the locals (arguments) in the current frame
+            frame.locals = args;
+            // Update function name for stack traces
+            frame.function_name = fn_name;
+            // The target may be a different function (mutual recursion), so drop
+            // any closure environment and loop state belonging to the caller
+            frame.captured = Vec::new();
+            // Keep the same return address, return bytecode, and stack_base
+        } else {
+            // No frame exists (top-level call), treat as regular call
+            let frame = Frame {
+                return_address: self.instruction_pointer + 1,
+                locals: args,
+                return_bytecode: self.current_bytecode.clone(),
+                function_name: fn_name,
+                captured: Vec::new(),
+                stack_base: self.value_stack.len(), // Current stack top is base for this function
+                multiple_values: false,
+            };
+            self.push_frame(frame)?;
+        }
+
+        // Switch to function bytecode
+        self.current_bytecode = fn_bytecode;
+        self.instruction_pointer = 0;
+        Ok(())
+    }
+
+    fn push_call_frame(&mut self, callable: &Value, args: Vec<Value>, multiple_values: bool, context: &str) -> Result<(), RuntimeError> {
+        let (function_name, locals, captured, body) = match callable {
+            Value::Function(fn_name) => {
+                let fn_bytecode = self.call_cache.resolve(fn_name, &self.functions)
+                    .ok_or_else(|| RuntimeError::new(format!("Undefined function '{}'", fn_name)))?;
+                (fn_name.to_string(), args, Vec::new(), fn_bytecode)
             }
-            Value::Function(name) => format!("<function {}>", name),
             Value::Closure(closure_data) => {
-                format!("<closure/{}>", closure_data.params.len())
+                let args = Self::bind_closure_args(closure_data, args)?;
+                let captured = closure_data.captured.iter().map(|(_, v)| v.clone()).collect();
+                ("<closure>".to_string(), args, captured, Rc::new(closure_data.body.clone()))
             }
-            Value::HashMap(map) => {
-                let mut items: Vec<String> = map.iter()
-                    .map(|(k, v)| format!("{} {}", k, Self::value_to_display_string(v)))
-                    .collect();
-                items.sort();
-                format!("{{{}}}", items.join(" "))
+            _ => {
+                return Err(RuntimeError::new(format!(
+                    "Type error in {}: expected function or closure, got {}",
+                    context,
+                    Self::type_name(callable)
+                )));
             }
-            Value::Vector(items) => {
-                let formatted_items: Vec<String> = items
-                    .iter()
-                    .map(|v| Self::value_to_display_string(v))
-                    .collect();
-                format!("[{}]", formatted_items.join(" "))
+        };
+
+        let frame = Frame {
+            return_address: self.instruction_pointer + 1,
+            locals,
+            return_bytecode: self.current_bytecode.clone(),
+            function_name,
+            captured,
+            stack_base: self.value_stack.len(),
+            multiple_values,
+        };
+        self.push_frame(frame)?;
+
+        self.current_bytecode = body;
+        self.instruction_pointer = 0;
+        Ok(())
+    }
+
+    /// Replace the current frame with a call to a function or closure (a tail call).
+    /// At top level there is no frame to reuse, so one is pushed.
+    fn reuse_call_frame(&mut self, callable: Value, args: Vec<Value>) -> Result<(), RuntimeError> {
+        let (function_name, captured, body, args) = match callable {
+            Value::Function(ref fn_name) => {
+                let fn_bytecode = self.call_cache.resolve(fn_name, &self.functions)
+                    .ok_or_else(|| RuntimeError::new(format!("Undefined function '{}'", fn_name)))?;
+                (fn_name.to_string(), Vec::new(), fn_bytecode, args)
+            }
+            Value::Closure(ref closure_data) => {
+                let args = Self::bind_closure_args(closure_data, args)?;
+                let captured = closure_data.captured.iter().map(|(_, v)| v.clone()).collect();
+                ("<closure>".to_string(), captured, Rc::new(closure_data.body.clone()), args)
+            }
+            _ => {
+                return Err(RuntimeError::new(format!(
+                    "Type error: expected function or closure, got {}",
+                    Self::type_name(&callable)
+                )));
             }
-            Value::TcpListener(_) => "<tcp-listener>".to_string(),
-            Value::TcpStream(_) => "<tcp-stream>".to_string(),
-            Value::SharedTcpListener(_) => "<shared-tcp-listener>".to_string(),
-            Value::Pointer(p) => format!("<pointer 0x{:x}>", p),
+        };
+
+        if let Some(frame) = self.call_stack.last_mut() {
+            // Reuse current frame: drop the caller's temporaries and swap in the callee
+            self.value_stack.truncate(frame.stack_base);
+            frame.locals = args;
+            frame.function_name = function_name;
+            frame.captured = captured;
+        } else {
+            // No frame exists (top-level call), treat as regular call
+            let frame = Frame {
+                return_address: self.instruction_pointer + 1,
+                locals: args,
+                return_bytecode: self.current_bytecode.clone(),
+                function_name,
+                captured,
+                stack_base: self.value_stack.len(),
+                multiple_values: false,
+            };
+            self.push_frame(frame)?;
         }
+
+        self.current_bytecode = body;
+        self.instruction_pointer = 0;
+        Ok(())
     }
 
-    pub fn run(&mut self) -> Result<(), RuntimeError> {
-        while !self.halted {
-            // Execute instruction and capture stack trace on error
-            if let Err(mut error) = self.execute_one_instruction() {
-                // If the error doesn't already have a call stack, add it
-                if error.call_stack.is_empty() {
-                    error.call_stack = self.get_stack_trace();
+    /// Path a load or require of `path` reads. A relative path is taken from the
+    /// directory of the file being run; when nothing is there but the path exists
+    /// from the working directory, as programs written before this expected, that
+    /// is used instead.
+    fn resolve_load_path(&self, path: &str) -> String {
+        let relative = std::path::Path::new(path);
+        let directory = self.current_file.as_deref()
+            .and_then(|file| std::path::Path::new(file).parent())
+            .filter(|directory| !directory.as_os_str().is_empty());
+        match directory {
+            Some(directory) if relative.is_relative() => {
+                let resolved = directory.join(relative);
+                if resolved.exists() || !relative.exists() {
+                    return resolved.to_string_lossy().to_string();
                 }
-                return Err(error);
+                path.to_string()
             }
+            _ => path.to_string(),
         }
-        Ok(())
+    }
+
+    /// Convert a value to a hash map key, rejecting unhashable values
+    fn map_key(key: &Value) -> Result<MapKey, RuntimeError> {
+        MapKey::from_value(key).ok_or_else(|| RuntimeError::new(format!(
+            "Type error: hashmap keys must be integers, strings or symbols, got {}",
+            Self::type_name(key)
+        )))
+    }
+
+    /// Check closure arity and pack surplus arguments into the rest parameter list
+    fn bind_closure_args(closure_data: &ClosureData, mut args: Vec<Value>) -> Result<Vec<Value>, RuntimeError> {
+        match &closure_data.rest_param {
+            None => {
+                // Regular closure - exact arity match required
+                if closure_data.params.len() != args.len() {
+                    return Err(RuntimeError::new(format!(
+                        "Closure arity mismatch: expected {} argument(s), got {}",
+                        closure_data.params.len(),
+                        args.len()
+                    )));
+                }
+            }
+            Some(_rest_name) => {
+                // Variadic closure - need at least the required params
+                if args.len() < closure_data.params.len() {
+                    return Err(RuntimeError::new(format!(
+                        "Variadic closure arity mismatch: expected at least {} argument(s), got {}",
+                        closure_data.params.len(),
+                        args.len()
+                    )));
+                }
+                // Pack extra args into a list and append to args
+                let rest_args: Vec<Value> = args.drain(closure_data.params.len()..).collect();
+                args.push(Value::List(List::from_vec(rest_args)));
+            }
+        }
+        Ok(args)
     }
 
     /// Execute a closure call in isolation (used for parallel operations)
@@ -4257,7 +6919,7 @@ impl VM {
         }
 
         // Set up execution environment
-        self.current_bytecode = bytecode.to_vec();
+        self.current_bytecode = Rc::new(bytecode.to_vec());
         self.instruction_pointer = 0;
         self.halted = false;
 
@@ -4265,15 +6927,13 @@ impl VM {
         let frame = Frame {
             return_address: 0,  // Not used for parallel calls
             locals: args.to_vec(),
-            return_bytecode: Vec::new(),  // Not used for parallel calls
+            return_bytecode: Rc::new(Vec::new()),  // Not used for parallel calls
             function_name: "<parallel>".to_string(),
             captured: captured.iter().map(|(_, v)| v.clone()).collect(),
             stack_base: self.value_stack.len(),
-            loop_start: None,
-            loop_bindings_start: None,
-            loop_bindings_count: None,
+            multiple_values: false,
         };
-        self.call_stack.push(frame);
+        self.push_frame(frame)?;
 
         // Execute the bytecode
         while !self.halted && self.instruction_pointer < self.current_bytecode.len() {
@@ -4288,10 +6948,89 @@ impl VM {
             .ok_or_else(|| RuntimeError::new("No return value from closure call".to_string()))
     }
 
+    /// Push the frame of a call, unless the call stack already holds as many
+    /// frames, or the value stack as many values, as the limits allow
+    fn push_frame(&mut self, frame: Frame) -> Result<(), RuntimeError> {
+        if self.call_stack.len() >= self.max_call_depth || self.value_stack.len() > self.max_value_stack {
+            return Err(self.stack_depth_error(&frame.function_name));
+        }
+        self.call_stack.push(frame);
+        Ok(())
+    }
+
+    /// Error for a call past a depth limit. Its stack trace is the call chain with
+    /// each run of frames of one function shown once with a count, and only the
+    /// ends of a chain still longer than that, so deep recursion doesn't print
+    /// thousands of lines.
+    #[cold]
+    fn stack_depth_error(&self, callee: &str) -> RuntimeError {
+        const SHOWN_AT_EACH_END: usize = 10;
+        let mut chain: Vec<(&str, usize)> = Vec::new();
+        for frame in &self.call_stack {
+            match chain.last_mut() {
+                Some((name, count)) if *name == frame.function_name => *count += 1,
+                _ => chain.push((&frame.function_name, 1)),
+            }
+        }
+        let mut call_stack: Vec<String> = chain.iter()
+            .map(|(name, count)| if *count == 1 { name.to_string() } else { format!("{} (x{})", name, count) })
+            .collect();
+        if call_stack.len() > 2 * SHOWN_AT_EACH_END + 1 {
+            let hidden: usize = chain[SHOWN_AT_EACH_END..chain.len() - SHOWN_AT_EACH_END].iter().map(|(_, count)| count).sum();
+            call_stack.splice(
+                SHOWN_AT_EACH_END..call_stack.len() - SHOWN_AT_EACH_END,
+                std::iter::once(format!("... {} frames omitted ...", Self::group_digits(hidden))),
+            );
+        }
+        let message = if self.call_stack.len() >= self.max_call_depth {
+            format!("Stack depth exceeded: calling '{}' would nest more than {} calls", callee, self.max_call_depth)
+        } else {
+            format!("Stack depth exceeded: calling '{}' with more than {} values on the value stack", callee, self.max_value_stack)
+        };
+        RuntimeError::with_stack(message, call_stack)
+    }
+
+    /// 48231 as "48,231"
+    fn group_digits(n: usize) -> String {
+        let digits = n.to_string();
+        let mut grouped = String::new();
+        for (i, digit) in digits.chars().enumerate() {
+            if i > 0 && (digits.len() - i) % 3 == 0 {
+                grouped.push(',');
+            }
+            grouped.push(digit);
+        }
+        grouped
+    }
+
     pub fn get_stack_trace(&self) -> Vec<String> {
         self.call_stack
             .iter()
             .map(|frame| frame.function_name.clone())
             .collect()
     }
+
+    /// Source position each frame in the stack trace was called from.
+    /// A frame's call instruction lives in its caller: the frame below it,
+    /// or the main bytecode for the outermost frame.
+    pub fn get_call_sites(&self) -> Vec<Option<Location>> {
+        self.call_stack
+            .iter()
+            .enumerate()
+            .map(|(i, frame)| {
+                let caller = if i == 0 { None } else { Some(self.call_stack[i - 1].function_name.as_str()) };
+                self.source_location(caller, frame.return_address.checked_sub(1)?)
+            })
+            .collect()
+    }
+
+    /// Look up the source position of an instruction in a function (None = main bytecode)
+    pub(super) fn source_location(&self, function: Option<&str>, offset: usize) -> Option<Location> {
+        let map = match function {
+            // A loop at top level runs in a frame named <main>
+            Some(name) if name != "<main>" => self.source_maps.functions.get(name)?,
+            _ => &self.source_maps.main,
+        };
+        map.lookup(offset).cloned()
+    }
 }
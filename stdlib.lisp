@@ -1,47 +1,24 @@
 ;; ============================================================
 ;; Standard Library for Lisp Bytecode VM
 ;; ============================================================
+;;
+;; This is the prelude: it is embedded in the lisp-vm binary and the REPL,
+;; and compiled and run before every program unless --no-prelude is given.
 
 ;; ------------------------------------------------------------
 ;; List Utilities
 ;; ------------------------------------------------------------
 
-;; map: Apply function to each element of a list
-(defun map (f lst)
-  (if (null? lst)
-      '()
-      (cons (f (car lst))
-            (map f (cdr lst)))))
-
-;; filter: Keep only elements that satisfy predicate
-(defun filter (pred lst)
-  (if (null? lst)
-      '()
-      (if (pred (car lst))
-          (cons (car lst) (filter pred (cdr lst)))
-          (filter pred (cdr lst)))))
-
-;; reduce/fold: Reduce list with binary function and initial value
-(defun reduce (f init lst)
-  (if (null? lst)
-      init
-      (reduce f (f init (car lst)) (cdr lst))))
+;; map, filter, reduce, length, reverse, nth, append, member, memq, assoc, assq
+;; and sort are built into the VM
 
-;; length: Get length of a list
-(defun length (lst)
-  (if (null? lst)
-      0
-      (+ 1 (length (cdr lst)))))
-
-;; reverse-helper: Helper for reverse
-(defun reverse-helper (lst acc)
-  (if (null? lst)
-      acc
-      (reverse-helper (cdr lst) (cons (car lst) acc))))
-
-;; reverse: Reverse a list
-(defun reverse (lst)
-  (reverse-helper lst '()))
+;; car and cdr compositions: (cadr lst) is (car (cdr lst)), and so on
+(defun caar (lst) (car (car lst)))
+(defun cadr (lst) (car (cdr lst)))
+(defun cdar (lst) (cdr (car lst)))
+(defun cddr (lst) (cdr (cdr lst)))
+(defun caddr (lst) (car (cdr (cdr lst))))
+(defun cdddr (lst) (cdr (cdr (cdr lst))))
 
 ;; take: Take first n elements of a list
 (defun take (n lst)
@@ -59,10 +36,6 @@
           '()
           (drop (- n 1) (cdr lst)))))
 
-;; nth: Get nth element (0-indexed, alias for list-ref)
-(defun nth (lst n)
-  (list-ref lst n))
-
 ;; range: Create a list from start to end (exclusive)
 (defun range (start end)
   (if (>= start end)
@@ -229,21 +202,7 @@
 (defun group-by (f lst)
   (group-by-helper f lst '()))
 
-;; sort: Sort a list using comparison function
-;; Uses a simple insertion sort
-(defun insert-sorted (cmp item lst)
-  (if (null? lst)
-      (list item)
-      (if (cmp item (car lst))
-          (cons item lst)
-          (cons (car lst) (insert-sorted cmp item (cdr lst))))))
-
-(defun sort (cmp lst)
-  (if (null? lst)
-      '()
-      (insert-sorted cmp (car lst) (sort cmp (cdr lst)))))
-
-;; sort-by: Sort a list by applying function to elements
+;; sort-by: Sort a list by applying function to elements (sort is built in)
 (defun sort-by (f cmp lst)
   (sort (lambda (a b) (cmp (f a) (f b))) lst))
 
@@ -405,31 +364,37 @@
 ;; Helper: is-err (alias for err?)
 (defun is-err (r) (err? r))
 
+;; ------------------------------------------------------------
+;; Streams
+;; ------------------------------------------------------------
+
+;; delay and cons-stream are special forms: (delay expr) is a promise of expr,
+;; which force evaluates once and remembers. (cons-stream a b) is (cons a (delay b)).
+;; force, promise?, stream-car and stream-cdr are built into the VM
+
+;; stream-null?: Check if a stream is empty; the empty stream is '()
+(defun stream-null? (s) (null? s))
+
+;; stream-ref: Element n of a stream, forcing only the elements before it
+(defun stream-ref (s n)
+  (if (= n 0)
+      (stream-car s)
+      (stream-ref (stream-cdr s) (- n 1))))
+
+;; stream-take: List of the first n elements of a stream
+(defun stream-take (n s)
+  (if (or (<= n 0) (stream-null? s))
+      '()
+      (cons (stream-car s) (stream-take (- n 1) (stream-cdr s)))))
+
 ;; ------------------------------------------------------------
 ;; Debugging and Profiling Macros
 ;; ------------------------------------------------------------
 
-;; time: Profile code execution time
-;; Usage: (time expr) - evaluates expr, prints elapsed time, returns result
-;; Note: Uses simple approach without gensym for now
-(defmacro time (expr)
-  (list 'let (list (list '__t_start__ (list 'current-timestamp)))
-    (list 'let (list (list '__t_result__ expr))
-      (list 'let (list (list '__t_end__ (list 'current-timestamp)))
-        (list 'let (list (list '__t_elapsed__ (list '- '__t_end__ '__t_start__)))
-          (list 'do
-            (list 'print (list 'string-append
-                              (list 'string-append "Elapsed time: "
-                                    (list 'number->string '__t_elapsed__))
-                              " seconds"))
-            '__t_result__))))))
-
-;; assert: Runtime assertion for testing and debugging
-;; Usage: (assert condition)
-;; Note: Simplified version - macros don't support variadic parameters
-(defmacro assert (condition)
-  `(if (not ,condition)
-       (do
-         (print "Assertion failed")
-         (err "Assertion failed"))
-       true))
+;; time is a special form: (time expr) evaluates expr, prints the elapsed time
+;; and the number of instructions executed, and returns the result
+
+;; assert is a special form: (assert condition) returns nil, or raises an error
+;; quoting the condition and giving its location when the condition is false.
+;; (assert condition "message") adds the message to the error.
+;; (assert-equal expected actual) shows both values when they differ
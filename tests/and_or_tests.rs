@@ -0,0 +1,140 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, List, Value};
+
+fn compile(source: &str) -> Result<(std::collections::HashMap<String, Vec<Instruction>>, Vec<Instruction>), String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    Compiler::new().compile_program(&exprs).map_err(|e| e.message)
+}
+
+fn run_vm(source: &str) -> Result<VM, String> {
+    let (functions, main) = compile(source)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+fn run(source: &str) -> Result<Option<Value>, String> {
+    Ok(run_vm(source)?.value_stack.last().cloned())
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+// ============================================================================
+// Values
+// ============================================================================
+
+#[test]
+fn test_and_returns_the_first_false_or_the_last_value() {
+    assert_eq!(run("(and 1 2 3)"), Ok(Some(Value::Integer(3))));
+    assert_eq!(run("(and 1 false 3)"), Ok(Some(Value::Boolean(false))));
+    assert_eq!(run("(and '(1 2))"), Ok(Some(ints(&[1, 2]))));
+    assert_eq!(run("(and true true)"), Ok(Some(Value::Boolean(true))));
+    // Only false is falsy: the empty list and zero count as true
+    assert_eq!(run("(and '() 0 'last)"), Ok(Some(Value::symbol("last"))));
+}
+
+#[test]
+fn test_or_returns_the_first_value_that_is_not_false() {
+    assert_eq!(run("(or false 2 3)"), Ok(Some(Value::Integer(2))));
+    assert_eq!(run("(or false false)"), Ok(Some(Value::Boolean(false))));
+    assert_eq!(run("(or false '(1 2))"), Ok(Some(ints(&[1, 2]))));
+    assert_eq!(run("(or '() false)"), Ok(Some(Value::List(List::Nil))));
+}
+
+#[test]
+fn test_results_are_usable_values() {
+    let source = r#"
+        (defun lookup (key alist)
+          (if (null? alist) false
+            (if (= (car (car alist)) key) (car (cdr (car alist))) (lookup key (cdr alist)))))
+        (let ((table (list (list 1 'one) (list 2 'two))))
+          (list (or (lookup 2 table) 'missing)
+                (or (lookup 3 table) 'missing)
+                (and (lookup 1 table) (lookup 2 table))
+                (and (lookup 1 table) (lookup 3 table))))
+    "#;
+    let expected = vec![Value::symbol("two"), Value::symbol("missing"), Value::symbol("two"), Value::Boolean(false)];
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(expected)))));
+}
+
+#[test]
+fn test_conditions_branch_on_and_or_results() {
+    // if, cond and when use the same rule as and and or: only false is falsy
+    let source = r#"
+        (defun describe (x) (if (and (> (length x) 0) (car x)) 'has-head 'empty))
+        (defun lookup (key alist)
+          (if (null? alist) false
+            (if (= (car (car alist)) key) (car (cdr (car alist))) (lookup key (cdr alist)))))
+        (let ((table (list (list 1 'one))))
+          (list (describe '(5 6))
+                (describe '())
+                (if (or (lookup 1 table) 'default) 'found 'none)
+                (if (or (lookup 2 table) false) 'found 'none)
+                (cond ((and 1 '()) 'cond-taken) (true 'cond-skipped))
+                (when (or false 0) 'when-taken)))
+    "#;
+    let expected = ["has-head", "empty", "found", "none", "cond-taken", "when-taken"].map(Value::symbol).to_vec();
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(expected)))));
+    // filter keeps every element its predicate doesn't reject with false
+    assert_eq!(run("(filter (lambda (x) (and (> x 1) x)) '(1 2 3))"), Ok(Some(ints(&[2, 3]))));
+}
+
+// ============================================================================
+// Short-circuiting
+// ============================================================================
+
+#[test]
+fn test_or_never_evaluates_operands_after_a_true_one() {
+    let source = "(defun error-fn () (car 5)) (or 1 (error-fn))";
+    assert_eq!(run(source), Ok(Some(Value::Integer(1))));
+    // The same call fails when it is reached
+    assert!(run("(defun error-fn () (car 5)) (or false (error-fn))").is_err());
+}
+
+#[test]
+fn test_and_never_evaluates_operands_after_a_false_one() {
+    let source = r#"
+        (define calls 0)
+        (defun count-call (v) (do (set! calls (+ calls 1)) v))
+        (list (and (count-call 1) (count-call false) (count-call 3))
+              (or (count-call false) (count-call 'hit) (count-call 'skipped))
+              calls)
+    "#;
+    let expected = vec![Value::Boolean(false), Value::symbol("hit"), Value::Integer(4)];
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(expected)))));
+}
+
+// ============================================================================
+// Lowering and tail position
+// ============================================================================
+
+#[test]
+fn test_lowered_to_conditional_jumps() {
+    let (_, main) = compile("(define x 1) (or false x 3)").unwrap();
+    let jumps = main.iter().filter(|instr| matches!(instr, Instruction::JmpIfTrueOrPop(_))).count();
+    assert_eq!(jumps, 2, "got: {:?}", main);
+    assert!(!main.iter().any(|instr| matches!(instr, Instruction::Call(name, _) if name == "or")));
+
+    let (_, main) = compile("(define x 1) (and x 2)").unwrap();
+    assert!(main.iter().any(|instr| matches!(instr, Instruction::JmpIfFalseOrPop(_))), "got: {:?}", main);
+}
+
+#[test]
+fn test_final_operand_recurs_in_tail_position() {
+    let source = "(loop ((i 0)) (or (and (= i 100000) i) (recur (+ i 1))))";
+    let vm = run_vm(source).unwrap();
+    assert_eq!(vm.value_stack, vec![Value::Integer(100000)]);
+
+    let source = "(defun find-first (n limit) (and (< n limit) (or (and (= (% n 7) 6) n) (find-first (+ n 1) limit)))) (find-first 100 200000)";
+    assert_eq!(run(source), Ok(Some(Value::Integer(104))));
+}
+
+#[test]
+fn test_and_or_need_an_operand() {
+    assert_eq!(run("(and)").unwrap_err(), "and expects at least 1 argument");
+    assert_eq!(run("(or)").unwrap_err(), "or expects at least 1 argument");
+}
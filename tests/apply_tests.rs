@@ -1,4 +1,4 @@
-use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Value};
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, Value};
 
 fn compile_and_run(source: &str) -> Result<String, String> {
     let mut parser = Parser::new(source);
@@ -12,7 +12,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
     for (name, bytecode) in functions {
         vm.functions.insert(name, bytecode);
     }
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().map_err(|e| format!("Runtime error: {:?}", e))?;
 
     // Get the top value from the stack and format it
@@ -25,6 +25,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
 fn format_value(value: &Value) -> String {
     match value {
         Value::Integer(n) => n.to_string(),
+        Value::BigInt(n) => n.to_string(),
         Value::Float(f) => {
             if f.fract() == 0.0 && !f.is_nan() && !f.is_infinite() {
                 format!("{:.1}", f)
@@ -33,6 +34,7 @@ fn format_value(value: &Value) -> String {
             }
         }
         Value::Boolean(b) => if *b { "true".to_string() } else { "false".to_string() },
+        Value::Char(c) => format!("#\\{}", c),
         Value::List(items) => {
             let formatted_items: Vec<String> = items.iter().map(format_value).collect();
             format!("({})", formatted_items.join(" "))
@@ -49,13 +51,22 @@ fn format_value(value: &Value) -> String {
         }
         Value::HashMap(_) => "<hashmap>".to_string(),
         Value::Vector(items) => {
-            let formatted_items: Vec<String> = items.iter().map(format_value).collect();
+            let formatted_items: Vec<String> = items.borrow().iter().map(format_value).collect();
             format!("[{}]", formatted_items.join(" "))
         }
         Value::TcpListener(_) => "#<tcp-listener>".to_string(),
         Value::TcpStream(_) => "#<tcp-stream>".to_string(),
         Value::SharedTcpListener(_) => "#<shared-tcp-listener>".to_string(),
+        Value::Struct(data) => {
+            let fields: Vec<String> = data.fields.iter().map(|v| format_value(v)).collect();
+            format!("#<{} {}>", data.name, fields.join(" "))
+        }
         Value::Pointer(p) => format!("#<pointer 0x{:x}>", p),
+        Value::Cell(_) => "#<cell>".to_string(),
+        Value::Port(_) => "#<port>".to_string(),
+        Value::Promise(_) => "#<promise>".to_string(),
+        Value::Task(_) => "#<task>".to_string(),
+        Value::Channel(_) => "#<channel>".to_string(),
     }
 }
 
@@ -279,3 +290,101 @@ fn test_apply_with_variadic_recursive_sum() {
     let result = compile_and_run(source).unwrap();
     assert_eq!(result.trim(), "100");
 }
+
+// ==================== Leading Arguments ====================
+
+#[test]
+fn test_apply_with_leading_args() {
+    assert_eq!(compile_and_run("(apply + 1 '(2))").unwrap(), "3");
+    assert_eq!(compile_and_run("(defun lst (&rest xs) xs) (apply lst 1 2 '(3 4))").unwrap(), "(1 2 3 4)");
+}
+
+#[test]
+fn test_apply_leading_args_with_empty_list() {
+    assert_eq!(compile_and_run("(defun lst (&rest xs) xs) (apply lst 1 2 '())").unwrap(), "(1 2)");
+    assert_eq!(compile_and_run("(defun three (a b c) (+ a b c)) (apply three 1 2 3 '())").unwrap(), "6");
+}
+
+#[test]
+fn test_apply_leading_args_with_non_list() {
+    let err = compile_and_run("(apply + 1 2)").unwrap_err();
+    assert!(err.contains("expected list of arguments"), "got: {}", err);
+}
+
+#[test]
+fn test_apply_leading_args_to_rest_parameter() {
+    let source = r#"
+        (defun tag (label &rest items) (cons label items))
+        (apply tag 'a 'b '(c d))
+    "#;
+    assert_eq!(compile_and_run(source).unwrap(), "(a b c d)");
+}
+
+#[test]
+fn test_apply_rest_parameter_below_minimum_arity() {
+    let source = r#"
+        (let ((f (lambda (a b &rest more) (list a b more))))
+          (apply f 1 '()))
+    "#;
+    let err = compile_and_run(source).unwrap_err();
+    assert!(err.contains("arity mismatch"), "got: {}", err);
+}
+
+#[test]
+fn test_apply_requires_function_and_list() {
+    let err = compile_and_run("(apply +)").unwrap_err();
+    assert!(err.contains("apply expects a function and an argument list"), "got: {}", err);
+}
+
+// ==================== Tail Position ====================
+
+#[test]
+fn test_apply_in_tail_position_is_tail_call() {
+    let mut parser = Parser::new("(defun spin (n acc) (if (= n 0) acc (apply spin (list (- n 1) (+ acc 1)))))");
+    let exprs = parser.parse_all().unwrap();
+    let (functions, _) = Compiler::new().compile_program(&exprs).unwrap();
+    let bytecode = &functions["spin"];
+    assert!(bytecode.contains(&Instruction::TailApply), "got: {:?}", bytecode);
+    assert!(!bytecode.contains(&Instruction::Apply), "got: {:?}", bytecode);
+}
+
+#[test]
+fn test_tail_apply_does_not_grow_stack() {
+    let source = r#"
+        (defun spin (n acc) (if (= n 0) acc (apply spin (- n 1) (list (+ acc 1)))))
+        (spin 100000 0)
+    "#;
+    assert_eq!(compile_and_run(source).unwrap(), "100000");
+}
+
+#[test]
+fn test_tail_apply_to_closure() {
+    let source = r#"
+        (defun run-down (n)
+          (let ((step (lambda (k) (if (= k 0) 'done (run-down (- k 1))))))
+            (apply step (list n))))
+        (run-down 100000)
+    "#;
+    assert_eq!(compile_and_run(source).unwrap(), "done");
+}
+
+#[test]
+fn test_apply_arity_counts_leading_args() {
+    let source = r#"
+        (let ((add2 (lambda (a b) (+ a b))))
+          (apply add2 1 '(2 3)))
+    "#;
+    let err = compile_and_run(source).unwrap_err();
+    assert!(err.contains("expected 2 argument(s), got 3"), "got: {}", err);
+}
+
+#[test]
+fn test_trampoline_through_apply() {
+    // Each function applies the other, defined later in the file, in tail position
+    let source = r#"
+        (defun ping (n) (if (= n 0) 'ping (apply pong (list (- n 1)))))
+        (defun pong (n) (if (= n 0) 'pong (apply ping (list (- n 1)))))
+        (ping 100001)
+    "#;
+    assert_eq!(compile_and_run(source).unwrap(), "pong");
+}
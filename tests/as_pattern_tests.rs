@@ -0,0 +1,152 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, List, Value};
+
+fn compile(source: &str) -> Result<(std::collections::HashMap<String, Vec<Instruction>>, Vec<Instruction>), String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    Compiler::new().compile_program(&exprs).map_err(|e| e.message)
+}
+
+fn run_vm(source: &str) -> Result<VM, String> {
+    let (functions, main) = compile(source)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+fn run(source: &str) -> Result<Option<Value>, String> {
+    Ok(run_vm(source)?.value_stack.last().cloned())
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+fn list(values: Vec<Value>) -> Value {
+    Value::List(List::from_vec(values))
+}
+
+// ============================================================================
+// Binding the whole value
+// ============================================================================
+
+#[test]
+fn test_as_pattern_binds_whole_and_parts() {
+    let source = "(match '(1 2 3) ((@ whole (head . tail)) (list whole head tail)))";
+    assert_eq!(run(source), Ok(Some(list(vec![ints(&[1, 2, 3]), Value::Integer(1), ints(&[2, 3])]))));
+}
+
+#[test]
+fn test_whole_is_the_matched_value_itself() {
+    let source = "(define xs '(1 2 3)) (match xs ((@ whole (_ . _)) (eq? whole xs)))";
+    assert_eq!(run(source), Ok(Some(Value::Boolean(true))));
+}
+
+#[test]
+fn test_inner_pattern_must_still_match() {
+    let source = r#"
+        (defun classify (v)
+          (match v
+            ((@ pair (a b)) (list 'pair pair))
+            ((@ other _) (list 'other other))))
+        (list (classify '(1 2)) (classify '(1 2 3)) (classify 7))
+    "#;
+    let expected = list(vec![
+        list(vec![Value::symbol("pair"), ints(&[1, 2])]),
+        list(vec![Value::symbol("other"), ints(&[1, 2, 3])]),
+        list(vec![Value::symbol("other"), Value::Integer(7)]),
+    ]);
+    assert_eq!(run(source), Ok(Some(expected)));
+}
+
+// ============================================================================
+// Nesting
+// ============================================================================
+
+#[test]
+fn test_as_patterns_nest_inside_cons_patterns() {
+    let source = "(match '((1 2) (3 4)) (((@ first (a b)) (@ second (c . (@ rest (d))))) (list first a b second c rest d)))";
+    let expected = list(vec![
+        ints(&[1, 2]), Value::Integer(1), Value::Integer(2),
+        ints(&[3, 4]), Value::Integer(3), ints(&[4]), Value::Integer(4),
+    ]);
+    assert_eq!(run(source), Ok(Some(expected)));
+
+    // An as-pattern directly inside another
+    let source = "(match '(5) ((@ outer (@ inner (x))) (list outer inner x)))";
+    assert_eq!(run(source), Ok(Some(list(vec![ints(&[5]), ints(&[5]), Value::Integer(5)]))));
+}
+
+#[test]
+fn test_as_patterns_inside_or_patterns() {
+    let source = r#"
+        (defun tagged (v)
+          (match v
+            ((or (@ whole ('a x)) (@ whole ('b x))) (list x whole))
+            (_ 'untagged)))
+        (list (tagged '(a 1)) (tagged '(b 2)) (tagged '(c 3)))
+    "#;
+    let expected = list(vec![
+        list(vec![Value::Integer(1), list(vec![Value::symbol("a"), Value::Integer(1)])]),
+        list(vec![Value::Integer(2), list(vec![Value::symbol("b"), Value::Integer(2)])]),
+        Value::symbol("untagged"),
+    ]);
+    assert_eq!(run(source), Ok(Some(expected)));
+}
+
+// ============================================================================
+// Multi-clause defun
+// ============================================================================
+
+#[test]
+fn test_as_patterns_in_defun_clauses() {
+    let source = r#"
+        (defun dedupe
+          (('()) '())
+          (((@ xs (x . (@ rest (y . _))))) (if (= x y) (dedupe rest) (cons x (dedupe rest))))
+          ((xs) xs))
+        (dedupe '(1 1 2 3 3 3 4))
+    "#;
+    assert_eq!(run(source), Ok(Some(ints(&[1, 2, 3, 4]))));
+}
+
+#[test]
+fn test_tail_calls_clean_up_the_extra_binding() {
+    let source = r#"
+        (defun walk
+          (((@ xs (x . rest)) acc) (walk rest (+ acc (+ x (list-length xs)))))
+          (('() acc) acc))
+        (walk (list 1 1 1 1 1 1 1 1 1 1) 0)
+    "#;
+    // Each step adds 1 plus the remaining length: 10 + (10 + 9 + ... + 1)
+    assert_eq!(run(source), Ok(Some(Value::Integer(10 + 55))));
+
+    let source = r#"
+        (defun make (n acc) (if (= n 0) acc (make (- n 1) (cons n acc))))
+        (defun walk
+          (((@ xs (x . rest)) acc) (walk rest (+ acc x)))
+          (('() acc) acc))
+        (walk (make 100000 '()) 0)
+    "#;
+    let vm = run_vm(source).unwrap();
+    assert_eq!(vm.value_stack, vec![Value::Integer(100000 * 100001 / 2)]);
+
+    let (functions, _) = compile("(defun walk (((@ xs (x . rest)) acc) (walk rest (+ acc x))) (('() acc) acc))").unwrap();
+    assert!(functions["walk"].iter().any(|instr| matches!(instr, Instruction::TailCall(_, _))),
+        "got: {:?}", functions["walk"]);
+}
+
+// ============================================================================
+// Errors
+// ============================================================================
+
+#[test]
+fn test_malformed_as_patterns() {
+    let err = run("(match 1 ((@ x) x))").unwrap_err();
+    assert_eq!(err, "as-pattern expects a name and a pattern: (@ name pattern)");
+    let err = run("(match 1 ((@ 5 x) x))").unwrap_err();
+    assert_eq!(err, "as-pattern name must be a variable");
+    let err = run("(match 1 ((@ _ x) x))").unwrap_err();
+    assert_eq!(err, "as-pattern name must be a variable");
+}
@@ -0,0 +1,163 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, test_runner, List, MapKey, Symbol, Value};
+
+fn run(source: &str) -> Result<Value, lisp_bytecode_vm::RuntimeError> {
+    let mut parser = Parser::new_with_file(source, "checks.lisp".to_string());
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm.run()?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+/// Run the program, then its deftests
+fn run_tests(source: &str) -> test_runner::TestReport {
+    let mut parser = Parser::new_with_file(source, "checks.lisp".to_string());
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm.run().unwrap();
+    test_runner::run_tests(&mut vm, &compiler.tests())
+}
+
+fn compile_error(source: &str) -> String {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    Compiler::new().compile_program(&exprs).unwrap_err().message
+}
+
+fn field(map: &Value, name: &str) -> Value {
+    match map {
+        Value::HashMap(map) => map.borrow()[&MapKey::Symbol(Symbol::intern(name))].clone(),
+        other => panic!("expected an error map, got {:?}", other),
+    }
+}
+
+// ============================================================================
+// assert and assert-equal
+// ============================================================================
+
+#[test]
+fn test_passing_assertions_return_nil() {
+    assert_eq!(run("(assert (= (+ 1 1) 2))").unwrap(), Value::List(List::Nil));
+    // Anything but false passes, as with and/or
+    assert_eq!(run("(assert '(1 2))").unwrap(), Value::List(List::Nil));
+    assert_eq!(run("(assert true \"never shown\")").unwrap(), Value::List(List::Nil));
+    assert_eq!(run("(assert-equal '(1 2) (list 1 2))").unwrap(), Value::List(List::Nil));
+}
+
+#[test]
+fn test_failed_assert_quotes_the_source_and_its_location() {
+    let err = run("(define x 3)\n(do (print x)\n    (assert (equal? (list x \"a\") '(y 2.5))))").unwrap_err();
+    assert_eq!(err.message, "Assertion failed: (assert (equal? (list x \"a\") '(y 2.5)))");
+
+    let err = run("(define x 3)\n  (assert (= x 4))").unwrap_err();
+    assert_eq!(err.message, "Assertion failed: (assert (= x 4))");
+    let location = err.location.unwrap();
+    assert_eq!((location.file.as_str(), location.line, location.column), ("checks.lisp", 2, 3));
+}
+
+#[test]
+fn test_failed_assert_adds_its_message() {
+    let err = run("(define x 3)\n(assert (= x 4) \"x should be four\")").unwrap_err();
+    assert_eq!(err.message, "Assertion failed: (assert (= x 4)): x should be four");
+    let location = err.location.as_ref().unwrap();
+    assert_eq!((location.line, location.column), (2, 1));
+
+    let output = err.format();
+    assert!(output.contains("│ checks.lisp:2:1\n"), "got:\n{}", output);
+    assert!(output.contains("│ Assertion failed: (assert (= x 4)): x should be four\n"), "got:\n{}", output);
+}
+
+#[test]
+fn test_failed_assert_equal_shows_both_values() {
+    let err = run("(assert-equal \"4\" (+ 2 2))").unwrap_err();
+    assert_eq!(err.message, "Assertion failed: (assert-equal \"4\" (+ 2 2)): expected \"4\", got 4");
+}
+
+#[test]
+fn test_failed_assertions_are_catchable() {
+    let source = "(handler-case\n  (assert-equal 1 2)\n  (catch (e) e))";
+    let caught = run(source).unwrap();
+    assert_eq!(field(&caught, "message"), Value::string("Assertion failed: (assert-equal 1 2): expected 1, got 2"));
+    assert_eq!(field(&caught, "line"), Value::Integer(2));
+    assert_eq!(field(&caught, "column"), Value::Integer(3));
+}
+
+#[test]
+fn test_assertions_check_their_arguments() {
+    assert_eq!(compile_error("(assert)"), "assert expects 1 or 2 arguments: (assert expr) or (assert expr \"message\")");
+    assert_eq!(compile_error("(assert true \"a\" \"b\")"), "assert expects 1 or 2 arguments: (assert expr) or (assert expr \"message\")");
+    assert_eq!(compile_error("(define m \"a\") (assert true m)"), "assert message must be a string literal");
+    assert_eq!(compile_error("(assert-equal 1)"), "assert-equal expects exactly 2 arguments: (assert-equal expected actual)");
+}
+
+// ============================================================================
+// deftest and the runner
+// ============================================================================
+
+const SUITE: &str = r#"
+(defun square (x) (* x x))
+
+(deftest square
+  (assert-equal 16 (square 4))
+  (assert (= (square 3) 9)))
+
+(deftest wrong-square
+  (assert-equal 5 (square 2))
+  (assert false))
+
+(deftest crashes
+  (car 5))
+
+(deftest last-passes
+  (assert true))
+"#;
+
+#[test]
+fn test_runner_runs_every_test_in_order() {
+    let report = run_tests(SUITE);
+    let outcomes: Vec<(&str, bool)> = report.results.iter()
+        .map(|result| (result.name.as_str(), result.error.is_none()))
+        .collect();
+    assert_eq!(outcomes, vec![("square", true), ("wrong-square", false), ("crashes", false), ("last-passes", true)]);
+    assert_eq!((report.passed(), report.failed()), (2, 2));
+}
+
+#[test]
+fn test_a_test_stops_at_its_first_failing_assertion() {
+    let report = run_tests(SUITE);
+    let error = report.results[1].error.as_ref().unwrap();
+    assert_eq!(error.message, "Assertion failed: (assert-equal 5 (square 2)): expected 5, got 4");
+    assert_eq!(error.location.as_ref().map(|l| (l.line, l.column)), Some((9, 3)));
+}
+
+#[test]
+fn test_report_lists_tests_failures_and_counts() {
+    let output = run_tests(SUITE).format();
+    assert!(output.starts_with("PASS square\nFAIL wrong-square\nFAIL crashes\nPASS last-passes\n"), "got:\n{}", output);
+    assert!(output.contains("╭─ Test Failed: wrong-square "), "got:\n{}", output);
+    assert!(output.contains("│ checks.lisp:9:3\n"), "got:\n{}", output);
+    assert!(output.contains("│ Type error: 'car' expects a list, got integer\n"), "got:\n{}", output);
+    assert!(output.ends_with("\n2 passed, 2 failed\n"), "got:\n{}", output);
+}
+
+#[test]
+fn test_tests_do_not_run_with_the_program() {
+    // Only the runner calls a deftest, and its name doesn't clash with the function
+    assert_eq!(run(&format!("{}(square 5)", SUITE)).unwrap(), Value::Integer(25));
+}
+
+#[test]
+fn test_deftest_errors() {
+    assert_eq!(compile_error("(deftest t1 (assert true)) (deftest t1 (assert false))"), "Test 't1' is defined twice");
+    assert_eq!(compile_error("(deftest t1)"), "deftest expects a name and a body: (deftest name body...)");
+    assert_eq!(compile_error("(deftest \"t1\" (assert true))"), "Test name must be a symbol");
+    assert_eq!(compile_error("(do (deftest t1 (assert true)))"), "deftest is only allowed at the top level of a file");
+}
@@ -0,0 +1,235 @@
+use lisp_bytecode_vm::{bytecode, Compiler, VM, parser::Parser, Instruction, Value};
+use lisp_bytecode_vm::vm::bigint::BigInt;
+use std::collections::HashMap;
+
+/// Helper function to compile and run source code
+fn compile_and_run(source: &str) -> Result<VM, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+/// Helper to get the top of the stack after running source
+fn eval(source: &str) -> Value {
+    let vm = compile_and_run(source).unwrap();
+    vm.value_stack.last().cloned().expect("empty stack")
+}
+
+/// Helper to render an integer result, fixnum or bignum, in decimal
+fn eval_integer_string(source: &str) -> String {
+    match eval(source) {
+        Value::Integer(n) => n.to_string(),
+        Value::BigInt(n) => n.to_string(),
+        other => panic!("Expected integer result, got {:?}", other),
+    }
+}
+
+const FACT: &str = "(defun fact (n) (if (<= n 1) 1 (* n (fact (- n 1)))))";
+
+// ============================================================================
+// Overflow promotion
+// ============================================================================
+
+#[test]
+fn test_mul_overflow_promotes() {
+    let result = eval("(* 1000000000000000000 1000000000000000000)");
+    assert!(matches!(result, Value::BigInt(_)), "got {:?}", result);
+    assert_eq!(eval_integer_string("(* 1000000000000000000 1000000000000000000)"),
+               "1000000000000000000000000000000000000");
+}
+
+#[test]
+fn test_add_and_sub_overflow_promote() {
+    assert_eq!(eval_integer_string("(+ 9223372036854775807 1)"), "9223372036854775808");
+    assert_eq!(eval_integer_string("(- (- 0 9223372036854775807) 2)"), "-9223372036854775809");
+    assert_eq!(eval_integer_string("(+ 9223372036854775807 9223372036854775807)"), "18446744073709551614");
+}
+
+#[test]
+fn test_small_results_stay_fixnums() {
+    assert_eq!(eval("(* 1000000000 1000000000)"), Value::Integer(1000000000000000000));
+    assert_eq!(eval("(+ 1 2)"), Value::Integer(3));
+}
+
+#[test]
+fn test_bignum_results_demote_when_they_fit() {
+    assert_eq!(eval("(- (+ 9223372036854775807 10) 20)"), Value::Integer(9223372036854775797));
+    assert_eq!(eval("(/ (* 4611686018427387904 4) 8)"), Value::Integer(2305843009213693952));
+}
+
+#[test]
+fn test_factorial_50_is_exact() {
+    let source = format!("{} (fact 50)", FACT);
+    assert_eq!(eval_integer_string(&source),
+               "30414093201713378043612608166064768844377641568960512000000000000");
+}
+
+#[test]
+fn test_neg_and_division_edge_cases() {
+    assert_eq!(eval_integer_string("(- 0 (- (- 0 9223372036854775807) 1))"), "9223372036854775808");
+    assert_eq!(eval_integer_string("(/ (- (- 0 9223372036854775807) 1) -1)"), "9223372036854775808");
+    assert_eq!(eval("(% (- (- 0 9223372036854775807) 1) -1)"), Value::Integer(0));
+}
+
+#[test]
+fn test_bignum_division_truncates() {
+    let source = format!("{} (list (/ (+ (fact 25) 1) 7) (% (+ (fact 25) 1) 7) (% (- 0 (+ (fact 25) 1)) 7))", FACT);
+    match eval(&source) {
+        Value::List(items) => {
+            let items = items.to_vec();
+            assert_eq!(items[0].as_bigint().unwrap().to_string(), "2215887149047283712000000");
+            assert_eq!(items[1], Value::Integer(1));
+            assert_eq!(items[2], Value::Integer(-1));
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_bignum_division_by_zero_errors() {
+    let source = format!("{} (/ (fact 30) 0)", FACT);
+    let err = compile_and_run(&source).err().expect("expected an error");
+    assert!(err.contains("Division by zero"), "got: {}", err);
+}
+
+// ============================================================================
+// Comparison, equality and mixed arithmetic
+// ============================================================================
+
+#[test]
+fn test_bignum_comparisons() {
+    let source = format!(r#"
+        {}
+        (list (> (fact 30) (fact 29))
+              (< (fact 30) 5)
+              (>= (fact 25) (fact 25))
+              (<= (- 0 (fact 25)) 0)
+              (== (fact 30) (* 30 (fact 29)))
+              (!= (fact 30) (fact 29))
+              (== (fact 30) 1))
+    "#, FACT);
+    match eval(&source) {
+        Value::List(items) => {
+            assert_eq!(items.to_vec(), vec![
+                Value::Boolean(true),
+                Value::Boolean(false),
+                Value::Boolean(true),
+                Value::Boolean(true),
+                Value::Boolean(true),
+                Value::Boolean(true),
+                Value::Boolean(false),
+            ]);
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_bignum_mixed_with_float_is_inexact() {
+    let source = format!("{} (* (fact 25) 0.5)", FACT);
+    match eval(&source) {
+        Value::Float(f) => assert!((f - 7.755605021665493e24).abs() < 1e10, "got {}", f),
+        other => panic!("Expected float result, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_bignum_type_predicates() {
+    let source = format!("{} (list (integer? (fact 25)) (number? (fact 25)) (type-of (fact 25)))", FACT);
+    match eval(&source) {
+        Value::List(items) => {
+            assert_eq!(items.to_vec(), vec![Value::Boolean(true), Value::Boolean(true), Value::symbol("integer")]);
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_bignum_number_to_string() {
+    let source = format!("{} (number->string (fact 22))", FACT);
+    assert_eq!(eval(&source), Value::string("1124000727777607680000"));
+}
+
+#[test]
+fn test_bignum_type_error() {
+    let source = format!(r#"{} (+ (fact 25) "x")"#, FACT);
+    let err = compile_and_run(&source).err().expect("expected an error");
+    assert!(err.contains("'+' expects two numbers, got integer and string"), "got: {}", err);
+}
+
+// ============================================================================
+// Rounding floats
+// ============================================================================
+
+const INF: &str = "(* 1e300 1e300)";
+
+#[test]
+fn test_rounding_at_the_ends_of_the_fixnum_range() {
+    // -2^63 still fits; the float nearest i64::MAX is 2^63, which doesn't
+    assert_eq!(eval("(floor -9223372036854775808.0)"), Value::Integer(i64::MIN));
+    assert_eq!(eval("(ceil 9223372036854774784.0)"), Value::Integer(9223372036854774784));
+    let result = eval("(round 9223372036854775807.0)");
+    assert!(matches!(result, Value::BigInt(_)), "got {:?}", result);
+    assert_eq!(eval_integer_string("(round 9223372036854775807.0)"), "9223372036854775808");
+    assert_eq!(eval_integer_string("(floor -18446744073709551616.5)"), "-18446744073709551616");
+}
+
+#[test]
+fn test_rounding_a_huge_float_is_exact() {
+    assert_eq!(eval_integer_string("(round 1e300)"), "1000000000000000052504760255204420248704468581108159154915854115511802457988908195786371375080447864043704443832883878176942523235360430575644792184786706982848387200926575803737830233794788090059368953234970799945081119038967640880074652742780142494579258788820056842838115669472196386865459400540160");
+    // The conversion itself truncates toward zero
+    assert_eq!(BigInt::from_f64(-0.75), Some(BigInt::zero()));
+    assert_eq!(BigInt::from_f64(-5e-324), Some(BigInt::zero()));
+    assert_eq!(BigInt::from_f64(-2.5e19).map(|n| n.to_string()), Some("-25000000000000000000".to_string()));
+    assert_eq!(BigInt::from_f64(f64::NAN), None);
+    assert_eq!(BigInt::from_f64(f64::NEG_INFINITY), None);
+    assert_eq!(eval_integer_string("(ceil -1e300)"), "-1000000000000000052504760255204420248704468581108159154915854115511802457988908195786371375080447864043704443832883878176942523235360430575644792184786706982848387200926575803737830233794788090059368953234970799945081119038967640880074652742780142494579258788820056842838115669472196386865459400540160");
+}
+
+#[test]
+fn test_rounding_nan_or_infinity_is_a_located_error() {
+    let cases = [
+        ("floor", format!("(- {} {})", INF, INF), "+nan.0"),
+        ("ceil", INF.to_string(), "+inf.0"),
+        ("round", format!("(- 0.0 {})", INF), "-inf.0"),
+    ];
+    for (name, arg, shown) in cases {
+        let source = format!("(define x {})\n(handler-case (+ 1 ({} x)) (catch (e) (list (map-get e 'message) (map-get e 'line) (map-get e 'column))))", arg, name);
+        let mut parser = Parser::new(&source);
+        let exprs = parser.parse_all().unwrap();
+        let mut compiler = Compiler::new();
+        let (functions, main) = compiler.compile_program(&exprs).unwrap();
+        let mut vm = VM::new();
+        vm.functions.extend(functions);
+        vm.current_bytecode = main.into();
+        vm.source_maps = compiler.source_maps();
+        vm.run().unwrap();
+        let message = Value::string(format!("Type error: '{}' expects a finite number, got {}", name, shown));
+        assert_eq!(vm.value_stack.last(), Some(&Value::List(lisp_bytecode_vm::List::from_vec(vec![
+            message, Value::Integer(2), Value::Integer(20),
+        ]))));
+    }
+}
+
+// ============================================================================
+// Serialization
+// ============================================================================
+
+#[test]
+fn test_serialize_bignum_constant() {
+    let big = BigInt::from_i64(i64::MAX).mul(&BigInt::from_i64(-3));
+    let main = vec![Instruction::Push(Value::from_bigint(big.clone())), Instruction::Halt];
+
+    let bytes = bytecode::serialize_bytecode(&HashMap::new(), &main);
+    let (_, loaded_main) = bytecode::deserialize_bytecode(&bytes).unwrap();
+
+    assert_eq!(loaded_main[0], Instruction::Push(Value::from_bigint(big)));
+}
@@ -0,0 +1,111 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value, RuntimeError};
+
+fn run(source: &str) -> Result<Value, RuntimeError> {
+    let mut parser = Parser::new_with_file(source, "bits.lisp".to_string());
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm.run()?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+/// Run with every operand behind a variable, so nothing folds at compile time
+fn run_unfolded(expr: &str, a: &str, b: &str) -> Value {
+    run(&format!("(define a {}) (define b {}) {}", a, b, expr)).unwrap()
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+fn compile_error(source: &str) -> String {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    Compiler::new().compile_program(&exprs).unwrap_err().message
+}
+
+#[test]
+fn test_and_or_xor_not_on_known_patterns() {
+    // 12 is 1100 and 10 is 1010
+    assert_eq!(run("(list (bit-and 12 10) (bit-or 12 10) (bit-xor 12 10) (bit-not 12))").unwrap(), ints(&[8, 14, 6, -13]));
+    assert_eq!(run_unfolded("(list (bit-and a b) (bit-or a b) (bit-xor a b) (bit-not a))", "12", "10"), ints(&[8, 14, 6, -13]));
+    assert_eq!(run("(list (bit-and 255 4660) (bit-or 61440 15) (bit-xor 255 255) (bit-not 0) (bit-not -1))").unwrap(),
+        ints(&[0x34, 0xF00F, 0, -1, 0]));
+    // Builtins are values too
+    assert_eq!(run("(list (reduce bit-or 0 '(1 2 4 8)) (map bit-not '(5 -6)))").unwrap(),
+        Value::List(List::from_vec(vec![Value::Integer(15), ints(&[-6, 5])])));
+}
+
+#[test]
+fn test_negative_numbers_are_twos_complement() {
+    assert_eq!(run_unfolded("(list (bit-and a b) (bit-or a b) (bit-xor a b))", "-1", "85"), ints(&[85, -1, -86]));
+    assert_eq!(run_unfolded("(list (bit-and a b) (bit-or a b) (bit-xor a b))", "-8", "-3"), ints(&[-8, -3, 5]));
+    // Clearing the low byte of a negative number
+    assert_eq!(run_unfolded("(bit-and a (bit-not 255))", "-1000", "0"), Value::Integer(-1024));
+}
+
+#[test]
+fn test_shift_left_multiplies_by_powers_of_two() {
+    assert_eq!(run("(list (shift-left 1 10) (shift-left 3 4) (shift-left -5 2) (shift-left 7 0) (shift-left 0 100))").unwrap(),
+        ints(&[1024, 48, -20, 7, 0]));
+    // Past 64 bits it promotes to a bignum, as * does
+    assert_eq!(run_unfolded("(= (shift-left a b) (* 4294967296 4294967296))", "1", "64"), Value::Boolean(true));
+    assert_eq!(run_unfolded("(= (shift-left a b) (* -3 (* 4294967296 4294967296)))", "-3", "64"), Value::Boolean(true));
+    assert_eq!(run("(shift-left 1 62)").unwrap(), Value::Integer(1 << 62));
+}
+
+#[test]
+fn test_shift_right_is_arithmetic() {
+    assert_eq!(run("(list (shift-right 1024 3) (shift-right 7 1) (shift-right -16 2) (shift-right -5 1) (shift-right -1 5))").unwrap(),
+        ints(&[128, 3, -4, -3, -1]));
+    // Shifting every bit out leaves only the sign
+    assert_eq!(run_unfolded("(list (shift-right a 64) (shift-right b 64) (shift-right a 1000))", "12345", "-12345"), ints(&[0, -1, 0]));
+    assert_eq!(run_unfolded("(shift-right (shift-left a 100) 100)", "-37", "0"), Value::Integer(-37));
+    assert_eq!(run_unfolded("(shift-right (neg (shift-left a 70)) 68)", "5", "0"), Value::Integer(-20));
+    assert_eq!(run_unfolded("(shift-right (- 1 (shift-left a 70)) 69)", "1", "0"), Value::Integer(-2));
+}
+
+#[test]
+fn test_bignums_combine_bit_by_bit() {
+    let source = r#"
+        (define big (+ (shift-left 1 80) 5))
+        (list (bit-and big 7) (= (bit-or big 2) (+ big 2)) (= (bit-xor big big) 0)
+              (bit-and (bit-not big) 7) (bit-and (neg big) 255) (= (bit-not (bit-not big)) big)
+              (= (bit-and big (neg (shift-left 1 80))) (shift-left 1 80)))
+    "#;
+    assert_eq!(run(source).unwrap(), Value::List(List::from_vec(vec![
+        Value::Integer(5), Value::Boolean(true), Value::Boolean(true),
+        Value::Integer(2), Value::Integer(251), Value::Boolean(true), Value::Boolean(true),
+    ])));
+}
+
+#[test]
+fn test_non_integers_are_rejected_at_the_call() {
+    let err = run("(define x 1.5)\n  (bit-and x 3)").unwrap_err();
+    assert_eq!(err.message, "Type error: 'bit-and' expects two integers, got float and integer");
+    assert_eq!(err.location.map(|l| (l.line, l.column)), Some((2, 3)));
+    assert_eq!(run("(bit-not \"1\")").unwrap_err().message, "Type error: 'bit-not' expects an integer, got string");
+    assert_eq!(run("(define n '(1)) (shift-right 8 n)").unwrap_err().message,
+        "Type error: 'shift-right' expects two integers, got integer and list");
+    assert_eq!(run("(handler-case (bit-or 'a 1) (catch (e) (hash-ref e 'line)))").unwrap(), Value::Integer(1));
+}
+
+#[test]
+fn test_negative_shift_counts_are_errors() {
+    let err = run("(define n -1)\n(shift-left 1 n)").unwrap_err();
+    assert_eq!(err.message, "'shift-left' can't shift by a negative count: -1");
+    assert_eq!(err.location.map(|l| (l.line, l.column)), Some((2, 1)));
+    assert_eq!(run("(define n -3) (shift-right 8 n)").unwrap_err().message, "'shift-right' can't shift by a negative count: -3");
+    // A literal count is caught when the call is compiled
+    assert_eq!(compile_error("(shift-right 8 -2)"), "'shift-right' can't shift by a negative count: -2");
+}
+
+#[test]
+fn test_bitwise_builtins_check_their_arguments() {
+    assert_eq!(compile_error("(bit-and 1)"), "bit-and expects exactly 2 arguments: (bit-and a b)");
+    assert_eq!(compile_error("(bit-not 1 2)"), "bit-not expects exactly 1 argument: (bit-not a)");
+    assert_eq!(compile_error("(shift-left 1 2 3)"), "shift-left expects exactly 2 arguments: (shift-left a count)");
+}
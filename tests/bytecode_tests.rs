@@ -225,3 +225,85 @@ fn test_serialize_large_numbers() {
     assert!(matches!(loaded_main[0], Instruction::Push(Value::Integer(i64::MAX))));
     assert!(matches!(loaded_main[1], Instruction::Push(Value::Integer(i64::MIN))));
 }
+
+#[test]
+fn test_deserialize_rejects_other_version() {
+    let mut bytes = bytecode::serialize_bytecode(&HashMap::new(), &[Instruction::Halt]);
+    bytes[4] = bytecode::BYTECODE_VERSION - 1;
+
+    let err = bytecode::deserialize_bytecode(&bytes).unwrap_err();
+    assert!(err.contains("Unsupported bytecode version"), "got: {}", err);
+    assert!(err.contains(&format!("expected {}", bytecode::BYTECODE_VERSION)), "got: {}", err);
+    assert!(err.contains("recompile"), "got: {}", err);
+}
+
+#[test]
+fn test_deserialize_rejects_truncated_header() {
+    let err = bytecode::deserialize_bytecode(b"LISP").unwrap_err();
+    assert!(err.contains("missing version"), "got: {}", err);
+}
+
+#[test]
+fn test_compiled_program_round_trip_runs_identically() {
+    use lisp_bytecode_vm::{Compiler, VM, parser::Parser};
+
+    // Tail calls, nested closures capturing outer variables and quoted constants
+    let source = r#"
+        (defun count-down (n acc) (if (<= n 0) acc (count-down (- n 1) (+ acc 1))))
+        (defun make-adder (x) (lambda (y) (lambda (z) (+ x y z))))
+        (defun tags () '(a (b 1.5) "c"))
+        (list (count-down 10000 0) (((make-adder 1) 2) 3) (tags))
+    "#;
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+
+    let bytes = bytecode::serialize_bytecode(&functions, &main);
+    let (loaded_functions, loaded_main) = bytecode::deserialize_bytecode(&bytes).unwrap();
+    assert_eq!(loaded_functions, functions);
+    assert_eq!(loaded_main, main);
+    assert!(loaded_functions["count-down"].iter().any(|i| matches!(i, Instruction::TailCall(_, _))));
+
+    let run = |functions: HashMap<String, Vec<Instruction>>, main: Vec<Instruction>| {
+        let mut vm = VM::new();
+        vm.functions.extend(functions);
+        vm.current_bytecode = main.into();
+        vm.run().map_err(|e| e.message).unwrap();
+        vm.value_stack.last().cloned()
+    };
+    let expected = run(functions, main);
+    assert!(expected.is_some());
+    assert_eq!(run(loaded_functions, loaded_main), expected);
+}
+
+#[test]
+fn test_pattern_matching_program_round_trip() {
+    use lisp_bytecode_vm::{Compiler, VM, parser::Parser};
+
+    let source = r#"
+        (defun len ((()) 0) (((_ . t)) (+ 1 (len t))))
+        (defun fact ((0 acc) acc) ((n acc) (fact (- n 1) (* n acc))))
+        (defun classify ((0) 'zero) (((h . _)) h) ((_) 'other))
+        (list (len '(1 2 3)) (fact 20 1) (classify 0) (classify '(x y)) (classify 5))
+    "#;
+    let exprs = Parser::new_with_file(source, "patterns.lisp".to_string()).parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    let source_maps = compiler.source_maps();
+
+    let bytes = bytecode::serialize_bytecode_with_source_maps(&functions, &main, &source_maps);
+    let (loaded_functions, loaded_main, loaded_maps) = bytecode::deserialize_bytecode_with_source_maps(&bytes).unwrap();
+    assert_eq!(loaded_functions, functions);
+    assert_eq!(loaded_main, main);
+    assert_eq!(loaded_maps.functions["fact"].entries(), source_maps.functions["fact"].entries());
+
+    let run = |functions: HashMap<String, Vec<Instruction>>, main: Vec<Instruction>| {
+        let mut vm = VM::new();
+        vm.functions.extend(functions);
+        vm.current_bytecode = main.into();
+        vm.run().map_err(|e| e.message).unwrap();
+        vm.value_stack
+    };
+    let expected = run(functions, main);
+    assert_eq!(expected.len(), 1);
+    assert_eq!(run(loaded_functions, loaded_main), expected);
+}
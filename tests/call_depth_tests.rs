@@ -0,0 +1,130 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, RuntimeError, Value};
+
+fn run_with_depth(source: &str, max_depth: Option<usize>) -> Result<Value, RuntimeError> {
+    run_with_limits(source, max_depth, None)
+}
+
+fn run_with_limits(source: &str, max_depth: Option<usize>, max_stack: Option<usize>) -> Result<Value, RuntimeError> {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    if let Some(depth) = max_depth {
+        vm.max_call_depth = depth;
+    }
+    if let Some(values) = max_stack {
+        vm.max_value_stack = values;
+    }
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm.run()?;
+    Ok(vm.value_stack.last().cloned().unwrap())
+}
+
+fn run(source: &str) -> Result<Value, RuntimeError> {
+    run_with_depth(source, None)
+}
+
+const COUNT_DOWN: &str = "(defun count-down (n) (if (= n 0) 0 (+ 1 (count-down (- n 1)))))";
+
+#[test]
+fn test_default_limit_stops_deep_recursion() {
+    assert_eq!(VM::new().max_call_depth, 10000);
+    let err = run(&format!("{} (count-down 100000)", COUNT_DOWN)).unwrap_err();
+    assert_eq!(err.message, "Stack depth exceeded: calling 'count-down' would nest more than 10000 calls");
+    // Recursion within the limit is unaffected
+    assert_eq!(run(&format!("{} (count-down 5000)", COUNT_DOWN)).unwrap(), Value::Integer(5000));
+}
+
+#[test]
+fn test_limit_is_configurable() {
+    let source = format!("{} (count-down 300)", COUNT_DOWN);
+    assert!(run_with_depth(&source, Some(100)).is_err());
+    assert_eq!(run_with_depth(&source, Some(1000)).unwrap(), Value::Integer(300));
+    let deep = format!("{} (count-down 100000)", COUNT_DOWN);
+    assert_eq!(run_with_depth(&deep, Some(200000)).unwrap(), Value::Integer(100000));
+}
+
+#[test]
+fn test_tail_calls_do_not_count_towards_the_limit() {
+    let source = "(defun spin (n) (if (= n 0) 'done (spin (- n 1)))) (spin 100000)";
+    assert_eq!(run_with_depth(source, Some(50)).unwrap(), Value::symbol("done"));
+}
+
+#[test]
+fn test_exceeding_the_limit_is_catchable() {
+    let source = format!(r#"
+        {}
+        (list (handler-case (count-down 100000) (catch (e) (hash-ref e 'message)))
+              (count-down 10))
+    "#, COUNT_DOWN);
+    let message = Value::string("Stack depth exceeded: calling 'count-down' would nest more than 10000 calls");
+    assert_eq!(run(&source).unwrap(), Value::List(List::from_vec(vec![message, Value::Integer(10)])));
+}
+
+#[test]
+fn test_error_shows_the_call_chain_compactly() {
+    let source = format!("(defun outer () (+ 1 (count-down 50))) {} (outer)", COUNT_DOWN);
+    let err = run_with_depth(&source, Some(20)).unwrap_err();
+    assert_eq!(err.call_stack, vec!["outer".to_string(), "count-down (x19)".to_string()]);
+    let output = err.format();
+    assert!(output.contains("│ #0: count-down (x19)\n│ #1: outer\n"), "got:\n{}", output);
+
+    // Mutual recursion has no runs to fold, so only the ends of the chain are kept
+    let source = r#"
+        (defun ping (n) (+ 1 (pong n)))
+        (defun pong (n) (+ 1 (ping n)))
+        (ping 0)
+    "#;
+    let err = run_with_depth(source, Some(100)).unwrap_err();
+    assert_eq!(err.call_stack.len(), 21);
+    assert_eq!(err.call_stack[10], "... 80 frames omitted ...");
+    assert_eq!(err.call_stack[0], "ping");
+    assert_eq!(err.call_stack[20], "pong");
+}
+
+#[test]
+fn test_long_chains_show_how_many_frames_were_omitted() {
+    let source = r#"
+        (defun ping (n) (+ 1 (pong n)))
+        (defun pong (n) (+ 1 (ping n)))
+        (ping 0)
+    "#;
+    let err = run_with_depth(source, Some(50000)).unwrap_err();
+    assert_eq!(err.call_stack.len(), 21);
+    assert_eq!(err.call_stack[10], "... 49,980 frames omitted ...");
+}
+
+#[test]
+fn test_value_stack_limit_is_configurable() {
+    assert_eq!(VM::new().max_value_stack, 1_000_000);
+    // Deep enough to fill the value stack long before the call stack
+    let source = format!("{} (count-down 100000)", COUNT_DOWN);
+    let err = run_with_limits(&source, Some(1_000_000), Some(1000)).unwrap_err();
+    assert_eq!(err.message, "Stack depth exceeded: calling 'count-down' with more than 1000 values on the value stack");
+    assert_eq!(run_with_limits(&source, Some(1_000_000), None).unwrap(), Value::Integer(100000));
+}
+
+#[test]
+fn test_runaway_factorial_fails_without_taking_the_process_down() {
+    let source = r#"
+        (defun factorial (n) (if (= n 0) 1 (* n (factorial (- n 1)))))
+        (list (handler-case (factorial 1000000) (catch (e) 'overflowed))
+              (factorial 5))
+    "#;
+    assert_eq!(run(source).unwrap(), Value::List(List::from_vec(vec![Value::symbol("overflowed"), Value::Integer(120)])));
+    let err = run("(defun factorial (n) (if (= n 0) 1 (* n (factorial (- n 1))))) (factorial 1000000)").unwrap_err();
+    assert_eq!(err.message, "Stack depth exceeded: calling 'factorial' would nest more than 10000 calls");
+    assert_eq!(err.call_stack, vec!["factorial (x10000)".to_string()]);
+}
+
+#[test]
+fn test_tail_recursive_factorial_of_the_same_depth_succeeds() {
+    // Kept modulo a prime so the product stays a fixnum
+    let source = r#"
+        (defun factorial-mod (n acc) (if (= n 0) acc (factorial-mod (- n 1) (% (* acc n) 1000000007))))
+        (factorial-mod 1000000 1)
+    "#;
+    assert_eq!(run(source).unwrap(), Value::Integer(641102369));
+}
@@ -0,0 +1,154 @@
+use lisp_bytecode_vm::{bytecode, Compiler, VM, parser::Parser, Instruction, List, Value};
+
+fn compile(source: &str) -> Result<(std::collections::HashMap<String, Vec<Instruction>>, Vec<Instruction>), String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    Compiler::new().compile_program(&exprs).map_err(|e| e.message)
+}
+
+fn run_vm(source: &str) -> Result<VM, String> {
+    let (functions, main) = compile(source)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+fn run(source: &str) -> Result<Option<Value>, String> {
+    Ok(run_vm(source)?.value_stack.last().cloned())
+}
+
+fn symbols(names: &[&str]) -> Value {
+    Value::List(List::from_vec(names.iter().map(|name| Value::symbol(name)).collect()))
+}
+
+fn has_jump_table(instructions: &[Instruction]) -> bool {
+    instructions.iter().any(|instr| matches!(instr, Instruction::JumpTable(_, _, _)))
+}
+
+const DIGITS: &str = r#"
+    (defun name (n)
+      (case n
+        (0 'zero)
+        (1 'one)
+        ((2 3) 'few)
+        (5 'five)
+        (else 'many)))
+"#;
+
+#[test]
+fn test_dense_integer_keys_use_a_jump_table() {
+    let source = format!("{} (list (name 0) (name 1) (name 2) (name 3) (name 4) (name 5) (name 6) (name -1))", DIGITS);
+    let expected = symbols(&["zero", "one", "few", "few", "many", "five", "many", "many"]);
+    assert_eq!(run(&source), Ok(Some(expected)));
+
+    let (functions, _) = compile(DIGITS).unwrap();
+    assert!(has_jump_table(&functions["name"]), "got: {:?}", functions["name"]);
+}
+
+#[test]
+fn test_keys_that_are_not_integers_fall_through_the_table() {
+    // An integral float selects its integer's clause, as it would with =
+    let source = format!("{} (list (name 2.0) (name 2.5) (name 'two) (name \"2\"))", DIGITS);
+    assert_eq!(run(&source), Ok(Some(symbols(&["few", "many", "many", "many"]))));
+}
+
+#[test]
+fn test_small_or_sparse_cases_compare_keys_in_order() {
+    let source = "(defun size (n) (case n (1 'small) (1000 'large) (else 'other))) (list (size 1) (size 1000) (size 7))";
+    assert_eq!(run(source), Ok(Some(symbols(&["small", "large", "other"]))));
+
+    let (functions, _) = compile("(defun size (n) (case n (1 'a) (2 'b) (1000 'c) (2000 'd)))").unwrap();
+    assert!(!has_jump_table(&functions["size"]), "got: {:?}", functions["size"]);
+}
+
+#[test]
+fn test_symbol_boolean_and_string_keys() {
+    let source = r#"
+        (defun kind (x) (case x ((red green blue) 'color) (circle 'shape) (true 'yes) ("hi" 'greeting) (else 'unknown)))
+        (list (kind 'green) (kind 'circle) (kind true) (kind "hi") (kind 'hi) (kind 'else) (kind 3))
+    "#;
+    assert_eq!(run(source), Ok(Some(symbols(&["color", "shape", "yes", "greeting", "unknown", "unknown", "unknown"]))));
+}
+
+#[test]
+fn test_no_match_without_else_is_nil() {
+    assert_eq!(run("(case 9 (1 'one) (2 'two))"), Ok(Some(Value::List(List::Nil))));
+    assert_eq!(run("(case 9 (1 'a) (2 'b) (3 'c) (4 'd))"), Ok(Some(Value::List(List::Nil))));
+    assert_eq!(run("(case 'x)"), Ok(Some(Value::List(List::Nil))));
+}
+
+#[test]
+fn test_first_clause_with_a_key_wins() {
+    let first = Value::symbol("first");
+    assert_eq!(run("(case 2 (1 'a) (2 'first) (3 'c) (2 'second) (4 'd))"), Ok(Some(first.clone())));
+    assert_eq!(run("(case 'k (k 'first) (k 'second))"), Ok(Some(first)));
+}
+
+#[test]
+fn test_key_is_evaluated_once() {
+    for keys in ["(1 'one) (2 'two)", "(1 'one) (2 'two) (3 'three) (4 'four)"] {
+        let source = format!(r#"
+            (define calls 0)
+            (defun next () (set! calls (+ calls 1)) 2)
+            (define result (case (next) {}))
+            (list result calls)
+        "#, keys);
+        let expected = Value::List(List::from_vec(vec![Value::symbol("two"), Value::Integer(1)]));
+        assert_eq!(run(&source), Ok(Some(expected)));
+    }
+}
+
+#[test]
+fn test_case_inside_expressions_leaves_the_stack_balanced() {
+    // Both lowerings, below an operand and with locals bound in a body
+    let source = r#"
+        (define total 0)
+        (dotimes (i 1000)
+          (set! total (+ total (+ (case (% i 3) ((0) 1) (else (let ((k 2)) k)))
+                                  (case (% i 5) (0 10) (1 20) (2 30) (3 40) (else 50))))))
+        total
+    "#;
+    let vm = run_vm(source).unwrap();
+    // % i 3 gives 334 zeros; % i 5 cycles through every clause 200 times
+    assert_eq!(vm.value_stack, vec![Value::Integer(334 + 666 * 2 + 200 * 150)]);
+}
+
+#[test]
+fn test_clause_bodies_are_tail_calls() {
+    let source = r#"
+        (defun walk (n acc)
+          (case (% n 4)
+            (0 (if (= n 0) acc (walk (- n 1) (+ acc 1))))
+            (1 (walk (- n 1) acc))
+            (2 (walk (- n 1) (+ acc 2)))
+            (3 (walk (- n 1) acc))))
+        (walk 200000 0)
+    "#;
+    assert_eq!(run(source), Ok(Some(Value::Integer(150000))));
+
+    let source = "(defun down (n) (case n (0 'done) (else (down (- n 1))))) (down 200000)";
+    assert_eq!(run(source), Ok(Some(Value::symbol("done"))));
+}
+
+#[test]
+fn test_jump_table_round_trips_through_bytecode() {
+    let (functions, main) = compile(&format!("{} (list (name 3) (name 8))", DIGITS)).unwrap();
+    let bytes = bytecode::serialize_bytecode(&functions, &main);
+    let (loaded_functions, loaded_main) = bytecode::deserialize_bytecode(&bytes).unwrap();
+    assert_eq!(loaded_functions, functions);
+    assert_eq!(loaded_main, main);
+}
+
+#[test]
+fn test_malformed_case() {
+    let err = run("(case)").unwrap_err();
+    assert_eq!(err, "case expects a key and clauses: (case key (keys body...) ... (else body...))");
+    let err = run("(case 1 (1))").unwrap_err();
+    assert_eq!(err, "case clause expects (keys body...)");
+    let err = run("(case 1 (else 'a) (1 'b))").unwrap_err();
+    assert_eq!(err, "else clause must be the last clause in case");
+    let err = run("(case 1 (1.5 'a))").unwrap_err();
+    assert_eq!(err, "case keys must be integers, booleans, strings or symbols");
+}
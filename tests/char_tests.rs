@@ -0,0 +1,206 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, LispExpr, List, Value};
+use lisp_bytecode_vm::vm::value::format_char;
+
+fn run(source: &str) -> Result<Option<Value>, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+    let (functions, main) = Compiler::new().compile_program(&exprs).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned())
+}
+
+fn parse(source: &str) -> Result<LispExpr, String> {
+    Parser::new(source).parse_all().map(|exprs| exprs[0].expr.clone())
+}
+
+fn chars(values: &[char]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|c| Value::Char(*c)).collect()))
+}
+
+// ============================================================================
+// Literals
+// ============================================================================
+
+#[test]
+fn test_char_literals() {
+    assert_eq!(run("#\\a"), Ok(Some(Value::Char('a'))));
+    assert_eq!(run("#\\space"), Ok(Some(Value::Char(' '))));
+    assert_eq!(run("#\\newline"), Ok(Some(Value::Char('\n'))));
+    assert_eq!(run("#\\tab"), Ok(Some(Value::Char('\t'))));
+    assert_eq!(run("#\\x41"), Ok(Some(Value::Char('A'))));
+    assert_eq!(run("#\\λ"), Ok(Some(Value::Char('λ'))));
+    // A single letter is the character itself, not a name
+    assert_eq!(run("#\\x"), Ok(Some(Value::Char('x'))));
+}
+
+#[test]
+fn test_delimiters_can_be_chars() {
+    assert_eq!(run("(list #\\( #\\) #\\; #\\\" #\\')"), Ok(Some(chars(&['(', ')', ';', '"', '\'']))));
+    assert_eq!(run("(list #\\  #\\a)"), Ok(Some(chars(&[' ', 'a']))));
+    // After its first character a char literal runs to the next delimiter
+    assert_eq!(run("(list #\\a)"), Ok(Some(chars(&['a']))));
+    assert_eq!(run("(list #\\ab)").unwrap_err(), "Unknown character name: #\\ab at line 1, column 7");
+    assert_eq!(run("'(#\\a)"), Ok(Some(chars(&['a']))));
+}
+
+#[test]
+fn test_chars_are_not_strings() {
+    assert_eq!(run("(equal? #\\a \"a\")"), Ok(Some(Value::Boolean(false))));
+    assert_eq!(run("(equal? #\\a #\\a)"), Ok(Some(Value::Boolean(true))));
+    assert_eq!(run("(type-of #\\a)"), Ok(Some(Value::symbol("char"))));
+}
+
+#[test]
+fn test_unknown_char_names() {
+    assert_eq!(parse("#\\bogus").unwrap_err(), "Unknown character name: #\\bogus at line 1, column 1");
+    assert_eq!(parse("#\\xzz").unwrap_err(), "Unknown character name: #\\xzz at line 1, column 1");
+}
+
+// ============================================================================
+// Builtins
+// ============================================================================
+
+#[test]
+fn test_char_integer_conversions() {
+    assert_eq!(run("(char->integer #\\a)"), Ok(Some(Value::Integer(97))));
+    assert_eq!(run("(char->integer #\\newline)"), Ok(Some(Value::Integer(10))));
+    assert_eq!(run("(integer->char 955)"), Ok(Some(Value::Char('λ'))));
+    assert_eq!(run("(integer->char (+ (char->integer #\\a) 1))"), Ok(Some(Value::Char('b'))));
+}
+
+#[test]
+fn test_char_eq() {
+    assert_eq!(run("(char=? #\\a #\\a)"), Ok(Some(Value::Boolean(true))));
+    assert_eq!(run("(char=? #\\a #\\A)"), Ok(Some(Value::Boolean(false))));
+    // Reached through a function value as well as inline
+    assert_eq!(run("(apply char=? (list #\\z #\\z))"), Ok(Some(Value::Boolean(true))));
+}
+
+#[test]
+fn test_string_ref_returns_chars() {
+    assert_eq!(run("(string-ref \"hello\" 1)"), Ok(Some(Value::Char('e'))));
+    // Indices count characters, not bytes
+    assert_eq!(run("(string-ref \"añb\" 2)"), Ok(Some(Value::Char('b'))));
+    let source = r#"
+        (defun digits (s i acc)
+          (if (= i (string-length s)) acc
+            (digits s (+ i 1) (+ (* acc 10) (- (char->integer (string-ref s i)) (char->integer #\0))))))
+        (digits "4096" 0 0)
+    "#;
+    assert_eq!(run(source), Ok(Some(Value::Integer(4096))));
+}
+
+#[test]
+fn test_char_builtin_errors() {
+    assert_eq!(run("(char->integer \"a\")").unwrap_err(), "Type error: 'char->integer' expects a char, got string");
+    assert_eq!(run("(integer->char -1)").unwrap_err(), "'integer->char' expects a Unicode code point, got -1");
+    assert_eq!(run("(integer->char 55296)").unwrap_err(), "'integer->char' expects a Unicode code point, got 55296");
+    assert_eq!(run("(char=? #\\a \"a\")").unwrap_err(), "Type error: 'char=?' expects two chars, got char and string");
+    assert_eq!(run("(string-ref \"abc\" 3)").unwrap_err(), "'string-ref' index 3 out of bounds for string of length 3");
+    assert_eq!(run("(string-ref \"abc\" -1)").unwrap_err(), "'string-ref' index -1 out of bounds for string of length 3");
+}
+
+#[test]
+fn test_char_ordering() {
+    assert_eq!(run("(list (char<? #\\a #\\b) (char<? #\\b #\\a) (char<? #\\a #\\a))"),
+        Ok(Some(Value::List(List::from_vec(vec![Value::Boolean(true), Value::Boolean(false), Value::Boolean(false)])))));
+    // Code point order: uppercase sorts before lowercase
+    assert_eq!(run("(char<? #\\Z #\\a)"), Ok(Some(Value::Boolean(true))));
+    assert_eq!(run("(char<? #\\a 1)").unwrap_err(), "Type error: 'char<?' expects two chars, got char and integer");
+}
+
+#[test]
+fn test_char_classes() {
+    let classify = |c: &str| run(&format!("(list (char-alphabetic? {c}) (char-numeric? {c}) (char-whitespace? {c}))"));
+    let flags = |a, n, w| Ok(Some(Value::List(List::from_vec(vec![Value::Boolean(a), Value::Boolean(n), Value::Boolean(w)]))));
+    assert_eq!(classify("#\\q"), flags(true, false, false));
+    assert_eq!(classify("#\\7"), flags(false, true, false));
+    assert_eq!(classify("#\\space"), flags(false, false, true));
+    assert_eq!(classify("#\\newline"), flags(false, false, true));
+    assert_eq!(classify("#\\("), flags(false, false, false));
+    assert_eq!(classify("#\\λ"), flags(true, false, false));
+    assert_eq!(run("(char-numeric? \"7\")").unwrap_err(), "Type error: 'char-numeric?' expects a char, got string");
+}
+
+// ============================================================================
+// Strings as lists of chars
+// ============================================================================
+
+#[test]
+fn test_string_list_conversions_use_chars() {
+    assert_eq!(run("(string->list \"héy\")"), Ok(Some(chars(&['h', 'é', 'y']))));
+    assert_eq!(run("(string->list \"\")"), Ok(Some(Value::List(List::Nil))));
+    assert_eq!(run("(list->string (list #\\o #\\k))"), Ok(Some(Value::string("ok"))));
+    // Strings may still be mixed in
+    assert_eq!(run("(list->string (list \"ab\" #\\c))"), Ok(Some(Value::string("abc"))));
+    assert_eq!(run("(list->string (list #\\a 1))").unwrap_err(),
+        "Type error: 'list->string' expects a list of chars or strings, but found integer");
+    // char-code takes the chars string->list gives
+    assert_eq!(run("(char-code (car (string->list \"A\")))"), Ok(Some(Value::Integer(65))));
+}
+
+#[test]
+fn test_tokenizer_written_in_lisp() {
+    let source = r#"
+        (defun take-while (pred cs acc)
+          (if (null? cs) (list (reverse-chars acc '()) cs)
+            (if (pred (car cs)) (take-while pred (cdr cs) (cons (car cs) acc))
+              (list (reverse-chars acc '()) cs))))
+        (defun reverse-chars (cs acc)
+          (if (null? cs) acc (reverse-chars (cdr cs) (cons (car cs) acc))))
+        (defun tokens (cs)
+          (if (null? cs) '()
+            (let ((c (car cs)))
+              (if (char-whitespace? c) (tokens (cdr cs))
+                (if (char-numeric? c)
+                  (let ((split (take-while char-numeric? cs '())))
+                    (cons (string->number (list->string (car split))) (tokens (car (cdr split)))))
+                  (if (char-alphabetic? c)
+                    (let ((split (take-while char-alphabetic? cs '())))
+                      (cons (string->symbol (list->string (car split))) (tokens (car (cdr split)))))
+                    (cons c (tokens (cdr cs)))))))))
+        (tokens (string->list "(add 12 x3)"))
+    "#;
+    let expected = vec![
+        Value::Char('('), Value::symbol("add"), Value::Integer(12),
+        Value::symbol("x"), Value::Integer(3), Value::Char(')'),
+    ];
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(expected)))));
+}
+
+// ============================================================================
+// Printing
+// ============================================================================
+
+#[test]
+fn test_write_form_round_trips() {
+    for c in ['a', ' ', '\n', '\t', '\0', '(', '#', '\\', 'λ', '\u{1b}'] {
+        let written = format_char(c);
+        assert_eq!(parse(&written), Ok(LispExpr::Char(c)), "written as {}", written);
+    }
+    assert_eq!(format_char('a'), "#\\a");
+    assert_eq!(format_char(' '), "#\\space");
+    assert_eq!(format_char('\u{1b}'), "#\\x1b");
+}
+
+#[test]
+fn test_values_show_chars_in_write_form() {
+    let err = run("(assert-equal #\\a #\\space)").unwrap_err();
+    assert_eq!(err, "Assertion failed: (assert-equal #\\a #\\space): expected #\\a, got #\\space");
+    let err = run("(assert-equal \"a\" #\\a)").unwrap_err();
+    assert_eq!(err, "Assertion failed: (assert-equal \"a\" #\\a): expected \"a\", got #\\a");
+}
+
+#[test]
+fn test_display_form_is_the_bare_char() {
+    assert_eq!(run("(format \"[{}] [{}]\" (list #\\a #\\space))"), Ok(Some(Value::string("[a] [ ]"))));
+}
+
+#[test]
+fn test_char_builtins_check_their_arguments() {
+    assert_eq!(run("(char->integer)").unwrap_err(), "char->integer expects exactly 1 argument: (char->integer c)");
+    assert_eq!(run("(string-ref \"abc\")").unwrap_err(), "string-ref expects exactly 2 arguments: (string-ref s i)");
+}
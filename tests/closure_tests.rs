@@ -0,0 +1,297 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, List, Value};
+
+/// Helper function to compile and run source code
+fn compile_and_run(source: &str) -> Result<VM, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+/// Helper to compile source and return the named function's bytecode
+fn compile_function(source: &str, name: &str) -> Vec<Instruction> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, _) = compiler.compile_program(&exprs).unwrap();
+    functions[name].clone()
+}
+
+/// Helper to get integer result from VM
+fn get_int_result(vm: &VM) -> i64 {
+    match vm.value_stack.last() {
+        Some(Value::Integer(n)) => *n,
+        other => panic!("Expected integer result, got {:?}", other),
+    }
+}
+
+const MAKE_ADDER: &str = "(defun make-adder (n) (lambda (x) (+ x n)))";
+
+// ============================================================================
+// Capturing free variables
+// ============================================================================
+
+#[test]
+fn test_closure_remembers_argument() {
+    let source = format!("{} ((make-adder 5) 3)", MAKE_ADDER);
+    let vm = compile_and_run(&source).unwrap();
+    assert_eq!(get_int_result(&vm), 8);
+}
+
+#[test]
+fn test_capture_list_holds_only_free_variables() {
+    let source = "(defun make-adder (n unused) (lambda (x) (+ x n)))";
+    let bytecode = compile_function(source, "make-adder");
+    let closure = bytecode.iter().find_map(|instr| match instr {
+        Instruction::MakeClosure(params, _, captured) => Some((params.clone(), *captured)),
+        _ => None,
+    });
+    assert_eq!(closure, Some((vec!["x".to_string()], 1)));
+}
+
+#[test]
+fn test_closures_from_separate_calls_are_independent() {
+    let source = format!(r#"
+        {}
+        (let ((add1 (make-adder 1))
+              (add10 (make-adder 10)))
+          (list (add1 1) (add10 1) (add1 2)))
+    "#, MAKE_ADDER);
+    let vm = compile_and_run(&source).unwrap();
+    let expected = Value::List(List::from_vec(vec![Value::Integer(2), Value::Integer(11), Value::Integer(3)]));
+    assert_eq!(vm.value_stack.last(), Some(&expected));
+}
+
+#[test]
+fn test_closure_stored_in_global_is_callable() {
+    let source = format!(r#"
+        {}
+        (def add5 (make-adder 5))
+        (def add7 (make-adder 7))
+        (+ (add5 1) (add7 1))
+    "#, MAKE_ADDER);
+    let vm = compile_and_run(&source).unwrap();
+    assert_eq!(get_int_result(&vm), 14);
+}
+
+#[test]
+fn test_global_closure_tail_call() {
+    // A tail call through a global closure reuses the frame
+    let source = r#"
+        (def count-down (lambda (n) (if (= n 0) 0 (count-down (- n 1)))))
+        (defun run (n) (count-down n))
+        (run 100000)
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 0);
+}
+
+#[test]
+fn test_nested_closures_capture_every_level() {
+    let source = r#"
+        (defun make-adder3 (a) (lambda (b) (lambda (c) (+ a b c))))
+        (((make-adder3 1) 20) 300)
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 321);
+}
+
+#[test]
+fn test_closure_captures_let_binding() {
+    let source = r#"
+        (defun scaler (factor)
+          (let ((offset 100))
+            (lambda (x) (+ offset (* x factor)))))
+        ((scaler 3) 4)
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 112);
+}
+
+// ============================================================================
+// Mutable captured variables
+// ============================================================================
+
+const MAKE_COUNTER: &str = "(defun make-counter () (let ((n 0)) (lambda () (set! n (+ n 1)) n)))";
+
+#[test]
+fn test_counter_increments_across_calls() {
+    let source = format!("{} (let ((c (make-counter))) (do (c) (c) (c)))", MAKE_COUNTER);
+    let vm = compile_and_run(&source).unwrap();
+    assert_eq!(get_int_result(&vm), 3);
+}
+
+#[test]
+fn test_counters_from_factory_are_independent() {
+    // Each call to make-counter has returned before its counter is used
+    let source = format!(r#"
+        {}
+        (def c1 (make-counter))
+        (def c2 (make-counter))
+        (c1) (c1) (c2)
+        (list (c1) (c2) (c1))
+    "#, MAKE_COUNTER);
+    let vm = compile_and_run(&source).unwrap();
+    let expected = Value::List(List::from_vec(vec![Value::Integer(3), Value::Integer(2), Value::Integer(4)]));
+    assert_eq!(vm.value_stack.last(), Some(&expected));
+}
+
+#[test]
+fn test_closures_from_same_let_share_cell() {
+    let source = r#"
+        (defun make-pair ()
+          (let ((n 0))
+            (list (lambda () (set! n (+ n 1))) (lambda () n))))
+        (let ((pair (make-pair)))
+          (do ((car pair)) ((car pair)) ((car (cdr pair)))))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 2);
+}
+
+#[test]
+fn test_closures_sharing_a_counter_see_each_others_increments() {
+    let source = r#"
+        (defun make-counters ()
+          (let ((n 0))
+            (list (lambda () (set! n (+ n 1)) n)
+                  (lambda () (set! n (+ n 10)) n))))
+        (let ((counters (make-counters)))
+          (let ((by-one (car counters)) (by-ten (car (cdr counters))))
+            (list (by-one) (by-ten) (by-one) (by-ten))))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    let expected = Value::List(List::from_vec(vec![Value::Integer(1), Value::Integer(11), Value::Integer(12), Value::Integer(22)]));
+    assert_eq!(vm.value_stack.last(), Some(&expected));
+}
+
+#[test]
+fn test_captured_loop_variable_can_be_assigned() {
+    let source = "(defun f () (loop ((n 0)) (let ((inc (lambda () (set! n (+ n 1))))) (do (inc) (inc) n)))) (f)";
+    assert_eq!(get_int_result(&compile_and_run(source).unwrap()), 2);
+    // recur makes a fresh cell, so each closure keeps the variable of its own iteration
+    let source = r#"
+        (loop ((i 0) (fs '()))
+          (if (< i 3)
+            (recur (+ i 1) (cons (lambda () (set! i (* i 10)) i) fs))
+            (list (map (lambda (f) (f)) fs) i)))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    let tens = Value::List(List::from_vec(vec![Value::Integer(20), Value::Integer(10), Value::Integer(0)]));
+    assert_eq!(vm.value_stack.last(), Some(&Value::List(List::from_vec(vec![tens, Value::Integer(3)]))));
+}
+
+#[test]
+fn test_named_let_body_can_assign_enclosing_variables() {
+    // The body of a named let is compiled as a lambda, which captures n
+    let source = "(let ((n 0)) (let walk ((i 0)) (if (< i 4) (do (set! n (+ n i)) (walk (+ i 1))) n)))";
+    assert_eq!(get_int_result(&compile_and_run(source).unwrap()), 6);
+}
+
+#[test]
+fn test_assignment_in_frame_is_seen_by_closure() {
+    let source = r#"
+        (let ((k 1))
+          (let ((get-k (lambda () k)))
+            (do (set! k 5) (get-k))))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 5);
+}
+
+#[test]
+fn test_captured_parameter_can_be_assigned() {
+    let source = r#"
+        (defun make-accumulator (total) (lambda (x) (set! total (+ total x))))
+        (let ((acc (make-accumulator 100)))
+          (do (acc 10) (acc 5)))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 115);
+}
+
+#[test]
+fn test_set_uncaptured_locals_and_parameters() {
+    let vm = compile_and_run("(defun bump (x) (do (set! x (+ x 1)) (* x 2))) (bump 4)").unwrap();
+    assert_eq!(get_int_result(&vm), 10);
+
+    let vm = compile_and_run("(let ((v 1)) (do (set! v 7) v))").unwrap();
+    assert_eq!(get_int_result(&vm), 7);
+}
+
+#[test]
+fn test_only_mutated_captures_get_cells() {
+    let bytecode = compile_function(MAKE_COUNTER, "make-counter");
+    assert!(bytecode.contains(&Instruction::MakeCell), "got: {:?}", bytecode);
+
+    let bytecode = compile_function("(defun make-getter () (let ((n 0)) (lambda () n)))", "make-getter");
+    assert!(!bytecode.contains(&Instruction::MakeCell), "got: {:?}", bytecode);
+
+    // Assigned but never captured: a plain stack slot is enough
+    let bytecode = compile_function("(defun f () (let ((n 0)) (do (set! n 1) n)))", "f");
+    assert!(!bytecode.contains(&Instruction::MakeCell), "got: {:?}", bytecode);
+}
+
+#[test]
+fn test_set_unbound_variable_is_compile_error() {
+    let err = compile_and_run("(set! nowhere 1)").err().expect("expected an error");
+    assert!(err.contains("Cannot set! 'nowhere'"), "got: {}", err);
+    assert!(err.contains("not bound in any enclosing scope"), "got: {}", err);
+}
+
+#[test]
+fn test_set_error_points_at_the_name() {
+    let source = "(defun f (x)\n  (set! y x))";
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let err = Compiler::new().compile_program(&exprs).unwrap_err();
+    assert_eq!((err.location.line, err.location.column), (2, 9));
+    let output = err.format(Some(source));
+    assert!(output.contains("│    2 │   (set! y x))\n│      │         ^\n"), "got:\n{}", output);
+}
+
+#[test]
+fn test_set_of_function_name_is_compile_error() {
+    let err = compile_and_run("(defun bump () 1) (defun reset () (set! bump 0))").err().expect("expected an error");
+    assert_eq!(err, "Cannot set! 'bump': it names a function, not a variable");
+    let err = compile_and_run("(set! car 1)").err().expect("expected an error");
+    assert_eq!(err, "Cannot set! 'car': it names a function, not a variable");
+}
+
+#[test]
+fn test_set_reassigns_defined_global() {
+    let source = r#"
+        (define total 0)
+        (defun add! (x) (set! total (+ total x)))
+        (add! 3)
+        (list (add! 4) total)
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    let expected = Value::List(List::from_vec(vec![Value::Integer(7), Value::Integer(7)]));
+    assert_eq!(vm.value_stack.last(), Some(&expected));
+    assert_eq!(vm.global_vars.get("total"), Some(&Value::Integer(7)));
+}
+
+#[test]
+fn test_set_of_def_constant_is_compile_error() {
+    let err = compile_and_run("(def limit 1) (set! limit 2)").err().expect("expected an error");
+    assert!(err.contains("Cannot set! constant 'limit'"), "got: {}", err);
+
+    // Also when the function assigning it is compiled before the def
+    let err = compile_and_run("(defun raise-limit () (set! limit 2)) (def limit 1)").err().expect("expected an error");
+    assert!(err.contains("Cannot set! constant 'limit'"), "got: {}", err);
+}
+
+#[test]
+fn test_local_shadows_global_in_set() {
+    let source = "(define n 1) (defun f (n) (set! n 5)) (list (f 0) n)";
+    let vm = compile_and_run(source).unwrap();
+    let expected = Value::List(List::from_vec(vec![Value::Integer(5), Value::Integer(1)]));
+    assert_eq!(vm.value_stack.last(), Some(&expected));
+}
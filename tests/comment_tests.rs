@@ -0,0 +1,78 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value, CompileError};
+
+fn compile(source: &str) -> Result<(std::collections::HashMap<String, Vec<lisp_bytecode_vm::Instruction>>, Vec<lisp_bytecode_vm::Instruction>), CompileError> {
+    let exprs = Parser::new_with_file(source, "comments.lisp".to_string()).parse_all().unwrap();
+    Compiler::new().compile_program(&exprs)
+}
+
+fn run(source: &str) -> Value {
+    let (functions, main) = compile(source).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().unwrap();
+    vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil))
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+#[test]
+fn test_line_comments_inside_nested_forms() {
+    let source = r#"
+        (defun f (x) ; the argument
+          (let ((y (* x 2))) ; doubled
+            (list x ; first
+                  y))) ; last
+        (f 3)
+    "#;
+    assert_eq!(run(source), ints(&[3, 6]));
+}
+
+#[test]
+fn test_block_comments_nest_and_span_lines() {
+    let source = r#"
+        #|
+          (defun f (x) (car))   ; would not compile
+          #| a nested comment |#
+          (print "still inside")
+        |#
+        (list 1 #| two |# 3)
+    "#;
+    assert_eq!(run(source), ints(&[1, 3]));
+}
+
+#[test]
+fn test_compile_error_after_block_comment_points_at_the_form() {
+    let source = "#| a comment\n   over three\n   lines |#\n(define x 1)\n  (car x #| inline |# x)\n";
+    let err = compile(source).unwrap_err();
+    assert_eq!(err.message, "car expects exactly 1 argument");
+    assert_eq!((err.location.line, err.location.column), (5, 3));
+
+    // The caret diagnostic shows that line, with the caret under the form
+    let formatted = err.format(Some(source));
+    assert!(formatted.contains("comments.lisp:5:3"), "got: {}", formatted);
+    assert!(formatted.contains("│    5 │   (car x #| inline |# x)\n│      │   ^\n"), "got: {}", formatted);
+}
+
+#[test]
+fn test_datum_comment_before_the_last_element() {
+    assert_eq!(run("(list 1 2 #;3)"), ints(&[1, 2]));
+    assert_eq!(run("(+ 1 2 #;(error \"skipped\"))"), Value::Integer(3));
+    // The commented form can span lines and hold comments of its own
+    assert_eq!(run("(list 1\n  #;(2 ; two\n     #| and |# 3))"), ints(&[1]));
+}
+
+#[test]
+fn test_datum_comment_removes_a_whole_defun() {
+    // Commented out, the broken defun is never compiled, even as the last form
+    let source = r#"
+        (defun twice (x) (* 2 x))
+        #;(defun twice (x)
+            (car x x))
+        (twice 21)
+        #;(defun broken () (undefined-function))
+    "#;
+    assert_eq!(run(source), Value::Integer(42));
+}
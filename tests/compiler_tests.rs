@@ -1,11 +1,18 @@
 use lisp_bytecode_vm::{Compiler, parser::Parser, Instruction, Value};
 
+/// These tests check the code generated for each form, so constants are not folded
+fn unfolded_compiler() -> Compiler {
+    let mut compiler = Compiler::new();
+    compiler.set_constant_folding(false);
+    compiler
+}
+
 #[test]
 fn test_compile_number() {
     let mut parser = Parser::new("42");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (functions, main) = compiler.compile_program(&exprs).unwrap();
 
     assert_eq!(functions.len(), 0);
@@ -19,7 +26,7 @@ fn test_compile_arithmetic() {
     let mut parser = Parser::new("(+ 5 3)");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (_, main) = compiler.compile_program(&exprs).unwrap();
 
     // Should have: Push(5), Push(3), Add, Halt
@@ -45,7 +52,7 @@ fn test_compile_all_arithmetic_operators() {
         let mut parser = Parser::new(&source);
         let exprs = parser.parse_all().unwrap();
 
-        let mut compiler = Compiler::new();
+        let mut compiler = unfolded_compiler();
         let (_, main) = compiler.compile_program(&exprs).unwrap();
 
         assert_eq!(main.len(), 4);
@@ -69,7 +76,7 @@ fn test_compile_comparison_operators() {
         let mut parser = Parser::new(&source);
         let exprs = parser.parse_all().unwrap();
 
-        let mut compiler = Compiler::new();
+        let mut compiler = unfolded_compiler();
         let (_, main) = compiler.compile_program(&exprs).unwrap();
 
         assert_eq!(main.len(), 4);
@@ -82,7 +89,7 @@ fn test_compile_negation() {
     let mut parser = Parser::new("(neg 5)");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (_, main) = compiler.compile_program(&exprs).unwrap();
 
     assert_eq!(main.len(), 3);
@@ -95,7 +102,7 @@ fn test_compile_if_expression() {
     let mut parser = Parser::new("(if (> 5 3) 10 20)");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (_, main) = compiler.compile_program(&exprs).unwrap();
 
     // Should have comparison, conditional jump, branches, and halt
@@ -114,7 +121,7 @@ fn test_compile_function_definition() {
     let mut parser = Parser::new("(defun double (x) (* x 2))");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (functions, _main) = compiler.compile_program(&exprs).unwrap();
 
     assert_eq!(functions.len(), 1);
@@ -133,7 +140,7 @@ fn test_compile_function_call() {
     let mut parser = Parser::new("(defun add1 (x) (+ x 1)) (add1 5)");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (functions, main) = compiler.compile_program(&exprs).unwrap();
 
     assert_eq!(functions.len(), 1);
@@ -148,7 +155,7 @@ fn test_compile_nested_expressions() {
     let mut parser = Parser::new("(+ (* 2 3) (- 10 5))");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (_, main) = compiler.compile_program(&exprs).unwrap();
 
     // Should compile nested multiplications and subtractions before the addition
@@ -172,7 +179,7 @@ fn test_compile_error_undefined_variable() {
     let mut parser = Parser::new("unknown_var");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let result = compiler.compile_program(&exprs);
 
     assert!(result.is_err());
@@ -185,7 +192,7 @@ fn test_compile_error_wrong_arg_count() {
     let mut parser = Parser::new("(+ 1)");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let result = compiler.compile_program(&exprs);
 
     assert!(result.is_err());
@@ -204,7 +211,7 @@ fn test_compile_multiple_functions() {
     let mut parser = Parser::new(source);
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (functions, _) = compiler.compile_program(&exprs).unwrap();
 
     assert_eq!(functions.len(), 3);
@@ -218,7 +225,7 @@ fn test_compile_variadic_addition() {
     let mut parser = Parser::new("(+ 1 2 3 4)");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (_, main) = compiler.compile_program(&exprs).unwrap();
 
     // Should have: Push(1), Push(2), Add, Push(3), Add, Push(4), Add, Halt
@@ -238,7 +245,7 @@ fn test_compile_variadic_multiplication() {
     let mut parser = Parser::new("(* 2 3 4)");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (_, main) = compiler.compile_program(&exprs).unwrap();
 
     // Should have: Push(2), Push(3), Mul, Push(4), Mul, Halt
@@ -256,7 +263,7 @@ fn test_compile_variadic_subtraction() {
     let mut parser = Parser::new("(- 10 2 3)");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (_, main) = compiler.compile_program(&exprs).unwrap();
 
     // Should have: Push(10), Push(2), Sub, Push(3), Sub, Halt
@@ -274,7 +281,7 @@ fn test_compile_variadic_division() {
     let mut parser = Parser::new("(/ 20 2 5)");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (_, main) = compiler.compile_program(&exprs).unwrap();
 
     // Should have: Push(20), Push(2), Div, Push(5), Div, Halt
@@ -292,7 +299,7 @@ fn test_compile_variadic_modulo() {
     let mut parser = Parser::new("(% 10 4 2)");
     let exprs = parser.parse_all().unwrap();
 
-    let mut compiler = Compiler::new();
+    let mut compiler = unfolded_compiler();
     let (_, main) = compiler.compile_program(&exprs).unwrap();
 
     // Should have: Push(10), Push(4), Mod, Push(2), Mod, Halt
@@ -315,7 +322,7 @@ fn test_compile_error_single_arg_arithmetic() {
         let mut parser = Parser::new(&source);
         let exprs = parser.parse_all().unwrap();
 
-        let mut compiler = Compiler::new();
+        let mut compiler = unfolded_compiler();
         let result = compiler.compile_program(&exprs);
 
         assert!(result.is_err(), "Expected error for {} with 1 argument", op);
@@ -0,0 +1,238 @@
+use lisp_bytecode_vm::{disassembler, Compiler, VM, parser::Parser, Instruction, Value, List};
+use std::collections::HashMap;
+
+/// Helper function to compile source into (functions, main)
+fn compile(source: &str) -> (HashMap<String, Vec<Instruction>>, Vec<Instruction>) {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+
+    let mut compiler = Compiler::new();
+    compiler.compile_program(&exprs).unwrap()
+}
+
+/// Helper function to compile and run source code
+fn compile_and_run(source: &str) -> VM {
+    let (functions, main) = compile(source);
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().unwrap();
+    vm
+}
+
+/// Helper to get integer result from VM
+fn get_int_result(vm: &VM) -> i64 {
+    match vm.value_stack.last() {
+        Some(Value::Integer(n)) => *n,
+        other => panic!("Expected integer result, got {:?}", other),
+    }
+}
+
+/// Parse the "  addr: Instr ; note" lines of a disassembly section into instruction text
+fn disassembly_lines(output: &str, section: &str) -> Vec<String> {
+    let start = output.find(section).expect("section not found");
+    output[start..]
+        .lines()
+        .skip(2)
+        .take_while(|line| !line.trim().is_empty())
+        .filter(|line| !line.ends_with(':'))
+        .map(|line| {
+            let text = line.splitn(2, ": ").nth(1).unwrap();
+            text.split(" ;").next().unwrap().trim().to_string()
+        })
+        .collect()
+}
+
+/// Assert that no Jmp/JmpIfFalse in the disassembly lands on another Jmp
+fn assert_no_jump_chains(lines: &[String]) {
+    for (addr, line) in lines.iter().enumerate() {
+        let target = line
+            .strip_prefix("Jmp(")
+            .or_else(|| line.strip_prefix("JmpIfFalse("))
+            .map(|rest| rest.trim_end_matches(')').parse::<usize>().unwrap());
+
+        if let Some(target) = target {
+            if let Some(landing) = lines.get(target) {
+                assert!(!landing.starts_with("Jmp("),
+                        "jump at {} lands on another jump at {}: {}", addr, target, landing);
+            }
+        }
+    }
+}
+
+/// Build a function with `n` numbered clauses and an else fallback
+fn cond_function_source(n: usize) -> String {
+    let mut clauses = String::new();
+    for i in 0..n {
+        clauses.push_str(&format!("((== x {}) {}) ", i, i * 10));
+    }
+    format!("(defun classify (x) (cond {}(else -1)))", clauses)
+}
+
+// ============================================================================
+// Basic cond Tests
+// ============================================================================
+
+#[test]
+fn test_cond_first_clause() {
+    let vm = compile_and_run("(cond ((< 1 2) 10) ((< 2 3) 20) (else 30))");
+    assert_eq!(get_int_result(&vm), 10);
+}
+
+#[test]
+fn test_cond_middle_clause() {
+    let vm = compile_and_run("(cond ((> 1 2) 10) ((< 2 3) 20) (else 30))");
+    assert_eq!(get_int_result(&vm), 20);
+}
+
+#[test]
+fn test_cond_else_clause() {
+    let vm = compile_and_run("(cond ((> 1 2) 10) ((> 2 3) 20) (else 30))");
+    assert_eq!(get_int_result(&vm), 30);
+}
+
+#[test]
+fn test_cond_no_match_is_nil() {
+    let vm = compile_and_run("(cond ((> 1 2) 10) ((> 2 3) 20))");
+    assert_eq!(vm.value_stack.last(), Some(&Value::List(List::Nil)));
+}
+
+#[test]
+fn test_cond_multiple_body_expressions() {
+    let source = r#"
+        (def x 5)
+        (cond ((> x 3) (print "big") (* x 2))
+              (else 0))
+    "#;
+    let vm = compile_and_run(source);
+    assert_eq!(get_int_result(&vm), 10);
+}
+
+#[test]
+fn test_cond_empty_is_nil() {
+    let vm = compile_and_run("(cond)");
+    assert_eq!(vm.value_stack.last(), Some(&Value::List(List::Nil)));
+}
+
+#[test]
+fn test_cond_clause_without_body_yields_test_value() {
+    let vm = compile_and_run("(cond ((> 1 2)) ((< 1 2)) (else false))");
+    assert_eq!(vm.value_stack.last(), Some(&Value::Boolean(true)));
+
+    let vm = compile_and_run("(list 1 (cond ((> 1 2))) 3)");
+    assert_eq!(vm.value_stack.last(), Some(&Value::list_from_vec(vec![
+        Value::Integer(1),
+        Value::List(List::Nil),
+        Value::Integer(3),
+    ])));
+}
+
+#[test]
+fn test_cond_else_without_body_is_nil() {
+    let vm = compile_and_run("(cond ((> 1 2) 1) (else))");
+    assert_eq!(vm.value_stack.last(), Some(&Value::List(List::Nil)));
+}
+
+#[test]
+fn test_cond_else_must_be_last() {
+    let mut parser = Parser::new("(cond (else 1) ((> 1 2) 2))");
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let err = compiler.compile_program(&exprs).unwrap_err();
+    assert!(err.message.contains("else clause must be the last clause"));
+}
+
+// ============================================================================
+// Tail position Tests
+// ============================================================================
+
+#[test]
+fn test_cond_else_is_tail_position() {
+    let source = r#"
+        (defun fact (n acc)
+          (cond ((== n 0) acc)
+                (else (fact (- n 1) (* acc n)))))
+        (fact 10 1)
+    "#;
+    let (functions, _) = compile(source);
+    assert!(functions["fact"].iter().any(|i| matches!(i, Instruction::TailCall(_, _))),
+            "fact should use TailCall in the else clause");
+
+    let vm = compile_and_run(source);
+    assert_eq!(get_int_result(&vm), 3628800);
+}
+
+#[test]
+fn test_cond_clause_body_last_expr_is_tail_position() {
+    let source = r#"
+        (defun count-down (n)
+          (cond ((> n 0) (print n) (count-down (- n 1)))
+                (else 99)))
+        (count-down 5000)
+    "#;
+    let (functions, _) = compile(source);
+    assert!(functions["count-down"].iter().any(|i| matches!(i, Instruction::TailCall(_, _))));
+
+    let vm = compile_and_run(source);
+    assert_eq!(get_int_result(&vm), 99);
+}
+
+// ============================================================================
+// Bytecode shape Tests
+// ============================================================================
+
+#[test]
+fn test_cond_no_jump_chains_up_to_eight_clauses() {
+    for n in 1..=8 {
+        let (functions, main) = compile(&cond_function_source(n));
+        let output = disassembler::disassemble_bytecode(&functions, &main);
+        let lines = disassembly_lines(&output, "Function: classify");
+
+        assert_no_jump_chains(&lines);
+
+        // One JmpIfFalse per test clause and one exit Jmp per test clause
+        let jmp_if_false = lines.iter().filter(|l| l.starts_with("JmpIfFalse(")).count();
+        let jmp = lines.iter().filter(|l| l.starts_with("Jmp(")).count();
+        assert_eq!(jmp_if_false, n);
+        assert_eq!(jmp, n);
+    }
+}
+
+#[test]
+fn test_cond_all_exits_share_end_label() {
+    let (functions, main) = compile(&cond_function_source(8));
+    let output = disassembler::disassemble_bytecode(&functions, &main);
+    let lines = disassembly_lines(&output, "Function: classify");
+
+    let targets: Vec<&String> = lines.iter().filter(|l| l.starts_with("Jmp(")).collect();
+    assert!(targets.windows(2).all(|w| w[0] == w[1]),
+            "all clause exits should jump to the same end address: {:?}", targets);
+}
+
+#[test]
+fn test_cond_eight_clauses_results() {
+    let source = format!("{} (list (classify 0) (classify 7) (classify 42))", cond_function_source(8));
+    let vm = compile_and_run(&source);
+    match vm.value_stack.last() {
+        Some(Value::List(lst)) => {
+            assert_eq!(lst.to_vec(), vec![Value::Integer(0), Value::Integer(70), Value::Integer(-1)]);
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_cond_last_clause_without_else_is_tail_position() {
+    let source = r#"
+        (defun sum-to (n acc)
+          (cond ((== n 0) acc)
+                ((> n 0) (sum-to (- n 1) (+ acc n)))))
+        (sum-to 100000 0)
+    "#;
+    let (functions, _) = compile(source);
+    assert!(functions["sum-to"].iter().any(|i| matches!(i, Instruction::TailCall(_, _))));
+
+    let vm = compile_and_run(source);
+    assert_eq!(get_int_result(&vm), 5000050000);
+}
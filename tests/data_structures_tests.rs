@@ -12,7 +12,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
     for (name, bytecode) in functions {
         vm.functions.insert(name, bytecode);
     }
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().map_err(|e| format!("Runtime error: {:?}", e))?;
 
     // Get the top value from the stack and format it
@@ -25,6 +25,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
 fn format_value(value: &Value) -> String {
     match value {
         Value::Integer(n) => n.to_string(),
+        Value::BigInt(n) => n.to_string(),
         Value::Float(f) => {
             if f.fract() == 0.0 && !f.is_nan() && !f.is_infinite() {
                 format!("{:.1}", f)
@@ -33,6 +34,7 @@ fn format_value(value: &Value) -> String {
             }
         }
         Value::Boolean(b) => b.to_string(),
+        Value::Char(c) => format!("#\\{}", c),
         Value::List(items) => {
             let formatted_items: Vec<String> = items.iter().map(|v| format_value(v)).collect();
             format!("({})", formatted_items.join(" "))
@@ -42,20 +44,29 @@ fn format_value(value: &Value) -> String {
         Value::Function(name) => format!("<function {}>", name),
         Value::Closure(closure_data) => format!("<closure/{}>", closure_data.params.len()),
         Value::HashMap(map) => {
-            let mut items: Vec<String> = map.iter()
+            let mut items: Vec<String> = map.borrow().iter()
                 .map(|(k, v)| format!("\"{}\" {}", k, format_value(v)))
                 .collect();
             items.sort(); // Sort for consistent output
             format!("{{{}}}", items.join(" "))
         }
         Value::Vector(items) => {
-            let formatted_items: Vec<String> = items.iter().map(|v| format_value(v)).collect();
+            let formatted_items: Vec<String> = items.borrow().iter().map(|v| format_value(v)).collect();
             format!("[{}]", formatted_items.join(" "))
         }
         Value::TcpListener(_) => "#<tcp-listener>".to_string(),
         Value::TcpStream(_) => "#<tcp-stream>".to_string(),
         Value::SharedTcpListener(_) => "#<shared-tcp-listener>".to_string(),
+        Value::Struct(data) => {
+            let fields: Vec<String> = data.fields.iter().map(|v| format_value(v)).collect();
+            format!("#<{} {}>", data.name, fields.join(" "))
+        }
         Value::Pointer(p) => format!("#<pointer 0x{:x}>", p),
+        Value::Cell(_) => "#<cell>".to_string(),
+        Value::Port(_) => "#<port>".to_string(),
+        Value::Promise(_) => "#<promise>".to_string(),
+        Value::Task(_) => "#<task>".to_string(),
+        Value::Channel(_) => "#<channel>".to_string(),
     }
 }
 
@@ -211,6 +222,163 @@ fn test_hash_map_nested_values() {
     assert_eq!(result.trim(), "2");
 }
 
+#[test]
+fn test_map_literal_with_integer_and_symbol_keys() {
+    let result = compile_and_run("(map-get {1 \"one\" 'two 2 \"three\" 3} 1)").unwrap();
+    assert_eq!(result.trim(), "\"one\"");
+
+    let result = compile_and_run("(map-get {1 \"one\" 'two 2} 'two)").unwrap();
+    assert_eq!(result.trim(), "2");
+
+    // The string "two" and the symbol two are different keys
+    let result = compile_and_run("(map-contains? {'two 2} \"two\")").unwrap();
+    assert_eq!(result.trim(), "false");
+}
+
+#[test]
+fn test_map_literal_odd_items_is_parse_error() {
+    let err = compile_and_run("{1 2 3}").unwrap_err();
+    assert!(err.contains("needs a value for every key"), "got: {}", err);
+}
+
+#[test]
+fn test_map_get_default() {
+    let result = compile_and_run("(map-get {1 10} 2 0)").unwrap();
+    assert_eq!(result.trim(), "0");
+
+    let result = compile_and_run("(map-get {1 10} 1 0)").unwrap();
+    assert_eq!(result.trim(), "10");
+
+    let err = compile_and_run("(map-get {1 10} 2)").unwrap_err();
+    assert!(err.contains("Key 2 not found in hashmap"), "got: {}", err);
+}
+
+#[test]
+fn test_map_set_remove_and_count() {
+    let source = r#"
+        (let ((m (map-set! (make-map 1 10 2 20) 3 30)))
+            (list (map-count m)
+                  (map-count (map-remove! m 2))
+                  (map-contains? (map-remove! m 2) 2)
+                  (map-count (map-remove! m 99))))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(3 2 false 2)");
+}
+
+#[test]
+fn test_map_set_and_remove_change_the_map_itself() {
+    let source = r#"
+        (let ((m (make-map 1 10)))
+            (do (map-set! m 2 20)
+                (map-set! m 1 11)
+                (map-remove! m 2)
+                (list (map-get m 1) (map-contains? m 2) (map-count m))))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(11 false 1)");
+
+    // Every binding of the map sees the change; hashmap-set still makes a copy
+    let source = r#"
+        (let ((m {}))
+            (let ((same m) (copy (hashmap-set m 'a 1)))
+                (do (map-set! m 'b 2)
+                    (list (map-keys same) (map-keys copy)))))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "((b) (a))");
+
+    // A map set into itself prints with a label and compares without looping
+    let source = "(let ((m {1 2})) (do (map-set! m 'me m) (list (format \"{}\" (list m)) (equal? m m))))";
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(\"#0={1 2 me #0#}\" true)");
+}
+
+#[test]
+fn test_map_keys_are_sorted() {
+    let result = compile_and_run("(map-keys {3 'c 1 'a 2 'b})").unwrap();
+    assert_eq!(result.trim(), "(1 2 3)");
+}
+
+#[test]
+fn test_map_rejects_unhashable_key() {
+    let err = compile_and_run("(map-set! {} (lambda (x) x) 1)").unwrap_err();
+    assert!(err.contains("hashmap keys must be integers, strings or symbols, got closure"), "got: {}", err);
+
+    let err = compile_and_run("(make-map '(1 2) 3)").unwrap_err();
+    assert!(err.contains("hashmap keys must be integers, strings or symbols, got list"), "got: {}", err);
+}
+
+#[test]
+fn test_map_equal_ignores_insertion_order() {
+    let result = compile_and_run("(equal? {1 'a 2 'b} (map-set! (map-set! {} 2 'b) 1 'a))").unwrap();
+    assert_eq!(result.trim(), "true");
+
+    let result = compile_and_run("(equal? {1 'a 2 'b} {1 'a 2 'c})").unwrap();
+    assert_eq!(result.trim(), "false");
+}
+
+#[test]
+fn test_map_prints_sorted_by_key() {
+    let result = compile_and_run("(format \"{}\" (list {\"b\" 2 \"a\" 1 \"c\" 3}))").unwrap();
+    assert_eq!(result.trim(), "\"{a 1 b 2 c 3}\"");
+}
+
+#[test]
+fn test_hash_table_builtins() {
+    let source = r#"
+        (let ((h (hash-set! (hash-set! (make-hash-table) 'apple 3) "pear" 5)))
+            (list (hash-ref h 'apple 0)
+                  (hash-ref h "pear")
+                  (hash-ref h 'plum 0)
+                  (hash-keys (hash-remove! h 'apple))))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(3 5 0 (\"pear\"))");
+}
+
+#[test]
+fn test_hash_set_changes_the_table_itself() {
+    let source = r#"
+        (let ((h (make-hash-table)))
+            (do (hash-set! h 'apple 3)
+                (hash-set! h 'pear 5)
+                (hash-remove! h 'pear)
+                (list (hash-ref h 'apple) (hash-ref h 'pear 0) (hash-keys h))))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(3 0 (apple))");
+
+    // A table kept in a global is filled by a function that is handed it
+    let source = r#"
+        (define counts (make-hash-table))
+        (defun tally (table word) (hash-set! table word (+ 1 (hash-ref table word 0))))
+        (do (tally counts 'a) (tally counts 'b) (tally counts 'a)
+            (list (hash-ref counts 'a) (hash-ref counts 'b)))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(2 1)");
+}
+
+#[test]
+fn test_hash_table_keys_compare_by_value() {
+    let source = r#"
+        (let ((h (hash-set! (make-hash-table) (string-append "a" "b") 1)))
+            (list (hash-ref h "ab" 0) (hash-ref (hash-set! h 42 'x) (+ 40 2))))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(1 x)");
+}
+
+#[test]
+fn test_hash_table_is_a_map() {
+    let result = compile_and_run("(equal? (hash-set! (make-hash-table) 1 2) {1 2})").unwrap();
+    assert_eq!(result.trim(), "true");
+
+    let result = compile_and_run("(format \"{}\" (list (hash-set! (hash-set! (make-hash-table) 'b 2) 'a 1)))").unwrap();
+    assert_eq!(result.trim(), "\"{a 1 b 2}\"");
+}
+
 // ==================== Vector Tests ====================
 
 #[test]
@@ -388,6 +556,58 @@ fn test_vector_nested() {
     assert_eq!(result.trim(), "3");
 }
 
+#[test]
+fn test_make_vector() {
+    let result = compile_and_run("(make-vector 3 0)").unwrap();
+    assert_eq!(result.trim(), "[0 0 0]");
+
+    let result = compile_and_run("(make-vector 0 'x)").unwrap();
+    assert_eq!(result.trim(), "[]");
+}
+
+#[test]
+fn test_make_vector_negative_size() {
+    let err = compile_and_run("(make-vector -1 0)").unwrap_err();
+    assert!(err.contains("'make-vector' size cannot be negative: -1"), "got: {}", err);
+}
+
+#[test]
+fn test_vector_set_bang() {
+    let source = r#"
+        (let ((v (vector-set! (make-vector 3 0) 1 42)))
+            (vector-ref v 1))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "42");
+}
+
+#[test]
+fn test_vector_literal_indexing() {
+    let result = compile_and_run("(vector-ref #(10 20 30) 2)").unwrap();
+    assert_eq!(result.trim(), "30");
+}
+
+#[test]
+fn test_vector_ref_out_of_bounds_reports_index_and_length() {
+    let err = compile_and_run("(vector-ref #(1 2 3) 3)").unwrap_err();
+    assert!(err.contains("index 3 out of bounds for vector of length 3"), "got: {}", err);
+
+    let err = compile_and_run("(vector-ref #(1 2 3) -1)").unwrap_err();
+    assert!(err.contains("index -1 out of bounds for vector of length 3"), "got: {}", err);
+}
+
+#[test]
+fn test_vector_equal_is_element_wise() {
+    let result = compile_and_run("(equal? #(1 '(2 3) #(4)) (vector 1 (list 2 3) (vector 4)))").unwrap();
+    assert_eq!(result.trim(), "true");
+
+    let result = compile_and_run("(equal? #(1 2 3) #(1 2 4))").unwrap();
+    assert_eq!(result.trim(), "false");
+
+    let result = compile_and_run("(equal? #(1 2) #(1 2 3))").unwrap();
+    assert_eq!(result.trim(), "false");
+}
+
 // ==================== Integration Tests ====================
 
 #[test]
@@ -598,11 +818,12 @@ fn test_string_to_number_negative() {
 
 #[test]
 fn test_string_to_number_with_whitespace() {
+    // Surrounding whitespace is not part of a number
     let source = r#"
         (string->number "  100  ")
     "#;
     let result = compile_and_run(source).unwrap();
-    assert_eq!(result.trim(), "100");
+    assert_eq!(result.trim(), "()");
 }
 
 #[test]
@@ -610,9 +831,8 @@ fn test_string_to_number_invalid() {
     let source = r#"
         (string->number "not-a-number")
     "#;
-    let result = compile_and_run(source);
-    assert!(result.is_err());
-    assert!(result.unwrap_err().contains("cannot parse"));
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "()");
 }
 
 #[test]
@@ -0,0 +1,221 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Value};
+use lisp_bytecode_vm::vm::debugger::{Breakpoint, Debugger};
+use std::cell::RefCell;
+use std::io::{Cursor, Write};
+use std::rc::Rc;
+
+/// Output sink the test can read back after the debugger has been moved into the VM
+#[derive(Clone, Default)]
+struct SharedOutput(Rc<RefCell<Vec<u8>>>);
+
+impl Write for SharedOutput {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        self.0.borrow_mut().extend_from_slice(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+/// Compile source and run it under the debugger, feeding it `commands`.
+/// Returns the VM and everything the debugger printed.
+fn debug_run(source: &str, commands: &str) -> (VM, String) {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    // Step through the code as written, so (+ 1 2) is not folded into one push
+    let mut compiler = Compiler::new();
+    compiler.set_constant_folding(false);
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+
+    let output = SharedOutput::default();
+    let mut debugger = Debugger::with_io(Box::new(Cursor::new(commands.to_string())), Box::new(output.clone()));
+    debugger.set_param_names(compiler.function_params().clone());
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.debugger = Some(debugger);
+    vm.run().map_err(|e| e.message).unwrap();
+
+    let text = String::from_utf8(output.0.borrow().clone()).unwrap();
+    (vm, text)
+}
+
+/// Like debug_run, with the source maps, let binding names and source text a
+/// debugger gets when the program is compiled for it
+fn debug_run_located(source: &str, commands: &str) -> (VM, String) {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    compiler.set_constant_folding(false);
+    compiler.set_record_slot_names(true);
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+
+    let output = SharedOutput::default();
+    let mut debugger = Debugger::with_io(Box::new(Cursor::new(commands.to_string())), Box::new(output.clone()));
+    debugger.set_param_names(compiler.function_params().clone());
+    debugger.set_slot_names(compiler.slot_names());
+    debugger.add_source("<input>".to_string(), source.to_string());
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm.debugger = Some(debugger);
+    vm.run().map_err(|e| e.message).unwrap();
+
+    let text = String::from_utf8(output.0.borrow().clone()).unwrap();
+    (vm, text)
+}
+
+const FACT: &str = r#"
+    (defun fact (n) (if (<= n 1) 1 (* n (fact (- n 1)))))
+    (fact 3)
+"#;
+
+#[test]
+fn test_step_shows_instruction_and_stack() {
+    let (_, output) = debug_run("(+ 1 2)", "step\nstep\ncontinue\n");
+    assert!(output.contains("-> main:0  Push(Integer(1))"), "got: {}", output);
+    assert!(output.contains("-> main:1  Push(Integer(2))"), "got: {}", output);
+    assert!(output.contains("   stack: [1]"), "got: {}", output);
+    assert!(output.contains("-> main:2"), "got: {}", output);
+    assert!(output.contains("   stack: [1 2]"), "got: {}", output);
+}
+
+#[test]
+fn test_empty_line_steps() {
+    let (_, output) = debug_run("(+ 1 2)", "\n\nc\n");
+    assert!(output.contains("-> main:2"), "got: {}", output);
+}
+
+#[test]
+fn test_debugging_does_not_change_result() {
+    // Running out of commands lets the program finish
+    let (vm, _) = debug_run(FACT, "");
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(6)));
+}
+
+#[test]
+fn test_function_breakpoint_shows_named_locals() {
+    let (vm, output) = debug_run(FACT, "break fact\ncontinue\nprint n\ncontinue\nprint n\ncontinue\ncontinue\n");
+    assert!(output.contains("Breakpoint set at entry of 'fact'"), "got: {}", output);
+    assert!(output.contains("-> fact:0"), "got: {}", output);
+    assert!(output.contains("   locals: n = 3"), "got: {}", output);
+    assert!(output.contains("n = 3\n"), "got: {}", output);
+    assert!(output.contains("n = 2\n"), "got: {}", output);
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(6)));
+}
+
+#[test]
+fn test_instruction_breakpoint() {
+    let mut debugger = Debugger::with_io(Box::new(Cursor::new(String::new())), Box::new(SharedOutput::default()));
+    debugger.add_breakpoint(Breakpoint::Instruction(Some("fact".to_string()), 2));
+    debugger.add_breakpoint(Breakpoint::Instruction(Some("fact".to_string()), 2));
+    assert_eq!(debugger.breakpoints().len(), 1);
+
+    let (_, output) = debug_run(FACT, "b fact:2\nc\nbt\nc\nc\nc\n");
+    assert!(output.contains("Breakpoint set at fact:2"), "got: {}", output);
+    assert!(output.contains("-> fact:2  Leq"), "got: {}", output);
+    assert!(output.contains("  main\n  fact\n"), "got: {}", output);
+    assert_eq!(output.matches("-> fact:2").count(), 3);
+}
+
+#[test]
+fn test_print_global_and_unknown_variable() {
+    let source = r#"
+        (def limit 10)
+        (+ limit 1)
+    "#;
+    let commands = "b main:3\nc\np limit\np missing\nc\n";
+    let (_, output) = debug_run(source, commands);
+    assert!(output.contains("limit = 10"), "got: {}", output);
+    assert!(output.contains("No variable named 'missing' in this frame or the globals"), "got: {}", output);
+}
+
+#[test]
+fn test_quit_halts_program() {
+    let (vm, output) = debug_run(FACT, "step\nquit\n");
+    assert!(output.contains("-> main:1"), "got: {}", output);
+    assert!(vm.halted);
+    assert_ne!(vm.value_stack.last(), Some(&Value::Integer(6)));
+}
+
+#[test]
+fn test_unknown_command() {
+    let (_, output) = debug_run("42", "frobnicate\nc\n");
+    assert!(output.contains("Unknown command 'frobnicate'"), "got: {}", output);
+}
+
+const SCALE: &str = "(defun scale (x)
+  (let ((doubled (* x 2)))
+    (+ doubled 1)))
+(let ((base 5))
+  (list (scale base) (scale 1)))";
+
+#[test]
+fn test_line_breakpoint_shows_the_line_with_a_caret() {
+    let (vm, output) = debug_run_located(SCALE, "break line 3\nc\nc\nc\n");
+    assert!(output.contains("Breakpoint set at line 3"), "got: {}", output);
+    // Once for each call, not for each instruction on the line
+    assert_eq!(output.matches("   at <input>:3:").count(), 2, "got: {}", output);
+    assert!(output.contains("      3 │     (+ doubled 1)))\n        │        ^\n"), "got: {}", output);
+    assert_eq!(vm.value_stack.last(), Some(&Value::List(lisp_bytecode_vm::List::from_vec(vec![Value::Integer(11), Value::Integer(3)]))));
+}
+
+#[test]
+fn test_file_line_breakpoint() {
+    let (_, output) = debug_run_located(SCALE, "break other.lisp:3\nbreak <input>.lisp:3\nc\nc\n");
+    assert!(output.contains("Breakpoint set at line 3 of other.lisp"), "got: {}", output);
+    // Neither file matches <input>, so the program runs to the end
+    assert_eq!(output.matches("-> ").count(), 1, "got: {}", output);
+}
+
+#[test]
+fn test_locals_names_let_bindings() {
+    let (_, output) = debug_run_located(SCALE, "break line 3\nc\nlocals\nprint doubled\nprint base\nc\nc\n");
+    assert!(output.contains("   locals: x = 5, doubled = 10\n"), "got: {}", output);
+    assert!(output.contains("doubled = 10\n"), "got: {}", output);
+    // Only the paused frame's bindings are in scope
+    assert!(output.contains("No variable named 'base'"), "got: {}", output);
+}
+
+#[test]
+fn test_stack_shows_frame_boundaries() {
+    let (_, output) = debug_run_located(SCALE, "break line 3\nc\nstack\nc\nc\n");
+    assert!(output.contains("   main:\n     [0] 5  (base)\n   scale:\n     [1] 10  (doubled)\n"), "got: {}", output);
+}
+
+#[test]
+fn test_backtrace_shows_source_positions() {
+    let (_, output) = debug_run_located(SCALE, "break line 3\nc\nbt\nc\nc\n");
+    assert!(output.contains("  main at <input>:5:9\n  scale at <input>:3:8\n"), "got: {}", output);
+}
+
+#[test]
+fn test_next_steps_over_calls() {
+    let source = "(defun twice (x) (* x 2))\n(+ (twice 3) 1)";
+    let (vm, output) = debug_run_located(source, "n\nn\nn\nc\n");
+    assert!(output.contains("-> main:1  Call(\"twice\", 1)"), "got: {}", output);
+    // The call ran to its return without pausing inside it
+    assert!(!output.contains("-> twice:"), "got: {}", output);
+    assert!(output.contains("-> main:2  Push(Integer(1))\n"), "got: {}", output);
+    assert!(output.contains("   stack: [6]\n"), "got: {}", output);
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(7)));
+}
+
+#[test]
+fn test_function_breakpoint_on_a_tail_called_function() {
+    let source = r#"
+        (defun ping (n) (if (= n 0) 'done (pong (- n 1))))
+        (defun pong (n) (ping n))
+        (ping 4)
+    "#;
+    // pong is only ever entered by a tail call from ping, which reuses ping's frame
+    let (_, output) = debug_run(source, "break pong\nc\nc\nc\nc\n");
+    assert_eq!(output.matches("-> pong:0").count(), 4, "got: {}", output);
+    assert!(output.contains("   locals: n = 3"), "got: {}", output);
+    assert!(output.contains("   locals: n = 0"), "got: {}", output);
+}
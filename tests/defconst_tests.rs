@@ -0,0 +1,129 @@
+use lisp_bytecode_vm::{disassembler, Compiler, VM, parser::Parser, CompileError, Instruction, Value};
+use std::collections::HashMap;
+
+fn compile(source: &str) -> Result<(HashMap<String, Vec<Instruction>>, Vec<Instruction>), CompileError> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    Compiler::new().compile_program(&exprs)
+}
+
+fn run(source: &str) -> Result<Option<Value>, String> {
+    let (functions, main) = compile(source).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned())
+}
+
+fn loads_global(instructions: &[Instruction], name: &str) -> bool {
+    instructions.iter().any(|instr| matches!(instr, Instruction::LoadGlobal(n) if n == name))
+}
+
+#[test]
+fn test_loop_body_has_no_global_load() {
+    let source = r#"
+        (defun sum-scaled (n acc)
+          (if (= n 0)
+              acc
+              (sum-scaled (- n 1) (+ acc (* n SCALE)))))
+        (defconst SCALE 3)
+        (sum-scaled 10 0)
+    "#;
+    let (functions, main) = compile(source).unwrap();
+    let output = disassembler::disassemble_bytecode(&functions, &main);
+    let body = &output[output.find("Function: sum-scaled").unwrap()..output.find("=== Main ===").unwrap()];
+    assert!(!body.contains("LoadGlobal"), "got: {}", output);
+    assert!(body.contains("Push(Integer(3))"), "got: {}", output);
+    assert_eq!(run(source), Ok(Some(Value::Integer(165))));
+}
+
+#[test]
+fn test_dotimes_body_has_no_global_load() {
+    let source = "(defconst STEP 2) (define total 0) (dotimes (i 5) (set! total (+ total STEP))) total";
+    let (_, main) = compile(source).unwrap();
+    assert!(!loads_global(&main, "STEP"), "got: {:?}", main);
+    assert_eq!(run(source), Ok(Some(Value::Integer(10))));
+}
+
+#[test]
+fn test_constants_fold_through_other_constants() {
+    let source = "(defconst MINUTE 60) (defconst HOUR (* 60 MINUTE)) (defconst DAY (* 24 HOUR)) (defun days (n) (* n DAY)) (days 2)";
+    let (functions, _) = compile(source).unwrap();
+    assert!(functions["days"].contains(&Instruction::Push(Value::Integer(86400))), "got: {:?}", functions["days"]);
+    assert_eq!(run(source), Ok(Some(Value::Integer(172800))));
+}
+
+#[test]
+fn test_float_and_string_literals_are_inlined() {
+    let source = r#"(defconst PI 3.5) (defconst GREETING "hi") (defun show () (list PI GREETING)) (show)"#;
+    let (functions, _) = compile(source).unwrap();
+    assert!(!loads_global(&functions["show"], "PI") && !loads_global(&functions["show"], "GREETING"), "got: {:?}", functions["show"]);
+    let expected = vec![Value::Float(3.5), Value::String(std::sync::Arc::new("hi".to_string()))];
+    assert_eq!(run(source), Ok(Some(Value::List(lisp_bytecode_vm::List::from_vec(expected)))));
+}
+
+#[test]
+fn test_non_foldable_initializer_is_a_global() {
+    let source = "(defconst ITEMS (list 1 2 3)) (defun count-items () (list-length ITEMS)) (count-items)";
+    let (functions, _) = compile(source).unwrap();
+    assert!(loads_global(&functions["count-items"], "ITEMS"), "got: {:?}", functions["count-items"]);
+    assert_eq!(run(source), Ok(Some(Value::Integer(3))));
+}
+
+#[test]
+fn test_locals_shadow_a_constant() {
+    let source = "(defconst N 1) (defun f (N) (let ((m N)) (+ m (let ((N 10)) N)))) (f 5)";
+    assert_eq!(run(source), Ok(Some(Value::Integer(15))));
+}
+
+#[test]
+fn test_set_of_a_constant_points_at_the_defconst() {
+    for source in ["(defconst LIMIT 10)\n(set! LIMIT 11)", "(defconst LIMIT (list 10))\n(defun bump () (set! LIMIT 11))"] {
+        let err = compile(source).unwrap_err();
+        assert_eq!(err.message, "Cannot set! constant 'LIMIT'");
+        assert_eq!(err.location.line, 2);
+        let (note, location) = err.note.clone().expect("a note pointing at the defconst");
+        assert_eq!(note, "'LIMIT' is defined with defconst here");
+        assert_eq!((location.line, location.column), (1, 1));
+    }
+}
+
+#[test]
+fn test_redefining_a_constant_points_at_the_defconst() {
+    for redefinition in ["(defconst LIMIT 20)", "(def LIMIT 20)", "(define LIMIT 20)"] {
+        let source = format!("(defconst LIMIT 10)\n  {}", redefinition);
+        let err = compile(&source).unwrap_err();
+        assert_eq!(err.message, "Cannot redefine constant 'LIMIT'", "for {}", redefinition);
+        assert_eq!(err.location.line, 2);
+        let (_, location) = err.note.clone().expect("a note pointing at the defconst");
+        assert_eq!(location.line, 1);
+    }
+
+    // The first defconst is the one that's inlined
+    assert_eq!(compile("(defconst A 1) (defun f () A) (defconst A 2)").unwrap_err().message, "Cannot redefine constant 'A'");
+}
+
+#[test]
+fn test_note_is_part_of_the_boxed_diagnostic() {
+    let source = "(defconst LIMIT 10)\n(set! LIMIT 11)";
+    let output = compile(source).unwrap_err().format(Some(source));
+    assert!(output.contains("╭─ Compile Error"), "got: {}", output);
+    assert!(output.contains("├─ Note"), "got: {}", output);
+    assert!(output.contains("'LIMIT' is defined with defconst here (<input>:1:1)"), "got: {}", output);
+    assert!(output.contains("(defconst LIMIT 10)"), "got: {}", output);
+}
+
+#[test]
+fn test_constants_in_modules() {
+    let source = "(module config (export LIMIT) (defconst LIMIT 7)) (defun limit () config/LIMIT) (limit)";
+    let (functions, _) = compile(source).unwrap();
+    assert!(functions["limit"].contains(&Instruction::Push(Value::Integer(7))), "got: {:?}", functions["limit"]);
+    assert_eq!(run(source), Ok(Some(Value::Integer(7))));
+}
+
+#[test]
+fn test_malformed_defconst() {
+    assert_eq!(compile("(defconst A)").unwrap_err().message, "defconst expects exactly: (defconst name value)");
+    assert_eq!(compile("(defconst 1 2)").unwrap_err().message, "Variable name must be a symbol");
+}
@@ -0,0 +1,110 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, repl::Repl, List, Value};
+
+fn compile_and_run(source: &str) -> Result<VM, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    for (module, exports) in compiler.module_exports {
+        vm.module_exports.insert(module, exports);
+    }
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+fn result(source: &str) -> Result<Option<Value>, String> {
+    compile_and_run(source).map(|vm| vm.value_stack.last().cloned())
+}
+
+#[test]
+fn test_define_global_value() {
+    assert_eq!(result("(define pi 3) (* pi 2)"), Ok(Some(Value::Integer(6))));
+
+    let vm = compile_and_run("(define answer (+ 40 2))").unwrap();
+    assert_eq!(vm.global_vars.get("answer"), Some(&Value::Integer(42)));
+}
+
+#[test]
+fn test_define_is_read_from_function_bodies() {
+    let source = r#"
+        (define scale 10)
+        (defun scaled (x) (* x scale))
+        (scaled 4)
+    "#;
+    assert_eq!(result(source), Ok(Some(Value::Integer(40))));
+}
+
+#[test]
+fn test_redefinition_overwrites() {
+    assert_eq!(result("(define limit 1) (define limit 2) limit"), Ok(Some(Value::Integer(2))));
+}
+
+#[test]
+fn test_defines_run_in_source_order() {
+    // Each read sees the define above it, not a later one
+    let source = r#"
+        (define seen '())
+        (define x 1)
+        (set! seen (cons x seen))
+        (define x 2)
+        (set! seen (cons x seen))
+        (reverse seen)
+    "#;
+    assert_eq!(result(source), Ok(Some(Value::List(List::from_vec(vec![Value::Integer(1), Value::Integer(2)])))));
+
+    // An initializer runs after the expressions above it
+    let source = r#"
+        (define log '())
+        (set! log (cons 'before log))
+        (define y (do (set! log (cons 'initializer log)) 0))
+        (reverse log)
+    "#;
+    assert_eq!(result(source), Ok(Some(Value::List(List::from_vec(vec![Value::symbol("before"), Value::symbol("initializer")])))));
+
+    // A read above every define of the name fails at run time
+    let err = result("(define early x) (define x 1)").unwrap_err();
+    assert!(err.contains("Undefined global variable 'x'"), "got: {}", err);
+}
+
+#[test]
+fn test_def_bindings_stay_immutable() {
+    let err = result("(def limit 1) (define limit 2)").unwrap_err();
+    assert!(err.contains("Cannot redefine constant 'limit'"), "got: {}", err);
+
+    let err = result("(define limit 1) (def limit 2)").unwrap_err();
+    assert!(err.contains("Cannot redefine constant 'limit'"), "got: {}", err);
+}
+
+#[test]
+fn test_define_in_module() {
+    let source = r#"
+        (module config
+            (export get-port)
+            (define port 8080)
+            (defun get-port () port))
+
+        (config/get-port)
+    "#;
+    assert_eq!(result(source), Ok(Some(Value::Integer(8080))));
+}
+
+#[test]
+fn test_define_errors() {
+    let err = result("(define x)").unwrap_err();
+    assert!(err.contains("define expects exactly: (define name value)"), "got: {}", err);
+    let err = result("(define (f) 1)").unwrap_err();
+    assert!(err.contains("Variable name must be a symbol"), "got: {}", err);
+}
+
+#[test]
+fn test_redefinition_in_repl_is_seen_by_functions() {
+    let mut repl = Repl::new();
+    repl.eval_input("(define greeting 1)").unwrap();
+    repl.eval_input("(defun get-greeting () greeting)").unwrap();
+    repl.eval_input("(define greeting 2)").unwrap();
+    assert_eq!(repl.eval_input("(get-greeting)"), Ok(Some(Value::Integer(2))));
+}
@@ -222,3 +222,172 @@ fn test_disassemble_conditional_jumps() {
     assert!(output.contains("JmpIfFalse(4)"));
     assert!(output.contains("Jmp(5)"));
 }
+
+// ============================================================================
+// Labels, annotations and the disassemble builtin
+// ============================================================================
+
+fn run_source(source: &str) -> lisp_bytecode_vm::VM {
+    use lisp_bytecode_vm::{parser::Parser, Compiler, VM};
+
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().unwrap();
+    vm
+}
+
+fn disassembly_result(source: &str) -> String {
+    let vm = run_source(source);
+    match vm.value_stack.last() {
+        Some(Value::String(s)) => s.to_string(),
+        other => panic!("Expected string result, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_disassemble_function_labels_jump_targets() {
+    let bytecode = vec![
+        Instruction::LoadArg(0),
+        Instruction::JmpIfFalse(4),
+        Instruction::Push(Value::Integer(1)),
+        Instruction::Jmp(5),
+        Instruction::Push(Value::Integer(2)),
+        Instruction::Ret,
+    ];
+
+    let output = disassembler::disassemble_function("pick", &bytecode);
+
+    assert!(output.starts_with("Function: pick\n  6 instruction(s)\n"));
+    assert!(output.contains("JmpIfFalse(4)"));
+    assert!(output.contains("; -> L0"));
+    assert!(output.contains("; -> L1"));
+    assert!(output.contains("L0:\n     4: Push(Integer(2))"));
+    assert!(output.contains("L1:\n     5: Ret"));
+}
+
+#[test]
+fn test_disassemble_function_is_stable() {
+    let bytecode = vec![
+        Instruction::Push(Value::Boolean(true)),
+        Instruction::JmpIfFalse(3),
+        Instruction::Jmp(3),
+        Instruction::Halt,
+    ];
+
+    let first = disassembler::disassemble_function("f", &bytecode);
+    let second = disassembler::disassemble_function("f", &bytecode);
+    assert_eq!(first, second);
+}
+
+#[test]
+fn test_disassemble_annotates_self_tail_call_and_slide() {
+    let bytecode = vec![
+        Instruction::Push(Value::Integer(1)),
+        Instruction::LoadArg(0),
+        Instruction::Slide(1),
+        Instruction::TailCall("loop".to_string(), 1),
+        Instruction::TailCall("other".to_string(), 0),
+    ];
+
+    let output = disassembler::disassemble_function("loop", &bytecode);
+
+    assert!(output.contains("Slide(1)"));
+    assert!(output.contains("; keep top, drop 1 below"));
+    assert!(output.contains("TailCall(\"loop\", 1)"));
+    assert!(output.contains("; -> self (frame reused)"));
+    assert!(output.contains("; -> other (frame reused)"));
+}
+
+#[test]
+fn test_disassemble_builtin_quoted_name() {
+    let output = disassembly_result(r#"
+        (defun countdown (n)
+          (if (<= n 0) 0 (countdown (- n 1))))
+        (disassemble 'countdown)
+    "#);
+
+    assert!(output.starts_with("Function: countdown\n"));
+    assert!(output.contains("TailCall(\"countdown\", 1)"));
+    assert!(output.contains("; -> self (frame reused)"));
+    assert!(output.contains("JmpIfFalse("));
+}
+
+#[test]
+fn test_disassemble_builtin_non_tail_call() {
+    let output = disassembly_result(r#"
+        (defun fact (n)
+          (if (<= n 1) 1 (* n (fact (- n 1)))))
+        (disassemble 'fact)
+    "#);
+
+    assert!(output.contains("Call(\"fact\", 1)"));
+    assert!(!output.contains("TailCall"));
+}
+
+#[test]
+fn test_disassemble_builtin_closure() {
+    let output = disassembly_result("(disassemble (lambda (x) (+ x 1)))");
+
+    assert!(output.starts_with("Function: <closure>\n"));
+    assert!(output.contains("Add"));
+}
+
+#[test]
+fn test_disassemble_builtin_undefined_function() {
+    use lisp_bytecode_vm::{parser::Parser, Compiler, VM};
+
+    let mut parser = Parser::new("(disassemble 'no-such-function)");
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    let err = vm.run().unwrap_err();
+    assert!(err.message.contains("Undefined function 'no-such-function' in disassemble"));
+}
+
+/// Compile source and disassemble the whole program with parameter names
+fn program_listing(source: &str) -> String {
+    use lisp_bytecode_vm::{parser::Parser, Compiler};
+
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    disassembler::disassemble_bytecode_with_params(&functions, &main, compiler.function_params())
+}
+
+#[test]
+fn test_disassemble_names_argument_slots() {
+    let output = program_listing("(defun scale (factor x) (do (set! x (* x factor)) x))");
+
+    assert!(output.contains("LoadArg(1)                       ; x\n"), "got:\n{}", output);
+    assert!(output.contains("LoadArg(0)                       ; factor\n"), "got:\n{}", output);
+    assert!(output.contains("StoreArg(1)                      ; set! x\n"), "got:\n{}", output);
+}
+
+#[test]
+fn test_disassemble_nested_closures_indented() {
+    let output = program_listing("(defun adder (n) (lambda (x) (lambda (y) (+ x y n))))");
+
+    let outer = output.find("  1: MakeClosure([\"x\"]").expect("outer closure listed");
+    let inner = output.find("\n             ").expect("closure body indented");
+    assert!(inner > outer, "got:\n{}", output);
+    assert!(output.contains("\n                     1: LoadArg(0)                       ; y\n"), "got:\n{}", output);
+}
+
+#[test]
+fn test_disassemble_closure_value_names_params() {
+    let output = disassembly_result("(disassemble (lambda (a . rest) (cons a rest)))");
+
+    assert!(output.contains("; a\n"), "got:\n{}", output);
+    assert!(output.contains("; rest\n"), "got:\n{}", output);
+}
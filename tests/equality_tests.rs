@@ -0,0 +1,178 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+
+fn run(source: &str) -> Result<Option<Value>, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+    let (functions, main) = Compiler::new().compile_program(&exprs).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned())
+}
+
+fn booleans(values: &[bool]) -> Result<Option<Value>, String> {
+    Ok(Some(Value::List(List::from_vec(values.iter().map(|b| Value::Boolean(*b)).collect()))))
+}
+
+// ============================================================================
+// equal?: structure
+// ============================================================================
+
+#[test]
+fn test_equal_compares_nested_lists() {
+    assert_eq!(run("(equal? '(1 2 (3)) '(1 2 (3)))"), Ok(Some(Value::Boolean(true))));
+    assert_eq!(run("(equal? '(1 2 (3)) '(1 2 (4)))"), Ok(Some(Value::Boolean(false))));
+    assert_eq!(run("(equal? '(1 2) '(1 2 3))"), Ok(Some(Value::Boolean(false))));
+    assert_eq!(run("(equal? (cons 1 (cons 2 '())) (list 1 2))"), Ok(Some(Value::Boolean(true))));
+}
+
+#[test]
+fn test_equal_compares_strings_vectors_and_maps_by_contents() {
+    assert_eq!(run("(list (equal? \"ab\" (string-append \"a\" \"b\")) (equal? \"ab\" \"abc\"))"), booleans(&[true, false]));
+    assert_eq!(run("(equal? (vector 1 (list 2 #(3))) (vector 1 (list 2 (vector 3))))"), Ok(Some(Value::Boolean(true))));
+    let source = r#"
+        (list (equal? (hash-map "a" (list 1 2) "b" #(3)) (hash-map "b" (vector 3) "a" '(1 2)))
+              (equal? (hash-map "a" 1) (hash-map "a" 2))
+              (equal? (hash-map "a" 1) (hash-map "a" 1 "b" 2)))
+    "#;
+    assert_eq!(run(source), booleans(&[true, false, false]));
+}
+
+#[test]
+fn test_equal_compares_structs_field_by_field() {
+    let source = r#"
+        (defstruct point x y)
+        (list (equal? (make-point 1 (list 2)) (make-point 1 (list 2)))
+              (equal? (make-point 1 2) (make-point 1 3)))
+    "#;
+    assert_eq!(run(source), booleans(&[true, false]));
+}
+
+#[test]
+fn test_equal_errors_on_circular_structures() {
+    // Each vector holds itself, so comparing them element by element would never end
+    let source = r#"
+        (define v (vector 0 1))
+        (define w (vector 0 1))
+        (vector-set! v 0 v)
+        (vector-set! w 0 w)
+        (equal? v w)
+    "#;
+    assert_eq!(run(source), Err("equal? can't compare circular structures: a vector contains itself".to_string()));
+    // A circular list, built through a vector; the same object is still equal to itself
+    let source = r#"
+        (define v (vector 0))
+        (define l (list 'in v))
+        (vector-set! v 0 l)
+        (define w (vector 0))
+        (vector-set! w 0 (list 'in w))
+        (list (equal? l l) (handler-case (equal? l (list 'in w)) (catch (e) 'circular)))
+    "#;
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(vec![Value::Boolean(true), Value::symbol("circular")])))));
+}
+
+#[test]
+fn test_equal_handles_very_deep_nesting() {
+    let source = r#"
+        (defun nest (n acc) (if (= n 0) acc (nest (- n 1) (list acc))))
+        (list (equal? (nest 5000 '()) (nest 5000 '())) (equal? (nest 5000 '()) (nest 5000 '(1))))
+    "#;
+    assert_eq!(run(source), booleans(&[true, false]));
+}
+
+#[test]
+fn test_closures_are_only_equal_to_themselves() {
+    let source = r#"
+        (defun make-adder (n) (lambda (x) (+ x n)))
+        (define add1 (make-adder 1))
+        (list (eq? add1 add1) (eqv? add1 add1) (equal? add1 add1)
+              (eq? add1 (make-adder 1)) (eqv? add1 (make-adder 1)) (equal? add1 (make-adder 1))
+              (equal? (list add1) (list add1)) (equal? (list add1) (list (make-adder 1))))
+    "#;
+    assert_eq!(run(source), booleans(&[true, true, true, false, false, false, true, false]));
+}
+
+// ============================================================================
+// eqv?: numbers of one type by value
+// ============================================================================
+
+#[test]
+fn test_eqv_compares_numbers_of_the_same_type() {
+    let source = r#"
+        (list (eqv? 2 2) (eqv? 2.5 2.5) (eqv? (* 10000000000 10000000000) (* 100000 1000000000000000))
+              (eqv? 1 1.0) (eqv? "ab" "ab") (eqv? (list 1) (list 1)) (eqv? 'a 'a))
+    "#;
+    assert_eq!(run(source), booleans(&[true, true, true, false, false, false, true]));
+    // eq? doesn't look inside bignums, which are heap objects
+    assert_eq!(run("(eq? (* 10000000000 10000000000) (* 10000000000 10000000000))"), Ok(Some(Value::Boolean(false))));
+    assert_eq!(run("(equal? 1 1.0)"), Ok(Some(Value::Boolean(false))));
+    assert_eq!(run("(map eqv? '(1 2) '(1 3))"), booleans(&[true, false]));
+}
+
+// ============================================================================
+// =: numbers only
+// ============================================================================
+
+#[test]
+fn test_numeric_equals_compares_across_number_types() {
+    assert_eq!(run("(list (= 1 1) (= 1 1.0) (= (* 10000000000 10000000000) 100000000000000000000.0) (= 2 3))"), booleans(&[true, true, true, false]));
+}
+
+#[test]
+fn test_numeric_equals_rejects_other_values() {
+    let source = "(define a 'x)\n(+ 1 (if (= a 'y) 1 2))";
+    let exprs = Parser::new_with_file(source, "equals.lisp".to_string()).parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    let err = vm.run().unwrap_err();
+    assert_eq!(err.message, "Type error: '=' expects two numbers, got symbol and symbol");
+    assert_eq!(err.location.map(|l| (l.file, l.line, l.column)), Some(("equals.lisp".to_string(), 2, 10)));
+    assert!(run("(= \"a\" \"a\")").unwrap_err().starts_with("Type error: '=' expects two numbers"));
+    assert!(run("(apply = (list '() '()))").unwrap_err().starts_with("Type error: '=' expects two numbers"));
+}
+
+// ============================================================================
+// Literal patterns compare as equal? does
+// ============================================================================
+
+#[test]
+fn test_literal_patterns_use_equal() {
+    let source = r#"
+        (defun kind (x) (match x (1 'one) ((2 "two") 'two) (_ 'other)))
+        (list (kind 1) (kind 1.0) (kind (list 2 "two")) (kind (list 2.0 "two")))
+    "#;
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(vec![
+        Value::symbol("one"), Value::symbol("other"), Value::symbol("two"), Value::symbol("other"),
+    ])))));
+    let source = "(defun zero? ((0) true) ((_) false)) (list (zero? 0) (zero? 0.0))";
+    assert_eq!(run(source), booleans(&[true, false]));
+}
+
+// ============================================================================
+// eq?: identity
+// ============================================================================
+
+#[test]
+fn test_eq_compares_heap_objects_by_identity() {
+    let source = r#"
+        (define shared (list 1))
+        (define v (vector 1))
+        (list (eq? (list 1) (list 1))
+              (eq? shared shared)
+              (eq? v v)
+              (eq? v (vector 1))
+              (eq? (hash-map "a" 1) (hash-map "a" 1)))
+    "#;
+    assert_eq!(run(source), booleans(&[false, true, true, false, false]));
+}
+
+#[test]
+fn test_eq_compares_immediates_by_value() {
+    assert_eq!(run("(list (eq? 7 7) (eq? #\\a #\\a) (eq? 'k 'k) (eq? true true) (eq? '() '()) (eq? 7 8))"),
+        booleans(&[true, true, true, true, true, false]));
+}
@@ -16,7 +16,7 @@ fn compile_and_run(source: &str) -> VM {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
     vm
 }
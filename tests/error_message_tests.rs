@@ -1,4 +1,5 @@
-use lisp_bytecode_vm::{Compiler, VM, parser::Parser};
+use lisp_bytecode_vm::{bytecode, Compiler, VM, parser::Parser};
+use std::collections::HashMap;
 
 /// Helper function to compile Lisp code and capture compile errors
 fn compile_lisp(source: &str) -> Result<(), String> {
@@ -21,7 +22,8 @@ fn compile_and_run(source: &str) -> Result<String, String> {
     for (name, bytecode) in functions {
         vm.functions.insert(name, bytecode);
     }
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
     vm.run().map_err(|e| e.format())?;
 
     Ok(String::new())
@@ -168,3 +170,57 @@ fn test_suggestion_formatting() {
     assert!(error.contains("│"));
     assert!(error.contains("╰─"));
 }
+
+#[test]
+fn test_runtime_error_stack_trace_with_call_sites() {
+    let source = "(defun outer (x) (+ 1 (middle x)))\n(defun middle (x) (+ 1 (inner x)))\n(defun inner (x) (car x))\n(outer 5)";
+
+    let error = compile_and_run(source).unwrap_err();
+
+    // Innermost frame first, each with the location of the call that entered it
+    let inner = error.find("#0: inner called at <input>:2:24").expect(&error);
+    let middle = error.find("#1: middle called at <input>:1:23").expect(&error);
+    let outer = error.find("#2: outer called at <input>:4:1").expect(&error);
+    assert!(inner < middle && middle < outer, "got: {}", error);
+
+    // The failing instruction itself is located in the header
+    assert!(error.contains("│ <input>:3:18"), "got: {}", error);
+    assert!(error.contains("├─ Call Stack"), "got: {}", error);
+}
+
+#[test]
+fn test_tail_called_frame_keeps_its_own_name() {
+    let source = "(defun start (x) (finish x))\n(defun finish (x) (car x))\n(+ 1 (start 5))";
+
+    let error = compile_and_run(source).unwrap_err();
+
+    assert!(error.contains("#0: finish called at <input>:3:6"), "got: {}", error);
+    assert!(!error.contains("start"), "got: {}", error);
+}
+
+#[test]
+fn test_source_maps_survive_bytecode_files() {
+    let source = "(defun inner (x) (car x))\n(defun outer (x) (+ 1 (inner x)))\n(outer 5)";
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+
+    let bytes = bytecode::serialize_bytecode_with_source_maps(&functions, &main, &compiler.source_maps());
+    let (functions, main, source_maps) = bytecode::deserialize_bytecode_with_source_maps(&bytes).unwrap();
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = source_maps;
+    let error = vm.run().unwrap_err().format();
+
+    assert!(error.contains("#0: inner called at <input>:2:23"), "got: {}", error);
+    assert!(error.contains("#1: outer called at <input>:3:1"), "got: {}", error);
+
+    // Files without the section still load
+    assert!(bytecode::deserialize_bytecode(&bytes).is_ok());
+    let plain = bytecode::serialize_bytecode(&HashMap::new(), &[]);
+    let (_, _, source_maps) = bytecode::deserialize_bytecode_with_source_maps(&plain).unwrap();
+    assert!(source_maps.main.is_empty());
+}
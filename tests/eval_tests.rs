@@ -12,7 +12,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
     for (name, bytecode) in functions {
         vm.functions.insert(name, bytecode);
     }
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().map_err(|e| format!("Runtime error: {:?}", e))?;
 
     // Get the top value from the stack and format it
@@ -25,6 +25,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
 fn format_value(value: &Value) -> String {
     match value {
         Value::Integer(n) => n.to_string(),
+        Value::BigInt(n) => n.to_string(),
         Value::Float(f) => {
             if f.fract() == 0.0 && !f.is_nan() && !f.is_infinite() {
                 format!("{:.1}", f)
@@ -33,6 +34,7 @@ fn format_value(value: &Value) -> String {
             }
         }
         Value::Boolean(b) => if *b { "true".to_string() } else { "false".to_string() },
+        Value::Char(c) => format!("#\\{}", c),
         Value::List(items) => {
             let formatted_items: Vec<String> = items.iter().map(format_value).collect();
             format!("({})", formatted_items.join(" "))
@@ -52,7 +54,13 @@ fn format_value(value: &Value) -> String {
         Value::TcpListener(_) => "#<tcp-listener>".to_string(),
         Value::TcpStream(_) => "#<tcp-stream>".to_string(),
         Value::SharedTcpListener(_) => "#<shared-tcp-listener>".to_string(),
+        Value::Struct(data) => format!("#<{}>", data.name),
         Value::Pointer(p) => format!("#<pointer 0x{:x}>", p),
+        Value::Cell(_) => "#<cell>".to_string(),
+        Value::Port(_) => "#<port>".to_string(),
+        Value::Promise(_) => "#<promise>".to_string(),
+        Value::Task(_) => "#<task>".to_string(),
+        Value::Channel(_) => "#<channel>".to_string(),
     }
 }
 
@@ -218,9 +226,10 @@ fn test_eval_parse_error() {
 
 #[test]
 fn test_eval_type_error() {
-    let result = compile_and_run(r#"(eval 42)"#);
+    // Data evaluates as a form, but a vector is no form
+    let result = compile_and_run(r#"(eval (vector 1 2))"#);
     assert!(result.is_err());
-    assert!(result.unwrap_err().contains("expects a string"));
+    assert!(result.unwrap_err().contains("'eval' can't evaluate #(1 2): Cannot convert vector to an expression"));
 }
 
 // Eval with floats
@@ -382,3 +391,54 @@ fn test_eval_with_higher_order_functions() {
     "#);
     assert_eq!(result, Ok("12".to_string()));
 }
+
+// Eval of data forms
+
+#[test]
+fn test_eval_of_read_data() {
+    assert_eq!(compile_and_run(r#"(eval (read-from-string "(+ 1 2)"))"#), Ok("3".to_string()));
+    assert_eq!(compile_and_run("(eval '(let ((x 5)) (* x x)))"), Ok("25".to_string()));
+    assert_eq!(compile_and_run("(eval (list '+ 1 2 (list '* 3 4)))"), Ok("15".to_string()));
+    // Atoms evaluate as they would in source
+    assert_eq!(compile_and_run("(eval 42)"), Ok("42".to_string()));
+    assert_eq!(compile_and_run("(eval ''sym)"), Ok("sym".to_string()));
+    assert_eq!(compile_and_run("(eval :key)"), Ok(":key".to_string()));
+}
+
+#[test]
+fn test_eval_of_data_uses_the_global_environment() {
+    let result = compile_and_run(r#"
+        (def base 10)
+        (defun add-base (x) (+ x base))
+        (eval '(defun process (x) (add-base (* x 2))))
+        (eval (list 'process (read-from-string "5")))
+    "#);
+    assert_eq!(result, Ok("20".to_string()));
+}
+
+#[test]
+fn test_eval_compile_errors_are_catchable() {
+    let result = compile_and_run(r#"
+        (list (handler-case (eval '(car)) (catch (e) (hash-ref e 'message)))
+              (handler-case (eval (list '+ 1 (lambda (x) x))) (catch (e) (hash-ref e 'message)))
+              'after)
+    "#);
+    assert_eq!(result, Ok(r#"("'eval' failed to compile (car): car expects exactly 1 argument" "'eval' can't evaluate (+ 1 <closure/1>): Cannot convert closure to an expression" after)"#.to_string()));
+    let result = compile_and_run("(eval '(undefined-fn 3))");
+    assert!(result.unwrap_err().contains("Undefined function 'undefined-fn'"));
+}
+
+#[test]
+fn test_eval_leaves_the_calling_frame_intact() {
+    // The eval'd code's own locals, and anything it leaves behind, stay above
+    // the caller's arguments and locals
+    let result = compile_and_run(r#"
+        (defun around (a b)
+          (let ((p (* a 10)))
+            (list a p (eval '(let ((z 1) (w 2)) (+ z w))) b
+                  (handler-case (eval '(let ((z 1)) (car z))) (catch (e) 'caught))
+                  (eval '(do 1 2 3)) p)))
+        (around 1 2)
+    "#);
+    assert_eq!(result, Ok("(1 10 3 2 caught 3 10)".to_string()));
+}
@@ -0,0 +1,387 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, List, Value};
+
+/// Helper function to compile and run source code
+fn compile_and_run(source: &str) -> Result<VM, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+fn run(source: &str) -> Value {
+    let vm = compile_and_run(source).unwrap();
+    vm.value_stack.last().cloned().expect("No value on stack")
+}
+
+fn list(items: Vec<Value>) -> Value {
+    Value::List(List::from_vec(items))
+}
+
+fn symbol(name: &str) -> Value {
+    Value::symbol(name)
+}
+
+fn string(s: &str) -> Value {
+    Value::String(std::sync::Arc::new(s.to_string()))
+}
+
+/// Message of the built-in error raised by `expr`
+fn caught_message(expr: &str) -> String {
+    let source = format!("(handler-case {} (catch (e) (map-get e 'message)))", expr);
+    match run(&source) {
+        Value::String(message) => message.to_string(),
+        other => panic!("Expected an error message, got {:?}", other),
+    }
+}
+
+// ============================================================================
+// raise and handler-case
+// ============================================================================
+
+#[test]
+fn test_value_without_raise() {
+    assert_eq!(run("(handler-case (+ 1 2) (catch (e) 'never))"), Value::Integer(3));
+}
+
+#[test]
+fn test_raised_value_is_bound() {
+    let result = run("(handler-case (raise 'oops) (catch (e) (list 'caught e)))");
+    assert_eq!(result, list(vec![symbol("caught"), symbol("oops")]));
+}
+
+#[test]
+fn test_raise_unwinds_call_frames() {
+    let source = r#"
+        (defun dig (n) (if (= n 0) (raise 'bottom) (+ 1 (dig (- n 1)))))
+        (handler-case (dig 100) (catch (e) e))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(vm.value_stack, vec![symbol("bottom")]);
+    assert!(vm.call_stack.is_empty());
+}
+
+#[test]
+fn test_stack_depth_is_restored() {
+    // The let slots inside the protected expression are dropped, the ones around it kept
+    let source = r#"
+        (let ((a 1)
+              (r (handler-case (let ((b 2) (c 3)) (+ b (raise c)))
+                   (catch (e) (+ e 100)))))
+          (+ a r))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(vm.value_stack, vec![Value::Integer(104)]);
+    assert!(vm.handlers.is_empty());
+}
+
+#[test]
+fn test_catch_inside_loop() {
+    let source = r#"
+        (loop ((i 0) (acc '()))
+          (if (= i 3)
+              acc
+              (recur (+ i 1) (cons (handler-case (if (= i 1) (raise i) i) (catch (e) (* e 100))) acc))))
+    "#;
+    assert_eq!(run(source), list(vec![Value::Integer(2), Value::Integer(100), Value::Integer(0)]));
+}
+
+#[test]
+fn test_catch_body_closure_captures_error() {
+    assert_eq!(run("(handler-case (raise 7) (catch (e) ((lambda () (* e 2)))))"), Value::Integer(14));
+
+    let source = "(handler-case (raise 1) (catch (e) (let ((bump (lambda () (set! e (+ e 1))))) (do (bump) (bump) e))))";
+    assert_eq!(run(source), Value::Integer(3));
+}
+
+#[test]
+fn test_catch_clause_assigns_enclosing_local() {
+    let source = "(let ((seen 0)) (do (handler-case (raise 5) (catch (e) (set! seen e))) seen))";
+    assert_eq!(run(source), Value::Integer(5));
+}
+
+// ============================================================================
+// Built-in runtime errors
+// ============================================================================
+
+#[test]
+fn test_builtin_errors_are_catchable() {
+    assert_eq!(caught_message("(/ 1 0)"), "Division by zero");
+    assert!(caught_message("(car 5)").contains("Type error"));
+    // A call to a function the program never defines is a compile error, but eval'd code fails at runtime
+    assert!(caught_message("(eval \"(undefined-fn 3)\")").contains("Undefined function 'undefined-fn'"));
+    assert!(caught_message("((lambda (x) x))").contains("arity mismatch"));
+}
+
+#[test]
+fn test_undefined_global_at_runtime_is_catchable() {
+    let mut parser = Parser::new("(handler-case ghost (catch (e) (map-get e 'message)))");
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    compiler.with_known_globals(["ghost".to_string()].iter());
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message).unwrap();
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message).unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&string("Undefined global variable 'ghost'")));
+}
+
+#[test]
+fn test_unmatched_defun_clauses_are_catchable() {
+    let source = "(defun sign\n  ((n) when (> n 0) 'positive)\n  ((0) 'zero))\n(handler-case (sign -1) (catch (e) (list (map-get e 'message) (map-get e 'line))))";
+    assert_eq!(run(source), list(vec![string("No matching clause in function 'sign'"), Value::Integer(1)]));
+    // The program carries on after the handler
+    assert_eq!(run("(defun f ((0) 'zero))\n(+ 1 (handler-case (f 5) (catch (e) 1)))"), Value::Integer(2));
+}
+
+#[test]
+fn test_builtin_error_carries_location() {
+    let source = "(def x 1)\n(handler-case (+ x (car 5)) (catch (e) (list (map-get e 'line) (map-get e 'column))))";
+    assert_eq!(run(source), list(vec![Value::Integer(2), Value::Integer(20)]));
+}
+
+// ============================================================================
+// Nesting and re-raising
+// ============================================================================
+
+#[test]
+fn test_innermost_handler_catches() {
+    let source = "(handler-case (+ 1 (handler-case (raise 5) (catch (e) (+ e 10)))) (catch (e) 'outer))";
+    assert_eq!(run(source), Value::Integer(16));
+}
+
+#[test]
+fn test_reraise_reaches_enclosing_handler() {
+    let source = r#"
+        (handler-case
+          (handler-case (raise 1) (catch (e) (raise (+ e 1))))
+          (catch (e) (* e 10)))
+    "#;
+    assert_eq!(run(source), Value::Integer(20));
+
+    // A re-raised built-in error keeps its message, also when nothing catches it
+    assert_eq!(caught_message("(handler-case (/ 1 0) (catch (e) (raise e)))"), "Division by zero");
+    let err = compile_and_run("(handler-case (/ 1 0) (catch (e) (raise e)))").err().expect("expected an error");
+    assert_eq!(err, "Division by zero");
+}
+
+#[test]
+fn test_uncaught_raise_reports_value() {
+    let err = compile_and_run("(raise '(bad thing))").err().expect("expected an error");
+    assert_eq!(err, "Uncaught raise: (bad thing)");
+}
+
+#[test]
+fn test_handlers_inside_eval() {
+    assert_eq!(run("(eval \"(handler-case (raise 42) (catch (e) (+ e 1)))\")"), Value::Integer(43));
+    assert_eq!(run("(handler-case (eval \"(raise 42)\") (catch (e) e))"), Value::Integer(42));
+}
+
+// ============================================================================
+// Tail calls
+// ============================================================================
+
+#[test]
+fn test_protected_call_keeps_its_frame() {
+    // The call is in tail position of the function, but the handler needs the frame
+    let source = "(defun guarded (n) (handler-case (work n) (catch (e) 0))) (defun work (n) n)";
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let (functions, _) = Compiler::new().compile_program(&exprs).unwrap();
+    let bytecode = &functions["guarded"];
+    assert!(bytecode.contains(&Instruction::Call("work".to_string(), 1)), "got: {:?}", bytecode);
+    assert!(!bytecode.iter().any(|instr| matches!(instr, Instruction::TailCall(_, _))), "got: {:?}", bytecode);
+}
+
+#[test]
+fn test_recursion_through_handlers() {
+    // Every level installs a handler, so the raise is caught by the innermost one
+    let source = r#"
+        (defun countdown (n)
+          (handler-case (if (= n 0) (raise 'done) (countdown (- n 1)))
+            (catch (e) (list e n))))
+        (countdown 5)
+    "#;
+    assert_eq!(run(source), list(vec![symbol("done"), Value::Integer(0)]));
+}
+
+#[test]
+fn test_catch_clause_keeps_tail_calls() {
+    let source = r#"
+        (defun retry (n) (handler-case (raise n) (catch (e) (if (= e 0) 'finished (retry (- e 1))))))
+        (retry 100000)
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&symbol("finished")));
+    assert!(vm.call_stack.is_empty());
+}
+
+#[test]
+fn test_recur_out_of_protected_expression_is_error() {
+    let err = compile_and_run("(loop ((i 0)) (handler-case (recur (+ i 1)) (catch (e) e)))").err().expect("expected an error");
+    assert!(err.contains("recur cannot jump out of a handler-case"), "got: {}", err);
+}
+
+// ============================================================================
+// catch and throw
+// ============================================================================
+
+#[test]
+fn test_catch_without_throw() {
+    assert_eq!(run("(catch 'done (+ 1 2))"), Value::Integer(3));
+    assert_eq!(run("(catch 'done 1 2 3)"), Value::Integer(3));
+}
+
+#[test]
+fn test_throw_gives_catch_its_value() {
+    assert_eq!(run("(catch 'done (+ 1 (throw 'done 41)))"), Value::Integer(41));
+
+    let source = r#"
+        (defun find-first (pred items)
+          (catch 'found
+            (do (dolist (x items) (if (pred x) (throw 'found x) false))
+                false)))
+        (list (find-first (lambda (x) (> x 2)) '(1 2 3 4)) (find-first (lambda (x) (> x 9)) '(1 2)))
+    "#;
+    assert_eq!(run(source), list(vec![Value::Integer(3), Value::Boolean(false)]));
+}
+
+#[test]
+fn test_throw_unwinds_frames_and_stack() {
+    let source = r#"
+        (defun dig (n) (if (= n 0) (throw 'bottom 'reached) (+ 1 (dig (- n 1)))))
+        (let ((a 1)
+              (r (catch 'bottom (let ((b 2)) (+ b (dig 100))))))
+          (list a r))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(vm.value_stack, vec![list(vec![Value::Integer(1), symbol("reached")])]);
+    assert!(vm.call_stack.is_empty());
+    assert!(vm.handlers.is_empty());
+}
+
+#[test]
+fn test_throw_out_of_let_restores_pre_let_depth() {
+    // Step through by hand: the let's bindings are on the stack when the throw
+    // happens, and its Slide never runs, so the unwind has to drop them
+    let source = "(list 1 2 (catch 'k (let ((a 10) (b 20)) (let ((c 30)) (throw 'k (+ a (+ b c)))))) 4)";
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+    let (push_catch, resume) = main.iter().enumerate()
+        .find_map(|(i, instr)| match instr {
+            Instruction::PushCatch(addr) => Some((i, *addr)),
+            _ => None,
+        })
+        .expect("catch compiles to PushCatch");
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    let mut pre_let_depth = None;
+    let mut deepest = 0;
+    while !vm.halted {
+        let at = vm.instruction_pointer;
+        if pre_let_depth.is_some() && at == resume {
+            break;
+        }
+        vm.execute_one_instruction().unwrap();
+        if at == push_catch {
+            pre_let_depth = Some(vm.value_stack.len());
+        }
+        deepest = deepest.max(vm.value_stack.len());
+    }
+
+    let pre_let_depth = pre_let_depth.expect("PushCatch ran");
+    assert!(deepest >= pre_let_depth + 3, "the let bindings were pushed: {}", deepest);
+    // Only the thrown value is left above where the let started
+    assert_eq!(vm.value_stack.len(), pre_let_depth + 1);
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(60)));
+
+    vm.run().unwrap();
+    let expected = list(vec![Value::Integer(1), Value::Integer(2), Value::Integer(60), Value::Integer(4)]);
+    assert_eq!(vm.value_stack, vec![expected]);
+}
+
+#[test]
+fn test_repeated_throws_out_of_let_leave_no_slots() {
+    // A leaked slot per iteration would shift every later local
+    let source = r#"
+        (defun step (i)
+          (let ((base 100))
+            (+ base (catch 'odd (let ((x i) (y 2)) (if (= (% x 2) 1) (throw 'odd x) (* x y)))))))
+        (define total 0)
+        (dotimes (i 1000) (set! total (+ total (step i))))
+        total
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    // Even i contribute 2i, odd ones i, each on top of 100
+    let expected: i64 = (0..1000).map(|i| 100 + if i % 2 == 1 { i } else { 2 * i }).sum();
+    assert_eq!(vm.value_stack, vec![Value::Integer(expected)]);
+    assert!(vm.handlers.is_empty());
+}
+
+#[test]
+fn test_throw_reaches_matching_tag() {
+    // The inner catch is for another tag, so the throw passes through it
+    let source = "(catch 'outer (list 'inner (catch 'inner (throw 'outer 'skipped))))";
+    assert_eq!(run(source), symbol("skipped"));
+
+    // With the same tag twice, the innermost catch takes it
+    let source = "(catch 'tag (list 'outer (catch 'tag (throw 'tag 1))))";
+    assert_eq!(run(source), list(vec![symbol("outer"), Value::Integer(1)]));
+
+    // The tag is any value, compared by equality
+    assert_eq!(run("(catch (list 1 2) (throw '(1 2) 'matched))"), symbol("matched"));
+}
+
+#[test]
+fn test_throw_passes_through_handler_case() {
+    let source = "(catch 'done (handler-case (throw 'done 'thrown) (catch (e) 'handled)))";
+    assert_eq!(run(source), symbol("thrown"));
+
+    // Errors pass through a catch to the handler-case around it
+    let source = "(handler-case (catch 'done (car 1)) (catch (e) 'handled))";
+    assert_eq!(run(source), symbol("handled"));
+    let vm = compile_and_run(source).unwrap();
+    assert!(vm.handlers.is_empty());
+}
+
+#[test]
+fn test_throw_without_catch_is_error() {
+    let err = compile_and_run("(throw 'missing 1)").err().expect("expected an error");
+    assert_eq!(err, "throw to tag 'missing' has no matching catch");
+
+    // A catch that has already returned doesn't count
+    let err = compile_and_run("(catch 'done 1) (throw 'done 2)").err().expect("expected an error");
+    assert_eq!(err, "throw to tag 'done' has no matching catch");
+
+    // The error is an ordinary one, so handler-case can catch it
+    assert_eq!(
+        run("(handler-case (catch 'other (throw 'missing 1)) (catch (e) (map-get e 'message)))"),
+        string("throw to tag 'missing' has no matching catch")
+    );
+}
+
+#[test]
+fn test_throw_out_of_eval() {
+    assert_eq!(run("(catch 'done (eval \"(throw 'done 5)\"))"), Value::Integer(5));
+}
+
+#[test]
+fn test_catch_errors() {
+    let err = compile_and_run("(catch 'done)").err().expect("expected an error");
+    assert_eq!(err, "catch expects a tag and at least 1 body expression");
+    let err = compile_and_run("(throw 'done)").err().expect("expected an error");
+    assert_eq!(err, "throw expects a tag and a value");
+    let err = compile_and_run("(loop ((i 0)) (catch 'done (recur (+ i 1))))").err().expect("expected an error");
+    assert!(err.contains("recur cannot jump out of"), "got: {}", err);
+}
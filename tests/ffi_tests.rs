@@ -21,7 +21,7 @@ fn run_lisp(source: &str) -> Result<Value, String> {
     for (name, bytecode) in functions {
         vm.functions.insert(name, bytecode);
     }
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
 
     vm.run().map_err(|e| format!("Runtime error: {:?}", e))?;
 
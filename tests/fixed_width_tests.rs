@@ -0,0 +1,164 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, MapKey, Symbol, Value, RuntimeError};
+
+fn run_with(source: &str, fold: bool) -> Result<Value, RuntimeError> {
+    let mut parser = Parser::new_with_file(source, "overflow.lisp".to_string());
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    compiler.set_constant_folding(fold);
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm.run()?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn run(source: &str) -> Result<Value, RuntimeError> {
+    run_with(source, true)
+}
+
+fn int(source: &str) -> i64 {
+    // Folded and unfolded code must agree
+    match (run_with(source, true), run_with(source, false)) {
+        (Ok(Value::Integer(folded)), Ok(Value::Integer(n))) if folded == n => n,
+        other => panic!("Expected the same integer from {} either way, got {:?}", source, other),
+    }
+}
+
+fn compile_error(source: &str) -> lisp_bytecode_vm::CompileError {
+    let exprs = Parser::new_with_file(source, "overflow.lisp".to_string()).parse_all().unwrap();
+    Compiler::new().compile_program(&exprs).unwrap_err()
+}
+
+const MAX: i64 = i64::MAX;
+const MIN: i64 = i64::MIN;
+
+// i64::MIN has no positive literal, so programs spell it as a difference
+const MIN_SOURCE: &str = "(- -9223372036854775807 1)";
+
+// ============================================================================
+// checked-add, checked-sub, checked-mul
+// ============================================================================
+
+#[test]
+fn test_checked_ops_reach_both_ends_of_the_range() {
+    assert_eq!(int("(checked-add 9223372036854775806 1)"), MAX);
+    assert_eq!(int("(checked-sub -9223372036854775807 1)"), MIN);
+    assert_eq!(int("(checked-mul 4611686018427387904 -2)"), MIN);
+    assert_eq!(int("(checked-mul 3037000499 3037000499)"), 9223372030926249001);
+    assert_eq!(int(&format!("(checked-add {} 9223372036854775807)", MIN_SOURCE)), -1);
+}
+
+#[test]
+fn test_checked_ops_trap_past_either_end() {
+    let cases = [
+        ("(checked-add x 1)", "9223372036854775807", "Integer overflow in (checked-add 9223372036854775807 1): the result doesn't fit in 64 bits"),
+        ("(checked-sub x 1)", MIN_SOURCE, "Integer overflow in (checked-sub -9223372036854775808 1): the result doesn't fit in 64 bits"),
+        ("(checked-mul x 2)", "9223372036854775807", "Integer overflow in (checked-mul 9223372036854775807 2): the result doesn't fit in 64 bits"),
+        ("(checked-mul x -1)", MIN_SOURCE, "Integer overflow in (checked-mul -9223372036854775808 -1): the result doesn't fit in 64 bits"),
+    ];
+    for (call, x, message) in cases {
+        // x is a define, so nothing folds and the VM reports it
+        let err = run(&format!("(define x {})\n{}", x, call)).unwrap_err();
+        assert_eq!(err.message, message);
+        assert_eq!(err.location.map(|l| (l.line, l.column)), Some((2, 1)));
+    }
+}
+
+#[test]
+fn test_checked_ops_reject_bignum_operands() {
+    let err = run("(define big (* 9223372036854775807 2))\n(checked-add big -9223372036854775807)").unwrap_err();
+    assert_eq!(err.message, "Integer overflow in (checked-add 18446744073709551614 -9223372036854775807): the result doesn't fit in 64 bits");
+}
+
+#[test]
+fn test_overflow_errors_are_catchable() {
+    let source = "(define x 9223372036854775807)\n(handler-case (checked-mul x x) (catch (e) (hash-ref e 'message)))";
+    assert_eq!(run(source).unwrap(), Value::string("Integer overflow in (checked-mul 9223372036854775807 9223372036854775807): the result doesn't fit in 64 bits"));
+    let err = run("(define x 9223372036854775807)\n(handler-case (checked-add x 1) (catch (e) e))").unwrap();
+    match err {
+        Value::HashMap(map) => assert_eq!(map.borrow()[&MapKey::Symbol(Symbol::intern("line"))], Value::Integer(2)),
+        other => panic!("expected an error map, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_checked_ops_check_their_arguments() {
+    assert_eq!(run("(define s \"1\") (checked-add s 1)").unwrap_err().message, "Type error: 'checked-add' expects two integers, got string and integer");
+    assert_eq!(run("(define f 1.5) (wrapping-mul 2 f)").unwrap_err().message, "Type error: 'wrapping-mul' expects two integers, got integer and float");
+    assert_eq!(compile_error("(checked-sub 1)").message, "checked-sub expects exactly 2 arguments: (checked-sub a b)");
+    assert_eq!(compile_error("(wrapping-add 1 2 3)").message, "wrapping-add expects exactly 2 arguments: (wrapping-add a b)");
+}
+
+// ============================================================================
+// wrapping-add, wrapping-sub, wrapping-mul
+// ============================================================================
+
+#[test]
+fn test_wrapping_ops_wrap_around_both_ends() {
+    assert_eq!(int("(wrapping-add 9223372036854775807 1)"), MIN);
+    assert_eq!(int(&format!("(wrapping-sub {} 1)", MIN_SOURCE)), MAX);
+    assert_eq!(int("(wrapping-mul 9223372036854775807 2)"), -2);
+    assert_eq!(int(&format!("(wrapping-mul {} -1)", MIN_SOURCE)), MIN);
+    assert_eq!(int("(wrapping-add 1 2)"), 3);
+    assert_eq!(int("(wrapping-sub 5 7)"), -2);
+}
+
+#[test]
+fn test_wrapping_ops_reduce_bignums_modulo_2_64() {
+    // 2^64 + 5 and -(2^64 + 5)
+    assert_eq!(int("(wrapping-add (* 4294967296 4294967296) 5)"), 5);
+    assert_eq!(int("(wrapping-add (+ (* 4294967296 4294967296) 5) 0)"), 5);
+    assert_eq!(int("(wrapping-add (- 0 (* 4294967296 4294967296) 5) 0)"), -5);
+    assert_eq!(int("(wrapping-add (+ 9223372036854775807 1) 0)"), MIN);
+}
+
+#[test]
+fn test_wrapping_ops_drive_a_prng() {
+    // Knuth's MMIX linear congruential generator, which relies on wrapping at 2^64
+    let source = r#"
+        (defun next (state) (wrapping-add (wrapping-mul state 6364136223846793005) 1442695040888963407))
+        (next (next (next 42)))
+    "#;
+    let expected = (0..3).fold(42i64, |state, _| state.wrapping_mul(6364136223846793005).wrapping_add(1442695040888963407));
+    assert_eq!(run(source).unwrap(), Value::Integer(expected));
+}
+
+// ============================================================================
+// Constant folding
+// ============================================================================
+
+#[test]
+fn test_overflowing_literal_call_is_a_compile_error() {
+    let err = compile_error("(define y 1)\n  (print (checked-add 9223372036854775807 1))");
+    assert_eq!(err.message, "Integer overflow in (checked-add 9223372036854775807 1): the result doesn't fit in 64 bits");
+    assert_eq!((err.location.line, err.location.column), (2, 10));
+    // Operands that fold count as literals
+    let err = compile_error("(defconst big 4611686018427387904)\n(checked-mul big (+ 1 1))");
+    assert_eq!(err.message, "Integer overflow in (checked-mul 4611686018427387904 2): the result doesn't fit in 64 bits");
+    assert_eq!((err.location.line, err.location.column), (2, 1));
+}
+
+#[test]
+fn test_folded_calls_nest() {
+    assert_eq!(run("(checked-add (wrapping-add 9223372036854775807 1) 5)").unwrap(), Value::Integer(MIN + 5));
+    let err = compile_error("(+ 1 (checked-mul (wrapping-sub 0 9223372036854775807) 2))");
+    assert_eq!(err.message, "Integer overflow in (checked-mul -9223372036854775807 2): the result doesn't fit in 64 bits");
+    assert_eq!((err.location.line, err.location.column), (1, 6));
+}
+
+#[test]
+fn test_plain_arithmetic_still_promotes() {
+    // + - and * never overflow; they move to bignums, folded or not
+    for fold in [true, false] {
+        let big = run_with("(* 9223372036854775807 2)", fold).unwrap();
+        assert!(matches!(big, Value::BigInt(_)), "got {:?}", big);
+        assert_eq!(run_with("(- (+ 9223372036854775807 1) 1)", fold).unwrap(), Value::Integer(MAX));
+        // Negating the most negative integer and dividing it by -1 don't trap either
+        let two_to_the_63 = run_with("(+ 9223372036854775807 1)", fold).unwrap();
+        assert!(matches!(two_to_the_63, Value::BigInt(_)), "got {:?}", two_to_the_63);
+        assert_eq!(run_with(&format!("(- 0 {})", MIN_SOURCE), fold).unwrap(), two_to_the_63);
+        assert_eq!(run_with(&format!("(/ {} -1)", MIN_SOURCE), fold).unwrap(), two_to_the_63);
+    }
+}
@@ -1,4 +1,5 @@
-use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Value};
+use lisp_bytecode_vm::{Compiler, LispExpr, VM, parser::Parser, Value, optimizer::Optimizer};
+use lisp_bytecode_vm::vm::value::format_float;
 
 /// Helper function to compile and run source code
 fn compile_and_run(source: &str) -> VM {
@@ -10,7 +11,7 @@ fn compile_and_run(source: &str) -> VM {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
     vm
 }
@@ -458,3 +459,185 @@ fn test_pythagorean_theorem() {
     let vm = compile_and_run("(sqrt (+ (* 3 3) (* 4 4)))");
     assert_eq!(get_float(&vm), 5.0);
 }
+
+// ============================================================
+// Float Division, Rounding and Equality
+// ============================================================
+
+#[test]
+fn test_float_division_operator() {
+    let vm = compile_and_run("(/. 1 2)");
+    assert_eq!(get_float(&vm), 0.5);
+
+    let vm = compile_and_run("(/. 20 2 4)");
+    assert_eq!(get_float(&vm), 2.5);
+}
+
+#[test]
+fn test_integer_division_still_truncates() {
+    let vm = compile_and_run("(list (/ 1 2) (/ 1.0 2) (/. 10 5))");
+    match vm.value_stack.last() {
+        Some(Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![Value::Integer(0), Value::Float(0.5), Value::Float(2.0)]);
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_float_division_by_zero_errors() {
+    let mut parser = Parser::new("(/. 1 0)");
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    let err = vm.run().unwrap_err();
+    assert!(err.message.contains("Division by zero"));
+}
+
+#[test]
+fn test_division_type_error_mentions_truncation() {
+    let mut parser = Parser::new("(define s \"2\")\n(/ 7 s)");
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    let err = vm.run().unwrap_err();
+    assert_eq!(err.message, "Type error: '/' expects two numbers, got integer and string");
+    assert!(err.suggestion.unwrap().contains("/ on two integers truncates toward zero, so (/ 7 2) is 3"));
+}
+
+#[test]
+fn test_round() {
+    let vm = compile_and_run("(list (round 2.5) (round -2.5) (round 2.4) (round 7))");
+    match vm.value_stack.last() {
+        Some(Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![
+                Value::Integer(3),
+                Value::Integer(-3),
+                Value::Integer(2),
+                Value::Integer(7),
+            ]);
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_exponent_literal() {
+    let vm = compile_and_run("1e-5");
+    assert_eq!(get_float(&vm), 0.00001);
+
+    let vm = compile_and_run("(* 2.5e3 2)");
+    assert_eq!(get_float(&vm), 5000.0);
+}
+
+#[test]
+fn test_single_equals_coerces() {
+    let vm = compile_and_run("(= 2 2.0)");
+    assert!(get_bool(&vm));
+
+    let vm = compile_and_run("(= 2 2.5)");
+    assert!(!get_bool(&vm));
+}
+
+#[test]
+fn test_constant_folding_matches_runtime_for_mixed_operands() {
+    let cases = [
+        "(+ 1 2.5)", "(- 2.5 1)", "(* 3 0.5)", "(/ 7 2.0)", "(/ 7.0 2)", "(/ 7 2)",
+        "(% 7.5 2)", "(% 7 2)", "(< 1 1.5)", "(<= 2.0 2)", "(> 3 2.9)", "(>= 1 1.0)",
+        "(== 1 1.0)", "(!= 1 1.0)",
+    ];
+
+    for source in cases {
+        let mut parser = Parser::new(source);
+        let exprs = parser.parse_all().unwrap();
+        // Compare the bytecode optimizer against unfolded code
+        let mut compiler = Compiler::new();
+        compiler.set_constant_folding(false);
+        let (_, main) = compiler.compile_program(&exprs).unwrap();
+
+        let mut plain = VM::new();
+        plain.current_bytecode = main.clone().into();
+        plain.run().unwrap();
+
+        let mut optimizer = Optimizer::new();
+        let mut folded = VM::new();
+        folded.current_bytecode = optimizer.optimize(main).into();
+        folded.run().unwrap();
+
+        assert!(optimizer.get_stats().constant_folds > 0, "{} was not folded", source);
+        assert_eq!(plain.value_stack.last(), folded.value_stack.last(), "mismatch for {}", source);
+    }
+}
+
+// ============================================================
+// Printing Round-Trip
+// ============================================================
+
+#[test]
+fn test_printed_floats_read_back_equal() {
+    let values = [
+        0.1, -2.5, 3.0, -0.0, 1e-7, 6.02214076e23, 1e300, f64::MAX, f64::MIN_POSITIVE,
+        1.0 / 3.0, f64::INFINITY, f64::NEG_INFINITY,
+    ];
+
+    for f in values {
+        let printed = format_float(f);
+        let mut parser = Parser::new(&printed);
+        let exprs = parser.parse_all().unwrap();
+        match &exprs[0].expr {
+            LispExpr::Float(read) => assert_eq!(read.to_bits(), f.to_bits(), "{} printed as {}", f, printed),
+            other => panic!("{} printed as {} and read back as {:?}", f, printed, other),
+        }
+    }
+}
+
+#[test]
+fn test_printed_nan_reads_back_as_nan() {
+    let printed = format_float(f64::NAN);
+    assert_eq!(printed, "+nan.0");
+    let vm = compile_and_run(&printed);
+    assert!(get_float(&vm).is_nan());
+}
+
+#[test]
+fn test_whole_floats_print_with_decimal_point() {
+    assert_eq!(format_float(3.0), "3.0");
+    assert_eq!(format_float(-0.0), "-0.0");
+    assert_eq!(format_float(0.5), "0.5");
+    assert_eq!(format_float(f64::NEG_INFINITY), "-inf.0");
+}
+
+#[test]
+fn test_number_string_round_trip_for_floats() {
+    let vm = compile_and_run(r#"(list (number->string 2.5) (string->number "2.5") (string->number (number->string (/. 1 3))))"#);
+    match vm.value_stack.last() {
+        Some(Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![
+                Value::string("2.5"),
+                Value::Float(2.5),
+                Value::Float(1.0 / 3.0),
+            ]);
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_infinity_literals() {
+    let vm = compile_and_run("(list (> +inf.0 1e308) (< -inf.0 0) (== (/. 1 3) (/. 1 3)))");
+    match vm.value_stack.last() {
+        Some(Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![Value::Boolean(true), Value::Boolean(true), Value::Boolean(true)]);
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+}
+
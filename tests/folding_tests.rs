@@ -0,0 +1,162 @@
+use lisp_bytecode_vm::{Compiler, VM, disassembler, parser::Parser, Instruction, Value};
+
+fn compile(source: &str, fold: bool) -> Vec<Instruction> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    compiler.set_constant_folding(fold);
+    let (_, main) = compiler.compile_program(&exprs).unwrap();
+    main
+}
+
+fn run(main: Vec<Instruction>) -> Result<Option<Value>, String> {
+    let mut vm = VM::new();
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned())
+}
+
+/// Run `source` with and without folding, asserting both give the same outcome
+fn assert_same_as_runtime(source: &str) -> Result<Option<Value>, String> {
+    let folded = run(compile(source, true));
+    let plain = run(compile(source, false));
+    assert_eq!(folded, plain, "folding changed the result of {}", source);
+    folded
+}
+
+#[test]
+fn test_dead_branch_is_eliminated() {
+    let main = compile("(if (< 1 2) 'yes 'no)", true);
+    let output = disassembler::disassemble_bytecode(&Default::default(), &main);
+    assert!(!output.contains("Jmp"), "got: {}", output);
+    assert!(!output.contains("\"no\""), "got: {}", output);
+    assert_eq!(run(main), Ok(Some(Value::symbol("yes"))));
+}
+
+#[test]
+fn test_arithmetic_folds_to_one_push() {
+    assert_eq!(compile("(* 60 60 24)", true), vec![Instruction::Push(Value::Integer(86400)), Instruction::Halt]);
+    assert_eq!(
+        compile("(+ (- 10 (neg 2)) (% 7 3) (/ 9 2))", true),
+        vec![Instruction::Push(Value::Integer(17)), Instruction::Halt]
+    );
+    assert_eq!(compile("(if false 1 (+ 2 3))", true), vec![Instruction::Push(Value::Integer(5)), Instruction::Halt]);
+}
+
+#[test]
+fn test_partially_constant_expressions() {
+    // The constant argument is folded, the call is left alone
+    let main = compile("(defun f (x) x) (f (* 2 3))", true);
+    assert!(main.contains(&Instruction::Push(Value::Integer(6))), "got: {:?}", main);
+    assert!(!main.contains(&Instruction::Mul), "got: {:?}", main);
+
+    // Only the taken branch of a constant condition is compiled, even if it is not constant
+    let main = compile("(defun f (x) x) (if (= 1 1) (f 1) (f 2))", true);
+    assert!(!main.iter().any(|instr| matches!(instr, Instruction::JmpIfFalse(_))), "got: {:?}", main);
+    assert!(!main.contains(&Instruction::Push(Value::Integer(2))), "got: {:?}", main);
+}
+
+#[test]
+fn test_division_by_zero_is_left_for_runtime() {
+    let main = compile("(/ 1 0)", true);
+    assert!(main.contains(&Instruction::Div), "got: {:?}", main);
+    assert_eq!(assert_same_as_runtime("(/ 1 0)"), Err("Division by zero".to_string()));
+    assert!(assert_same_as_runtime("(% 5 (- 2 2))").is_err());
+}
+
+#[test]
+fn test_overflow_matches_runtime() {
+    for source in [
+        "(* 9223372036854775807 2)",
+        "(+ 9223372036854775807 1)",
+        "(- (neg 9223372036854775807) 2)",
+        "(/ (- (neg 9223372036854775807) 1) -1)",
+        "(% (- (neg 9223372036854775807) 1) -1)",
+    ] {
+        assert!(assert_same_as_runtime(source).is_ok(), "{} failed", source);
+    }
+    // The overflow folds to the bignum the VM would have promoted it to
+    let main = compile("(* 9223372036854775807 2)", true);
+    assert_eq!(main.len(), 2, "got: {:?}", main);
+    assert_eq!(run(main), run(compile("(* 9223372036854775807 2)", false)));
+}
+
+#[test]
+fn test_bignum_operands_fold_and_narrow() {
+    for source in [
+        "(- (* 9223372036854775807 2) 9223372036854775807)",
+        "(/ (* 4294967296 4294967296) 4294967296)",
+        "(% (+ (* 4294967296 4294967296) 7) 10)",
+        "(< 9223372036854775807 (+ 9223372036854775807 1))",
+    ] {
+        let main = compile(source, true);
+        assert_eq!(main.len(), 2, "{} was not folded: {:?}", source, main);
+        assert!(assert_same_as_runtime(source).is_ok(), "{} failed", source);
+    }
+    // A result that fits comes back as a plain integer
+    assert_eq!(
+        compile("(- (* 9223372036854775807 2) 9223372036854775807)", true),
+        vec![Instruction::Push(Value::Integer(9223372036854775807)), Instruction::Halt]
+    );
+}
+
+#[test]
+fn test_integer_division_builtins_fold() {
+    assert_eq!(
+        compile("(list (quotient -7 2) (remainder -7 2) (modulo -7 2))", true),
+        vec![
+            Instruction::Push(Value::Integer(-3)),
+            Instruction::Push(Value::Integer(-1)),
+            Instruction::Push(Value::Integer(1)),
+            Instruction::MakeList(3),
+            Instruction::Halt,
+        ]
+    );
+    let main = compile("(modulo 7 (- 3 3))", true);
+    assert!(main.contains(&Instruction::Modulo), "got: {:?}", main);
+    assert!(assert_same_as_runtime("(modulo 7 (- 3 3))").unwrap_err().contains("Division by zero in 'modulo'"));
+}
+
+#[test]
+fn test_disassembly_shows_the_folded_constant() {
+    let main = compile("(* 2 (+ 3 4))", true);
+    let output = disassembler::disassemble_bytecode(&Default::default(), &main);
+    assert!(output.contains("Push(Integer(14))"), "got: {}", output);
+    assert!(!output.contains("Add") && !output.contains("Mul"), "got: {}", output);
+}
+
+#[test]
+fn test_variables_and_calls_are_not_folded() {
+    let mut parser = Parser::new("(defun f (x) (+ x (* 2 3)))");
+    let exprs = parser.parse_all().unwrap();
+    let (functions, _) = Compiler::new().compile_program(&exprs).unwrap();
+    assert!(functions["f"].contains(&Instruction::Add), "got: {:?}", functions["f"]);
+    assert!(functions["f"].contains(&Instruction::Push(Value::Integer(6))), "got: {:?}", functions["f"]);
+
+    // A call with side effects is kept even when its arguments are constant
+    let main = compile("(+ 1 (print 2))", true);
+    assert!(main.contains(&Instruction::Add), "got: {:?}", main);
+}
+
+#[test]
+fn test_non_boolean_condition_folds_to_the_then_branch() {
+    // Only false is falsy, so any other constant takes the then branch
+    assert_eq!(assert_same_as_runtime("(if (+ 1 2) 'a 'b)"), Ok(Some(Value::symbol("a"))));
+    assert_eq!(assert_same_as_runtime("(if '() 'a 'b)"), Ok(Some(Value::symbol("a"))));
+}
+
+#[test]
+fn test_shadowed_operator_is_not_folded() {
+    let source = "(let ((+ (lambda (a b) (* a b)))) (+ 3 4))";
+    assert_eq!(assert_same_as_runtime(source), Ok(Some(Value::Integer(12))));
+
+    let source = "(defmacro + (a b) (list '* a b)) (+ 3 4)";
+    assert_eq!(assert_same_as_runtime(source), Ok(Some(Value::Integer(12))));
+}
+
+#[test]
+fn test_folding_can_be_disabled() {
+    let main = compile("(if (< 1 2) (* 60 60) 0)", false);
+    assert!(main.iter().any(|instr| matches!(instr, Instruction::JmpIfFalse(_))), "got: {:?}", main);
+    assert!(main.contains(&Instruction::Mul), "got: {:?}", main);
+}
@@ -12,7 +12,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
     for (name, bytecode) in functions {
         vm.functions.insert(name, bytecode);
     }
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().map_err(|e| format!("Runtime error: {:?}", e))?;
 
     // Get the top value from the stack and format it
@@ -0,0 +1,142 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Value};
+use lisp_bytecode_vm::vm::gc::{DEFAULT_GC_THRESHOLD, GC_THRESHOLD_ENV};
+
+fn vm_for(source: &str) -> VM {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm
+}
+
+// A letrec closure refers to itself through its cell, so each call leaves a cycle
+const CYCLES: &str = r#"
+    (defun make-counter (n)
+      (letrec ((count (lambda (i) (if (= i 0) 0 (+ 1 (count (- i 1)))))))
+        (count n)))
+    (defun churn (n) (dotimes (i n) (make-counter 3)))
+    (churn 10000)
+"#;
+
+#[test]
+fn test_short_lived_pairs_keep_heap_bounded() {
+    // 1,000,000 iterations of a 10-element list: 10 million pairs
+    let mut vm = vm_for("(defun churn (n) (dotimes (i n) (list i i i i i i i i i i))) (churn 1000000)");
+    vm.heap.set_threshold(10_000);
+    vm.run().unwrap();
+
+    let stats = &vm.heap.stats;
+    assert!(stats.collections >= 1000, "got: {:?}", stats);
+    assert!(stats.peak_live_objects < 1000, "got: {:?}", stats);
+}
+
+#[test]
+fn test_unreachable_cycles_are_reclaimed() {
+    let mut vm = vm_for(CYCLES);
+    vm.heap.set_threshold(1000);
+    vm.run().unwrap();
+    assert!(vm.heap.stats.cells_reclaimed > 9000, "got: {:?}", vm.heap.stats);
+    assert!(vm.heap.live_cells() <= 1000, "got: {}", vm.heap.live_cells());
+
+    // Without collections every cycle is still alive
+    let mut vm = vm_for(CYCLES);
+    vm.heap.set_threshold(usize::MAX);
+    vm.run().unwrap();
+    assert_eq!(vm.heap.stats.collections, 0);
+    assert_eq!(vm.heap.live_cells(), 10000);
+}
+
+#[test]
+fn test_stress_mode_keeps_reachable_values() {
+    // Collecting after every allocation must not empty a cell still in use
+    let source = r#"
+        (defun make-parity ()
+          (letrec ((even? (lambda (n) (if (= n 0) true (odd? (- n 1)))))
+                   (odd? (lambda (n) (if (= n 0) false (even? (- n 1))))))
+            even?))
+        (define checks '())
+        (define is-even (make-parity))
+        (dotimes (i 20) (set! checks (cons (is-even i) (cons i checks))))
+        (list (car (cdr checks)) (is-even 31) (is-even 100) (catch 'done (throw 'done (make-parity))))
+    "#;
+    let mut vm = vm_for(source);
+    vm.heap.set_stress(true);
+    vm.run().unwrap();
+    assert!(vm.heap.stats.collections >= 40, "got: {:?}", vm.heap.stats);
+
+    let result = vm.value_stack.last().cloned().unwrap();
+    let items = match result {
+        Value::List(list) => list.to_vec(),
+        other => panic!("Expected a list, got {:?}", other),
+    };
+    assert_eq!(items[0], Value::Integer(19));
+    assert_eq!(items[1], Value::Boolean(false));
+    assert_eq!(items[2], Value::Boolean(true));
+    assert!(matches!(items[3], Value::Closure(_)));
+
+    // Both closures are still reachable, from the global and from the result
+    vm.collect_garbage();
+    assert_eq!(vm.heap.stats.cells_reclaimed, 0);
+    assert_eq!(vm.heap.live_cells(), 4);
+}
+
+#[test]
+fn test_threshold_from_environment() {
+    std::env::set_var(GC_THRESHOLD_ENV, "2500");
+    let configured = VM::new().heap.threshold();
+    std::env::remove_var(GC_THRESHOLD_ENV);
+    assert_eq!(configured, 2500);
+
+    std::env::set_var(GC_THRESHOLD_ENV, "many");
+    let fallback = VM::new().heap.threshold();
+    std::env::remove_var(GC_THRESHOLD_ENV);
+    assert_eq!(fallback, DEFAULT_GC_THRESHOLD);
+}
+
+#[test]
+fn test_gc_builtin_reports_reclaimed_objects() {
+    // Each cycle is a cell and the closure stored in it
+    let source = r#"
+        (defun make-cycle ()
+          (letrec ((self (lambda () (list 'captured self))))
+            (self)))
+        (dotimes (i 10) (make-cycle))
+        (list (gc) (gc))
+    "#;
+    let mut vm = vm_for(source);
+    vm.heap.set_threshold(usize::MAX);
+    vm.run().unwrap();
+    let counts = match vm.value_stack.last() {
+        Some(Value::List(list)) => list.to_vec(),
+        other => panic!("Expected a list, got {:?}", other),
+    };
+    assert_eq!(counts[0], Value::Integer(20));
+    // The second collection finds nothing left to free
+    assert_eq!(counts[1], Value::Integer(0));
+    assert_eq!(vm.heap.stats.cells_reclaimed, 10);
+    assert_eq!(vm.heap.stats.objects_reclaimed, 20);
+    assert_eq!(vm.heap.live_cells(), 0);
+}
+
+#[test]
+fn test_long_loop_reaches_steady_state() {
+    // Short-lived lists and cycles on every iteration; the live heap is sampled
+    // at each collection and has to stop growing
+    let source = r#"
+        (defun step (i)
+          (letrec ((walk (lambda (xs) (if (null? xs) 0 (+ (car xs) (walk (cdr xs)))))))
+            (walk (list i i i i i))))
+        (defun churn (n) (dotimes (i n) (step i)))
+        (churn 50000)
+    "#;
+    let mut vm = vm_for(source);
+    vm.heap.set_threshold(5000);
+    vm.run().unwrap();
+    let stats = &vm.heap.stats;
+    assert!(stats.collections >= 50, "got: {:?}", stats);
+    assert!(stats.peak_live_objects < 5000, "got: {:?}", stats);
+    assert!(vm.heap.live_cells() < 5000, "got: {}", vm.heap.live_cells());
+}
@@ -0,0 +1,85 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+
+fn run(source: &str) -> Result<Value, String> {
+    let exprs = Parser::new(source).parse_all()?;
+    let (functions, main) = Compiler::new().compile_program(&exprs).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn symbol_name(value: &Value) -> String {
+    match value {
+        Value::Symbol(s) => s.as_str().to_string(),
+        _ => panic!("expected a symbol, got {:?}", value),
+    }
+}
+
+const SWAP: &str = r#"
+    (defmacro swap! (a b)
+      (let ((tmp (gensym "tmp")))
+        `(let ((,tmp ,a))
+           (do (set! ,a ,b)
+               (set! ,b ,tmp)))))
+"#;
+
+#[test]
+fn test_macro_temporaries_do_not_capture_user_names() {
+    // The user's own variable is called tmp, like the macro's temporary
+    let source = format!("{}(define tmp 1) (define other 2) (swap! tmp other) (list tmp other)", SWAP);
+    assert_eq!(run(&source).unwrap(), Value::List(List::from_vec(vec![Value::Integer(2), Value::Integer(1)])));
+    let source = r#"
+        (defmacro or2 (a b)
+          (let ((v (gensym)))
+            `(let ((,v ,a)) (if ,v ,v ,b))))
+        (let ((G__0 5) (G__1 6)) (or2 #f (+ G__0 G__1)))
+    "#;
+    assert_eq!(run(source).unwrap(), Value::Integer(11));
+}
+
+#[test]
+fn test_every_call_makes_a_new_symbol() {
+    assert_eq!(run("(eq? (gensym) (gensym))").unwrap(), Value::Boolean(false));
+    assert_eq!(run(r#"(let ((g (gensym "x"))) (list (eq? g g) (equal? g (gensym "x"))))"#).unwrap(),
+        Value::List(List::from_vec(vec![Value::Boolean(true), Value::Boolean(false)])));
+    assert_eq!(run("(symbol? (gensym))").unwrap(), Value::Boolean(true));
+}
+
+#[test]
+fn test_gensym_names_start_with_the_prefix() {
+    let name = symbol_name(&run(r#"(gensym "loop-var")"#).unwrap());
+    assert!(name.starts_with("#:loop-var"), "{}", name);
+    assert!(name["#:loop-var".len()..].chars().all(|c| c.is_ascii_digit()), "{}", name);
+    assert!(symbol_name(&run("(gensym)").unwrap()).starts_with("#:G__"));
+}
+
+#[test]
+fn test_the_reader_never_produces_a_gensym() {
+    // What a gensym is written as doesn't read back as a symbol at all
+    let source = r#"(handler-case (read-from-string (symbol->string (gensym))) (catch (e) 'unreadable))"#;
+    assert_eq!(run(source).unwrap(), Value::symbol("unreadable"));
+    // Nor does a name string->symbol made first come back from gensym
+    let taken = symbol_name(&run("(gensym)").unwrap());
+    let next = taken["#:G__".len()..].parse::<u64>().unwrap() + 1;
+    let source = format!(r##"(define taken (string->symbol "#:G__{}")) (list (eq? taken (gensym)) (eq? taken (gensym)))"##, next);
+    assert_eq!(run(&source).unwrap(), Value::List(List::from_vec(vec![Value::Boolean(false), Value::Boolean(false)])));
+}
+
+#[test]
+fn test_gensyms_work_as_binding_names() {
+    assert_eq!(run("((eval (list 'lambda (list (gensym)) 42)) 1)").unwrap(), Value::Integer(42));
+    let source = r#"
+        (define g (gensym "n"))
+        (eval (list 'let (list (list g 20)) (list '+ g g)))
+    "#;
+    assert_eq!(run(source).unwrap(), Value::Integer(40));
+}
+
+#[test]
+fn test_gensym_checks_its_prefix() {
+    assert_eq!(run("(gensym 5)").unwrap_err(), "Type error: 'gensym' expects a string prefix, got integer");
+    assert_eq!(run("(gensym 'x)").unwrap_err(), "Type error: 'gensym' expects a string prefix, got symbol");
+    assert_eq!(run(r#"(gensym "a" "b")"#).unwrap_err(), "gensym expects at most 1 argument: an optional prefix string");
+}
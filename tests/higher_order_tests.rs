@@ -0,0 +1,106 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+
+fn run_vm(source: &str) -> Result<VM, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+fn run(source: &str) -> Result<Option<Value>, String> {
+    Ok(run_vm(source)?.value_stack.last().cloned())
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+#[test]
+fn test_map_accepts_any_callable() {
+    let source = r#"
+        (defun square (x) (* x x))
+        (define offset 10)
+        (list (map square '(1 2 3))
+              (map (lambda (x) (+ x offset)) '(1 2 3))
+              (map car '((1 2) (3 4)))
+              (map neg '(1 2)))
+    "#;
+    let expected = vec![ints(&[1, 4, 9]), ints(&[11, 12, 13]), ints(&[1, 3]), ints(&[-1, -2])];
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(expected)))));
+}
+
+#[test]
+fn test_filter_and_reduce() {
+    let source = r#"
+        (defun even? (n) (= (% n 2) 0))
+        (list (filter even? '(1 2 3 4 5 6))
+              (filter (lambda (x) (> x 3)) '(1 5 2 7))
+              (reduce + 0 '(1 2 3 4))
+              (reduce (lambda (acc x) (cons x acc)) '() '(1 2 3)))
+    "#;
+    let expected = vec![ints(&[2, 4, 6]), ints(&[5, 7]), Value::Integer(10), ints(&[3, 2, 1])];
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(expected)))));
+}
+
+#[test]
+fn test_empty_lists() {
+    assert_eq!(run("(map (lambda (x) x) '())"), Ok(Some(ints(&[]))));
+    assert_eq!(run("(filter (lambda (x) true) '())"), Ok(Some(ints(&[]))));
+    assert_eq!(run("(reduce + 42 '())"), Ok(Some(Value::Integer(42))));
+    assert_eq!(run("(map + '(1 2) '())"), Ok(Some(ints(&[]))));
+}
+
+#[test]
+fn test_map_over_several_lists() {
+    assert_eq!(run("(map + '(1 2 3) '(10 20 30))"), Ok(Some(ints(&[11, 22, 33]))));
+    // Stops at the end of the shortest list
+    assert_eq!(run("(map (lambda (a b c) (list a b c)) '(1 2) '(3 4 5) '(6 7 8))").unwrap(), Some(Value::List(List::from_vec(vec![ints(&[1, 3, 6]), ints(&[2, 4, 7])]))));
+}
+
+#[test]
+fn test_long_lists_do_not_grow_the_stack() {
+    let source = r#"
+        (defun range-down (n acc) (if (= n 0) acc (range-down (- n 1) (cons n acc))))
+        (define numbers (range-down 20000 '()))
+        (list (reduce + 0 (map (lambda (x) (* 2 x)) numbers))
+              (list-length (filter (lambda (x) (= (% x 4) 0)) numbers)))
+    "#;
+    let vm = run_vm(source).unwrap();
+    assert_eq!(vm.value_stack, vec![ints(&[20000 * 20001, 5000])]);
+    assert!(vm.call_stack.is_empty());
+}
+
+#[test]
+fn test_builtins_are_first_class() {
+    assert_eq!(run("(apply map (list car '((1 2) (3 4))))"), Ok(Some(ints(&[1, 3]))));
+    let expected = vec![Value::List(List::from_vec(vec![Value::Boolean(false), Value::Boolean(true)])), ints(&[2])];
+    assert_eq!(run("(map (lambda (f) (f (lambda (x) (> x 1)) '(1 2))) (list map filter))"), Ok(Some(Value::List(List::from_vec(expected)))));
+}
+
+#[test]
+fn test_errors_raised_by_the_function_unwind_through_map() {
+    let source = r#"
+        (define result
+          (handler-case (map (lambda (x) (if (= x 3) (raise "three") x)) '(1 2 3 4))
+            (catch (e) e)))
+        result
+    "#;
+    let vm = run_vm(source).unwrap();
+    assert_eq!(vm.value_stack, vec![Value::String(std::sync::Arc::new("three".to_string()))]);
+}
+
+#[test]
+fn test_type_errors() {
+    assert_eq!(run("(map 5 '(1 2))").unwrap_err(), "Type error: expected function or closure, got integer");
+    assert_eq!(run("(map + '(1) 2)").unwrap_err(), "Type error: 'map' expects lists, got integer");
+}
+
+#[test]
+fn test_a_defun_replaces_the_builtin() {
+    let source = "(defun map (f lst) 'mine) (map car '((1)))";
+    assert_eq!(run(source), Ok(Some(Value::symbol("mine"))));
+}
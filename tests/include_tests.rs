@@ -0,0 +1,144 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, CompileError, Instruction, Value};
+use std::collections::HashMap;
+use std::fs;
+use std::path::PathBuf;
+
+/// Write `files` under a fresh directory for the test, returning the directory
+fn write_files(test: &str, files: &[(&str, &str)]) -> PathBuf {
+    let dir = std::env::temp_dir().join(format!("lisp-include-tests-{}", test));
+    let _ = fs::remove_dir_all(&dir);
+    for (name, content) in files {
+        let path = dir.join(name);
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        fs::write(path, content).unwrap();
+    }
+    dir
+}
+
+fn compile_file(path: &PathBuf) -> Result<(HashMap<String, Vec<Instruction>>, Vec<Instruction>), CompileError> {
+    let file = path.to_string_lossy().to_string();
+    let source = fs::read_to_string(path).unwrap();
+    let exprs = Parser::new_with_file(&source, file).parse_all().unwrap();
+    Compiler::new().compile_program(&exprs)
+}
+
+fn run_file(path: &PathBuf) -> Result<Option<Value>, String> {
+    let (functions, main) = compile_file(path).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.current_file = Some(path.to_string_lossy().to_string());
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned())
+}
+
+#[test]
+fn test_include_chain_is_one_compilation_unit() {
+    let dir = write_files("chain", &[
+        ("main.lisp", r#"
+            (include "lib/shapes.lisp")
+            (defun count-down (n) (if (= n 0) 'done (step-down n)))
+            (list (area 3 4) (count-down 100000))
+        "#),
+        // Relative to lib/, where shapes.lisp is
+        ("lib/shapes.lisp", r#"
+            (include "steps.lisp")
+            (defun area (w h) (* w h))
+        "#),
+        ("lib/steps.lisp", "(defun step-down (n) (count-down (- n 1)))"),
+    ]);
+    let expected = Value::List(lisp_bytecode_vm::List::from_vec(vec![Value::Integer(12), Value::symbol("done")]));
+    assert_eq!(run_file(&dir.join("main.lisp")), Ok(Some(expected)));
+
+    // The included defuns are tail-called like the including file's own
+    let (functions, _) = compile_file(&dir.join("main.lisp")).unwrap();
+    assert!(functions["step-down"].contains(&Instruction::TailCall("count-down".to_string(), 1)), "got: {:?}", functions["step-down"]);
+    assert!(functions["count-down"].contains(&Instruction::TailCall("step-down".to_string(), 1)), "got: {:?}", functions["count-down"]);
+}
+
+#[test]
+fn test_calls_to_included_defuns_are_arity_checked() {
+    let dir = write_files("arity", &[
+        ("main.lisp", "(include \"lib.lisp\")\n(area 3)"),
+        ("lib.lisp", "(defun area (w h) (* w h))"),
+    ]);
+    let err = compile_file(&dir.join("main.lisp")).unwrap_err();
+    assert_eq!(err.message, "'area' expects 2 argument(s), got 1");
+    assert_eq!(err.location.line, 2);
+}
+
+#[test]
+fn test_circular_include_lists_the_cycle() {
+    let dir = write_files("cycle", &[
+        ("main.lisp", "(include \"a.lisp\")"),
+        ("a.lisp", "(include \"b.lisp\")"),
+        ("b.lisp", "(defun b () 1)\n(include \"a.lisp\")"),
+    ]);
+    let err = compile_file(&dir.join("main.lisp")).unwrap_err();
+    let (a, b) = (dir.join("a.lisp"), dir.join("b.lisp"));
+    let (a, b) = (a.to_string_lossy(), b.to_string_lossy());
+    assert_eq!(err.message, format!("Circular include: {} -> {} -> {}", a, b, a));
+    assert_eq!((err.location.file.as_str(), err.location.line), (&*b, 2));
+
+    // Including the file being compiled is a cycle too
+    let dir = write_files("self-cycle", &[("main.lisp", "(include \"main.lisp\")")]);
+    let err = compile_file(&dir.join("main.lisp")).unwrap_err();
+    assert!(err.message.starts_with("Circular include: "), "got: {}", err.message);
+}
+
+#[test]
+fn test_errors_in_an_included_file_cite_that_file() {
+    let dir = write_files("diagnostics", &[
+        ("main.lisp", "; the program\n(include \"lib.lisp\")\n(f)"),
+        ("lib.lisp", "(defun f ()\n  (let ((x 1))\n    (set! undefined-thing x)))"),
+    ]);
+    let main = dir.join("main.lisp");
+    let source = fs::read_to_string(&main).unwrap();
+    let exprs = Parser::new_with_file(&source, main.to_string_lossy().to_string()).parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let err = compiler.compile_program(&exprs).unwrap_err();
+    let lib = dir.join("lib.lisp").to_string_lossy().to_string();
+    assert_eq!(err.location.file, lib);
+    assert_eq!(err.location.line, 3);
+
+    // The source context is the included file's, not the one given for the program
+    let output = err.format(Some(compiler.source_for(&err, &source)));
+    assert!(output.contains(&format!("{}:3:", lib)), "got: {}", output);
+    assert!(output.contains("(set! undefined-thing x)"), "got: {}", output);
+    assert!(!output.contains("the program"), "got: {}", output);
+}
+
+#[test]
+fn test_include_errors() {
+    let dir = write_files("errors", &[
+        ("missing.lisp", "(include \"nowhere.lisp\")"),
+        ("nested.lisp", "(defun f () (include \"lib.lisp\"))"),
+        ("literal.lisp", "(include lib)"),
+    ]);
+    let err = compile_file(&dir.join("missing.lisp")).unwrap_err();
+    assert!(err.message.starts_with(&format!("Cannot include '{}'", dir.join("nowhere.lisp").to_string_lossy())), "got: {}", err.message);
+    let err = compile_file(&dir.join("nested.lisp")).unwrap_err();
+    assert_eq!(err.message, "include is only allowed at the top level of a file");
+    let err = compile_file(&dir.join("literal.lisp")).unwrap_err();
+    assert_eq!(err.message, "include expects a file path string: (include \"file.lisp\")");
+}
+
+#[test]
+fn test_load_resolves_paths_from_the_loading_file() {
+    let dir = write_files("load-chain", &[
+        ("main.lisp", "(load \"lib/first.lisp\")\n(list (first-value) (second-value))"),
+        ("lib/first.lisp", "(load \"more/second.lisp\")\n(defun first-value () 1)"),
+        ("lib/more/second.lisp", "(defun second-value () 2)"),
+    ]);
+    let expected = Value::List(lisp_bytecode_vm::List::from_vec(vec![Value::Integer(1), Value::Integer(2)]));
+    assert_eq!(run_file(&dir.join("main.lisp")), Ok(Some(expected)));
+}
+
+#[test]
+fn test_loaded_globals_share_the_environment() {
+    let dir = write_files("load-globals", &[
+        ("main.lisp", "(define counter 1)\n(load \"bump.lisp\")\n(load \"bump.lisp\")\ncounter"),
+        ("bump.lisp", "(set! counter (+ counter 10))"),
+    ]);
+    assert_eq!(run_file(&dir.join("main.lisp")), Ok(Some(Value::Integer(21))));
+}
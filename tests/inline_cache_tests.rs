@@ -0,0 +1,100 @@
+use lisp_bytecode_vm::{Compiler, Instruction, VM, parser::Parser, repl::Repl, List, Value};
+
+fn vm_for(source: &str) -> VM {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm
+}
+
+fn run(source: &str) -> Result<Value, String> {
+    let mut vm = vm_for(source);
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+#[test]
+fn test_redefinition_mid_run_is_seen_by_compiled_callers() {
+    // g's call to f is cached after the first round; the eval'd defun must still win
+    let source = r#"
+        (defun f () 1)
+        (defun g () (f))
+        (defun rounds (i acc)
+          (if (= i 10)
+              (reverse acc)
+              (do (if (= i 5) (eval "(defun f () 2)") '())
+                  (rounds (+ i 1) (cons (g) acc)))))
+        (rounds 0 '())
+    "#;
+    assert_eq!(run(source).unwrap(), ints(&[1, 1, 1, 1, 1, 2, 2, 2, 2, 2]));
+}
+
+#[test]
+fn test_redefinition_reaches_cached_tail_calls() {
+    let source = r#"
+        (defun step (n) (if (= n 0) 'old (hop (- n 1))))
+        (defun hop (n) (step n))
+        (list (hop 20)
+              (do (eval "(defun step (n) (if (= n 0) 'new (hop (- n 1))))") (hop 20)))
+    "#;
+    assert_eq!(run(source).unwrap(), Value::List(List::from_vec(vec![Value::symbol("old"), Value::symbol("new")])));
+}
+
+#[test]
+fn test_redefinition_between_runs() {
+    let mut vm = vm_for("(defun f (x) (* x 10)) (defun g (x) (+ (f x) 1)) (g 4)");
+    vm.run().unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(41)));
+
+    // Replace f directly in the table, as the REPL and load do, and run g's caller again
+    vm.functions.insert("f".to_string(), vec![Instruction::LoadArg(0), Instruction::Ret]);
+    vm.current_bytecode = vec![Instruction::Push(Value::Integer(4)), Instruction::Call("g".to_string(), 1), Instruction::Halt].into();
+    vm.value_stack.clear();
+    vm.instruction_pointer = 0;
+    vm.halted = false;
+    vm.run().unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(5)));
+}
+
+#[test]
+fn test_redefinition_in_the_repl() {
+    let mut repl = Repl::new();
+    repl.eval_input("(defun greeting () 'hello)").unwrap();
+    repl.eval_input("(defun greet-twice () (list (greeting) (greeting)))").unwrap();
+    let both = |word: &str| Some(Value::List(List::from_vec(vec![Value::symbol(word), Value::symbol(word)])));
+    assert_eq!(repl.eval_input("(greet-twice)").unwrap(), both("hello"));
+    repl.eval_input("(defun greeting () 'goodbye)").unwrap();
+    assert_eq!(repl.eval_input("(greet-twice)").unwrap(), both("goodbye"));
+}
+
+#[test]
+fn test_linked_functions_keep_their_table_bytecode() {
+    // Calls run through linked copies; what the table holds is what was compiled
+    let mut vm = vm_for("(defun f (x) x) (defun g (x) (f x)) (g 1) (g 2)");
+    let compiled = vm.functions.get("g").cloned();
+    vm.run().unwrap();
+    assert_eq!(vm.functions.get("g").cloned(), compiled);
+    assert!(compiled.unwrap().contains(&Instruction::TailCall("f".to_string(), 1)));
+}
+
+#[test]
+fn test_cached_calls_report_errors_where_they_happen() {
+    let source = "(defun inner (x) (car x))\n(defun outer (x) (+ 1 (inner x)))\n(outer '(1))\n(outer 5)";
+    let exprs = Parser::new_with_file(source, "cache.lisp".to_string()).parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    let err = vm.run().unwrap_err();
+    assert_eq!(err.message, "Type error: 'car' expects a list, got integer");
+    assert_eq!(err.location.map(|l| (l.line, l.column)), Some((1, 18)));
+    assert_eq!(err.call_stack, vec!["outer".to_string(), "inner".to_string()]);
+}
@@ -0,0 +1,76 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+
+fn vm_for(source: &str) -> VM {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm
+}
+
+fn run_with_budget(source: &str, budget: u64) -> Result<Value, String> {
+    let mut vm = vm_for(source);
+    vm.set_instruction_budget(Some(budget));
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+/// Instructions the program runs to completion with no budget
+fn instructions_used(source: &str) -> u64 {
+    let mut vm = vm_for(source);
+    vm.run().unwrap();
+    vm.instructions_executed
+}
+
+const SUM: &str = "(defun sum (n acc) (if (= n 0) acc (sum (- n 1) (+ acc n)))) (sum 100 0)";
+
+#[test]
+fn test_an_infinite_loop_stops_at_the_budget() {
+    assert_eq!(run_with_budget("(loop () (recur))", 50_000).unwrap_err(), "Instruction budget exceeded: 50000 instructions executed");
+    assert_eq!(run_with_budget("(defun spin (n) (spin (+ n 1))) (spin 0)", 1_000).unwrap_err(),
+        "Instruction budget exceeded: 1000 instructions executed");
+}
+
+#[test]
+fn test_the_budget_counts_every_instruction_executed() {
+    let used = instructions_used(SUM);
+    assert_eq!(run_with_budget(SUM, used).unwrap(), Value::Integer(5050));
+    assert!(run_with_budget(SUM, used - 1).is_err());
+    // Counted across runs: what the first used is gone for the second
+    let mut vm = vm_for(SUM);
+    vm.set_instruction_budget(Some(used + used / 2));
+    vm.run().unwrap();
+    vm.current_bytecode = vm_for(SUM).current_bytecode.into();
+    vm.instruction_pointer = 0;
+    vm.halted = false;
+    assert!(vm.run().unwrap_err().message.starts_with("Instruction budget exceeded"));
+    // Lifting the limit lets it run again
+    vm.set_instruction_budget(None);
+    vm.instruction_pointer = 0;
+    vm.halted = false;
+    vm.run().unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(5050)));
+}
+
+#[test]
+fn test_a_handler_can_catch_the_budget_error_once() {
+    let source = "(handler-case (loop () (recur)) (catch (e) (list 'stopped (hash-ref e 'message))))";
+    assert_eq!(run_with_budget(source, 10_000).unwrap(), Value::List(List::from_vec(vec![
+        Value::symbol("stopped"), Value::string("Instruction budget exceeded: 10000 instructions executed"),
+    ])));
+    // The same from code eval ran
+    let source = "(handler-case (eval '(loop () (recur))) (catch (e) 'caught))";
+    assert_eq!(run_with_budget(source, 10_000).unwrap(), Value::symbol("caught"));
+}
+
+#[test]
+fn test_a_handler_that_keeps_running_is_stopped_too() {
+    let source = "
+        (defun forever ()
+          (handler-case (loop () (recur)) (catch (e) (forever))))
+        (forever)";
+    assert_eq!(run_with_budget(source, 10_000).unwrap_err(), "Instruction budget exceeded: 10000 instructions executed");
+    let source = "(handler-case (handler-case (loop () (recur)) (catch (e) (loop () (recur)))) (catch (e) 'outer))";
+    assert!(run_with_budget(source, 10_000).is_err());
+}
@@ -0,0 +1,135 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value, RuntimeError};
+
+fn run(source: &str) -> Result<Value, RuntimeError> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm.run()?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn int(source: &str) -> i64 {
+    match run(source) {
+        Ok(Value::Integer(n)) => n,
+        other => panic!("Expected an integer from {}, got {:?}", source, other),
+    }
+}
+
+// ============================================================================
+// Sign conventions
+// ============================================================================
+
+#[test]
+fn test_quotient_truncates_toward_zero() {
+    assert_eq!(int("(quotient 7 3)"), 2);
+    assert_eq!(int("(quotient -7 3)"), -2);
+    assert_eq!(int("(quotient 7 -3)"), -2);
+    assert_eq!(int("(quotient -7 -3)"), 2);
+}
+
+#[test]
+fn test_remainder_follows_the_dividend() {
+    assert_eq!(int("(remainder 7 3)"), 1);
+    assert_eq!(int("(remainder -7 3)"), -1);
+    assert_eq!(int("(remainder 7 -3)"), 1);
+    assert_eq!(int("(remainder -7 -3)"), -1);
+}
+
+#[test]
+fn test_modulo_follows_the_divisor() {
+    assert_eq!(int("(modulo 7 3)"), 1);
+    assert_eq!(int("(modulo -7 3)"), 2);
+    assert_eq!(int("(modulo 7 -3)"), -2);
+    assert_eq!(int("(modulo -7 -3)"), -1);
+}
+
+#[test]
+fn test_exact_multiples_are_zero() {
+    assert_eq!(int("(remainder -9 3)"), 0);
+    assert_eq!(int("(modulo -9 3)"), 0);
+    assert_eq!(int("(modulo 9 -3)"), 0);
+    assert_eq!(int("(modulo 0 5)"), 0);
+}
+
+#[test]
+fn test_quotient_and_remainder_reconstruct_the_dividend() {
+    let source = r#"
+        (defun check (a b) (= a (+ (* b (quotient a b)) (remainder a b))))
+        (list (check 17 5) (check -17 5) (check 17 -5) (check -17 -5))
+    "#;
+    let expected = Value::List(List::from_vec(vec![Value::Boolean(true); 4]));
+    assert_eq!(run(source).unwrap(), expected);
+}
+
+// ============================================================================
+// Extremes and bignums
+// ============================================================================
+
+#[test]
+fn test_min_integer_by_minus_one() {
+    assert_eq!(run("(quotient (- -9223372036854775807 1) -1)").unwrap(), run("(+ 9223372036854775807 1)").unwrap());
+    assert_eq!(int("(remainder (- -9223372036854775807 1) -1)"), 0);
+    assert_eq!(int("(modulo (- -9223372036854775807 1) -1)"), 0);
+}
+
+#[test]
+fn test_bignum_operands() {
+    // 2^64 overflows into a bignum
+    assert_eq!(int("(quotient (* 4294967296 4294967296) 4294967296)"), 4294967296);
+    assert_eq!(int("(remainder (- 0 (+ (* 4294967296 4294967296) 1)) 10)"), -7);
+    assert_eq!(int("(modulo (- 0 (+ (* 4294967296 4294967296) 1)) 10)"), 3);
+    assert_eq!(int("(modulo 5 (* 4294967296 4294967296))"), 5);
+    assert_eq!(run("(modulo -5 (* 4294967296 4294967296))").unwrap(), run("(- (* 4294967296 4294967296) 5)").unwrap());
+}
+
+// ============================================================================
+// Errors
+// ============================================================================
+
+#[test]
+fn test_division_by_zero_is_located() {
+    for op in ["quotient", "remainder", "modulo"] {
+        let source = format!("(defun f (a b)\n  ({} a b))\n(f 7 0)", op);
+        let err = run(&source).unwrap_err();
+        assert!(err.message.contains(&format!("Division by zero in '{}'", op)), "got: {}", err.message);
+        let location = err.location.expect("a location for the error");
+        assert_eq!((location.line, location.column), (2, 3));
+    }
+}
+
+#[test]
+fn test_division_by_zero_is_catchable() {
+    let source = "(handler-case (modulo 1 0) (catch (e) 'caught))";
+    assert_eq!(run(source).unwrap(), Value::symbol("caught"));
+    let err = run("(quotient (* 4294967296 4294967296) 0)").unwrap_err();
+    assert!(err.message.contains("Division by zero in 'quotient'"), "got: {}", err.message);
+}
+
+#[test]
+fn test_non_integers_are_rejected() {
+    let err = run("(modulo 7.5 2)").unwrap_err();
+    assert!(err.message.contains("'modulo' expects two integers, got float and integer"), "got: {}", err.message);
+    let err = run(r#"(quotient 7 "2")"#).unwrap_err();
+    assert!(err.message.contains("'quotient' expects two integers, got integer and string"), "got: {}", err.message);
+}
+
+// ============================================================================
+// As ordinary functions
+// ============================================================================
+
+#[test]
+fn test_operators_as_values() {
+    let source = "(list (map (lambda (n) (modulo n 3)) '(-2 -1 0 1 2)) (reduce quotient 1000 '(2 5)) (remainder 10 4))";
+    let expected = Value::List(List::from_vec(vec![
+        Value::List(List::from_vec(vec![Value::Integer(1), Value::Integer(2), Value::Integer(0), Value::Integer(1), Value::Integer(2)])),
+        Value::Integer(100),
+        Value::Integer(2),
+    ]));
+    assert_eq!(run(source).unwrap(), expected);
+    assert_eq!(int("(let ((f modulo)) (f -7 3))"), 2);
+}
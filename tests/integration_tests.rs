@@ -11,7 +11,7 @@ fn compile_and_get_result(source: &str) -> i64 {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     // Get the top value from the stack
@@ -383,7 +383,7 @@ fn test_quote_empty_list() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     assert_eq!(vm.value_stack.last(), Some(&Value::Integer(1)));
@@ -402,7 +402,7 @@ fn test_quote_list() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     assert_eq!(vm.value_stack.last(), Some(&Value::Integer(1)));
@@ -439,7 +439,7 @@ fn test_list_predicate() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     assert_eq!(vm.value_stack.last(), Some(&Value::Boolean(true)));
@@ -453,7 +453,7 @@ fn test_list_predicate() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     assert_eq!(vm.value_stack.last(), Some(&Value::Boolean(false)));
@@ -498,10 +498,10 @@ fn test_quoted_symbols() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
-    assert_eq!(vm.value_stack.last(), Some(&Value::Symbol(Arc::new("+".to_string()))));
+    assert_eq!(vm.value_stack.last(), Some(&Value::symbol("+")));
 }
 
 #[test]
@@ -517,7 +517,7 @@ fn test_string_literals() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     assert_eq!(vm.value_stack.last(), Some(&Value::Boolean(true)));
@@ -536,7 +536,7 @@ fn test_symbol_string_conversion() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     assert_eq!(vm.value_stack.last(), Some(&Value::String(Arc::new("foo".to_string()))));
@@ -550,10 +550,10 @@ fn test_symbol_string_conversion() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
-    assert_eq!(vm.value_stack.last(), Some(&Value::Symbol(Arc::new("bar".to_string()))));
+    assert_eq!(vm.value_stack.last(), Some(&Value::symbol("bar")));
 }
 
 #[test]
@@ -577,7 +577,7 @@ fn test_map_basic() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     let expected = Value::List(List::from_vec(vec![
@@ -611,7 +611,7 @@ fn test_map_empty_list() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     assert_eq!(vm.value_stack.last(), Some(&Value::List(List::Nil)));
@@ -639,7 +639,7 @@ fn test_filter_basic() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     let expected = Value::List(List::from_vec(vec![
@@ -672,7 +672,7 @@ fn test_filter_all_pass() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     let expected = Value::List(List::from_vec(vec![
@@ -705,7 +705,7 @@ fn test_filter_none_pass() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     assert_eq!(vm.value_stack.last(), Some(&Value::List(List::Nil)));
@@ -780,7 +780,7 @@ fn test_map_with_closure() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     let expected = Value::List(List::from_vec(vec![
@@ -816,7 +816,7 @@ fn test_filter_with_closure() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     let expected = Value::List(List::from_vec(vec![
@@ -856,7 +856,7 @@ fn test_compose_map_and_filter() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
 
     let expected = Value::List(List::from_vec(vec![
@@ -0,0 +1,200 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+use std::fs;
+use std::io::Cursor;
+use std::path::PathBuf;
+
+/// A fresh, empty directory for the test
+fn temp_dir(test: &str) -> PathBuf {
+    let dir = std::env::temp_dir().join(format!("lisp-io-tests-{}-{}", test, std::process::id()));
+    let _ = fs::remove_dir_all(&dir);
+    fs::create_dir_all(&dir).unwrap();
+    dir
+}
+
+/// Path inside `dir` as a Lisp string literal
+fn lisp_path(dir: &PathBuf, name: &str) -> String {
+    format!("{:?}", dir.join(name).to_string_lossy())
+}
+
+fn vm_for(source: &str) -> VM {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm
+}
+
+fn run(source: &str) -> Result<Value, String> {
+    let mut vm = vm_for(source);
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+/// Run with `input` standing in for stdin
+fn run_with_input(source: &str, input: &str) -> Result<Value, String> {
+    let mut vm = vm_for(source);
+    vm.line_input = Some(Box::new(Cursor::new(input.to_string().into_bytes())));
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn strings(items: &[&str]) -> Value {
+    Value::List(List::from_vec(items.iter().map(|s| Value::string(*s)).collect()))
+}
+
+// ============================================================================
+// Whole files
+// ============================================================================
+
+#[test]
+fn test_write_then_read_file() {
+    let dir = temp_dir("round-trip");
+    let path = lisp_path(&dir, "out.txt");
+    let source = format!(r#"(do (write-file {path} "hello\nworld") (read-file {path}))"#, path = path);
+    assert_eq!(run(&source), Ok(Value::string("hello\nworld")));
+    assert_eq!(fs::read_to_string(dir.join("out.txt")).unwrap(), "hello\nworld");
+}
+
+#[test]
+fn test_append_file_creates_and_extends() {
+    let dir = temp_dir("append");
+    let path = lisp_path(&dir, "log.txt");
+    let source = format!(r#"(do (append-file {path} "one ") (append-file {path} "two") (read-file {path}))"#, path = path);
+    assert_eq!(run(&source), Ok(Value::string("one two")));
+}
+
+#[test]
+fn test_write_file_replaces_contents() {
+    let dir = temp_dir("replace");
+    let path = lisp_path(&dir, "f.txt");
+    let source = format!(r#"(do (write-file {path} "a long first version") (write-file {path} "short") (read-file {path}))"#, path = path);
+    assert_eq!(run(&source), Ok(Value::string("short")));
+}
+
+// ============================================================================
+// Ports
+// ============================================================================
+
+#[test]
+fn test_print_to_port_and_read_lines_back() {
+    let dir = temp_dir("ports");
+    let path = lisp_path(&dir, "lines.txt");
+    let source = format!(r#"
+        (let ((out (open-output-file {path})))
+          (do (print "first" out)
+              (println 42 out)
+              (print (list 'a "b") out)
+              (close-port out)))
+        (let ((in (open-input-file {path})))
+          (let ((lines (list (read-line in) (read-line in) (read-line in))))
+            (do (close-port in) lines)))
+    "#, path = path);
+    // print displays, so the string in the list isn't quoted
+    assert_eq!(run(&source), Ok(strings(&["first", "42", "(a b)"])));
+}
+
+#[test]
+fn test_read_line_is_nil_at_end_of_file() {
+    let dir = temp_dir("eof");
+    fs::write(dir.join("two.txt"), "x\r\ny").unwrap();
+    let path = lisp_path(&dir, "two.txt");
+    let source = format!(r#"
+        (defun read-all (in acc)
+          (let ((line (read-line in)))
+            (if (null? line) acc (read-all in (append acc (list line))))))
+        (read-all (open-input-file {path}) '())
+    "#, path = path);
+    assert_eq!(run(&source), Ok(strings(&["x", "y"])));
+}
+
+#[test]
+fn test_print_returns_its_value() {
+    let dir = temp_dir("print-value");
+    let path = lisp_path(&dir, "v.txt");
+    let source = format!("(let ((out (open-output-file {path}))) (+ 1 (print 41 out)))", path = path);
+    assert_eq!(run(&source), Ok(Value::Integer(42)));
+}
+
+#[test]
+fn test_double_close_is_a_no_op() {
+    let dir = temp_dir("double-close");
+    let path = lisp_path(&dir, "c.txt");
+    let source = format!(r#"
+        (let ((out (open-output-file {path})))
+          (do (print "kept" out) (close-port out) (close-port out)))
+        (read-file {path})
+    "#, path = path);
+    assert_eq!(run(&source), Ok(Value::string("kept\n")));
+}
+
+#[test]
+fn test_using_a_closed_port_is_an_error() {
+    let dir = temp_dir("closed");
+    let path = lisp_path(&dir, "closed.txt");
+    let source = format!(r#"(let ((out (open-output-file {path}))) (do (close-port out) (print "late" out)))"#, path = path);
+    let err = run(&source).unwrap_err();
+    assert!(err.contains("port is closed"), "got: {}", err);
+}
+
+#[test]
+fn test_port_direction_is_checked() {
+    let dir = temp_dir("direction");
+    fs::write(dir.join("in.txt"), "data\n").unwrap();
+    let path = lisp_path(&dir, "in.txt");
+    let err = run(&format!(r#"(print "x" (open-input-file {}))"#, path)).unwrap_err();
+    assert!(err.contains("port is an input port"), "got: {}", err);
+    let err = run(&format!("(read-line (open-output-file {}))", lisp_path(&dir, "out.txt"))).unwrap_err();
+    assert!(err.contains("port is an output port"), "got: {}", err);
+    let err = run(r#"(print "x" "not a port")"#).unwrap_err();
+    assert!(err.contains("'print' expects a port, got string"), "got: {}", err);
+}
+
+// ============================================================================
+// Standard input
+// ============================================================================
+
+#[test]
+fn test_read_line_from_input() {
+    let source = "(list (read-line) (read-line) (read-line))";
+    let expected = Value::List(List::from_vec(vec![Value::string("alpha"), Value::string(""), Value::List(List::Nil)]));
+    assert_eq!(run_with_input(source, "alpha\n\n"), Ok(expected));
+}
+
+#[test]
+fn test_read_line_keeps_a_last_line_without_newline() {
+    assert_eq!(run_with_input("(list (read-line) (read-line))", "a\nb"), Ok(strings(&["a", "b"])));
+}
+
+// ============================================================================
+// Errors
+// ============================================================================
+
+#[test]
+fn test_missing_file_is_a_catchable_error() {
+    let dir = temp_dir("missing");
+    let path = lisp_path(&dir, "nope.txt");
+    for form in ["read-file", "open-input-file"] {
+        let err = run(&format!("({} {})", form, path)).unwrap_err();
+        assert!(err.contains(&format!("'{}' failed", form)), "got: {}", err);
+        let caught = run(&format!("(handler-case ({} {}) (catch (e) 'missing))", form, path));
+        assert_eq!(caught, Ok(Value::symbol("missing")));
+    }
+}
+
+#[test]
+fn test_unwritable_path_is_a_catchable_error() {
+    let dir = temp_dir("unwritable");
+    // A path under a regular file cannot be created
+    fs::write(dir.join("file"), "").unwrap();
+    let path = lisp_path(&dir, "file/child.txt");
+    for form in ["write-file", "append-file"] {
+        let err = run(&format!(r#"({} {} "x")"#, form, path)).unwrap_err();
+        assert!(err.contains(&format!("'{}' failed to write", form)), "got: {}", err);
+        let caught = run(&format!(r#"(handler-case ({} {} "x") (catch (e) 'failed))"#, form, path));
+        assert_eq!(caught, Ok(Value::symbol("failed")));
+    }
+    let caught = run(&format!("(handler-case (open-output-file {}) (catch (e) 'failed))", path));
+    assert_eq!(caught, Ok(Value::symbol("failed")));
+}
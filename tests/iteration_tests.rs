@@ -0,0 +1,117 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, List, Value};
+
+fn compile(source: &str) -> Result<(std::collections::HashMap<String, Vec<Instruction>>, Vec<Instruction>), String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    Compiler::new().compile_program(&exprs).map_err(|e| e.message)
+}
+
+fn run(source: &str) -> Result<Option<Value>, String> {
+    let (functions, main) = compile(source)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned())
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+#[test]
+fn test_dotimes_counts_from_zero() {
+    let source = "(let ((total 0)) (do (dotimes (i 100) (set! total (+ total i))) total))";
+    assert_eq!(run(source), Ok(Some(Value::Integer(4950))));
+
+    let source = "(define seen '()) (dotimes (i 4) (set! seen (cons i seen))) seen";
+    assert_eq!(run(source), Ok(Some(ints(&[3, 2, 1, 0]))));
+}
+
+#[test]
+fn test_dolist_visits_each_element() {
+    let source = "(define seen '()) (dolist (x '(1 2 3)) (set! seen (cons (* x 10) seen))) seen";
+    assert_eq!(run(source), Ok(Some(ints(&[30, 20, 10]))));
+
+    // Several body forms run in order on each iteration
+    let source = "(define out '()) (dolist (x '(1 2)) (set! out (cons x out)) (set! out (cons 0 out))) out";
+    assert_eq!(run(source), Ok(Some(ints(&[0, 2, 0, 1]))));
+}
+
+#[test]
+fn test_iteration_forms_evaluate_to_nil() {
+    assert_eq!(run("(dotimes (i 3) i)"), Ok(Some(Value::List(List::Nil))));
+    assert_eq!(run("(dolist (x '(1 2)) x)"), Ok(Some(Value::List(List::Nil))));
+
+    // Zero iterations never run the body
+    assert_eq!(run("(dotimes (i 0) (car 1))"), Ok(Some(Value::List(List::Nil))));
+    assert_eq!(run("(dotimes (i -5) (car 1))"), Ok(Some(Value::List(List::Nil))));
+    assert_eq!(run("(dolist (x '()) (car 1))"), Ok(Some(Value::List(List::Nil))));
+}
+
+#[test]
+fn test_count_is_evaluated_once() {
+    let source = r#"
+        (define n 3)
+        (define runs 0)
+        (dotimes (i n) (set! n 100) (set! runs (+ runs 1)))
+        runs
+    "#;
+    assert_eq!(run(source), Ok(Some(Value::Integer(3))));
+}
+
+#[test]
+fn test_loop_variable_is_scoped_to_the_body() {
+    let err = run("(dotimes (i 3) i) i").unwrap_err();
+    assert!(err.contains("Undefined variable 'i'"), "got: {}", err);
+
+    // An outer binding of the same name is untouched
+    let source = "(let ((x 'outer)) (do (dolist (x '(1 2)) x) x))";
+    assert_eq!(run(source), Ok(Some(Value::symbol("outer"))));
+}
+
+#[test]
+fn test_each_iteration_has_its_own_binding() {
+    let source = r#"
+        (define fns '())
+        (dotimes (i 3) (set! fns (cons (lambda () i) fns)))
+        (list ((car fns)) ((car (cdr fns))) ((car (cdr (cdr fns)))))
+    "#;
+    assert_eq!(run(source), Ok(Some(ints(&[2, 1, 0]))));
+
+    // Assigning the variable doesn't change how many times the loop runs
+    let source = "(define runs 0) (dotimes (i 3) (set! i 10) (set! runs (+ runs 1))) runs";
+    assert_eq!(run(source), Ok(Some(Value::Integer(3))));
+}
+
+#[test]
+fn test_nested_loops() {
+    let source = r#"
+        (define out '())
+        (dotimes (i 2) (dolist (x '(10 20)) (set! out (cons (+ i x) out))))
+        out
+    "#;
+    assert_eq!(run(source), Ok(Some(ints(&[21, 11, 20, 10]))));
+}
+
+#[test]
+fn test_loops_compile_to_jumps() {
+    let (functions, _) = compile("(defun sum (n) (let ((total 0)) (do (dotimes (i n) (set! total (+ total i))) total)))").unwrap();
+    let body = &functions["sum"];
+    assert!(body.iter().any(|instr| matches!(instr, Instruction::Jmp(_))), "got: {:?}", body);
+    assert!(!body.iter().any(|instr| matches!(instr,
+        Instruction::Call(_, _) | Instruction::TailCall(_, _) | Instruction::MakeClosure(..) | Instruction::MakeVariadicClosure(..))),
+        "got: {:?}", body);
+    assert_eq!(run("(defun sum (n) (let ((total 0)) (do (dotimes (i n) (set! total (+ total i))) total))) (sum 10)"),
+        Ok(Some(Value::Integer(45))));
+}
+
+#[test]
+fn test_malformed_iteration_forms() {
+    let err = run("(dotimes (i) 1)").unwrap_err();
+    assert_eq!(err, "dotimes expects (dotimes (var count) body...)");
+    let err = run("(dolist (x '(1)))").unwrap_err();
+    assert_eq!(err, "dolist expects (dolist (var list) body...)");
+    let err = run("(dotimes ((i) 3) 1)").unwrap_err();
+    assert_eq!(err, "dotimes variable must be a symbol");
+}
@@ -0,0 +1,94 @@
+use lisp_bytecode_vm::{Compiler, CompileError, VM, parser::Parser, List, Value};
+
+fn compile(source: &str) -> Result<(std::collections::HashMap<String, Vec<lisp_bytecode_vm::Instruction>>, Vec<lisp_bytecode_vm::Instruction>), CompileError> {
+    let exprs = Parser::new_with_file(source, "keywords.lisp".to_string()).parse_all().unwrap();
+    Compiler::new().compile_program(&exprs)
+}
+
+fn run(source: &str) -> Result<Value, String> {
+    let (functions, main) = compile(source).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn list(values: Vec<Value>) -> Value {
+    Value::List(List::from_vec(values))
+}
+
+const CONNECT: &str = "(defun connect (host &key (port 8080) (timeout 30)) (list host port timeout))\n";
+
+#[test]
+fn test_all_defaults() {
+    let source = format!("{}(connect \"localhost\")", CONNECT);
+    assert_eq!(run(&source).unwrap(), list(vec![Value::string("localhost"), Value::Integer(8080), Value::Integer(30)]));
+    // Without a default, a keyword parameter is '()
+    assert_eq!(run("(defun f (&key verbose) verbose) (f)").unwrap(), Value::List(List::Nil));
+}
+
+#[test]
+fn test_keywords_in_any_order() {
+    let source = format!("{}(list (connect \"a\" :port 9000) (connect \"b\" :timeout 5 :port 1) (connect \"c\" :port 1 :timeout 5))", CONNECT);
+    assert_eq!(run(&source).unwrap(), list(vec![
+        list(vec![Value::string("a"), Value::Integer(9000), Value::Integer(30)]),
+        list(vec![Value::string("b"), Value::Integer(1), Value::Integer(5)]),
+        list(vec![Value::string("c"), Value::Integer(1), Value::Integer(5)]),
+    ]));
+}
+
+#[test]
+fn test_defaults_see_earlier_parameters() {
+    let source = r#"
+        (defun window (width &key (height (* width 2)) (area (* width height)))
+          (list width height area))
+        (list (window 3) (window 3 :height 4) (window 3 :area 0))
+    "#;
+    let ints = |values: &[i64]| list(values.iter().map(|n| Value::Integer(*n)).collect());
+    assert_eq!(run(source).unwrap(), list(vec![ints(&[3, 6, 18]), ints(&[3, 4, 12]), ints(&[3, 6, 0])]));
+}
+
+#[test]
+fn test_keywords_evaluate_to_themselves() {
+    assert_eq!(run(":port").unwrap(), Value::symbol(":port"));
+    assert_eq!(run("(list (eq? :port ':port) (symbol? :port))").unwrap(), list(vec![Value::Boolean(true), Value::Boolean(true)]));
+    // A keyword can be computed, and a function with &key parameters passed around
+    let source = format!("{}(list (apply connect (list \"h\" :timeout 1)) (map (lambda (k) (connect \"h\" k 2)) '(:port :timeout)))", CONNECT);
+    let h = |port, timeout| list(vec![Value::string("h"), Value::Integer(port), Value::Integer(timeout)]);
+    assert_eq!(run(&source).unwrap(), list(vec![h(8080, 1), list(vec![h(2, 30), h(8080, 2)])]));
+}
+
+#[test]
+fn test_unknown_keyword_is_a_compile_error_at_direct_calls() {
+    let source = format!("{}(connect \"localhost\" :prot 9000)", CONNECT);
+    let err = compile(&source).unwrap_err();
+    assert_eq!(err.message, "Unknown keyword argument :prot for 'connect'");
+    assert_eq!((err.location.line, err.location.column), (2, 22));
+    assert_eq!(err.suggestion.as_deref(), Some("Did you mean :port? 'connect' takes :port, :timeout"));
+
+    let err = compile(&format!("{}(connect \"localhost\" :port)", CONNECT)).unwrap_err();
+    assert_eq!(err.message, "Keyword argument :port for 'connect' has no value");
+}
+
+#[test]
+fn test_unknown_keyword_is_a_runtime_error_otherwise() {
+    let source = format!("{}(apply connect (list \"localhost\" :prot 9000))", CONNECT);
+    assert_eq!(run(&source).unwrap_err(), "Unknown keyword argument :prot for 'connect', expected one of :port, :timeout");
+    let source = format!("{}(apply connect (list \"localhost\" 9000))", CONNECT);
+    assert_eq!(run(&source).unwrap_err(), "'connect' expects keyword arguments after its required ones, got 9000");
+    let source = format!("{}(apply connect (list \"localhost\" :port 1 :port 2))", CONNECT);
+    assert_eq!(run(&source).unwrap_err(), "Keyword argument :port given twice to 'connect'");
+    let source = format!("{}(handler-case (apply connect (list \"h\" :port)) (catch (e) 'caught))", CONNECT);
+    assert_eq!(run(&source).unwrap(), Value::symbol("caught"));
+}
+
+#[test]
+fn test_keyword_parameter_lists_are_checked() {
+    assert_eq!(compile("(defun f (a &key) a)").unwrap_err().message, "&key must be followed by at least one parameter");
+    assert_eq!(compile("(defun f (a &key a) a)").unwrap_err().message, "Parameter 'a' appears more than once");
+    assert_eq!(compile("(defun f (&key (b)) b)").unwrap_err().message, "Keyword parameter must be a name or (name default)");
+    assert_eq!(compile("(lambda (&key b) b)").unwrap_err().message, "&key parameters are only supported in defun");
+    let err = compile(&format!("{}(connect)", CONNECT)).unwrap_err();
+    assert_eq!(err.suggestion.as_deref(), Some("It is defined as (defun connect (host &key port timeout) ...)"));
+}
@@ -0,0 +1,135 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, List, Value};
+
+/// Helper function to compile and run source code
+fn compile_and_run(source: &str) -> Result<VM, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+/// Helper to compile source and return the named function's bytecode
+fn compile_function(source: &str, name: &str) -> Vec<Instruction> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, _) = compiler.compile_program(&exprs).unwrap();
+    functions[name].clone()
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+fn list_result(vm: &VM) -> Vec<Value> {
+    match vm.value_stack.last() {
+        Some(Value::List(items)) => items.to_vec(),
+        other => panic!("Expected list result, got {:?}", other),
+    }
+}
+
+// ============================================================================
+// Resolution to the innermost binding
+// ============================================================================
+
+#[test]
+fn test_inner_let_shadows_outer() {
+    let vm = compile_and_run("(let ((x 1)) (let ((x 2)) x))").unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(2)));
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_three_levels_of_shadowing() {
+    let vm = compile_and_run("(let ((x 1)) (let ((x 2)) (let ((x 3)) x)))").unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(3)));
+    assert_eq!(vm.value_stack.len(), 1, "every shadowed slot should be popped");
+}
+
+#[test]
+fn test_each_level_sees_its_own_binding() {
+    let source = "(let ((x 1)) (list x (let ((x 2)) (list x (let ((x 3)) x) x)) x))";
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(list_result(&vm), vec![Value::Integer(1), ints(&[2, 3, 2]), Value::Integer(1)]);
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_outer_reference_before_inner_let() {
+    // The first x is resolved before the inner let is compiled, the last after its Slide
+    let source = r#"
+        (defun f (x)
+          (list x (let ((x (* x 10))) x) x))
+        (f 4)
+    "#;
+    assert!(compile_function(source, "f").contains(&Instruction::Slide(1)));
+
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(list_result(&vm), vec![Value::Integer(4), Value::Integer(40), Value::Integer(4)]);
+}
+
+#[test]
+fn test_inner_value_reads_outer_binding() {
+    let source = "(let ((x 1)) (let ((x (+ x 10))) (let ((x (* x 2))) x)))";
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(22)));
+}
+
+#[test]
+fn test_shadowing_a_function_parameter() {
+    let source = r#"
+        (defun f (x)
+          (list x (let ((x (* x 10))) (list x (let ((x (+ x 1))) x) x)) x))
+        (f 2)
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(list_result(&vm), vec![Value::Integer(2), ints(&[20, 21, 20]), Value::Integer(2)]);
+}
+
+#[test]
+fn test_shadowing_with_destructuring() {
+    let vm = compile_and_run("(let ((x 1)) (list (let (((x y) (list 7 8))) (list x y)) x))").unwrap();
+    assert_eq!(list_result(&vm), vec![ints(&[7, 8]), Value::Integer(1)]);
+}
+
+// ============================================================================
+// Closures and assignment
+// ============================================================================
+
+#[test]
+fn test_closure_keeps_the_binding_it_captured() {
+    let source = "(let ((x 1)) (let ((get (lambda () x))) (let ((x 5)) (list x (get)))))";
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(list_result(&vm), vec![Value::Integer(5), Value::Integer(1)]);
+}
+
+#[test]
+fn test_set_on_inner_binding_leaves_outer_alone() {
+    let source = r#"
+        (let ((x 1))
+          (let ((get (lambda () x)))
+            (list (let ((x 2)) (do (set! x 20) x)) x (get))))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(list_result(&vm), vec![Value::Integer(20), Value::Integer(1), Value::Integer(1)]);
+}
+
+#[test]
+fn test_shadowing_in_tail_position() {
+    let source = r#"
+        (defun countdown (x)
+          (let ((x (- x 1)))
+            (if (<= x 0) x (countdown x))))
+        (countdown 5000)
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(0)));
+    assert_eq!(vm.value_stack.len(), 1);
+}
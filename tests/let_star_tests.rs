@@ -0,0 +1,187 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, Value};
+
+/// Helper function to compile and run source code
+fn compile_and_run(source: &str) -> Result<VM, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+/// Helper to compile source and return the named function's bytecode
+fn compile_function(source: &str, name: &str) -> Vec<Instruction> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, _) = compiler.compile_program(&exprs).unwrap();
+    functions[name].clone()
+}
+
+/// Helper to get integer result from VM
+fn get_int_result(vm: &VM) -> i64 {
+    match vm.value_stack.last() {
+        Some(Value::Integer(n)) => *n,
+        other => panic!("Expected integer result, got {:?}", other),
+    }
+}
+
+// ============================================================================
+// Sequential binding
+// ============================================================================
+
+#[test]
+fn test_let_star_sees_earlier_bindings() {
+    let vm = compile_and_run("(let* ((x 1) (y (+ x 1))) y)").unwrap();
+    assert_eq!(get_int_result(&vm), 2);
+}
+
+#[test]
+fn test_let_star_chain() {
+    let source = r#"
+        (let* ((a 2)
+               (b (* a 3))
+               (c (+ a b)))
+          (list a b c))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    match vm.value_stack.last() {
+        Some(Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![Value::Integer(2), Value::Integer(6), Value::Integer(8)]);
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_let_star_empty_bindings() {
+    let vm = compile_and_run("(let* () 42)").unwrap();
+    assert_eq!(get_int_result(&vm), 42);
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_let_star_destructuring_binding() {
+    let vm = compile_and_run("(let* (((a b) (list 1 2)) (c (+ a b))) c)").unwrap();
+    assert_eq!(get_int_result(&vm), 3);
+}
+
+#[test]
+fn test_let_star_captured_by_lambda() {
+    let source = r#"
+        (defun make-adder (n)
+          (let* ((m (* n 10))
+                 (f (lambda (x) (+ x m))))
+            f))
+        (let ((add (make-adder 3))) (add 4))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 34);
+}
+
+#[test]
+fn test_let_star_rejects_malformed_bindings() {
+    let err = compile_and_run("(let* x 1)").err().expect("expected an error");
+    assert!(err.contains("let* bindings must be a list"), "got: {}", err);
+
+    let err = compile_and_run("(let* ((x 1)))").err().expect("expected an error");
+    assert!(err.contains("let* expects exactly 2 arguments"), "got: {}", err);
+}
+
+// ============================================================================
+// Shadowing and stack cleanup
+// ============================================================================
+
+#[test]
+fn test_let_star_shadowing_within_bindings() {
+    let vm = compile_and_run("(let* ((x 1) (x (+ x 10)) (x (* x 2))) x)").unwrap();
+    assert_eq!(get_int_result(&vm), 22);
+    assert_eq!(vm.value_stack.len(), 1, "shadowed bindings should not leak onto the stack");
+}
+
+#[test]
+fn test_let_star_shadowing_outer_variable_pops_every_binding() {
+    let source = r#"
+        (defun f (x)
+          (let ((y 100))
+            (let* ((x (+ x 1)) (y (+ x y)) (x (* x 2)))
+              (list x y))))
+        (f 4)
+    "#;
+    assert!(compile_function(source, "f").contains(&Instruction::Slide(3)));
+
+    let vm = compile_and_run(source).unwrap();
+    match vm.value_stack.last() {
+        Some(Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![Value::Integer(10), Value::Integer(105)]);
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_outer_binding_restored_after_let_star() {
+    let source = r#"
+        (let ((x 1))
+          (let ((inner (let* ((x 50) (y (+ x 1))) y)))
+            (+ inner x)))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 52);
+}
+
+// ============================================================================
+// Tail position
+// ============================================================================
+
+#[test]
+fn test_let_star_body_tail_call() {
+    let source = r#"
+        (defun countdown (n)
+          (let* ((m (- n 1)) (done (<= m 0)))
+            (if done 0 (countdown m))))
+        (countdown 5000)
+    "#;
+    let bytecode = compile_function(source, "countdown");
+    assert!(bytecode.iter().any(|i| matches!(i, Instruction::TailCall(_, _))));
+
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 0);
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_let_star_bindings_are_not_tail_calls() {
+    let source = r#"
+        (defun inc (n) (+ n 1))
+        (defun f (n)
+          (let* ((a (inc n)) (b (inc a)))
+            b))
+        (f 1)
+    "#;
+    let bytecode = compile_function(source, "f");
+    assert!(!bytecode.iter().any(|i| matches!(i, Instruction::TailCall(_, _))));
+
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 3);
+}
+
+#[test]
+fn test_let_as_a_later_operand() {
+    // The first operand is already on the stack when the let's slots are allocated
+    let source = r#"
+        (defun f (x) (+ x (let* ((a 2) (b (* a 10))) b)))
+        (defun g (x) (list x (let ((a 5)) a) (let* ((c 7)) (cons c '()))))
+        (+ (f 1) (car (cdr (g 100))))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 26);
+    assert_eq!(vm.value_stack.len(), 1);
+}
@@ -0,0 +1,174 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, Value};
+
+/// Helper function to compile and run source code
+fn compile_and_run(source: &str) -> Result<VM, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+/// Helper to get integer result from VM
+fn get_int_result(vm: &VM) -> i64 {
+    match vm.value_stack.last() {
+        Some(Value::Integer(n)) => *n,
+        other => panic!("Expected integer result, got {:?}", other),
+    }
+}
+
+// ============================================================================
+// Basic letrec Tests
+// ============================================================================
+
+#[test]
+fn test_letrec_self_recursive_lambda() {
+    let source = r#"
+        (letrec ((fact (lambda (n) (if (== n 0) 1 (* n (fact (- n 1)))))))
+          (fact 5))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 120);
+}
+
+#[test]
+fn test_let_cannot_refer_to_itself() {
+    let source = r#"
+        (let ((fact (lambda (n) (if (== n 0) 1 (* n (fact (- n 1)))))))
+          (fact 5))
+    "#;
+    let err = compile_and_run(source).err().expect("expected an error");
+    assert!(err.contains("'fact'"), "got: {}", err);
+}
+
+#[test]
+fn test_letrec_mutual_recursion() {
+    let source = r#"
+        (letrec ((my-even? (lambda (n) (if (== n 0) true (my-odd? (- n 1)))))
+                 (my-odd? (lambda (n) (if (== n 0) false (my-even? (- n 1))))))
+          (list (my-even? 10) (my-odd? 7) (my-even? 3)))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    match vm.value_stack.last() {
+        Some(Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![
+                Value::Boolean(true),
+                Value::Boolean(true),
+                Value::Boolean(false),
+            ]);
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+}
+
+#[test]
+fn test_letrec_non_lambda_bindings() {
+    let source = r#"
+        (letrec ((x 10)
+                 (y (+ x 5)))
+          (* x y))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 150);
+}
+
+#[test]
+fn test_letrec_closure_escapes_scope() {
+    let source = r#"
+        (let ((counter (letrec ((count-to (lambda (n acc) (if (<= n 0) acc (count-to (- n 1) (+ acc 1))))))
+                         count-to)))
+          (counter 50 0))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 50);
+}
+
+#[test]
+fn test_letrec_captures_outer_parameter() {
+    let source = r#"
+        (defun sum-multiples (k limit)
+          (letrec ((go (lambda (i) (if (> i limit) 0 (+ (* i k) (go (+ i 1)))))))
+            (go 1)))
+        (sum-multiples 3 4)
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 30);
+}
+
+// ============================================================================
+// Uninitialized access
+// ============================================================================
+
+#[test]
+fn test_letrec_read_before_initialization_errors() {
+    let source = r#"
+        (letrec ((a b)
+                 (b 1))
+          a)
+    "#;
+    let err = compile_and_run(source).err().expect("expected an error");
+    assert!(err.contains("letrec binding 'b' used before initialization"), "got: {}", err);
+}
+
+#[test]
+fn test_letrec_self_reference_in_non_lambda_initializer_errors() {
+    let err = compile_and_run("(letrec ((x (+ x 1))) x)").err().expect("expected an error");
+    assert!(err.contains("letrec binding 'x' used before initialization"), "got: {}", err);
+}
+
+#[test]
+fn test_letrec_invalid_binding_name() {
+    let err = compile_and_run("(letrec ((1 2)) 3)").err().expect("expected an error");
+    assert!(err.contains("letrec binding name must be a symbol"), "got: {}", err);
+}
+
+// ============================================================================
+// Stack cleanup and tail position
+// ============================================================================
+
+#[test]
+fn test_letrec_slides_bindings_like_let() {
+    let source = r#"
+        (defun f (n)
+          (letrec ((a (lambda () n))
+                   (b (lambda () (a))))
+            (b)))
+        (f 7)
+    "#;
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    // The body ends in a tail call, after which the peephole pass drops the Slide
+    compiler.set_constant_folding(false);
+    let (functions, _) = compiler.compile_program(&exprs).unwrap();
+    assert!(functions["f"].contains(&Instruction::Slide(2)));
+
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 7);
+    assert_eq!(vm.value_stack.len(), 1, "letrec cells should not leak onto the stack");
+}
+
+#[test]
+fn test_letrec_body_tail_call() {
+    let source = r#"
+        (defun countdown (n)
+          (letrec ((step (lambda (x) (- x 1))))
+            (if (<= n 0) 0 (countdown (step n)))))
+        (countdown 5000)
+    "#;
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, _) = compiler.compile_program(&exprs).unwrap();
+    assert!(functions["countdown"].iter().any(|i| matches!(i, Instruction::TailCall(_, _))));
+
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 0);
+    assert_eq!(vm.value_stack.len(), 1);
+}
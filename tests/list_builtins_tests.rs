@@ -0,0 +1,220 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value, RuntimeError};
+
+fn run(source: &str) -> Result<Value, RuntimeError> {
+    let mut parser = Parser::new_with_file(source, "lists.lisp".to_string());
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm.run()?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+fn compile_error(source: &str) -> String {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    Compiler::new().compile_program(&exprs).unwrap_err().message
+}
+
+// ============================================================================
+// list, length, reverse
+// ============================================================================
+
+#[test]
+fn test_list_builds_a_proper_list() {
+    assert_eq!(run("(list 1 (+ 1 1) 3)").unwrap(), ints(&[1, 2, 3]));
+    assert_eq!(run("(list)").unwrap(), Value::List(List::Nil));
+    // As a value it takes any number of arguments too
+    assert_eq!(run("(map list '(1 2))").unwrap(), Value::List(List::from_vec(vec![ints(&[1]), ints(&[2])])));
+    assert_eq!(run("(apply list '(4 5 6))").unwrap(), ints(&[4, 5, 6]));
+}
+
+#[test]
+fn test_length() {
+    assert_eq!(run("(length '(1 2 3))").unwrap(), Value::Integer(3));
+    assert_eq!(run("(length '())").unwrap(), Value::Integer(0));
+    assert_eq!(run("(map length '((1) (1 2) ()))").unwrap(), ints(&[1, 2, 0]));
+}
+
+#[test]
+fn test_length_rejects_a_non_list() {
+    // Lists have no dotted tail, so the only improper value length can be
+    // handed is not a list at all
+    let err = run("(define pair 5)\n(length pair)").unwrap_err();
+    assert_eq!(err.message, "Type error: 'length' expects a list, got integer");
+    assert_eq!(err.location.map(|l| (l.line, l.column)), Some((2, 1)));
+}
+
+#[test]
+fn test_reverse() {
+    assert_eq!(run("(reverse '(1 2 3))").unwrap(), ints(&[3, 2, 1]));
+    assert_eq!(run("(reverse '())").unwrap(), Value::List(List::Nil));
+    assert_eq!(run("(reverse \"abc\")").unwrap_err().message, "Type error: 'reverse' expects a list, got string");
+}
+
+// ============================================================================
+// append
+// ============================================================================
+
+#[test]
+fn test_append_joins_any_number_of_lists() {
+    assert_eq!(run("(append '(1) '(2 3) '() '(4))").unwrap(), ints(&[1, 2, 3, 4]));
+    assert_eq!(run("(append '(1 2) '(3))").unwrap(), ints(&[1, 2, 3]));
+    assert_eq!(run("(append)").unwrap(), Value::List(List::Nil));
+    assert_eq!(run("(apply append '((1) (2) (3 4)))").unwrap(), ints(&[1, 2, 3, 4]));
+    assert_eq!(run("(apply append '())").unwrap(), Value::List(List::Nil));
+}
+
+#[test]
+fn test_append_with_one_argument_returns_it_unchanged() {
+    assert_eq!(run("(append '(1 2))").unwrap(), ints(&[1, 2]));
+    assert_eq!(run("(append 7)").unwrap(), Value::Integer(7));
+    assert_eq!(run("(define xs '(1 2)) (eq? (append xs) xs)").unwrap(), Value::Boolean(true));
+    assert_eq!(run("(apply append (list \"s\"))").unwrap(), Value::string("s"));
+}
+
+#[test]
+fn test_append_shares_its_last_list() {
+    assert_eq!(run("(define tail '(3 4)) (eq? (cdr (append '(2) tail)) tail)").unwrap(), Value::Boolean(true));
+    assert_eq!(run("(define tail '(3 4)) (eq? (cdr (apply append (list '(2) tail))) tail)").unwrap(), Value::Boolean(true));
+}
+
+#[test]
+fn test_append_rejects_non_lists() {
+    assert_eq!(run("(append '(1) 2)").unwrap_err().message, "Type error: 'append' expects lists, got integer");
+    assert_eq!(run("(append '(1) \"a\" '(2))").unwrap_err().message, "Type error: 'append' expects lists, got string");
+}
+
+// ============================================================================
+// nth
+// ============================================================================
+
+#[test]
+fn test_nth_takes_the_index_first() {
+    assert_eq!(run("(nth 0 '(10 20 30))").unwrap(), Value::Integer(10));
+    assert_eq!(run("(nth 2 '(10 20 30))").unwrap(), Value::Integer(30));
+    assert_eq!(run("(map (lambda (i) (nth i '(a b c))) '(2 0))").unwrap(),
+        Value::List(List::from_vec(vec![Value::symbol("c"), Value::symbol("a")])));
+}
+
+#[test]
+fn test_nth_out_of_range_reports_the_call() {
+    let err = run("(define xs '(10 20 30))\n  (nth 3 xs)").unwrap_err();
+    assert_eq!(err.message, "'nth' index 3 out of bounds for list of length 3");
+    assert_eq!(err.location.map(|l| (l.line, l.column)), Some((2, 3)));
+    assert_eq!(run("(nth -1 '(1))").unwrap_err().message, "'nth' index cannot be negative: -1");
+    assert_eq!(run("(nth 0 '())").unwrap_err().message, "'nth' index 0 out of bounds for list of length 0");
+    assert_eq!(run("(nth '(1) 0)").unwrap_err().message, "Type error: 'nth' expects an integer and a list, got list and integer");
+    // Caught like any other runtime error
+    assert_eq!(run("(handler-case (nth 5 '(1)) (catch (e) (hash-ref e 'line)))").unwrap(), Value::Integer(1));
+}
+
+#[test]
+fn test_list_builtins_check_their_arguments() {
+    assert_eq!(compile_error("(nth 1)"), "nth expects exactly 2 arguments: (nth i lst)");
+    assert_eq!(compile_error("(length '(1) '(2))"), "length expects exactly 1 argument: (length lst)");
+    assert_eq!(compile_error("(reverse)"), "reverse expects exactly 1 argument: (reverse lst)");
+    assert_eq!(compile_error("(list-ref '(1))"), "list-ref expects exactly 2 arguments: (list-ref lst i)");
+}
+
+#[test]
+fn test_reverse_returns_a_fresh_list() {
+    assert_eq!(run("(define one (list 1)) (eq? (reverse one) one)").unwrap(), Value::Boolean(false));
+    assert_eq!(run("(define xs (list 1 2 3)) (reverse xs) xs").unwrap(), ints(&[1, 2, 3]));
+}
+
+// ============================================================================
+// member, memq, assoc, assq
+// ============================================================================
+
+#[test]
+fn test_member_and_assoc_compare_with_equal() {
+    assert_eq!(run("(member 3 '(1 2 3 4))").unwrap(), ints(&[3, 4]));
+    assert_eq!(run("(member '(2) '(1 (2) 3))").unwrap(), Value::List(List::from_vec(vec![ints(&[2]), Value::Integer(3)])));
+    assert_eq!(run("(assoc 'b '((a 1) (b 2) (b 3)))").unwrap(), Value::List(List::from_vec(vec![Value::symbol("b"), Value::Integer(2)])));
+    // Nothing found, or nothing to look in, is '()
+    assert_eq!(run("(member 5 '(1 2 3 4))").unwrap(), Value::List(List::Nil));
+    assert_eq!(run("(member 1 '())").unwrap(), Value::List(List::Nil));
+    assert_eq!(run("(assoc 'z '((a 1)))").unwrap(), Value::List(List::Nil));
+    assert_eq!(run("(assoc 'z '())").unwrap(), Value::List(List::Nil));
+}
+
+#[test]
+fn test_memq_and_assq_compare_identity() {
+    // An equal but separately built list is found by member and assoc only
+    let source = r#"
+        (define key (list 1 2))
+        (define items (list 'x key 'y))
+        (define alist (list (list key 'found)))
+        (list (member (list 1 2) items) (memq (list 1 2) items) (memq key items)
+              (assoc (list 1 2) alist) (assq (list 1 2) alist) (eq? (assq key alist) (car alist)))
+    "#;
+    let tail = Value::List(List::from_vec(vec![ints(&[1, 2]), Value::symbol("y")]));
+    let entry = Value::List(List::from_vec(vec![ints(&[1, 2]), Value::symbol("found")]));
+    assert_eq!(run(source).unwrap(), Value::List(List::from_vec(vec![
+        tail.clone(), Value::List(List::Nil), tail, entry, Value::List(List::Nil), Value::Boolean(true),
+    ])));
+    assert_eq!(run("(memq 'b '(a b c))").unwrap(), Value::List(List::from_vec(vec![Value::symbol("b"), Value::symbol("c")])));
+}
+
+#[test]
+fn test_member_and_assoc_reject_non_lists() {
+    assert_eq!(run("(member 1 5)").unwrap_err().message, "Type error: 'member' expects a list, got integer");
+    assert_eq!(run("(assq 'a \"ab\")").unwrap_err().message, "Type error: 'assq' expects a list, got string");
+    assert_eq!(run("(assoc 'b '((a 1) 7))").unwrap_err().message, "Type error: 'assoc' expects a list of pairs, got the entry 7");
+    assert_eq!(run("(assoc 'b '((a 1) ()))").unwrap_err().message, "Type error: 'assoc' expects a list of pairs, got the entry ()");
+}
+
+// ============================================================================
+// sort
+// ============================================================================
+
+#[test]
+fn test_sort_is_stable() {
+    // Pairs sorted by their first element keep the order of their second
+    let source = r#"
+        (sort (lambda (a b) (< (car a) (car b)))
+              '((3 0) (1 1) (2 2) (1 3) (3 4) (2 5) (1 6)))
+    "#;
+    let pairs = [(1, 1), (1, 3), (1, 6), (2, 2), (2, 5), (3, 0), (3, 4)];
+    assert_eq!(run(source).unwrap(), Value::List(List::from_vec(pairs.iter().map(|(a, b)| ints(&[*a, *b])).collect())));
+    assert_eq!(run("(sort < '(5 3 9 1 3 7))").unwrap(), ints(&[1, 3, 3, 5, 7, 9]));
+    assert_eq!(run("(sort > '())").unwrap(), Value::List(List::Nil));
+    assert_eq!(run("(define xs (list 2 1)) (sort < xs) xs").unwrap(), ints(&[2, 1]));
+}
+
+#[test]
+fn test_sort_comparator_can_allocate_and_recurse() {
+    // Each comparison builds lists, recurses, and even sorts, all from inside sort
+    let source = r#"
+        (defun digits (n) (if (< n 10) (list n) (cons (% n 10) (digits (quotient n 10)))))
+        (defun digit-sum (n) (reduce + 0 (sort < (digits n))))
+        (defun by-digit-sum (a b)
+          (let ((sa (digit-sum a)) (sb (digit-sum b)))
+            (if (= sa sb) (< a b) (< sa sb))))
+        (defun upto (n acc) (if (= n 0) acc (upto (- n 1) (cons (* n 37) acc))))
+        (list (sort by-digit-sum '(99 10 55 1 91 100 18 27))
+              (length (sort (lambda (a b) (< (length (digits a)) (length (digits b)))) (upto 300 '()))))
+    "#;
+    assert_eq!(run(source).unwrap(), Value::List(List::from_vec(vec![
+        ints(&[1, 10, 100, 18, 27, 55, 91, 99]), Value::Integer(300),
+    ])));
+}
+
+#[test]
+fn test_sort_comparator_errors_unwind_cleanly() {
+    let source = r#"
+        (list (handler-case (sort (lambda (a b) (car a)) '(1 2 3)) (catch (e) 'caught))
+              (sort < '(2 1)))
+    "#;
+    assert_eq!(run(source).unwrap(), Value::List(List::from_vec(vec![Value::symbol("caught"), ints(&[1, 2])])));
+    assert_eq!(run("(sort (lambda (a b) 1) '(2 1))").unwrap_err().message,
+        "Type error: 'sort' expects its comparison to return a boolean, got integer");
+    assert_eq!(run("(sort < 5)").unwrap_err().message, "Type error: 'sort' expects a list, got integer");
+}
@@ -0,0 +1,259 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+
+fn compile(source: &str) -> Result<Compiler, String> {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    compiler.compile_program(&exprs).map_err(|e| e.message)?;
+    Ok(compiler)
+}
+
+fn run(source: &str) -> Result<Value, String> {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+/// Message and line of each warning
+fn warnings(source: &str) -> Vec<(String, usize)> {
+    compile(source).unwrap().warnings().iter()
+        .map(|warning| (warning.message.clone(), warning.location.line))
+        .collect()
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+fn list(values: Vec<Value>) -> Value {
+    Value::List(List::from_vec(values))
+}
+
+fn symbols(names: &[&str]) -> Value {
+    list(names.iter().map(|name| Value::symbol(name)).collect())
+}
+
+// ============================================================================
+// Literal patterns
+// ============================================================================
+
+#[test]
+fn test_integer_heads_dispatch_commands() {
+    let source = r#"
+        (defun run-command (command)
+          (match command
+            ((1 . args) (list 'one args))
+            ((2 x) (list 'two x))
+            ((3 . _) 'three)
+            (_ 'unknown)))
+        (list (run-command '(1 a b)) (run-command '(2 5)) (run-command '(2 5 6)) (run-command '(3)) (run-command '(4 1)))
+    "#;
+    assert_eq!(run(source).unwrap(), list(vec![
+        list(vec![Value::symbol("one"), symbols(&["a", "b"])]),
+        list(vec![Value::symbol("two"), Value::Integer(5)]),
+        Value::symbol("unknown"),
+        Value::symbol("three"),
+        Value::symbol("unknown"),
+    ]));
+    // The same clauses in a multi-clause defun
+    let source = r#"
+        (defun handle
+          (((1 . args)) (list 'one args))
+          (((2 x)) (list 'two x))
+          ((_) 'unknown))
+        (list (handle '(1)) (handle '(2 7)) (handle '(9)))
+    "#;
+    assert_eq!(run(source).unwrap(), list(vec![
+        list(vec![Value::symbol("one"), Value::List(List::Nil)]),
+        list(vec![Value::symbol("two"), Value::Integer(7)]),
+        Value::symbol("unknown"),
+    ]));
+}
+
+#[test]
+fn test_string_literals_compare_by_content() {
+    let source = r#"
+        (defun verb (words)
+          (match words
+            (("add" a b) (+ a b))
+            (("neg" a) (- 0 a))
+            ((other . _) other)))
+        (list (verb '("add" 2 3)) (verb (list (string-append "ne" "g") 4)) (verb '("mul" 2 3)))
+    "#;
+    assert_eq!(run(source).unwrap(), list(vec![Value::Integer(5), Value::Integer(-4), Value::string("mul")]));
+    assert_eq!(run(r#"(defun greet (("hi") 'hello) ((_) 'what)) (list (greet "hi") (greet "HI") (greet 'hi))"#).unwrap(),
+        symbols(&["hello", "what", "what"]));
+    // Strings inside a quoted pattern are literals too
+    assert_eq!(run(r#"(match '("a" b) ('("a" b) 'quoted) (_ 'other))"#).unwrap(), Value::symbol("quoted"));
+}
+
+#[test]
+fn test_nil_matches_the_empty_list() {
+    let source = r#"
+        (defun shape (xs)
+          (match xs
+            (nil 'empty)
+            ((x . nil) (list 'one x))
+            (_ 'more)))
+        (list (shape '()) (shape '(7)) (shape '(7 8)))
+    "#;
+    assert_eq!(run(source).unwrap(), list(vec![
+        Value::symbol("empty"), list(vec![Value::symbol("one"), Value::Integer(7)]), Value::symbol("more"),
+    ]));
+    assert_eq!(run("(defun empty? ((nil) #t) ((_) #f)) (list (empty? '()) (empty? '(1)) (empty? 0))").unwrap(),
+        list(vec![Value::Boolean(true), Value::Boolean(false), Value::Boolean(false)]));
+}
+
+#[test]
+fn test_literals_match_as_equal_does() {
+    // 1 and 1.0 are different literals
+    assert_eq!(run("(list (match 1.0 (1 'int) (1.0 'float)) (match 1 (1.0 'float) (1 'int)))").unwrap(), symbols(&["float", "int"]));
+    assert_eq!(run("(match (list #\\a #t) ((#\\a #t) 'both) (_ 'neither))").unwrap(), Value::symbol("both"));
+}
+
+// ============================================================================
+// Type patterns
+// ============================================================================
+
+#[test]
+fn test_type_patterns_bind_only_values_of_their_type() {
+    let source = r#"
+        (defun describe (v)
+          (match v
+            ((:integer n) (list 'integer n))
+            ((:string s) (list 'string s))
+            ((:list (a b)) (list 'pair a b))
+            ((:function f) (list 'function (f '(2 3))))
+            (_ 'other)))
+        (list (describe 5) (describe (* 99999999999 99999999999 99999999999)) (describe "s")
+              (describe '(1 2)) (describe '(1 2 3)) (describe (lambda (xs) (length xs))) (describe car) (describe 1.5))
+    "#;
+    let result = run(source).unwrap();
+    let items = match &result {
+        Value::List(items) => items.iter().cloned().collect::<Vec<_>>(),
+        _ => panic!("expected a list, got {:?}", result),
+    };
+    assert_eq!(items[0], list(vec![Value::symbol("integer"), Value::Integer(5)]));
+    assert!(matches!(&items[1], Value::List(parts) if parts.iter().next() == Some(&Value::symbol("integer"))));
+    assert_eq!(items[2], list(vec![Value::symbol("string"), Value::string("s")]));
+    assert_eq!(items[3], list(vec![Value::symbol("pair"), Value::Integer(1), Value::Integer(2)]));
+    assert_eq!(items[4], Value::symbol("other"));
+    assert_eq!(items[5], list(vec![Value::symbol("function"), Value::Integer(2)]));
+    assert_eq!(items[6], list(vec![Value::symbol("function"), Value::Integer(2)]));
+    assert_eq!(items[7], Value::symbol("other"));
+}
+
+#[test]
+fn test_number_covers_integers_and_floats() {
+    let source = r#"
+        (defun half
+          (((:number n)) (/. n 2))
+          ((_) 'not-a-number))
+        (list (half 3) (half 1.5) (half "3"))
+    "#;
+    assert_eq!(run(source).unwrap(), list(vec![Value::Float(1.5), Value::Float(0.75), Value::symbol("not-a-number")]));
+}
+
+#[test]
+fn test_type_patterns_nest_and_compose_with_or() {
+    let source = r#"
+        (defun tag (v)
+          (match v
+            (((:symbol op) (:integer a) (:integer b)) (list op (+ a b)))
+            ((or (:char c) (:string c)) (list 'text c))
+            ((or 1 2 3) 'small)
+            (_ 'other)))
+        (list (tag '(plus 1 2)) (tag '(plus 1 2.0)) (tag #\x) (tag "x") (tag 2) (tag 4))
+    "#;
+    assert_eq!(run(source).unwrap(), list(vec![
+        list(vec![Value::symbol("plus"), Value::Integer(3)]),
+        Value::symbol("other"),
+        list(vec![Value::symbol("text"), Value::Char('x')]),
+        list(vec![Value::symbol("text"), Value::string("x")]),
+        Value::symbol("small"),
+        Value::symbol("other"),
+    ]));
+}
+
+#[test]
+fn test_bad_type_patterns_are_compile_errors() {
+    assert_eq!(compile("(match 1 ((:int n) n))").err().unwrap(), "Unknown type pattern ':int'");
+    assert_eq!(compile("(match 1 ((:integer a b) a))").err().unwrap(), "type pattern expects one pattern: (:integer x)");
+}
+
+// ============================================================================
+// Literal heads with deeply nested tails
+// ============================================================================
+
+#[test]
+fn test_literal_head_with_deeply_nested_tail() {
+    // The tail is checked and bound three lists deep; a value with the right
+    // head but the wrong nesting falls through to the next clause
+    let clauses = r#"
+        (((1 . ((a (b (c d))) e))) (list a b c d e))
+        (((1 . rest)) (list 'fallback rest))
+        ((_) 'other)
+    "#;
+    let calls = "(list (f '(1 (10 (20 (30 40))) 50)) (f '(1 (10 (20 30)) 50)) (f '(1 (10 20) 50)) (f '(2 (10 (20 (30 40))) 50)))";
+    let expected = list(vec![
+        ints(&[10, 20, 30, 40, 50]),
+        list(vec![Value::symbol("fallback"), list(vec![list(vec![Value::Integer(10), ints(&[20, 30])]), Value::Integer(50)])]),
+        list(vec![Value::symbol("fallback"), list(vec![ints(&[10, 20]), Value::Integer(50)])]),
+        Value::symbol("other"),
+    ]);
+    assert_eq!(run(&format!("(defun f {}) {}", clauses, calls)).unwrap(), expected);
+
+    let source = format!(r#"
+        (defun f (v)
+          (match v
+            ((1 . ((a (b (c d))) e)) (list a b c d e))
+            ((1 . rest) (list 'fallback rest))
+            (_ 'other)))
+        {}
+    "#, calls);
+    assert_eq!(run(&source).unwrap(), expected);
+}
+
+#[test]
+fn test_string_head_with_typed_nested_tail() {
+    let source = r#"
+        (defun point
+          ((("at" ((:integer x) (:integer y)) . _)) (list x y))
+          (((_ . _)) 'bad))
+        (list (point '("at" (3 4))) (point '("at" (3 4) extra)) (point '("at" (3 "4"))) (point '("to" (3 4))))
+    "#;
+    assert_eq!(run(source).unwrap(), list(vec![ints(&[3, 4]), ints(&[3, 4]), Value::symbol("bad"), Value::symbol("bad")]));
+}
+
+// ============================================================================
+// Unreachable clauses
+// ============================================================================
+
+#[test]
+fn test_a_repeated_literal_clause_is_unreachable() {
+    let source = "(defun f (v)\n  (match v\n    (1 'one)\n    (2 'two)\n    (1 'again)))\n(f 1)";
+    assert_eq!(warnings(source), vec![
+        ("Unreachable clause: the clause on line 3 has the same pattern and always matches first".to_string(), 5),
+    ]);
+    let source = "(defun g\n  (((\"a\" . _)) 1)\n  (((\"a\" . rest)) (length rest))\n  ((_) 0))\n(g 1)";
+    assert_eq!(warnings(source), vec![
+        ("Unreachable clause: the clause on line 2 has the same pattern and always matches first".to_string(), 3),
+    ]);
+}
+
+#[test]
+fn test_or_alternatives_all_covered_are_unreachable() {
+    let source = "(defun f (v)\n  (match v\n    ((or 1 2 3) 'small)\n    ((or 3 1) 'again)\n    ((or 3 4) 'some-new)))\n(f 1)";
+    assert_eq!(warnings(source), vec![
+        ("Unreachable clause: the clause on line 3 has the same pattern and always matches first".to_string(), 4),
+    ]);
+}
+
+#[test]
+fn test_guarded_or_different_clauses_are_not_unreachable() {
+    assert_eq!(warnings("(defun f (v) (match v (1 when (> v 0) 'one) (1 'one-anyway) (1.0 'float) (\"1\" 'string) (_ 'other))) (f 1)"), vec![]);
+    assert_eq!(warnings("(defun f (v) (match v ((:integer n) n) ((:float n) n) ((1 . _) 'one) ((1 _) 'pair))) (f 1)"), vec![]);
+}
@@ -11,7 +11,7 @@ fn compile_and_run(source: &str) -> VM {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
     vm
 }
@@ -116,7 +116,7 @@ fn test_load_file_not_found() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
 
     let result = vm.run();
     assert!(result.is_err());
@@ -311,7 +311,7 @@ fn test_require_file_not_found() {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
 
     let result = vm.run();
     assert!(result.is_err());
@@ -1,4 +1,4 @@
-use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Value};
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, Value};
 
 /// Helper function to compile and run source code
 fn compile_and_run(source: &str) -> VM {
@@ -10,7 +10,7 @@ fn compile_and_run(source: &str) -> VM {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
     vm
 }
@@ -171,3 +171,92 @@ fn test_loop_even_larger_iteration() {
     let vm = compile_and_run(source);
     assert_eq!(get_int_result(&vm), 42);
 }
+
+#[test]
+fn test_loop_body_call_not_tail_when_loop_is_operand() {
+    // The loop result is bound and used afterwards, so the call to `double` must return here
+    let source = r#"
+        (defun double (x) (* x 2))
+        (defun f (n)
+          (let ((r (loop ((i 0))
+                     (if (< i n)
+                       (recur (+ i 1))
+                       (double i)))))
+            (+ 1 r)))
+        (f 5)
+    "#;
+    let vm = compile_and_run(source);
+    assert_eq!(get_int_result(&vm), 11);
+}
+
+// ============================================================================
+// Compilation to jumps
+// ============================================================================
+
+fn compile_error(source: &str) -> String {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    Compiler::new().compile_program(&exprs).unwrap_err().message
+}
+
+#[test]
+fn test_recur_jumps_back_into_the_same_slots() {
+    let source = "(defun sum-to (n) (loop ((i 0) (acc 0)) (if (> i n) acc (recur (+ i 1) (+ acc i))))) (sum-to 10)";
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let (functions, _) = Compiler::new().compile_program(&exprs).unwrap();
+    let body = &functions["sum-to"];
+    assert!(body.contains(&Instruction::SetLocal(0)) && body.contains(&Instruction::SetLocal(1)), "got: {:?}", body);
+    assert!(body.iter().enumerate().any(|(i, instruction)| matches!(instruction, Instruction::Jmp(target) if *target < i)),
+        "expected a backward jump in {:?}", body);
+    assert!(!body.iter().any(|i| matches!(i, Instruction::Call(..) | Instruction::TailCall(..))), "got: {:?}", body);
+    assert_eq!(get_int_result(&compile_and_run(source)), 55);
+}
+
+#[test]
+fn test_recur_drops_bindings_made_in_the_body() {
+    let source = r#"
+        (defun f (n)
+          (loop ((i 0) (acc '()))
+            (let ((sq (* i i)))
+              (match i
+                (3 acc)
+                (_ (let ((next (+ i 1))) (recur next (cons sq acc))))))))
+        (f 0)
+    "#;
+    let vm = compile_and_run(source);
+    assert_eq!(get_list_result(&vm), vec![Value::Integer(4), Value::Integer(1), Value::Integer(0)]);
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_nested_loops_recur_to_the_innermost() {
+    let source = r#"
+        (loop ((i 0) (total 0))
+          (if (= i 3)
+            total
+            (recur (+ i 1)
+                   (+ total (loop ((j 0) (row 0)) (if (= j 4) row (recur (+ j 1) (+ row j))))))))
+    "#;
+    assert_eq!(get_int_result(&compile_and_run(source)), 18);
+}
+
+#[test]
+fn test_recur_outside_a_loop_is_an_error() {
+    assert_eq!(compile_error("(recur 1)"), "recur is only allowed inside a loop");
+    assert_eq!(compile_error("(defun f (n) (recur (- n 1)))"), "recur is only allowed inside a loop");
+    // A lambda in the body is a new function, which recur can't jump out of
+    assert_eq!(compile_error("(loop ((i 0)) (lambda () (recur 1)))"), "recur is only allowed inside a loop");
+}
+
+#[test]
+fn test_recur_outside_tail_position_is_an_error() {
+    assert_eq!(compile_error("(loop ((i 0)) (+ 1 (recur (+ i 1))))"), "recur must be in tail position of its loop");
+    assert_eq!(compile_error("(loop ((i 0)) (do (recur 1) i))"), "recur must be in tail position of its loop");
+    assert_eq!(compile_error("(loop ((i (recur 0))) i)"), "recur is only allowed inside a loop");
+}
+
+#[test]
+fn test_recur_must_match_the_loop_arity() {
+    assert_eq!(compile_error("(loop ((i 0) (acc 1)) (recur (+ i 1)))"),
+        "recur expects 2 argument(s) to match the loop bindings, got 1");
+    assert_eq!(compile_error("(loop () (recur 1))"), "recur expects 0 argument(s) to match the loop bindings, got 1");
+}
@@ -0,0 +1,189 @@
+use lisp_bytecode_vm::{Compiler, CompileError, VM, parser::Parser, List, Value};
+
+fn compile(compiler: &mut Compiler, source: &str) -> Result<VM, CompileError> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let (functions, main) = compiler.compile_program(&exprs)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    Ok(vm)
+}
+
+/// Helper to compile and run source code, returning the top of the stack
+fn run(source: &str) -> Value {
+    let mut vm = compile(&mut Compiler::new(), source).map_err(|e| e.message).unwrap();
+    vm.run().map_err(|e| e.message).unwrap();
+    vm.value_stack.last().cloned().expect("No value on stack")
+}
+
+fn compile_error(source: &str) -> CompileError {
+    compile(&mut Compiler::new(), source).err().expect("expected a compile error")
+}
+
+const CONTROL_MACROS: &str = r#"
+    (defmacro my-when (c . body) `(if ,c (do ,@body) false))
+    (defmacro my-unless (c &rest body) `(if ,c false (do ,@body)))
+    (defmacro while (c . body) `(loop () (if ,c (do ,@body (recur)) false)))
+    (defmacro -> (x . forms)
+      (if (null? forms)
+          x
+          (let ((f (car forms)))
+            `(-> ,(if (list? f) `(,(car f) ,x ,@(cdr f)) `(,f ,x)) ,@(cdr forms)))))
+"#;
+
+#[test]
+fn test_when_and_unless_with_body() {
+    let source = format!("{} (+ (my-when (> 2 1) 1 2 3) (my-unless (> 1 2) 10 20))", CONTROL_MACROS);
+    assert_eq!(run(&source), Value::Integer(23));
+}
+
+#[test]
+fn test_while_loop() {
+    let source = format!("{} (let ((i 0)) (do (while (< i 5) (set! i (+ i 1))) i))", CONTROL_MACROS);
+    assert_eq!(run(&source), Value::Integer(5));
+}
+
+#[test]
+fn test_threading_macro_recursively_expands() {
+    // (- (* (+ 5 1) 2) 3)
+    let source = format!("{} (-> 5 (+ 1) (* 2) (- 3))", CONTROL_MACROS);
+    assert_eq!(run(&source), Value::Integer(9));
+}
+
+#[test]
+fn test_macro_shadows_builtin_form() {
+    let source = "(defmacro when (c . body) `(if ,c (do ,@body) 0)) (when true 1 2)";
+    assert_eq!(run(source), Value::Integer(2));
+}
+
+#[test]
+fn test_special_forms_cannot_be_redefined() {
+    let err = compile_error("(defmacro if (c a b) b)\n(if true 1 2)");
+    assert_eq!(err.message, "Cannot define macro 'if': it is a special form");
+    assert_eq!((err.location.line, err.location.column), (1, 11));
+
+    for form in ["let", "lambda", "quote", "defun", "catch"] {
+        let err = compile_error(&format!("(defmacro {} (x) x)", form));
+        assert!(err.message.contains("it is a special form"), "{}: {}", form, err.message);
+    }
+}
+
+#[test]
+fn test_expansion_compiles_in_place() {
+    // The expansion uses if, which still means the special form
+    let source = "(defmacro unless (test body) (list 'if test ''() body)) (list (unless false 5) (unless true 5))";
+    assert_eq!(run(source), Value::List(List::from_vec(vec![Value::Integer(5), Value::List(List::Nil)])));
+}
+
+#[test]
+fn test_macro_can_call_defined_function() {
+    let source = r#"
+        (defun square-form (x) (list '* x x))
+        (defmacro square (x) (square-form x))
+        (square 7)
+    "#;
+    assert_eq!(run(source), Value::Integer(49));
+}
+
+#[test]
+fn test_macro_with_several_body_forms() {
+    let source = "(defmacro twice (x) (print 'expanding) `(+ ,x ,x)) (twice 4)";
+    assert_eq!(run(source), Value::Integer(8));
+}
+
+#[test]
+fn test_arity_error_points_at_call_site() {
+    let err = compile_error("(defmacro pair (a b) `(list ,a ,b))\n\n(pair 1)");
+    assert!(err.message.contains("Macro 'pair' expects 2 arguments, got 1"), "got: {}", err.message);
+    assert_eq!((err.location.line, err.location.column), (3, 1));
+}
+
+#[test]
+fn test_error_in_expansion_points_at_call_site() {
+    let err = compile_error("(defmacro broken (x) `(+ ,x undefined-name))\n(broken 1)");
+    assert!(err.message.contains("Undefined variable 'undefined-name'"), "got: {}", err.message);
+    assert_eq!(err.location.line, 2);
+}
+
+#[test]
+fn test_error_in_expansion_notes_the_macro_definition() {
+    let err = compile_error("(defmacro broken (x) `(+ ,x undefined-name))\n(broken 1)");
+    let (note, location) = err.note.clone().expect("a note pointing at the defmacro");
+    assert_eq!(note, "in the expansion of macro 'broken', defined here");
+    assert_eq!((location.line, location.column), (1, 1));
+
+    // Through nested expansions, the note names the macro whose expansion failed
+    let source = "(defmacro outer (x) `(inner ,x))\n(defmacro inner (x) `(+ ,x missing))\n(outer 1)";
+    let err = compile_error(source);
+    assert_eq!(err.note.clone().unwrap().0, "in the expansion of macro 'inner', defined here");
+    assert_eq!(err.location.line, 3);
+    let output = err.format(Some(source));
+    assert!(output.contains("├─ Note"), "got: {}", output);
+    assert!(output.contains("defined here (<input>:2:1)"), "got: {}", output);
+}
+
+#[test]
+fn test_error_in_an_argument_points_at_the_argument() {
+    let source = "(defmacro my-when (c body) `(if ,c ,body false))\n(my-when true\n  (let ((x 1)) (set! nowhere x)))";
+    let err = compile_error(source);
+    assert!(err.message.contains("nowhere"), "got: {}", err.message);
+    assert_eq!((err.location.line, err.location.column), (3, 22));
+    assert!(err.note.is_some());
+}
+
+#[test]
+fn test_runtime_error_in_an_argument_points_at_the_argument() {
+    let source = "(defmacro my-when (c body) `(if ,c ,body false))\n(my-when true\n  (car 5))";
+    let mut compiler = Compiler::new();
+    let mut vm = compile(&mut compiler, source).map_err(|e| e.message).unwrap();
+    vm.source_maps = compiler.source_maps();
+    let err = vm.run().err().expect("expected a runtime error");
+    let location = err.location.expect("a location for the error");
+    assert_eq!((location.line, location.column), (3, 3));
+
+    // Code the macro generated is placed at the call site
+    let source = "(defmacro first-of (x) `(car ,x))\n(first-of 5)";
+    let mut compiler = Compiler::new();
+    let mut vm = compile(&mut compiler, source).map_err(|e| e.message).unwrap();
+    vm.source_maps = compiler.source_maps();
+    let location = vm.run().err().expect("expected a runtime error").location.unwrap();
+    assert_eq!((location.line, location.column), (2, 1));
+}
+
+#[test]
+fn test_runaway_expansion_is_reported() {
+    let err = compile_error("(defmacro forever (x) `(forever ,x))\n(forever 1)");
+    assert!(err.message.contains("macro expansion too deep: 'forever'"), "got: {}", err.message);
+    assert!(err.message.contains("500"), "got: {}", err.message);
+    assert_eq!(err.location.line, 2);
+}
+
+#[test]
+fn test_runaway_nested_expansion_is_reported() {
+    // Each expansion nests the next call one form deeper
+    let mut compiler = Compiler::new();
+    compiler.set_macro_expansion_limit(10);
+    let err = compile(&mut compiler, "(defmacro grow (x) `(+ 1 (grow ,x)))\n(grow 1)").err().expect("expected a compile error");
+    assert!(err.message.contains("macro expansion too deep: 'grow' expanded more than 10 levels"), "got: {}", err.message);
+    assert_eq!(err.location.line, 2);
+}
+
+#[test]
+fn test_expansion_limit_is_configurable() {
+    let source = r#"
+        (defmacro count-down (n) (if (= n 0) 0 `(count-down ,(- n 1))))
+        (count-down 20)
+    "#;
+    let mut compiler = Compiler::new();
+    compiler.set_macro_expansion_limit(10);
+    let err = compile(&mut compiler, source).err().expect("expected a compile error");
+    assert!(err.message.contains("expanded more than 10 levels"), "got: {}", err.message);
+
+    let mut compiler = Compiler::new();
+    compiler.set_macro_expansion_limit(30);
+    let mut vm = compile(&mut compiler, source).map_err(|e| e.message).unwrap();
+    vm.run().map_err(|e| e.message).unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(0)));
+}
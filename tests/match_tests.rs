@@ -0,0 +1,224 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, List, Value};
+
+fn compile(source: &str) -> Result<(std::collections::HashMap<String, Vec<Instruction>>, Vec<Instruction>), String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    Compiler::new().compile_program(&exprs).map_err(|e| e.message)
+}
+
+fn run_vm(source: &str) -> Result<VM, String> {
+    let (functions, main) = compile(source)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+fn run(source: &str) -> Result<Option<Value>, String> {
+    Ok(run_vm(source)?.value_stack.last().cloned())
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+fn symbol(name: &str) -> Value {
+    Value::symbol(name)
+}
+
+const DESCRIBE: &str = r#"
+    (defun describe (v)
+      (match v
+        (0 'zero)
+        ('() 'empty)
+        ((x) 'single)
+        ((x . rest) 'many)
+        (_ 'other)))
+"#;
+
+#[test]
+fn test_literal_list_and_wildcard_clauses() {
+    let source = format!("{} (list (describe 0) (describe '()) (describe '(1)) (describe '(1 2)) (describe 7))", DESCRIBE);
+    let expected = ["zero", "empty", "single", "many", "other"].iter().map(|s| symbol(s)).collect();
+    assert_eq!(run(&source), Ok(Some(Value::List(List::from_vec(expected)))));
+}
+
+#[test]
+fn test_nested_destructuring_binds_variables() {
+    let source = "(match '((1 2) (3 (4 5))) (((a b) (c (d e))) (list e d c b a)))";
+    assert_eq!(run(source), Ok(Some(ints(&[5, 4, 3, 2, 1]))));
+
+    // Outer locals stay visible next to the bindings
+    let source = "(let ((base 100)) (match '(1 . (2 3)) ((h . t) (+ base (+ h (car t))))))";
+    assert_eq!(run(source), Ok(Some(Value::Integer(103))));
+}
+
+#[test]
+fn test_nested_dotted_patterns_bind_every_variable() {
+    // a is the car of the car, b the rest of the car, c the rest of the list
+    let source = "(match '((1 2) 3 4) (((a . b) . c) (list a b c)))";
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(vec![Value::Integer(1), ints(&[2]), ints(&[3, 4])])))));
+    let source = "(match '(((1) 2) 3) ((((a . b) . c) . d) (list a b c d)))";
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(vec![
+        Value::Integer(1), Value::List(List::Nil), ints(&[2]), ints(&[3]),
+    ])))));
+}
+
+#[test]
+fn test_cons_patterns() {
+    let source = "(match '(1 2 3) ((cons a b) (list a b)))";
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(vec![Value::Integer(1), ints(&[2, 3])])))));
+    // Nested, and mixed with list patterns and wildcards
+    let source = "(match '((1 2) 3) ((cons (cons a _) (cons b '())) (list a b)))";
+    assert_eq!(run(source), Ok(Some(ints(&[1, 3]))));
+    let source = "(match '(1 (2 3)) ((cons a (cons (b c) _)) (list a b c)))";
+    assert_eq!(run(source), Ok(Some(ints(&[1, 2, 3]))));
+    // The empty list isn't a pair
+    let source = "(match '() ((cons h t) 'pair) (_ 'empty))";
+    assert_eq!(run(source), Ok(Some(symbol("empty"))));
+    let err = run("(match '(1) ((cons h) h))").unwrap_err();
+    assert_eq!(err, "cons pattern expects a head and a tail pattern: (cons head tail)");
+}
+
+#[test]
+fn test_symbol_literal_clauses() {
+    let source = r#"
+        (defun op (name) (match name ('add +) ('mul *) (_ 'unknown)))
+        (list ((op 'add) 2 3) ((op 'mul) 2 3) (op 'div))
+    "#;
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(vec![
+        Value::Integer(5), Value::Integer(6), symbol("unknown"),
+    ])))));
+}
+
+#[test]
+fn test_match_anywhere_an_expression_is_allowed() {
+    let source = "(+ 1 (match '(2 3) ((a b) (* a b))))";
+    assert_eq!(run(source), Ok(Some(Value::Integer(7))));
+
+    let source = "(list (match 1 (1 'one) (_ 'other)) (match 2 (1 'one) (_ 'other)))";
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(vec![symbol("one"), symbol("other")])))));
+
+    // Closures created in a clause capture its bindings
+    let source = "(define f (match '(3 4) ((a b) (lambda (k) (+ k (* a b)))))) (f 1)";
+    assert_eq!(run(source), Ok(Some(Value::Integer(13))));
+}
+
+#[test]
+fn test_scrutinee_is_evaluated_once() {
+    let source = r#"
+        (define calls 0)
+        (defun next () (set! calls (+ calls 1)) calls)
+        (define result (match (next) (5 'five) (2 'two) (1 'one) (_ 'other)))
+        (list result calls)
+    "#;
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(vec![symbol("one"), Value::Integer(1)])))));
+}
+
+#[test]
+fn test_clause_bodies_are_tail_calls() {
+    let source = "(defun count (n acc) (match n (0 acc) (k (count (- k 1) (+ acc 1))))) (count 200000 0)";
+    assert_eq!(run(source), Ok(Some(Value::Integer(200000))));
+
+    let (functions, _) = compile("(defun count (n acc) (match n (0 acc) (k (count (- k 1) (+ acc 1)))))").unwrap();
+    assert!(functions["count"].iter().any(|instr| matches!(instr, Instruction::TailCall(_, _))),
+        "got: {:?}", functions["count"]);
+
+    // recur from a clause body restarts the enclosing loop
+    let source = "(loop ((i 0) (acc 0)) (match i (5 acc) (j (recur (+ j 1) (+ acc j)))))";
+    assert_eq!(run(source), Ok(Some(Value::Integer(10))));
+}
+
+#[test]
+fn test_stack_depth_is_the_same_whichever_clause_runs() {
+    // Clauses bind 0, 1, 2 and 3 variables; a leak from any of them would pile up values
+    let source = r#"
+        (define shapes (list 0 '(1) '(1 2) '(1 2 3)))
+        (define total 0)
+        (dotimes (i 2000)
+          (dolist (shape shapes)
+            (set! total (+ total (match shape
+                                   (0 0)
+                                   ((a) a)
+                                   ((a b) (+ a b))
+                                   ((a b c) (+ a (+ b c))))))))
+        total
+    "#;
+    let vm = run_vm(source).unwrap();
+    assert_eq!(vm.value_stack, vec![Value::Integer(2000 * 10)]);
+
+    // The same inside a function, with a value below the match on the stack
+    let source = r#"
+        (defun step (x) (+ 1 (match x ((a b) b) ((a) a) (_ 0))))
+        (defun run (n acc) (if (= n 0) acc (run (- n 1) (+ acc (step (if (= (% n 3) 0) '(1 2) (if (= (% n 3) 1) '(5) 9)))))))
+        (run 3000 0)
+    "#;
+    let vm = run_vm(source).unwrap();
+    assert_eq!(vm.value_stack, vec![Value::Integer(1000 * 3 + 1000 * 6 + 1000 * 1)]);
+}
+
+#[test]
+fn test_guard_that_rejects_falls_through_to_a_later_clause() {
+    let source = r#"
+        (defun sign (n) (match n (x (when (> x 0)) 'positive) (0 'zero) (_ 'negative)))
+        (list (sign 5) (sign 0) (sign -3))
+    "#;
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(vec![symbol("positive"), symbol("zero"), symbol("negative")])))));
+
+    // The pattern matches and binds a and b, the guard rejects, the next clause
+    // sees the scrutinee again rather than the first clause's bindings
+    let source = "(match '(3 1) ((a b) (when (< a b)) 'sorted) ((x y) (list y x)))";
+    assert_eq!(run(source), Ok(Some(ints(&[1, 3]))));
+}
+
+#[test]
+fn test_guard_sees_bindings_and_outer_locals() {
+    let source = "(let ((limit 10)) (match '(4 9) ((a b) (when (> (+ a b) limit)) (list 'over a b)) (_ 'under)))";
+    assert_eq!(run(source), Ok(Some(Value::List(List::from_vec(vec![symbol("over"), Value::Integer(4), Value::Integer(9)])))));
+    // The defun form of a guard works in match too
+    let source = "(match 4 (n when (= (% n 2) 0) 'even) (_ 'odd))";
+    assert_eq!(run(source), Ok(Some(symbol("even"))));
+}
+
+#[test]
+fn test_when_expression_as_a_clause_body_is_not_a_guard() {
+    assert_eq!(run("(match 4 (x (when (> x 0) 'positive)))"), Ok(Some(symbol("positive"))));
+}
+
+#[test]
+fn test_failed_guards_leave_the_stack_balanced() {
+    let source = r#"
+        (defun count-positive (ns acc)
+          (match ns
+            ('() acc)
+            ((cons h t) (when (> h 0)) (count-positive t (+ acc 1)))
+            ((cons _ t) (count-positive t acc))))
+        (define total 0)
+        (dotimes (i 1000)
+          (set! total (+ total (match i (n (when (> n 10000)) 0) ((@ n _) (when (< n 0)) 0) (_ 1)))))
+        (list (count-positive '(1 -1 2 -2 3) 0) total)
+    "#;
+    let vm = run_vm(source).unwrap();
+    assert_eq!(vm.value_stack, vec![ints(&[3, 1000])]);
+}
+
+#[test]
+fn test_no_matching_clause_shows_the_value() {
+    let err = run("(match '(1 2 3) ((a b) a) (0 'zero))").unwrap_err();
+    assert_eq!(err, "No matching pattern in match for value (1 2 3)");
+
+    // The error can be handled like any other
+    let source = "(handler-case (match 5 (0 'zero)) (catch (e) 'unmatched))";
+    assert_eq!(run(source), Ok(Some(symbol("unmatched"))));
+}
+
+#[test]
+fn test_malformed_match() {
+    let err = run("(match 1)").unwrap_err();
+    assert_eq!(err, "match expects a value and at least 1 clause: (match expr (pattern body...) ...)");
+    let err = run("(match 1 (x))").unwrap_err();
+    assert_eq!(err, "match clause expects (pattern body...)");
+    let err = run("(match 1 (x when (> x 0)))").unwrap_err();
+    assert_eq!(err, "Guarded match clause must have a guard and a body: (pattern when guard body...)");
+}
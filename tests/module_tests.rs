@@ -17,7 +17,7 @@ fn compile_and_run(source: &str) -> Result<VM, String> {
     for (module, exports) in compiler.module_exports {
         vm.module_exports.insert(module, exports);
     }
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().map_err(|e| format!("Runtime error: {:?}", e))?;
 
     Ok(vm)
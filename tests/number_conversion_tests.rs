@@ -0,0 +1,188 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+use std::sync::Arc;
+
+fn run(source: &str) -> Result<Value, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+    let (functions, main) = Compiler::new().compile_program(&exprs).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn string(s: &str) -> Value {
+    Value::String(Arc::new(s.to_string()))
+}
+
+fn nil() -> Value {
+    Value::List(List::Nil)
+}
+
+// ============================================================================
+// string->number
+// ============================================================================
+
+#[test]
+fn test_string_to_number_with_radix() {
+    assert_eq!(run(r#"(string->number "ff" 16)"#), Ok(Value::Integer(255)));
+    assert_eq!(run(r#"(string->number "777" 8)"#), Ok(Value::Integer(511)));
+    assert_eq!(run(r#"(string->number "1010" 2)"#), Ok(Value::Integer(10)));
+    assert_eq!(run(r#"(string->number "1010" 10)"#), Ok(Value::Integer(1010)));
+}
+
+#[test]
+fn test_hex_accepts_both_cases() {
+    assert_eq!(run(r#"(string->number "DeadBeef" 16)"#), Ok(Value::Integer(0xdeadbeef)));
+    assert_eq!(run(r#"(string->number "ABCDEF" 16)"#), run(r#"(string->number "abcdef" 16)"#));
+}
+
+#[test]
+fn test_negative_numbers() {
+    assert_eq!(run(r#"(string->number "-ff" 16)"#), Ok(Value::Integer(-255)));
+    assert_eq!(run(r#"(string->number "-1010" 2)"#), Ok(Value::Integer(-10)));
+    assert_eq!(run(r#"(string->number "+17" 8)"#), Ok(Value::Integer(15)));
+}
+
+#[test]
+fn test_malformed_input_is_nil() {
+    assert_eq!(run(r#"(string->number "12abc")"#), Ok(nil()));
+    assert_eq!(run(r#"(string->number "")"#), Ok(nil()));
+    assert_eq!(run(r#"(string->number "-")"#), Ok(nil()));
+    assert_eq!(run(r#"(string->number "19" 8)"#), Ok(nil()));
+    assert_eq!(run(r#"(string->number "102" 2)"#), Ok(nil()));
+    assert_eq!(run(r#"(string->number "0xff" 16)"#), Ok(nil()));
+    assert_eq!(run(r#"(string->number "1.5" 16)"#), Ok(nil()));
+}
+
+#[test]
+fn test_surrounding_whitespace_is_rejected() {
+    assert_eq!(run(r#"(string->number " 42")"#), Ok(nil()));
+    assert_eq!(run(r#"(string->number "42 ")"#), Ok(nil()));
+    assert_eq!(run(r#"(string->number "ff\n" 16)"#), Ok(nil()));
+    assert_eq!(run(r#"(string->number "- 5")"#), Ok(nil()));
+}
+
+#[test]
+fn test_overflow_is_nil() {
+    assert_eq!(run(r#"(string->number "9223372036854775807")"#), Ok(Value::Integer(i64::MAX)));
+    assert_eq!(run(r#"(string->number "-9223372036854775808")"#), Ok(Value::Integer(i64::MIN)));
+    assert_eq!(run(r#"(string->number "9223372036854775808")"#), Ok(nil()));
+    assert_eq!(run(r#"(string->number "-9223372036854775809")"#), Ok(nil()));
+    assert_eq!(run(r#"(string->number "7fffffffffffffff" 16)"#), Ok(Value::Integer(i64::MAX)));
+    assert_eq!(run(r#"(string->number "8000000000000000" 16)"#), Ok(nil()));
+    assert_eq!(run(r#"(string->number "11111111111111111111111111111111111111111111111111111111111111111" 2)"#), Ok(nil()));
+}
+
+#[test]
+fn test_decimal_still_reads_floats() {
+    assert_eq!(run(r#"(string->number "2.5")"#), Ok(Value::Float(2.5)));
+    assert_eq!(run(r#"(string->number "1e3" 10)"#), Ok(Value::Float(1000.0)));
+}
+
+#[test]
+fn test_callers_can_branch_on_nil() {
+    let source = r#"
+        (defun parse-or (text fallback)
+          (let ((n (string->number text 16)))
+            (if (null? n) fallback n)))
+        (list (parse-or "1f" 0) (parse-or "zz" 0))
+    "#;
+    assert_eq!(run(source), Ok(Value::List(List::from_vec(vec![Value::Integer(31), Value::Integer(0)]))));
+}
+
+#[test]
+fn test_string_to_number_rejects_non_strings() {
+    let err = run("(string->number 42)").unwrap_err();
+    assert!(err.contains("'string->number' expects a string"), "got: {}", err);
+}
+
+// ============================================================================
+// number->string
+// ============================================================================
+
+#[test]
+fn test_number_to_string_with_radix() {
+    assert_eq!(run("(number->string 255 16)"), Ok(string("ff")));
+    assert_eq!(run("(number->string 511 8)"), Ok(string("777")));
+    assert_eq!(run("(number->string 10 2)"), Ok(string("1010")));
+    assert_eq!(run("(number->string 0 2)"), Ok(string("0")));
+    assert_eq!(run("(number->string 42 10)"), Ok(string("42")));
+}
+
+#[test]
+fn test_number_to_string_negative_and_extremes() {
+    assert_eq!(run("(number->string -255 16)"), Ok(string("-ff")));
+    assert_eq!(run("(number->string -9223372036854775807 16)"), Ok(string("-7fffffffffffffff")));
+    assert_eq!(run("(number->string (- -9223372036854775807 1) 2)"), Ok(string(&format!("-1{}", "0".repeat(63)))));
+}
+
+#[test]
+fn test_number_to_string_bigint_radix() {
+    // 2^64 overflows into a bigint
+    assert_eq!(run("(number->string (* 4294967296 4294967296) 16)"), Ok(string("10000000000000000")));
+    assert_eq!(run("(number->string (* 4294967296 4294967296) 2)"), Ok(string(&format!("1{}", "0".repeat(64)))));
+    assert_eq!(run("(number->string (* 4294967296 4294967296))"), Ok(string("18446744073709551616")));
+    assert_eq!(run("(number->string (- 0 (* 4294967296 4294967297)) 8)"), Ok(string("-2000000000040000000000")));
+}
+
+#[test]
+fn test_round_trip_in_every_radix() {
+    let source = r#"
+        (defun round-trip (n radix) (string->number (number->string n radix) radix))
+        (list (round-trip 123456789 2) (round-trip -123456789 8) (round-trip 123456789 10) (round-trip -123456789 16))
+    "#;
+    let expected = vec![
+        Value::Integer(123456789),
+        Value::Integer(-123456789),
+        Value::Integer(123456789),
+        Value::Integer(-123456789),
+    ];
+    assert_eq!(run(source), Ok(Value::List(List::from_vec(expected))));
+}
+
+#[test]
+fn test_floats_only_in_radix_ten() {
+    assert_eq!(run("(number->string 2.5 10)"), Ok(string("2.5")));
+    let err = run("(number->string 2.5 16)").unwrap_err();
+    assert!(err.contains("radix 10"), "got: {}", err);
+}
+
+#[test]
+fn test_unsupported_radix_is_an_error() {
+    let err = run("(number->string 10 3)").unwrap_err();
+    assert!(err.contains("radix must be 2, 8, 10 or 16"), "got: {}", err);
+    let err = run(r#"(string->number "10" 36)"#).unwrap_err();
+    assert!(err.contains("radix must be 2, 8, 10 or 16"), "got: {}", err);
+}
+
+#[test]
+fn test_wrong_argument_count() {
+    let err = run("(number->string 1 2 3)").unwrap_err();
+    assert!(err.contains("number->string expects 1 or 2 arguments"), "got: {}", err);
+}
+
+// ============================================================================
+// As ordinary functions
+// ============================================================================
+
+#[test]
+fn test_conversions_in_tail_position() {
+    let source = r#"
+        (defun parse-hex (text) (string->number text 16))
+        (defun to-binary (n) (number->string n 2))
+        (list (parse-hex "ff") (to-binary 5))
+    "#;
+    assert_eq!(run(source), Ok(Value::List(List::from_vec(vec![Value::Integer(255), string("101")]))));
+}
+
+#[test]
+fn test_conversions_as_values() {
+    let source = r#"(list (map string->number (list "1" "x" "3")) (map number->string '(4 5)))"#;
+    let expected = vec![
+        Value::List(List::from_vec(vec![Value::Integer(1), nil(), Value::Integer(3)])),
+        Value::List(List::from_vec(vec![string("4"), string("5")])),
+    ];
+    assert_eq!(run(source), Ok(Value::List(List::from_vec(expected))));
+}
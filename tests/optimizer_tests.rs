@@ -914,3 +914,23 @@ fn test_strength_reduction_no_optimization() {
     assert_eq!(optimized.len(), 4);
     assert_eq!(optimizer.get_stats().strength_reductions, 0);
 }
+
+#[test]
+fn test_constant_folding_skips_overflow() {
+    let mut optimizer = Optimizer::new();
+
+    let bytecode = vec![
+        Instruction::Push(Value::Integer(i64::MAX)),
+        Instruction::Push(Value::Integer(2)),
+        Instruction::Mul,
+        Instruction::Push(Value::Integer(i64::MIN)),
+        Instruction::Neg,
+        Instruction::Halt,
+    ];
+
+    // Overflowing results are left for the VM to promote to bignums
+    let optimized = optimizer.optimize(bytecode.clone());
+
+    assert_eq!(optimized, bytecode);
+    assert_eq!(optimizer.get_stats().constant_folds, 0);
+}
@@ -0,0 +1,111 @@
+use lisp_bytecode_vm::{Compiler, parser::Parser};
+
+/// Message and line of each warning
+fn warnings(source: &str) -> Vec<(String, usize)> {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    compiler.compile_program(&exprs).unwrap();
+    compiler.warnings().iter()
+        .map(|warning| (warning.message.clone(), warning.location.line))
+        .collect()
+}
+
+fn not_covered(function: &str, missing: &str, line: usize) -> (String, usize) {
+    (format!("Non-exhaustive function '{}': clauses do not cover: {}", function, missing), line)
+}
+
+fn covered_before(line: usize) -> (String, usize) {
+    ("Unreachable clause: the clauses before it already match everything it does".to_string(), line)
+}
+
+// ============================================================================
+// Missing arguments
+// ============================================================================
+
+#[test]
+fn test_a_list_function_without_the_empty_case() {
+    assert_eq!(warnings("(defun head\n  (((x . _)) x))"), vec![not_covered("head", "(nil)", 1)]);
+    assert_eq!(warnings("(defun head\n  ((nil) 0)\n  (((x . _)) x))"), vec![]);
+    // Short lists only
+    assert_eq!(warnings("(defun f\n  ((nil) 0)\n  (((x)) x))"), vec![not_covered("f", "((_ _ . _))", 1)]);
+}
+
+#[test]
+fn test_a_missing_case_two_levels_down() {
+    // Lists of lists: the empty one and one-element inner lists are handled,
+    // longer inner lists are not
+    let source = "(defun firsts\n  ((nil) '())\n  (((nil . rest)) (firsts rest))\n  ((((x) . rest)) (cons x (firsts rest))))";
+    assert_eq!(warnings(source), vec![not_covered("firsts", "(((_ _ . _) . _))", 1)]);
+    let source = "(defun firsts\n  ((nil) '())\n  (((nil . rest)) (firsts rest))\n  ((((x . _) . rest)) (cons x (firsts rest))))";
+    assert_eq!(warnings(source), vec![]);
+}
+
+#[test]
+fn test_literals_only_run_out_with_a_wildcard() {
+    assert_eq!(warnings("(defun name\n  ((0) 'zero)\n  ((1) 'one))"), vec![not_covered("name", "(_)", 1)]);
+    assert_eq!(warnings("(defun greet\n  ((\"hi\") 1)\n  ((\"bye\") 2))"), vec![not_covered("greet", "(_)", 1)]);
+    assert_eq!(warnings("(defun name\n  ((0) 'zero)\n  ((1) 'one)\n  ((_) 'many))"), vec![]);
+    // Both booleans are all there are
+    assert_eq!(warnings("(defun yes\n  ((true) 1))"), vec![not_covered("yes", "(false)", 1)]);
+    assert_eq!(warnings("(defun yes\n  ((true) 1)\n  ((false) 0))"), vec![]);
+    // A column of its own for each argument
+    assert_eq!(warnings("(defun pick\n  ((nil n) n)\n  (((x . _) 0) x))"), vec![not_covered("pick", "((_ . _) _)", 1)]);
+}
+
+#[test]
+fn test_guards_and_arities_in_coverage() {
+    // A guarded clause may fail, so it covers nothing
+    let source = "(defun sign\n  ((n) when (< n 0) -1)\n  ((n) when (>= n 0) 1))";
+    assert_eq!(warnings(source), vec![not_covered("sign", "(_)", 1)]);
+    let source = "(defun sign\n  ((n) when (< n 0) -1)\n  ((_) 1))";
+    assert_eq!(warnings(source), vec![]);
+    // Each number of arguments is checked on its own
+    let source = "(defun total\n  ((x) x)\n  ((nil y) y))";
+    assert_eq!(warnings(source), vec![not_covered("total", "((_ . _) _)", 1)]);
+}
+
+#[test]
+fn test_type_and_struct_patterns_cover_their_own_values() {
+    // (:list l) is every list
+    assert_eq!(warnings("(defun size\n  (((:list l)) (length l)))"), vec![]);
+    // A list inside it is still checked
+    assert_eq!(warnings("(defun size\n  (((:list (x . _))) x))"), vec![not_covered("size", "(nil)", 1)]);
+    let source = "(defstruct circle r)\n(defstruct square s)\n(defun area\n  (((circle r)) (* 3 r r))\n  (((square s)) (* s s)))";
+    assert_eq!(warnings(source), vec![]);
+}
+
+// ============================================================================
+// Clauses the earlier ones cover
+// ============================================================================
+
+#[test]
+fn test_a_clause_hidden_behind_an_or_pattern() {
+    let source = "(defun size\n  (((or nil (_ . nil))) 'short)\n  (((_ _ . _)) 'long)\n  (((x)) x)\n  ((_) 'other))";
+    assert_eq!(warnings(source), vec![covered_before(4)]);
+}
+
+#[test]
+fn test_a_clause_covered_by_several_earlier_ones() {
+    // (1) falls to the first clause, (2) to the second
+    let source = "(defun f\n  (((1 . _)) 'starts-with-one)\n  (((_)) 'single)\n  (((or (1) (2))) 'never)\n  ((_) 'other))";
+    assert_eq!(warnings(source), vec![covered_before(4)]);
+    // Some of it left to match
+    let source = "(defun f\n  (((1 . _)) 'starts-with-one)\n  (((_)) 'single)\n  (((or (1) (2 3))) 'pair)\n  ((_) 'other))";
+    assert_eq!(warnings(source), vec![]);
+    // A catch-all after the list cases still gets values that aren't lists
+    let source = "(defun len\n  ((nil) 0)\n  (((_ . rest)) (+ 1 (len rest)))\n  ((_) 0))";
+    assert_eq!(warnings(source), vec![]);
+    let source = "(defun len\n  ((_) 0)\n  ((nil) 0))";
+    assert_eq!(warnings(source), vec![covered_before(3)]);
+}
+
+#[test]
+fn test_a_guarded_clause_covers_nothing() {
+    let source = "(defun f\n  (((x . _)) when (> x 0) 'positive)\n  (((x . _)) x)\n  ((_) 'other))";
+    assert_eq!(warnings(source), vec![]);
+    // The one left unreachable by a single earlier clause is warned about once
+    let source = "(defun f\n  (((x . _)) x)\n  (((y . _)) y)\n  ((_) 'other))";
+    assert_eq!(warnings(source), vec![
+        ("Unreachable clause: the clause on line 2 has the same pattern and always matches first".to_string(), 3),
+    ]);
+}
@@ -1,4 +1,4 @@
-use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Value};
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, Value};
 
 fn compile_and_run(source: &str) -> Result<String, String> {
     let mut parser = Parser::new(source);
@@ -12,7 +12,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
     for (name, bytecode) in functions {
         vm.functions.insert(name, bytecode);
     }
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().map_err(|e| format!("Runtime error: {:?}", e))?;
 
     // Get the top value from the stack and format it
@@ -25,6 +25,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
 fn format_value(value: &Value) -> String {
     match value {
         Value::Integer(n) => n.to_string(),
+        Value::BigInt(n) => n.to_string(),
         Value::Float(f) => {
             if f.fract() == 0.0 && !f.is_nan() && !f.is_infinite() {
                 format!("{:.1}", f)
@@ -33,6 +34,7 @@ fn format_value(value: &Value) -> String {
             }
         }
         Value::Boolean(b) => b.to_string(),
+        Value::Char(c) => format!("#\\{}", c),
         Value::List(items) => {
             let formatted_items: Vec<String> = items.iter().map(|v| format_value(v)).collect();
             format!("({})", formatted_items.join(" "))
@@ -45,20 +47,29 @@ fn format_value(value: &Value) -> String {
             format!("<closure/{}>", param_count)
         }
         Value::HashMap(map) => {
-            let mut items: Vec<String> = map.iter()
+            let mut items: Vec<String> = map.borrow().iter()
                 .map(|(k, v)| format!("\"{}\" {}", k, format_value(v)))
                 .collect();
             items.sort();
             format!("{{{}}}", items.join(" "))
         }
         Value::Vector(items) => {
-            let formatted_items: Vec<String> = items.iter().map(|v| format_value(v)).collect();
+            let formatted_items: Vec<String> = items.borrow().iter().map(|v| format_value(v)).collect();
             format!("[{}]", formatted_items.join(" "))
         }
         Value::TcpListener(_) => "#<tcp-listener>".to_string(),
         Value::TcpStream(_) => "#<tcp-stream>".to_string(),
         Value::SharedTcpListener(_) => "#<shared-tcp-listener>".to_string(),
+        Value::Struct(data) => {
+            let fields: Vec<String> = data.fields.iter().map(|v| format_value(v)).collect();
+            format!("#<{} {}>", data.name, fields.join(" "))
+        }
         Value::Pointer(p) => format!("#<pointer 0x{:x}>", p),
+        Value::Cell(_) => "#<cell>".to_string(),
+        Value::Port(_) => "#<port>".to_string(),
+        Value::Promise(_) => "#<promise>".to_string(),
+        Value::Task(_) => "#<task>".to_string(),
+        Value::Channel(_) => "#<channel>".to_string(),
     }
 }
 
@@ -587,3 +598,264 @@ fn test_deeply_nested_recursion() {
     let result = compile_and_run(source).unwrap();
     assert_eq!(result.trim(), "6");
 }
+
+// ==================== Guard Tests ====================
+
+#[test]
+fn test_guard_selects_clause() {
+    let source = r#"
+        (defun classify
+          ((n) when (< n 0) 'negative)
+          ((0) 'zero)
+          ((n) when (> n 100) 'large)
+          ((n) 'small))
+        (list (classify -5) (classify 0) (classify 500) (classify 7))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(negative zero large small)");
+}
+
+#[test]
+fn test_guard_sees_destructured_bindings() {
+    let source = r#"
+        (defun sorted-pair?
+          (((a b)) when (<= a b) true)
+          ((_) false))
+        (list (sorted-pair? '(1 2)) (sorted-pair? '(3 2)))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(true false)");
+}
+
+#[test]
+fn test_failed_guard_does_not_leak_bindings() {
+    // If the first clause's bindings stayed on the stack, `y` in the second
+    // clause would read the stale `a` from slot 0 instead
+    let source = r#"
+        (defun pick
+          ((a b) when (> a b) a)
+          ((_ y) y))
+        (list (pick 1 5) (pick 9 2))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(5 9)");
+}
+
+#[test]
+fn test_failed_guard_falls_through_to_cons_pattern() {
+    let source = r#"
+        (defun sum-positive
+          (('()) 0)
+          (((h . t)) when (> h 0) (+ h (sum-positive t)))
+          (((_ . t)) (sum-positive t)))
+        (sum-positive '(1 -2 3 -4 5))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "9");
+}
+
+#[test]
+fn test_guard_body_with_multiple_expressions() {
+    let source = r#"
+        (defun describe
+          ((n) when (> n 0) (print n) 'positive)
+          ((_) 'other))
+        (describe 3)
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "positive");
+}
+
+#[test]
+fn test_guarded_tail_recursion() {
+    let source = r#"
+        (defun count-down
+          ((n acc) when (> n 0) (count-down (- n 1) (+ acc 1)))
+          ((_ acc) acc))
+        (count-down 100000 0)
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "100000");
+}
+
+#[test]
+fn test_failed_final_guard_matches_exhausted_match() {
+    let guarded = r#"
+        (defun f ((n) when (> n 0) n))
+        (f -1)
+    "#;
+    let exhausted = r#"
+        (defun f ((0) 0))
+        (f -1)
+    "#;
+    let guarded_result = compile_and_run(guarded).unwrap_err();
+    assert_eq!(guarded_result, compile_and_run(exhausted).unwrap_err());
+    assert!(guarded_result.contains("No matching clause in function 'f'"), "got: {}", guarded_result);
+}
+
+#[test]
+fn test_no_matching_clause_is_a_runtime_error() {
+    // Caught like any other error
+    let source = r#"
+        (defun f ((0) 'zero) ((n) when (> n 10) 'big))
+        (handler-case (f 3) (catch (e) (map-get e 'message)))
+    "#;
+    assert_eq!(compile_and_run(source).unwrap(), "\"No matching clause in function 'f'\"");
+
+    // Uncaught, it stops the script with a failing exit status, located at the defun
+    let dir = std::env::temp_dir().join(format!("lisp-clause-tests-{}", std::process::id()));
+    let _ = std::fs::remove_dir_all(&dir);
+    std::fs::create_dir_all(&dir).unwrap();
+    let script = dir.join("clauses.lisp");
+    std::fs::write(&script, "(defun f ((0) 'zero))\n(print 'before)\n(f 3)\n(print 'after)\n").unwrap();
+    let output = std::process::Command::new(env!("CARGO_BIN_EXE_lisp-vm"))
+        .arg(&script)
+        .output()
+        .unwrap();
+    assert_eq!(String::from_utf8_lossy(&output.stdout), "before\n");
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    assert!(stderr.contains("No matching clause in function 'f'"), "got: {}", stderr);
+    assert!(stderr.contains("clauses.lisp:1:2"), "got: {}", stderr);
+    assert_eq!(output.status.code(), Some(1));
+    let _ = std::fs::remove_dir_all(&dir);
+}
+
+#[test]
+fn test_guarded_clause_requires_body() {
+    let source = r#"
+        (defun f ((n) when (> n 0)))
+        (f 1)
+    "#;
+    let err = compile_and_run(source).unwrap_err();
+    assert!(err.contains("Guarded clause must have a guard and a body"), "got: {}", err);
+}
+
+// ==================== Or-Pattern Tests ====================
+
+#[test]
+fn test_or_pattern_literals() {
+    let source = r#"
+        (defun small?
+          (((or 0 1 2)) true)
+          ((_) false))
+        (list (small? 0) (small? 2) (small? 3))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(true true false)");
+}
+
+#[test]
+fn test_or_pattern_message_shapes() {
+    let source = r#"
+        (defun payload
+          (((or ('ping x) ('pong x _))) x)
+          ((_) 'unknown))
+        (list (payload '(ping 1)) (payload '(pong 2 extra)) (payload '(pong 3)))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(1 2 unknown)");
+}
+
+#[test]
+fn test_or_pattern_with_wildcard_alternative() {
+    let source = r#"
+        (defun last-or-only
+          (((or (_ x) (x))) x)
+          ((_) 'none))
+        (list (last-or-only '(1 2)) (last-or-only '(3)) (last-or-only '(4 5 6)))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(2 3 none)");
+}
+
+#[test]
+fn test_or_pattern_nested_two_levels_in_cons() {
+    let source = r#"
+        (defun find-x
+          (((_ . ((or (v 'x) ('x v)) . _))) v)
+          ((_) 'none))
+        (list (find-x '(1 (7 x) 2)) (find-x '(1 (x 8))) (find-x '(1 (y y))) (find-x '(1)))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(7 8 none none)");
+}
+
+#[test]
+fn test_or_pattern_alternatives_bind_same_slots() {
+    // Bindings come from different positions in each alternative but the shared
+    // body sees them by name
+    let source = r#"
+        (defun swap-pair
+          (((or ('ab a b) ('ba b a))) (list a b)))
+        (list (swap-pair '(ab 1 2)) (swap-pair '(ba 1 2)))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "((1 2) (2 1))");
+}
+
+#[test]
+fn test_or_pattern_across_arguments() {
+    let source = r#"
+        (defun either-zero
+          (((or 0 _) (or 0 _)) 'maybe))
+        (either-zero 5 6)
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "maybe");
+}
+
+#[test]
+fn test_or_pattern_with_guard_and_recursion() {
+    let source = r#"
+        (defun count-small
+          (('()) 0)
+          ((((or 1 2 3) . t)) (+ 1 (count-small t)))
+          (((h . t)) when (< h 0) (+ 1 (count-small t)))
+          (((_ . t)) (count-small t)))
+        (count-small '(1 5 2 -4 9 3))
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "4");
+}
+
+#[test]
+fn test_or_pattern_body_is_shared() {
+    let source = r#"
+        (defun f
+          (((or (x) (x _) (_ _ x))) (+ x 12345)))
+        (f '(1 2 3))
+    "#;
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, _) = compiler.compile_program(&exprs).unwrap();
+    let body_copies = functions["f"].iter()
+        .filter(|i| **i == Instruction::Push(Value::Integer(12345)))
+        .count();
+    assert_eq!(body_copies, 1);
+
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "12348");
+}
+
+#[test]
+fn test_or_pattern_mismatched_variables_error() {
+    let source = "(defun f\n  (((or (x y) (x z))) x))";
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let err = compiler.compile_program(&exprs).err().expect("expected a compile error");
+
+    assert!(err.message.contains("the first binds {x, y}, this one binds {x, z}"), "got: {}", err.message);
+    // Points at the offending alternative, not the whole or-pattern
+    assert_eq!((err.location.line, err.location.column), (2, 15));
+}
+
+#[test]
+fn test_or_pattern_needs_alternatives() {
+    let source = r#"
+        (defun f (((or)) 1))
+    "#;
+    let err = compile_and_run(source).unwrap_err();
+    assert!(err.contains("or-pattern needs at least one alternative"), "got: {}", err);
+}
@@ -0,0 +1,159 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, List, Value};
+use std::collections::HashMap;
+
+fn compile(source: &str, optimize: bool) -> (HashMap<String, Vec<Instruction>>, Vec<Instruction>) {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    compiler.set_constant_folding(optimize);
+    compiler.compile_program(&exprs).unwrap()
+}
+
+fn run(source: &str, optimize: bool) -> Result<Value, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    compiler.set_constant_folding(optimize);
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+/// Instruction counts of `name` without and with the pass, after checking
+/// that the program gives the same result either way
+fn counts(source: &str, name: &str) -> (usize, usize) {
+    assert_eq!(run(source, true), run(source, false), "the pass changed the result of {}", source);
+    (compile(source, false).0[name].len(), compile(source, true).0[name].len())
+}
+
+// ============================================================================
+// Reductions
+// ============================================================================
+
+#[test]
+fn test_dead_code_after_an_unconditional_jump_is_removed() {
+    // The clause chain ends in a Jmp over an unreachable MatchFailed
+    let source = "(defun classify (x) (match x (0 'zero) (_ 'other))) (list (classify 0) (classify 5))";
+    let (before, after) = counts(source, "classify");
+    assert!(after < before, "expected fewer instructions, {} -> {}", before, after);
+    assert!(!compile(source, true).0["classify"].contains(&Instruction::MatchFailed));
+}
+
+#[test]
+fn test_jump_to_the_next_instruction_is_removed() {
+    let source = "(defun classify (x) (match x (0 'zero) (_ 'other))) (classify 1)";
+    let body = &compile(source, true).0["classify"];
+    for (i, instruction) in body.iter().enumerate() {
+        assert_ne!(instruction, &Instruction::Jmp(i + 1), "jump to next at {} in {:?}", i, body);
+    }
+}
+
+#[test]
+fn test_no_op_slides_are_removed() {
+    for body in compile("(defun f (x) (let () (+ x 1))) (f 1)", true).0.values() {
+        assert!(!body.contains(&Instruction::Slide(0)), "got: {:?}", body);
+        assert!(!body.contains(&Instruction::PopN(0)), "got: {:?}", body);
+    }
+}
+
+#[test]
+fn test_bodies_without_redundancy_are_unchanged() {
+    let source = "(defun sub (a b) (- a b)) (sub 1 2)";
+    assert_eq!(compile(source, true).0["sub"], compile(source, false).0["sub"]);
+}
+
+#[test]
+fn test_loads_feeding_add_are_fused() {
+    let source = "(defun add (a b) (+ a b)) (add 1 2)";
+    assert_eq!(compile(source, true).0["add"], vec![Instruction::AddArgs(0, 1), Instruction::Ret]);
+    let source = r#"
+        (defun sum-to (n)
+          (let ((total 0) (i 0))
+            (do (dotimes (k n) (set! total (+ total k)))
+                total)))
+        (list (sum-to 10) (sum-to 0))
+    "#;
+    let (before, after) = counts(source, "sum-to");
+    assert!(after < before, "expected fewer instructions, {} -> {}", before, after);
+    assert_eq!(run(source, true), Ok(Value::List(List::from_vec(vec![Value::Integer(45), Value::Integer(0)]))));
+}
+
+#[test]
+fn test_fused_add_reports_type_errors() {
+    let source = "(defun add (a b) (+ a b)) (add 1 \"x\")";
+    assert_eq!(run(source, true), run(source, false));
+    assert!(run(source, true).is_err());
+}
+
+// ============================================================================
+// Jump targets survive relocation
+// ============================================================================
+
+#[test]
+fn test_forward_jumps_after_removed_code() {
+    let source = r#"
+        (defun describe (x)
+          (list (match x (0 'zero) (1 'one) (_ 'many))
+                (if (< x 1) 'small 'big)
+                (match x ((a . b) 'pair) (_ 'atom))))
+        (list (describe 0) (describe 1) (describe 7))
+    "#;
+    let (before, after) = counts(source, "describe");
+    assert!(after < before, "expected fewer instructions, {} -> {}", before, after);
+}
+
+#[test]
+fn test_backward_jumps_after_removed_code() {
+    let source = r#"
+        (defun sum-to (n)
+          (let ((total 0))
+            (do (dotimes (i n)
+                  (set! total (+ total (match i (0 0) (_ i)))))
+                total)))
+        (sum-to 10)
+    "#;
+    let (before, after) = counts(source, "sum-to");
+    assert!(after < before, "expected fewer instructions, {} -> {}", before, after);
+    let body = &compile(source, true).0["sum-to"];
+    assert!(body.iter().enumerate().any(|(i, instr)| matches!(instr, Instruction::Jmp(t) if *t < i)), "got: {:?}", body);
+    assert_eq!(run(source, true), Ok(Value::Integer(45)));
+}
+
+#[test]
+fn test_multi_clause_dispatch_and_handlers() {
+    let source = r#"
+        (defun area
+          (((circle r)) (* 3 (* r r)))
+          (((square s)) (* s s))
+          ((other) (match other (0 'nothing) (_ 'unknown))))
+        (defun safe-div (a b)
+          (handler-case (match b (0 (/ a b)) (_ (/ a b))) (catch (e) 'failed)))
+        (list (area (list 'circle 2)) (area (list 'square 3)) (area 0) (area 5) (safe-div 6 3) (safe-div 1 0))
+    "#;
+    counts(source, "area");
+    let (before, after) = counts(source, "safe-div");
+    assert!(after < before, "expected fewer instructions, {} -> {}", before, after);
+}
+
+// ============================================================================
+// Source locations
+// ============================================================================
+
+#[test]
+fn test_errors_are_still_located() {
+    let source = "(defun pick (x)\n  (match x\n    (0 'zero)\n    (_ (car x))))\n(pick 5)";
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    let err = vm.run().unwrap_err();
+    assert_eq!(err.location.map(|l| l.line), Some(4), "got: {}", err.message);
+}
@@ -13,7 +13,7 @@ fn run_code(source: &str) -> Result<Value, String> {
 
     let mut vm = VM::new();
     vm.functions.extend(functions);
-    vm.current_bytecode = main_bytecode;
+    vm.current_bytecode = main_bytecode.into();
 
     vm.run().map_err(|e| e.message.clone())?;
 
@@ -0,0 +1,88 @@
+use lisp_bytecode_vm::{Compiler, Instruction, VM, parser::Parser, prelude, List, Value};
+
+/// Run source after the prelude, the way lisp-vm runs a file
+fn run(source: &str) -> Result<Value, String> {
+    let mut compiler = Compiler::new();
+    let mut vm = VM::new();
+    prelude::load(&mut compiler, &mut vm)?;
+    let exprs = Parser::new_with_file(source, "main.lisp".to_string()).parse_all()?;
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+#[test]
+fn test_prelude_functions_are_available() {
+    assert_eq!(run("(list (cadr '(1 2 3)) (caddr '(1 2 3)) (caar '((4) 5)))").unwrap(), ints(&[2, 3, 4]));
+    assert_eq!(run("(list (cddr '(1 2 3)) (cdar '((1 2))))").unwrap(),
+        Value::List(List::from_vec(vec![ints(&[3]), ints(&[2])])));
+    assert_eq!(run("(list (not false) (not true))").unwrap(),
+        Value::List(List::from_vec(vec![Value::Boolean(true), Value::Boolean(false)])));
+    assert_eq!(run("(sum (map abs '(-1 2 -3)))").unwrap(), Value::Integer(6));
+    // sort-by goes through the VM's sort, so it is stable too
+    assert_eq!(run("(map cadr (sort-by car < '((2 a) (1 b) (2 c) (1 d))))").unwrap(),
+        Value::List(List::from_vec(["b", "d", "a", "c"].iter().map(Value::symbol).collect())));
+}
+
+#[test]
+fn test_prelude_functions_are_values() {
+    assert_eq!(run("(map cadr '((1 2) (3 4)))").unwrap(), ints(&[2, 4]));
+}
+
+#[test]
+fn test_programs_can_redefine_prelude_functions() {
+    assert_eq!(run("(defun cadr (lst) 'mine) (cadr '(1 2))").unwrap(), Value::symbol("mine"));
+}
+
+#[test]
+fn test_without_the_prelude_its_names_are_undefined() {
+    let exprs = Parser::new("(cadr '(1 2))").parse_all().unwrap();
+    let err = Compiler::new().compile_program(&exprs).unwrap_err();
+    assert!(err.message.contains("'cadr'"), "got: {}", err.message);
+}
+
+#[test]
+fn test_prelude_globals_are_set_before_the_program() {
+    // What prelude::run does with the prelude's top-level code, here with a define of its own
+    let mut compiler = Compiler::new();
+    let mut vm = VM::new();
+    prelude::load(&mut compiler, &mut vm).unwrap();
+    let exprs = Parser::new("(define answer 42)").parse_all().unwrap();
+    let (_, setup) = compiler.compile_program(&exprs).unwrap();
+    compiler.clear_main_bytecode();
+    prelude::run(&mut vm, setup).unwrap();
+
+    let exprs = Parser::new("(+ answer 1)").parse_all().unwrap();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().unwrap();
+    assert_eq!(vm.value_stack, vec![Value::Integer(43)]);
+}
+
+#[test]
+fn test_prelude_errors_name_the_prelude() {
+    let mut vm = VM::new();
+    let err = prelude::run(&mut vm, vec![Instruction::Push(Value::Integer(1)), Instruction::Car, Instruction::Halt]).unwrap_err();
+    assert!(err.starts_with("Error in the prelude"), "got: {}", err);
+    assert!(err.contains("Type error: 'car' expects a list, got integer"), "got: {}", err);
+    // The VM is left ready for the program
+    assert!(vm.value_stack.is_empty());
+    assert_eq!(vm.instruction_pointer, 0);
+}
+
+#[test]
+fn test_prelude_compiles_cleanly() {
+    let mut compiler = Compiler::new();
+    let (functions, main) = prelude::compile(&mut compiler).unwrap();
+    assert!(functions.contains_key("cadr"));
+    assert_eq!(main, vec![Instruction::Halt]);
+    assert_eq!(compiler.warnings(), &[]);
+}
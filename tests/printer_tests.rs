@@ -0,0 +1,105 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+use lisp_bytecode_vm::vm::printer::{self, PrintOptions};
+
+fn run(source: &str) -> Result<Value, String> {
+    let exprs = Parser::new(source).parse_all()?;
+    let (functions, main) = Compiler::new().compile_program(&exprs).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn write(value: &Value) -> String {
+    printer::print_value(value, &PrintOptions::write())
+}
+
+fn bounded(value: &Value) -> String {
+    printer::print_value(value, &PrintOptions::bounded())
+}
+
+fn ints(count: i64) -> Value {
+    Value::List(List::from_vec((0..count).map(Value::Integer).collect()))
+}
+
+const CIRCULAR: &str = "(define v (vector 1 2)) (vector-set! v 1 v)";
+
+#[test]
+fn test_a_vector_inside_itself_prints_finitely() {
+    let v = run(&format!("{} v", CIRCULAR)).unwrap();
+    assert_eq!(write(&v), "#0=#(1 #0#)");
+    assert_eq!(bounded(&v), "#0=#(1 #0#)");
+    // display and format strings, as print shows it
+    assert_eq!(run(&format!("{} (format \"{{}}\" (list (list 'v v)))", CIRCULAR)).unwrap(), Value::string("(v #0=#(1 #0#))"));
+    // Each cycle gets a label of its own, and a labelled vector met again
+    // outside itself is shown by its label too
+    let source = format!("{} (define w (vector 'a v 'b)) (vector-set! w 2 w) (list w w)", CIRCULAR);
+    assert_eq!(write(&run(&source).unwrap()), "(#0=#(a #1=#(1 #1#) #0#) #0#)");
+}
+
+#[test]
+fn test_shared_vectors_are_labelled_only_when_bounded() {
+    let both = run("(define w (vector 'a \"b\")) (list w w)").unwrap();
+    assert_eq!(write(&both), "(#(a \"b\") #(a \"b\"))");
+    assert_eq!(bounded(&both), "(#0=#(a \"b\") #0#)");
+    // A cycle through a map inside the vector
+    let source = "(define v (vector 0)) (vector-set! v 0 (hash-map 'self v)) v";
+    assert_eq!(write(&run(source).unwrap()), "#0=#({self #0#})");
+}
+
+#[test]
+fn test_long_lists_are_cut_to_the_element_limit() {
+    let source = "(defun build (n acc) (if (= n 0) acc (build (- n 1) (cons (- n 1) acc)))) (build 10000 '())";
+    let list = run(source).unwrap();
+    let text = bounded(&list);
+    assert_eq!(text, "(0 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 ...)");
+    // write still shows every element
+    let text = write(&list);
+    assert!(text.starts_with("(0 1 2 ") && text.ends_with(" 9998 9999)"), "{}", &text[text.len() - 20..]);
+    assert_eq!(text.split(' ').count(), 10000);
+    // Exactly at the limit nothing is elided
+    assert_eq!(bounded(&ints(20)), write(&ints(20)));
+}
+
+#[test]
+fn test_deep_structure_is_cut_to_the_depth_limit() {
+    let nested = run("'(1 (2 (3 (4 (5 (6 (7 (8 (9 (10))))))))))").unwrap();
+    assert_eq!(bounded(&nested), "(1 (2 (3 (4 (5 (6 (7 (8 ...))))))))");
+    let options = PrintOptions::bounded().with_limits(Some(2), Some(3));
+    let value = run("(list '(a (b)) (vector 1 2 3 4) (hash-map 'x '(1)) '())").unwrap();
+    assert_eq!(printer::print_value(&value, &options), "((a ...) #(1 2 3 ...) {x ...} ...)");
+    assert_eq!(printer::print_value(&nested, &options.with_limits(Some(0), None)), "...");
+}
+
+#[test]
+fn test_error_messages_show_values_bounded() {
+    let source = "(defun build () (let ((v (make-vector 30 0))) (vector->list v)))
+                  (match (build) ((a b) 'pair))";
+    assert_eq!(run(source).unwrap_err(),
+        "No matching pattern in match for value (0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 ...)");
+    assert_eq!(run(&format!("{} (match v (1 'one))", CIRCULAR)).unwrap_err(), "No matching pattern in match for value #0=#(1 #0#)");
+    let source = "(assert-equal 'deep '(1 (2 (3 (4 (5 (6 (7 (8 (9))))))))))";
+    assert!(run(source).unwrap_err().ends_with("expected deep, got (1 (2 (3 (4 (5 (6 (7 (8 ...))))))))"));
+}
+
+#[test]
+fn test_pp_breaks_long_lists_over_lines() {
+    let value = run("'(define (area r) (let ((pi 3.14159) (r2 (* r r))) (* pi r2)) ((nested list) (of lists)))").unwrap();
+    assert_eq!(printer::pretty_print(&value, &PrintOptions::bounded(), 40), "\
+(define (area r)
+        (let ((pi 3.14159) (r2 (* r r)))
+             (* pi r2))
+        ((nested list) (of lists)))");
+    // What fits stays on one line
+    assert_eq!(printer::pretty_print(&ints(5), &PrintOptions::bounded(), 40), "(0 1 2 3 4)");
+}
+
+#[test]
+fn test_pp_returns_its_value_and_checks_its_limits() {
+    assert_eq!(run("(pp '(0 1 2))").unwrap(), ints(3));
+    assert_eq!(run("(map pp '(7))").unwrap(), Value::List(List::from_vec(vec![Value::Integer(7)])));
+    assert_eq!(run("(pp 1 -1 5)").unwrap_err(), "'pp' expects a non-negative integer depth, got -1");
+    assert_eq!(run("(pp 1 2 'all)").unwrap_err(), "'pp' expects a non-negative integer length, got all");
+    assert_eq!(run("(pp 1 2)").unwrap_err(), "pp expects 1 or 3 arguments: the value, then optionally a max depth and a max length");
+}
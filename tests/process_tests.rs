@@ -0,0 +1,134 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+use std::fs;
+use std::process::Command;
+
+fn vm_for(source: &str, args: &[&str]) -> VM {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.args = args.iter().map(|arg| arg.to_string()).collect();
+    vm
+}
+
+fn run(source: &str) -> Result<Value, String> {
+    let mut vm = vm_for(source, &[]);
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+/// Run a program that should call exit, returning its exit code
+fn exit_code(source: &str) -> Option<i32> {
+    let mut vm = vm_for(source, &[]);
+    vm.run().map_err(|e| e.message).unwrap();
+    vm.exit_code
+}
+
+fn strings(values: &[&str]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|s| Value::string(*s)).collect()))
+}
+
+// ============================================================================
+// command-line-args and getenv
+// ============================================================================
+
+#[test]
+fn test_command_line_args() {
+    let mut vm = vm_for("(list (command-line-args) (get-args) (map string-length (command-line-args)))", &["10", "--fast"]);
+    vm.run().unwrap();
+    let lengths = Value::List(List::from_vec(vec![Value::Integer(2), Value::Integer(6)]));
+    assert_eq!(vm.value_stack.last(), Some(&Value::List(List::from_vec(vec![
+        strings(&["10", "--fast"]), strings(&["10", "--fast"]), lengths,
+    ]))));
+    assert_eq!(run("(command-line-args)").unwrap(), Value::List(List::Nil));
+}
+
+#[test]
+fn test_getenv() {
+    std::env::set_var("LISP_VM_PROCESS_TESTS", "forty two");
+    assert_eq!(run("(getenv \"LISP_VM_PROCESS_TESTS\")").unwrap(), Value::string("forty two"));
+    assert_eq!(run("(getenv \"LISP_VM_PROCESS_TESTS_UNSET\")").unwrap(), Value::List(List::Nil));
+    assert_eq!(run("(getenv 'home)").unwrap_err(), "Type error: 'getenv' expects a string, got symbol");
+}
+
+// ============================================================================
+// exit
+// ============================================================================
+
+#[test]
+fn test_exit_stops_the_program() {
+    let mut vm = vm_for("(defun f (x) (+ x (exit 3))) (f 1) (car 5)", &[]);
+    vm.run().unwrap();
+    assert_eq!(vm.exit_code, Some(3));
+    assert!(vm.halted);
+    // Nothing is left half-done
+    assert!(vm.value_stack.is_empty());
+    assert!(vm.call_stack.is_empty());
+    assert!(vm.handlers.is_empty());
+    assert_eq!(run("(+ 1 2)").map(|_| ()), Ok(()));
+}
+
+#[test]
+fn test_exit_unwinds_past_handlers_and_nested_runs() {
+    // From deep inside functions, through a handler-case that doesn't catch it
+    let source = r#"
+        (defun countdown (n) (if (= n 0) (exit 7) (+ 1 (countdown (- n 1)))))
+        (handler-case (countdown 20) (catch (e) (exit 1)))
+    "#;
+    assert_eq!(exit_code(source), Some(7));
+    // From code eval runs
+    assert_eq!(exit_code("(+ 1 (eval \"(exit 4)\"))"), Some(4));
+    assert_eq!(exit_code("(map (lambda (x) (if (= x 2) (exit 0) x)) '(1 2 3)) (exit 9)"), Some(0));
+}
+
+#[test]
+fn test_exit_codes_must_fit_a_process_status() {
+    assert_eq!(run("(exit 256)").unwrap_err(), "'exit' expects an exit code from 0 to 255, got 256");
+    assert_eq!(run("(exit \"0\")").unwrap_err(), "'exit' expects an exit code from 0 to 255, got \"0\"");
+    // A bad exit code is an ordinary error, so it can be caught
+    assert_eq!(run("(handler-case (exit -1) (catch (e) 'caught))").unwrap(), Value::symbol("caught"));
+}
+
+// ============================================================================
+// The lisp-vm binary
+// ============================================================================
+
+#[test]
+fn test_script_sees_its_args_and_sets_the_exit_status() {
+    let dir = std::env::temp_dir().join(format!("lisp-process-tests-{}", std::process::id()));
+    let _ = fs::remove_dir_all(&dir);
+    fs::create_dir_all(&dir).unwrap();
+    let script = dir.join("echo.lisp");
+    let output_file = dir.join("out.txt");
+    let source = format!(r#"
+        (define out (open-output-file {:?}))
+        (print "written before exit" out)
+        (print (string-join (command-line-args) ","))
+        (exit (string->number (car (command-line-args))))
+        (print "not reached")
+    "#, output_file.to_string_lossy());
+    fs::write(&script, source).unwrap();
+
+    // After --, even what looks like a lisp-vm option is the script's
+    let output = Command::new(env!("CARGO_BIN_EXE_lisp-vm"))
+        .arg(&script)
+        .args(["--", "42", "--disasm", "x y"])
+        .output()
+        .unwrap();
+    assert_eq!(String::from_utf8_lossy(&output.stdout), "42,--disasm,x y\n");
+    assert_eq!(output.status.code(), Some(42));
+    // The port the program left open was flushed on the way out
+    assert_eq!(fs::read_to_string(&output_file).unwrap(), "written before exit\n");
+
+    // The options can also come first, with -- before the script
+    let output = Command::new(env!("CARGO_BIN_EXE_lisp-vm"))
+        .args(["--no-prelude", "--"])
+        .arg(&script)
+        .arg("5")
+        .output()
+        .unwrap();
+    assert_eq!(String::from_utf8_lossy(&output.stdout), "5\n");
+    assert_eq!(output.status.code(), Some(5));
+    let _ = fs::remove_dir_all(&dir);
+}
@@ -0,0 +1,111 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Value};
+use lisp_bytecode_vm::vm::profiler::{Profiler, MAIN};
+
+fn profile(source: &str) -> (VM, Profiler) {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.profiler = Some(Profiler::new());
+    vm.run().unwrap();
+    let profiler = vm.profiler.take().expect("the profiler is reattached after the run");
+    (vm, profiler)
+}
+
+fn calls(profiler: &Profiler, function: &str) -> u64 {
+    profiler.function(function).map_or(0, |profile| profile.calls)
+}
+
+#[test]
+fn test_call_counts_are_exact() {
+    let source = r#"
+        (defun square (x) (* x x))
+        (defun sum-squares (n acc)
+          (if (= n 0) acc (sum-squares (- n 1) (+ acc (square n)))))
+        (sum-squares 250 0)
+    "#;
+    let (vm, profiler) = profile(source);
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(5239625)));
+    assert_eq!(calls(&profiler, "square"), 250);
+    // The first call and 250 tail calls, each counted as a call of sum-squares
+    assert_eq!(calls(&profiler, "sum-squares"), 251);
+    assert_eq!(calls(&profiler, MAIN), 1);
+}
+
+#[test]
+fn test_tail_calls_are_attributed_to_the_callee() {
+    let source = r#"
+        (defun ping (n) (if (= n 0) 'done (pong (- n 1))))
+        (defun pong (n) (ping n))
+        (ping 10)
+    "#;
+    let (_, profiler) = profile(source);
+    assert_eq!(calls(&profiler, "ping"), 11);
+    assert_eq!(calls(&profiler, "pong"), 10);
+    // pong's only instructions are loading its argument and the tail call
+    assert_eq!(profiler.function("pong").unwrap().exclusive_instructions, 20);
+}
+
+#[test]
+fn test_instruction_counts_add_up() {
+    let source = "(defun inc (x) (+ x 1)) (defun twice (x) (list (inc x) (inc x))) (list (twice 1) (twice 2))";
+    let (_, profiler) = profile(source);
+    let total = profiler.total_instructions();
+    let exclusive: u64 = profiler.functions().iter().map(|(_, profile)| profile.exclusive_instructions).sum();
+    assert_eq!(exclusive, total);
+    assert_eq!(profiler.function(MAIN).unwrap().inclusive_instructions, total);
+    let opcodes: u64 = profiler.opcodes().iter().map(|(_, count)| count).sum();
+    assert_eq!(opcodes, total);
+
+    // A caller's inclusive count covers its callees
+    let twice = profiler.function("twice").unwrap();
+    let inc = profiler.function("inc").unwrap();
+    assert_eq!(twice.inclusive_instructions, twice.exclusive_instructions + inc.inclusive_instructions);
+    assert!(profiler.opcodes().contains(&("Add", 4)), "got: {:?}", profiler.opcodes());
+}
+
+#[test]
+fn test_recursion_counts_inclusive_once() {
+    let source = "(defun fact (n) (if (= n 0) 1 (* n (fact (- n 1))))) (fact 10)";
+    let (_, profiler) = profile(source);
+    let fact = profiler.function("fact").unwrap();
+    assert_eq!(fact.calls, 11);
+    assert_eq!(fact.inclusive_instructions, fact.exclusive_instructions);
+    assert!(fact.inclusive_time >= fact.exclusive_time);
+}
+
+#[test]
+fn test_report_and_json() {
+    let (_, profiler) = profile("(defun f (x) x) (f 1) (f 2)");
+    let report = profiler.report();
+    assert!(report.contains("calls"), "got: {}", report);
+    assert!(report.lines().any(|line| line.starts_with("f ") && line.split_whitespace().nth(1) == Some("2")), "got: {}", report);
+
+    let json = profiler.to_json();
+    assert!(json.contains("\"name\": \"f\", \"calls\": 2,"), "got: {}", json);
+    assert!(json.contains(&format!("\"total_instructions\": {},", profiler.total_instructions())), "got: {}", json);
+    assert!(json.contains("{\"opcode\": \"Call\", \"count\": 2}"), "got: {}", json);
+}
+
+#[test]
+fn test_hottest_function_comes_first() {
+    let source = r#"
+        (defun cold (x) x)
+        (defun hot (n) (if (= n 0) 0 (hot (- n 1))))
+        (cold 1)
+        (hot 50)
+    "#;
+    let (_, profiler) = profile(source);
+    let functions = profiler.functions();
+    assert_eq!(functions[0].0, "hot");
+    assert!(functions.windows(2).all(|pair| pair[0].1.exclusive_instructions >= pair[1].1.exclusive_instructions));
+
+    // The report's table is in the same order
+    let report = profiler.report();
+    let rows: Vec<&str> = report.lines().skip(3).take(functions.len())
+        .map(|line| line.split_whitespace().next().unwrap())
+        .collect();
+    assert_eq!(rows, functions.iter().map(|(name, _)| *name).collect::<Vec<_>>());
+}
@@ -0,0 +1,123 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, prelude, List, Value};
+
+/// Run source after the prelude, which has the stream helpers
+fn run(source: &str) -> Result<Value, String> {
+    let mut compiler = Compiler::new();
+    let mut vm = VM::new();
+    prelude::load(&mut compiler, &mut vm)?;
+    let exprs = Parser::new_with_file(source, "promises.lisp".to_string()).parse_all()?;
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+// ============================================================================
+// delay and force
+// ============================================================================
+
+#[test]
+fn test_force_evaluates_the_expression_once() {
+    let source = r#"
+        (define count 0)
+        (define p (delay (do (set! count (+ count 1)) (* 6 7))))
+        (list count (force p) (force p) count)
+    "#;
+    assert_eq!(run(source).unwrap(), ints(&[0, 42, 42, 1]));
+}
+
+#[test]
+fn test_force_returns_the_same_value_every_time() {
+    assert_eq!(run("(define p (delay (list 1 2))) (eq? (force p) (force p))").unwrap(), Value::Boolean(true));
+}
+
+#[test]
+fn test_delay_captures_its_environment() {
+    // n is set! inside the delayed expression, so the promise shares its binding
+    let source = "(let ((n 0)) (let ((p (delay (do (set! n (+ n 1)) n)))) (list (force p) (force p) n)))";
+    assert_eq!(run(source).unwrap(), ints(&[1, 1, 1]));
+    assert_eq!(run("(defun later (x) (delay (* x 10))) (force (later 4))").unwrap(), Value::Integer(40));
+}
+
+#[test]
+fn test_force_of_a_non_promise_returns_it() {
+    assert_eq!(run("(force 5)").unwrap(), Value::Integer(5));
+    assert_eq!(run("(map force (list 1 (delay 2) 3))").unwrap(), ints(&[1, 2, 3]));
+}
+
+#[test]
+fn test_promise_predicate() {
+    assert_eq!(run("(list (promise? (delay 1)) (promise? 1) (promise? (lambda () 1)))").unwrap(),
+        Value::List(List::from_vec(vec![Value::Boolean(true), Value::Boolean(false), Value::Boolean(false)])));
+    assert_eq!(run("(type-of (delay 1))").unwrap(), Value::symbol("promise"));
+}
+
+#[test]
+fn test_delay_checks_its_arguments() {
+    assert_eq!(run("(delay)").unwrap_err(), "delay expects exactly 1 expression: (delay expr)");
+    assert_eq!(run("(cons-stream 1)").unwrap_err(), "cons-stream expects exactly 2 arguments: (cons-stream first rest)");
+}
+
+// ============================================================================
+// Errors while forcing
+// ============================================================================
+
+#[test]
+fn test_reentrant_force_is_an_error() {
+    let err = run("(define p (delay (+ 1 (force p)))) (force p)").unwrap_err();
+    assert!(err.starts_with("Re-entrant force"), "got: {}", err);
+    let source = "(define p (delay (force p))) (handler-case (force p) (catch (e) 'caught))";
+    assert_eq!(run(source).unwrap(), Value::symbol("caught"));
+}
+
+#[test]
+fn test_a_failed_force_can_be_retried() {
+    let source = r#"
+        (define tries 0)
+        (define p (delay (do (set! tries (+ tries 1)) (if (= tries 1) (raise 'flaky) tries))))
+        (list (handler-case (force p) (catch (e) e)) (force p) (force p))
+    "#;
+    assert_eq!(run(source).unwrap(),
+        Value::List(List::from_vec(vec![Value::symbol("flaky"), Value::Integer(2), Value::Integer(2)])));
+}
+
+// ============================================================================
+// Streams
+// ============================================================================
+
+#[test]
+fn test_infinite_streams() {
+    let source = r#"
+        (defun integers-from (n) (cons-stream n (integers-from (+ n 1))))
+        (defun stream-map (f s) (cons-stream (f (stream-car s)) (stream-map f (stream-cdr s))))
+        (define squares (stream-map (lambda (x) (* x x)) (integers-from 1)))
+        (list (stream-take 5 squares) (stream-ref (integers-from 0) 10000))
+    "#;
+    assert_eq!(run(source).unwrap(), Value::List(List::from_vec(vec![ints(&[1, 4, 9, 16, 25]), Value::Integer(10000)])));
+}
+
+#[test]
+fn test_stream_cdr_is_memoized() {
+    let source = r#"
+        (define built 0)
+        (defun count-from (n) (do (set! built (+ built 1)) (cons-stream n (count-from (+ n 1)))))
+        (define s (count-from 0))
+        (stream-take 3 s)
+        (stream-take 3 s)
+        built
+    "#;
+    // stream-take evaluates its stream argument, so taking 3 builds a fourth cell
+    assert_eq!(run(source).unwrap(), Value::Integer(4));
+}
+
+#[test]
+fn test_finite_streams_end_with_the_empty_list() {
+    let source = "(define s (cons-stream 1 (cons-stream 2 '()))) (list (stream-take 10 s) (stream-null? (stream-cdr (stream-cdr s))))";
+    assert_eq!(run(source).unwrap(), Value::List(List::from_vec(vec![ints(&[1, 2]), Value::Boolean(true)])));
+}
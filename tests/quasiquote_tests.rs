@@ -0,0 +1,92 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Value};
+
+/// Helper function to compile and run source code, printing the result
+fn run(source: &str) -> Result<String, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    vm.value_stack.last().map(format_value).ok_or_else(|| "No value on stack".to_string())
+}
+
+fn format_value(value: &Value) -> String {
+    match value {
+        Value::Integer(n) => n.to_string(),
+        Value::Symbol(s) => s.to_string(),
+        Value::List(items) => {
+            let formatted_items: Vec<String> = items.iter().map(format_value).collect();
+            format!("({})", formatted_items.join(" "))
+        }
+        other => format!("{:?}", other),
+    }
+}
+
+#[test]
+fn test_unquote_and_splice() {
+    let result = run("(let ((b 2) (c '(3 4))) `(1 ,b ,@c 5))").unwrap();
+    assert_eq!(result, "(1 2 3 4 5)");
+}
+
+#[test]
+fn test_splice_at_end_of_list() {
+    let result = run("(let ((c '(3 4))) `(1 2 ,@c))").unwrap();
+    assert_eq!(result, "(1 2 3 4)");
+}
+
+#[test]
+fn test_splice_empty_list() {
+    let result = run("`(1 ,@'() 2)").unwrap();
+    assert_eq!(result, "(1 2)");
+}
+
+#[test]
+fn test_splice_in_nested_list() {
+    let result = run("(let ((xs '(2 3))) `(a (b ,@xs) c))").unwrap();
+    assert_eq!(result, "(a (b 2 3) c)");
+}
+
+#[test]
+fn test_quasiquote_without_unquote_is_quote() {
+    let result = run("`(a (b c) 1)").unwrap();
+    assert_eq!(result, "(a (b c) 1)");
+}
+
+#[test]
+fn test_unquote_whole_template() {
+    let result = run("`,(+ 1 2)").unwrap();
+    assert_eq!(result, "3");
+}
+
+#[test]
+fn test_nested_quasiquote_keeps_inner_unquote() {
+    // The inner unquote belongs to the inner quasiquote, so it stays as data
+    let result = run("(let ((b 2)) `(1 `(2 ,b)))").unwrap();
+    assert_eq!(result, "(1 (quasiquote (2 (unquote b))))");
+}
+
+#[test]
+fn test_nested_quasiquote_evaluates_double_unquote() {
+    let result = run("(let ((b 2)) `(1 `(2 ,(3 ,b))))").unwrap();
+    assert_eq!(result, "(1 (quasiquote (2 (unquote (3 2)))))");
+
+    let result = run("(let ((b 2)) `(1 `(2 ,,b)))").unwrap();
+    assert_eq!(result, "(1 (quasiquote (2 (unquote 2))))");
+}
+
+#[test]
+fn test_nested_quasiquote_splices_only_at_its_level() {
+    let result = run("(let ((c '(3 4))) `(1 `(2 ,@c ,,@c)))").unwrap();
+    assert_eq!(result, "(1 (quasiquote (2 (unquote-splicing c) (unquote 3 4))))");
+}
+
+#[test]
+fn test_splice_outside_list_is_error() {
+    let err = run("(let ((c '(1))) `,@c)").unwrap_err();
+    assert!(err.contains("only allowed inside a list"), "got: {}", err);
+}
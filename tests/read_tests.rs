@@ -0,0 +1,103 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+use std::io::Cursor;
+
+fn vm_for(source: &str) -> VM {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm
+}
+
+fn run(source: &str) -> Result<Value, String> {
+    let mut vm = vm_for(source);
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+/// Run with `input` standing in for stdin
+fn run_with_input(source: &str, input: &str) -> Result<Value, String> {
+    let mut vm = vm_for(source);
+    vm.line_input = Some(Box::new(Cursor::new(input.to_string().into_bytes())));
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn list(values: Vec<Value>) -> Value {
+    Value::List(List::from_vec(values))
+}
+
+// ============================================================================
+// read-from-string
+// ============================================================================
+
+#[test]
+fn test_read_from_string_gives_data_as_quote_does() {
+    let source = r#"(read-from-string "(define (sq x) (* x x)) ignored")"#;
+    assert_eq!(run(source).unwrap(), run("'(define (sq x) (* x x))").unwrap());
+    let source = r#"(read-from-string "  ; a comment first\n (\"text\" #\\a 2.5 -7 :key #t (a . (b)) 'q)")"#;
+    assert_eq!(run(source).unwrap(), run(r#"'("text" #\a 2.5 -7 :key #t (a b) (quote q))"#).unwrap());
+    assert_eq!(run(r#"(symbol? (read-from-string "sym"))"#).unwrap(), Value::Boolean(true));
+}
+
+#[test]
+fn test_read_from_string_reads_what_write_wrote() {
+    let source = r#"(read-from-string (string-append "(" (string-append "\"say \\\"hi\\\"\\n\"" " #\\space)")))"#;
+    assert_eq!(run(source).unwrap(), list(vec![Value::string("say \"hi\"\n"), Value::Char(' ')]));
+}
+
+#[test]
+fn test_bad_input_is_a_catchable_error_with_its_position() {
+    let message = |text: &str| run(&format!("(read-from-string {:?})", text)).unwrap_err();
+    assert_eq!(message("(1 (2 3)"), r#"'read-from-string' failed to parse "(1 (2 3)": Unclosed list starting at line 1, column 1 - missing closing parenthesis"#);
+    assert_eq!(message("\n  )"), r#"'read-from-string' failed to parse "\n  )": Unexpected closing parenthesis at line 2, column 3"#);
+    assert_eq!(message("\"abc"), r#"'read-from-string' failed to parse "\"abc": Unclosed string starting at line 1, column 1 - missing closing quote"#);
+    assert_eq!(message("'"), r#"'read-from-string' failed to parse "'": Unexpected end of input after ''' at line 1, column 1"#);
+    assert_eq!(message("(a . 5)"), "'read-from-string' can't read (a . 5): Rest of dotted list must be a list");
+    assert_eq!(message(" ; nothing"), r#"'read-from-string' found no datum in " ; nothing""#);
+    assert_eq!(run("(read-from-string 5)").unwrap_err(), "Type error: 'read-from-string' expects a string, got integer");
+
+    let source = r#"(handler-case (read-from-string "(oops") (catch (e) (list 'caught (string? (hash-ref e 'message)))))"#;
+    assert_eq!(run(source).unwrap(), list(vec![Value::symbol("caught"), Value::Boolean(true)]));
+}
+
+// ============================================================================
+// read
+// ============================================================================
+
+#[test]
+fn test_read_takes_one_datum_at_a_time() {
+    let source = "(list (read) (read) (read) (read))";
+    let input = "(1 2\n   3) foo \"bar\"\n; a comment\n#| and a block |# baz\n";
+    assert_eq!(run_with_input(source, input).unwrap(), list(vec![
+        list(vec![Value::Integer(1), Value::Integer(2), Value::Integer(3)]),
+        Value::symbol("foo"),
+        Value::string("bar"),
+        Value::symbol("baz"),
+    ]));
+}
+
+#[test]
+fn test_read_is_nil_at_end_of_input() {
+    assert_eq!(run_with_input("(list (read) (read))", "last").unwrap(), list(vec![Value::symbol("last"), Value::List(List::Nil)]));
+    assert_eq!(run_with_input("(read)", "  ; only a comment\n").unwrap(), Value::List(List::Nil));
+}
+
+#[test]
+fn test_read_line_continues_after_the_last_datum_read() {
+    let source = "(list (read) (read-line) (read-line) (read))";
+    assert_eq!(run_with_input(source, "42 and the rest\nnext line\n(x)\n").unwrap(), list(vec![
+        Value::Integer(42), Value::string(" and the rest"), Value::string("next line"), list(vec![Value::symbol("x")]),
+    ]));
+}
+
+#[test]
+fn test_read_of_partial_or_invalid_input_is_a_catchable_error() {
+    assert_eq!(run_with_input("(read)", "(1 2\n3").unwrap_err(),
+        "'read' failed to parse input: Unclosed list starting at line 1, column 1 - missing closing parenthesis");
+    assert_eq!(run_with_input("(read)", ") 1").unwrap_err(), "'read' failed to parse input: Unexpected closing parenthesis at line 1, column 1");
+    // The bad input is dropped, so reading goes on after it
+    let source = "(list (handler-case (read) (catch (e) 'bad)) (read))";
+    assert_eq!(run_with_input(source, "#bogus\n7\n").unwrap(), list(vec![Value::symbol("bad"), Value::Integer(7)]));
+}
@@ -12,7 +12,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
     for (name, bytecode) in functions {
         vm.functions.insert(name, bytecode);
     }
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().map_err(|e| format!("Runtime error: {:?}", e))?;
 
     // Get the top value from the stack and format it
@@ -25,6 +25,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
 fn format_value(value: &Value) -> String {
     match value {
         Value::Integer(n) => n.to_string(),
+        Value::BigInt(n) => n.to_string(),
         Value::Float(f) => {
             if f.fract() == 0.0 && !f.is_nan() && !f.is_infinite() {
                 format!("{:.1}", f)
@@ -33,6 +34,7 @@ fn format_value(value: &Value) -> String {
             }
         }
         Value::Boolean(b) => b.to_string(),
+        Value::Char(c) => format!("#\\{}", c),
         Value::List(items) => {
             let formatted_items: Vec<String> = items.iter().map(|v| format_value(v)).collect();
             format!("({})", formatted_items.join(" "))
@@ -42,20 +44,29 @@ fn format_value(value: &Value) -> String {
         Value::Function(name) => format!("<function {}>", name),
         Value::Closure(closure_data) => format!("<closure/{}>", closure_data.params.len()),
         Value::HashMap(map) => {
-            let mut items: Vec<String> = map.iter()
+            let mut items: Vec<String> = map.borrow().iter()
                 .map(|(k, v)| format!("\"{}\" {}", k, format_value(v)))
                 .collect();
             items.sort(); // Sort for consistent output
             format!("{{{}}}", items.join(" "))
         }
         Value::Vector(items) => {
-            let formatted_items: Vec<String> = items.iter().map(|v| format_value(v)).collect();
+            let formatted_items: Vec<String> = items.borrow().iter().map(|v| format_value(v)).collect();
             format!("#({})", formatted_items.join(" "))
         }
         Value::TcpListener(_) => "#<tcp-listener>".to_string(),
         Value::TcpStream(_) => "#<tcp-stream>".to_string(),
         Value::SharedTcpListener(_) => "#<shared-tcp-listener>".to_string(),
+        Value::Struct(data) => {
+            let fields: Vec<String> = data.fields.iter().map(|v| format_value(v)).collect();
+            format!("#<{} {}>", data.name, fields.join(" "))
+        }
         Value::Pointer(p) => format!("#<pointer 0x{:x}>", p),
+        Value::Cell(_) => "#<cell>".to_string(),
+        Value::Port(_) => "#<port>".to_string(),
+        Value::Promise(_) => "#<promise>".to_string(),
+        Value::Task(_) => "#<task>".to_string(),
+        Value::Channel(_) => "#<channel>".to_string(),
     }
 }
 
@@ -103,3 +103,87 @@ fn test_clear_state_clears_input_buffer() {
 
     assert_eq!(repl.input_buffer.len(), 0);
 }
+
+#[test]
+fn test_is_complete_input_ignores_parens_in_comments() {
+    let mut repl = Repl::new();
+    repl.input_buffer = "(defun f (x) ; returns x (unchanged\n  x)".to_string();
+    assert!(repl.is_complete_input());
+
+    repl.input_buffer = "(list 1 #;(2) 3".to_string();
+    assert!(!repl.is_complete_input());
+}
+
+#[test]
+fn test_definitions_persist_between_inputs() {
+    let mut repl = Repl::new();
+    assert_eq!(repl.eval_input("(def base 10)"), Ok(None));
+    assert_eq!(repl.eval_input("(defun add-base (x) (+ x base))"), Ok(None));
+    assert_eq!(repl.eval_input("(add-base 5)"), Ok(Some(Value::Integer(15))));
+
+    // Macros from an earlier input still expand
+    repl.eval_input("(defmacro twice (e) `(+ ,e ,e))").unwrap();
+    assert_eq!(repl.eval_input("(twice 21)"), Ok(Some(Value::Integer(42))));
+}
+
+#[test]
+fn test_redefinition_is_seen_by_earlier_callers() {
+    let mut repl = Repl::new();
+    repl.eval_input("(defun greeting () 1)").unwrap();
+    repl.eval_input("(defun call-greeting () (greeting))").unwrap();
+    assert_eq!(repl.eval_input("(call-greeting)"), Ok(Some(Value::Integer(1))));
+
+    repl.eval_input("(defun greeting () 2)").unwrap();
+    assert_eq!(repl.eval_input("(call-greeting)"), Ok(Some(Value::Integer(2))));
+}
+
+#[test]
+fn test_errors_do_not_end_the_session() {
+    let mut repl = Repl::new();
+    let err = repl.eval_input("(defun f (x)\n  (if))").unwrap_err();
+    assert!(err.contains("Compile Error"), "got: {}", err);
+    assert!(err.contains("(if))"), "source line missing: {}", err);
+
+    let err = repl.eval_input("(/ 1 0)").unwrap_err();
+    assert!(err.contains("Runtime Error"), "got: {}", err);
+    assert!(err.contains("Division by zero"), "got: {}", err);
+
+    assert_eq!(repl.eval_input("(+ 1 2)"), Ok(Some(Value::Integer(3))));
+}
+
+#[test]
+fn test_load_file_keeps_definitions() {
+    let path = std::env::temp_dir().join(format!("repl-load-{}.lisp", std::process::id()));
+    std::fs::write(&path, "(defun loaded-square (x) (* x x))\n(def loaded-value 7)\n").unwrap();
+
+    let mut repl = Repl::new();
+    repl.load_file(path.to_str().unwrap()).unwrap();
+    std::fs::remove_file(&path).unwrap();
+    assert_eq!(repl.eval_input("(loaded-square loaded-value)"), Ok(Some(Value::Integer(49))));
+
+    let err = repl.load_file("no-such-file.lisp").unwrap_err();
+    assert!(err.contains("Cannot read 'no-such-file.lisp'"), "got: {}", err);
+}
+
+#[test]
+fn test_is_complete_input_ignores_parens_in_strings() {
+    let mut repl = Repl::new();
+    repl.input_buffer = "(print \"(\")".to_string();
+    assert!(repl.is_complete_input());
+
+    repl.input_buffer = "(print \")\"".to_string();
+    assert!(!repl.is_complete_input());
+}
+
+#[test]
+fn test_input_over_several_lines_is_evaluated_once_complete() {
+    let mut repl = Repl::new();
+    repl.input_buffer = "(defun dbl (n)\n".to_string();
+    assert!(!repl.is_complete_input());
+    repl.input_buffer.push_str("  (* n 2))\n");
+    assert!(repl.is_complete_input());
+
+    let input = repl.input_buffer.clone();
+    assert_eq!(repl.eval_input(&input), Ok(None));
+    assert_eq!(repl.eval_input("(dbl 21)"), Ok(Some(Value::Integer(42))));
+}
@@ -0,0 +1,119 @@
+use lisp_bytecode_vm::{Compiler, CompileError, VM, parser::Parser, Value};
+
+fn compile(source: &str) -> Result<(), CompileError> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    Compiler::new().compile_program(&exprs).map(|_| ())
+}
+
+fn run(source: &str) -> Result<Option<Value>, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).map_err(|e| e.message)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned())
+}
+
+#[test]
+fn test_undefined_function_is_a_compile_error() {
+    let err = compile("(defun f (x) (+ x 1))\n(print (g 2))").unwrap_err();
+    assert_eq!(err.message, "Undefined function 'g'");
+    assert_eq!((err.location.line, err.location.column), (2, 9));
+    assert!(err.suggestion.unwrap().contains("(defun g ...)"));
+}
+
+#[test]
+fn test_all_undefined_names_are_listed() {
+    let source = "(defun f (x)\n  (helper x))\n(print undefined-var)\n(f (other 1))\n(helper 2)";
+    let err = compile(source).unwrap_err();
+    assert_eq!(
+        err.message,
+        "3 undefined names: function 'helper' (2:4), variable 'undefined-var' (3:8), function 'other' (4:5)"
+    );
+    // The error points at the first of them
+    assert_eq!((err.location.line, err.location.column), (2, 4));
+}
+
+#[test]
+fn test_forward_references_are_not_flagged() {
+    // The function is defined after its first caller
+    let source = "(defun a (n) (b n)) (defun b (n) (* n 2)) (a 21)";
+    assert_eq!(run(source), Ok(Some(Value::Integer(42))));
+
+    // A global read inside a function that runs after the def
+    let source = "(defun get () limit) (def limit 11) (get)";
+    assert_eq!(run(source), Ok(Some(Value::Integer(11))));
+}
+
+#[test]
+fn test_builtins_resolve() {
+    assert_eq!(run("(car (cdr (cons 1 (list 2 3))))"), Ok(Some(Value::Integer(2))));
+}
+
+#[test]
+fn test_loaded_code_can_define_functions() {
+    // eval may define the function, so the call is left for runtime
+    assert!(compile("(eval \"(defun later (x) x)\") (later 1)").is_ok());
+    let err = run("(eval \"(undefined-fn 3)\")").unwrap_err();
+    assert!(err.contains("undefined-fn"), "got: {}", err);
+}
+
+#[test]
+fn test_check_can_be_disabled() {
+    let mut parser = Parser::new("(defined-elsewhere 1)");
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    compiler.set_check_unresolved(false);
+    assert!(compiler.compile_program(&exprs).is_ok());
+}
+
+#[test]
+fn test_too_many_arguments_is_a_compile_error() {
+    let err = compile("(defun loop-with-let (n) (let ((x n)) x))\n(loop-with-let 1 2 3)").unwrap_err();
+    assert_eq!(err.message, "'loop-with-let' expects 1 argument(s), got 3");
+    assert_eq!((err.location.line, err.location.column), (2, 1));
+    assert_eq!(err.suggestion.as_deref(), Some("It is defined as (defun loop-with-let (n) ...)"));
+}
+
+#[test]
+fn test_too_few_arguments_is_a_compile_error() {
+    let err = compile("(defun add (a b) (+ a b)) (defun f () (add 1))").unwrap_err();
+    assert_eq!(err.message, "'add' expects 2 argument(s), got 1");
+
+    // Recursive calls are checked against the function being defined
+    let err = compile("(defun count (n acc) (if (= n 0) acc (count (- n 1))))").unwrap_err();
+    assert_eq!(err.message, "'count' expects 2 argument(s), got 1");
+}
+
+#[test]
+fn test_rest_parameters_need_minimum_arity() {
+    assert!(compile("(defun tagged (tag . items) items) (tagged 'a) (tagged 'a 1 2 3)").is_ok());
+
+    let err = compile("(defun tagged (tag &rest items) items) (tagged)").unwrap_err();
+    assert_eq!(err.message, "'tagged' expects at least 1 argument(s), got 0");
+    assert_eq!(err.suggestion.as_deref(), Some("It is defined as (defun tagged (tag . items) ...)"));
+}
+
+#[test]
+fn test_forward_references_skip_arity_check() {
+    // The callee isn't compiled yet when the call is, so the call is left alone
+    assert!(compile("(defun early () (later 1 2)) (defun later (a b) (+ a b)) (early)").is_ok());
+
+    // A program's own defun replaces one compiled before it (as from the stdlib),
+    // so calls above it are meant for the new definition
+    let mut compiler = Compiler::new();
+    compiler.compile_program(&Parser::new("(defun pair (a) a)").parse_all().unwrap()).unwrap();
+    compiler.clear_main_bytecode();
+    let exprs = Parser::new("(defun use-pair () (pair 1 2)) (defun pair (a b) (+ a b))").parse_all().unwrap();
+    assert!(compiler.compile_program(&exprs).is_ok());
+}
+
+#[test]
+fn test_indirect_calls_skip_arity_check() {
+    assert!(compile("(defun one (x) x) (apply one '(1 2))").is_ok());
+    assert!(compile("(defun one (x) x) (let ((f one)) (f 1 2))").is_ok());
+}
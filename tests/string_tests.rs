@@ -0,0 +1,143 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Value};
+
+/// Helper function to compile and run source code
+fn compile_and_run(source: &str) -> Result<VM, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+/// Helper to get the top of the stack after running source
+fn eval(source: &str) -> Value {
+    let vm = compile_and_run(source).unwrap();
+    vm.value_stack.last().cloned().expect("empty stack")
+}
+
+fn string(s: &str) -> Value {
+    Value::string(s)
+}
+
+// ============================================================================
+// Literals and escape sequences
+// ============================================================================
+
+#[test]
+fn test_string_literal() {
+    assert_eq!(eval(r#""hello""#), string("hello"));
+}
+
+#[test]
+fn test_string_escape_sequences() {
+    assert_eq!(eval(r#""line1\nline2""#), string("line1\nline2"));
+    assert_eq!(eval(r#""a\tb""#), string("a\tb"));
+    assert_eq!(eval(r#""say \"hi\"""#), string("say \"hi\""));
+    assert_eq!(eval(r#""back\\slash""#), string("back\\slash"));
+}
+
+#[test]
+fn test_escaped_characters_count_once() {
+    assert_eq!(eval(r#"(string-length "a\nb\\")"#), Value::Integer(4));
+}
+
+// ============================================================================
+// Core operations
+// ============================================================================
+
+#[test]
+fn test_string_length_counts_characters() {
+    assert_eq!(eval(r#"(string-length "")"#), Value::Integer(0));
+    assert_eq!(eval(r#"(string-length "héllo")"#), Value::Integer(5));
+}
+
+#[test]
+fn test_string_append() {
+    assert_eq!(eval(r#"(string-append "a" "b")"#), string("ab"));
+    assert_eq!(eval(r#"(print (string-append "a" "b"))"#), string("ab"));
+}
+
+#[test]
+fn test_substring() {
+    assert_eq!(eval(r#"(substring "hello world" 6 11)"#), string("world"));
+    assert_eq!(eval(r#"(substring "hello" 2 2)"#), string(""));
+    assert_eq!(eval(r#"(substring "héllo" 1 3)"#), string("él"));
+}
+
+#[test]
+fn test_substring_out_of_range_reports_indices() {
+    let err = compile_and_run(r#"(substring "hello" 2 10)"#).err().expect("expected an error");
+    assert!(err.contains("start=2, end=10, string length=5"), "got: {}", err);
+
+    let err = compile_and_run(r#"(substring "hello" -1 3)"#).err().expect("expected an error");
+    assert!(err.contains("start=-1, end=3"), "got: {}", err);
+
+    let err = compile_and_run(r#"(substring "hello" 4 2)"#).err().expect("expected an error");
+    assert!(err.contains("start=4, end=2"), "got: {}", err);
+}
+
+#[test]
+fn test_substring_error_points_at_call() {
+    let mut parser = Parser::new("(def s \"hello\")\n(string-append s (substring s 3 9))");
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    let err = vm.run().err().expect("expected an error");
+    let location = err.location.expect("expected a source location");
+    assert_eq!((location.line, location.column), (2, 18));
+}
+
+#[test]
+fn test_symbol_string_round_trip() {
+    assert_eq!(eval(r#"(symbol->string (string->symbol "round-trip"))"#), string("round-trip"));
+    assert_eq!(eval(r#"(string->symbol "x")"#), eval("'x"));
+}
+
+#[test]
+fn test_string_list_round_trip() {
+    assert_eq!(eval(r#"(string->list "abc")"#), Value::list_from_vec(vec![Value::Char('a'), Value::Char('b'), Value::Char('c')]));
+    assert_eq!(eval(r#"(list->string (string->list "round trip"))"#), string("round trip"));
+}
+
+// ============================================================================
+// Equality
+// ============================================================================
+
+#[test]
+fn test_string_eq_compares_contents() {
+    assert_eq!(eval(r#"(string=? "abc" "abc")"#), Value::Boolean(true));
+    assert_eq!(eval(r#"(string=? "abc" "abd")"#), Value::Boolean(false));
+    assert_eq!(eval(r#"(string=? (string-append "ab" "c") "abc")"#), Value::Boolean(true));
+}
+
+#[test]
+fn test_string_eq_rejects_non_strings() {
+    let err = compile_and_run(r#"(string=? "1" 1)"#).err().expect("expected an error");
+    assert!(err.contains("'string=?' expects two strings, got string and integer"), "got: {}", err);
+}
+
+#[test]
+fn test_equality_operator_compares_string_contents() {
+    assert_eq!(eval(r#"(== (string-append "foo" "bar") "foobar")"#), Value::Boolean(true));
+    assert_eq!(eval(r#"(== (substring "foobar" 0 3) "bar")"#), Value::Boolean(false));
+}
+
+#[test]
+fn test_string_eq_as_first_class_function() {
+    let source = r#"
+        (defun all-same? (f a b) (f a b))
+        (all-same? string=? "x" "x")
+    "#;
+    assert_eq!(eval(source), Value::Boolean(true));
+}
@@ -0,0 +1,146 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+
+fn run(source: &str) -> Result<Option<Value>, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).map_err(|e| e.message)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned())
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+fn booleans(values: &[bool]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|b| Value::Boolean(*b)).collect()))
+}
+
+const SHAPES: &str = r#"
+    (defstruct point x y)
+    (defstruct size x y)
+    (defstruct rect corner extent)
+    (defstruct circle center r)
+"#;
+
+fn run_shapes(source: &str) -> Result<Option<Value>, String> {
+    run(&format!("{}\n{}", SHAPES, source))
+}
+
+#[test]
+fn test_constructor_and_accessors() {
+    let source = "(define p (make-point 3 4)) (list (point-x p) (point-y p))";
+    assert_eq!(run_shapes(source), Ok(Some(ints(&[3, 4]))));
+
+    // Fields hold any value, other structs included
+    let source = "(point-y (rect-extent (make-rect (make-point 0 0) (make-point 5 6))))";
+    assert_eq!(run_shapes(source), Ok(Some(Value::Integer(6))));
+}
+
+#[test]
+fn test_predicate_checks_the_type() {
+    let source = "(list (point? (make-point 1 2)) (point? (make-size 1 2)) (point? '(1 2)) (point? 7))";
+    assert_eq!(run_shapes(source), Ok(Some(booleans(&[true, false, false, false]))));
+}
+
+#[test]
+fn test_types_with_the_same_fields_differ() {
+    let source = r#"
+        (list (equal? (make-point 1 2) (make-point 1 2))
+              (equal? (make-point 1 2) (make-point 1 3))
+              (equal? (make-point 1 2) (make-size 1 2)))
+    "#;
+    assert_eq!(run_shapes(source), Ok(Some(booleans(&[true, false, false]))));
+}
+
+#[test]
+fn test_structs_print_with_their_type() {
+    let source = r#"(format "{} {}" (list (make-point 1 2) (make-rect (make-point 0 0) "big")))"#;
+    let expected = "#<point 1 2> #<rect #<point 0 0> big>";
+    assert_eq!(run_shapes(source), Ok(Some(Value::String(std::sync::Arc::new(expected.to_string())))));
+}
+
+#[test]
+fn test_accessor_on_the_wrong_type() {
+    let err = run_shapes("(point-x (make-size 1 2))").unwrap_err();
+    assert_eq!(err, "Type error: expected point struct, got size");
+
+    let err = run_shapes("(circle-r '(1 2))").unwrap_err();
+    assert_eq!(err, "Type error: expected circle struct, got list");
+}
+
+#[test]
+fn test_constructor_arity_is_checked() {
+    let err = run_shapes("(make-point 1)").unwrap_err();
+    assert!(err.contains("make-point"), "got: {}", err);
+}
+
+#[test]
+fn test_struct_patterns_in_defun_clauses() {
+    let source = r#"
+        (defun area
+          (((circle _ r)) (* 3 (* r r)))
+          (((rect (point 0 0) (size w h))) (* w h))
+          (((rect _ _)) 'offset)
+          ((_) 'unknown))
+        (list (area (make-circle (make-point 0 0) 2))
+              (area (make-rect (make-point 0 0) (make-size 3 4)))
+              (area (make-rect (make-point 1 0) (make-size 3 4)))
+              (area (make-point 3 4)))
+    "#;
+    let result = run_shapes(source).unwrap().unwrap();
+    let items = match result {
+        Value::List(list) => list.to_vec(),
+        other => panic!("Expected a list, got {:?}", other),
+    };
+    assert_eq!(items[0], Value::Integer(12));
+    assert_eq!(items[1], Value::Integer(12));
+    assert_eq!(items[2], Value::symbol("offset"));
+    assert_eq!(items[3], Value::symbol("unknown"));
+}
+
+#[test]
+fn test_struct_patterns_before_the_definition() {
+    // A defun above the defstruct still reads (pair a b) as a struct pattern
+    let source = r#"
+        (defun swap (((pair a b)) (make-pair b a)))
+        (defstruct pair first second)
+        (pair-first (swap (make-pair 1 2)))
+    "#;
+    assert_eq!(run(source), Ok(Some(Value::Integer(2))));
+}
+
+#[test]
+fn test_struct_patterns_mix_with_list_and_or_patterns() {
+    let source = r#"
+        (defun x-of
+          (((or (point x _) (size x _))) x)
+          ((((point x _) . _)) x)
+          ((_) false))
+        (list (x-of (make-point 1 2)) (x-of (make-size 3 4)) (x-of (list (make-point 5 6) 7)))
+    "#;
+    assert_eq!(run_shapes(source), Ok(Some(ints(&[1, 3, 5]))));
+}
+
+#[test]
+fn test_pattern_field_count_must_match() {
+    let err = run_shapes("(defun f (((point a b c)) a))").unwrap_err();
+    assert_eq!(err, "Pattern for struct 'point' has 3 fields, but the struct is defined with 2");
+
+    let err = run_shapes("(defun f (((circle r)) r))").unwrap_err();
+    assert_eq!(err, "Pattern for struct 'circle' has 1 field, but the struct is defined with 2");
+}
+
+#[test]
+fn test_malformed_defstruct() {
+    let err = run("(defstruct)").unwrap_err();
+    assert_eq!(err, "defstruct expects: (defstruct name field ...)");
+    let err = run("(defstruct point (x) y)").unwrap_err();
+    assert_eq!(err, "Fields of struct 'point' must be symbols");
+    let err = run("(defstruct point x x)").unwrap_err();
+    assert_eq!(err, "Struct 'point' declares field 'x' twice");
+}
@@ -0,0 +1,96 @@
+use lisp_bytecode_vm::{bytecode, Compiler, VM, parser::Parser, Instruction, Symbol, Value};
+
+fn compile(source: &str) -> (std::collections::HashMap<String, Vec<Instruction>>, Vec<Instruction>) {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    Compiler::new().compile_program(&exprs).unwrap()
+}
+
+fn run_compiled(functions: std::collections::HashMap<String, Vec<Instruction>>, main: Vec<Instruction>) -> Result<Option<Value>, String> {
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned())
+}
+
+fn run(source: &str) -> Result<Option<Value>, String> {
+    let (functions, main) = compile(source);
+    run_compiled(functions, main)
+}
+
+fn booleans(values: &[bool]) -> Value {
+    Value::List(lisp_bytecode_vm::List::from_vec(values.iter().map(|b| Value::Boolean(*b)).collect()))
+}
+
+#[test]
+fn test_each_name_has_one_id() {
+    let a = Symbol::intern("interned-once");
+    assert_eq!(a, Symbol::intern(&String::from("interned-once")));
+    assert_eq!(a.id(), Symbol::intern("interned-once").id());
+    assert_ne!(a, Symbol::intern("interned-twice"));
+    assert_eq!(a.name(), "interned-once");
+    assert_eq!(Value::symbol("interned-once"), Value::Symbol(a));
+}
+
+#[test]
+fn test_runtime_symbols_are_eq_to_literal_ones() {
+    let source = r#"
+        (list (eq? 'alpha (string->symbol "alpha"))
+              (eq? (string->symbol "beta") (string->symbol "beta"))
+              (eq? 'alpha 'beta)
+              (eq? 'alpha "alpha"))
+    "#;
+    assert_eq!(run(source), Ok(Some(booleans(&[true, true, false, false]))));
+}
+
+#[test]
+fn test_symbol_string_round_trip() {
+    let source = r#"(symbol->string (string->symbol (symbol->string 'round-trip)))"#;
+    assert_eq!(run(source), Ok(Some(Value::String(std::sync::Arc::new("round-trip".to_string())))));
+
+    let source = r#"(format "{} {}" (list 'printed (list (string->symbol "made-at-runtime") 'x)))"#;
+    assert_eq!(run(source), Ok(Some(Value::String(std::sync::Arc::new("printed (made-at-runtime x)".to_string())))));
+}
+
+#[test]
+fn test_eq_is_identity() {
+    let source = r#"
+        (define shared (list 1 2))
+        (list (eq? shared shared)
+              (eq? (list 1) (list 1))
+              (equal? (list 1) (list 1))
+              (eq? 3 3)
+              (eq? true true)
+              (eq? '() '()))
+    "#;
+    assert_eq!(run(source), Ok(Some(booleans(&[true, false, true, true, true, true]))));
+
+    // Also as a first-class function
+    assert_eq!(run("(apply eq? (list 'k (string->symbol \"k\")))"), Ok(Some(Value::Boolean(true))));
+}
+
+#[test]
+fn test_case_dispatches_on_runtime_symbols() {
+    let source = r#"
+        (defun handle (message) (case message ((open close) 'file) (send 'net) (else 'unknown)))
+        (list (handle (string->symbol "close")) (handle (string->symbol "send")) (handle (string->symbol "seen")))
+    "#;
+    let expected = vec![Value::symbol("file"), Value::symbol("net"), Value::symbol("unknown")];
+    assert_eq!(run(source), Ok(Some(Value::List(lisp_bytecode_vm::List::from_vec(expected)))));
+}
+
+#[test]
+fn test_symbol_keys_in_maps() {
+    let source = r#"(map-get (map-set! (make-map) 'color "red") (string->symbol "color"))"#;
+    assert_eq!(run(source), Ok(Some(Value::String(std::sync::Arc::new("red".to_string())))));
+}
+
+#[test]
+fn test_symbols_survive_bytecode_round_trip() {
+    // A loaded program refers to the same symbols by name, whatever ids they had
+    let (functions, main) = compile("(defun tag () 'loaded-symbol) (eq? (tag) (string->symbol \"loaded-symbol\"))");
+    let bytes = bytecode::serialize_bytecode(&functions, &main);
+    let (functions, main) = bytecode::deserialize_bytecode(&bytes).unwrap();
+    assert_eq!(run_compiled(functions, main), Ok(Some(Value::Boolean(true))));
+}
@@ -0,0 +1,131 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+
+fn run(source: &str) -> Result<Value, String> {
+    let exprs = Parser::new(source).parse_all()?;
+    let (functions, main) = Compiler::new().compile_program(&exprs).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn list(values: Vec<Value>) -> Value {
+    Value::List(List::from_vec(values))
+}
+
+fn symbols(names: &[&str]) -> Value {
+    list(names.iter().map(|name| Value::symbol(name)).collect())
+}
+
+#[test]
+fn test_two_tasks_ping_pong_a_counter() {
+    // Each side takes the counter, adds one and passes it back, 10,000 times;
+    // b keeps the last value rather than pass it on
+    let source = "
+        (define ping (make-channel))
+        (define pong (make-channel))
+        (defun player (in out rounds keep-last)
+          (loop ((i 1))
+            (let ((n (+ (chan-recv in) 1)))
+              (if (= i rounds)
+                  (do (if keep-last #f (chan-send out n)) n)
+                  (do (chan-send out n) (recur (+ i 1)))))))
+        (define a (spawn (lambda () (player ping pong 10000 #f))))
+        (define b (spawn (lambda () (player pong ping 10000 #t))))
+        (chan-send ping 0)
+        (list (task-result a) (task-result b))";
+    assert_eq!(run(source).unwrap(), list(vec![Value::Integer(19999), Value::Integer(20000)]));
+}
+
+#[test]
+fn test_tasks_take_turns_in_spawn_order() {
+    let source = "
+        (define log '())
+        (defun note (x) (set! log (cons x log)))
+        (defun worker (name)
+          (lambda () (note name) (yield) (note name) (yield) (note name)))
+        (define tasks (list (spawn (worker 'a)) (spawn (worker 'b)) (spawn (worker 'c))))
+        (map task-result tasks)
+        (reverse log)";
+    assert_eq!(run(source).unwrap(), symbols(&["a", "b", "c", "a", "b", "c", "a", "b", "c"]));
+    // yield with no other task goes straight on
+    assert_eq!(run("(yield)").unwrap(), Value::Boolean(true));
+}
+
+#[test]
+fn test_an_uncaught_error_ends_only_its_task() {
+    let source = "
+        (define ch (make-channel))
+        (define bad (spawn (lambda () (car 5))))
+        (define good (spawn (lambda () (chan-send ch 'still-here) 'finished)))
+        (define got (chan-recv ch))
+        (list got (task-result good) (hash-ref (task-result bad) 'message) (task-status bad) (task-status good))";
+    let result = run(source).unwrap();
+    let Value::List(items) = &result else { panic!("{:?}", result) };
+    let items = items.to_vec();
+    assert_eq!(items[0], Value::symbol("still-here"));
+    assert_eq!(items[1], Value::symbol("finished"));
+    assert!(matches!(&items[2], Value::String(message) if message.contains("car")), "{:?}", items[2]);
+    assert_eq!(items[3..], [Value::symbol("failed"), Value::symbol("done")]);
+    // A value raised in the task is its result as raised
+    assert_eq!(run("(task-result (spawn (lambda () (raise 'oops))))").unwrap(), Value::symbol("oops"));
+    // The same error in the main task still stops the program
+    assert!(run("(spawn (lambda () 1)) (car 5)").is_err());
+}
+
+#[test]
+fn test_channels_block_until_both_sides_meet() {
+    let source = "
+        (define ch (make-channel))
+        (define log '())
+        (defun note (x) (set! log (cons x log)))
+        (define status '())
+        (define sender (spawn (lambda () (note 'sending) (chan-send ch 42) (note 'sent))))
+        (do (yield)
+            (set! status (task-status sender))
+            (note (list 'received (chan-recv ch)))
+            (task-result sender))
+        (list status (reverse log))";
+    assert_eq!(run(source).unwrap(), list(vec![
+        Value::symbol("blocked"),
+        list(vec![Value::symbol("sending"), list(vec![Value::symbol("received"), Value::Integer(42)]), Value::symbol("sent")]),
+    ]));
+}
+
+#[test]
+fn test_sleeping_tasks_wake_in_time_order() {
+    let source = "
+        (define log '())
+        (defun note (x) (set! log (cons x log)))
+        (define slow (spawn (lambda () (sleep 30) (note 'slow))))
+        (define fast (spawn (lambda () (sleep 5) (note 'fast))))
+        (note 'main)
+        (task-result slow)
+        (task-status fast)
+        (reverse log)";
+    assert_eq!(run(source).unwrap(), symbols(&["main", "fast", "slow"]));
+    assert_eq!(run("(sleep -1)").unwrap_err(), "'sleep' expects a non-negative number of milliseconds, got -1");
+}
+
+#[test]
+fn test_waiting_with_no_task_to_wake_is_a_deadlock() {
+    let deadlock = "Deadlock: every task is waiting on a channel or another task";
+    assert_eq!(run("(chan-recv (make-channel))").unwrap_err(), deadlock);
+    let source = "
+        (define ch (make-channel))
+        (define t (spawn (lambda () (chan-recv ch))))
+        (task-result t)";
+    assert_eq!(run(source).unwrap_err(), deadlock);
+    // A handler in the main task can catch it
+    assert_eq!(run("(handler-case (chan-send (make-channel) 1) (catch (e) 'stuck))").unwrap(), Value::symbol("stuck"));
+}
+
+#[test]
+fn test_task_builtins_check_their_arguments() {
+    assert_eq!(run("(spawn 5)").unwrap_err(), "Type error: 'spawn' expects a function of no arguments, got integer");
+    assert_eq!(run("(chan-send 'ch 1)").unwrap_err(), "Type error: 'chan-send' expects a channel, got symbol");
+    assert_eq!(run("(task-result (make-channel))").unwrap_err(), "Type error: 'task-result' expects a task, got channel");
+    assert_eq!(run("(eval '(chan-recv (make-channel)))").unwrap_err(), "'chan-recv' can't wait inside load, require or eval");
+    assert_eq!(run("(list (type-of (spawn (lambda () 1))) (type-of (make-channel)))").unwrap(), symbols(&["task", "channel"]));
+}
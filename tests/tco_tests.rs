@@ -1,4 +1,4 @@
-use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction};
+use lisp_bytecode_vm::{Compiler, VM, disassembler, parser::Parser, Instruction};
 
 /// Helper function to compile source and run it
 fn compile_and_run(source: &str) -> VM {
@@ -9,16 +9,16 @@ fn compile_and_run(source: &str) -> VM {
     let (functions, main) = compiler.compile_program(&exprs).unwrap();
 
     let mut vm = VM::new();
-    vm.functions = functions;
-    vm.current_bytecode = main;
+    vm.functions = functions.into();
+    vm.current_bytecode = main.into();
     vm.run().unwrap();
     vm
 }
 
-/// Helper to check that a function uses TailCall instruction
+/// Helper to check that a function makes a named tail call, from its disassembly
 fn function_uses_tailcall(vm: &VM, function_name: &str) -> bool {
     if let Some(bytecode) = vm.functions.get(function_name) {
-        bytecode.iter().any(|instr| matches!(instr, Instruction::TailCall(_, _)))
+        disassembler::disassemble_function(function_name, bytecode).contains("TailCall(")
     } else {
         false
     }
@@ -275,3 +275,450 @@ fn test_multiple_tail_recursive_functions() {
         _ => panic!("Expected integer result"),
     }
 }
+
+/// Helper to run a program one instruction at a time, recording the deepest call stack
+fn run_tracking_max_depth(source: &str) -> (VM, usize) {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+
+    let mut max_depth = 0;
+    while !vm.halted {
+        vm.execute_one_instruction().unwrap();
+        max_depth = max_depth.max(vm.call_stack.len());
+    }
+    (vm, max_depth)
+}
+
+#[test]
+fn test_mutual_tail_recursion_one_million() {
+    let source = r#"
+        (defun even? (n)
+          (if (== n 0)
+            true
+            (odd? (- n 1))))
+
+        (defun odd? (n)
+          (if (== n 0)
+            false
+            (even? (- n 1))))
+
+        (even? 1000000)
+    "#;
+
+    let vm = compile_and_run(source);
+
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::Boolean(b)) => assert_eq!(*b, true),
+        _ => panic!("Expected boolean result"),
+    }
+}
+
+#[test]
+fn test_mutual_tail_recursion_reuses_frame_across_functions() {
+    let source = r#"
+        (defun ping (n)
+          (if (<= n 0)
+            'done
+            (pong (- n 1))))
+
+        (defun pong (n)
+          (if (<= n 0)
+            'done
+            (ping (- n 1))))
+
+        (ping 1000)
+    "#;
+
+    let (vm, max_depth) = run_tracking_max_depth(source);
+
+    // Top-level call pushes one frame; every ping <-> pong hop must reuse it
+    assert_eq!(max_depth, 1, "cross-function tail calls should not push frames");
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_three_way_mutual_tail_recursion() {
+    let source = r#"
+        (defun a (n) (if (<= n 0) 1 (b (- n 1))))
+        (defun b (n) (if (<= n 0) 2 (c (- n 1))))
+        (defun c (n) (if (<= n 0) 3 (a (- n 1))))
+        (list (a 300000) (a 300001) (a 300002))
+    "#;
+
+    let (vm, max_depth) = run_tracking_max_depth(source);
+    assert_eq!(max_depth, 1);
+
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![
+                lisp_bytecode_vm::Value::Integer(1),
+                lisp_bytecode_vm::Value::Integer(2),
+                lisp_bytecode_vm::Value::Integer(3),
+            ]);
+        }
+        _ => panic!("Expected list result"),
+    }
+}
+
+#[test]
+fn test_call_inside_comparison_is_not_tail_call() {
+    // The call to `inc` is an operand of `<`, so it must return to the caller
+    let source = r#"
+        (defun inc (n) (+ n 1))
+        (defun small? (n) (< (inc n) 10))
+        (defun same? (n) (== (inc n) n))
+        (list (small? 3) (small? 20) (same? 1))
+    "#;
+
+    let vm = compile_and_run(source);
+    assert!(!function_uses_tailcall(&vm, "small?"));
+    assert!(!function_uses_tailcall(&vm, "same?"));
+
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![
+                lisp_bytecode_vm::Value::Boolean(true),
+                lisp_bytecode_vm::Value::Boolean(false),
+                lisp_bytecode_vm::Value::Boolean(false),
+            ]);
+        }
+        _ => panic!("Expected list result"),
+    }
+}
+
+#[test]
+fn test_call_inside_list_constructor_is_not_tail_call() {
+    let source = r#"
+        (defun inc (n) (+ n 1))
+        (defun pair (n) (list (inc n) (inc (inc n))))
+        (pair 1)
+    "#;
+
+    let vm = compile_and_run(source);
+    assert!(!function_uses_tailcall(&vm, "pair"));
+
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![
+                lisp_bytecode_vm::Value::Integer(2),
+                lisp_bytecode_vm::Value::Integer(3),
+            ]);
+        }
+        _ => panic!("Expected list result"),
+    }
+}
+
+// ==================== Named let ====================
+
+/// Helper to find the bodies of all closures created by some bytecode (recursively)
+fn closure_bodies(bytecode: &[Instruction]) -> Vec<Vec<Instruction>> {
+    let mut bodies = Vec::new();
+    for instr in bytecode {
+        if let Instruction::MakeClosure(_, body, _) | Instruction::MakeVariadicClosure(_, _, body, _) = instr {
+            bodies.push(body.clone());
+            bodies.extend(closure_bodies(body));
+        }
+    }
+    bodies
+}
+
+/// Helper to check that some closure created by this bytecode uses TailCallClosure
+fn closure_uses_tailcall(bytecode: &[Instruction]) -> bool {
+    closure_bodies(bytecode)
+        .iter()
+        .any(|body| body.iter().any(|instr| matches!(instr, Instruction::TailCallClosure(_))))
+}
+
+#[test]
+fn test_named_let_sum() {
+    let source = r#"
+        (let loop ((i 0) (acc 0))
+          (if (== i 10)
+            acc
+            (loop (+ i 1) (+ acc i))))
+    "#;
+
+    let vm = compile_and_run(source);
+    assert!(closure_uses_tailcall(&vm.current_bytecode),
+            "named let self-call should compile to TailCallClosure");
+
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::Integer(n)) => assert_eq!(*n, 45),
+        _ => panic!("Expected integer result"),
+    }
+}
+
+#[test]
+fn test_named_let_in_defun_uses_tailcall() {
+    let source = r#"
+        (defun sum-to (n)
+          (let loop ((i 0) (acc 0))
+            (if (> i n)
+              acc
+              (loop (+ i 1) (+ acc i)))))
+        (sum-to 100)
+    "#;
+
+    let vm = compile_and_run(source);
+    assert!(closure_uses_tailcall(&vm.functions["sum-to"]));
+
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::Integer(n)) => assert_eq!(*n, 5050),
+        _ => panic!("Expected integer result"),
+    }
+}
+
+#[test]
+fn test_named_let_one_million_iterations() {
+    let source = r#"
+        (defun count-up (n)
+          (let loop ((i 0))
+            (if (== i n)
+              i
+              (loop (+ i 1)))))
+        (count-up 1000000)
+    "#;
+
+    let vm = compile_and_run(source);
+
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::Integer(n)) => assert_eq!(*n, 1000000),
+        _ => panic!("Expected integer result"),
+    }
+}
+
+#[test]
+fn test_named_let_does_not_grow_call_stack() {
+    let source = r#"
+        (defun count-up (n)
+          (let loop ((i 0))
+            (if (== i n)
+              i
+              (loop (+ i 1)))))
+        (count-up 5000)
+    "#;
+
+    let (vm, max_depth) = run_tracking_max_depth(source);
+
+    // One frame for count-up; the named let closure reuses it on every iteration
+    assert_eq!(max_depth, 1, "named let iterations should reuse the frame");
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_named_let_non_tail_self_call() {
+    // The self-call is an operand of *, so it must not reuse the frame
+    let source = r#"
+        (let fact ((n 5))
+          (if (<= n 1)
+            1
+            (* n (fact (- n 1)))))
+    "#;
+
+    let vm = compile_and_run(source);
+
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::Integer(n)) => assert_eq!(*n, 120),
+        _ => panic!("Expected integer result"),
+    }
+}
+
+#[test]
+fn test_named_let_captures_outer_variables() {
+    let source = r#"
+        (defun collect-multiples (k limit)
+          (let loop ((i limit) (acc '()))
+            (if (<= i 0)
+              acc
+              (loop (- i 1) (cons (* i k) acc)))))
+        (collect-multiples 3 4)
+    "#;
+
+    let vm = compile_and_run(source);
+
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![
+                lisp_bytecode_vm::Value::Integer(3),
+                lisp_bytecode_vm::Value::Integer(6),
+                lisp_bytecode_vm::Value::Integer(9),
+                lisp_bytecode_vm::Value::Integer(12),
+            ]);
+        }
+        _ => panic!("Expected list result"),
+    }
+}
+
+#[test]
+fn test_named_let_initializers_see_outer_scope() {
+    // `i` in the initializer refers to the outer binding, not the loop variable
+    let source = r#"
+        (let ((i 7))
+          (let loop ((i (+ i 1)) (n 0))
+            (if (== n 2) i (loop (+ i 10) (+ n 1)))))
+    "#;
+
+    let vm = compile_and_run(source);
+
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::Integer(n)) => assert_eq!(*n, 28),
+        _ => panic!("Expected integer result"),
+    }
+}
+
+#[test]
+fn test_tail_call_at_end_of_multi_statement_body() {
+    // The body is an implicit begin; the recursive call is its last statement
+    let source = r#"
+        (defun walk (n acc)
+          (cons n acc)
+          (if (<= n 0) acc (walk (- n 1) (+ acc 1))))
+        (walk 5000 0)
+    "#;
+
+    let (vm, max_depth) = run_tracking_max_depth(source);
+    assert!(function_uses_tailcall(&vm, "walk"), "walk should use TailCall instruction");
+    assert_eq!(max_depth, 1, "the recursive call should reuse the frame");
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::Integer(n)) => assert_eq!(*n, 5000),
+        _ => panic!("Expected integer result"),
+    }
+}
+
+#[test]
+fn test_tail_call_at_end_of_progn() {
+    let source = r#"
+        (defun walk (n)
+          (progn
+            (list n)
+            (if (<= n 0) 'done (walk (- n 1)))))
+        (walk 10)
+    "#;
+
+    let vm = compile_and_run(source);
+    assert!(function_uses_tailcall(&vm, "walk"), "walk should use TailCall instruction");
+
+    // Only the last statement of a begin is a tail call
+    let source = "(defun f (n) 0) (defun g (n) (begin (f n) (f n)))";
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let (functions, _) = Compiler::new().compile_program(&exprs).unwrap();
+    let calls: Vec<&Instruction> = functions["g"].iter()
+        .filter(|instr| matches!(instr, Instruction::Call(_, _) | Instruction::TailCall(_, _)))
+        .collect();
+    assert_eq!(calls, vec![&Instruction::Call("f".to_string(), 1), &Instruction::TailCall("f".to_string(), 1)]);
+}
+
+#[test]
+fn test_tail_call_through_or_final_operand() {
+    let source = r#"
+        (defun all-done? (n)
+          (or (== n 0) (all-done? (- n 1))))
+        (all-done? 100000)
+    "#;
+
+    let (vm, max_depth) = run_tracking_max_depth(source);
+    assert!(function_uses_tailcall(&vm, "all-done?"), "all-done? should use TailCall instruction");
+    assert_eq!(max_depth, 1, "recursion through or should reuse the frame");
+    assert_eq!(vm.value_stack.last(), Some(&lisp_bytecode_vm::Value::Boolean(true)));
+}
+
+#[test]
+fn test_tail_call_through_and_final_operand() {
+    let source = r#"
+        (defun walk (n)
+          (and (> n 0) (walk (- n 1))))
+        (walk 100000)
+    "#;
+
+    let (vm, max_depth) = run_tracking_max_depth(source);
+    assert!(function_uses_tailcall(&vm, "walk"), "walk should use TailCall instruction");
+    assert_eq!(max_depth, 1, "recursion through and should reuse the frame");
+    assert_eq!(vm.value_stack.last(), Some(&lisp_bytecode_vm::Value::Boolean(false)));
+}
+
+#[test]
+fn test_non_final_and_or_operands_are_not_tail_calls() {
+    let source = "(defun ok? (n) true) (defun f (n) (and (ok? n) (or (ok? n) (ok? n))))";
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let (functions, _) = Compiler::new().compile_program(&exprs).unwrap();
+    let calls: Vec<&Instruction> = functions["f"].iter()
+        .filter(|instr| matches!(instr, Instruction::Call(_, _) | Instruction::TailCall(_, _)))
+        .collect();
+    assert_eq!(calls, vec![
+        &Instruction::Call("ok?".to_string(), 1),
+        &Instruction::Call("ok?".to_string(), 1),
+        &Instruction::TailCall("ok?".to_string(), 1),
+    ]);
+}
+
+#[test]
+fn test_mutual_tail_recursion_500k_alternations() {
+    let source = r#"
+        (defun my-even? (n) (if (== n 0) true (my-odd? (- n 1))))
+        (defun my-odd? (n) (if (== n 0) false (my-even? (- n 1))))
+        (list (my-even? 500000) (my-odd? 500000))
+    "#;
+
+    let vm = compile_and_run(source);
+    let even = disassembler::disassemble_function("my-even?", &vm.functions["my-even?"]);
+    let odd = disassembler::disassemble_function("my-odd?", &vm.functions["my-odd?"]);
+    assert!(even.contains("TailCall(\"my-odd?\", 1)"), "got: {}", even);
+    assert!(odd.contains("TailCall(\"my-even?\", 1)"), "got: {}", odd);
+
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::List(items)) => assert_eq!(items.to_vec(), vec![
+            lisp_bytecode_vm::Value::Boolean(true),
+            lisp_bytecode_vm::Value::Boolean(false),
+        ]),
+        _ => panic!("Expected list result"),
+    }
+}
+
+#[test]
+fn test_mutual_tail_calls_between_different_arities() {
+    // The frame shrinks from three arguments to two and grows back, with let
+    // bindings on top of the arguments at each call site
+    let source = r#"
+        (defun ping (n a b)
+          (let ((next (- n 1)) (sum (+ a b)))
+            (if (<= n 0) sum (pong next sum))))
+        (defun pong (n total)
+          (let ((next (- n 1)))
+            (if (<= n 0) total (ping next total 1))))
+        (ping 200000 0 0)
+    "#;
+
+    let (vm, max_depth) = run_tracking_max_depth(source);
+    assert_eq!(max_depth, 1, "cross-function tail calls should not push frames");
+    assert_eq!(vm.value_stack, vec![lisp_bytecode_vm::Value::Integer(100000)]);
+    assert!(function_uses_tailcall(&vm, "ping") && function_uses_tailcall(&vm, "pong"));
+}
+
+#[test]
+fn test_mutual_tail_calls_through_closures_and_variables() {
+    let source = r#"
+        (defun bounce (f g n)
+          (if (== n 0) 'done (f g f (- n 1))))
+        (letrec ((state-a (lambda (n) (if (== n 0) 'a (state-b (- n 1)))))
+                 (state-b (lambda (n) (if (== n 0) 'b (state-a (- n 1))))))
+          (list (state-a 100001) (bounce bounce bounce 100000)))
+    "#;
+
+    let (vm, max_depth) = run_tracking_max_depth(source);
+    assert!(max_depth <= 2, "closure tail calls should reuse the frame, got depth {}", max_depth);
+    assert!(vm.functions["bounce"].iter().any(|instr| matches!(instr, Instruction::TailCallClosure(3))));
+    match vm.value_stack.last() {
+        Some(lisp_bytecode_vm::Value::List(items)) => assert_eq!(items.to_vec(), vec![
+            lisp_bytecode_vm::Value::symbol("b"),
+            lisp_bytecode_vm::Value::symbol("done"),
+        ]),
+        _ => panic!("Expected list result"),
+    }
+}
@@ -0,0 +1,190 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+use std::io::{Read, Write};
+use std::net::{TcpListener, TcpStream};
+use std::thread;
+use std::time::Duration;
+
+fn run(source: &str) -> Result<Value, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+    let (functions, main) = Compiler::new().compile_program(&exprs).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+/// A port that was free a moment ago
+fn free_port() -> u16 {
+    TcpListener::bind("127.0.0.1:0").unwrap().local_addr().unwrap().port()
+}
+
+/// Run a Lisp server on its own thread. Values are not Send, so the VM is
+/// built there and `check` inspects the result before the thread ends.
+fn spawn_server(source: String, check: fn(Result<Value, String>)) -> thread::JoinHandle<()> {
+    thread::spawn(move || check(run(&source)))
+}
+
+fn done(result: Result<Value, String>) {
+    assert_eq!(result, Ok(Value::symbol("done")));
+}
+
+/// Connect once the server thread is listening
+fn connect(port: u16) -> TcpStream {
+    for _ in 0..200 {
+        if let Ok(stream) = TcpStream::connect(("127.0.0.1", port)) {
+            stream.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+            return stream;
+        }
+        thread::sleep(Duration::from_millis(10));
+    }
+    panic!("server never started listening on port {}", port);
+}
+
+const HTTP_SERVER: &str = r#"
+    (define response
+      "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 16\r\nConnection: close\r\n\r\nHello from Lisp!")
+    (defun read-request (conn)
+      (loop ((request ""))
+        (if (string-contains? request "\r\n\r\n")
+          request
+          (let ((chunk (socket-read conn 16)))
+            (if (string? chunk) (recur (string-append request chunk)) chunk)))))
+    (defun serve (listener remaining)
+      (if (= remaining 0)
+        'done
+        (let ((conn (tcp-accept listener)))
+          (let ((request (read-request conn)))
+            (do (socket-write conn response)
+                (socket-close conn)
+                (serve listener (- remaining 1)))))))
+"#;
+
+/// Send a GET request and return the full response
+fn http_get(port: u16, path: &str) -> String {
+    let mut stream = connect(port);
+    write!(stream, "GET {} HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", path).unwrap();
+    let mut response = String::new();
+    stream.read_to_string(&mut response).unwrap();
+    response
+}
+
+// ============================================================================
+// A hand-rolled HTTP server
+// ============================================================================
+
+#[test]
+fn test_http_request_against_lisp_server() {
+    let port = free_port();
+    let server = spawn_server(format!("{}(serve (tcp-listen {}) 1)", HTTP_SERVER, port), done);
+
+    let response = http_get(port, "/");
+    assert!(response.starts_with("HTTP/1.1 200 OK\r\n"), "got: {:?}", response);
+    let (_, body) = response.split_once("\r\n\r\n").expect("headers end with a blank line");
+    assert_eq!(body, "Hello from Lisp!");
+
+    server.join().unwrap();
+}
+
+#[test]
+fn test_server_handles_sequential_connections() {
+    let port = free_port();
+    let server = spawn_server(format!("{}(serve (tcp-listen {}) 3)", HTTP_SERVER, port), done);
+    for path in ["/", "/a", "/b/c"] {
+        assert!(http_get(port, path).ends_with("\r\n\r\nHello from Lisp!"));
+    }
+    server.join().unwrap();
+}
+
+#[test]
+fn test_a_server_task_lets_other_tasks_run_while_it_waits() {
+    let port = free_port();
+    // The main task counts its turns until the server task has served both
+    // connections. Were accept to block, it would get one turn before the
+    // first and none again until the server finished.
+    let server = spawn_server(format!(r#"{}
+        (define server (spawn (lambda () (serve (tcp-listen {}) 2))))
+        (define turns
+          (loop ((n 0))
+            (if (eq? (task-status server) 'done) n (do (yield) (recur (+ n 1))))))
+        (if (> turns 2) (task-result server) turns)
+    "#, HTTP_SERVER, port), done);
+    for path in ["/", "/again"] {
+        thread::sleep(Duration::from_millis(20));
+        assert!(http_get(port, path).ends_with("\r\n\r\nHello from Lisp!"));
+    }
+    server.join().unwrap();
+}
+
+// ============================================================================
+// Reading and writing
+// ============================================================================
+
+#[test]
+fn test_socket_read_respects_max_bytes_and_ends_with_nil() {
+    let port = free_port();
+    let server = spawn_server(format!(r#"
+        (let ((conn (tcp-accept (tcp-listen {}))))
+          (let ((first (socket-read conn 3)))
+            (let ((rest (socket-read conn 100)))
+              (let ((end (socket-read conn 100)))
+                (list first rest end (socket-write conn "ok"))))))
+    "#, port), |result| {
+        let expected = vec![Value::string("abc"), Value::string("def"), Value::List(List::Nil), Value::Integer(2)];
+        assert_eq!(result, Ok(Value::List(List::from_vec(expected))));
+    });
+
+    let mut client = connect(port);
+    client.write_all(b"abcdef").unwrap();
+    client.shutdown(std::net::Shutdown::Write).unwrap();
+    let mut reply = String::new();
+    client.read_to_string(&mut reply).unwrap();
+
+    server.join().unwrap();
+    assert_eq!(reply, "ok");
+}
+
+// ============================================================================
+// Closed sockets and errors
+// ============================================================================
+
+#[test]
+fn test_closed_socket_errors_are_catchable() {
+    let port = free_port();
+    let server = spawn_server(format!(r#"
+        (let ((conn (tcp-accept (tcp-listen {}))))
+          (do (socket-close conn)
+              (list (socket-close conn)
+                    (socket-read conn 10)
+                    (handler-case (socket-write conn "late") (catch (e) 'write-failed)))))
+    "#, port), |result| {
+        let expected = vec![Value::Boolean(true), Value::List(List::Nil), Value::symbol("write-failed")];
+        assert_eq!(result, Ok(Value::List(List::from_vec(expected))));
+    });
+
+    let _client = connect(port);
+    server.join().unwrap();
+}
+
+#[test]
+fn test_listen_on_a_port_in_use_is_catchable() {
+    let taken = TcpListener::bind("0.0.0.0:0").unwrap();
+    let port = taken.local_addr().unwrap().port();
+    let err = run(&format!("(tcp-listen {})", port)).unwrap_err();
+    assert!(err.contains(&format!("'tcp-listen' failed to bind to port {}", port)), "got: {}", err);
+    let caught = run(&format!("(handler-case (tcp-listen {}) (catch (e) 'in-use))", port));
+    assert_eq!(caught, Ok(Value::symbol("in-use")));
+}
+
+#[test]
+fn test_argument_errors() {
+    let err = run("(tcp-listen 70000)").unwrap_err();
+    assert!(err.contains("invalid port number 70000"), "got: {}", err);
+    let err = run(r#"(tcp-accept "listener")"#).unwrap_err();
+    assert!(err.contains("'tcp-accept' expects a tcp-listener, got string"), "got: {}", err);
+    let err = run(r#"(socket-write 42 "x")"#).unwrap_err();
+    assert!(err.contains("'socket-write' expects a tcp-stream, got integer"), "got: {}", err);
+    let err = run("(socket-close '())").unwrap_err();
+    assert!(err.contains("'socket-close' expects a tcp-stream"), "got: {}", err);
+}
@@ -0,0 +1,165 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, MapKey, Symbol, Value};
+use std::cell::RefCell;
+use std::io::Write;
+use std::rc::Rc;
+
+fn compile_and_run(source: &str) -> VM {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message).unwrap();
+    vm
+}
+
+/// Output sink the test can read back after it has been moved into the VM
+#[derive(Clone, Default)]
+struct SharedOutput(Rc<RefCell<Vec<u8>>>);
+
+impl Write for SharedOutput {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        self.0.borrow_mut().extend_from_slice(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+/// Run source, returning its value and each (time ...) report as key=value pairs
+fn timed(source: &str) -> (Value, Vec<Vec<(String, String)>>) {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+    let output = SharedOutput::default();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.time_output = Some(Box::new(output.clone()));
+    vm.run().map_err(|e| e.message).unwrap();
+    let text = String::from_utf8(output.0.borrow().clone()).unwrap();
+    let reports = text.lines()
+        .map(|line| {
+            let fields = line.strip_prefix("time ").unwrap_or_else(|| panic!("not a time report: {:?}", line));
+            fields.split(' ')
+                .map(|field| {
+                    let (key, value) = field.split_once('=').unwrap();
+                    (key.to_string(), value.to_string())
+                })
+                .collect()
+        })
+        .collect();
+    (vm.value_stack.last().cloned().unwrap(), reports)
+}
+
+fn field<'a>(report: &'a [(String, String)], key: &str) -> &'a str {
+    &report.iter().find(|(k, _)| k == key).unwrap_or_else(|| panic!("no {} in {:?}", key, report)).1
+}
+
+fn stat(map: &Value, name: &str) -> i64 {
+    match map {
+        Value::HashMap(map) => match map.borrow()[&MapKey::Symbol(Symbol::intern(name))] {
+            Value::Integer(n) => n,
+            ref other => panic!("{} is {:?}", name, other),
+        },
+        other => panic!("expected a map, got {:?}", other),
+    }
+}
+
+const FIB: &str = "(defun fib (n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))";
+
+#[test]
+fn test_time_returns_body_value() {
+    let vm = compile_and_run(&format!("{} (time (fib 15))", FIB));
+    assert_eq!(vm.value_stack, vec![Value::Integer(610)]);
+}
+
+#[test]
+fn test_time_leaves_stack_balanced() {
+    let vm = compile_and_run("(+ (time (let ((a 2) (b 3)) (* a b))) 1)");
+    assert_eq!(vm.value_stack, vec![Value::Integer(7)]);
+
+    // Several body forms run in sequence, like do
+    let vm = compile_and_run("(time 1 2 3)");
+    assert_eq!(vm.value_stack, vec![Value::Integer(3)]);
+}
+
+#[test]
+fn test_instructions_are_counted() {
+    let vm = compile_and_run("(time (+ 1 2))");
+    // TimeStart, the folded push, TimeEnd and Halt
+    assert_eq!(vm.instructions_executed, 4);
+
+    let small = compile_and_run(&format!("{} (time (fib 10))", FIB)).instructions_executed;
+    let large = compile_and_run(&format!("{} (time (fib 15))", FIB)).instructions_executed;
+    assert!(large > small * 10, "fib 15: {}, fib 10: {}", large, small);
+}
+
+#[test]
+fn test_raise_unwinds_through_time() {
+    let vm = compile_and_run("(handler-case (time (raise 'stop)) (catch (e) e))");
+    assert_eq!(vm.value_stack, vec![Value::symbol("stop")]);
+}
+
+#[test]
+fn test_time_is_not_a_tail_call() {
+    // The report comes after the body returns, so the body keeps its frame
+    let mut parser = Parser::new(&format!("{} (defun timed-fib (n) (time (fib n)))", FIB));
+    let exprs = parser.parse_all().unwrap();
+    let (functions, _) = Compiler::new().compile_program(&exprs).unwrap();
+    let bytecode = &functions["timed-fib"];
+    assert!(bytecode.contains(&Instruction::Call("fib".to_string(), 1)), "got: {:?}", bytecode);
+    assert_eq!(bytecode.last(), Some(&Instruction::Ret));
+}
+
+#[test]
+fn test_time_report_is_one_line_of_key_value_pairs() {
+    let (value, reports) = timed("(time (+ 1 2))");
+    assert_eq!(value, Value::Integer(3));
+    assert_eq!(reports.len(), 1);
+    let keys: Vec<&str> = reports[0].iter().map(|(key, _)| key.as_str()).collect();
+    assert_eq!(keys, vec!["elapsed-ms", "instructions", "allocated"]);
+    let elapsed: f64 = field(&reports[0], "elapsed-ms").parse().unwrap();
+    assert!(elapsed >= 0.0, "got {}", elapsed);
+    assert_eq!(field(&reports[0], "instructions"), "1");
+    assert_eq!(field(&reports[0], "allocated"), "0");
+}
+
+#[test]
+fn test_time_counts_only_its_own_allocations() {
+    // The list built before the timed expression doesn't count
+    let (_, reports) = timed("(define xs (list 1 2 3)) (time (list 4 5 6 7)) (time (cons 0 xs))");
+    assert_eq!(field(&reports[0], "allocated"), "4");
+    assert_eq!(field(&reports[1], "allocated"), "1");
+}
+
+#[test]
+fn test_gc_stats_reports_the_collector_counters() {
+    let (stats, _) = timed("(gc) (gc-stats)");
+    assert_eq!(stat(&stats, "collections"), 1);
+    for name in ["allocated", "live-objects", "peak-live-objects", "cells-reclaimed", "objects-reclaimed"] {
+        assert!(stat(&stats, name) >= 0, "{} is negative", name);
+    }
+    let (allocated, _) = timed("(define before (hash-ref (gc-stats) 'allocated)) (list 1 2 3) (- (hash-ref (gc-stats) 'allocated) before)");
+    // The three pairs of the list
+    assert_eq!(allocated, Value::Integer(3));
+}
+
+#[test]
+fn test_current_time_millis_advances() {
+    let (value, _) = timed("(define start (current-time-millis)) (list start (- (current-time-millis) start) (current-timestamp))");
+    let items = match value {
+        Value::List(items) => items.to_vec(),
+        other => panic!("got {:?}", other),
+    };
+    match items.as_slice() {
+        [Value::Integer(start), Value::Integer(elapsed), Value::Integer(seconds)] => {
+            assert!(*elapsed >= 0, "got {}", elapsed);
+            assert!((start / 1000 - seconds).abs() <= 1, "{} ms against {} s", start, seconds);
+        }
+        other => panic!("got {:?}", other),
+    }
+}
@@ -0,0 +1,200 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value};
+use std::cell::RefCell;
+use std::fs;
+use std::io::Write;
+use std::process::Command;
+use std::rc::Rc;
+
+/// Output sink the test can read back after it has been moved into the VM
+#[derive(Clone, Default)]
+struct SharedOutput(Rc<RefCell<Vec<u8>>>);
+
+impl Write for SharedOutput {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        self.0.borrow_mut().extend_from_slice(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+fn vm_for(source: &str) -> VM {
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm
+}
+
+/// Run source, returning its value and what the traced functions printed
+fn run_traced(vm: &mut VM) -> (Result<Value, String>, String) {
+    let output = SharedOutput::default();
+    vm.trace_output = Some(Box::new(output.clone()));
+    let result = vm.run().map_err(|e| e.message)
+        .map(|_| vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)));
+    let bytes = output.0.borrow().clone();
+    (result, String::from_utf8(bytes).unwrap())
+}
+
+fn trace(source: &str) -> String {
+    let (result, output) = run_traced(&mut vm_for(source));
+    result.unwrap();
+    output
+}
+
+const FACT: &str = "(defun fact (n) (if (= n 0) 1 (* n (fact (- n 1)))))\n";
+
+#[test]
+fn test_calls_and_returns_are_indented_by_depth() {
+    let output = trace(&format!("{}(trace fact) (fact 3)", FACT));
+    let expected = "\
+> (fact 3)
+  > (fact 2)
+    > (fact 1)
+      > (fact 0)
+      < 1
+    < 1
+  < 2
+< 6
+";
+    assert_eq!(output, expected);
+    // Arguments and results are printed as write prints them
+    let output = trace(r#"(defun greet (name) (list "hi" name)) (trace greet) (greet "bob")"#);
+    assert_eq!(output, "> (greet \"bob\")\n< (\"hi\" \"bob\")\n");
+}
+
+#[test]
+fn test_only_traced_functions_print() {
+    let source = format!("{}(defun twice (x) (* 2 x)) (trace twice) (twice (fact 2))", FACT);
+    assert_eq!(trace(&source), "> (twice 2)\n< 4\n");
+}
+
+#[test]
+fn test_tail_calls_into_a_traced_function_still_print() {
+    // spin calls itself in tail position, so each call prints inside the last
+    let source = "(defun spin (n acc) (if (= n 0) acc (spin (- n 1) (+ acc 1)))) (trace spin) (spin 2 0)";
+    let expected = "\
+> (spin 2 0)
+  > (spin 1 1)
+    > (spin 0 2)
+    < 2
+  < 2
+< 2
+";
+    assert_eq!(trace(source), expected);
+}
+
+#[test]
+fn test_untraced_callers_keep_their_tail_calls() {
+    let source = r#"
+        (defun leaf (n) n)
+        (defun bounce (n) (if (= n 0) (leaf 0) (bounce (- n 1))))
+        (trace leaf)
+        (bounce 100000)
+    "#;
+    let mut vm = vm_for(source);
+    vm.max_call_depth = 50;
+    let (result, output) = run_traced(&mut vm);
+    assert_eq!(result, Ok(Value::Integer(0)));
+    assert_eq!(output, "> (leaf 0)\n< 0\n");
+}
+
+#[test]
+fn test_untrace_restores_the_definition() {
+    let source = format!(r#"{}
+        (define before fact)
+        (trace fact)
+        (fact 1)
+        (untrace fact)
+        (list (eq? before fact) (fact 5))
+    "#, FACT);
+    let mut vm = vm_for(&source);
+    let definition = vm.functions["fact"].clone();
+    let (result, output) = run_traced(&mut vm);
+    assert_eq!(result, Ok(Value::List(List::from_vec(vec![Value::Boolean(true), Value::Integer(120)]))));
+    assert_eq!(output, "> (fact 1)\n  > (fact 0)\n  < 1\n< 1\n");
+    assert_eq!(vm.functions["fact"], definition);
+}
+
+#[test]
+fn test_trace_and_untrace_take_names_too() {
+    let source = format!("{}(list (trace 'fact) (trace fact) (untrace 'fact) (untrace fact) (fact 3))", FACT);
+    let (result, output) = run_traced(&mut vm_for(&source));
+    let fact = Value::symbol("fact");
+    assert_eq!(result, Ok(Value::List(List::from_vec(vec![fact.clone(), fact.clone(), fact.clone(), fact, Value::Integer(6)]))));
+    assert_eq!(output, "");
+}
+
+#[test]
+fn test_tracing_a_missing_function_fails_at_the_trace_call() {
+    let exprs = Parser::new("(trace nope)").parse_all().unwrap();
+    let err = Compiler::new().compile_program(&exprs).unwrap_err();
+    assert_eq!(err.message, "Undefined variable 'nope'");
+
+    let (result, _) = run_traced(&mut vm_for("(trace 'nope)"));
+    assert_eq!(result.unwrap_err(), "'trace' found no function named 'nope'");
+    let (result, _) = run_traced(&mut vm_for("(untrace (lambda (x) x))"));
+    assert_eq!(result.unwrap_err(), "Type error: 'untrace' expects a function or its name, got closure");
+    let (result, _) = run_traced(&mut vm_for("(handler-case (trace 'nope) (catch (e) 'caught))"));
+    assert_eq!(result, Ok(Value::symbol("caught")));
+}
+
+#[test]
+fn test_redefining_a_traced_function_drops_the_trace() {
+    let source = format!(r#"{}
+        (trace fact)
+        (eval '(defun fact (n) 'new))
+        (untrace fact)
+        (fact 3)
+    "#, FACT);
+    let (result, output) = run_traced(&mut vm_for(&source));
+    assert_eq!(result, Ok(Value::symbol("new")));
+    assert_eq!(output, "");
+}
+
+#[test]
+fn test_indentation_recovers_after_an_error_unwinds_traced_calls() {
+    let source = r#"
+        (defun dig (n) (if (= n 0) (car n) (+ 1 (dig (- n 1)))))
+        (trace dig)
+        (handler-case (dig 2) (catch (e) 'caught))
+        (dig 0)
+    "#;
+    let (result, output) = run_traced(&mut vm_for(source));
+    assert!(result.unwrap_err().contains("'car' expects a list"));
+    let expected = "\
+> (dig 2)
+  > (dig 1)
+    > (dig 0)
+> (dig 0)
+";
+    assert_eq!(output, expected);
+}
+
+#[test]
+fn test_trace_flag_traces_the_named_functions() {
+    let dir = std::env::temp_dir().join(format!("lisp-trace-tests-{}", std::process::id()));
+    let _ = fs::remove_dir_all(&dir);
+    fs::create_dir_all(&dir).unwrap();
+    let script = dir.join("fact.lisp");
+    fs::write(&script, format!("{}(defun twice (x) (* 2 x))\n(print (twice (fact 1)))\n", FACT)).unwrap();
+
+    let output = Command::new(env!("CARGO_BIN_EXE_lisp-vm"))
+        .arg("--trace=fact,twice")
+        .arg(&script)
+        .output()
+        .unwrap();
+    assert_eq!(String::from_utf8_lossy(&output.stdout), "> (fact 1)\n  > (fact 0)\n  < 1\n< 1\n> (twice 1)\n< 2\n2\n");
+
+    let output = Command::new(env!("CARGO_BIN_EXE_lisp-vm"))
+        .arg("--trace=nope")
+        .arg(&script)
+        .output()
+        .unwrap();
+    assert_eq!(String::from_utf8_lossy(&output.stderr), "Error: --trace: no function named 'nope'\n");
+    assert_eq!(output.status.code(), Some(1));
+    let _ = fs::remove_dir_all(&dir);
+}
@@ -0,0 +1,107 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser};
+use lisp_bytecode_vm::vm::profiler::Profiler;
+use lisp_bytecode_vm::vm::tracer::CallTracer;
+use std::cell::RefCell;
+use std::io::Write;
+use std::rc::Rc;
+
+/// Output sink the test can read back after the tracer has been moved into the VM
+#[derive(Clone, Default)]
+struct SharedOutput(Rc<RefCell<Vec<u8>>>);
+
+impl Write for SharedOutput {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        self.0.borrow_mut().extend_from_slice(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+fn vm_for(source: &str) -> VM {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let (functions, main) = Compiler::new().compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm
+}
+
+/// Run source with a call tracer attached, returning what it logged
+fn trace(source: &str) -> String {
+    let output = SharedOutput::default();
+    let mut vm = vm_for(source);
+    vm.call_tracer = Some(CallTracer::with_output(Box::new(output.clone())));
+    vm.run().map_err(|e| e.message).unwrap();
+    let bytes = output.0.borrow().clone();
+    String::from_utf8(bytes).unwrap()
+}
+
+#[test]
+fn test_calls_are_indented_by_depth() {
+    let output = trace("(defun fact (n) (if (= n 0) 1 (* n (fact (- n 1))))) (fact 2)");
+    let expected = "\
+→ (fact 2)
+  → (fact 1)
+    → (fact 0)
+    ← fact = 1
+  ← fact = 1
+← fact = 2
+";
+    assert_eq!(output, expected);
+}
+
+#[test]
+fn test_tail_calls_are_marked() {
+    let source = r#"
+        (defun ping (n) (if (= n 0) 'done (pong (- n 1))))
+        (defun pong (n) (ping n))
+        (defun start () (list (ping 2)))
+        (start)
+    "#;
+    let expected = "\
+→ (start)
+  → (ping 2)
+  ↪ (pong 1)
+  ↪ (ping 1)
+  ↪ (pong 0)
+  ↪ (ping 0)
+  ← ping = done
+← start = (done)
+";
+    assert_eq!(trace(source), expected);
+}
+
+#[test]
+fn test_arguments_are_printed_as_values() {
+    let output = trace(r#"(defun greet (name tags) name) (greet "ada" '(a b))"#);
+    assert_eq!(output, "→ (greet \"ada\" (a b))\n← greet = \"ada\"\n");
+}
+
+#[test]
+fn test_frames_unwound_by_an_error_are_marked() {
+    let source = r#"
+        (defun inner (x) (raise "boom"))
+        (defun outer (x) (inner x))
+        (defun guarded () (list (handler-case (+ 1 (outer 1)) (catch (e) 0))))
+        (guarded)
+    "#;
+    let output = trace(source);
+    assert!(output.contains("  → (outer 1)\n  ↪ (inner 1)\n  ← inner (unwound)\n"), "got: {}", output);
+    // The catch clause runs as a closure called with the raised value
+    assert!(output.ends_with("  → (<closure> \"boom\")\n  ← <closure> = 0\n← guarded = (0)\n"), "got: {}", output);
+}
+
+#[test]
+fn test_tracer_and_profiler_together() {
+    let output = SharedOutput::default();
+    let mut vm = vm_for("(defun f (x) x) (f 1) (f 2)");
+    vm.call_tracer = Some(CallTracer::with_output(Box::new(output.clone())));
+    vm.profiler = Some(Profiler::new());
+    vm.run().unwrap();
+    assert_eq!(vm.profiler.unwrap().function("f").unwrap().calls, 2);
+    assert_eq!(String::from_utf8(output.0.borrow().clone()).unwrap(), "→ (f 1)\n← f = 1\n→ (f 2)\n← f = 2\n");
+}
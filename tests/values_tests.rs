@@ -0,0 +1,173 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, Instruction, Value};
+
+/// Helper function to compile and run source code
+fn compile_and_run(source: &str) -> Result<VM, String> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all()?;
+
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).map_err(|e| e.message)?;
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm)
+}
+
+/// Helper to compile source and return the named function's bytecode
+fn compile_function(source: &str, name: &str) -> Vec<Instruction> {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, _) = compiler.compile_program(&exprs).unwrap();
+    functions[name].clone()
+}
+
+/// Helper to get integer result from VM
+fn get_int_result(vm: &VM) -> i64 {
+    match vm.value_stack.last() {
+        Some(Value::Integer(n)) => *n,
+        other => panic!("Expected integer result, got {:?}", other),
+    }
+}
+
+// ============================================================================
+// call-with-values
+// ============================================================================
+
+#[test]
+fn test_bind_two_returned_values() {
+    let source = r#"
+        (defun div-mod (a b) (values (/ a b) (% a b)))
+        (call-with-values (lambda () (div-mod 17 5))
+                          (lambda (q r) (list q r)))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    match vm.value_stack.last() {
+        Some(Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![Value::Integer(3), Value::Integer(2)]);
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+    assert_eq!(vm.value_stack.len(), 1, "the value count should not leak onto the stack");
+}
+
+#[test]
+fn test_zero_values_consumed_by_sink() {
+    let source = r#"
+        (defun nothing () (values))
+        (defun sink () 'done)
+        (call-with-values nothing sink)
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&Value::symbol("done")));
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_producer_with_single_plain_value() {
+    let source = r#"
+        (defun answer () 42)
+        (call-with-values answer (lambda (x) (+ x 1)))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 43);
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_values_from_let_body_drop_let_bindings() {
+    let source = r#"
+        (defun split (n)
+          (let ((half (/ n 2)))
+            (values half (- n half))))
+        (call-with-values (lambda () (split 9)) (lambda (a b) (* a b)))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 20);
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_values_through_tail_call() {
+    let source = r#"
+        (defun finish (a b) (values b a))
+        (defun swap (a b) (finish a b))
+        (call-with-values (lambda () (swap 1 2)) (lambda (x y) (- x y)))
+    "#;
+    let bytecode = compile_function(source, "swap");
+    assert!(bytecode.iter().any(|i| matches!(i, Instruction::TailCall(_, _))));
+
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 1);
+}
+
+#[test]
+fn test_consumer_arity_mismatch_is_an_error() {
+    let source = r#"
+        (defun two () (values 1 2))
+        (call-with-values two (lambda (x) x))
+    "#;
+    let err = compile_and_run(source).err().expect("expected an error");
+    assert!(err.contains("arity mismatch"), "got: {}", err);
+}
+
+#[test]
+fn test_call_with_values_rejects_wrong_argument_count() {
+    let err = compile_and_run("(call-with-values (lambda () 1))").err().expect("expected an error");
+    assert!(err.contains("call-with-values expects exactly 2 arguments"), "got: {}", err);
+}
+
+// ============================================================================
+// Single-value contexts
+// ============================================================================
+
+#[test]
+fn test_single_value_behaves_like_plain_value() {
+    let source = r#"
+        (defun answer () (values 42))
+        (let ((x (answer))) (+ x 1))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 43);
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_ordinary_call_sees_primary_value() {
+    let source = r#"
+        (defun div-mod (a b) (values (/ a b) (% a b)))
+        (let ((q (div-mod 17 5))) q)
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 3);
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_values_outside_tail_position_keeps_primary_value() {
+    let source = r#"
+        (defun f () (let ((x (values 7 8 9))) x))
+        (f)
+    "#;
+    let bytecode = compile_function(source, "f");
+    assert!(!bytecode.iter().any(|i| matches!(i, Instruction::Values(_))));
+    // The extra values are pushed and popped again, which the peephole pass removes
+    assert!(!bytecode.contains(&Instruction::Push(Value::Integer(8))));
+    assert!(!bytecode.contains(&Instruction::Push(Value::Integer(9))));
+
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(get_int_result(&vm), 7);
+    assert_eq!(vm.value_stack.len(), 1);
+}
+
+#[test]
+fn test_zero_values_in_ordinary_context_is_nil() {
+    let source = r#"
+        (defun nothing () (values))
+        (let ((x (nothing))) (null? x))
+    "#;
+    let vm = compile_and_run(source).unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&Value::Boolean(true)));
+}
@@ -12,7 +12,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
     for (name, bytecode) in functions {
         vm.functions.insert(name, bytecode);
     }
-    vm.current_bytecode = main;
+    vm.current_bytecode = main.into();
     vm.run().map_err(|e| format!("Runtime error: {:?}", e))?;
 
     // Get the top value from the stack and format it
@@ -25,6 +25,7 @@ fn compile_and_run(source: &str) -> Result<String, String> {
 fn format_value(value: &Value) -> String {
     match value {
         Value::Integer(n) => n.to_string(),
+        Value::BigInt(n) => n.to_string(),
         Value::Float(f) => {
             if f.fract() == 0.0 && !f.is_nan() && !f.is_infinite() {
                 format!("{:.1}", f)
@@ -33,6 +34,7 @@ fn format_value(value: &Value) -> String {
             }
         }
         Value::Boolean(b) => b.to_string(),
+        Value::Char(c) => format!("#\\{}", c),
         Value::List(items) => {
             let formatted_items: Vec<String> = items.iter().map(|v| format_value(v)).collect();
             format!("({})", formatted_items.join(" "))
@@ -45,20 +47,29 @@ fn format_value(value: &Value) -> String {
             format!("<closure/{}>", param_count)
         }
         Value::HashMap(map) => {
-            let mut items: Vec<String> = map.iter()
+            let mut items: Vec<String> = map.borrow().iter()
                 .map(|(k, v)| format!("\"{}\" {}", k, format_value(v)))
                 .collect();
             items.sort();
             format!("{{{}}}", items.join(" "))
         }
         Value::Vector(items) => {
-            let formatted_items: Vec<String> = items.iter().map(|v| format_value(v)).collect();
+            let formatted_items: Vec<String> = items.borrow().iter().map(|v| format_value(v)).collect();
             format!("[{}]", formatted_items.join(" "))
         }
         Value::TcpListener(_) => "#<tcp-listener>".to_string(),
         Value::TcpStream(_) => "#<tcp-stream>".to_string(),
         Value::SharedTcpListener(_) => "#<shared-tcp-listener>".to_string(),
+        Value::Struct(data) => {
+            let fields: Vec<String> = data.fields.iter().map(|v| format_value(v)).collect();
+            format!("#<{} {}>", data.name, fields.join(" "))
+        }
         Value::Pointer(p) => format!("#<pointer 0x{:x}>", p),
+        Value::Cell(_) => "#<cell>".to_string(),
+        Value::Port(_) => "#<port>".to_string(),
+        Value::Promise(_) => "#<promise>".to_string(),
+        Value::Task(_) => "#<task>".to_string(),
+        Value::Channel(_) => "#<channel>".to_string(),
     }
 }
 
@@ -277,3 +288,113 @@ fn test_variadic_zero_required_no_args() {
     let result = compile_and_run(source).unwrap();
     assert_eq!(result.trim(), "()");
 }
+
+// ==================== &rest marker Tests ====================
+
+/// Helper that returns the VM so stack state can be inspected
+fn run_vm(source: &str) -> VM {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().unwrap();
+    vm
+}
+
+#[test]
+fn test_rest_marker_defun_basic() {
+    let source = r#"
+        (defun f (a b &rest others)
+            others)
+        (f 1 2 3 4 5)
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(3 4 5)");
+}
+
+#[test]
+fn test_rest_marker_no_extra_args_is_empty_list() {
+    let source = r#"
+        (defun f (a b &rest others)
+            others)
+        (f 1 2)
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "()");
+}
+
+#[test]
+fn test_rest_marker_zero_required_params() {
+    let source = r#"
+        (defun all-nums (&rest nums)
+            nums)
+        (all-nums 1 2 3)
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(1 2 3)");
+}
+
+#[test]
+fn test_rest_marker_insufficient_args() {
+    let source = r#"
+        (defun f (a b &rest others)
+            others)
+        (f 1)
+    "#;
+    let result = compile_and_run(source);
+    assert!(result.unwrap_err().contains("at least 2"));
+}
+
+#[test]
+fn test_rest_marker_lambda() {
+    let source = r#"
+        ((lambda (x &rest xs) (cons x xs)) 1 2 3)
+    "#;
+    let result = compile_and_run(source).unwrap();
+    assert_eq!(result.trim(), "(1 2 3)");
+}
+
+#[test]
+fn test_rest_marker_must_be_followed_by_one_name() {
+    let source = r#"
+        (defun f (a &rest b c) a)
+    "#;
+    let result = compile_and_run(source);
+    assert!(result.unwrap_err().contains("&rest must be followed by exactly one parameter name"));
+
+    let result = compile_and_run("(defun g (a &rest) a)");
+    assert!(result.unwrap_err().contains("&rest must be followed by exactly one parameter name"));
+}
+
+#[test]
+fn test_rest_marker_tail_calls_do_not_leak_stack() {
+    let source = r#"
+        (defun sum-args (acc n &rest extra)
+            (if (<= n 0)
+                (+ acc (list-length extra))
+                (sum-args (+ acc n) (- n 1))))
+        (defun spread (n)
+            (if (<= n 0)
+                0
+                (sum-args 0 n 1 2 3)))
+        (list (spread 3) (sum-args 0 2000) (sum-args 0 2000 9 9 9 9) (sum-args 5 0 7 7))
+    "#;
+    let vm = run_vm(source);
+    assert_eq!(vm.value_stack.len(), 1, "tail calls with rest args should not leak stack slots");
+    match vm.value_stack.last() {
+        Some(Value::List(items)) => {
+            assert_eq!(items.to_vec(), vec![
+                Value::Integer(6),
+                Value::Integer(2001000),
+                Value::Integer(2001000),
+                Value::Integer(7),
+            ]);
+        }
+        other => panic!("Expected list result, got {:?}", other),
+    }
+}
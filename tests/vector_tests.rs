@@ -0,0 +1,158 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, List, Value, RuntimeError};
+
+fn vm_for(source: &str) -> VM {
+    let mut parser = Parser::new(source);
+    let exprs = parser.parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.source_maps = compiler.source_maps();
+    vm
+}
+
+fn run(source: &str) -> Result<Value, RuntimeError> {
+    let mut vm = vm_for(source);
+    vm.run()?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+fn ints(values: &[i64]) -> Value {
+    Value::List(List::from_vec(values.iter().map(|n| Value::Integer(*n)).collect()))
+}
+
+/// Render a value the way print shows it
+fn printed(source: &str) -> String {
+    match run(&format!("(format \"{{}}\" (list {}))", source)) {
+        Ok(Value::String(s)) => s.to_string(),
+        other => panic!("Expected a string, got {:?}", other),
+    }
+}
+
+// ============================================================================
+// Construction and access
+// ============================================================================
+
+#[test]
+fn test_make_vector_fills_every_slot() {
+    let source = "(let ((v (make-vector 3 7))) (list (vector-length v) (vector-ref v 0) (vector-ref v 2)))";
+    assert_eq!(run(source).unwrap(), ints(&[3, 7, 7]));
+    assert_eq!(run("(vector-length (make-vector 0 1))").unwrap(), Value::Integer(0));
+}
+
+#[test]
+fn test_literal_vector() {
+    assert_eq!(run("(vector-ref #(10 20 30) 1)").unwrap(), Value::Integer(20));
+    assert_eq!(run("(vector-length #())").unwrap(), Value::Integer(0));
+}
+
+#[test]
+fn test_vectors_print_with_hash_paren() {
+    assert_eq!(printed("#(1 2 3)"), "#(1 2 3)");
+    assert_eq!(printed("#()"), "#()");
+    assert_eq!(printed("(make-vector 2 #(1))"), "#(#(1) #(1))");
+}
+
+// ============================================================================
+// In-place mutation
+// ============================================================================
+
+#[test]
+fn test_vector_set_mutates_in_place() {
+    let source = "(let ((v (make-vector 3 0))) (do (vector-set! v 1 42) (vector->list v)))";
+    assert_eq!(run(source).unwrap(), ints(&[0, 42, 0]));
+}
+
+#[test]
+fn test_aliased_references_see_the_change() {
+    let source = r#"
+        (define v #(1 2 3))
+        (define alias v)
+        (vector-set! v 0 99)
+        (vector->list alias)
+    "#;
+    assert_eq!(run(source).unwrap(), ints(&[99, 2, 3]));
+}
+
+#[test]
+fn test_mutation_through_a_function_argument() {
+    let source = r#"
+        (defun fill-squares (v i)
+          (if (= i (vector-length v))
+              v
+              (do (vector-set! v i (* i i))
+                  (fill-squares v (+ i 1)))))
+        (let ((v (make-vector 5 0)))
+          (do (fill-squares v 0) (vector->list v)))
+    "#;
+    assert_eq!(run(source).unwrap(), ints(&[0, 1, 4, 9, 16]));
+}
+
+#[test]
+fn test_closure_sees_mutation() {
+    let source = r#"
+        (let ((counts (make-vector 1 0)))
+          (let ((bump (lambda () (vector-set! counts 0 (+ (vector-ref counts 0) 1)))))
+            (do (bump) (bump) (bump) (vector-ref counts 0))))
+    "#;
+    assert_eq!(run(source).unwrap(), Value::Integer(3));
+}
+
+#[test]
+fn test_literals_are_fresh_each_evaluation() {
+    let source = r#"
+        (defun fresh () #(0 0))
+        (do (vector-set! (fresh) 0 5) (vector-ref (fresh) 0))
+    "#;
+    assert_eq!(run(source).unwrap(), Value::Integer(0));
+}
+
+#[test]
+fn test_functional_vector_set_copies() {
+    let source = "(let ((v #(1 2))) (let ((w (vector-set v 0 9))) (list (vector->list v) (vector->list w))))";
+    assert_eq!(run(source).unwrap(), Value::List(List::from_vec(vec![ints(&[1, 2]), ints(&[9, 2])])));
+}
+
+#[test]
+fn test_vector_set_as_a_value() {
+    let source = "(let ((v (make-vector 2 0)) (set (lambda (f) (f v 1 8)))) (do (set vector-set!) (vector->list v)))";
+    assert_eq!(run(source).unwrap(), ints(&[0, 8]));
+}
+
+// ============================================================================
+// Bounds and type errors
+// ============================================================================
+
+#[test]
+fn test_out_of_bounds_read_is_located() {
+    let source = "(defun get (v i)\n  (vector-ref v i))\n(get #(1 2 3) 3)";
+    let err = run(source).unwrap_err();
+    assert!(err.message.contains("'vector-ref' index 3 out of bounds for vector of length 3"), "got: {}", err.message);
+    let location = err.location.expect("a location for the error");
+    assert_eq!((location.line, location.column), (2, 3));
+}
+
+#[test]
+fn test_out_of_bounds_write_is_located() {
+    let source = "(define v (make-vector 2 0))\n(vector-set! v -1 5)";
+    let err = run(source).unwrap_err();
+    assert!(err.message.contains("'vector-set!' index -1 out of bounds for vector of length 2"), "got: {}", err.message);
+    assert_eq!(err.location.map(|l| l.line), Some(2));
+}
+
+#[test]
+fn test_errors_are_catchable() {
+    let source = "(handler-case (vector-ref (make-vector 1 0) 5) (catch (e) 'caught))";
+    assert_eq!(run(source).unwrap(), Value::symbol("caught"));
+}
+
+#[test]
+fn test_type_errors() {
+    let err = run("(vector-ref '(1 2) 0)").unwrap_err();
+    assert!(err.message.contains("'vector-ref' expects a vector and an integer"), "got: {}", err.message);
+    let err = run("(vector-set! #(1) 0.5 2)").unwrap_err();
+    assert!(err.message.contains("'vector-set!' expects a vector, an integer, and a value"), "got: {}", err.message);
+    let err = run("(make-vector -1 0)").unwrap_err();
+    assert!(err.message.contains("size cannot be negative"), "got: {}", err.message);
+}
@@ -6,7 +6,7 @@ fn test_vm_push_and_halt() {
     vm.current_bytecode = vec![
         Instruction::Push(Value::Integer(42)),
         Instruction::Halt,
-    ];
+    ].into();
 
     vm.run().unwrap();
 
@@ -23,7 +23,7 @@ fn test_vm_arithmetic_add() {
         Instruction::Push(Value::Integer(3)),
         Instruction::Add,
         Instruction::Halt,
-    ];
+    ].into();
 
     vm.run().unwrap();
 
@@ -48,7 +48,7 @@ fn test_vm_arithmetic_operations() {
             Instruction::Push(Value::Integer(b)),
             op,
             Instruction::Halt,
-        ];
+        ].into();
 
         vm.run().unwrap();
 
@@ -64,7 +64,7 @@ fn test_vm_negation() {
         Instruction::Push(Value::Integer(5)),
         Instruction::Neg,
         Instruction::Halt,
-    ];
+    ].into();
 
     vm.run().unwrap();
 
@@ -98,7 +98,7 @@ fn test_vm_comparison_operations() {
             Instruction::Push(Value::Integer(b)),
             op,
             Instruction::Halt,
-        ];
+        ].into();
 
         vm.run().unwrap();
 
@@ -117,7 +117,7 @@ fn test_vm_conditional_jump_true() {
         Instruction::Jmp(5),
         Instruction::Push(Value::Integer(20)),
         Instruction::Halt,
-    ];
+    ].into();
 
     vm.run().unwrap();
 
@@ -135,7 +135,7 @@ fn test_vm_conditional_jump_false() {
         Instruction::Jmp(5),
         Instruction::Push(Value::Integer(20)),
         Instruction::Halt,
-    ];
+    ].into();
 
     vm.run().unwrap();
 
@@ -162,7 +162,7 @@ fn test_vm_function_call() {
         Instruction::Push(Value::Integer(5)),
         Instruction::Call("double".to_string(), 1),
         Instruction::Halt,
-    ];
+    ].into();
 
     vm.run().unwrap();
 
@@ -198,7 +198,7 @@ fn test_vm_recursive_function() {
         Instruction::Push(Value::Integer(5)),
         Instruction::Call("fact".to_string(), 1),
         Instruction::Halt,
-    ];
+    ].into();
 
     vm.run().unwrap();
 
@@ -230,7 +230,7 @@ fn test_vm_multiple_function_calls() {
         Instruction::Call("add".to_string(), 2),
         Instruction::Add,
         Instruction::Halt,
-    ];
+    ].into();
 
     vm.run().unwrap();
 
@@ -261,7 +261,7 @@ fn test_vm_load_arg() {
         Instruction::Push(Value::Integer(4)),
         Instruction::Call("test".to_string(), 3),
         Instruction::Halt,
-    ];
+    ].into();
 
     vm.run().unwrap();
 
@@ -291,7 +291,7 @@ fn test_vm_stack_trace() {
     vm.current_bytecode = vec![
         Instruction::Call("outer".to_string(), 0),
         Instruction::Halt,
-    ];
+    ].into();
 
     // Manually step through to check stack trace mid-execution
     vm.execute_one_instruction(); // Call outer
@@ -336,7 +336,7 @@ fn test_vm_full_stack_trace_on_error() {
     vm.current_bytecode = vec![
         Instruction::Call("level1".to_string(), 0),
         Instruction::Halt,
-    ];
+    ].into();
 
     // Run and expect error with full stack trace
     let result = vm.run();
@@ -0,0 +1,136 @@
+use lisp_bytecode_vm::{Compiler, CompileWarning, VM, parser::Parser, Value};
+
+fn warnings(source: &str) -> Vec<CompileWarning> {
+    let exprs = Parser::new_with_file(source, "lint.lisp".to_string()).parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    compiler.compile_program(&exprs).unwrap();
+    compiler.warnings().to_vec()
+}
+
+/// Message and line:column of each warning
+fn reported(source: &str) -> Vec<(String, usize, usize)> {
+    warnings(source).into_iter()
+        .map(|warning| (warning.message, warning.location.line, warning.location.column))
+        .collect()
+}
+
+fn warning(message: &str, line: usize, column: usize) -> (String, usize, usize) {
+    (message.to_string(), line, column)
+}
+
+// ============================================================================
+// What is reported
+// ============================================================================
+
+#[test]
+fn test_unused_let_binding() {
+    assert_eq!(reported("(let ((x 1) (y 2))\n  (+ x 1))"), vec![warning("Unused let binding 'y'", 1, 14)]);
+    assert_eq!(reported("(let* ((x 1) (y (+ x 1))) y)"), vec![]);
+    assert_eq!(reported("(letrec ((f (lambda (n) n)) (g 1)) (f 2))"), vec![warning("Unused let binding 'g'", 1, 30)]);
+}
+
+#[test]
+fn test_unused_parameters() {
+    assert_eq!(reported("(defun first-of (a b) a)"), vec![warning("Unused parameter 'b'", 1, 20)]);
+    assert_eq!(reported("(defun count-rest (. rest) 0)"), vec![warning("Unused parameter 'rest'", 1, 22)]);
+    assert_eq!(reported("(define k (lambda (x) 42))"), vec![warning("Unused parameter 'x'", 1, 20)]);
+}
+
+#[test]
+fn test_rest_marker_is_not_a_parameter() {
+    assert_eq!(reported("(defun f (a &rest xs) (list a xs))"), vec![]);
+    assert_eq!(reported("(lambda (&rest xs) xs)"), vec![]);
+    // The rest parameter itself is still checked
+    assert_eq!(reported("(defun g (a &rest xs) a)"), vec![warning("Unused parameter 'xs'", 1, 19)]);
+}
+
+#[test]
+fn test_underscore_names_are_not_reported() {
+    assert_eq!(reported("(defun pick (_ignored chosen) chosen)"), vec![]);
+    assert_eq!(reported("(let ((_x 1)) 2)"), vec![]);
+    assert_eq!(reported("(match '(1 2) ((_ b) b))"), vec![]);
+}
+
+#[test]
+fn test_shadowed_binding_used_only_inside_is_reported() {
+    let source = "(let ((x 1))\n  (let ((x 2))\n    x))";
+    assert_eq!(reported(source), vec![warning("Unused let binding 'x'", 1, 8)]);
+    // A parameter shadowed by a let, and a let binding shadowed by a later one in the same let
+    assert_eq!(reported("(defun f (n) (let ((n 0)) n))"), vec![warning("Unused parameter 'n'", 1, 11)]);
+    assert_eq!(reported("(let ((n 1) (n 2)) n)"), vec![warning("Unused let binding 'n'", 1, 8)]);
+    // Used before it is shadowed, so nothing to report
+    assert_eq!(reported("(let ((x 1)) (let ((x (+ x 1))) x))"), vec![]);
+}
+
+#[test]
+fn test_unused_pattern_variables() {
+    // Struct names in patterns are not variables
+    let source = "(defstruct rect w h)\n(defstruct square s)\n(defun area\n  (((rect w h)) w)\n  (((square s)) (* s s)))";
+    assert_eq!(reported(source), vec![warning("Unused pattern variable 'h'", 4, 13)]);
+    let source = "(match (list 1 2 3)\n  ((a . rest) a)\n  (_ 0))";
+    assert_eq!(reported(source), vec![warning("Unused pattern variable 'rest'", 2, 9)]);
+    // A variable the guard reads is used
+    assert_eq!(reported("(defun sign\n  ((n) when (< n 0) -1)\n  ((_) 1))"), vec![]);
+    assert_eq!(reported("(let (((a b) (list 1 2))) a)"), vec![warning("Unused let binding 'b'", 1, 11)]);
+}
+
+#[test]
+fn test_uses_in_closures_and_quasiquotes_count() {
+    assert_eq!(reported("(defun adder (n) (lambda (x) (+ x n)))"), vec![]);
+    assert_eq!(reported("(defun wrap (x) `(value ,x))"), vec![]);
+    // A quoted symbol is not a use
+    assert_eq!(reported("(defun name-of (x) 'x)"), vec![warning("Unused parameter 'x'", 1, 17)]);
+    assert_eq!(reported("(defun counter (n) (set! n 0))"), vec![]);
+}
+
+#[test]
+fn test_loop_variables_are_not_reported() {
+    assert_eq!(reported("(dotimes (i 3) (print \"hi\"))"), vec![]);
+    assert_eq!(reported("(handler-case (car 1) (catch (e) 0))"), vec![]);
+    // They still shadow outer bindings
+    assert_eq!(reported("(let ((i 1)) (dotimes (i 3) (print i)))"), vec![warning("Unused let binding 'i'", 1, 8)]);
+}
+
+#[test]
+fn test_warnings_are_in_source_order() {
+    let source = "(defun f (a)\n  (let ((b 1))\n    (let ((c 2)) 0)))";
+    let messages: Vec<String> = warnings(source).into_iter().map(|warning| warning.message).collect();
+    assert_eq!(messages, vec!["Unused parameter 'a'", "Unused let binding 'b'", "Unused let binding 'c'"]);
+}
+
+// ============================================================================
+// Reporting
+// ============================================================================
+
+#[test]
+fn test_warnings_do_not_stop_the_program() {
+    let source = "(defun first-of (a b) a)\n(first-of 1 2)";
+    let exprs = Parser::new(source).parse_all().unwrap();
+    let mut compiler = Compiler::new();
+    let (functions, main) = compiler.compile_program(&exprs).unwrap();
+    assert_eq!(compiler.warnings().len(), 1);
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().unwrap();
+    assert_eq!(vm.value_stack.last(), Some(&Value::Integer(1)));
+}
+
+#[test]
+fn test_each_program_has_its_own_warnings() {
+    let mut compiler = Compiler::new();
+    compiler.compile_program(&Parser::new("(let ((x 1)) 2)").parse_all().unwrap()).unwrap();
+    assert_eq!(compiler.warnings().len(), 1);
+    compiler.compile_program(&Parser::new("(let ((x 1)) x)").parse_all().unwrap()).unwrap();
+    assert_eq!(compiler.warnings(), &[]);
+}
+
+#[test]
+fn test_warning_box_underlines_the_name() {
+    let source = "(defun greet (name greeting)\n  (string-append \"hi \" name))";
+    let output = warnings(source)[0].format(Some(source));
+    assert!(output.starts_with("\n╭─ Warning ───"), "got:\n{}", output);
+    assert!(output.contains("│ lint.lisp:1:20\n"), "got:\n{}", output);
+    assert!(output.contains("│ Unused parameter 'greeting'\n"), "got:\n{}", output);
+    assert!(output.contains("│    1 │ (defun greet (name greeting)\n│      │                    ^^^^^^^^\n"), "got:\n{}", output);
+}
@@ -0,0 +1,71 @@
+use lisp_bytecode_vm::{Compiler, VM, parser::Parser, repl::Repl, List, Value};
+use std::fs;
+
+fn run(source: &str) -> Result<Value, String> {
+    let exprs = Parser::new(source).parse_all()?;
+    let (functions, main) = Compiler::new().compile_program(&exprs).map_err(|e| e.message)?;
+    let mut vm = VM::new();
+    vm.functions.extend(functions);
+    vm.current_bytecode = main.into();
+    vm.run().map_err(|e| e.message)?;
+    Ok(vm.value_stack.last().cloned().unwrap_or(Value::List(List::Nil)))
+}
+
+/// What `body` writes to the output port `out`
+fn output(test: &str, body: &str) -> String {
+    let path = std::env::temp_dir().join(format!("lisp-write-tests-{}-{}.txt", test, std::process::id()));
+    let source = format!("(define out (open-output-file {:?})) {} (close-port out)", path.to_string_lossy(), body);
+    run(&source).unwrap();
+    let text = fs::read_to_string(&path).unwrap();
+    let _ = fs::remove_file(&path);
+    text
+}
+
+const NESTED: &str = r#"(list 1 (list "say \"hi\"\n" #\a) 'sym #\space (list 2.5 "back\\slash" #t))"#;
+
+#[test]
+fn test_write_is_machine_readable() {
+    assert_eq!(output("write", &format!("(write {} out)", NESTED)),
+        r#"(1 ("say \"hi\"\n" #\a) sym #\space (2.5 "back\\slash" true))"#);
+    assert_eq!(output("write-atoms", r#"(write "tab\t" out) (write #\x out) (write 'x out) (write :key out)"#),
+        r##""tab\t"#\xx:key"##);
+}
+
+#[test]
+fn test_display_is_for_people() {
+    assert_eq!(output("display", &format!("(display {} out)", NESTED)),
+        "(1 (say \"hi\"\n a) sym   (2.5 back\\slash true))");
+    assert_eq!(output("display-atoms", r#"(display "text" out) (display #\c out) (newline out) (display 'x out)"#),
+        "textc\nx");
+}
+
+#[test]
+fn test_print_displays_then_ends_the_line() {
+    assert_eq!(output("print", r#"(print "plain" out) (print (list "a" #\b) out)"#), "plain\n(a b)\n");
+    // Like print, write and display return their argument
+    assert_eq!(run("(list (write 1) (display \"x\") (print 'y))").unwrap(),
+        Value::List(List::from_vec(vec![Value::Integer(1), Value::string("x"), Value::symbol("y")])));
+}
+
+#[test]
+fn test_write_output_reads_back_as_an_equal_value() {
+    let original = run(NESTED).unwrap();
+    let written = output("round-trip", &format!("(write {} out)", NESTED));
+    let exprs = Parser::new(&written).parse_all().unwrap();
+    assert_eq!(exprs.len(), 1, "written: {}", written);
+    assert_eq!(run(&format!("'{}", written)).unwrap(), original);
+
+    // Every readable atom survives the trip, control characters included
+    for atom in [r#""""#, r#""\\\"""#, "#\\newline", "#\\x1b", "-7", "0.1", "+inf.0", "false", "'()", ":k"] {
+        let value = run(atom).unwrap();
+        let written = output("atoms", &format!("(write {} out)", atom));
+        assert_eq!(run(&format!("'{}", written)).unwrap(), value, "{} was written as {}", atom, written);
+    }
+}
+
+#[test]
+fn test_repl_echoes_values_as_write_does() {
+    let mut repl = Repl::new();
+    let value = repl.eval_input(r#"(list "line\nbreak" #\a)"#).unwrap().unwrap();
+    assert_eq!(repl.format_value(&value), r#"("line\nbreak" #\a)"#);
+}